@@ -0,0 +1,192 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/tls"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "strconv"
+    "time"
+    "ipset-api-server/internal/models"
+)
+
+// requestTimeout - ожидание ответа на обычный запрос к серверу
+const requestTimeout = 30 * time.Second
+
+// apiClient - клиент API сервера. Входит по ключу API, как ipset-cli login,
+// и входит заново, когда токен истекает.
+type apiClient struct {
+    baseURL string
+    apiKey  string
+    token   string
+    http    *http.Client
+}
+
+// apiError - ответ сервера с кодом ошибки
+type apiError struct {
+    Status  int
+    Message string
+}
+
+func (e *apiError) Error() string {
+    return fmt.Sprintf("API error (%d): %s", e.Status, e.Message)
+}
+
+func newAPIClient(cfg *agentConfig) *apiClient {
+    client := &http.Client{}
+    if cfg.Insecure {
+        client.Transport = &http.Transport{
+            TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+        }
+    }
+    return &apiClient{
+        baseURL: cfg.APIURL,
+        apiKey:  cfg.APIKey,
+        token:   cfg.Token,
+        http:    client,
+    }
+}
+
+func (c *apiClient) login(ctx context.Context) error {
+    var resp models.LoginResponse
+    if _, err := c.send(ctx, http.MethodPost, "/login", &models.LoginRequest{APIKey: c.apiKey}, &resp, requestTimeout); err != nil {
+        return fmt.Errorf("login failed: %v", err)
+    }
+    c.token = resp.Token
+    return nil
+}
+
+// request выполняет запрос и разбирает JSON ответа в result. Без токена и
+// при ответе 401 клиент с ключом API входит заново и повторяет запрос.
+func (c *apiClient) request(ctx context.Context, method, path string, body, result interface{}, timeout time.Duration) (http.Header, error) {
+    if c.token == "" && c.apiKey != "" {
+        if err := c.login(ctx); err != nil {
+            return nil, err
+        }
+    }
+
+    header, err := c.send(ctx, method, path, body, result, timeout)
+    if apiErr, ok := err.(*apiError); ok && apiErr.Status == http.StatusUnauthorized && c.apiKey != "" {
+        if err := c.login(ctx); err != nil {
+            return nil, err
+        }
+        header, err = c.send(ctx, method, path, body, result, timeout)
+    }
+    return header, err
+}
+
+func (c *apiClient) send(ctx context.Context, method, path string, body, result interface{}, timeout time.Duration) (http.Header, error) {
+    ctx, cancel := context.WithTimeout(ctx, timeout)
+    defer cancel()
+
+    var reader io.Reader
+    if body != nil {
+        data, err := json.Marshal(body)
+        if err != nil {
+            return nil, err
+        }
+        reader = bytes.NewReader(data)
+    }
+
+    req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+    if err != nil {
+        return nil, err
+    }
+    if body != nil {
+        req.Header.Set("Content-Type", "application/json")
+    }
+    if c.token != "" {
+        req.Header.Set("Authorization", "Bearer "+c.token)
+    }
+
+    resp, err := c.http.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    data, err := io.ReadAll(resp.Body)
+    if err != nil {
+        return nil, err
+    }
+    if resp.StatusCode >= 400 {
+        var errResp models.ErrorResponse
+        if json.Unmarshal(data, &errResp) != nil || errResp.Error == "" {
+            errResp.Error = string(bytes.TrimSpace(data))
+        }
+        return nil, &apiError{Status: resp.StatusCode, Message: errResp.Error}
+    }
+
+    if result != nil {
+        if err := json.Unmarshal(data, result); err != nil {
+            return nil, fmt.Errorf("failed to parse response of %s: %v", path, err)
+        }
+    }
+    return resp.Header, nil
+}
+
+func (c *apiClient) getSet(ctx context.Context, name string) (*models.IPSetSet, error) {
+    var set models.IPSetSet
+    if _, err := c.request(ctx, http.MethodGet, "/sets/"+url.PathEscape(name), nil, &set, requestTimeout); err != nil {
+        return nil, err
+    }
+    return &set, nil
+}
+
+// exportRecords возвращает действующие записи сета и номер изменения, с
+// которым они получены (заголовок X-Revision)
+func (c *apiClient) exportRecords(ctx context.Context, name string) ([]*models.IPSetRecord, int64, error) {
+    var records []*models.IPSetRecord
+    header, err := c.request(ctx, http.MethodGet, "/sets/"+url.PathEscape(name)+"/export?format=json", nil, &records, requestTimeout)
+    if err != nil {
+        return nil, 0, err
+    }
+
+    revision, err := strconv.ParseInt(header.Get("X-Revision"), 10, 64)
+    if err != nil {
+        return nil, 0, fmt.Errorf("export of set %s has no X-Revision header", name)
+    }
+    return records, revision, nil
+}
+
+// watch ждет изменений после since (since < 0 - только новых) не дольше
+// timeout
+func (c *apiClient) watch(ctx context.Context, since int64, timeout time.Duration) (*models.WatchResult, error) {
+    params := url.Values{}
+    if since >= 0 {
+        params.Set("since", strconv.FormatInt(since, 10))
+    }
+    seconds := int(timeout / time.Second)
+    if seconds < 1 {
+        seconds = 1
+    }
+    params.Set("timeout", strconv.Itoa(seconds))
+
+    var result models.WatchResult
+    if _, err := c.request(ctx, http.MethodGet, "/watch?"+params.Encode(), nil, &result, timeout+requestTimeout); err != nil {
+        return nil, err
+    }
+    return &result, nil
+}
+
+// register регистрирует агента; в ответе - назначенные ему сеты
+func (c *apiClient) register(ctx context.Context, registration *models.AgentRegistration) (*models.AgentStatus, error) {
+    var status models.AgentStatus
+    if _, err := c.request(ctx, http.MethodPost, "/agents/register", registration, &status, requestTimeout); err != nil {
+        return nil, err
+    }
+    return &status, nil
+}
+
+// heartbeat отправляет состояние сетов агента
+func (c *apiClient) heartbeat(ctx context.Context, hostname string, heartbeat *models.AgentHeartbeat) (*models.AgentStatus, error) {
+    var status models.AgentStatus
+    if _, err := c.request(ctx, http.MethodPost, "/agents/"+url.PathEscape(hostname)+"/heartbeat", heartbeat, &status, requestTimeout); err != nil {
+        return nil, err
+    }
+    return &status, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/joho/godotenv"
+)
+
+// agentConfig - настройки агента. Флаг, не заданный в командной строке,
+// берется из переменной окружения (или env-файла -env), иначе - значение
+// по умолчанию.
+type agentConfig struct {
+    APIURL    string
+    APIKey    string
+    Token     string
+    Insecure  bool
+    Sets      []string
+    Labels    map[string]string
+    IPSetPath string
+    Interval  time.Duration
+    Heartbeat time.Duration
+    Hostname  string
+    Once      bool
+    DryRun    bool
+    Drift     bool
+    JSON      bool
+}
+
+// agentFlag - флаг агента и переменная окружения с его значением
+type agentFlag struct {
+    name    string
+    env     string
+    value   string
+    usage   string
+    boolean bool
+}
+
+var agentFlags = []agentFlag{
+    {name: "api-url", env: "AGENT_API_URL", value: "http://localhost:8080", usage: "API server URL"},
+    {name: "api-key", env: "AGENT_API_KEY", usage: "API key to log in with (the token is renewed when it expires)"},
+    {name: "token", env: "AGENT_TOKEN", usage: "JWT token from 'ipset-cli login', used without -api-key"},
+    {name: "insecure", env: "AGENT_INSECURE", value: "false", usage: "Skip TLS verification", boolean: true},
+    {name: "sets", env: "AGENT_SETS", usage: "Comma separated sets to apply in addition to the sets assigned by labels"},
+    {name: "labels", env: "AGENT_LABELS", usage: "Comma separated host labels key=value, sets are assigned to the host by them"},
+    {name: "ipset", env: "AGENT_IPSET_PATH", value: "ipset", usage: "Path to the ipset binary"},
+    {name: "interval", env: "AGENT_INTERVAL", value: "5m", usage: "Interval between full syncs of all sets"},
+    {name: "heartbeat", env: "AGENT_HEARTBEAT", value: "1m", usage: "Interval between heartbeats with the applied revisions to the server"},
+    {name: "hostname", env: "AGENT_HOSTNAME", usage: "Host name in reports (default: system host name)"},
+    {name: "once", value: "false", usage: "Apply the sets once and exit, non-zero if any set failed", boolean: true},
+    {name: "dry-run", value: "false", usage: "Print the ipset restore batches instead of applying them, then exit", boolean: true},
+    {name: "drift", value: "false", usage: "Compare the sets in the kernel with the server and exit, 1 on drift", boolean: true},
+    {name: "json", value: "false", usage: "Print the -drift report as JSON", boolean: true},
+}
+
+func loadConfig(args []string) (*agentConfig, error) {
+    fs := flag.NewFlagSet("ipset-agent", flag.ExitOnError)
+    envFile := fs.String("env", "", "Env file with agent settings (default: process environment)")
+    for _, f := range agentFlags {
+        usage := f.usage
+        if f.env != "" {
+            usage += " [" + f.env + "]"
+        }
+        if f.boolean {
+            fs.Bool(f.name, false, usage)
+        } else {
+            fs.String(f.name, f.value, usage)
+        }
+    }
+    fs.Parse(args)
+
+    if *envFile != "" {
+        if err := godotenv.Load(*envFile); err != nil {
+            return nil, fmt.Errorf("failed to read %s: %v", *envFile, err)
+        }
+    }
+
+    set := make(map[string]bool)
+    fs.Visit(func(f *flag.Flag) {
+        set[f.Name] = true
+    })
+    values := make(map[string]string)
+    for _, f := range agentFlags {
+        value := fs.Lookup(f.name).Value.String()
+        if env := os.Getenv(f.env); !set[f.name] && f.env != "" && env != "" {
+            value = env
+        }
+        values[f.name] = value
+    }
+
+    cfg := &agentConfig{
+        APIURL:    strings.TrimRight(values["api-url"], "/"),
+        APIKey:    values["api-key"],
+        Token:     values["token"],
+        IPSetPath: values["ipset"],
+        Hostname:  values["hostname"],
+    }
+    for _, name := range strings.Split(values["sets"], ",") {
+        if name = strings.TrimSpace(name); name != "" {
+            cfg.Sets = append(cfg.Sets, name)
+        }
+    }
+    cfg.Labels = make(map[string]string)
+    for _, pair := range strings.Split(values["labels"], ",") {
+        if pair = strings.TrimSpace(pair); pair == "" {
+            continue
+        }
+        key, value, ok := strings.Cut(pair, "=")
+        if !ok || strings.TrimSpace(key) == "" {
+            return nil, fmt.Errorf("invalid label %q, expected key=value", pair)
+        }
+        cfg.Labels[strings.TrimSpace(key)] = strings.TrimSpace(value)
+    }
+    if cfg.APIKey == "" && cfg.Token == "" {
+        return nil, fmt.Errorf("no credentials, use -api-key (AGENT_API_KEY) or -token (AGENT_TOKEN)")
+    }
+
+    var err error
+    for name, value := range map[string]*bool{
+        "insecure": &cfg.Insecure,
+        "once":     &cfg.Once,
+        "dry-run":  &cfg.DryRun,
+        "drift":    &cfg.Drift,
+        "json":     &cfg.JSON,
+    } {
+        if *value, err = strconv.ParseBool(values[name]); err != nil {
+            return nil, fmt.Errorf("invalid %s: %s", name, values[name])
+        }
+    }
+    if cfg.Interval, err = time.ParseDuration(values["interval"]); err != nil || cfg.Interval <= 0 {
+        return nil, fmt.Errorf("invalid interval: %s", values["interval"])
+    }
+    if cfg.Heartbeat, err = time.ParseDuration(values["heartbeat"]); err != nil || cfg.Heartbeat <= 0 {
+        return nil, fmt.Errorf("invalid heartbeat: %s", values["heartbeat"])
+    }
+    if cfg.Hostname == "" {
+        if cfg.Hostname, err = os.Hostname(); err != nil {
+            return nil, fmt.Errorf("failed to get host name: %v", err)
+        }
+    }
+    return cfg, nil
+}
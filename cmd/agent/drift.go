@@ -0,0 +1,75 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "os"
+    "ipset-api-server/internal/models"
+    "ipset-api-server/pkg/drift"
+    "ipset-api-server/pkg/validation"
+)
+
+// checkDrift сравнивает сеты в ядре с сервером и печатает отчет (-json - в
+// JSON). Возвращает true, если хоть один сет отличается.
+func (a *agent) checkDrift(ctx context.Context) (bool, error) {
+    var reports []*drift.Report
+    for _, name := range a.sets() {
+        report, err := a.compare(ctx, name)
+        if err != nil {
+            return false, fmt.Errorf("set %s: %v", name, err)
+        }
+        reports = append(reports, report)
+    }
+
+    drifted := false
+    for _, report := range reports {
+        if report.Drifted() {
+            drifted = true
+        }
+        if !a.cfg.JSON {
+            drift.Print(os.Stdout, report)
+        }
+    }
+    if a.cfg.JSON {
+        data, err := json.MarshalIndent(reports, "", "  ")
+        if err != nil {
+            return false, err
+        }
+        fmt.Println(string(data))
+    }
+    return drifted, nil
+}
+
+// compare сравнивает сет в ядре с сетом сервера
+func (a *agent) compare(ctx context.Context, name string) (*drift.Report, error) {
+    set, err := a.client.getSet(ctx, name)
+    if err != nil {
+        return nil, err
+    }
+    records, _, err := a.client.exportRecords(ctx, name)
+    if err != nil {
+        return nil, err
+    }
+
+    kernel, err := a.ipset.save(ctx, name)
+    if err != nil {
+        return nil, err
+    }
+    return drift.Compare(serverSet(set, records), kernel), nil
+}
+
+// serverSet - сет сервера в синтаксисе ipset
+func serverSet(set *models.IPSetSet, records []*models.IPSetRecord) *drift.Set {
+    entries := make([]validation.Entry, len(records))
+    for i, record := range records {
+        entries[i] = validation.Entry{
+            IP:       record.IP,
+            CIDR:     record.CIDR,
+            Port:     record.Port,
+            Protocol: record.Protocol,
+            SecondIP: record.SecondIP,
+        }
+    }
+    return drift.ServerSet(set.Name, set.Type, set.Options, entries)
+}
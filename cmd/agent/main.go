@@ -0,0 +1,374 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "os/signal"
+    "syscall"
+    "time"
+    "ipset-api-server/internal/models"
+    "ipset-api-server/pkg/drift"
+)
+
+const (
+    // maxWatchTimeout - наибольшее ожидание изменений за один запрос GET /watch
+    maxWatchTimeout = 5 * time.Minute
+    // retryDelay - пауза после ошибки запроса GET /watch
+    retryDelay = 10 * time.Second
+    // failedSyncDelay - через сколько повторить синхронизацию, в которой не
+    // все сеты применены (если Interval не меньше)
+    failedSyncDelay = time.Minute
+)
+
+// agent применяет сеты сервера к ядру хоста: при запуске и раз в Interval
+// все сеты, а между ними - сеты, которые изменились по GET /watch. Сеты
+// агента - заданные флагом -sets и назначенные ему сервером по меткам.
+type agent struct {
+    cfg    *agentConfig
+    client *apiClient
+    ipset  ipsetRunner
+
+    // recordSets - в каком из примененных сетов запись: изменение записи
+    // приходит с новым сетом, а меняется и тот, из которого она ушла
+    recordSets map[int]string
+    // assigned - сеты, назначенные агенту сервером
+    assigned []string
+    // applied - последний результат применения каждого сета, отправляется
+    // в heartbeat. Если сет не применился, в нем остается прошлая ревизия.
+    applied map[string]*models.AgentSetResult
+    // lastError - ошибка агента, не относящаяся к сету (GET /watch)
+    lastError string
+    // nextHeartbeat - время следующего heartbeat
+    nextHeartbeat time.Time
+}
+
+func main() {
+    cfg, err := loadConfig(os.Args[1:])
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+        os.Exit(2)
+    }
+
+    a := &agent{
+        cfg:        cfg,
+        client:     newAPIClient(cfg),
+        ipset:      ipsetRunner{path: cfg.IPSetPath},
+        recordSets: make(map[int]string),
+        applied:    make(map[string]*models.AgentSetResult),
+    }
+
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+
+    // Проверка и пробный запуск с явным списком сетов не регистрируют хост
+    if len(cfg.Sets) == 0 || !(cfg.Drift || cfg.DryRun) {
+        if err := a.register(ctx); err != nil {
+            if len(cfg.Sets) == 0 {
+                fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+                os.Exit(2)
+            }
+            log.Printf("%v", err)
+        }
+    }
+
+    if cfg.Drift {
+        drifted, err := a.checkDrift(ctx)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+            os.Exit(2)
+        }
+        if drifted {
+            os.Exit(1)
+        }
+        return
+    }
+    if cfg.Once || cfg.DryRun {
+        if _, ok := a.sync(ctx, a.sets()); !ok {
+            os.Exit(1)
+        }
+        return
+    }
+    a.run(ctx)
+}
+
+// run применяет все сеты, затем ждет изменений и применяет изменившиеся
+// сеты до остановки агента
+func (a *agent) run(ctx context.Context) {
+    log.Printf("ipset-agent on %s: applying sets %v from %s", a.cfg.Hostname, a.sets(), a.cfg.APIURL)
+
+    since, ok := a.sync(ctx, a.sets())
+    next := a.nextSync(ok)
+    for ctx.Err() == nil {
+        wait := time.Until(next)
+        if wait <= 0 {
+            revision, ok := a.sync(ctx, a.sets())
+            if since < 0 {
+                since = revision
+            }
+            next = a.nextSync(ok)
+            continue
+        }
+        if time.Until(a.nextHeartbeat) <= 0 {
+            if added := a.heartbeat(ctx); len(added) > 0 {
+                a.sync(ctx, added)
+            }
+            continue
+        }
+        if heartbeat := time.Until(a.nextHeartbeat); heartbeat < wait {
+            wait = heartbeat
+        }
+        if wait > maxWatchTimeout {
+            wait = maxWatchTimeout
+        }
+
+        result, err := a.client.watch(ctx, since, wait)
+        if apiErr, ok := err.(*apiError); ok && apiErr.Status == http.StatusGone {
+            // Изменения после since уже удалены на сервере: сеты читаются
+            // заново целиком, ожидание продолжается с номера этого чтения
+            log.Printf("watch: %v, resyncing all sets", err)
+            since, next = -1, time.Now()
+            continue
+        }
+        if err != nil {
+            if ctx.Err() == nil {
+                log.Printf("watch failed: %v", err)
+                a.lastError = "watch failed: " + err.Error()
+                sleep(ctx, retryDelay)
+            }
+            continue
+        }
+        a.lastError = ""
+        since = result.Revision
+
+        if changed := a.changedSets(result.Changes); len(changed) > 0 {
+            a.sync(ctx, changed)
+        }
+    }
+}
+
+// nextSync - время следующей синхронизации всех сетов
+func (a *agent) nextSync(ok bool) time.Time {
+    if !ok && failedSyncDelay < a.cfg.Interval {
+        return time.Now().Add(failedSyncDelay)
+    }
+    return time.Now().Add(a.cfg.Interval)
+}
+
+// changedSets - применяемые агентом сеты, которых касаются изменения
+func (a *agent) changedSets(changes []*models.ChangeEvent) []string {
+    touched := make(map[string]bool)
+    for _, change := range changes {
+        touched[change.SetName] = true
+        if change.RecordID != 0 && a.recordSets[change.RecordID] != "" {
+            touched[a.recordSets[change.RecordID]] = true
+        }
+    }
+
+    var sets []string
+    for _, name := range a.sets() {
+        if touched[name] {
+            sets = append(sets, name)
+        }
+    }
+    return sets
+}
+
+// sets - сеты агента: заданные флагом -sets и назначенные сервером
+func (a *agent) sets() []string {
+    sets := append([]string{}, a.cfg.Sets...)
+    for _, name := range a.assigned {
+        if !containsString(sets, name) {
+            sets = append(sets, name)
+        }
+    }
+    return sets
+}
+
+// sync применяет сеты и отправляет heartbeat серверу; сеты, которые сервер
+// назначил агенту с прошлого heartbeat, применяются следом. Возвращает
+// наименьший номер изменения, с которым получены сеты (-1, если ни один не
+// получен), и false, если хоть один сет не применен.
+func (a *agent) sync(ctx context.Context, sets []string) (int64, bool) {
+    since := int64(-1)
+    ok := true
+    for _, name := range sets {
+        result := a.apply(ctx, name)
+        a.record(result)
+
+        if result.Error != "" {
+            ok = false
+            log.Printf("set %s: %s", name, result.Error)
+            continue
+        }
+        if since < 0 || result.Revision < since {
+            since = result.Revision
+        }
+        if !a.cfg.DryRun {
+            log.Printf("set %s: applied %d entries (revision %d)", name, result.Entries, result.Revision)
+        }
+    }
+
+    if a.cfg.DryRun || a.cfg.Drift {
+        return since, ok
+    }
+    if added := a.heartbeat(ctx); len(added) > 0 {
+        revision, addedOK := a.sync(ctx, added)
+        if revision >= 0 && (since < 0 || revision < since) {
+            since = revision
+        }
+        ok = ok && addedOK
+    }
+    return since, ok
+}
+
+// record запоминает результат применения сета для heartbeat. Если сет не
+// применился, в ядре остается прошлое содержимое, поэтому ревизия и
+// контрольная сумма остаются прежними.
+func (a *agent) record(result *models.AgentSetResult) {
+    if result.Error != "" {
+        failed := &models.AgentSetResult{SetName: result.SetName}
+        if previous := a.applied[result.SetName]; previous != nil {
+            *failed = *previous
+        }
+        failed.Error = result.Error
+        result = failed
+    }
+    a.applied[result.SetName] = result
+}
+
+// register регистрирует агента с его метками и запоминает назначенные сеты
+func (a *agent) register(ctx context.Context) error {
+    status, err := a.client.register(ctx, &models.AgentRegistration{
+        Hostname: a.cfg.Hostname,
+        Labels:   a.cfg.Labels,
+    })
+    if err != nil {
+        return fmt.Errorf("failed to register agent: %v", err)
+    }
+    a.assigned = status.AssignedSets
+
+    // Состояние сетов с прошлого запуска: если сет сейчас не применится,
+    // в ядре останется примененная тогда ревизия
+    for _, set := range status.Sets {
+        if set.Status != models.AgentSetMissing && a.applied[set.SetName] == nil {
+            result := set.AgentSetResult
+            a.applied[set.SetName] = &result
+        }
+    }
+    return nil
+}
+
+// heartbeat отправляет серверу состояние сетов агента. Возвращает сеты,
+// которые сервер назначил агенту с прошлого раза; сеты, с которых
+// назначение снято, агент больше не обновляет, но и не удаляет из ядра.
+func (a *agent) heartbeat(ctx context.Context) []string {
+    a.nextHeartbeat = time.Now().Add(a.cfg.Heartbeat)
+
+    heartbeat := &models.AgentHeartbeat{Error: a.lastError}
+    for _, name := range a.sets() {
+        if result := a.applied[name]; result != nil {
+            heartbeat.Sets = append(heartbeat.Sets, result)
+        }
+    }
+
+    status, err := a.client.heartbeat(ctx, a.cfg.Hostname, heartbeat)
+    if apiErr, ok := err.(*apiError); ok && apiErr.Status == http.StatusNotFound {
+        // Агента удалили из реестра - регистрируемся заново
+        if err = a.register(ctx); err == nil {
+            status, err = a.client.heartbeat(ctx, a.cfg.Hostname, heartbeat)
+        }
+    }
+    if err != nil {
+        log.Printf("failed to send heartbeat: %v", err)
+        return nil
+    }
+
+    previous := a.sets()
+    a.assigned = status.AssignedSets
+    var added []string
+    for _, name := range a.sets() {
+        if !containsString(previous, name) {
+            added = append(added, name)
+        }
+    }
+    if len(added) > 0 {
+        log.Printf("sets assigned by the server: %v", added)
+    }
+    return added
+}
+
+// apply получает сет с сервера и заменяет им сет в ядре
+func (a *agent) apply(ctx context.Context, name string) *models.AgentSetResult {
+    result := &models.AgentSetResult{SetName: name}
+
+    set, err := a.client.getSet(ctx, name)
+    if err != nil {
+        result.Error = err.Error()
+        return result
+    }
+    records, revision, err := a.client.exportRecords(ctx, name)
+    if err != nil {
+        result.Error = err.Error()
+        return result
+    }
+    result.Revision = revision
+    result.Digest = drift.Digest(serverSet(set, records))
+
+    var kernel *kernelHeader
+    if !a.cfg.DryRun {
+        if kernel, err = a.ipset.header(ctx, name); err != nil {
+            result.Error = err.Error()
+            return result
+        }
+    }
+    batch, entries, err := restoreBatch(set, records, kernel, time.Now())
+    result.Entries = entries
+    if err != nil {
+        result.Error = err.Error()
+        return result
+    }
+
+    if a.cfg.DryRun {
+        log.Printf("set %s: %d entries (revision %d)", name, entries, revision)
+        fmt.Print(batch)
+        return result
+    }
+    if err := a.ipset.restore(ctx, name, batch); err != nil {
+        result.Error = err.Error()
+        return result
+    }
+    now := time.Now().UTC()
+    result.AppliedAt = &now
+
+    for id, setName := range a.recordSets {
+        if setName == name {
+            delete(a.recordSets, id)
+        }
+    }
+    for _, record := range records {
+        a.recordSets[record.ID] = name
+    }
+    return result
+}
+
+func containsString(values []string, value string) bool {
+    for _, v := range values {
+        if v == value {
+            return true
+        }
+    }
+    return false
+}
+
+// sleep ждет d или остановки агента
+func sleep(ctx context.Context, d time.Duration) {
+    timer := time.NewTimer(d)
+    defer timer.Stop()
+    select {
+    case <-ctx.Done():
+    case <-timer.C:
+    }
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "hash/crc32"
+    "os/exec"
+    "strconv"
+    "strings"
+    "time"
+    "ipset-api-server/internal/models"
+    "ipset-api-server/pkg/drift"
+    "ipset-api-server/pkg/validation"
+)
+
+// tmpSetName - имя временного сета, в котором собирается новое содержимое
+// сета. Имя сета в ipset - не длиннее 31 символа, поэтому вместо суффикса
+// к имени берется его контрольная сумма.
+func tmpSetName(name string) string {
+    return fmt.Sprintf("ipset-agent-%08x", crc32.ChecksumIEEE([]byte(name)))
+}
+
+// kernelHeader - заголовок сета в ядре (ipset list -t)
+type kernelHeader struct {
+    Type   string
+    Family string
+    // References - число ссылок на сет (правила iptables, сеты list:set)
+    References int
+}
+
+// restoreBatch собирает команды ipset restore, которые заменяют содержимое
+// сета за один шаг: новое содержимое создается во временном сете, затем
+// временный сет меняется местами с действующим (swap) и удаляется. Если
+// сета в ядре еще нет (kernel = nil), временный сет переименовывается.
+// swap возможен только между сетами одного типа и семейства: если они
+// изменились на сервере, старый сет удаляется и временный переименовывается
+// на его место, а если на старый сет ссылаются правила (удалить его нельзя),
+// возвращается ошибка. Возвращает число элементов в сете.
+func restoreBatch(set *models.IPSetSet, records []*models.IPSetRecord, kernel *kernelHeader, now time.Time) (string, int, error) {
+    tmp := tmpSetName(set.Name)
+
+    ips := make([]string, len(records))
+    for i, record := range records {
+        ips[i] = record.IP
+    }
+    family := validation.ExportFamily(set.Options, ips)
+    withTimeout := validation.HasTimeout(set.Options)
+
+    // У некоторых типов (hash:mac, list:set) семейства нет
+    recreate := kernel != nil && (kernel.Type != set.Type || kernel.Family != "" && kernel.Family != family)
+    if recreate && kernel.References > 0 {
+        return "", 0, fmt.Errorf("set %s is %s (family %s) in the kernel and %s (family %s) on the server: "+
+            "it cannot be swapped and is referenced %d times, remove the references to recreate it",
+            set.Name, kernel.Type, kernel.Family, set.Type, family, kernel.References)
+    }
+
+    var sb strings.Builder
+    sb.WriteString(strings.TrimSpace(fmt.Sprintf("create %s %s %s", tmp, set.Type, validation.WithFamily(set.Options, family))) + "\n")
+
+    entries := 0
+    for _, record := range records {
+        // Запись другого семейства ipset не примет, как и при экспорте
+        if f := validation.AddrFamily(record.IP); f != "" && f != family {
+            continue
+        }
+        entry := validation.FormatEntry(family, validation.Entry{
+            IP:       record.IP,
+            CIDR:     record.CIDR,
+            Port:     record.Port,
+            Protocol: record.Protocol,
+            SecondIP: record.SecondIP,
+        })
+        if withTimeout {
+            entry += fmt.Sprintf(" timeout %d", validation.EntryTimeout(record.ExpiresAt, now))
+        }
+        sb.WriteString(fmt.Sprintf("add %s %s\n", tmp, entry))
+        entries++
+    }
+
+    switch {
+    case recreate:
+        sb.WriteString(fmt.Sprintf("destroy %s\n", set.Name))
+        sb.WriteString(fmt.Sprintf("rename %s %s\n", tmp, set.Name))
+    case kernel != nil:
+        sb.WriteString(fmt.Sprintf("swap %s %s\n", tmp, set.Name))
+        sb.WriteString(fmt.Sprintf("destroy %s\n", tmp))
+    default:
+        sb.WriteString(fmt.Sprintf("rename %s %s\n", tmp, set.Name))
+    }
+    return sb.String(), entries, nil
+}
+
+// ipsetRunner запускает ipset по заданному пути (в проверках его можно
+// заменить скриптом)
+type ipsetRunner struct {
+    path string
+}
+
+func (r ipsetRunner) run(ctx context.Context, stdin string, args ...string) error {
+    _, err := r.output(ctx, stdin, args...)
+    return err
+}
+
+// output запускает ipset и возвращает его вывод; в ошибку входит stderr
+func (r ipsetRunner) output(ctx context.Context, stdin string, args ...string) (string, error) {
+    cmd := exec.CommandContext(ctx, r.path, args...)
+    if stdin != "" {
+        cmd.Stdin = strings.NewReader(stdin)
+    }
+
+    var stdout, stderr bytes.Buffer
+    cmd.Stdout = &stdout
+    cmd.Stderr = &stderr
+    if err := cmd.Run(); err != nil {
+        msg := strings.TrimSpace(stderr.String() + stdout.String())
+        if msg != "" {
+            return "", fmt.Errorf("%s %s: %s", r.path, strings.Join(args, " "), msg)
+        }
+        return "", fmt.Errorf("%s %s: %v", r.path, strings.Join(args, " "), err)
+    }
+    return stdout.String(), nil
+}
+
+// exists - есть ли сет в ядре
+func (r ipsetRunner) exists(ctx context.Context, name string) bool {
+    return r.run(ctx, "", "list", "-name", name) == nil
+}
+
+// header возвращает заголовок сета в ядре; nil - сета в ядре нет
+func (r ipsetRunner) header(ctx context.Context, name string) (*kernelHeader, error) {
+    if !r.exists(ctx, name) {
+        return nil, nil
+    }
+    output, err := r.output(ctx, "", "list", "-t", name)
+    if err != nil {
+        return nil, err
+    }
+    return parseHeader(output), nil
+}
+
+// parseHeader разбирает вывод ipset list -t:
+//
+//    Name: blacklist
+//    Type: hash:net
+//    Header: family inet hashsize 1024 maxelem 65536
+//    References: 1
+func parseHeader(output string) *kernelHeader {
+    header := &kernelHeader{}
+    for _, line := range strings.Split(output, "\n") {
+        key, value, ok := strings.Cut(line, ":")
+        if !ok {
+            continue
+        }
+        value = strings.TrimSpace(value)
+        switch key {
+        case "Type":
+            header.Type = value
+        case "Header":
+            fields := strings.Fields(value)
+            for i := 0; i+1 < len(fields); i++ {
+                if fields[i] == "family" {
+                    header.Family = fields[i+1]
+                }
+            }
+        case "References":
+            header.References, _ = strconv.Atoi(value)
+        }
+    }
+    return header
+}
+
+// save возвращает сет в ядре в виде ipset save; nil - сета в ядре нет
+func (r ipsetRunner) save(ctx context.Context, name string) (*drift.Set, error) {
+    if !r.exists(ctx, name) {
+        return nil, nil
+    }
+    output, err := r.output(ctx, "", "save", name)
+    if err != nil {
+        return nil, err
+    }
+    set := drift.ParseSave(output)[name]
+    if set == nil {
+        return nil, fmt.Errorf("%s save %s: no such set in the output", r.path, name)
+    }
+    return set, nil
+}
+
+// restore применяет пакет restoreBatch. Временный сет, оставшийся от
+// прерванного применения, удаляется до и (при ошибке) после пакета, так
+// что действующий сет либо полностью заменен, либо не изменен.
+func (r ipsetRunner) restore(ctx context.Context, name, batch string) error {
+    tmp := tmpSetName(name)
+    r.run(ctx, "", "destroy", tmp)
+
+    if err := r.run(ctx, batch, "-exist", "restore"); err != nil {
+        r.run(ctx, "", "destroy", tmp)
+        return err
+    }
+    return nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+    "context"
+    "os"
+    "path/filepath"
+    "runtime"
+    "strings"
+    "testing"
+    "time"
+    "ipset-api-server/internal/models"
+)
+
+// fakeIpset - скрипт вместо ipset: записывает аргументы каждого вызова в
+// calls.log, а пакет ipset restore - в stdin.log. Сеты в ядре - файлы в
+// каталоге sets, в файле - тип, семейство и число ссылок на сет. Если есть
+// файл fail, restore завершается с ошибкой.
+const fakeIpset = `#!/bin/sh
+dir=$(dirname "$0")
+echo "$*" >> "$dir/calls.log"
+case "$1" in
+list)
+    if [ ! -f "$dir/sets/$3" ]; then
+        echo "ipset v7.1: The set with the given name does not exist" >&2
+        exit 1
+    fi
+    if [ "$2" = "-t" ]; then
+        read type family references < "$dir/sets/$3"
+        printf 'Name: %s\nType: %s\nRevision: 7\nHeader: family %s hashsize 1024 maxelem 65536\n' "$3" "$type" "$family"
+        printf 'Size in memory: 504\nReferences: %s\nNumber of entries: 0\n' "$references"
+    else
+        echo "$3"
+    fi
+    ;;
+destroy)
+    if [ ! -f "$dir/sets/$2" ]; then
+        echo "ipset v7.1: The set with the given name does not exist" >&2
+        exit 1
+    fi
+    rm -f "$dir/sets/$2"
+    ;;
+-exist)
+    cat >> "$dir/stdin.log"
+    if [ -f "$dir/fail" ]; then
+        echo "ipset v7.1: Error in line 2: Syntax error" >&2
+        exit 1
+    fi
+    ;;
+esac
+`
+
+// newFakeIpset создает скрипт fakeIpset с сетами в ядре и возвращает его
+// каталог. sets - имя сета и строка его файла ("hash:net inet 0").
+func newFakeIpset(t *testing.T, sets map[string]string) (ipsetRunner, string) {
+    t.Helper()
+    if runtime.GOOS == "windows" {
+        t.Skip("the fake ipset is a shell script")
+    }
+    dir := t.TempDir()
+    if err := os.WriteFile(filepath.Join(dir, "ipset"), []byte(fakeIpset), 0755); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.Mkdir(filepath.Join(dir, "sets"), 0755); err != nil {
+        t.Fatal(err)
+    }
+    for name, header := range sets {
+        if err := os.WriteFile(filepath.Join(dir, "sets", name), []byte(header+"\n"), 0644); err != nil {
+            t.Fatal(err)
+        }
+    }
+    return ipsetRunner{path: filepath.Join(dir, "ipset")}, dir
+}
+
+func readLines(t *testing.T, path string) []string {
+    t.Helper()
+    data, err := os.ReadFile(path)
+    if os.IsNotExist(err) {
+        return nil
+    }
+    if err != nil {
+        t.Fatal(err)
+    }
+    return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func checkLines(t *testing.T, what string, got, want []string) {
+    t.Helper()
+    if strings.Join(got, "\n") != strings.Join(want, "\n") {
+        t.Fatalf("%s:\n%s\nwant:\n%s", what, strings.Join(got, "\n"), strings.Join(want, "\n"))
+    }
+}
+
+func testSet() (*models.IPSetSet, []*models.IPSetRecord) {
+    set := &models.IPSetSet{Name: "blacklist", Type: "hash:net"}
+    records := []*models.IPSetRecord{
+        {ID: 100001, SetName: "blacklist", IP: "10.0.0.1"},
+        {ID: 100002, SetName: "blacklist", IP: "10.1.0.0", CIDR: "16"},
+        // Адрес другого семейства сет не примет
+        {ID: 100003, SetName: "blacklist", IP: "2001:db8::1"},
+    }
+    return set, records
+}
+
+func TestRestoreBatch(t *testing.T) {
+    set, records := testSet()
+    tmp := tmpSetName(set.Name)
+    if len(tmp) > 31 {
+        t.Fatalf("temporary set name %q is longer than 31", tmp)
+    }
+
+    batch, entries, err := restoreBatch(set, records, &kernelHeader{Type: "hash:net", Family: "inet"}, time.Now())
+    if err != nil {
+        t.Fatal(err)
+    }
+    if entries != 2 {
+        t.Fatalf("%d entries, want 2", entries)
+    }
+    checkLines(t, "batch for an existing set", strings.Split(strings.TrimSuffix(batch, "\n"), "\n"), []string{
+        "create " + tmp + " hash:net",
+        "add " + tmp + " 10.0.0.1",
+        "add " + tmp + " 10.1.0.0/16",
+        "swap " + tmp + " blacklist",
+        "destroy " + tmp,
+    })
+
+    batch, _, _ = restoreBatch(set, records, nil, time.Now())
+    checkLines(t, "batch for a new set", strings.Split(strings.TrimSuffix(batch, "\n"), "\n"), []string{
+        "create " + tmp + " hash:net",
+        "add " + tmp + " 10.0.0.1",
+        "add " + tmp + " 10.1.0.0/16",
+        "rename " + tmp + " blacklist",
+    })
+
+    // Сет другого типа или семейства не поменять местами с новым: старый
+    // удаляется, новый занимает его место
+    for _, kernel := range []*kernelHeader{
+        {Type: "hash:ip", Family: "inet"},
+        {Type: "hash:net", Family: "inet6"},
+    } {
+        batch, _, err = restoreBatch(set, records, kernel, time.Now())
+        if err != nil {
+            t.Fatal(err)
+        }
+        checkLines(t, "batch for a "+kernel.Type+" "+kernel.Family+" set", strings.Split(strings.TrimSuffix(batch, "\n"), "\n"), []string{
+            "create " + tmp + " hash:net",
+            "add " + tmp + " 10.0.0.1",
+            "add " + tmp + " 10.1.0.0/16",
+            "destroy blacklist",
+            "rename " + tmp + " blacklist",
+        })
+    }
+
+    // Сет, на который ссылаются правила, удалить нельзя
+    _, _, err = restoreBatch(set, records, &kernelHeader{Type: "hash:ip", Family: "inet", References: 2}, time.Now())
+    if err == nil || !strings.Contains(err.Error(), "referenced 2 times") {
+        t.Fatalf("error %v, want a referenced set error", err)
+    }
+}
+
+func TestParseHeader(t *testing.T) {
+    header := parseHeader(`Name: office-nets
+Type: hash:net,iface
+Revision: 7
+Header: family inet6 hashsize 1024 maxelem 65536 timeout 3600
+Size in memory: 1240
+References: 3
+Number of entries: 0
+`)
+    if *header != (kernelHeader{Type: "hash:net,iface", Family: "inet6", References: 3}) {
+        t.Fatalf("header %+v", header)
+    }
+
+    header = parseHeader("Name: macs\nType: hash:mac\nHeader: hashsize 1024 maxelem 65536\nReferences: 0\n")
+    if *header != (kernelHeader{Type: "hash:mac"}) {
+        t.Fatalf("header %+v", header)
+    }
+}
+
+func TestRestoreBatchTimeout(t *testing.T) {
+    now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+    expires := now.Add(90*time.Second + time.Millisecond)
+    set := &models.IPSetSet{Name: "temp", Type: "hash:ip", Options: "timeout 3600"}
+    records := []*models.IPSetRecord{
+        {ID: 1, IP: "10.0.0.1"},
+        {ID: 2, IP: "10.0.0.2", ExpiresAt: &expires},
+    }
+    tmp := tmpSetName(set.Name)
+
+    batch, _, _ := restoreBatch(set, records, nil, now)
+    checkLines(t, "batch", strings.Split(strings.TrimSuffix(batch, "\n"), "\n"), []string{
+        "create " + tmp + " hash:ip timeout 3600",
+        // Бессрочная запись - timeout 0, а не timeout сета
+        "add " + tmp + " 10.0.0.1 timeout 0",
+        "add " + tmp + " 10.0.0.2 timeout 91",
+        "rename " + tmp + " temp",
+    })
+}
+
+func TestRestoreRunsBatch(t *testing.T) {
+    runner, dir := newFakeIpset(t, map[string]string{"blacklist": "hash:net inet 1"})
+    ctx := context.Background()
+    set, records := testSet()
+    tmp := tmpSetName(set.Name)
+
+    if header, err := runner.header(ctx, "whitelist"); header != nil || err != nil {
+        t.Fatalf("header of a missing set: %+v, %v", header, err)
+    }
+    kernel, err := runner.header(ctx, set.Name)
+    if err != nil {
+        t.Fatal(err)
+    }
+    batch, _, err := restoreBatch(set, records, kernel, time.Now())
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := runner.restore(ctx, set.Name, batch); err != nil {
+        t.Fatal(err)
+    }
+
+    // Остаток прерванного применения удаляется до пакета, пакет целиком
+    // уходит в один ipset restore
+    checkLines(t, "calls", readLines(t, filepath.Join(dir, "calls.log")), []string{
+        "list -name whitelist",
+        "list -name blacklist",
+        "list -t blacklist",
+        "destroy " + tmp,
+        "-exist restore",
+    })
+    checkLines(t, "restore input", readLines(t, filepath.Join(dir, "stdin.log")), []string{
+        "create " + tmp + " hash:net",
+        "add " + tmp + " 10.0.0.1",
+        "add " + tmp + " 10.1.0.0/16",
+        "swap " + tmp + " blacklist",
+        "destroy " + tmp,
+    })
+}
+
+func TestRestoreFailure(t *testing.T) {
+    runner, dir := newFakeIpset(t, nil)
+    if err := os.WriteFile(filepath.Join(dir, "fail"), nil, 0644); err != nil {
+        t.Fatal(err)
+    }
+    set, records := testSet()
+    tmp := tmpSetName(set.Name)
+
+    batch, _, _ := restoreBatch(set, records, nil, time.Now())
+    err := runner.restore(context.Background(), set.Name, batch)
+    if err == nil || !strings.Contains(err.Error(), "Syntax error") {
+        t.Fatalf("error %v, want the ipset error", err)
+    }
+
+    // Недособранный временный сет удаляется после ошибки
+    checkLines(t, "calls", readLines(t, filepath.Join(dir, "calls.log")), []string{
+        "destroy " + tmp,
+        "-exist restore",
+        "destroy " + tmp,
+    })
+}
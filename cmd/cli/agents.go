@@ -0,0 +1,416 @@
+// cmd/cli/agents.go
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/url"
+    "os"
+    "sort"
+    "strings"
+    
+    "github.com/olekukonko/tablewriter"
+    "github.com/spf13/cobra"
+)
+
+func NewAgentsCmd() *cobra.Command {
+    cmd := &cobra.Command{
+        Use:   "agents",
+        Short: "Show ipset-agent hosts and manage set assignment",
+        Long: `Show hosts running ipset-agent: which revision of every set each host applied,
+the last error and whether the host is stale (no heartbeat) or drifted (a set is
+outdated, failed or not applied). Assignment rules give sets to hosts by labels.`,
+    }
+    
+    cmd.AddCommand(NewListAgentsCmd())
+    cmd.AddCommand(NewGetAgentCmd())
+    cmd.AddCommand(NewDeleteAgentCmd())
+    cmd.AddCommand(NewAssignmentsCmd())
+    
+    return cmd
+}
+
+func NewListAgentsCmd() *cobra.Command {
+    cmd := &cobra.Command{
+        Use:   "list",
+        Short: "List agents with their rollout status",
+        Long: `List agents with their rollout status. Agent status: ok, drifted (some set is
+outdated, failed or missing) or stale (no heartbeat for AGENT_STALE_AFTER).
+Examples:
+  ipset-cli agents list
+  ipset-cli agents list --status drifted
+  ipset-cli agents list -l role=edge -l dc=msk`,
+        Run: runListAgents,
+    }
+    
+    cmd.Flags().String("status", "", "Filter by status (ok, drifted, stale)")
+    cmd.Flags().StringArrayP("label", "l", nil, "Filter by label key=value, repeatable")
+    
+    return cmd
+}
+
+func NewGetAgentCmd() *cobra.Command {
+    return &cobra.Command{
+        Use:   "get [hostname]",
+        Short: "Show an agent and the state of its sets",
+        Args:  cobra.ExactArgs(1),
+        Run:   runGetAgent,
+    }
+}
+
+func NewDeleteAgentCmd() *cobra.Command {
+    return &cobra.Command{
+        Use:   "delete [hostname]",
+        Short: "Remove a host from the registry",
+        Long: `Remove a host from the registry, e.g. a decommissioned one. A running agent
+registers again with its next heartbeat.`,
+        Args: cobra.ExactArgs(1),
+        Run:  runDeleteAgent,
+    }
+}
+
+func NewAssignmentsCmd() *cobra.Command {
+    cmd := &cobra.Command{
+        Use:   "assignments",
+        Short: "Manage assignment rules",
+        Long: `Manage assignment rules. A rule gives its sets to every agent that has all
+labels of its selector; an empty selector matches every agent.`,
+    }
+    
+    cmd.AddCommand(&cobra.Command{
+        Use:   "list",
+        Short: "List assignment rules",
+        Run:   runListAssignments,
+    })
+    
+    create := &cobra.Command{
+        Use:   "create",
+        Short: "Create an assignment rule",
+        Long: `Create an assignment rule.
+Examples:
+  ipset-cli agents assignments create --selector role=edge -s blacklist -s whitelist
+  ipset-cli agents assignments create -s bogons -d "All hosts"`,
+        Run: runCreateAssignment,
+    }
+    assignmentFlags(create)
+    cmd.AddCommand(create)
+    
+    update := &cobra.Command{
+        Use:   "update [id]",
+        Short: "Update an assignment rule",
+        Long: `Update an assignment rule. Only the given flags are changed.
+Examples:
+  ipset-cli agents assignments update 1 -s blacklist -s whitelist -s bogons
+  ipset-cli agents assignments update 1 --selector role=edge,dc=msk`,
+        Args: cobra.ExactArgs(1),
+        Run:  runUpdateAssignment,
+    }
+    assignmentFlags(update)
+    cmd.AddCommand(update)
+    
+    cmd.AddCommand(&cobra.Command{
+        Use:   "delete [id]",
+        Short: "Delete an assignment rule",
+        Args:  cobra.ExactArgs(1),
+        Run:   runDeleteAssignment,
+    })
+    
+    return cmd
+}
+
+// assignmentFlags - флаги правила, общие для create и update
+func assignmentFlags(cmd *cobra.Command) {
+    cmd.Flags().StringSlice("selector", nil, "Comma separated labels key=value the agent must have (empty - every agent)")
+    cmd.Flags().StringSliceP("set-name", "s", nil, "Set to assign, repeatable")
+    cmd.Flags().StringP("description", "d", "", "Description")
+}
+
+// assignmentBody собирает тело запроса из заданных флагов
+func assignmentBody(cmd *cobra.Command) map[string]interface{} {
+    body := make(map[string]interface{})
+    
+    if cmd.Flags().Changed("selector") {
+        pairs, _ := cmd.Flags().GetStringSlice("selector")
+        selector := make(map[string]string)
+        for _, pair := range pairs {
+            key, value, _ := strings.Cut(pair, "=")
+            selector[key] = value
+        }
+        body["selector"] = selector
+    }
+    if cmd.Flags().Changed("set-name") {
+        body["sets"], _ = cmd.Flags().GetStringSlice("set-name")
+    }
+    if cmd.Flags().Changed("description") {
+        body["description"], _ = cmd.Flags().GetString("description")
+    }
+    
+    return body
+}
+
+func runListAgents(cmd *cobra.Command, args []string) {
+    params := url.Values{}
+    if status, _ := cmd.Flags().GetString("status"); status != "" {
+        params.Set("status", status)
+    }
+    labels, _ := cmd.Flags().GetStringArray("label")
+    for _, label := range labels {
+        params.Add("label", label)
+    }
+    
+    path := "/agents"
+    if len(params) > 0 {
+        path += "?" + params.Encode()
+    }
+    data, err := makeRequest("GET", path, nil)
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+    
+    var agents []map[string]interface{}
+    if err := json.Unmarshal(data, &agents); err != nil {
+        fmt.Printf("Error parsing response: %v\n", err)
+        return
+    }
+    
+    switch config.Output {
+    case "json":
+        outputAsJSON(agents)
+    case "yaml":
+        outputAsYAML(agents)
+    default:
+        outputAgentsTable(agents)
+    }
+}
+
+func runGetAgent(cmd *cobra.Command, args []string) {
+    data, err := makeRequest("GET", "/agents/"+url.PathEscape(args[0]), nil)
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+    
+    var agent map[string]interface{}
+    if err := json.Unmarshal(data, &agent); err != nil {
+        fmt.Printf("Error parsing response: %v\n", err)
+        return
+    }
+    
+    switch config.Output {
+    case "json":
+        outputAsJSON(agent)
+    case "yaml":
+        outputAsYAML(agent)
+    default:
+        outputAgent(agent)
+    }
+}
+
+func runDeleteAgent(cmd *cobra.Command, args []string) {
+    if _, err := makeRequest("DELETE", "/agents/"+url.PathEscape(args[0]), nil); err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+    
+    fmt.Printf("Agent %s deleted successfully\n", args[0])
+}
+
+func runListAssignments(cmd *cobra.Command, args []string) {
+    data, err := makeRequest("GET", "/agents/assignments", nil)
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+    
+    var rules []map[string]interface{}
+    if err := json.Unmarshal(data, &rules); err != nil {
+        fmt.Printf("Error parsing response: %v\n", err)
+        return
+    }
+    
+    switch config.Output {
+    case "json":
+        outputAsJSON(rules)
+    case "yaml":
+        outputAsYAML(rules)
+    default:
+        outputAssignmentsTable(rules)
+    }
+}
+
+func runCreateAssignment(cmd *cobra.Command, args []string) {
+    jsonData, _ := json.Marshal(assignmentBody(cmd))
+    data, err := makeRequestWithBody("POST", "/agents/assignments", jsonData)
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+    
+    outputAssignment(data, "Assignment created successfully:")
+}
+
+func runUpdateAssignment(cmd *cobra.Command, args []string) {
+    body := assignmentBody(cmd)
+    if len(body) == 0 {
+        fmt.Println("Error: nothing to update")
+        return
+    }
+    
+    jsonData, _ := json.Marshal(body)
+    data, err := makeRequestWithBody("PUT", "/agents/assignments/"+args[0], jsonData)
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+    
+    outputAssignment(data, "Assignment updated successfully:")
+}
+
+func runDeleteAssignment(cmd *cobra.Command, args []string) {
+    if _, err := makeRequest("DELETE", "/agents/assignments/"+args[0], nil); err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+    
+    fmt.Printf("Assignment %s deleted successfully\n", args[0])
+}
+
+// outputAssignment печатает правило из ответа сервера
+func outputAssignment(data []byte, message string) {
+    var rule map[string]interface{}
+    if err := json.Unmarshal(data, &rule); err != nil {
+        fmt.Printf("Error parsing response: %v\n", err)
+        return
+    }
+    
+    switch config.Output {
+    case "json":
+        outputAsJSON(rule)
+    case "yaml":
+        outputAsYAML(rule)
+    default:
+        fmt.Println(message)
+        outputAssignmentsTable([]map[string]interface{}{rule})
+    }
+}
+
+func outputAgentsTable(agents []map[string]interface{}) {
+    if len(agents) == 0 {
+        fmt.Println("No agents found")
+        return
+    }
+    
+    table := tablewriter.NewWriter(os.Stdout)
+    table.SetHeader([]string{"Hostname", "Status", "Labels", "Sets", "Last Error", "Last Seen"})
+    table.SetAutoWrapText(false)
+    table.SetBorder(false)
+    table.SetRowLine(true)
+    table.SetColumnSeparator("│")
+    
+    for _, agent := range agents {
+        sets, _ := agent["sets"].([]interface{})
+        lines := make([]string, 0, len(sets))
+        for _, item := range sets {
+            set, _ := item.(map[string]interface{})
+            lines = append(lines, agentSetLine(set))
+        }
+        table.Append([]string{
+            historyValue(agent["hostname"]),
+            historyValue(agent["status"]),
+            formatLabels(agent["labels"], ""),
+            strings.Join(lines, "\n"),
+            truncateString(historyValue(agent["last_error"]), 40),
+            formatTime(agent["last_seen_at"]),
+        })
+    }
+    
+    table.Render()
+}
+
+// outputAgent печатает агента и по строке на каждый его сет
+func outputAgent(agent map[string]interface{}) {
+    fmt.Printf("Hostname:   %s\n", historyValue(agent["hostname"]))
+    fmt.Printf("Status:     %s\n", historyValue(agent["status"]))
+    fmt.Printf("Labels:     %s\n", formatLabels(agent["labels"], ""))
+    fmt.Printf("Registered: %s\n", formatTime(agent["registered_at"]))
+    fmt.Printf("Last seen:  %s\n", formatTime(agent["last_seen_at"]))
+    if lastError := historyValue(agent["last_error"]); lastError != "" {
+        fmt.Printf("Last error: %s\n", lastError)
+    }
+    
+    sets, _ := agent["sets"].([]interface{})
+    if len(sets) == 0 {
+        fmt.Println("\nNo sets assigned")
+        return
+    }
+    
+    fmt.Println()
+    table := tablewriter.NewWriter(os.Stdout)
+    table.SetHeader([]string{"Set", "Status", "Revision", "Entries", "Applied", "Error"})
+    table.SetBorder(false)
+    table.SetColumnSeparator("│")
+    
+    for _, item := range sets {
+        set, _ := item.(map[string]interface{})
+        table.Append([]string{
+            historyValue(set["set_name"]),
+            historyValue(set["status"]),
+            formatNumber(set["revision"]),
+            formatNumber(set["entries"]),
+            formatTime(set["applied_at"]),
+            truncateString(historyValue(set["error"]), 40),
+        })
+    }
+    
+    table.Render()
+}
+
+// agentSetLine - сет агента в таблице: имя, статус и примененная ревизия
+func agentSetLine(set map[string]interface{}) string {
+    line := fmt.Sprintf("%s: %s", historyValue(set["set_name"]), historyValue(set["status"]))
+    if set["status"] != "missing" {
+        line += " (rev " + formatNumber(set["revision"]) + ")"
+    }
+    return line
+}
+
+func outputAssignmentsTable(rules []map[string]interface{}) {
+    if len(rules) == 0 {
+        fmt.Println("No assignments found")
+        return
+    }
+    
+    table := tablewriter.NewWriter(os.Stdout)
+    table.SetHeader([]string{"ID", "Selector", "Sets", "Description", "Updated"})
+    table.SetBorder(false)
+    table.SetColumnSeparator("│")
+    
+    for _, rule := range rules {
+        table.Append([]string{
+            formatNumber(rule["id"]),
+            formatLabels(rule["selector"], "all"),
+            webhookList(rule["sets"], ""),
+            truncateString(historyValue(rule["description"]), 30),
+            formatTime(rule["updated_at"]),
+        })
+    }
+    
+    table.Render()
+}
+
+// formatLabels печатает метки key=value по возрастанию ключа, без меток -
+// empty (пустой селектор правила - все агенты)
+func formatLabels(value interface{}, empty string) string {
+    labels, _ := value.(map[string]interface{})
+    if len(labels) == 0 {
+        return empty
+    }
+    
+    pairs := make([]string, 0, len(labels))
+    for key, val := range labels {
+        pairs = append(pairs, fmt.Sprintf("%s=%v", key, val))
+    }
+    sort.Strings(pairs)
+    return strings.Join(pairs, ",")
+}
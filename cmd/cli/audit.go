@@ -0,0 +1,146 @@
+// cmd/cli/audit.go
+package main
+
+import (
+    "fmt"
+    "net/url"
+    "os"
+    "strconv"
+    "time"
+    
+    "github.com/olekukonko/tablewriter"
+    "github.com/spf13/cobra"
+)
+
+func NewAuditCmd() *cobra.Command {
+    cmd := &cobra.Command{
+        Use:   "audit",
+        Short: "Show the audit log of record and set changes",
+    }
+
+    cmd.AddCommand(NewListAuditCmd())
+
+    return cmd
+}
+
+func NewListAuditCmd() *cobra.Command {
+    cmd := &cobra.Command{
+        Use:   "list",
+        Short: "List audit events, newest first",
+        Long: `List audit events, newest first.
+Examples:
+  ipset-cli audit list --set-name blacklist
+  ipset-cli audit list --record-id 123456 -o json
+  ipset-cli audit list --action delete --since 2024-01-01`,
+        Run: runListAudit,
+    }
+
+    cmd.Flags().String("actor", "", "Filter by actor (API key ID)")
+    cmd.Flags().String("action", "", "Filter by action (create, update, delete, delete_set, import, restore, expire, activate, deactivate)")
+    cmd.Flags().StringP("set-name", "s", "", "Filter by set name")
+    cmd.Flags().Int("record-id", 0, "Filter by record ID")
+    cmd.Flags().String("request-id", "", "Filter by request ID")
+    cmd.Flags().String("since", "", "Only events at or after this date (YYYY-MM-DD or RFC3339)")
+    cmd.Flags().String("until", "", "Only events before this date")
+    cmd.Flags().IntP("limit", "l", 100, "Maximum number of events to show (0 - all)")
+    cmd.Flags().String("cursor", "", "Continue from a cursor returned by a previous listing")
+
+    return cmd
+}
+
+func runListAudit(cmd *cobra.Command, args []string) {
+    params := url.Values{}
+    
+    for flag, param := range map[string]string{
+        "actor":      "actor",
+        "action":     "action",
+        "set-name":   "set_name",
+        "request-id": "request_id",
+        "cursor":     "cursor",
+    } {
+        if value, _ := cmd.Flags().GetString(flag); value != "" {
+            params.Set(param, value)
+        }
+    }
+    
+    for _, flag := range []string{"since", "until"} {
+        value, _ := cmd.Flags().GetString(flag)
+        value, err := timeFlag(value)
+        if err != nil {
+            fmt.Printf("Error: --%s: %v\n", flag, err)
+            return
+        }
+        if value != "" {
+            params.Set(flag, value)
+        }
+    }
+    
+    if recordID, _ := cmd.Flags().GetInt("record-id"); recordID != 0 {
+        params.Set("record_id", strconv.Itoa(recordID))
+    }
+    
+    limit, _ := cmd.Flags().GetInt("limit")
+    
+    events, next, err := fetchPages("/audit", params, limit)
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+    
+    switch config.Output {
+    case "json":
+        outputAsJSON(events)
+    case "yaml":
+        outputAsYAML(events)
+    default:
+        outputAuditTable(events)
+    }
+    
+    if next != "" {
+        fmt.Fprintf(os.Stderr, "More events available, continue with --cursor %s\n", next)
+    }
+}
+
+func outputAuditTable(events []map[string]interface{}) {
+    if len(events) == 0 {
+        fmt.Println("No audit events found")
+        return
+    }
+    
+    table := tablewriter.NewWriter(os.Stdout)
+    table.SetHeader([]string{"ID", "Time", "Actor", "Action", "Set Name", "Record", "Request"})
+    table.SetBorder(false)
+    table.SetColumnSeparator("│")
+    
+    for _, event := range events {
+        table.Append([]string{
+            formatNumber(event["id"]),
+            formatTime(event["timestamp"]),
+            fmt.Sprintf("%v", event["actor"]),
+            fmt.Sprintf("%v", event["action"]),
+            fmt.Sprintf("%v", event["set_name"]),
+            formatNumber(event["record_id"]),
+            fmt.Sprintf("%v", event["request_id"]),
+        })
+    }
+    
+    table.Render()
+}
+
+// formatNumber печатает число из JSON без экспоненты (1e+06)
+func formatNumber(value interface{}) string {
+    if n, ok := value.(float64); ok {
+        return strconv.FormatFloat(n, 'f', -1, 64)
+    }
+    return ""
+}
+
+// formatTime печатает время события в локальной зоне с точностью до секунды
+func formatTime(value interface{}) string {
+    s, _ := value.(string)
+    t, err := time.Parse(time.RFC3339Nano, s)
+    if err != nil {
+        return s
+    }
+    return t.Local().Format("2006-01-02 15:04:05")
+}
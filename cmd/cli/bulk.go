@@ -0,0 +1,320 @@
+// cmd/cli/bulk.go
+package main
+
+import (
+    "encoding/csv"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+
+    "github.com/spf13/cobra"
+)
+
+// bulkIntFields - поля записи, которые передаются числами
+var bulkIntFields = map[string]bool{"port": true, "ttl": true}
+
+// bulkTimeFields - поля записи и фильтра с датой (YYYY-MM-DD или RFC3339)
+var bulkTimeFields = map[string]bool{
+    "expires_at": true, "active_from": true,
+    "created_after": true, "created_before": true, "updated_after": true, "updated_before": true,
+}
+
+// bulkRecordFields - поля записи, которые можно указать в CSV и в --set
+var bulkRecordFields = map[string]bool{
+    "set_name": true, "ip": true, "cidr": true, "port": true, "protocol": true, "second_ip": true,
+    "description": true, "context": true, "set_type": true, "set_options": true,
+    "ttl": true, "expires_at": true, "active_from": true, "schedule": true,
+}
+
+// bulkFilterFields - фильтры --where, как у records list
+var bulkFilterFields = map[string]bool{
+    "set_name": true, "context": true, "protocol": true, "port": true,
+    "created_after": true, "created_before": true, "updated_after": true, "updated_before": true,
+}
+
+func NewBulkRecordsCmd() *cobra.Command {
+    cmd := &cobra.Command{
+        Use:   "bulk [file]",
+        Short: "Create, update and delete many records in one request",
+        Long: `Send a list of create, update and delete operations in one request.
+The file is JSON (the request body of POST /records/bulk or just the list of
+operations) or CSV with a header: the op and id columns and any record
+fields (set_name, ip, cidr, port, protocol, second_ip, description, context,
+set_type, set_options, ttl, expires_at, active_from, schedule). Empty cells
+are not sent. Without a file, or with "-", operations are read from stdin.
+
+With --where and --set, every record matching the filters gets the same
+change instead (POST /records/bulk/update).
+
+In atomic mode (default) either all operations are applied or none;
+in best-effort mode each operation is applied on its own.
+Examples:
+  ipset-cli records bulk ops.json
+  ipset-cli records bulk ops.csv --mode best-effort
+  ipset-cli records bulk --where set_name=blacklist --where context=old --set context=fail2ban`,
+        Args: cobra.MaximumNArgs(1),
+        Run:  runBulkRecords,
+    }
+
+    cmd.Flags().StringP("mode", "m", "atomic", "Mode: atomic or best-effort")
+    cmd.Flags().String("format", "", "Input format: json or csv (default: by file extension, json for stdin)")
+    cmd.Flags().StringArray("where", nil, "Filter records to update, field=value (set_name, context, protocol, port, created_after, ...)")
+    cmd.Flags().StringArray("set", nil, "Change for every matching record, field=value (context, description, ttl, ...)")
+
+    return cmd
+}
+
+func runBulkRecords(cmd *cobra.Command, args []string) {
+    mode, _ := cmd.Flags().GetString("mode")
+    mode = strings.ReplaceAll(mode, "-", "_")
+    if mode != "atomic" && mode != "best_effort" {
+        fmt.Printf("Error: unknown mode %q (use atomic or best-effort)\n", mode)
+        return
+    }
+
+    where, _ := cmd.Flags().GetStringArray("where")
+    set, _ := cmd.Flags().GetStringArray("set")
+
+    var body map[string]interface{}
+    var path string
+    var err error
+    if len(where) > 0 || len(set) > 0 {
+        if len(args) > 0 {
+            fmt.Println("Error: --where and --set can not be used with a file")
+            return
+        }
+        path = "/records/bulk/update"
+        body, err = bulkUpdateBody(where, set)
+    } else {
+        format, _ := cmd.Flags().GetString("format")
+        path, body, err = readBulkFile(args, format)
+    }
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+    if _, ok := body["mode"]; !ok || cmd.Flags().Changed("mode") {
+        body["mode"] = mode
+    }
+
+    jsonData, _ := json.Marshal(body)
+    data, err := makeRequestWithBody("POST", path, jsonData)
+
+    // В режиме atomic сервер отвечает кодом невыполненной операции, но
+    // итог пакета все равно в теле ответа
+    var apiErr *apiError
+    if errors.As(err, &apiErr) && json.Valid(apiErr.Body) && strings.Contains(string(apiErr.Body), `"results"`) {
+        data, err = apiErr.Body, nil
+    }
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+
+    if config.Output == "json" {
+        fmt.Println(string(data))
+        return
+    }
+    printBulkResult(data)
+}
+
+// bulkUpdateBody собирает тело POST /records/bulk/update из --where и --set
+func bulkUpdateBody(where, set []string) (map[string]interface{}, error) {
+    if len(where) == 0 {
+        return nil, fmt.Errorf("--set needs at least one --where filter")
+    }
+    if len(set) == 0 {
+        return nil, fmt.Errorf("--where needs at least one --set change")
+    }
+
+    filter, err := bulkFields(where, bulkFilterFields, "--where")
+    if err != nil {
+        return nil, err
+    }
+    update, err := bulkFields(set, bulkRecordFields, "--set")
+    if err != nil {
+        return nil, err
+    }
+    return map[string]interface{}{"filter": filter, "update": update}, nil
+}
+
+// bulkFields разбирает пары field=value
+func bulkFields(pairs []string, allowed map[string]bool, flag string) (map[string]interface{}, error) {
+    fields := make(map[string]interface{})
+    for _, pair := range pairs {
+        name, value, ok := strings.Cut(pair, "=")
+        if !ok {
+            return nil, fmt.Errorf("%s %q: expected field=value", flag, pair)
+        }
+        if !allowed[name] {
+            return nil, fmt.Errorf("%s: unknown field %q", flag, name)
+        }
+        if err := setBulkField(fields, name, value); err != nil {
+            return nil, err
+        }
+    }
+    return fields, nil
+}
+
+// setBulkField переносит значение поля в запрос с нужным типом
+func setBulkField(fields map[string]interface{}, name, value string) error {
+    switch {
+    case bulkIntFields[name]:
+        n, err := strconv.Atoi(value)
+        if err != nil {
+            return fmt.Errorf("%s: invalid number %q", name, value)
+        }
+        fields[name] = n
+    case bulkTimeFields[name]:
+        t, err := timeFlag(value)
+        if err != nil {
+            return fmt.Errorf("%s: %v", name, err)
+        }
+        fields[name] = t
+    default:
+        fields[name] = value
+    }
+    return nil
+}
+
+// readBulkFile читает операции из файла или stdin. JSON с фильтром
+// отправляется в /records/bulk/update, остальное - в /records/bulk.
+func readBulkFile(args []string, format string) (string, map[string]interface{}, error) {
+    var data []byte
+    var err error
+    if len(args) == 0 || args[0] == "-" {
+        data, err = io.ReadAll(os.Stdin)
+    } else {
+        data, err = os.ReadFile(args[0])
+        if format == "" && strings.EqualFold(filepath.Ext(args[0]), ".csv") {
+            format = "csv"
+        }
+    }
+    if err != nil {
+        return "", nil, err
+    }
+
+    switch format {
+    case "csv":
+        operations, err := parseBulkCSV(data)
+        if err != nil {
+            return "", nil, err
+        }
+        return "/records/bulk", map[string]interface{}{"operations": operations}, nil
+
+    case "", "json":
+        var operations []interface{}
+        if err := json.Unmarshal(data, &operations); err == nil {
+            return "/records/bulk", map[string]interface{}{"operations": operations}, nil
+        }
+        var body map[string]interface{}
+        if err := json.Unmarshal(data, &body); err != nil {
+            return "", nil, fmt.Errorf("invalid JSON: %v", err)
+        }
+        if _, ok := body["filter"]; ok {
+            return "/records/bulk/update", body, nil
+        }
+        return "/records/bulk", body, nil
+    }
+    return "", nil, fmt.Errorf("unknown format %q (use json or csv)", format)
+}
+
+// parseBulkCSV превращает строки CSV в операции: op и id - операция,
+// остальные колонки - поля записи
+func parseBulkCSV(data []byte) ([]map[string]interface{}, error) {
+    reader := csv.NewReader(strings.NewReader(string(data)))
+    reader.TrimLeadingSpace = true
+    rows, err := reader.ReadAll()
+    if err != nil {
+        return nil, fmt.Errorf("invalid CSV: %v", err)
+    }
+    if len(rows) < 2 {
+        return nil, fmt.Errorf("CSV needs a header and at least one operation")
+    }
+
+    header := rows[0]
+    for _, name := range header {
+        if name != "op" && name != "id" && !bulkRecordFields[name] {
+            return nil, fmt.Errorf("CSV: unknown column %q", name)
+        }
+    }
+
+    var operations []map[string]interface{}
+    for i, row := range rows[1:] {
+        line := i + 2
+        operation := make(map[string]interface{})
+        record := make(map[string]interface{})
+        for j, name := range header {
+            value := strings.TrimSpace(row[j])
+            if value == "" {
+                continue
+            }
+            switch name {
+            case "op":
+                operation["op"] = value
+            case "id":
+                id, err := strconv.Atoi(value)
+                if err != nil {
+                    return nil, fmt.Errorf("CSV line %d: invalid id %q", line, value)
+                }
+                operation["id"] = id
+            default:
+                if err := setBulkField(record, name, value); err != nil {
+                    return nil, fmt.Errorf("CSV line %d: %v", line, err)
+                }
+            }
+        }
+        if len(record) > 0 {
+            operation["record"] = record
+        }
+        operations = append(operations, operation)
+    }
+    return operations, nil
+}
+
+// printBulkResult печатает итог пакета и невыполненные операции
+func printBulkResult(data []byte) {
+    var result struct {
+        Mode      string `json:"mode"`
+        Succeeded int    `json:"succeeded"`
+        Failed    int    `json:"failed"`
+        Results   []struct {
+            Index      int    `json:"index"`
+            Op         string `json:"op"`
+            ID         int    `json:"id"`
+            Status     int    `json:"status"`
+            Error      string `json:"error"`
+            ExistingID int    `json:"existing_id"`
+        } `json:"results"`
+    }
+    if err := json.Unmarshal(data, &result); err != nil {
+        fmt.Printf("Error: failed to parse response: %v\n", err)
+        return
+    }
+
+    for _, r := range result.Results {
+        if r.Status < 400 {
+            continue
+        }
+        target := ""
+        if r.ID != 0 {
+            target = fmt.Sprintf(" %d", r.ID)
+        }
+        fmt.Printf("  ❌ #%d %s%s: %d %s", r.Index, r.Op, target, r.Status, r.Error)
+        if r.ExistingID != 0 {
+            fmt.Printf(" (existing record %d)", r.ExistingID)
+        }
+        fmt.Println()
+    }
+
+    if result.Mode == "atomic" && result.Failed > 0 {
+        fmt.Printf("Nothing applied (atomic): %d of %d operations failed\n", result.Failed, len(result.Results))
+        return
+    }
+    fmt.Printf("Bulk completed (%s): %d succeeded, %d failed\n", result.Mode, result.Succeeded, result.Failed)
+}
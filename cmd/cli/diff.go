@@ -0,0 +1,140 @@
+// cmd/cli/diff.go
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/url"
+    "os"
+    "sort"
+    
+    "ipset-api-server/pkg/drift"
+    "ipset-api-server/pkg/validation"
+    
+    "github.com/spf13/cobra"
+)
+
+// diffRecord - поля записи из экспорта сета, нужные для сравнения
+type diffRecord struct {
+    IP       string `json:"ip"`
+    CIDR     string `json:"cidr"`
+    Port     int    `json:"port"`
+    Protocol string `json:"protocol"`
+    SecondIP string `json:"second_ip"`
+}
+
+func NewDiffSetsCmd() *cobra.Command {
+    cmd := &cobra.Command{
+        Use:   "diff [set-name...]",
+        Short: "Compare sets in the kernel with the server",
+        Long: `Compare sets loaded in the kernel (ipset save) with their copies on the server:
+entries missing from the kernel, extra entries and type/option mismatches.
+Without arguments all kernel sets that exist on the server are compared.
+Exit code: 0 - in sync, 1 - drift found, 2 - the comparison failed.
+Examples:
+  ipset-cli sets diff
+  ipset-cli sets diff blacklist
+  ipset-cli sets diff blacklist --output json`,
+        Run: runDiffSets,
+    }
+    
+    cmd.Flags().String("ipset", "ipset", "Path to the ipset binary")
+    
+    return cmd
+}
+
+func runDiffSets(cmd *cobra.Command, args []string) {
+    ipsetPath, _ := cmd.Flags().GetString("ipset")
+    
+    kernel, err := getIPSetSaved(ipsetPath)
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        os.Exit(2)
+    }
+    
+    names := args
+    if len(names) == 0 {
+        if names, err = serverKernelSets(kernel); err != nil {
+            fmt.Printf("Error: %v\n", err)
+            os.Exit(2)
+        }
+    }
+    
+    reports := []*drift.Report{}
+    for _, name := range names {
+        server, err := fetchServerSet(name)
+        if err != nil {
+            fmt.Printf("Error: set %s: %v\n", name, err)
+            os.Exit(2)
+        }
+        reports = append(reports, drift.Compare(server, kernel[name]))
+    }
+    
+    drifted := false
+    for _, report := range reports {
+        if report.Drifted() {
+            drifted = true
+        }
+    }
+    
+    if config.Output == "json" {
+        outputAsJSON(reports)
+    } else if len(reports) == 0 {
+        fmt.Println("No kernel sets found on the server")
+    } else {
+        for _, report := range reports {
+            drift.Print(os.Stdout, report)
+        }
+    }
+    
+    if drifted {
+        os.Exit(1)
+    }
+}
+
+// serverKernelSets - сеты ядра, которые есть на сервере
+func serverKernelSets(kernel map[string]*drift.Set) ([]string, error) {
+    sets, _, err := fetchPages("/sets", url.Values{}, 0)
+    if err != nil {
+        return nil, err
+    }
+    
+    var names []string
+    for _, set := range sets {
+        if name, _ := set["name"].(string); kernel[name] != nil {
+            names = append(names, name)
+        }
+    }
+    sort.Strings(names)
+    return names, nil
+}
+
+// fetchServerSet получает сет и его действующие записи с сервера
+func fetchServerSet(name string) (*drift.Set, error) {
+    data, err := makeRequest("GET", "/sets/"+url.PathEscape(name), nil)
+    if err != nil {
+        return nil, err
+    }
+    var set struct {
+        Type    string `json:"type"`
+        Options string `json:"options"`
+    }
+    if err := json.Unmarshal(data, &set); err != nil {
+        return nil, fmt.Errorf("error parsing response: %v", err)
+    }
+    
+    data, err = makeRequest("GET", "/sets/"+url.PathEscape(name)+"/export?format=json", nil)
+    if err != nil {
+        return nil, err
+    }
+    var records []diffRecord
+    if err := json.Unmarshal(data, &records); err != nil {
+        return nil, fmt.Errorf("error parsing response: %v", err)
+    }
+    
+    entries := make([]validation.Entry, len(records))
+    for i, r := range records {
+        entries[i] = validation.Entry{IP: r.IP, CIDR: r.CIDR, Port: r.Port, Protocol: r.Protocol, SecondIP: r.SecondIP}
+    }
+    return drift.ServerSet(name, set.Type, set.Options, entries), nil
+}
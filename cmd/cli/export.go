@@ -4,6 +4,7 @@ package main
 import (
     "encoding/json"
     "fmt"
+    "net/url"
     
     "github.com/spf13/cobra"
 )
@@ -25,12 +26,12 @@ func runExport(cmd *cobra.Command, args []string) {
     
     if len(args) == 0 {
         // Export all records
-        data, err := makeRequest("GET", "/records", nil)
+        var err error
+        records, _, err = fetchPages("/records", url.Values{"limit": {"1000"}}, 0)
         if err != nil {
             fmt.Printf("Error: %v\n", err)
             return
         }
-        json.Unmarshal(data, &records)
     } else {
         // Export single record
         id := args[0]
@@ -0,0 +1,153 @@
+// cmd/cli/history.go
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/url"
+    "os"
+    
+    "github.com/olekukonko/tablewriter"
+    "github.com/spf13/cobra"
+)
+
+func NewRecordHistoryCmd() *cobra.Command {
+    return &cobra.Command{
+        Use:   "history [id]",
+        Short: "Show all revisions of a record",
+        Long: `Show all revisions of a record, oldest first, including a deleted record.
+Examples:
+  ipset-cli records history 123456
+  ipset-cli records history 123456 -o json`,
+        Args: cobra.ExactArgs(1),
+        Run:  runRecordHistory,
+    }
+}
+
+func NewRestoreSetCmd() *cobra.Command {
+    cmd := &cobra.Command{
+        Use:   "restore [set-name]",
+        Short: "Restore a set from the trash or to its state at a point in time",
+        Long: `Restore a set to its state at a point in time: deleted records come back with
+their IDs, changed records get their previous values, records added later are deleted.
+Without --as-of all deleted records of the set are restored from the trash.
+Examples:
+  ipset-cli sets restore blacklist
+  ipset-cli sets restore blacklist --as-of 2024-01-01
+  ipset-cli sets restore blacklist --as-of 2024-01-01T12:00:00Z`,
+        Args: cobra.ExactArgs(1),
+        Run:  runRestoreSet,
+    }
+    
+    cmd.Flags().String("as-of", "", "Point in time to restore (YYYY-MM-DD or RFC3339), restore from the trash if omitted")
+    
+    return cmd
+}
+
+func runRecordHistory(cmd *cobra.Command, args []string) {
+    data, err := makeRequest("GET", "/records/"+args[0]+"/history", nil)
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+    
+    var revisions []map[string]interface{}
+    if err := json.Unmarshal(data, &revisions); err != nil {
+        fmt.Printf("Error parsing response: %v\n", err)
+        return
+    }
+    
+    switch config.Output {
+    case "json":
+        outputAsJSON(revisions)
+    case "yaml":
+        outputAsYAML(revisions)
+    default:
+        outputHistoryTable(revisions)
+    }
+}
+
+func outputHistoryTable(revisions []map[string]interface{}) {
+    table := tablewriter.NewWriter(os.Stdout)
+    table.SetHeader([]string{"Revision", "Time", "Operation", "Set Name", "IP", "CIDR", "Port", "Protocol", "Context"})
+    table.SetBorder(false)
+    table.SetColumnSeparator("│")
+    
+    for _, revision := range revisions {
+        record, _ := revision["record"].(map[string]interface{})
+        table.Append([]string{
+            formatNumber(revision["revision"]),
+            formatTime(revision["changed_at"]),
+            fmt.Sprintf("%v", revision["operation"]),
+            historyValue(record["set_name"]),
+            historyValue(record["ip"]),
+            historyValue(record["cidr"]),
+            formatNumber(record["port"]),
+            historyValue(record["protocol"]),
+            truncateString(historyValue(record["context"]), 20),
+        })
+    }
+    
+    table.Render()
+}
+
+// historyValue печатает поле записи из ревизии, пустые поля опущены в JSON
+func historyValue(value interface{}) string {
+    if value == nil {
+        return ""
+    }
+    return fmt.Sprintf("%v", value)
+}
+
+func runRestoreSet(cmd *cobra.Command, args []string) {
+    setName := args[0]
+    
+    asOf, _ := cmd.Flags().GetString("as-of")
+    asOf, err := timeFlag(asOf)
+    if err != nil {
+        fmt.Printf("Error: --as-of: %v\n", err)
+        return
+    }
+    
+    path := "/sets/" + url.PathEscape(setName) + "/restore"
+    if asOf != "" {
+        params := url.Values{}
+        params.Set("as_of", asOf)
+        path += "?" + params.Encode()
+    }
+    
+    data, err := makeRequest("POST", path, nil)
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+    
+    var result map[string]interface{}
+    if err := json.Unmarshal(data, &result); err != nil {
+        fmt.Printf("Error parsing response: %v\n", err)
+        return
+    }
+    
+    switch config.Output {
+    case "json":
+        outputAsJSON(result)
+    case "yaml":
+        outputAsYAML(result)
+    default:
+        count := func(key string) int {
+            ids, _ := result[key].([]interface{})
+            return len(ids)
+        }
+        if asOf == "" {
+            fmt.Printf("Set %s restored from trash: %d records restored\n", setName, count("restored"))
+        } else {
+            fmt.Printf("Set %s restored to %s: %d restored, %d updated, %d deleted\n",
+                setName, asOf, count("restored"), count("updated"), count("deleted"))
+        }
+        if errs, ok := result["errors"].([]interface{}); ok {
+            for _, e := range errs {
+                fmt.Printf("  Error: %v\n", e)
+            }
+        }
+    }
+}
@@ -14,6 +14,13 @@ func makeRequest(method, path string, body []byte) ([]byte, error) {
 }
 
 func makeRequestWithBody(method, path string, body []byte) ([]byte, error) {
+    data, _, err := makeRequestWithHeaders(method, path, body)
+    return data, err
+}
+
+// makeRequestWithHeaders возвращает вместе с телом заголовки ответа
+// (например, X-Next-Cursor при постраничной выборке)
+func makeRequestWithHeaders(method, path string, body []byte) ([]byte, http.Header, error) {
     url := config.APIURL + path
     
     var req *http.Request
@@ -27,7 +34,7 @@ func makeRequestWithBody(method, path string, body []byte) ([]byte, error) {
     }
     
     if err != nil {
-        return nil, err
+        return nil, nil, err
     }
     
     if config.Token != "" {
@@ -43,18 +50,28 @@ func makeRequestWithBody(method, path string, body []byte) ([]byte, error) {
     
     resp, err := client.Do(req)
     if err != nil {
-        return nil, err
+        return nil, nil, err
     }
     defer resp.Body.Close()
     
     data, err := io.ReadAll(resp.Body)
     if err != nil {
-        return nil, err
+        return nil, nil, err
     }
     
     if resp.StatusCode >= 400 {
-        return nil, fmt.Errorf("API error (%d): %s", resp.StatusCode, string(data))
+        return nil, nil, &apiError{Status: resp.StatusCode, Body: data}
     }
     
-    return data, nil
-}
\ No newline at end of file
+    return data, resp.Header, nil
+}
+// apiError - ответ сервера с кодом ошибки. Тело ответа нужно командам,
+// которые получают вместе с ошибкой результат (например, records bulk).
+type apiError struct {
+    Status int
+    Body   []byte
+}
+
+func (e *apiError) Error() string {
+    return fmt.Sprintf("API error (%d): %s", e.Status, string(e.Body))
+}
@@ -23,6 +23,8 @@ type ImportedRule struct {
     CIDR        string
     Port        int
     Protocol    string
+    SecondIP    string
+    Timeout     int
     Description string
     Context     string
     LineNumber  int
@@ -43,6 +45,9 @@ func NewImportCmd() *cobra.Command {
     }
     importFileCmd.Flags().StringP("context-prefix", "p", "imported", "Context prefix for imported rules")
     importFileCmd.Flags().BoolP("dry-run", "d", false, "Dry run - show what would be imported")
+    importFileCmd.Flags().StringP("mode", "m", "append", "Import mode: append, sync or replace")
+    importFileCmd.Flags().Bool("upsert", false, "Update description, context and expiry of records already in the set")
+    importFileCmd.Flags().Bool("skip-invalid", false, "In sync and replace modes, import a set without its invalid rules instead of skipping the set")
     cmd.AddCommand(importFileCmd)
 
     // Import from /etc/ipset
@@ -53,6 +58,9 @@ func NewImportCmd() *cobra.Command {
     }
     importEtcCmd.Flags().StringP("context-prefix", "p", "etc", "Context prefix for imported rules")
     importEtcCmd.Flags().BoolP("dry-run", "d", false, "Dry run - show what would be imported")
+    importEtcCmd.Flags().StringP("mode", "m", "append", "Import mode: append, sync or replace")
+    importEtcCmd.Flags().Bool("upsert", false, "Update description, context and expiry of records already in the set")
+    importEtcCmd.Flags().Bool("skip-invalid", false, "In sync and replace modes, import a set without its invalid rules instead of skipping the set")
     cmd.AddCommand(importEtcCmd)
 
     // Import from stdin
@@ -63,6 +71,9 @@ func NewImportCmd() *cobra.Command {
     }
     importStdinCmd.Flags().StringP("context-prefix", "p", "stdin", "Context prefix for imported rules")
     importStdinCmd.Flags().BoolP("dry-run", "d", false, "Dry run - show what would be imported")
+    importStdinCmd.Flags().StringP("mode", "m", "append", "Import mode: append, sync or replace")
+    importStdinCmd.Flags().Bool("upsert", false, "Update description, context and expiry of records already in the set")
+    importStdinCmd.Flags().Bool("skip-invalid", false, "In sync and replace modes, import a set without its invalid rules instead of skipping the set")
     cmd.AddCommand(importStdinCmd)
 
     // Import from running system
@@ -74,6 +85,9 @@ func NewImportCmd() *cobra.Command {
     }
     importSystemCmd.Flags().StringP("context-prefix", "p", "system", "Context prefix for imported rules")
     importSystemCmd.Flags().BoolP("dry-run", "d", false, "Dry run - show what would be imported")
+    importSystemCmd.Flags().StringP("mode", "m", "append", "Import mode: append, sync or replace")
+    importSystemCmd.Flags().Bool("upsert", false, "Update description, context and expiry of records already in the set")
+    importSystemCmd.Flags().Bool("skip-invalid", false, "In sync and replace modes, import a set without its invalid rules instead of skipping the set")
     cmd.AddCommand(importSystemCmd)
 
     // Import all
@@ -83,6 +97,9 @@ func NewImportCmd() *cobra.Command {
         Run:   runImportAll,
     }
     importAllCmd.Flags().BoolP("dry-run", "d", false, "Dry run - show what would be imported")
+    importAllCmd.Flags().StringP("mode", "m", "append", "Import mode: append, sync or replace")
+    importAllCmd.Flags().Bool("upsert", false, "Update description, context and expiry of records already in the set")
+    importAllCmd.Flags().Bool("skip-invalid", false, "In sync and replace modes, import a set without its invalid rules instead of skipping the set")
     cmd.AddCommand(importAllCmd)
 
     return cmd
@@ -92,6 +109,9 @@ func runImportFile(cmd *cobra.Command, args []string) {
     filename := args[0]
     contextPrefix, _ := cmd.Flags().GetString("context-prefix")
     dryRun, _ := cmd.Flags().GetBool("dry-run")
+    mode, _ := cmd.Flags().GetString("mode")
+    upsert, _ := cmd.Flags().GetBool("upsert")
+    skipInvalid, _ := cmd.Flags().GetBool("skip-invalid")
     
     rules, err := parseIPSetFile(filename)
     if err != nil {
@@ -99,13 +119,16 @@ func runImportFile(cmd *cobra.Command, args []string) {
         return
     }
     
-    importRules(rules, contextPrefix, dryRun)
+    importRules(rules, contextPrefix, mode, upsert, skipInvalid, dryRun)
 }
 
 func runImportEtc(cmd *cobra.Command, args []string) {
     etcFile := "/etc/ipset"
     contextPrefix, _ := cmd.Flags().GetString("context-prefix")
     dryRun, _ := cmd.Flags().GetBool("dry-run")
+    mode, _ := cmd.Flags().GetString("mode")
+    upsert, _ := cmd.Flags().GetBool("upsert")
+    skipInvalid, _ := cmd.Flags().GetBool("skip-invalid")
     
     if _, err := os.Stat(etcFile); os.IsNotExist(err) {
         fmt.Printf("File %s does not exist\n", etcFile)
@@ -119,12 +142,15 @@ func runImportEtc(cmd *cobra.Command, args []string) {
     }
     
     fmt.Printf("Importing from %s\n", etcFile)
-    importRules(rules, contextPrefix, dryRun)
+    importRules(rules, contextPrefix, mode, upsert, skipInvalid, dryRun)
 }
 
 func runImportStdin(cmd *cobra.Command, args []string) {
     contextPrefix, _ := cmd.Flags().GetString("context-prefix")
     dryRun, _ := cmd.Flags().GetBool("dry-run")
+    mode, _ := cmd.Flags().GetString("mode")
+    upsert, _ := cmd.Flags().GetBool("upsert")
+    skipInvalid, _ := cmd.Flags().GetBool("skip-invalid")
     
     stat, _ := os.Stdin.Stat()
     if (stat.Mode() & os.ModeCharDevice) != 0 {
@@ -145,12 +171,15 @@ func runImportStdin(cmd *cobra.Command, args []string) {
     }
     
     fmt.Println("Importing from stdin")
-    importRules(rules, contextPrefix, dryRun)
+    importRules(rules, contextPrefix, mode, upsert, skipInvalid, dryRun)
 }
 
 func runImportSystem(cmd *cobra.Command, args []string) {
     contextPrefix, _ := cmd.Flags().GetString("context-prefix")
     dryRun, _ := cmd.Flags().GetBool("dry-run")
+    mode, _ := cmd.Flags().GetString("mode")
+    upsert, _ := cmd.Flags().GetBool("upsert")
+    skipInvalid, _ := cmd.Flags().GetBool("skip-invalid")
     
     if !commandExists("ipset") {
         fmt.Println("ipset command not found in PATH")
@@ -185,11 +214,14 @@ func runImportSystem(cmd *cobra.Command, args []string) {
     }
     
     fmt.Printf("Importing from running ipset system\n")
-    importRules(rules, contextPrefix, dryRun)
+    importRules(rules, contextPrefix, mode, upsert, skipInvalid, dryRun)
 }
 
 func runImportAll(cmd *cobra.Command, args []string) {
     dryRun, _ := cmd.Flags().GetBool("dry-run")
+    mode, _ := cmd.Flags().GetString("mode")
+    upsert, _ := cmd.Flags().GetBool("upsert")
+    skipInvalid, _ := cmd.Flags().GetBool("skip-invalid")
     var allRules []ImportedRule
     sources := []string{}
     
@@ -242,5 +274,5 @@ func runImportAll(cmd *cobra.Command, args []string) {
     }
     
     fmt.Printf("Found %d rules from sources: %s\n", len(allRules), strings.Join(sources, ", "))
-    importRules(allRules, "imported", dryRun)
+    importRules(allRules, "imported", mode, upsert, skipInvalid, dryRun)
 }
\ No newline at end of file
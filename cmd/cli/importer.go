@@ -4,15 +4,39 @@ package main
 import (
     "encoding/json"
     "fmt"
+    "sort"
     //"strings"
+    
+    "ipset-api-server/pkg/validation"
 )
 
-func importRules(rules []ImportedRule, contextPrefix string, dryRun bool) {
+// importRules импортирует правила по сетам. mode - режим POST /sets/import:
+// append добавляет недостающие записи, sync и replace делают сет равным
+// импортируемому списку. upsert обновляет описание, контекст и срок записей,
+// которые уже есть в сете. В режимах sync и replace сет с неверными
+// правилами не импортируется: сервер удалил бы записи, которые им
+// соответствуют. skipInvalid импортирует такой сет без неверных правил.
+func importRules(rules []ImportedRule, contextPrefix, mode string, upsert, skipInvalid, dryRun bool) {
+    if mode != "append" && mode != "sync" && mode != "replace" {
+        fmt.Printf("Error: unknown mode %q (use append, sync or replace)\n", mode)
+        return
+    }
+    
     if len(rules) == 0 {
         fmt.Println("No rules to import")
         return
     }
     
+    // Проверяем правила по тем же правилам, что и сервер
+    rules, invalid := validRules(rules)
+    if mode != "append" && !skipInvalid {
+        rules = withoutSets(rules, invalid, mode)
+    }
+    if len(rules) == 0 {
+        fmt.Println("No valid rules to import")
+        return
+    }
+    
     // Группируем правила по set_name
     setMap := make(map[string][]ImportedRule)
     for _, rule := range rules {
@@ -32,7 +56,71 @@ func importRules(rules []ImportedRule, contextPrefix string, dryRun bool) {
         return
     }
     
-    performImport(setMap, contextPrefix)
+    performImport(setMap, contextPrefix, mode, upsert)
+}
+
+// validRules отбрасывает правила, не соответствующие типу сета, и печатает
+// причину для каждого из них. invalid - число отброшенных правил по сетам.
+func validRules(rules []ImportedRule) (valid []ImportedRule, invalid map[string]int) {
+    invalid = make(map[string]int)
+    for _, rule := range rules {
+        err := validation.ValidateRecord(rule.SetName, rule.SetType, rule.SetOptions, validation.Entry{
+            IP:       rule.IP,
+            CIDR:     rule.CIDR,
+            Port:     rule.Port,
+            Protocol: rule.Protocol,
+            SecondIP: rule.SecondIP,
+        })
+        if err != nil {
+            fmt.Printf("⚠️  Skipping line %d (set %s): %v\n", rule.LineNumber, rule.SetName, err)
+            invalid[rule.SetName]++
+            continue
+        }
+        valid = append(valid, rule)
+    }
+    return valid, invalid
+}
+
+// withoutSets убирает правила сетов с неверными правилами и печатает, какие
+// сеты не будут импортированы
+func withoutSets(rules []ImportedRule, invalid map[string]int, mode string) []ImportedRule {
+    if len(invalid) == 0 {
+        return rules
+    }
+    
+    names := make([]string, 0, len(invalid))
+    for name := range invalid {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        fmt.Printf("❌ Set %s is not imported: it has %d invalid rules, and mode %s would remove "+
+            "their records (fix them or use --skip-invalid)\n", name, invalid[name], mode)
+    }
+    
+    var kept []ImportedRule
+    for _, rule := range rules {
+        if invalid[rule.SetName] == 0 {
+            kept = append(kept, rule)
+        }
+    }
+    return kept
+}
+
+// displayAddr форматирует адрес правила для вывода; IPv6 берется в скобки,
+// чтобы порт не сливался с адресом
+func displayAddr(rule ImportedRule) string {
+    addr := rule.IP
+    if rule.CIDR != "" {
+        addr += "/" + rule.CIDR
+    }
+    if rule.Port != 0 {
+        if validation.AddrFamily(rule.IP) == "inet6" {
+            addr = "[" + addr + "]"
+        }
+        addr += fmt.Sprintf(":%d", rule.Port)
+    }
+    return addr
 }
 
 func printDryRun(setMap map[string][]ImportedRule) {
@@ -48,35 +136,63 @@ func printDryRun(setMap map[string][]ImportedRule) {
         fmt.Printf("  Rules: %d\n", len(setRules))
         
         for i, rule := range setRules {
-            fmt.Printf("    %d. %s", i+1, rule.IP)
-            if rule.CIDR != "" {
-                fmt.Printf("/%s", rule.CIDR)
-            }
-            if rule.Port != 0 {
-                fmt.Printf(":%d", rule.Port)
-            }
+            fmt.Printf("    %d. %s", i+1, displayAddr(rule))
             if rule.Protocol != "" {
                 fmt.Printf(" (%s)", rule.Protocol)
             }
+            if rule.SecondIP != "" {
+                fmt.Printf(" -> %s", rule.SecondIP)
+            }
+            if rule.Timeout > 0 {
+                fmt.Printf(" [timeout %d]", rule.Timeout)
+            }
             fmt.Println()
         }
     }
 }
 
-func performImport(setMap map[string][]ImportedRule, contextPrefix string) {
-    var totalSuccess, totalFailed int
+// performImport отправляет каждый сет одним запросом: сервер применяет его
+// целиком или не меняет сет вовсе
+func performImport(setMap map[string][]ImportedRule, contextPrefix, mode string, upsert bool) {
+    var totalAdded, totalRemoved, totalUpdated, totalUnchanged, failedSets int
     
     for setName, setRules := range setMap {
-        fmt.Printf("\nImporting set: %s (%d rules)\n", setName, len(setRules))
+        fmt.Printf("\nImporting set: %s (%d rules, mode %s)\n", setName, len(setRules), mode)
+        
+        records := make([]map[string]interface{}, 0, len(setRules))
+        for _, rule := range setRules {
+            record := map[string]interface{}{
+                "ip":          rule.IP,
+                "context":     fmt.Sprintf("%s:%s", contextPrefix, rule.Context),
+                "description": rule.Description,
+            }
+            if rule.CIDR != "" {
+                record["cidr"] = rule.CIDR
+            }
+            if rule.Port != 0 {
+                record["port"] = rule.Port
+            }
+            if rule.Protocol != "" {
+                record["protocol"] = rule.Protocol
+            }
+            if rule.SecondIP != "" {
+                record["second_ip"] = rule.SecondIP
+            }
+            // timeout 0 в ipset - бессрочная запись
+            if rule.Timeout > 0 {
+                record["ttl"] = rule.Timeout
+            }
+            records = append(records, record)
+        }
         
-        // Подготавливаем данные для импорта сета
         importData := map[string]interface{}{
             "set_name":    setName,
+            "mode":        mode,
+            "upsert":      upsert,
             "context":     fmt.Sprintf("%s:%s", contextPrefix, setName),
             "description": fmt.Sprintf("Imported set %s", setName),
-            "records":     []map[string]interface{}{},
+            "records":     records,
         }
-        
         if len(setRules) > 0 {
             importData["set_type"] = setRules[0].SetType
             if setRules[0].SetOptions != "" {
@@ -84,65 +200,34 @@ func performImport(setMap map[string][]ImportedRule, contextPrefix string) {
             }
         }
         
-        // Создаем сет через API
         jsonData, _ := json.Marshal(importData)
-        _, err := makeRequestWithBody("POST", "/sets/import", jsonData)
+        resp, err := makeRequestWithBody("POST", "/sets/import", jsonData)
         if err != nil {
-            fmt.Printf("❌ Failed to create set %s: %v\n", setName, err)
-            totalFailed += len(setRules)
+            fmt.Printf("❌ Failed to import set %s: %v\n", setName, err)
+            failedSets++
             continue
         }
         
-        // Импортируем правила
-        var successCount, failCount int
-        
-        for _, rule := range setRules {
-            record := map[string]interface{}{
-                "set_name":    rule.SetName,
-                "ip":          rule.IP,
-                "context":     fmt.Sprintf("%s:%s", contextPrefix, rule.Context),
-                "description": rule.Description,
-                "set_type":    rule.SetType,
-            }
-            
-            if rule.SetOptions != "" {
-                record["set_options"] = rule.SetOptions
-            }
-            if rule.CIDR != "" {
-                record["cidr"] = rule.CIDR
-            }
-            if rule.Port != 0 {
-                record["port"] = rule.Port
-            }
-            if rule.Protocol != "" {
-                record["protocol"] = rule.Protocol
-            }
-            
-            jsonData, _ := json.Marshal(record)
-            _, err := makeRequestWithBody("POST", "/records", jsonData)
-            
-            if err != nil {
-                fmt.Printf("  ❌ Failed: %s", rule.IP)
-                if rule.Port != 0 {
-                    fmt.Printf(":%d", rule.Port)
-                }
-                fmt.Printf(" - %v\n", err)
-                failCount++
-            } else {
-                fmt.Printf("  ✅ %s", rule.IP)
-                if rule.Port != 0 {
-                    fmt.Printf(":%d", rule.Port)
-                }
-                fmt.Println()
-                successCount++
-            }
+        var result struct {
+            Added     []int `json:"added"`
+            Removed   []int `json:"removed"`
+            Updated   []int `json:"updated"`
+            Unchanged []int `json:"unchanged"`
+        }
+        if err := json.Unmarshal(resp, &result); err != nil {
+            fmt.Printf("❌ Failed to parse response for set %s: %v\n", setName, err)
+            failedSets++
+            continue
         }
         
-        fmt.Printf("  Set %s: %d successful, %d failed\n", setName, successCount, failCount)
-        totalSuccess += successCount
-        totalFailed += failCount
+        fmt.Printf("  ✅ Set %s: %d added, %d removed, %d updated, %d unchanged\n",
+            setName, len(result.Added), len(result.Removed), len(result.Updated), len(result.Unchanged))
+        totalAdded += len(result.Added)
+        totalRemoved += len(result.Removed)
+        totalUpdated += len(result.Updated)
+        totalUnchanged += len(result.Unchanged)
     }
     
-    fmt.Printf("\nImport completed: %d successful, %d failed across %d sets\n", 
-        totalSuccess, totalFailed, len(setMap))
-}
\ No newline at end of file
+    fmt.Printf("\nImport completed: %d added, %d removed, %d updated, %d unchanged, %d of %d sets failed\n",
+        totalAdded, totalRemoved, totalUpdated, totalUnchanged, failedSets, len(setMap))
+}
@@ -0,0 +1,74 @@
+// cmd/cli/lookup.go
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/url"
+    "strings"
+    
+    "ipset-api-server/pkg/validation"
+    
+    "github.com/spf13/cobra"
+)
+
+func NewLookupCmd() *cobra.Command {
+    return &cobra.Command{
+        Use:   "lookup [ip|cidr]",
+        Short: "Find sets and contexts that cover an address",
+        Long: `Find records that contain an IP address or overlap a network.
+Examples:
+  ipset-cli lookup 10.1.2.3
+  ipset-cli lookup 10.1.0.0/16
+  ipset-cli lookup 2001:db8::1`,
+        Args: cobra.ExactArgs(1),
+        Run:  runLookup,
+    }
+}
+
+func runLookup(cmd *cobra.Command, args []string) {
+    if _, err := validation.LookupPrefix(args[0]); err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+    
+    data, err := makeRequest("GET", "/lookup?ip="+url.QueryEscape(args[0]), nil)
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+    
+    var result struct {
+        IP       string                   `json:"ip" yaml:"ip"`
+        Records  []map[string]interface{} `json:"records" yaml:"records"`
+        Sets     []string                 `json:"sets" yaml:"sets"`
+        Contexts []string                 `json:"contexts" yaml:"contexts"`
+    }
+    if err := json.Unmarshal(data, &result); err != nil {
+        fmt.Printf("Error parsing response: %v\n", err)
+        return
+    }
+    
+    switch config.Output {
+    case "json":
+        outputAsJSON(result)
+        return
+    case "yaml":
+        outputAsYAML(result)
+        return
+    case "ipset":
+        outputAsIPSet(result.Records)
+        return
+    }
+    
+    if len(result.Records) == 0 {
+        fmt.Printf("%s is not covered by any set\n", result.IP)
+        return
+    }
+    
+    fmt.Printf("%s is covered by %d record(s)\n", result.IP, len(result.Records))
+    fmt.Printf("Sets:     %s\n", strings.Join(result.Sets, ", "))
+    fmt.Printf("Contexts: %s\n", strings.Join(result.Contexts, ", "))
+    fmt.Println()
+    outputAsTable(result.Records)
+}
@@ -47,6 +47,12 @@ func main() {
     rootCmd.AddCommand(NewSetsCmd())     // Это добавит все команды для работы с сетами
     rootCmd.AddCommand(NewImportCmd())
     rootCmd.AddCommand(NewExportCmd())   // Это для экспорта записей (старая команда)
+    rootCmd.AddCommand(NewLookupCmd())
+    rootCmd.AddCommand(NewAuditCmd())
+    rootCmd.AddCommand(NewTrashCmd())
+    rootCmd.AddCommand(NewWatchCmd())
+    rootCmd.AddCommand(NewWebhooksCmd())
+    rootCmd.AddCommand(NewAgentsCmd())
     rootCmd.AddCommand(NewConfigCmd())
 
     if err := rootCmd.Execute(); err != nil {
@@ -5,7 +5,12 @@ import (
     "encoding/json"
     "fmt"
     "os"
+    "strconv"
     //"strings"
+    "time"
+    
+    "ipset-api-server/pkg/schedule"
+    "ipset-api-server/pkg/validation"
     
     "github.com/olekukonko/tablewriter"
     "gopkg.in/yaml.v3"
@@ -104,19 +109,40 @@ func outputAsIPSet(records []map[string]interface{}) {
         setMap[setName] = append(setMap[setName], record)
     }
     
+    now := time.Now()
+    families := make(map[string]string)
     for setName, setRecords := range setMap {
         // Определяем тип сета
         setType := "hash:ip"
+        setOptions := ""
         if len(setRecords) > 0 {
             if st, ok := setRecords[0]["set_type"].(string); ok && st != "" {
                 setType = st
             }
+            setOptions, _ = setRecords[0]["set_options"].(string)
         }
         
+        // Семейство сета: IPv4 и IPv6 в одном сете ipset не хранит.
+        // Записи вне окна действия в сет не попадают и на него не влияют.
+        var ips []string
+        for _, record := range setRecords {
+            if !recordActive(record, now) {
+                continue
+            }
+            if ip, ok := record["ip"].(string); ok {
+                ips = append(ips, ip)
+            }
+        }
+        family := validation.ExportFamily(setOptions, ips)
+        families[setName] = family
+        
         fmt.Printf("# Create set: %s\n", setName)
-        fmt.Printf("ipset create %s %s -exist\n", setName, setType)
+        fmt.Printf("ipset create %s %s %s -exist\n", setName, setType, validation.WithFamily(setOptions, family))
         fmt.Println()
         
+        // В сет с опцией timeout каждая запись добавляется со своим сроком
+        withTimeout := validation.HasTimeout(setOptions)
+        
         for _, record := range setRecords {
             ip := fmt.Sprintf("%v", record["ip"])
             cidr := fmt.Sprintf("%v", record["cidr"])
@@ -125,19 +151,42 @@ func outputAsIPSet(records []map[string]interface{}) {
             desc := fmt.Sprintf("%v", record["description"])
             id := fmt.Sprintf("%v", record["id"])
             
-            // Формируем IP/CIDR
+            // Запись вне окна действия сейчас не должна быть в сете
+            if !recordActive(record, now) {
+                fmt.Printf("# Inactive record %s: outside its activation window\n", id)
+                continue
+            }
+            if f := validation.AddrFamily(ip); f != "" && f != family {
+                fmt.Printf("# Skipped record %s: %s does not belong to family %s\n", id, ip, family)
+                continue
+            }
+            
+            // Формируем IP/CIDR, длину одиночного адреса (/32, /128) не пишем
             entry := ip
-            if cidr != "" && cidr != "<nil>" && cidr != "0" && cidr != "32" {
+            if cidr != "" && cidr != "<nil>" && cidr != "0" &&
+                cidr != strconv.Itoa(validation.DefaultPrefixLen(family)) {
                 entry = ip + "/" + cidr
             }
             
             if port != "" && port != "<nil>" && port != "0" {
+                // У bitmap:port запись состоит только из порта
+                if entry != "" && entry != "<nil>" {
+                    entry += ","
+                } else {
+                    entry = ""
+                }
                 if protocol != "" && protocol != "<nil>" {
-                    entry += fmt.Sprintf(",%s:%s", protocol, port)
+                    entry += fmt.Sprintf("%s:%s", protocol, port)
                 } else {
-                    entry += fmt.Sprintf(",%s", port)
+                    entry += port
                 }
             }
+            if secondIP, ok := record["second_ip"].(string); ok && secondIP != "" {
+                entry += "," + secondIP
+            }
+            if withTimeout {
+                entry += fmt.Sprintf(" timeout %d", validation.EntryTimeout(recordExpiresAt(record), now))
+            }
             
             comment := fmt.Sprintf("# Rule ID: %s", id)
             if desc != "" && desc != "<nil>" {
@@ -152,8 +201,41 @@ func outputAsIPSet(records []map[string]interface{}) {
     
     fmt.Println("# Example iptables rules:")
     for setName := range setMap {
-        fmt.Printf("# iptables -A INPUT -m set --match-set %s src -j ACCEPT\n", setName)
+        iptables := "iptables"
+        if families[setName] == "inet6" {
+            iptables = "ip6tables"
+        }
+        fmt.Printf("# %s -A INPUT -m set --match-set %s src -j ACCEPT\n", iptables, setName)
+    }
+}
+
+// recordExpiresAt - срок записи из ответа API, nil у бессрочных записей
+func recordExpiresAt(record map[string]interface{}) *time.Time {
+    value, _ := record["expires_at"].(string)
+    t, err := time.Parse(time.RFC3339, value)
+    if err != nil {
+        return nil
+    }
+    return &t
+}
+
+// recordActive - действует ли запись из ответа API в момент now, как
+// решает сервер при экспорте
+func recordActive(record map[string]interface{}, now time.Time) bool {
+    if value, ok := record["active_from"].(string); ok {
+        if from, err := time.Parse(time.RFC3339, value); err == nil && now.Before(from) {
+            return false
+        }
+    }
+    value, _ := record["schedule"].(string)
+    if value == "" {
+        return true
+    }
+    sched, err := schedule.Parse(value)
+    if err != nil {
+        return true
     }
+    return sched.Active(now)
 }
 
 func truncateString(s string, maxLen int) string {
@@ -0,0 +1,62 @@
+// cmd/cli/paging.go
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/url"
+    "strconv"
+    "time"
+)
+
+// fetchPages запрашивает страницы списка, пока сервер возвращает курсор
+// следующей страницы в заголовке X-Next-Cursor. max ограничивает общее число
+// элементов (0 - без ограничения). Возвращает курсор, с которого можно
+// продолжить, если выборка остановилась на max.
+func fetchPages(path string, params url.Values, max int) ([]map[string]interface{}, string, error) {
+    var items []map[string]interface{}
+    
+    pageSize, _ := strconv.Atoi(params.Get("limit"))
+    
+    for {
+        // Не запрашиваем больше, чем осталось до max
+        if remaining := max - len(items); max > 0 && (pageSize <= 0 || remaining < pageSize) {
+            params.Set("limit", strconv.Itoa(remaining))
+        }
+        
+        data, header, err := makeRequestWithHeaders("GET", path+"?"+params.Encode(), nil)
+        if err != nil {
+            return nil, "", err
+        }
+        
+        var page []map[string]interface{}
+        if err := json.Unmarshal(data, &page); err != nil {
+            return nil, "", fmt.Errorf("error parsing response: %v", err)
+        }
+        items = append(items, page...)
+        
+        cursor := header.Get("X-Next-Cursor")
+        if max > 0 && len(items) >= max {
+            return items, cursor, nil
+        }
+        if cursor == "" {
+            return items, "", nil
+        }
+        params.Set("cursor", cursor)
+    }
+}
+
+// timeFlag приводит дату из флага к RFC3339, допускается формат YYYY-MM-DD
+func timeFlag(value string) (string, error) {
+    if value == "" {
+        return "", nil
+    }
+    if _, err := time.Parse(time.RFC3339, value); err == nil {
+        return value, nil
+    }
+    t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+    if err != nil {
+        return "", fmt.Errorf("invalid date %q (use YYYY-MM-DD or RFC3339)", value)
+    }
+    return t.Format(time.RFC3339), nil
+}
@@ -8,6 +8,8 @@ import (
     //"regexp"
     "strconv"
     "strings"
+    
+    "ipset-api-server/pkg/drift"
 )
 
 func parseIPSetFile(filename string) ([]ImportedRule, error) {
@@ -45,6 +47,7 @@ func parseIPSetData(data string, source string) ([]ImportedRule, error) {
             if len(fields) >= 3 {
                 currentSet.name = fields[1]
                 currentSet.setType = fields[2]
+                currentSet.options = ""
                 if len(fields) > 3 {
                     currentSet.options = strings.Join(fields[3:], " ")
                 }
@@ -56,7 +59,9 @@ func parseIPSetData(data string, source string) ([]ImportedRule, error) {
                 entry := fields[2]
                 
                 setType := currentSet.setType
+                setOptions := currentSet.options
                 if setName != currentSet.name {
+                    setOptions = ""
                     if strings.Contains(setName, "tcp") {
                         setType = "hash:ip,port"
                     } else if strings.Contains(setName, "udp") {
@@ -66,8 +71,9 @@ func parseIPSetData(data string, source string) ([]ImportedRule, error) {
                     }
                 }
                 
-                rule := parseIPSetEntry(setName, entry, setType, currentSet.options)
+                rule := parseIPSetEntry(setName, entry, setType, setOptions)
                 if rule != nil {
+                    rule.Timeout = entryTimeout(fields[3:])
                     rule.LineNumber = i + 1
                     rule.Description = fmt.Sprintf("Imported from %s line %d", source, i+1)
                     rule.Context = fmt.Sprintf("%s:%s", source, setName)
@@ -87,51 +93,95 @@ func parseIPSetEntry(setName, entry, setType, setOptions string) *ImportedRule {
         SetOptions: setOptions,
     }
     
-    // Парсим entry
-    if strings.Contains(entry, ",") {
-        parts := strings.Split(entry, ",")
-        ipPart := parts[0]
-        
-        // Парсим IP часть
-        if strings.Contains(ipPart, "/") {
-            ipCIDR := strings.Split(ipPart, "/")
-            rule.IP = ipCIDR[0]
-            rule.CIDR = ipCIDR[1]
-        } else if strings.Contains(ipPart, ":") {
-            ipPort := strings.Split(ipPart, ":")
-            rule.IP = ipPort[0]
-            if port, err := strconv.Atoi(ipPort[1]); err == nil {
-                rule.Port = port
-            }
-        } else {
-            rule.IP = ipPart
+    // bitmap:port хранит только порты: [proto:]port
+    if setType == "bitmap:port" {
+        if proto, port, ok := strings.Cut(entry, ":"); ok {
+            rule.Protocol = proto
+            entry = port
         }
-        
-        // Парсим proto:port часть
-        if len(parts) > 1 {
-            protoPort := parts[1]
-            if strings.Contains(protoPort, ":") {
-                pp := strings.Split(protoPort, ":")
-                rule.Protocol = pp[0]
-                if len(pp) > 1 {
-                    if port, err := strconv.Atoi(pp[1]); err == nil {
-                        rule.Port = port
-                    }
-                }
-            }
+        if port, err := strconv.Atoi(entry); err == nil {
+            rule.Port = port
         }
-    } else {
+        return rule
+    }
+    
+    // MAC и имя сета разбирать не нужно
+    if setType == "hash:mac" || setType == "list:set" {
         rule.IP = entry
-        if strings.Contains(entry, "/") {
-            ipCIDR := strings.Split(entry, "/")
-            rule.IP = ipCIDR[0]
-            rule.CIDR = ipCIDR[1]
+        return rule
+    }
+    
+    // Парсим entry
+    parts := strings.Split(entry, ",")
+    rule.IP, rule.CIDR, rule.Port = parseAddrPart(parts[0])
+    
+    // Парсим proto:port часть
+    if len(parts) > 1 {
+        protoPort := parts[1]
+        if strings.Contains(protoPort, ":") {
+            pp := strings.Split(protoPort, ":")
+            rule.Protocol = pp[0]
+            if len(pp) > 1 {
+                if port, err := strconv.Atoi(pp[1]); err == nil {
+                    rule.Port = port
+                }
+            }
+        } else if port, err := strconv.Atoi(protoPort); err == nil {
+            rule.Port = port
         }
     }
     
+    // Второй адрес hash:ip,port,ip и hash:ip,port,net
+    if len(parts) > 2 {
+        rule.SecondIP = strings.NewReplacer("[", "", "]", "").Replace(parts[2])
+    }
+    
     return rule
 }
 
+// entryTimeout возвращает timeout записи из параметров после нее в строке
+// add (ipset save выводит оставшееся время записи), 0 - если его нет
+func entryTimeout(params []string) int {
+    for i := 0; i+1 < len(params); i++ {
+        if params[i] == "timeout" {
+            timeout, _ := strconv.Atoi(params[i+1])
+            return timeout
+        }
+    }
+    return 0
+}
+
+// parseAddrPart разбирает адресную часть записи: 10.0.0.1, 10.0.0.0/24,
+// 2001:db8::1, 2001:db8::/32, [2001:db8::1], [2001:db8::]/32, а также
+// устаревшую форму ip:port и [ipv6]:port. Двоеточие само по себе не
+// отделяет порт - в IPv6-адресе (и в MAC) их несколько.
+func parseAddrPart(part string) (ip, cidr string, port int) {
+    if strings.HasPrefix(part, "[") {
+        if end := strings.Index(part, "]"); end > 0 {
+            ip = part[1:end]
+            rest := part[end+1:]
+            if strings.HasPrefix(rest, "/") {
+                cidr = rest[1:]
+            } else if strings.HasPrefix(rest, ":") {
+                port, _ = strconv.Atoi(rest[1:])
+            }
+            return ip, cidr, port
+        }
+    }
+    
+    if i := strings.LastIndex(part, "/"); i >= 0 {
+        return part[:i], part[i+1:], 0
+    }
+    
+    if strings.Count(part, ":") == 1 {
+        host, p, _ := strings.Cut(part, ":")
+        port, _ = strconv.Atoi(p)
+        return host, "", port
+    }
+    
+    return part, "", 0
+}
+
 func getIPSetSets() ([]string, error) {
     cmd := exec.Command("ipset", "list", "-n")
     output, err := cmd.Output()
@@ -160,6 +210,21 @@ func getIPSetRules(setName string) ([]ImportedRule, error) {
     return parseIPSetData(string(output), fmt.Sprintf("system:%s", setName))
 }
 
+// getIPSetSaved читает все сеты ядра командой ipset save (ipsetPath - путь
+// к ipset) в виде для сравнения с сервером
+func getIPSetSaved(ipsetPath string) (map[string]*drift.Set, error) {
+    cmd := exec.Command(ipsetPath, "save")
+    output, err := cmd.Output()
+    if err != nil {
+        if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+            return nil, fmt.Errorf("%s save: %s", ipsetPath, strings.TrimSpace(string(exitErr.Stderr)))
+        }
+        return nil, fmt.Errorf("%s save: %v", ipsetPath, err)
+    }
+    
+    return drift.ParseSave(string(output)), nil
+}
+
 func commandExists(cmd string) bool {
     _, err := exec.LookPath(cmd)
     return err == nil
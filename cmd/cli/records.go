@@ -4,7 +4,12 @@ package main
 import (
     "encoding/json"
     "fmt"
-    //"strconv"
+    "net/url"
+    "os"
+    "strconv"
+    
+    "ipset-api-server/pkg/schedule"
+    "ipset-api-server/pkg/validation"
     
     "github.com/spf13/cobra"
 )
@@ -21,16 +26,35 @@ func NewRecordsCmd() *cobra.Command {
     cmd.AddCommand(NewUpdateRecordCmd())
     cmd.AddCommand(NewDeleteRecordCmd())
     cmd.AddCommand(NewSearchRecordsCmd())
+    cmd.AddCommand(NewRecordHistoryCmd())
+    cmd.AddCommand(NewRestoreRecordCmd())
+    cmd.AddCommand(NewBulkRecordsCmd())
 
     return cmd
 }
 
 func NewListRecordsCmd() *cobra.Command {
-    return &cobra.Command{
+    cmd := &cobra.Command{
         Use:   "list",
-        Short: "List all records",
+        Short: "List records",
+        Long:  `List records with server-side filtering and sorting. Pages are fetched automatically until --limit records are shown.`,
         Run:   runListRecords,
     }
+    
+    cmd.Flags().StringP("set-name", "s", "", "Filter by set name")
+    cmd.Flags().StringP("context", "x", "", "Filter by context (substring, case-insensitive)")
+    cmd.Flags().StringP("protocol", "r", "", "Filter by protocol")
+    cmd.Flags().IntP("port", "p", 0, "Filter by port")
+    cmd.Flags().String("created-after", "", "Only records created at or after this date (YYYY-MM-DD or RFC3339)")
+    cmd.Flags().String("created-before", "", "Only records created before this date")
+    cmd.Flags().String("updated-after", "", "Only records updated at or after this date")
+    cmd.Flags().String("updated-before", "", "Only records updated before this date")
+    cmd.Flags().String("sort", "id", "Sort field (id, set_name, ip, context, created_at, updated_at), prefix with - for descending")
+    cmd.Flags().IntP("limit", "l", 0, "Maximum number of records to show (0 - all)")
+    cmd.Flags().Int("page-size", 500, "Records per request")
+    cmd.Flags().String("cursor", "", "Continue from a cursor returned by a previous listing")
+    
+    return cmd
 }
 
 func NewGetRecordCmd() *cobra.Command {
@@ -50,17 +74,22 @@ func NewCreateRecordCmd() *cobra.Command {
     }
     
     cmd.Flags().StringP("set-name", "s", "", "Set name (required)")
-    cmd.Flags().StringP("ip", "i", "", "IP address (required)")
+    cmd.Flags().StringP("ip", "i", "", "IP address (MAC for hash:mac, member set for list:set)")
     cmd.Flags().StringP("cidr", "c", "", "CIDR mask")
     cmd.Flags().IntP("port", "p", 0, "Port number")
     cmd.Flags().StringP("protocol", "r", "", "Protocol (tcp/udp)")
+    cmd.Flags().String("second-ip", "", "Second IP or network (hash:ip,port,ip and hash:ip,port,net)")
     cmd.Flags().StringP("description", "d", "", "Description")
     cmd.Flags().StringP("context", "x", "", "Context (required)")
-    cmd.Flags().StringP("set-type", "t", "hash:ip", "Set type")
+    cmd.Flags().StringP("set-type", "t", "", "Set type (default: type of the existing set, hash:ip for a new set)")
     cmd.Flags().StringP("set-options", "o", "", "Set options")
+    cmd.Flags().Int("ttl", 0, "Delete the record after this many seconds")
+    cmd.Flags().String("expires-at", "", "Delete the record at this time (YYYY-MM-DD or RFC3339)")
+    cmd.Flags().String("active-from", "", "Export the record starting at this time (YYYY-MM-DD or RFC3339)")
+    cmd.Flags().String("schedule", "", "Export the record only in these windows, e.g. 'mon-fri 09:00-18:00'")
+    cmd.Flags().Bool("upsert", false, "Update the existing record if the set already contains this entry")
     
     cmd.MarkFlagRequired("set-name")
-    cmd.MarkFlagRequired("ip")
     cmd.MarkFlagRequired("context")
     
     return cmd
@@ -79,10 +108,15 @@ func NewUpdateRecordCmd() *cobra.Command {
     cmd.Flags().StringP("cidr", "c", "", "CIDR mask")
     cmd.Flags().IntP("port", "p", 0, "Port number")
     cmd.Flags().StringP("protocol", "r", "", "Protocol (tcp/udp)")
+    cmd.Flags().String("second-ip", "", "Second IP or network")
     cmd.Flags().StringP("description", "d", "", "Description")
     cmd.Flags().StringP("context", "x", "", "Context")
     cmd.Flags().StringP("set-type", "t", "", "Set type")
     cmd.Flags().StringP("set-options", "o", "", "Set options")
+    cmd.Flags().Int("ttl", 0, "New lifetime of the record in seconds from now")
+    cmd.Flags().String("expires-at", "", "New expiry time (YYYY-MM-DD or RFC3339)")
+    cmd.Flags().String("active-from", "", "New activation time (YYYY-MM-DD or RFC3339)")
+    cmd.Flags().String("schedule", "", "New activation schedule, empty string removes it")
     
     return cmd
 }
@@ -106,16 +140,56 @@ func NewSearchRecordsCmd() *cobra.Command {
 }
 
 func runListRecords(cmd *cobra.Command, args []string) {
-    data, err := makeRequest("GET", "/records", nil)
+    params := url.Values{}
+    
+    for flag, param := range map[string]string{
+        "set-name": "set_name",
+        "context":  "context",
+        "protocol": "protocol",
+        "sort":     "sort",
+        "cursor":   "cursor",
+    } {
+        if value, _ := cmd.Flags().GetString(flag); value != "" {
+            params.Set(param, value)
+        }
+    }
+    
+    for flag, param := range map[string]string{
+        "created-after":  "created_after",
+        "created-before": "created_before",
+        "updated-after":  "updated_after",
+        "updated-before": "updated_before",
+    } {
+        value, _ := cmd.Flags().GetString(flag)
+        value, err := timeFlag(value)
+        if err != nil {
+            fmt.Printf("Error: --%s: %v\n", flag, err)
+            return
+        }
+        if value != "" {
+            params.Set(param, value)
+        }
+    }
+    
+    if port, _ := cmd.Flags().GetInt("port"); port != 0 {
+        params.Set("port", strconv.Itoa(port))
+    }
+    
+    limit, _ := cmd.Flags().GetInt("limit")
+    pageSize, _ := cmd.Flags().GetInt("page-size")
+    params.Set("limit", strconv.Itoa(pageSize))
+    
+    records, next, err := fetchPages("/records", params, limit)
     if err != nil {
         fmt.Printf("Error: %v\n", err)
         return
     }
-
-    var records []map[string]interface{}
-    json.Unmarshal(data, &records)
     
     outputResults(records)
+    
+    if next != "" {
+        fmt.Fprintf(os.Stderr, "More records available, continue with --cursor %s\n", next)
+    }
 }
 
 func runGetRecord(cmd *cobra.Command, args []string) {
@@ -143,14 +217,35 @@ func runCreateRecord(cmd *cobra.Command, args []string) {
     context, _ := cmd.Flags().GetString("context")
     setType, _ := cmd.Flags().GetString("set-type")
     setOptions, _ := cmd.Flags().GetString("set-options")
+    secondIP, _ := cmd.Flags().GetString("second-ip")
+
+    // Без --set-type тип задает сет, и запись проверяет сервер
+    var err error
+    if setType == "" {
+        err = validation.ValidateSetName("set_name", setName)
+    } else {
+        err = validation.ValidateRecord(setName, setType, setOptions, validation.Entry{
+            IP:       ip,
+            CIDR:     cidr,
+            Port:     port,
+            Protocol: protocol,
+            SecondIP: secondIP,
+        })
+    }
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
 
     record := map[string]interface{}{
         "set_name": setName,
         "ip":       ip,
         "context":  context,
-        "set_type": setType,
     }
     
+    if setType != "" {
+        record["set_type"] = setType
+    }
     if setOptions != "" {
         record["set_options"] = setOptions
     }
@@ -166,10 +261,27 @@ func runCreateRecord(cmd *cobra.Command, args []string) {
     if description != "" {
         record["description"] = description
     }
+    if secondIP != "" {
+        record["second_ip"] = secondIP
+    }
+    if err := setExpiry(cmd, record); err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+    if err := setActivation(cmd, record); err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
 
     jsonData, _ := json.Marshal(record)
     
-    data, err := makeRequestWithBody("POST", "/records", jsonData)
+    // С --upsert сервер обновляет запись с тем же элементом вместо 409
+    path := "/records"
+    upsert, _ := cmd.Flags().GetBool("upsert")
+    if upsert {
+        path += "?upsert=true"
+    }
+    data, err := makeRequestWithBody("POST", path, jsonData)
     if err != nil {
         fmt.Printf("Error: %v\n", err)
         return
@@ -178,7 +290,7 @@ func runCreateRecord(cmd *cobra.Command, args []string) {
     var result map[string]interface{}
     json.Unmarshal(data, &result)
     
-    fmt.Println("Record created successfully:")
+    fmt.Println("Record saved successfully:")
     outputResults([]map[string]interface{}{result})
 }
 
@@ -202,6 +314,9 @@ func runUpdateRecord(cmd *cobra.Command, args []string) {
     if protocol, _ := cmd.Flags().GetString("protocol"); protocol != "" {
         record["protocol"] = protocol
     }
+    if secondIP, _ := cmd.Flags().GetString("second-ip"); secondIP != "" {
+        record["second_ip"] = secondIP
+    }
     if description, _ := cmd.Flags().GetString("description"); description != "" {
         record["description"] = description
     }
@@ -214,6 +329,14 @@ func runUpdateRecord(cmd *cobra.Command, args []string) {
     if setOptions, _ := cmd.Flags().GetString("set-options"); setOptions != "" {
         record["set_options"] = setOptions
     }
+    if err := setExpiry(cmd, record); err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+    if err := setActivation(cmd, record); err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
 
     jsonData, _ := json.Marshal(record)
     
@@ -230,6 +353,52 @@ func runUpdateRecord(cmd *cobra.Command, args []string) {
     outputResults([]map[string]interface{}{result})
 }
 
+// setExpiry переносит в запрос срок записи из флагов --ttl и --expires-at
+func setExpiry(cmd *cobra.Command, record map[string]interface{}) error {
+    ttl, _ := cmd.Flags().GetInt("ttl")
+    expiresAt, _ := cmd.Flags().GetString("expires-at")
+    if ttl != 0 && expiresAt != "" {
+        return fmt.Errorf("--ttl and --expires-at are mutually exclusive")
+    }
+    
+    if ttl != 0 {
+        record["ttl"] = ttl
+    }
+    expiresAt, err := timeFlag(expiresAt)
+    if err != nil {
+        return err
+    }
+    if expiresAt != "" {
+        record["expires_at"] = expiresAt
+    }
+    return nil
+}
+
+// setActivation переносит в запрос окно действия записи из флагов
+// --active-from и --schedule. Пустой --schedule при обновлении снимает
+// расписание, поэтому важно, был ли флаг указан, а не его значение.
+func setActivation(cmd *cobra.Command, record map[string]interface{}) error {
+    activeFrom, _ := cmd.Flags().GetString("active-from")
+    activeFrom, err := timeFlag(activeFrom)
+    if err != nil {
+        return err
+    }
+    if activeFrom != "" {
+        record["active_from"] = activeFrom
+    }
+    
+    if cmd.Flags().Changed("schedule") {
+        value, _ := cmd.Flags().GetString("schedule")
+        if value != "" {
+            if _, err := schedule.Parse(value); err != nil {
+                return fmt.Errorf("--schedule: %v", err)
+            }
+        }
+        record["schedule"] = value
+    }
+    return nil
+}
+
 func runDeleteRecord(cmd *cobra.Command, args []string) {
     id := args[0]
     
@@ -245,7 +414,7 @@ func runDeleteRecord(cmd *cobra.Command, args []string) {
 func runSearchRecords(cmd *cobra.Command, args []string) {
     query := args[0]
     
-    data, err := makeRequest("GET", "/records/search?q="+query, nil)
+    data, err := makeRequest("GET", "/records/search?q="+url.QueryEscape(query), nil)
     if err != nil {
         fmt.Printf("Error: %v\n", err)
         return
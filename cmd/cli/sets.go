@@ -4,6 +4,7 @@ package main
 import (
     "encoding/json"
     "fmt"
+    "net/url"
     
     "github.com/olekukonko/tablewriter"
     "github.com/spf13/cobra"
@@ -13,14 +14,21 @@ func NewSetsCmd() *cobra.Command {
     cmd := &cobra.Command{
         Use:   "sets",
         Short: "Manage IPSet sets",
-        Long:  `List, get, delete and export IPSet sets`,
+        Long:  `Create, update, list, get, delete, rename, copy, swap and export IPSet sets`,
     }
 
     // Добавляем все подкоманды для sets
     cmd.AddCommand(NewListSetsCmd())
+    cmd.AddCommand(NewCreateSetCmd())
+    cmd.AddCommand(NewUpdateSetCmd())
     cmd.AddCommand(NewGetSetCmd())
     cmd.AddCommand(NewDeleteSetCmd())
     cmd.AddCommand(NewExportSetCmd())  // Это правильное название команды
+    cmd.AddCommand(NewRestoreSetCmd())
+    cmd.AddCommand(NewRenameSetCmd())
+    cmd.AddCommand(NewCopySetCmd())
+    cmd.AddCommand(NewSwapSetsCmd())
+    cmd.AddCommand(NewDiffSetsCmd())
 
     return cmd
 }
@@ -33,13 +41,57 @@ func NewListSetsCmd() *cobra.Command {
     }
 }
 
+func NewCreateSetCmd() *cobra.Command {
+    cmd := &cobra.Command{
+        Use:   "create [set-name]",
+        Short: "Create a set",
+        Long: `Create a set, possibly empty. Records added to the set get its type and options.
+Examples:
+  ipset-cli sets create blacklist
+  ipset-cli sets create office-nets --type hash:net --family inet6 --description "Office networks"`,
+        Args: cobra.ExactArgs(1),
+        Run:  runCreateSet,
+    }
+    
+    cmd.Flags().StringP("type", "t", "", "Set type (default hash:ip)")
+    cmd.Flags().StringP("options", "o", "", "Set options")
+    cmd.Flags().String("family", "", "Address family (inet or inet6)")
+    cmd.Flags().StringP("description", "d", "", "Description")
+    cmd.Flags().String("owner", "", "Owner (default: the API key)")
+    
+    return cmd
+}
+
+func NewUpdateSetCmd() *cobra.Command {
+    cmd := &cobra.Command{
+        Use:   "update [set-name]",
+        Short: "Update a set",
+        Long: `Update a set. Changing the type or options also updates every record of the set
+and fails if any record does not fit the new type.`,
+        Args: cobra.ExactArgs(1),
+        Run:  runUpdateSet,
+    }
+    
+    cmd.Flags().StringP("type", "t", "", "New set type")
+    cmd.Flags().StringP("options", "o", "", "New set options")
+    cmd.Flags().String("family", "", "New address family (inet or inet6)")
+    cmd.Flags().StringP("description", "d", "", "New description")
+    cmd.Flags().String("owner", "", "New owner")
+    
+    return cmd
+}
+
 func NewGetSetCmd() *cobra.Command {
-    return &cobra.Command{
+    cmd := &cobra.Command{
         Use:   "get [set-name]",
         Short: "Get details of a specific set",
         Args:  cobra.ExactArgs(1),
         Run:   runGetSet,
     }
+    
+    cmd.Flags().String("as-of", "", "Show the set as it was at this time (YYYY-MM-DD or RFC3339)")
+    
+    return cmd
 }
 
 func NewDeleteSetCmd() *cobra.Command {
@@ -65,66 +117,213 @@ func NewExportSetCmd() *cobra.Command {
     return cmd
 }
 
+func NewRenameSetCmd() *cobra.Command {
+    return &cobra.Command{
+        Use:   "rename [set-name] [new-name]",
+        Short: "Rename a set with all its records",
+        Args:  cobra.ExactArgs(2),
+        Run:   runRenameSet,
+    }
+}
+
+func NewCopySetCmd() *cobra.Command {
+    return &cobra.Command{
+        Use:   "copy [set-name] [new-name]",
+        Short: "Copy a set with all its records",
+        Long:  `Create a new set with the type, options and records of an existing set. Copied records get new IDs.`,
+        Args:  cobra.ExactArgs(2),
+        Run:   runCopySet,
+    }
+}
+
+func NewSwapSetsCmd() *cobra.Command {
+    return &cobra.Command{
+        Use:   "swap [from-set] [to-set]",
+        Short: "Swap the contents of two sets",
+        Long: `Swap the contents of two sets of the same type and family, like ipset swap.
+Build the new list in a temporary set, then swap it with the live one:
+  ipset-cli sets copy blacklist blacklist-new
+  ipset-cli records create -s blacklist-new -i 10.0.0.1
+  ipset-cli sets swap blacklist-new blacklist
+  ipset-cli sets delete blacklist-new`,
+        Args: cobra.ExactArgs(2),
+        Run:  runSwapSets,
+    }
+}
+
 func runListSets(cmd *cobra.Command, args []string) {
-    data, err := makeRequest("GET", "/sets", nil)
+    sets, _, err := fetchPages("/sets", url.Values{}, 0)
     if err != nil {
         fmt.Printf("Error: %v\n", err)
         return
     }
 
+    switch config.Output {
+    case "json":
+        outputAsJSON(sets)
+    case "yaml":
+        outputAsYAML(sets)
+    default:
+        outputSetsTable(cmd, sets)
+    }
+}
+
+func outputSetsTable(cmd *cobra.Command, sets []map[string]interface{}) {
+    table := tablewriter.NewWriter(cmd.OutOrStdout())
+    table.SetHeader([]string{"Set Name", "Type", "Family", "Records", "Owner", "Description", "Created", "Updated"})
+    table.SetBorder(false)
+    table.SetRowLine(true)
+    table.SetColumnSeparator("│")
+    table.SetHeaderColor(
+        tablewriter.Colors{tablewriter.Bold, tablewriter.FgCyanColor},
+        tablewriter.Colors{tablewriter.Bold, tablewriter.FgCyanColor},
+        tablewriter.Colors{tablewriter.Bold, tablewriter.FgCyanColor},
+        tablewriter.Colors{tablewriter.Bold, tablewriter.FgCyanColor},
+        tablewriter.Colors{tablewriter.Bold, tablewriter.FgCyanColor},
+        tablewriter.Colors{tablewriter.Bold, tablewriter.FgCyanColor},
+        tablewriter.Colors{tablewriter.Bold, tablewriter.FgCyanColor},
+        tablewriter.Colors{tablewriter.Bold, tablewriter.FgCyanColor},
+    )
+    
+    for _, set := range sets {
+        table.Append([]string{
+            fmt.Sprintf("%v", set["name"]),
+            fmt.Sprintf("%v", set["type"]),
+            fmt.Sprintf("%v", set["family"]),
+            fmt.Sprintf("%v", set["record_count"]),
+            fmt.Sprintf("%v", set["owner"]),
+            truncateString(fmt.Sprintf("%v", set["description"]), 30),
+            formatDate(set["created_at"]),
+            formatDate(set["updated_at"]),
+        })
+    }
+    
+    table.Render()
+}
+
+// setFlags переносит в запрос флаги сета; при изменении - только заданные
+func setFlags(cmd *cobra.Command, set map[string]interface{}, changedOnly bool) {
+    for _, flag := range []string{"type", "options", "family", "description", "owner"} {
+        value, _ := cmd.Flags().GetString(flag)
+        if cmd.Flags().Changed(flag) || (!changedOnly && value != "") {
+            set[flag] = value
+        }
+    }
+}
+
+func runCreateSet(cmd *cobra.Command, args []string) {
+    set := map[string]interface{}{"name": args[0]}
+    setFlags(cmd, set, false)
+    
+    jsonData, _ := json.Marshal(set)
+    data, err := makeRequestWithBody("POST", "/sets", jsonData)
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+    
+    outputSet(cmd, data, "Set created successfully:")
+}
+
+func runUpdateSet(cmd *cobra.Command, args []string) {
+    set := make(map[string]interface{})
+    setFlags(cmd, set, true)
+    if len(set) == 0 {
+        fmt.Println("Error: nothing to update")
+        return
+    }
+    
+    jsonData, _ := json.Marshal(set)
+    data, err := makeRequestWithBody("PUT", "/sets/"+args[0], jsonData)
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+    
+    outputSet(cmd, data, "Set updated successfully:")
+}
+
+func runRenameSet(cmd *cobra.Command, args []string) {
+    jsonData, _ := json.Marshal(map[string]string{"name": args[1]})
+    data, err := makeRequestWithBody("POST", "/sets/"+args[0]+"/rename", jsonData)
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+    
+    outputSet(cmd, data, fmt.Sprintf("Set %s renamed to %s:", args[0], args[1]))
+}
+
+func runCopySet(cmd *cobra.Command, args []string) {
+    jsonData, _ := json.Marshal(map[string]string{"name": args[1]})
+    data, err := makeRequestWithBody("POST", "/sets/"+args[0]+"/copy", jsonData)
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+    
+    outputSet(cmd, data, fmt.Sprintf("Set %s copied to %s:", args[0], args[1]))
+}
+
+func runSwapSets(cmd *cobra.Command, args []string) {
+    jsonData, _ := json.Marshal(map[string]string{"from": args[0], "to": args[1]})
+    data, err := makeRequestWithBody("POST", "/sets/swap", jsonData)
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+    
     var sets []map[string]interface{}
     if err := json.Unmarshal(data, &sets); err != nil {
         fmt.Printf("Error parsing response: %v\n", err)
         return
     }
-
+    
     switch config.Output {
     case "json":
         outputAsJSON(sets)
     case "yaml":
         outputAsYAML(sets)
-    case "table":
-        fallthrough
     default:
-        table := tablewriter.NewWriter(cmd.OutOrStdout())
-        table.SetHeader([]string{"Set Name", "Type", "Records", "Created", "Updated"})
-        table.SetBorder(false)
-        table.SetRowLine(true)
-        table.SetColumnSeparator("│")
-        table.SetHeaderColor(
-            tablewriter.Colors{tablewriter.Bold, tablewriter.FgCyanColor},
-            tablewriter.Colors{tablewriter.Bold, tablewriter.FgCyanColor},
-            tablewriter.Colors{tablewriter.Bold, tablewriter.FgCyanColor},
-            tablewriter.Colors{tablewriter.Bold, tablewriter.FgCyanColor},
-            tablewriter.Colors{tablewriter.Bold, tablewriter.FgCyanColor},
-        )
-        
-        for _, set := range sets {
-            var recordCount int
-            if records, ok := set["records"].([]interface{}); ok {
-                recordCount = len(records)
-            }
-            
-            created := formatDate(set["created_at"])
-            updated := formatDate(set["updated_at"])
-            
-            table.Append([]string{
-                fmt.Sprintf("%v", set["name"]),
-                fmt.Sprintf("%v", set["type"]),
-                fmt.Sprintf("%d", recordCount),
-                created,
-                updated,
-            })
-        }
-        
-        table.Render()
+        fmt.Printf("Sets %s and %s swapped:\n", args[0], args[1])
+        outputSetsTable(cmd, sets)
+    }
+}
+
+func outputSet(cmd *cobra.Command, data []byte, message string) {
+    var set map[string]interface{}
+    if err := json.Unmarshal(data, &set); err != nil {
+        fmt.Printf("Error parsing response: %v\n", err)
+        return
+    }
+    
+    switch config.Output {
+    case "json":
+        outputAsJSON(set)
+    case "yaml":
+        outputAsYAML(set)
+    default:
+        fmt.Println(message)
+        outputSetsTable(cmd, []map[string]interface{}{set})
     }
 }
 
 func runGetSet(cmd *cobra.Command, args []string) {
     setName := args[0]
     
-    data, err := makeRequest("GET", "/sets/"+setName, nil)
+    asOf, _ := cmd.Flags().GetString("as-of")
+    asOf, err := timeFlag(asOf)
+    if err != nil {
+        fmt.Printf("Error: --as-of: %v\n", err)
+        return
+    }
+    
+    path := "/sets/" + setName
+    if asOf != "" {
+        path += "?as_of=" + url.QueryEscape(asOf)
+    }
+    
+    data, err := makeRequest("GET", path, nil)
     if err != nil {
         fmt.Printf("Error: %v\n", err)
         return
@@ -136,7 +335,22 @@ func runGetSet(cmd *cobra.Command, args []string) {
         return
     }
 
-    outputResults([]map[string]interface{}{set})
+    if config.Output != "" && config.Output != "table" {
+        outputResults([]map[string]interface{}{set})
+        return
+    }
+    
+    // Сет и под ним его записи
+    outputSetsTable(cmd, []map[string]interface{}{set})
+    var records []map[string]interface{}
+    if items, ok := set["records"].([]interface{}); ok {
+        for _, item := range items {
+            if record, ok := item.(map[string]interface{}); ok {
+                records = append(records, record)
+            }
+        }
+    }
+    outputAsTable(records)
 }
 
 func runDeleteSet(cmd *cobra.Command, args []string) {
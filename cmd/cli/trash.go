@@ -0,0 +1,145 @@
+// cmd/cli/trash.go
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/url"
+    "os"
+    "strconv"
+    
+    "github.com/olekukonko/tablewriter"
+    "github.com/spf13/cobra"
+)
+
+func NewTrashCmd() *cobra.Command {
+    cmd := &cobra.Command{
+        Use:   "trash",
+        Short: "Show deleted records that can still be restored",
+    }
+
+    cmd.AddCommand(NewListTrashCmd())
+
+    return cmd
+}
+
+func NewListTrashCmd() *cobra.Command {
+    cmd := &cobra.Command{
+        Use:   "list",
+        Short: "List deleted records",
+        Long: `List deleted records. Filters and sorting are the same as for 'records list'.
+Deleted records are purged after the server's trash retention period.
+Examples:
+  ipset-cli trash list
+  ipset-cli trash list -s blacklist
+  ipset-cli trash list --sort -updated_at -o json`,
+        Run: runListTrash,
+    }
+    
+    cmd.Flags().StringP("set-name", "s", "", "Filter by set name")
+    cmd.Flags().StringP("context", "x", "", "Filter by context (substring, case-insensitive)")
+    cmd.Flags().String("sort", "id", "Sort field (id, set_name, ip, context, created_at, updated_at), prefix with - for descending")
+    cmd.Flags().IntP("limit", "l", 0, "Maximum number of records to show (0 - all)")
+    cmd.Flags().Int("page-size", 500, "Records per request")
+    cmd.Flags().String("cursor", "", "Continue from a cursor returned by a previous listing")
+    
+    return cmd
+}
+
+func NewRestoreRecordCmd() *cobra.Command {
+    return &cobra.Command{
+        Use:   "restore [id]",
+        Short: "Restore a deleted record from the trash",
+        Long: `Restore a deleted record from the trash with its previous ID.
+Examples:
+  ipset-cli records restore 123456`,
+        Args: cobra.ExactArgs(1),
+        Run:  runRestoreRecord,
+    }
+}
+
+func runListTrash(cmd *cobra.Command, args []string) {
+    params := url.Values{}
+    
+    for flag, param := range map[string]string{
+        "set-name": "set_name",
+        "context":  "context",
+        "sort":     "sort",
+        "cursor":   "cursor",
+    } {
+        if value, _ := cmd.Flags().GetString(flag); value != "" {
+            params.Set(param, value)
+        }
+    }
+    
+    limit, _ := cmd.Flags().GetInt("limit")
+    pageSize, _ := cmd.Flags().GetInt("page-size")
+    params.Set("limit", strconv.Itoa(pageSize))
+    
+    records, next, err := fetchPages("/trash", params, limit)
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+    
+    switch config.Output {
+    case "json":
+        outputAsJSON(records)
+    case "yaml":
+        outputAsYAML(records)
+    default:
+        outputTrashTable(records)
+    }
+    
+    if next != "" {
+        fmt.Fprintf(os.Stderr, "More records available, continue with --cursor %s\n", next)
+    }
+}
+
+func outputTrashTable(records []map[string]interface{}) {
+    if len(records) == 0 {
+        fmt.Println("Trash is empty")
+        return
+    }
+    
+    table := tablewriter.NewWriter(os.Stdout)
+    table.SetHeader([]string{"ID", "Set Name", "IP", "CIDR", "Port", "Protocol", "Context", "Deleted"})
+    table.SetBorder(false)
+    table.SetColumnSeparator("│")
+    
+    for _, record := range records {
+        table.Append([]string{
+            formatNumber(record["id"]),
+            historyValue(record["set_name"]),
+            historyValue(record["ip"]),
+            historyValue(record["cidr"]),
+            formatNumber(record["port"]),
+            historyValue(record["protocol"]),
+            truncateString(historyValue(record["context"]), 20),
+            formatTime(record["deleted_at"]),
+        })
+    }
+    
+    table.Render()
+}
+
+func runRestoreRecord(cmd *cobra.Command, args []string) {
+    data, err := makeRequest("POST", "/records/"+args[0]+"/restore", nil)
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+    
+    var record map[string]interface{}
+    if err := json.Unmarshal(data, &record); err != nil {
+        fmt.Printf("Error parsing response: %v\n", err)
+        return
+    }
+    
+    switch config.Output {
+    case "json", "yaml":
+        outputResults([]map[string]interface{}{record})
+    default:
+        fmt.Printf("Record %s restored\n", args[0])
+    }
+}
@@ -0,0 +1,128 @@
+// cmd/cli/watch.go
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/url"
+    "strconv"
+    "time"
+
+    "github.com/spf13/cobra"
+)
+
+// watchPollTimeout - сколько сервер держит один длинный опрос
+const watchPollTimeout = 30 * time.Second
+
+func NewWatchCmd() *cobra.Command {
+    cmd := &cobra.Command{
+        Use:   "watch",
+        Short: "Follow record and set changes as they happen",
+        Long: `Follow record and set changes (GET /watch). Each change has a revision
+number; start with --since to get the changes after it (for example the
+X-Revision header of a set export), otherwise only new changes are shown.
+With --output json every change is printed as one JSON line.
+Examples:
+  ipset-cli watch
+  ipset-cli watch --set-name blacklist --since 1500
+  ipset-cli watch --since 0 --once --output json`,
+        Run: runWatch,
+    }
+
+    cmd.Flags().Int64("since", -1, "Show changes after this revision (default: only new changes)")
+    cmd.Flags().StringP("set-name", "s", "", "Only changes of this set")
+    cmd.Flags().Bool("once", false, "Print the first batch of changes and exit")
+
+    return cmd
+}
+
+func runWatch(cmd *cobra.Command, args []string) {
+    since, _ := cmd.Flags().GetInt64("since")
+    setName, _ := cmd.Flags().GetString("set-name")
+    once, _ := cmd.Flags().GetBool("once")
+
+    // Сервер держит запрос до первого изменения
+    client.Timeout = watchPollTimeout + 10*time.Second
+
+    params := url.Values{}
+    if setName != "" {
+        params.Set("set_name", setName)
+    }
+
+    // Без --since поток начинается с текущего номера
+    if since < 0 {
+        result, err := fetchChanges(params, 0)
+        if err != nil {
+            fmt.Printf("Error: %v\n", err)
+            return
+        }
+        since = result.Revision
+        if config.Output != "json" {
+            fmt.Printf("Watching changes after revision %d\n", since)
+        }
+    }
+
+    for {
+        params.Set("since", strconv.FormatInt(since, 10))
+        result, err := fetchChanges(params, watchPollTimeout)
+        if err != nil {
+            fmt.Printf("Error: %v\n", err)
+            return
+        }
+        since = result.Revision
+
+        for _, change := range result.Changes {
+            printChange(change)
+        }
+        if once {
+            return
+        }
+    }
+}
+
+type watchResult struct {
+    Revision int64             `json:"revision"`
+    Changes  []json.RawMessage `json:"changes"`
+}
+
+// fetchChanges - один длинный опрос GET /watch
+func fetchChanges(params url.Values, timeout time.Duration) (*watchResult, error) {
+    params.Set("timeout", strconv.Itoa(int(timeout.Seconds())))
+    data, err := makeRequest("GET", "/watch?"+params.Encode(), nil)
+    if err != nil {
+        return nil, err
+    }
+
+    var result watchResult
+    if err := json.Unmarshal(data, &result); err != nil {
+        return nil, fmt.Errorf("failed to parse response: %v", err)
+    }
+    return &result, nil
+}
+
+// printChange печатает изменение строкой JSON или строкой текста
+func printChange(data json.RawMessage) {
+    if config.Output == "json" {
+        fmt.Println(string(data))
+        return
+    }
+
+    var change map[string]interface{}
+    if err := json.Unmarshal(data, &change); err != nil {
+        fmt.Printf("Error parsing change: %v\n", err)
+        return
+    }
+    line := fmt.Sprintf("#%s %s %-6s %-6s %s", formatNumber(change["revision"]),
+        formatTime(change["changed_at"]), change["operation"], change["kind"], change["set_name"])
+    if record, ok := change["record"].(map[string]interface{}); ok {
+        entry := fmt.Sprintf("%v", record["ip"])
+        if cidr, _ := record["cidr"].(string); cidr != "" {
+            entry += "/" + cidr
+        }
+        if port := formatNumber(record["port"]); port != "" && port != "0" {
+            entry += fmt.Sprintf(",%v:%s", record["protocol"], port)
+        }
+        line += fmt.Sprintf(" %s %s", formatNumber(record["id"]), entry)
+    }
+    fmt.Println(line)
+}
@@ -0,0 +1,397 @@
+// cmd/cli/webhooks.go
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/url"
+    "os"
+    "strconv"
+    "strings"
+    
+    "github.com/olekukonko/tablewriter"
+    "github.com/spf13/cobra"
+)
+
+func NewWebhooksCmd() *cobra.Command {
+    cmd := &cobra.Command{
+        Use:   "webhooks",
+        Short: "Manage webhook subscriptions",
+        Long: `Manage webhook subscriptions. The server POSTs every matching change of a set or
+record to the subscribed URL, signed with HMAC-SHA256, and retries failed deliveries.`,
+    }
+
+    cmd.AddCommand(NewListWebhooksCmd())
+    cmd.AddCommand(NewCreateWebhookCmd())
+    cmd.AddCommand(NewGetWebhookCmd())
+    cmd.AddCommand(NewUpdateWebhookCmd())
+    cmd.AddCommand(NewDeleteWebhookCmd())
+    cmd.AddCommand(NewListDeliveriesCmd())
+    cmd.AddCommand(NewRetryDeliveryCmd())
+
+    return cmd
+}
+
+func NewListWebhooksCmd() *cobra.Command {
+    return &cobra.Command{
+        Use:   "list",
+        Short: "List webhook subscriptions",
+        Run:   runListWebhooks,
+    }
+}
+
+func NewCreateWebhookCmd() *cobra.Command {
+    cmd := &cobra.Command{
+        Use:   "create [url]",
+        Short: "Subscribe a URL to changes",
+        Long: `Subscribe a URL to changes. Without --event the webhook receives every event,
+without --set-name changes of every set. The signing secret is printed only once.
+Examples:
+  ipset-cli webhooks create https://siem.example.com/ipset
+  ipset-cli webhooks create https://bot.example.com/hook -e record.create -e record.delete -s blacklist`,
+        Args: cobra.ExactArgs(1),
+        Run:  runCreateWebhook,
+    }
+    
+    webhookFlags(cmd)
+    
+    return cmd
+}
+
+func NewGetWebhookCmd() *cobra.Command {
+    return &cobra.Command{
+        Use:   "get [id]",
+        Short: "Get a webhook subscription",
+        Args:  cobra.ExactArgs(1),
+        Run:   runGetWebhook,
+    }
+}
+
+func NewUpdateWebhookCmd() *cobra.Command {
+    cmd := &cobra.Command{
+        Use:   "update [id]",
+        Short: "Update a webhook subscription",
+        Long: `Update a webhook subscription. Only the given flags are changed.
+Examples:
+  ipset-cli webhooks update 1 --active=false
+  ipset-cli webhooks update 1 --url https://siem.example.com/v2/ipset --secret new-secret`,
+        Args: cobra.ExactArgs(1),
+        Run:  runUpdateWebhook,
+    }
+    
+    cmd.Flags().String("url", "", "New URL")
+    webhookFlags(cmd)
+    
+    return cmd
+}
+
+func NewDeleteWebhookCmd() *cobra.Command {
+    return &cobra.Command{
+        Use:   "delete [id]",
+        Short: "Delete a webhook subscription and its deliveries",
+        Args:  cobra.ExactArgs(1),
+        Run:   runDeleteWebhook,
+    }
+}
+
+func NewListDeliveriesCmd() *cobra.Command {
+    cmd := &cobra.Command{
+        Use:   "deliveries",
+        Short: "Show the delivery log",
+        Long: `Show the delivery log, newest first. Deliveries that failed every attempt have
+status dead and can be sent again with 'webhooks retry'.
+Examples:
+  ipset-cli webhooks deliveries -w 1
+  ipset-cli webhooks deliveries --status dead`,
+        Run: runListDeliveries,
+    }
+    
+    cmd.Flags().Int64P("webhook", "w", 0, "Filter by webhook ID")
+    cmd.Flags().String("status", "", "Filter by status (pending, delivered, dead)")
+    cmd.Flags().IntP("limit", "l", 0, "Maximum number of deliveries to show (0 - all)")
+    cmd.Flags().Int("page-size", 500, "Deliveries per request")
+    cmd.Flags().String("cursor", "", "Continue from a cursor returned by a previous listing")
+    
+    return cmd
+}
+
+func NewRetryDeliveryCmd() *cobra.Command {
+    return &cobra.Command{
+        Use:   "retry [delivery-id]",
+        Short: "Send a delivery again",
+        Long: `Queue a delivery, usually a dead one, again with the full number of attempts.
+Examples:
+  ipset-cli webhooks retry 42`,
+        Args: cobra.ExactArgs(1),
+        Run:  runRetryDelivery,
+    }
+}
+
+// webhookFlags - флаги подписки, общие для create и update
+func webhookFlags(cmd *cobra.Command) {
+    cmd.Flags().StringSliceP("event", "e", nil, "Event to send (record.create, record.update, record.delete, set.create, set.update, set.delete), repeatable")
+    cmd.Flags().StringSliceP("set-name", "s", nil, "Send changes of this set only, repeatable")
+    cmd.Flags().String("secret", "", "Signing secret (default: generated by the server)")
+    cmd.Flags().StringP("description", "d", "", "Description")
+    cmd.Flags().Bool("active", true, "Send deliveries to the webhook")
+}
+
+// webhookBody собирает тело запроса из заданных флагов
+func webhookBody(cmd *cobra.Command) map[string]interface{} {
+    body := make(map[string]interface{})
+    
+    for flag, field := range map[string]string{
+        "url":         "url",
+        "secret":      "secret",
+        "description": "description",
+    } {
+        if cmd.Flags().Lookup(flag) != nil && cmd.Flags().Changed(flag) {
+            body[field], _ = cmd.Flags().GetString(flag)
+        }
+    }
+    for flag, field := range map[string]string{
+        "event":    "events",
+        "set-name": "set_names",
+    } {
+        if cmd.Flags().Changed(flag) {
+            body[field], _ = cmd.Flags().GetStringSlice(flag)
+        }
+    }
+    if cmd.Flags().Changed("active") {
+        body["active"], _ = cmd.Flags().GetBool("active")
+    }
+    
+    return body
+}
+
+func runListWebhooks(cmd *cobra.Command, args []string) {
+    data, err := makeRequest("GET", "/webhooks", nil)
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+    
+    var webhooks []map[string]interface{}
+    if err := json.Unmarshal(data, &webhooks); err != nil {
+        fmt.Printf("Error parsing response: %v\n", err)
+        return
+    }
+    
+    switch config.Output {
+    case "json":
+        outputAsJSON(webhooks)
+    case "yaml":
+        outputAsYAML(webhooks)
+    default:
+        outputWebhooksTable(webhooks)
+    }
+}
+
+func runCreateWebhook(cmd *cobra.Command, args []string) {
+    body := webhookBody(cmd)
+    body["url"] = args[0]
+    
+    jsonData, _ := json.Marshal(body)
+    data, err := makeRequestWithBody("POST", "/webhooks", jsonData)
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+    
+    webhook := outputWebhook(data, "Webhook created successfully:")
+    if webhook != nil && config.Output != "json" && config.Output != "yaml" {
+        fmt.Printf("\nSigning secret (shown only once): %v\n", webhook["secret"])
+    }
+}
+
+func runGetWebhook(cmd *cobra.Command, args []string) {
+    data, err := makeRequest("GET", "/webhooks/"+args[0], nil)
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+    
+    outputWebhook(data, "")
+}
+
+func runUpdateWebhook(cmd *cobra.Command, args []string) {
+    body := webhookBody(cmd)
+    if len(body) == 0 {
+        fmt.Println("Error: nothing to update")
+        return
+    }
+    
+    jsonData, _ := json.Marshal(body)
+    data, err := makeRequestWithBody("PUT", "/webhooks/"+args[0], jsonData)
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+    
+    outputWebhook(data, "Webhook updated successfully:")
+}
+
+func runDeleteWebhook(cmd *cobra.Command, args []string) {
+    if _, err := makeRequest("DELETE", "/webhooks/"+args[0], nil); err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+    
+    fmt.Printf("Webhook %s deleted successfully\n", args[0])
+}
+
+func runListDeliveries(cmd *cobra.Command, args []string) {
+    params := url.Values{}
+    
+    if webhook, _ := cmd.Flags().GetInt64("webhook"); webhook > 0 {
+        params.Set("webhook_id", strconv.FormatInt(webhook, 10))
+    }
+    for flag, param := range map[string]string{
+        "status": "status",
+        "cursor": "cursor",
+    } {
+        if value, _ := cmd.Flags().GetString(flag); value != "" {
+            params.Set(param, value)
+        }
+    }
+    
+    limit, _ := cmd.Flags().GetInt("limit")
+    pageSize, _ := cmd.Flags().GetInt("page-size")
+    params.Set("limit", strconv.Itoa(pageSize))
+    
+    deliveries, next, err := fetchPages("/webhooks/deliveries", params, limit)
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+    
+    switch config.Output {
+    case "json":
+        outputAsJSON(deliveries)
+    case "yaml":
+        outputAsYAML(deliveries)
+    default:
+        outputDeliveriesTable(deliveries)
+    }
+    
+    if next != "" {
+        fmt.Fprintf(os.Stderr, "More deliveries available, continue with --cursor %s\n", next)
+    }
+}
+
+func runRetryDelivery(cmd *cobra.Command, args []string) {
+    data, err := makeRequest("POST", "/webhooks/deliveries/"+args[0]+"/retry", nil)
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+    
+    var delivery map[string]interface{}
+    if err := json.Unmarshal(data, &delivery); err != nil {
+        fmt.Printf("Error parsing response: %v\n", err)
+        return
+    }
+    
+    switch config.Output {
+    case "json":
+        outputAsJSON(delivery)
+    case "yaml":
+        outputAsYAML(delivery)
+    default:
+        fmt.Printf("Delivery %s queued again\n", args[0])
+    }
+}
+
+// outputWebhook печатает подписку из ответа сервера и возвращает ее
+func outputWebhook(data []byte, message string) map[string]interface{} {
+    var webhook map[string]interface{}
+    if err := json.Unmarshal(data, &webhook); err != nil {
+        fmt.Printf("Error parsing response: %v\n", err)
+        return nil
+    }
+    
+    switch config.Output {
+    case "json":
+        outputAsJSON(webhook)
+    case "yaml":
+        outputAsYAML(webhook)
+    default:
+        if message != "" {
+            fmt.Println(message)
+        }
+        outputWebhooksTable([]map[string]interface{}{webhook})
+    }
+    return webhook
+}
+
+func outputWebhooksTable(webhooks []map[string]interface{}) {
+    if len(webhooks) == 0 {
+        fmt.Println("No webhooks found")
+        return
+    }
+    
+    table := tablewriter.NewWriter(os.Stdout)
+    table.SetHeader([]string{"ID", "URL", "Events", "Sets", "Active", "Description", "Updated"})
+    table.SetBorder(false)
+    table.SetColumnSeparator("│")
+    
+    for _, webhook := range webhooks {
+        table.Append([]string{
+            formatNumber(webhook["id"]),
+            historyValue(webhook["url"]),
+            webhookList(webhook["events"], "all"),
+            webhookList(webhook["set_names"], "all"),
+            historyValue(webhook["active"]),
+            truncateString(historyValue(webhook["description"]), 30),
+            formatTime(webhook["updated_at"]),
+        })
+    }
+    
+    table.Render()
+}
+
+func outputDeliveriesTable(deliveries []map[string]interface{}) {
+    if len(deliveries) == 0 {
+        fmt.Println("No deliveries found")
+        return
+    }
+    
+    table := tablewriter.NewWriter(os.Stdout)
+    table.SetHeader([]string{"ID", "Webhook", "Revision", "Event", "Status", "Attempts", "HTTP", "Next Attempt", "Error"})
+    table.SetBorder(false)
+    table.SetColumnSeparator("│")
+    
+    for _, delivery := range deliveries {
+        next := ""
+        if delivery["status"] == "pending" {
+            next = formatTime(delivery["next_attempt_at"])
+        }
+        table.Append([]string{
+            formatNumber(delivery["id"]),
+            formatNumber(delivery["webhook_id"]),
+            formatNumber(delivery["revision"]),
+            historyValue(delivery["event"]),
+            historyValue(delivery["status"]),
+            formatNumber(delivery["attempts"]),
+            formatNumber(delivery["last_status"]),
+            next,
+            truncateString(historyValue(delivery["last_error"]), 40),
+        })
+    }
+    
+    table.Render()
+}
+
+// webhookList печатает список фильтра подписки; пустой список - все
+func webhookList(value interface{}, empty string) string {
+    items, _ := value.([]interface{})
+    if len(items) == 0 {
+        return empty
+    }
+    
+    values := make([]string, 0, len(items))
+    for _, item := range items {
+        values = append(values, fmt.Sprintf("%v", item))
+    }
+    return strings.Join(values, ", ")
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+    "context"
     "fmt"
     "log"
     "time"
@@ -27,7 +28,7 @@ func main() {
         IsActive:  true,
     }
     
-    if err := keyStorage.SaveKey(key); err != nil {
+    if err := keyStorage.SaveKey(context.Background(), key); err != nil {
         log.Fatalf("Failed to save key: %v", err)
     }
     
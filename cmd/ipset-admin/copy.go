@@ -0,0 +1,348 @@
+package main
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "flag"
+    "fmt"
+    "sort"
+    "strconv"
+    "time"
+    "ipset-api-server/internal/config"
+    "ipset-api-server/internal/models"
+    "ipset-api-server/internal/storage"
+)
+
+// loadConfig читает конфигурацию из env-файла или из окружения процесса.
+// Кэш отключается: административные команды работают напрямую с хранилищем.
+func loadConfig(envFile string) (*config.Config, error) {
+    cfg := config.Load()
+    if envFile != "" {
+        var err error
+        cfg, err = config.LoadFromFile(envFile)
+        if err != nil {
+            return nil, fmt.Errorf("failed to read %s: %v", envFile, err)
+        }
+    }
+    
+    cfg.IPSetCacheEnabled = false
+    return cfg, nil
+}
+
+func runCopy(args []string) error {
+    fs := flag.NewFlagSet("copy", flag.ExitOnError)
+    from := fs.String("from", "", "Source storage type (file, sqlite, mysql, postgresql, clickhouse)")
+    to := fs.String("to", "", "Target storage type (file, sqlite, mysql, postgresql, clickhouse)")
+    fromEnv := fs.String("from-env", "", "Env file with source storage settings (default: process environment)")
+    toEnv := fs.String("to-env", "", "Env file with target storage settings (default: process environment)")
+    copyKeys := fs.Bool("keys", true, "Copy API keys")
+    copyRecords := fs.Bool("records", true, "Copy ipset records")
+    overwrite := fs.Bool("overwrite", false, "Replace records that already exist in the target with the same ID")
+    dryRun := fs.Bool("dry-run", false, "Show what would be copied without writing anything")
+    fs.Parse(args)
+    
+    if *from == "" || *to == "" {
+        fs.Usage()
+        return fmt.Errorf("both -from and -to are required")
+    }
+    if *from == *to && *fromEnv == *toEnv {
+        return fmt.Errorf("source and target are the same storage")
+    }
+    
+    srcCfg, err := loadConfig(*fromEnv)
+    if err != nil {
+        return err
+    }
+    dstCfg, err := loadConfig(*toEnv)
+    if err != nil {
+        return err
+    }
+    
+    ctx := context.Background()
+    
+    if *copyKeys {
+        if err := copyKeyStorage(ctx, *from, srcCfg, *to, dstCfg, *dryRun); err != nil {
+            return err
+        }
+    }
+    
+    if *copyRecords {
+        if err := copyIPSetStorage(ctx, *from, srcCfg, *to, dstCfg, *overwrite, *dryRun); err != nil {
+            return err
+        }
+    }
+    
+    if *dryRun {
+        fmt.Println("Dry run completed, nothing was written")
+    } else {
+        fmt.Println("Copy completed and verified")
+    }
+    return nil
+}
+
+func copyKeyStorage(ctx context.Context, from string, srcCfg *config.Config, to string, dstCfg *config.Config, dryRun bool) error {
+    src, err := storage.NewKeyStorage(from, srcCfg)
+    if err != nil {
+        return fmt.Errorf("failed to open source key storage: %v", err)
+    }
+    dst, err := storage.NewKeyStorage(to, dstCfg)
+    if err != nil {
+        return fmt.Errorf("failed to open target key storage: %v", err)
+    }
+    
+    srcKeys, err := src.ListKeys(ctx)
+    if err != nil {
+        return fmt.Errorf("failed to list source keys: %v", err)
+    }
+    srcKeys = uniqueKeys(srcKeys)
+    
+    fmt.Printf("Keys: %d in %s (checksum %s)\n", len(srcKeys), from, keysChecksum(srcKeys))
+    if dryRun {
+        return nil
+    }
+    
+    for _, key := range srcKeys {
+        if err := dst.SaveKey(ctx, key); err != nil {
+            return fmt.Errorf("failed to save key: %v", err)
+        }
+    }
+    
+    // Проверяем, что в целевом хранилище оказались те же ключи
+    dstKeys, err := dst.ListKeys(ctx)
+    if err != nil {
+        return fmt.Errorf("failed to list target keys: %v", err)
+    }
+    wanted := make(map[string]bool, len(srcKeys))
+    for _, key := range srcKeys {
+        wanted[key.Key] = true
+    }
+    var copied []*models.AuthKey
+    for _, key := range uniqueKeys(dstKeys) {
+        if wanted[key.Key] {
+            copied = append(copied, key)
+        }
+    }
+    
+    if len(copied) != len(srcKeys) {
+        return fmt.Errorf("key count mismatch: source %d, target %d", len(srcKeys), len(copied))
+    }
+    if keysChecksum(copied) != keysChecksum(srcKeys) {
+        return fmt.Errorf("key checksum mismatch after copy")
+    }
+    
+    fmt.Printf("Keys: %d copied to %s\n", len(copied), to)
+    return nil
+}
+
+func copyIPSetStorage(ctx context.Context, from string, srcCfg *config.Config, to string, dstCfg *config.Config, overwrite, dryRun bool) error {
+    src, err := storage.NewIPSetStorage(from, srcCfg)
+    if err != nil {
+        return fmt.Errorf("failed to open source ipset storage: %v", err)
+    }
+    dst, err := storage.NewIPSetStorage(to, dstCfg)
+    if err != nil {
+        return fmt.Errorf("failed to open target ipset storage: %v", err)
+    }
+    
+    importer, ok := dst.(storage.RecordImporter)
+    if !ok {
+        return fmt.Errorf("target storage %s does not support importing records", to)
+    }
+    
+    srcRecords, err := src.GetAll(ctx)
+    if err != nil {
+        return fmt.Errorf("failed to read source records: %v", err)
+    }
+    srcRecords = uniqueRecords(srcRecords)
+    
+    dstRecords, err := dst.GetAll(ctx)
+    if err != nil {
+        return fmt.Errorf("failed to read target records: %v", err)
+    }
+    existing := make(map[int]bool)
+    for _, record := range dstRecords {
+        existing[record.ID] = true
+    }
+    
+    conflicts := 0
+    for _, record := range srcRecords {
+        if existing[record.ID] {
+            conflicts++
+        }
+    }
+    
+    fmt.Printf("Records: %d in %s (checksum %s), %d already in %s, %d with conflicting IDs\n",
+        len(srcRecords), from, recordsChecksum(srcRecords), len(existing), to, conflicts)
+    
+    // Копируются только действующие записи и сеты, остальное не переносится.
+    // Истекшие записи, которые сервер еще не удалил, GetAll тоже не отдает.
+    trashed, err := countTrash(ctx, src)
+    if err != nil {
+        return err
+    }
+    expired, err := countExpired(ctx, src)
+    if err != nil {
+        return err
+    }
+    fmt.Printf("Warning: not copied: %s expired records, %d records in the trash, record history, "+
+        "the change stream (GET /watch), the audit log, webhooks and their deliveries, the agent registry\n",
+        expired, trashed)
+    
+    if conflicts > 0 && !overwrite {
+        return fmt.Errorf("%d records already exist in target, use -overwrite to replace them", conflicts)
+    }
+    if dryRun {
+        return nil
+    }
+    
+    // Сеты копируются первыми: в них могут быть пустые сеты, а записи
+    // без сета хранилище заведет с типом по умолчанию
+    srcSets, err := src.GetAllSets(ctx)
+    if err != nil {
+        return fmt.Errorf("failed to read source sets: %v", err)
+    }
+    for _, set := range srcSets {
+        if err := importer.ImportSet(ctx, set); err != nil {
+            return fmt.Errorf("failed to copy set %s: %v", set.Name, err)
+        }
+    }
+    fmt.Printf("Sets: %d copied to %s\n", len(srcSets), to)
+    
+    for i, record := range srcRecords {
+        if err := importer.ImportRecord(ctx, record); err != nil {
+            return fmt.Errorf("failed after %d of %d records: %v", i, len(srcRecords), err)
+        }
+        if (i+1)%1000 == 0 {
+            fmt.Printf("  %d/%d records copied\n", i+1, len(srcRecords))
+        }
+    }
+    
+    // Проверяем количество и контрольную сумму скопированных записей
+    dstRecords, err = dst.GetAll(ctx)
+    if err != nil {
+        return fmt.Errorf("failed to read target records: %v", err)
+    }
+    wanted := make(map[int]bool, len(srcRecords))
+    for _, record := range srcRecords {
+        wanted[record.ID] = true
+    }
+    var copied []*models.IPSetRecord
+    for _, record := range uniqueRecords(dstRecords) {
+        if wanted[record.ID] {
+            copied = append(copied, record)
+        }
+    }
+    
+    if len(copied) != len(srcRecords) {
+        return fmt.Errorf("record count mismatch: source %d, target %d", len(srcRecords), len(copied))
+    }
+    if recordsChecksum(copied) != recordsChecksum(srcRecords) {
+        return fmt.Errorf("record checksum mismatch after copy")
+    }
+    
+    fmt.Printf("Records: %d copied to %s\n", len(copied), to)
+    return nil
+}
+
+// countTrash - число записей в корзине хранилища
+func countTrash(ctx context.Context, s storage.IPSetStorage) (int, error) {
+    count := 0
+    query := &models.RecordQuery{Limit: 1000}
+    for {
+        page, err := s.ListTrash(ctx, query)
+        if err != nil {
+            return 0, fmt.Errorf("failed to read source trash: %v", err)
+        }
+        count += len(page.Records)
+        if page.NextCursor == "" {
+            return count, nil
+        }
+        query.Cursor = page.NextCursor
+    }
+}
+
+// countExpired - число истекших, но еще не удаленных записей хранилища;
+// "unknown number of", если хранилище не умеет их считать
+func countExpired(ctx context.Context, s storage.IPSetStorage) (string, error) {
+    counter, ok := s.(storage.ExpiredCounter)
+    if !ok {
+        return "unknown number of", nil
+    }
+    count, err := counter.CountExpired(ctx, time.Now())
+    if err != nil {
+        return "", fmt.Errorf("failed to count source expired records: %v", err)
+    }
+    return strconv.Itoa(count), nil
+}
+
+// uniqueKeys оставляет по одному ключу: ClickHouse хранит версии ключа
+// отдельными строками и отдает самую свежую первой
+func uniqueKeys(keys []*models.AuthKey) []*models.AuthKey {
+    seen := make(map[string]bool, len(keys))
+    var result []*models.AuthKey
+    for _, key := range keys {
+        if !seen[key.Key] {
+            seen[key.Key] = true
+            result = append(result, key)
+        }
+    }
+    return result
+}
+
+// uniqueRecords оставляет самую свежую версию каждой записи
+func uniqueRecords(records []*models.IPSetRecord) []*models.IPSetRecord {
+    latest := make(map[int]*models.IPSetRecord, len(records))
+    for _, record := range records {
+        if current, ok := latest[record.ID]; !ok || record.UpdatedAt.After(current.UpdatedAt) {
+            latest[record.ID] = record
+        }
+    }
+    
+    result := make([]*models.IPSetRecord, 0, len(latest))
+    for _, record := range latest {
+        result = append(result, record)
+    }
+    sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+    return result
+}
+
+// checksumTime приводит время к общему виду: хранилища сохраняют его
+// с разной точностью (MySQL и ClickHouse - до секунды) и в разных зонах
+func checksumTime(t time.Time) string {
+    return t.UTC().Truncate(time.Second).Format(time.RFC3339)
+}
+
+// checksumOptionalTime - checksumTime для необязательного времени, пустая
+// строка у nil
+func checksumOptionalTime(t *time.Time) string {
+    if t == nil {
+        return ""
+    }
+    return checksumTime(*t)
+}
+
+func keysChecksum(keys []*models.AuthKey) string {
+    sorted := append([]*models.AuthKey(nil), keys...)
+    sort.Slice(sorted, func(i, j int) bool { return sorted[i].Key < sorted[j].Key })
+    
+    h := sha256.New()
+    for _, key := range sorted {
+        fmt.Fprintf(h, "%s|%s|%s|%t\n", key.Key, checksumTime(key.CreatedAt), checksumTime(key.ExpiresAt), key.IsActive)
+    }
+    return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+func recordsChecksum(records []*models.IPSetRecord) string {
+    sorted := append([]*models.IPSetRecord(nil), records...)
+    sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+    
+    h := sha256.New()
+    for _, r := range sorted {
+        fmt.Fprintf(h, "%d|%q|%q|%q|%d|%q|%q|%q|%q|%q|%q|%s|%s|%s|%s|%q\n",
+            r.ID, r.SetName, r.IP, r.CIDR, r.Port, r.Protocol, r.SecondIP, r.Description, r.Context,
+            r.SetType, r.SetOptions, checksumTime(r.CreatedAt), checksumTime(r.UpdatedAt),
+            checksumOptionalTime(r.ExpiresAt), checksumOptionalTime(r.ActiveFrom), r.Schedule)
+    }
+    return hex.EncodeToString(h.Sum(nil))[:16]
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "sort"
+    "time"
+    "ipset-api-server/internal/models"
+    "ipset-api-server/internal/storage"
+    "ipset-api-server/pkg/validation"
+)
+
+// dedupeActor - автор событий аудита, которые пишет dedupe
+const dedupeActor = "ipset-admin"
+
+// runDedupe сливает записи, которые задают один и тот же элемент сета:
+// такие записи могли появиться до того, как хранилища стали проверять
+// уникальность. Из группы остается запись, созданная раньше всех (при
+// равном времени - с меньшим ID). Она получает элемент в приведенном виде,
+// пустые описание и контекст берет у дубликатов, а срок - самый поздний
+// (бессрочная запись остается бессрочной). Дубликаты уходят в корзину.
+func runDedupe(args []string) error {
+    fs := flag.NewFlagSet("dedupe", flag.ExitOnError)
+    storageType := fs.String("storage", "", "Storage type (file, sqlite, mysql, postgresql, clickhouse), default: IPSET_STORAGE_TYPE")
+    envFile := fs.String("env", "", "Env file with storage settings (default: process environment)")
+    dryRun := fs.Bool("dry-run", false, "Show duplicates without changing anything")
+    fs.Parse(args)
+
+    cfg, err := loadConfig(*envFile)
+    if err != nil {
+        return err
+    }
+    if *storageType == "" {
+        *storageType = cfg.IPSetStorageType
+    }
+
+    ctx := context.Background()
+
+    ipsetStorage, err := storage.NewIPSetStorage(*storageType, cfg)
+    if err != nil {
+        return fmt.Errorf("failed to open ipset storage: %v", err)
+    }
+    auditStorage, err := storage.NewAuditStorage(*storageType, cfg)
+    if err != nil {
+        return fmt.Errorf("failed to open audit storage: %v", err)
+    }
+
+    records, err := ipsetStorage.GetAll(ctx)
+    if err != nil {
+        return fmt.Errorf("failed to read records: %v", err)
+    }
+    groups := duplicateGroups(records)
+    if len(groups) == 0 {
+        fmt.Println("No duplicate records found")
+        return nil
+    }
+
+    removed := 0
+    for _, group := range groups {
+        kept, duplicates := group[0], group[1:]
+        ids := make([]int, len(duplicates))
+        for i, record := range duplicates {
+            ids[i] = record.ID
+        }
+        fmt.Printf("Set %s: keeping %d (%s), merging %v\n", kept.SetName, kept.ID, storage.EntryKey(normalizedRecord(kept)), ids)
+        removed += len(duplicates)
+        if *dryRun {
+            continue
+        }
+
+        // Дубликаты удаляются первыми, иначе приведенная запись совпала бы с ними
+        for _, record := range duplicates {
+            if err := ipsetStorage.Delete(ctx, record.ID); err != nil {
+                return fmt.Errorf("failed to delete record %d: %v", record.ID, err)
+            }
+            appendAudit(ctx, auditStorage, models.AuditDelete, record, nil)
+        }
+
+        merged := mergeDuplicates(kept, duplicates)
+        if storage.EntryKey(merged) == storage.EntryKey(kept) && merged.Description == kept.Description &&
+            merged.Context == kept.Context && merged.ExpiresAt == kept.ExpiresAt {
+            continue
+        }
+        if err := ipsetStorage.Update(ctx, merged.ID, merged); err != nil {
+            return fmt.Errorf("failed to update record %d: %v", merged.ID, err)
+        }
+        appendAudit(ctx, auditStorage, models.AuditUpdate, kept, merged)
+    }
+
+    if *dryRun {
+        fmt.Printf("Dry run: %d duplicate records in %d groups, nothing was changed\n", removed, len(groups))
+    } else {
+        fmt.Printf("Merged %d duplicate records in %d groups (moved to trash)\n", removed, len(groups))
+    }
+    return nil
+}
+
+// normalizedRecord - копия записи с элементом в том виде, в каком его
+// сохраняет сервер
+func normalizedRecord(record *models.IPSetRecord) *models.IPSetRecord {
+    entry := validation.NormalizeEntry(record.SetType, validation.Entry{
+        IP:       record.IP,
+        CIDR:     record.CIDR,
+        Port:     record.Port,
+        Protocol: record.Protocol,
+        SecondIP: record.SecondIP,
+    })
+
+    copied := *record
+    copied.IP = entry.IP
+    copied.CIDR = entry.CIDR
+    copied.Protocol = entry.Protocol
+    copied.SecondIP = entry.SecondIP
+    return &copied
+}
+
+// duplicateGroups - группы записей с одним элементом сета, первой идет
+// запись, которая останется
+func duplicateGroups(records []*models.IPSetRecord) [][]*models.IPSetRecord {
+    sort.Slice(records, func(i, j int) bool {
+        if !records[i].CreatedAt.Equal(records[j].CreatedAt) {
+            return records[i].CreatedAt.Before(records[j].CreatedAt)
+        }
+        return records[i].ID < records[j].ID
+    })
+
+    byKey := make(map[string][]*models.IPSetRecord)
+    var keys []string
+    for _, record := range records {
+        key := record.SetName + " " + storage.EntryKey(normalizedRecord(record))
+        if _, ok := byKey[key]; !ok {
+            keys = append(keys, key)
+        }
+        byKey[key] = append(byKey[key], record)
+    }
+
+    var groups [][]*models.IPSetRecord
+    for _, key := range keys {
+        if len(byKey[key]) > 1 {
+            groups = append(groups, byKey[key])
+        }
+    }
+    return groups
+}
+
+// mergeDuplicates - оставшаяся запись после слияния с дубликатами
+func mergeDuplicates(kept *models.IPSetRecord, duplicates []*models.IPSetRecord) *models.IPSetRecord {
+    merged := normalizedRecord(kept)
+    for _, record := range duplicates {
+        if merged.Description == "" {
+            merged.Description = record.Description
+        }
+        if merged.Context == "" {
+            merged.Context = record.Context
+        }
+        if merged.ExpiresAt != nil && (record.ExpiresAt == nil || record.ExpiresAt.After(*merged.ExpiresAt)) {
+            merged.ExpiresAt = record.ExpiresAt
+        }
+    }
+    return merged
+}
+
+// appendAudit пишет событие аудита так же, как сервер; ошибка журнала
+// не прерывает слияние
+func appendAudit(ctx context.Context, auditStorage storage.AuditStorage, action string, before, after *models.IPSetRecord) {
+    event := &models.AuditEvent{
+        Timestamp: time.Now().UTC(),
+        Actor:     dedupeActor,
+        Action:    action,
+    }
+    for _, r := range []struct {
+        record *models.IPSetRecord
+        data   *json.RawMessage
+    }{
+        {before, &event.Before},
+        {after, &event.After},
+    } {
+        if r.record == nil {
+            continue
+        }
+        event.SetName = r.record.SetName
+        event.RecordID = r.record.ID
+        data, err := json.Marshal(r.record)
+        if err != nil {
+            continue
+        }
+        *r.data = data
+    }
+
+    if err := auditStorage.Append(ctx, event); err != nil {
+        fmt.Printf("Warning: failed to write %s audit event for record %d: %v\n", action, event.RecordID, err)
+    }
+}
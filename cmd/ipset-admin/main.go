@@ -0,0 +1,59 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    
+    "github.com/joho/godotenv"
+)
+
+// command - подкоманда административной утилиты
+type command struct {
+    name  string
+    short string
+    run   func(args []string) error
+}
+
+var commands = []command{
+    {name: "copy", short: "Copy keys and records from one storage backend to another", run: runCopy},
+    {name: "migrate", short: "Show or apply database schema migrations (status, up)", run: runMigrate},
+    {name: "dedupe", short: "Merge records that repeat the same set entry, keeping the oldest", run: runDedupe},
+}
+
+func usage() {
+    fmt.Fprintln(os.Stderr, "Usage: ipset-admin <command> [flags]")
+    fmt.Fprintln(os.Stderr)
+    fmt.Fprintln(os.Stderr, "Commands:")
+    for _, cmd := range commands {
+        fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.short)
+    }
+    fmt.Fprintln(os.Stderr)
+    fmt.Fprintln(os.Stderr, "Run 'ipset-admin <command> -h' for command flags.")
+}
+
+func main() {
+    // Загружаем .env файл если существует
+    godotenv.Load()
+    
+    if len(os.Args) < 2 {
+        usage()
+        os.Exit(2)
+    }
+    
+    name := os.Args[1]
+    for _, cmd := range commands {
+        if cmd.name == name {
+            if err := cmd.run(os.Args[2:]); err != nil {
+                fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+                os.Exit(1)
+            }
+            return
+        }
+    }
+    
+    if name != "-h" && name != "--help" && name != "help" {
+        fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", name)
+    }
+    usage()
+    os.Exit(2)
+}
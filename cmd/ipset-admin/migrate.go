@@ -0,0 +1,75 @@
+package main
+
+import (
+    "context"
+    "flag"
+    "fmt"
+    "ipset-api-server/internal/storage"
+)
+
+func runMigrate(args []string) error {
+    if len(args) < 1 || (args[0] != "status" && args[0] != "up") {
+        fmt.Println("Usage: ipset-admin migrate <status|up> [flags]")
+        return fmt.Errorf("unknown migrate action")
+    }
+    action := args[0]
+
+    fs := flag.NewFlagSet("migrate "+action, flag.ExitOnError)
+    storageType := fs.String("storage", "", "Storage type (sqlite, mysql, postgresql, clickhouse), default: IPSET_STORAGE_TYPE")
+    envFile := fs.String("env", "", "Env file with storage settings (default: process environment)")
+    fs.Parse(args[1:])
+
+    cfg, err := loadConfig(*envFile)
+    if err != nil {
+        return err
+    }
+    if *storageType == "" {
+        *storageType = cfg.IPSetStorageType
+    }
+
+    ctx := context.Background()
+
+    if action == "up" {
+        applied, err := storage.MigrateSchema(ctx, *storageType, cfg)
+        for _, m := range applied {
+            fmt.Printf("Applied %d: %s\n", m.Version, m.Description)
+        }
+        if err != nil {
+            return err
+        }
+        if len(applied) == 0 {
+            fmt.Println("Schema is up to date")
+        }
+    }
+
+    status, err := storage.GetSchemaStatus(ctx, *storageType, cfg)
+    if err != nil {
+        return err
+    }
+
+    printSchemaStatus(status)
+
+    if status.Current > status.Latest {
+        return fmt.Errorf("schema version %d is newer than this build supports (%d)", status.Current, status.Latest)
+    }
+    return nil
+}
+
+func printSchemaStatus(status *storage.SchemaStatus) {
+    fmt.Printf("Storage: %s\n", status.StorageType)
+    fmt.Printf("Schema version: %d (latest known: %d)\n", status.Current, status.Latest)
+
+    if len(status.Applied) > 0 {
+        fmt.Println("\nApplied migrations:")
+        for _, m := range status.Applied {
+            fmt.Printf("  %4d  %-45s %s\n", m.Version, m.Description, m.AppliedAt.Local().Format("2006-01-02 15:04:05"))
+        }
+    }
+
+    if len(status.Pending) > 0 {
+        fmt.Println("\nPending migrations:")
+        for _, m := range status.Pending {
+            fmt.Printf("  %4d  %s\n", m.Version, m.Description)
+        }
+    }
+}
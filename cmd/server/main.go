@@ -30,11 +30,29 @@ func main() {
         log.Fatalf("Failed to initialize ipset storage: %v", err)
     }
 
+    // Инициализируем журнал аудита
+    auditStorage, err := storage.NewAuditStorage(cfg.IPSetStorageType, cfg)
+    if err != nil {
+        log.Fatalf("Failed to initialize audit storage: %v", err)
+    }
+
+    // Инициализируем подписки webhooks
+    webhookStorage, err := storage.NewWebhookStorage(cfg.IPSetStorageType, cfg)
+    if err != nil {
+        log.Fatalf("Failed to initialize webhook storage: %v", err)
+    }
+
+    // Инициализируем реестр агентов
+    agentStorage, err := storage.NewAgentStorage(cfg.IPSetStorageType, cfg)
+    if err != nil {
+        log.Fatalf("Failed to initialize agent storage: %v", err)
+    }
+
     // Инициализируем менеджер авторизации
     authManager := auth.NewManager(authStorage)
 
     // Инициализируем и запускаем API сервер
-    server := api.NewServer(cfg, authManager, ipsetStorage)
+    server := api.NewServer(cfg, authManager, ipsetStorage, auditStorage, webhookStorage, agentStorage)
     
     addr := fmt.Sprintf("%s:%s", cfg.ServerHost, cfg.ServerPort)
     log.Printf("Server starting on %s", addr)
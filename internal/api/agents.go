@@ -0,0 +1,537 @@
+package api
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+    "ipset-api-server/internal/models"
+    "ipset-api-server/pkg/drift"
+    "ipset-api-server/pkg/validation"
+
+    "github.com/gin-gonic/gin"
+)
+
+var (
+    hostnamePattern   = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,254}$`)
+    labelKeyPattern   = regexp.MustCompile(`^[A-Za-z0-9._/-]+$`)
+    labelValuePattern = regexp.MustCompile(`^[A-Za-z0-9._/-]*$`)
+)
+
+// agentStatuses - статусы, по которым можно отфильтровать GET /agents
+var agentStatuses = map[string]bool{models.AgentOK: true, models.AgentDrifted: true, models.AgentStale: true}
+
+// validateLabels проверяет метки агента или селектор правила: ключ и
+// значение - буквы, цифры и "._/-", значение может быть пустым
+func validateLabels(field string, labels map[string]string) error {
+    for key, value := range labels {
+        if !labelKeyPattern.MatchString(key) {
+            return fmt.Errorf("%s: invalid label key %q", field, key)
+        }
+        if !labelValuePattern.MatchString(value) {
+            return fmt.Errorf("%s: invalid value %q of label %s", field, value, key)
+        }
+    }
+    return nil
+}
+
+// selectorMatches - есть ли у агента все метки селектора
+func selectorMatches(selector, labels map[string]string) bool {
+    for key, value := range selector {
+        if v, ok := labels[key]; !ok || v != value {
+            return false
+        }
+    }
+    return true
+}
+
+// assignedSets - сеты, назначенные агенту с метками labels, по имени
+func assignedSets(labels map[string]string, rules []*models.AssignmentRule) []string {
+    seen := make(map[string]bool)
+    sets := []string{}
+    for _, rule := range rules {
+        if !selectorMatches(rule.Selector, labels) {
+            continue
+        }
+        for _, name := range rule.Sets {
+            if !seen[name] {
+                seen[name] = true
+                sets = append(sets, name)
+            }
+        }
+    }
+    sort.Strings(sets)
+    return sets
+}
+
+// parseLabelFilter разбирает фильтры label=key=value запроса GET /agents
+func parseLabelFilter(values []string) (map[string]string, error) {
+    selector := make(map[string]string)
+    for _, value := range values {
+        key, val, _ := strings.Cut(value, "=")
+        selector[key] = val
+    }
+    if err := validateLabels("label", selector); err != nil {
+        return nil, err
+    }
+    return selector, nil
+}
+
+// setDigest - контрольная сумма сета в том виде, в каком его сейчас
+// получит агент (записи вне окна действия не входят); пустая, если сета нет
+func (s *Server) setDigest(ctx context.Context, name string) string {
+    set, err := s.ipsetStorage.GetSet(ctx, name)
+    if err != nil {
+        return ""
+    }
+    records := s.activeSetRecords(ctx, name, time.Now())
+    entries := make([]validation.Entry, len(records))
+    for i, record := range records {
+        entries[i] = validation.Entry{
+            IP:       record.IP,
+            CIDR:     record.CIDR,
+            Port:     record.Port,
+            Protocol: record.Protocol,
+            SecondIP: record.SecondIP,
+        }
+    }
+    return drift.Digest(drift.ServerSet(name, set.Type, set.Options, entries))
+}
+
+// agentStatuses дополняет агентов назначенными сетами и статусами.
+// Контрольная сумма каждого сета считается один раз на запрос.
+func (s *Server) agentStatuses(ctx context.Context, agents []*models.Agent) ([]*models.AgentStatus, error) {
+    rules, err := s.agentStorage.ListAssignments(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    now := time.Now()
+    digests := make(map[string]string)
+    digest := func(name string) string {
+        if _, ok := digests[name]; !ok {
+            digests[name] = s.setDigest(ctx, name)
+        }
+        return digests[name]
+    }
+
+    statuses := make([]*models.AgentStatus, 0, len(agents))
+    for _, agent := range agents {
+        status := &models.AgentStatus{
+            Agent:        agent,
+            AssignedSets: assignedSets(agent.Labels, rules),
+            Sets:         []*models.AgentSetStatus{},
+            Status:       models.AgentOK,
+        }
+
+        // Сеты агента - назначенные правилами и те, о которых он сообщает
+        // (например, заданные ему флагом -sets)
+        reported := make(map[string]*models.AgentSetResult)
+        names := append([]string{}, status.AssignedSets...)
+        for _, result := range agent.Sets {
+            if reported[result.SetName] == nil && !containsString(names, result.SetName) {
+                names = append(names, result.SetName)
+            }
+            reported[result.SetName] = result
+        }
+        sort.Strings(names)
+
+        for _, name := range names {
+            set := &models.AgentSetStatus{Status: models.AgentSetOK}
+            result := reported[name]
+            switch {
+            case result == nil:
+                set.SetName = name
+                set.Status = models.AgentSetMissing
+            case result.Error != "":
+                set.AgentSetResult = *result
+                set.Status = models.AgentSetFailed
+            case result.Digest != digest(name):
+                set.AgentSetResult = *result
+                set.Status = models.AgentSetOutdated
+            default:
+                set.AgentSetResult = *result
+            }
+            if set.Status != models.AgentSetOK {
+                status.Status = models.AgentDrifted
+            }
+            status.Sets = append(status.Sets, set)
+        }
+
+        if now.Sub(agent.LastSeenAt) > s.config.AgentStaleAfter {
+            status.Status = models.AgentStale
+        }
+        statuses = append(statuses, status)
+    }
+    return statuses, nil
+}
+
+// agentResponse отвечает агентом со статусом
+func (s *Server) agentResponse(c *gin.Context, code int, agent *models.Agent) {
+    statuses, err := s.agentStatuses(c.Request.Context(), []*models.Agent{agent})
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+    c.JSON(code, statuses[0])
+}
+
+// registerAgent добавляет агента в реестр или обновляет метки уже
+// зарегистрированного; в ответе - назначенные агенту сеты
+func (s *Server) registerAgent(c *gin.Context) {
+    var req models.AgentRegistration
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+    if !hostnamePattern.MatchString(req.Hostname) {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: fmt.Sprintf("hostname: invalid host name %q", req.Hostname)})
+        return
+    }
+    if err := validateLabels("labels", req.Labels); err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+    if req.Labels == nil {
+        req.Labels = map[string]string{}
+    }
+
+    now := time.Now().UTC()
+    code := http.StatusOK
+    agent, err := s.agentStorage.GetAgent(c.Request.Context(), req.Hostname)
+    if err != nil {
+        agent = &models.Agent{
+            Hostname:     req.Hostname,
+            Sets:         []*models.AgentSetResult{},
+            RegisteredAt: now,
+        }
+        code = http.StatusCreated
+    }
+    agent.Labels = req.Labels
+    agent.LastSeenAt = now
+
+    if err := s.agentStorage.SaveAgent(c.Request.Context(), agent); err != nil {
+        c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    s.agentResponse(c, code, agent)
+}
+
+// heartbeatAgent сохраняет состояние агента. Новое применение сета или
+// новая ошибка пишутся в журнал аудита, как отчеты POST /agents/report.
+func (s *Server) heartbeatAgent(c *gin.Context) {
+    var heartbeat models.AgentHeartbeat
+    if err := c.ShouldBindJSON(&heartbeat); err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    agent, err := s.agentStorage.GetAgent(c.Request.Context(), c.Param("hostname"))
+    if err != nil {
+        c.JSON(http.StatusNotFound, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    previous := make(map[string]*models.AgentSetResult)
+    for _, result := range agent.Sets {
+        previous[result.SetName] = result
+    }
+    for _, result := range heartbeat.Sets {
+        if !agentResultChanged(previous[result.SetName], result) {
+            continue
+        }
+        if err := s.auditAgentResult(c, agent.Hostname, result); err != nil {
+            c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
+            return
+        }
+    }
+
+    if heartbeat.Sets == nil {
+        heartbeat.Sets = []*models.AgentSetResult{}
+    }
+    agent.Sets = heartbeat.Sets
+    agent.LastError = heartbeat.Error
+    agent.LastSeenAt = time.Now().UTC()
+    if err := s.agentStorage.SaveAgent(c.Request.Context(), agent); err != nil {
+        c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    s.agentResponse(c, http.StatusOK, agent)
+}
+
+// agentResultChanged - применен ли сет заново или изменилась ошибка с
+// прошлого heartbeat
+func agentResultChanged(previous, result *models.AgentSetResult) bool {
+    if previous == nil {
+        return result.AppliedAt != nil || result.Error != ""
+    }
+    if previous.Error != result.Error {
+        return true
+    }
+    if previous.AppliedAt == nil || result.AppliedAt == nil {
+        return previous.AppliedAt != result.AppliedAt
+    }
+    return !previous.AppliedAt.Equal(*result.AppliedAt)
+}
+
+// getAgents - реестр агентов со статусами; фильтры status и label
+// (label=key=value, можно несколько)
+func (s *Server) getAgents(c *gin.Context) {
+    status := c.Query("status")
+    if status != "" && !agentStatuses[status] {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "invalid status: " + status})
+        return
+    }
+    selector, err := parseLabelFilter(c.QueryArray("label"))
+    if err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    agents, err := s.agentStorage.ListAgents(c.Request.Context())
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+    var matched []*models.Agent
+    for _, agent := range agents {
+        if selectorMatches(selector, agent.Labels) {
+            matched = append(matched, agent)
+        }
+    }
+
+    statuses, err := s.agentStatuses(c.Request.Context(), matched)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+    result := make([]*models.AgentStatus, 0, len(statuses))
+    for _, agentStatus := range statuses {
+        if status == "" || agentStatus.Status == status {
+            result = append(result, agentStatus)
+        }
+    }
+    c.JSON(http.StatusOK, result)
+}
+
+func (s *Server) getAgent(c *gin.Context) {
+    agent, err := s.agentStorage.GetAgent(c.Request.Context(), c.Param("hostname"))
+    if err != nil {
+        c.JSON(http.StatusNotFound, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    s.agentResponse(c, http.StatusOK, agent)
+}
+
+// deleteAgent убирает хост из реестра; агент, который еще работает,
+// зарегистрируется заново
+func (s *Server) deleteAgent(c *gin.Context) {
+    if err := s.agentStorage.DeleteAgent(c.Request.Context(), c.Param("hostname")); err != nil {
+        c.JSON(http.StatusNotFound, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    c.JSON(http.StatusOK, models.SuccessResponse{Message: "agent deleted successfully"})
+}
+
+// applyAssignmentRequest переносит указанные в запросе поля в правило и
+// проверяет результат
+func applyAssignmentRequest(rule *models.AssignmentRule, req *models.AssignmentRequest) error {
+    if req.Selector != nil {
+        rule.Selector = *req.Selector
+    }
+    if req.Sets != nil {
+        rule.Sets = *req.Sets
+    }
+    if req.Description != nil {
+        rule.Description = *req.Description
+    }
+
+    if rule.Selector == nil {
+        rule.Selector = map[string]string{}
+    }
+    if err := validateLabels("selector", rule.Selector); err != nil {
+        return err
+    }
+    if len(rule.Sets) == 0 {
+        return fmt.Errorf("sets: at least one set is required")
+    }
+    for _, name := range rule.Sets {
+        if err := validation.ValidateSetName("sets", name); err != nil {
+            return err
+        }
+        if strings.Contains(name, ",") {
+            return fmt.Errorf("sets: invalid set name %q", name)
+        }
+    }
+    return nil
+}
+
+// assignmentID разбирает ID правила из пути запроса
+func assignmentID(c *gin.Context) (int64, bool) {
+    id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+    if err != nil || id <= 0 {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "invalid ID"})
+        return 0, false
+    }
+    return id, true
+}
+
+func (s *Server) createAssignment(c *gin.Context) {
+    var req models.AssignmentRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    now := time.Now().UTC()
+    rule := &models.AssignmentRule{CreatedAt: now, UpdatedAt: now}
+    if err := applyAssignmentRequest(rule, &req); err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    if err := s.agentStorage.CreateAssignment(c.Request.Context(), rule); err != nil {
+        c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    c.JSON(http.StatusCreated, rule)
+}
+
+func (s *Server) getAssignments(c *gin.Context) {
+    rules, err := s.agentStorage.ListAssignments(c.Request.Context())
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+    if rules == nil {
+        rules = []*models.AssignmentRule{}
+    }
+
+    c.JSON(http.StatusOK, rules)
+}
+
+func (s *Server) getAssignment(c *gin.Context) {
+    id, ok := assignmentID(c)
+    if !ok {
+        return
+    }
+
+    rule, err := s.agentStorage.GetAssignment(c.Request.Context(), id)
+    if err != nil {
+        c.JSON(http.StatusNotFound, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    c.JSON(http.StatusOK, rule)
+}
+
+func (s *Server) updateAssignment(c *gin.Context) {
+    id, ok := assignmentID(c)
+    if !ok {
+        return
+    }
+
+    var req models.AssignmentRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    rule, err := s.agentStorage.GetAssignment(c.Request.Context(), id)
+    if err != nil {
+        c.JSON(http.StatusNotFound, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+    if err := applyAssignmentRequest(rule, &req); err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+    rule.UpdatedAt = time.Now().UTC()
+
+    if err := s.agentStorage.UpdateAssignment(c.Request.Context(), rule); err != nil {
+        c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    c.JSON(http.StatusOK, rule)
+}
+
+func (s *Server) deleteAssignment(c *gin.Context) {
+    id, ok := assignmentID(c)
+    if !ok {
+        return
+    }
+
+    if err := s.agentStorage.DeleteAssignment(c.Request.Context(), id); err != nil {
+        c.JSON(http.StatusNotFound, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    c.JSON(http.StatusOK, models.SuccessResponse{Message: "assignment deleted successfully"})
+}
+
+// reportAgent принимает отчет агента о применении сетов к ядру и пишет его
+// в журнал аудита: по событию agent_apply или agent_apply_failed на сет,
+// отчет хоста - в After события
+func (s *Server) reportAgent(c *gin.Context) {
+    var report models.AgentReport
+    if err := c.ShouldBindJSON(&report); err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+    if !hostnamePattern.MatchString(report.Hostname) {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: fmt.Sprintf("hostname: invalid host name %q", report.Hostname)})
+        return
+    }
+
+    for _, result := range report.Sets {
+        if err := s.auditAgentResult(c, report.Hostname, result); err != nil {
+            c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
+            return
+        }
+    }
+
+    c.JSON(http.StatusOK, models.SuccessResponse{Message: "report saved successfully"})
+}
+
+// auditAgentResult пишет результат применения сета агентом в журнал аудита
+func (s *Server) auditAgentResult(c *gin.Context, hostname string, result *models.AgentSetResult) error {
+    action := models.AuditAgentApply
+    if result.Error != "" {
+        action = models.AuditAgentApplyFailed
+    }
+
+    data, err := json.Marshal(struct {
+        Hostname string `json:"hostname"`
+        *models.AgentSetResult
+    }{hostname, result})
+    if err != nil {
+        return err
+    }
+
+    event := &models.AuditEvent{
+        Timestamp: time.Now().UTC(),
+        Actor:     c.GetString("key_id"),
+        RequestID: c.GetString("request_id"),
+        Action:    action,
+        SetName:   result.SetName,
+        After:     data,
+    }
+    if err := s.auditStorage.Append(c.Request.Context(), event); err != nil {
+        log.Printf("audit: failed to write %s event for set %s from %s: %v",
+            action, result.SetName, hostname, err)
+        return err
+    }
+    return nil
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "log"
+    "net/http"
+    "time"
+    "ipset-api-server/internal/models"
+    
+    "github.com/gin-gonic/gin"
+)
+
+// maxRequestIDLength - ограничение на X-Request-ID, пришедший от клиента
+const maxRequestIDLength = 64
+
+// requestIDMiddleware берет ID запроса из заголовка X-Request-ID или
+// генерирует новый и возвращает его в ответе, чтобы событие аудита можно
+// было сопоставить с логами клиента и прокси
+func requestIDMiddleware() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        requestID := c.GetHeader("X-Request-ID")
+        if requestID == "" || len(requestID) > maxRequestIDLength {
+            buf := make([]byte, 16)
+            rand.Read(buf)
+            requestID = hex.EncodeToString(buf)
+        }
+        
+        c.Set("request_id", requestID)
+        c.Header("X-Request-ID", requestID)
+        c.Next()
+    }
+}
+
+// audit пишет событие об изменении одной записи. Изменение к этому моменту
+// уже сохранено, поэтому ошибка журнала не отменяет ответ, а попадает в лог.
+func (s *Server) audit(c *gin.Context, action string, before, after *models.IPSetRecord) {
+    s.writeAudit(c.Request.Context(), c.GetString("key_id"), c.GetString("request_id"), action, before, after)
+}
+
+// writeAudit - audit для изменений, которые сервер делает сам, без запроса
+// клиента
+func (s *Server) writeAudit(ctx context.Context, actor, requestID, action string, before, after *models.IPSetRecord) {
+    event := &models.AuditEvent{
+        Timestamp: time.Now().UTC(),
+        Actor:     actor,
+        RequestID: requestID,
+        Action:    action,
+    }
+    
+    for _, r := range []struct {
+        record *models.IPSetRecord
+        data   *json.RawMessage
+    }{
+        {before, &event.Before},
+        {after, &event.After},
+    } {
+        if r.record == nil {
+            continue
+        }
+        event.SetName = r.record.SetName
+        event.RecordID = r.record.ID
+        data, err := json.Marshal(r.record)
+        if err != nil {
+            log.Printf("audit: failed to encode record %d: %v", r.record.ID, err)
+            continue
+        }
+        *r.data = data
+    }
+    
+    if err := s.auditStorage.Append(ctx, event); err != nil {
+        log.Printf("audit: failed to write %s event for record %d (request %s): %v",
+            action, event.RecordID, event.RequestID, err)
+    }
+}
+
+// auditSet пишет событие об изменении самого сета (create_set, update_set),
+// у таких событий record_id = 0
+func (s *Server) auditSet(c *gin.Context, action string, before, after *models.IPSetSet) {
+    event := &models.AuditEvent{
+        Timestamp: time.Now().UTC(),
+        Actor:     c.GetString("key_id"),
+        RequestID: c.GetString("request_id"),
+        Action:    action,
+    }
+    
+    for _, r := range []struct {
+        set  *models.IPSetSet
+        data *json.RawMessage
+    }{
+        {before, &event.Before},
+        {after, &event.After},
+    } {
+        if r.set == nil {
+            continue
+        }
+        event.SetName = r.set.Name
+        copied := *r.set
+        copied.Records = nil
+        data, err := json.Marshal(&copied)
+        if err != nil {
+            log.Printf("audit: failed to encode set %s: %v", r.set.Name, err)
+            continue
+        }
+        *r.data = data
+    }
+    
+    if err := s.auditStorage.Append(c.Request.Context(), event); err != nil {
+        log.Printf("audit: failed to write %s event for set %s (request %s): %v",
+            action, event.SetName, event.RequestID, err)
+    }
+}
+
+// getAuditLog возвращает одну страницу журнала аудита, от новых событий
+// к старым. Курсор следующей страницы - в заголовках X-Next-Cursor и Link.
+func (s *Server) getAuditLog(c *gin.Context) {
+    query, err := parseAuditQuery(c)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+    
+    page, err := s.auditStorage.List(c.Request.Context(), query)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+    
+    setNextLink(c, page.NextCursor)
+    c.JSON(http.StatusOK, page.Events)
+}
@@ -0,0 +1,404 @@
+package api
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "ipset-api-server/internal/models"
+    "ipset-api-server/internal/storage"
+
+    "github.com/gin-gonic/gin"
+    "github.com/gin-gonic/gin/binding"
+)
+
+// Пакетные операции с записями. Операции проверяются так же, как отдельные
+// запросы POST, PUT и DELETE /records, и по состоянию хранилища до пакета,
+// поэтому одну запись пакет меняет не больше одного раза. В режиме atomic
+// проверенные операции выполняются одним вызовом ApplyChanges (одна
+// транзакция хранилища), в режиме best_effort - каждая отдельно.
+
+// maxBulkOperations - наибольшее число операций в пакете
+const maxBulkOperations = 10000
+
+// bulkItem - операция пакета: change для хранилища (nil, если операция не
+// прошла проверку) и запись до операции для журнала аудита
+type bulkItem struct {
+    result models.BulkResult
+    change *storage.RecordChange
+    before *models.IPSetRecord
+}
+
+// bulkBatch собирает операции пакета
+type bulkBatch struct {
+    items []*bulkItem
+
+    // ids - номер операции, которая меняет запись
+    ids map[int]int
+
+    // sets - прочитанные сеты, newSets - первая запись пакета в сет,
+    // которого еще нет: она задает тип и опции нового сета
+    sets    setCache
+    newSets map[string]*models.IPSetRecord
+}
+
+func newBulkBatch() *bulkBatch {
+    return &bulkBatch{
+        ids:     make(map[int]int),
+        sets:    make(setCache),
+        newSets: make(map[string]*models.IPSetRecord),
+    }
+}
+
+// bulkRecords выполняет пакет операций create, update и delete
+func (s *Server) bulkRecords(c *gin.Context) {
+    ctx := c.Request.Context()
+
+    var req models.BulkRecordsRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+    mode, err := bulkMode(req.Mode)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+    if len(req.Operations) == 0 {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "operations: at least one operation is required"})
+        return
+    }
+    if err := checkBulkSize(len(req.Operations)); err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    batch := newBulkBatch()
+    for i, op := range req.Operations {
+        batch.add(s.prepareOperation(ctx, batch, i, op))
+    }
+
+    s.runBulk(c, mode, batch.items)
+}
+
+// bulkUpdateRecords применяет одно изменение (как PUT /records/:id) ко всем
+// записям, подходящим под фильтр
+func (s *Server) bulkUpdateRecords(c *gin.Context) {
+    ctx := c.Request.Context()
+
+    var req models.BulkUpdateRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+    mode, err := bulkMode(req.Mode)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    filter := req.Filter
+    query := &models.RecordQuery{
+        SetName:       filter.SetName,
+        Context:       filter.Context,
+        Protocol:      filter.Protocol,
+        Port:          filter.Port,
+        CreatedAfter:  filter.CreatedAfter,
+        CreatedBefore: filter.CreatedBefore,
+        UpdatedAfter:  filter.UpdatedAfter,
+        UpdatedBefore: filter.UpdatedBefore,
+        Limit:         storage.MaxListLimit,
+    }
+    // Пустой фильтр изменил бы все записи - скорее всего, это ошибка
+    if filter == (models.RecordFilter{}) {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "filter: at least one filter is required"})
+        return
+    }
+    if err := storage.NormalizeRecordQuery(query); err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    var records []*models.IPSetRecord
+    for {
+        page, err := s.ipsetStorage.List(ctx, query)
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
+            return
+        }
+        records = append(records, page.Records...)
+        if err := checkBulkSize(len(records)); err != nil {
+            c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "filter: " + err.Error()})
+            return
+        }
+        if page.NextCursor == "" {
+            break
+        }
+        query.Cursor = page.NextCursor
+    }
+
+    batch := newBulkBatch()
+    for i, record := range records {
+        item := &bulkItem{result: models.BulkResult{Index: i, Op: storage.ChangeUpdate, ID: record.ID}}
+        before := *record
+        item.before = &before
+        if status, err := s.changeRecord(ctx, batch.sets, record, &req.Update); err != nil {
+            item.fail(status, err)
+        } else if err := s.checkBatchSet(ctx, batch, record); err != nil {
+            item.fail(http.StatusConflict, err)
+        } else {
+            item.change = &storage.RecordChange{Op: storage.ChangeUpdate, ID: record.ID, Record: record}
+        }
+        batch.add(item)
+    }
+
+    s.runBulk(c, mode, batch.items)
+}
+
+// prepareOperation проверяет операцию пакета и готовит изменение для
+// хранилища
+func (s *Server) prepareOperation(ctx context.Context, batch *bulkBatch, index int, op models.BulkOperation) *bulkItem {
+    item := &bulkItem{result: models.BulkResult{Index: index, Op: op.Op, ID: op.ID}}
+
+    if op.Op == storage.ChangeUpdate || op.Op == storage.ChangeDelete {
+        if op.ID < 100000 || op.ID > 999999 {
+            item.fail(http.StatusBadRequest, fmt.Errorf("invalid ID (must be 6-digit number)"))
+            return item
+        }
+        if other, ok := batch.ids[op.ID]; ok {
+            item.fail(http.StatusBadRequest, fmt.Errorf("record %d is already changed by operation %d", op.ID, other))
+            return item
+        }
+        batch.ids[op.ID] = index
+
+        existing, err := s.ipsetStorage.GetByID(ctx, op.ID)
+        if err != nil {
+            item.fail(http.StatusNotFound, err)
+            return item
+        }
+        before := *existing
+        item.before = &before
+
+        if op.Op == storage.ChangeDelete {
+            item.change = &storage.RecordChange{Op: storage.ChangeDelete, ID: op.ID}
+            return item
+        }
+
+        var req models.UpdateIPSetRequest
+        if err := bindOperation(op, &req); err != nil {
+            item.fail(http.StatusBadRequest, err)
+            return item
+        }
+        if status, err := s.changeRecord(ctx, batch.sets, existing, &req); err != nil {
+            item.fail(status, err)
+            return item
+        }
+        if err := s.checkBatchSet(ctx, batch, existing); err != nil {
+            item.fail(http.StatusConflict, err)
+            return item
+        }
+        item.change = &storage.RecordChange{Op: storage.ChangeUpdate, ID: op.ID, Record: existing}
+        return item
+    }
+
+    if op.Op != storage.ChangeCreate {
+        item.fail(http.StatusBadRequest, fmt.Errorf("op: unknown operation %q (use create, update or delete)", op.Op))
+        return item
+    }
+
+    var req models.CreateIPSetRequest
+    if err := bindOperation(op, &req); err != nil {
+        item.fail(http.StatusBadRequest, err)
+        return item
+    }
+    record, status, err := s.newRecord(ctx, batch.sets, &req)
+    if err != nil {
+        item.fail(status, err)
+        return item
+    }
+    if err := s.checkBatchSet(ctx, batch, record); err != nil {
+        item.fail(http.StatusConflict, err)
+        return item
+    }
+    item.change = &storage.RecordChange{Op: storage.ChangeCreate, Record: record}
+    return item
+}
+
+// bindOperation читает record операции и проверяет его, как ShouldBindJSON
+// проверяет тело отдельного запроса
+func bindOperation(op models.BulkOperation, req interface{}) error {
+    if len(op.Record) == 0 {
+        return fmt.Errorf("record: required for %s", op.Op)
+    }
+    if err := json.Unmarshal(op.Record, req); err != nil {
+        return fmt.Errorf("record: %v", err)
+    }
+    return binding.Validator.ValidateStruct(req)
+}
+
+func (b *bulkBatch) add(item *bulkItem) {
+    b.items = append(b.items, item)
+}
+
+// checkBatchSet не дает двум записям пакета завести один новый сет с
+// разными типами или опциями: сет получит тип и опции первой из них
+func (s *Server) checkBatchSet(ctx context.Context, b *bulkBatch, record *models.IPSetRecord) error {
+    if _, err := s.getSet(ctx, b.sets, record.SetName); err == nil {
+        return nil
+    }
+
+    first, ok := b.newSets[record.SetName]
+    if !ok {
+        b.newSets[record.SetName] = record
+        return nil
+    }
+    if first.SetType != record.SetType || !sameOptions(first.SetOptions, record.SetOptions) {
+        return fmt.Errorf("set_type: new set %s gets type %s and options %q from an earlier operation",
+            record.SetName, first.SetType, first.SetOptions)
+    }
+    return nil
+}
+
+// runBulk выполняет проверенные операции и отвечает итогом пакета. В режиме
+// atomic ответ - код первой невыполненной операции, если такая есть.
+func (s *Server) runBulk(c *gin.Context, mode string, items []*bulkItem) {
+    ctx := c.Request.Context()
+
+    if mode == models.BulkBestEffort {
+        for _, item := range items {
+            if item.change == nil {
+                continue
+            }
+            if err := s.ipsetStorage.ApplyChanges(ctx, []*storage.RecordChange{item.change}); err != nil {
+                item.failStorage(err)
+                continue
+            }
+            s.applied(c, item)
+        }
+        c.JSON(http.StatusOK, bulkSummary(mode, items))
+        return
+    }
+
+    failed := -1
+    var changes []*storage.RecordChange
+    for i, item := range items {
+        if item.change == nil {
+            if failed < 0 {
+                failed = i
+            }
+            continue
+        }
+        changes = append(changes, item.change)
+    }
+
+    applied := 0
+    if failed < 0 && len(changes) > 0 {
+        err := s.ipsetStorage.ApplyChanges(ctx, changes)
+        var changeErr *storage.ChangeError
+        switch {
+        case err == nil:
+            applied = len(items)
+        case errors.As(err, &changeErr):
+            failed = changeErr.Index
+            applied = changeErr.Applied
+            items[failed].failStorage(changeErr.Err)
+        default:
+            // Неизвестно, какая операция не выполнена
+            failed = 0
+            items[failed].failStorage(err)
+        }
+    }
+
+    for i, item := range items {
+        switch {
+        case i < applied:
+            s.applied(c, item)
+        case i != failed && item.result.Status == 0:
+            item.result.Status = http.StatusFailedDependency
+            item.result.Error = fmt.Sprintf("not applied: operation %d failed", failed)
+        }
+    }
+
+    status := http.StatusOK
+    if failed >= 0 {
+        status = items[failed].result.Status
+    }
+    c.JSON(status, bulkSummary(mode, items))
+}
+
+// applied записывает выполненную операцию в итог и журнал аудита
+func (s *Server) applied(c *gin.Context, item *bulkItem) {
+    record := item.change.Record
+    switch item.change.Op {
+    case storage.ChangeCreate:
+        item.result.Status = http.StatusCreated
+        item.result.ID = record.ID
+        s.audit(c, models.AuditCreate, nil, record)
+    case storage.ChangeUpdate:
+        item.result.Status = http.StatusOK
+        s.audit(c, models.AuditUpdate, item.before, record)
+    case storage.ChangeDelete:
+        item.result.Status = http.StatusOK
+        item.result.Record = item.before
+        s.audit(c, models.AuditDelete, item.before, nil)
+        return
+    }
+    item.result.Record = record
+
+    if record.ActiveFrom != nil || record.Schedule != "" {
+        s.wakeScheduler()
+    }
+}
+
+func (item *bulkItem) fail(status int, err error) {
+    item.change = nil
+    item.result.Status = status
+    item.result.Error = err.Error()
+}
+
+// failStorage записывает в итог ошибку хранилища: дубликат - 409 с ID
+// существующей записи, как у отдельного запроса
+func (item *bulkItem) failStorage(err error) {
+    var changeErr *storage.ChangeError
+    if errors.As(err, &changeErr) {
+        err = changeErr.Err
+    }
+    var duplicate *storage.DuplicateError
+    if errors.As(err, &duplicate) {
+        item.fail(http.StatusConflict, err)
+        item.result.ExistingID = duplicate.ID
+        return
+    }
+    item.fail(http.StatusInternalServerError, err)
+}
+
+func bulkSummary(mode string, items []*bulkItem) *models.BulkRecordsResult {
+    summary := &models.BulkRecordsResult{Mode: mode, Results: make([]models.BulkResult, len(items))}
+    for i, item := range items {
+        summary.Results[i] = item.result
+        if item.result.Status < http.StatusBadRequest {
+            summary.Succeeded++
+        } else {
+            summary.Failed++
+        }
+    }
+    return summary
+}
+
+func bulkMode(mode string) (string, error) {
+    switch mode {
+    case "":
+        return models.BulkAtomic, nil
+    case models.BulkAtomic, models.BulkBestEffort:
+        return mode, nil
+    }
+    return "", fmt.Errorf("mode: unknown mode %q (use atomic or best_effort)", mode)
+}
+
+func checkBulkSize(n int) error {
+    if n > maxBulkOperations {
+        return fmt.Errorf("too many operations: %d, at most %d are allowed", n, maxBulkOperations)
+    }
+    return nil
+}
@@ -0,0 +1,58 @@
+package api
+
+import (
+    "errors"
+    "net/http"
+    "ipset-api-server/internal/models"
+    "ipset-api-server/internal/storage"
+
+    "github.com/gin-gonic/gin"
+)
+
+// Хранилище не дает завести в сете второй экземпляр элемента (ip, cidr,
+// port, protocol, second_ip) и называет запись, которая уже есть. Клиент
+// получает 409 с ее ID, а с upsert - изменяет ее вместо создания новой.
+
+// respondDuplicate отвечает 409 с ID существующей записи, если хранилище
+// отказало из-за дубликата
+func respondDuplicate(c *gin.Context, err error) bool {
+    var duplicate *storage.DuplicateError
+    if !errors.As(err, &duplicate) {
+        return false
+    }
+
+    c.JSON(http.StatusConflict, models.DuplicateResponse{Error: err.Error(), ExistingID: duplicate.ID})
+    return true
+}
+
+// upsertRecord переносит в существующую запись с тем же элементом описание,
+// контекст, срок и окно действия из запроса на создание
+func (s *Server) upsertRecord(c *gin.Context, id int, record *models.IPSetRecord) {
+    ctx := c.Request.Context()
+
+    existing, err := s.ipsetStorage.GetByID(ctx, id)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+    before := *existing
+
+    existing.Description = record.Description
+    existing.Context = record.Context
+    existing.ExpiresAt = record.ExpiresAt
+    existing.ActiveFrom = record.ActiveFrom
+    existing.Schedule = record.Schedule
+
+    if err := s.ipsetStorage.Update(ctx, id, existing); err != nil {
+        if !respondDuplicate(c, err) {
+            c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
+        }
+        return
+    }
+    s.audit(c, models.AuditUpdate, &before, existing)
+    if existing.ActiveFrom != nil || existing.Schedule != "" {
+        s.wakeScheduler()
+    }
+
+    c.JSON(http.StatusOK, existing)
+}
@@ -0,0 +1,60 @@
+package api
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "time"
+    "ipset-api-server/internal/models"
+)
+
+// expiryActor - автор событий аудита об удалении истекших записей
+const expiryActor = "system"
+
+// recordExpiry возвращает срок записи из expires_at или ttl запроса.
+// ok = false, если срок в запросе не указан.
+func recordExpiry(expiresAt *time.Time, ttl int, now time.Time) (*time.Time, bool, error) {
+    if expiresAt != nil && ttl != 0 {
+        return nil, false, fmt.Errorf("expires_at and ttl are mutually exclusive")
+    }
+    if ttl < 0 {
+        return nil, false, fmt.Errorf("ttl must be a positive number of seconds")
+    }
+
+    if ttl > 0 {
+        at := now.Add(time.Duration(ttl) * time.Second)
+        return &at, true, nil
+    }
+    if expiresAt != nil {
+        if !expiresAt.After(now) {
+            return nil, false, fmt.Errorf("expires_at must be in the future")
+        }
+        return expiresAt, true, nil
+    }
+    return nil, false, nil
+}
+
+// sweepExpired раз в ExpirySweepInterval окончательно удаляет истекшие
+// записи и пишет по событию аудита на каждую
+func (s *Server) sweepExpired(ctx context.Context) {
+    ticker := time.NewTicker(s.config.ExpirySweepInterval)
+    defer ticker.Stop()
+
+    for {
+        records, err := s.ipsetStorage.DeleteExpired(ctx, time.Now())
+        if err != nil {
+            log.Printf("expiry: failed to delete expired records: %v", err)
+        } else if len(records) > 0 {
+            for _, record := range records {
+                s.writeAudit(ctx, expiryActor, "", models.AuditExpire, record, nil)
+            }
+            log.Printf("expiry: deleted %d expired records", len(records))
+        }
+
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+    }
+}
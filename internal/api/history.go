@@ -0,0 +1,153 @@
+package api
+
+import (
+    "fmt"
+    "net/http"
+    "sort"
+    "strconv"
+    "time"
+    "ipset-api-server/internal/models"
+    "ipset-api-server/internal/storage"
+    
+    "github.com/gin-gonic/gin"
+)
+
+// getRecordHistory возвращает ревизии записи от первой к последней,
+// в том числе для уже удаленной записи
+func (s *Server) getRecordHistory(c *gin.Context) {
+    id, err := strconv.Atoi(c.Param("id"))
+    if err != nil || id < 100000 || id > 999999 {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "invalid ID (must be 6-digit number)"})
+        return
+    }
+    
+    revisions, err := s.ipsetStorage.History(c.Request.Context(), id)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+    
+    if len(revisions) == 0 {
+        c.JSON(http.StatusNotFound, models.ErrorResponse{Error: fmt.Sprintf("no history for record %d", id)})
+        return
+    }
+    
+    c.JSON(http.StatusOK, revisions)
+}
+
+// restoreSet возвращает сет к состоянию на момент as_of: удаленные с тех пор
+// записи восстанавливаются с прежним ID, измененные получают прежние
+// значения, добавленные после as_of удаляются. Изменения применяются по
+// одной записи, как при импорте, и попадают в историю и журнал аудита.
+// Без as_of из корзины возвращаются удаленные записи сета.
+func (s *Server) restoreSet(c *gin.Context) {
+    setName := c.Param("set_name")
+    ctx := c.Request.Context()
+    
+    asOf, err := timeParam(c, "as_of")
+    if err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+    if asOf.IsZero() {
+        s.undeleteSet(c)
+        return
+    }
+    if asOf.After(time.Now()) {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "as_of is in the future"})
+        return
+    }
+    
+    past, err := s.ipsetStorage.GetBySetNameAt(ctx, setName, asOf)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+    if len(past) == 0 {
+        c.JSON(http.StatusNotFound, models.ErrorResponse{
+            Error: fmt.Sprintf("set %s has no records at %s", setName, asOf.Format(time.RFC3339)),
+        })
+        return
+    }
+    
+    // Ошибка означает, что сейчас в сете нет записей
+    current, _ := s.ipsetStorage.GetBySetName(ctx, setName)
+    currentByID := make(map[int]*models.IPSetRecord, len(current))
+    for _, record := range current {
+        currentByID[record.ID] = record
+    }
+    
+    result := models.RestoreResult{
+        SetName:  setName,
+        AsOf:     &asOf,
+        Restored: []int{},
+        Updated:  []int{},
+        Deleted:  []int{},
+    }
+    importer, canImport := s.ipsetStorage.(storage.RecordImporter)
+    
+    pastIDs := make(map[int]bool, len(past))
+    for _, record := range past {
+        pastIDs[record.ID] = true
+        
+        if existing, ok := currentByID[record.ID]; ok {
+            if sameRecordContent(existing, record) {
+                continue
+            }
+            updated := *record
+            if err := s.ipsetStorage.Update(ctx, record.ID, &updated); err != nil {
+                result.Errors = append(result.Errors, fmt.Sprintf("record %d: %v", record.ID, err))
+                continue
+            }
+            s.audit(c, models.AuditRestore, existing, &updated)
+            result.Updated = append(result.Updated, record.ID)
+            continue
+        }
+        
+        // Удаленную запись возвращаем с прежним ID, если он свободен.
+        // ID мог перейти к записи другого сета - тогда создаем новую.
+        restored := *record
+        restored.UpdatedAt = time.Now().UTC()
+        if _, err := s.ipsetStorage.GetByID(ctx, record.ID); err != nil && canImport {
+            err = importer.ImportRecord(ctx, &restored)
+            if err != nil {
+                result.Errors = append(result.Errors, fmt.Sprintf("record %d: %v", record.ID, err))
+                continue
+            }
+        } else if err := s.ipsetStorage.Create(ctx, &restored); err != nil {
+            result.Errors = append(result.Errors, fmt.Sprintf("record %d: %v", record.ID, err))
+            continue
+        }
+        s.audit(c, models.AuditRestore, nil, &restored)
+        result.Restored = append(result.Restored, restored.ID)
+    }
+    
+    for _, record := range current {
+        if pastIDs[record.ID] {
+            continue
+        }
+        if err := s.ipsetStorage.Delete(ctx, record.ID); err != nil {
+            result.Errors = append(result.Errors, fmt.Sprintf("record %d: %v", record.ID, err))
+            continue
+        }
+        s.audit(c, models.AuditRestore, record, nil)
+        result.Deleted = append(result.Deleted, record.ID)
+    }
+    sort.Ints(result.Deleted)
+    
+    c.JSON(http.StatusOK, result)
+}
+
+// sameRecordContent сравнивает записи без ID и времени создания и изменения
+func sameRecordContent(a, b *models.IPSetRecord) bool {
+    return a.SetName == b.SetName &&
+        a.SetType == b.SetType &&
+        a.SetOptions == b.SetOptions &&
+        a.IP == b.IP &&
+        a.CIDR == b.CIDR &&
+        a.Port == b.Port &&
+        a.Protocol == b.Protocol &&
+        a.SecondIP == b.SecondIP &&
+        a.Description == b.Description &&
+        a.Context == b.Context
+}
@@ -0,0 +1,300 @@
+package api
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net/http"
+    "sort"
+    "strings"
+    "time"
+    "ipset-api-server/internal/models"
+    "ipset-api-server/internal/storage"
+    "ipset-api-server/pkg/validation"
+
+    "github.com/gin-gonic/gin"
+)
+
+// Импорт сета. Записи импорта проверяются все сразу: если хотя бы одна не
+// подходит сету, сет не меняется. Изменение сохраняется одним вызовом
+// ApplySetChanges (одна транзакция хранилища), поэтому неудачный импорт не
+// оставляет сет заполненным наполовину. Запись импорта совпадает с записью
+// сета, если совпадает элемент ipset (storage.EntryKey); такие записи не
+// добавляются повторно, поэтому импорт можно повторять. В режиме replace
+// совпавшие записи сохраняют ID, но получают описание, контекст и срок из
+// импорта, как при upsert. Разница с сетом считается по сету, прочитанному
+// на номере изменения, и ApplySetChanges применяет ее, только если сет с
+// тех пор не менялся.
+
+func (s *Server) importSet(c *gin.Context) {
+    ctx := c.Request.Context()
+
+    var req models.ImportSetRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    mode := req.Mode
+    if mode == "" {
+        mode = models.ImportAppend
+    }
+    if mode != models.ImportAppend && mode != models.ImportSync && mode != models.ImportReplace {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{
+            Error: fmt.Sprintf("mode: unknown mode %q (use append, sync or replace)", mode),
+        })
+        return
+    }
+
+    // Ошибки в имени, типе или опциях сета относятся ко всем записям
+    if err := validation.ValidateSetName("set_name", req.SetName); err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+    target := &models.IPSetRecord{SetName: req.SetName}
+    if err := s.resolveSet(ctx, nil, target, req.SetType, req.SetOptions); err != nil {
+        c.JSON(http.StatusConflict, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+    if err := validation.ValidateSet(target.SetType, target.SetOptions); err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    records, err := importRecords(&req, target, time.Now())
+    if err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    // Сет читается на номере изменения, и если до применения импорта его
+    // изменили, разница считается заново
+    var diff *importDiff
+    for attempt := 1; ; attempt++ {
+        diff, err = s.applyImport(ctx, &req, mode, target, records, c.GetString("key_id"))
+        var changed *storage.SetChangedError
+        if !errors.As(err, &changed) || attempt == importAttempts {
+            break
+        }
+    }
+    if err != nil {
+        var changed *storage.SetChangedError
+        switch {
+        case errors.As(err, &changed):
+            c.JSON(http.StatusConflict, models.ErrorResponse{
+                Error: fmt.Sprintf("set %s is being changed concurrently, retry the import", req.SetName),
+            })
+        case !respondDuplicate(c, err):
+            c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
+        }
+        return
+    }
+
+    result := models.ImportSetResult{
+        SetName:   req.SetName,
+        Mode:      mode,
+        Added:     []int{},
+        Removed:   []int{},
+        Updated:   []int{},
+        Unchanged: diff.unchanged,
+    }
+    for _, record := range diff.remove {
+        s.audit(c, models.AuditDelete, record, nil)
+        result.Removed = append(result.Removed, record.ID)
+    }
+    for i, record := range diff.updated {
+        s.audit(c, models.AuditUpdate, diff.update[i], record)
+        result.Updated = append(result.Updated, record.ID)
+    }
+    for _, record := range diff.add {
+        s.audit(c, models.AuditImport, nil, record)
+        result.Added = append(result.Added, record.ID)
+    }
+
+    c.JSON(http.StatusOK, result)
+}
+
+// importAttempts - сколько раз импорт пересчитывается, если сет меняют
+// одновременно с ним
+const importAttempts = 3
+
+// importDiff - изменение сета при импорте: добавленные и удаленные записи,
+// прежний и новый вид обновленных записей и ID оставшихся без изменений
+type importDiff struct {
+    add, remove     []*models.IPSetRecord
+    update, updated []*models.IPSetRecord
+    unchanged       []int
+}
+
+// applyImport читает сет, сравнивает его с записями импорта и применяет
+// разницу. Если сет изменили после чтения, возвращает
+// *storage.SetChangedError, и сет не меняется.
+func (s *Server) applyImport(ctx context.Context, req *models.ImportSetRequest, mode string, target *models.IPSetRecord,
+    records []*models.IPSetRecord, owner string) (*importDiff, error) {
+    revision, err := s.ipsetStorage.Revision(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    // Сета нет - он создается вместе с записями
+    var newSet *models.IPSetSet
+    if _, err := s.ipsetStorage.GetSet(ctx, req.SetName); err != nil {
+        newSet = &models.IPSetSet{
+            Name:    req.SetName,
+            Type:    target.SetType,
+            Options: target.SetOptions,
+            Family:  validation.Family(target.SetOptions),
+            Owner:   owner,
+        }
+    }
+
+    // Ошибка означает, что в сете нет записей
+    current, _ := s.ipsetStorage.GetBySetName(ctx, req.SetName)
+    diff := &importDiff{}
+    diff.add, diff.remove, diff.unchanged = diffImport(mode, current, records)
+    if req.Upsert || mode == models.ImportReplace {
+        diff.update, diff.updated, diff.unchanged = upsertImport(current, records, diff.unchanged)
+    }
+
+    if newSet == nil && len(diff.add) == 0 && len(diff.remove) == 0 && len(diff.updated) == 0 {
+        return diff, nil
+    }
+    removeIDs := make([]int, len(diff.remove))
+    for i, record := range diff.remove {
+        removeIDs[i] = record.ID
+    }
+    if err := s.ipsetStorage.ApplySetChanges(ctx, req.SetName, revision, newSet, removeIDs, diff.updated, diff.add); err != nil {
+        return nil, err
+    }
+    return diff, nil
+}
+
+// importRecords проверяет записи импорта и собирает из них записи сета.
+// Ошибки собираются по всем записям, одинаковые записи в импорте - ошибка.
+func importRecords(req *models.ImportSetRequest, target *models.IPSetRecord, now time.Time) ([]*models.IPSetRecord, error) {
+    var errs []string
+    seen := make(map[string]int, len(req.Records))
+    records := make([]*models.IPSetRecord, 0, len(req.Records))
+
+    for i, rec := range req.Records {
+        record := &models.IPSetRecord{
+            SetName:     req.SetName,
+            SetType:     target.SetType,
+            SetOptions:  target.SetOptions,
+            IP:          rec.IP,
+            CIDR:        rec.CIDR,
+            Port:        rec.Port,
+            Protocol:    rec.Protocol,
+            SecondIP:    rec.SecondIP,
+            Description: rec.Description,
+            Context:     rec.Context,
+        }
+        if record.Description == "" {
+            record.Description = req.Description
+        }
+        if record.Context == "" {
+            record.Context = req.Context
+        }
+
+        expiresAt, _, err := recordExpiry(nil, rec.TTL, now)
+        if err == nil {
+            err = prepareRecord(record)
+        }
+        if err != nil {
+            errs = append(errs, fmt.Sprintf("records[%d]: %v", i, err))
+            continue
+        }
+        record.ExpiresAt = expiresAt
+
+        key := storage.EntryKey(record)
+        if first, ok := seen[key]; ok {
+            errs = append(errs, fmt.Sprintf("records[%d]: duplicates records[%d]", i, first))
+            continue
+        }
+        seen[key] = i
+        records = append(records, record)
+    }
+
+    if len(errs) > 0 {
+        return nil, errors.New(strings.Join(errs, "; "))
+    }
+    return records, nil
+}
+
+// diffImport сравнивает записи сета с записями импорта: add - записи
+// импорта, которых нет в сете, remove - записи сета, которые уходят в
+// корзину, unchanged - ID записей сета, которые остаются как есть. После
+// импорта в сете будут ровно записи add и unchanged. replace сравнивает
+// записи так же, как sync.
+func diffImport(mode string, current, records []*models.IPSetRecord) (add, remove []*models.IPSetRecord, unchanged []int) {
+    unchanged = []int{}
+
+    // Повторы элемента в сете (остались от старых версий) sync удаляет
+    byKey := make(map[string]*models.IPSetRecord, len(current))
+    for _, record := range current {
+        if _, ok := byKey[storage.EntryKey(record)]; !ok {
+            byKey[storage.EntryKey(record)] = record
+        }
+    }
+
+    kept := make(map[int]bool, len(records))
+    for _, record := range records {
+        if existing, ok := byKey[storage.EntryKey(record)]; ok {
+            kept[existing.ID] = true
+            continue
+        }
+        add = append(add, record)
+    }
+
+    for _, record := range current {
+        if kept[record.ID] || mode == models.ImportAppend {
+            unchanged = append(unchanged, record.ID)
+        } else {
+            remove = append(remove, record)
+        }
+    }
+    sort.Ints(unchanged)
+    return add, remove, unchanged
+}
+
+// upsertImport отбирает среди оставшихся записей сета (unchanged) те, у
+// которых описание, контекст или срок отличаются от записи импорта с тем же
+// элементом. Возвращает их прежний и новый вид и ID остальных записей.
+func upsertImport(current, records []*models.IPSetRecord, unchanged []int) (before, after []*models.IPSetRecord, rest []int) {
+    byKey := make(map[string]*models.IPSetRecord, len(records))
+    for _, record := range records {
+        byKey[storage.EntryKey(record)] = record
+    }
+    kept := make(map[int]bool, len(unchanged))
+    for _, id := range unchanged {
+        kept[id] = true
+    }
+
+    rest = []int{}
+    for _, existing := range current {
+        if !kept[existing.ID] {
+            continue
+        }
+        record, ok := byKey[storage.EntryKey(existing)]
+        if !ok || (existing.Description == record.Description && existing.Context == record.Context &&
+            sameExpiry(existing.ExpiresAt, record.ExpiresAt)) {
+            rest = append(rest, existing.ID)
+            continue
+        }
+        changed := *existing
+        changed.Description = record.Description
+        changed.Context = record.Context
+        changed.ExpiresAt = record.ExpiresAt
+        before = append(before, existing)
+        after = append(after, &changed)
+    }
+    sort.Ints(rest)
+    return before, after, rest
+}
+
+func sameExpiry(a, b *time.Time) bool {
+    if a == nil || b == nil {
+        return a == b
+    }
+    return a.Equal(*b)
+}
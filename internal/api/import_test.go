@@ -0,0 +1,96 @@
+package api
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "reflect"
+    "strconv"
+    "testing"
+    "ipset-api-server/internal/models"
+    "ipset-api-server/internal/storage"
+)
+
+func TestImportReplaceKeepsMatchingRecords(t *testing.T) {
+    ts := newTestServer(t, "")
+    kept := ts.createRecord("blacklist", "10.0.0.1")
+    changed := ts.createRecord("blacklist", "10.0.0.2")
+    removed := ts.createRecord("blacklist", "10.0.0.3")
+
+    var result models.ImportSetResult
+    ts.do(http.MethodPost, "/sets/import", map[string]interface{}{
+        "set_name": "blacklist",
+        "mode":     models.ImportReplace,
+        "context":  "test",
+        "records": []map[string]interface{}{
+            {"ip": "10.0.0.1"},
+            {"ip": "10.0.0.2", "description": "moved to the new list"},
+            {"ip": "10.0.0.4"},
+        },
+    }, http.StatusOK, &result)
+
+    // Совпавшие записи остаются с прежними ID, новые описание и контекст
+    // переходят в запись, как при upsert
+    if !reflect.DeepEqual(result.Unchanged, []int{kept.ID}) {
+        t.Fatalf("unchanged %v, want [%d]", result.Unchanged, kept.ID)
+    }
+    if !reflect.DeepEqual(result.Updated, []int{changed.ID}) {
+        t.Fatalf("updated %v, want [%d]", result.Updated, changed.ID)
+    }
+    if !reflect.DeepEqual(result.Removed, []int{removed.ID}) {
+        t.Fatalf("removed %v, want [%d]", result.Removed, removed.ID)
+    }
+    if len(result.Added) != 1 {
+        t.Fatalf("added %v, want one record", result.Added)
+    }
+
+    var record models.IPSetRecord
+    ts.do(http.MethodGet, "/records/"+strconv.Itoa(changed.ID), nil, http.StatusOK, &record)
+    if record.Description != "moved to the new list" {
+        t.Fatalf("description %q after replace", record.Description)
+    }
+
+    // Повторный импорт ничего не меняет
+    ts.do(http.MethodPost, "/sets/import", map[string]interface{}{
+        "set_name": "blacklist",
+        "mode":     models.ImportReplace,
+        "context":  "test",
+        "records": []map[string]interface{}{
+            {"ip": "10.0.0.1"},
+            {"ip": "10.0.0.2", "description": "moved to the new list"},
+            {"ip": "10.0.0.4"},
+        },
+    }, http.StatusOK, &result)
+    if len(result.Added) != 0 || len(result.Removed) != 0 || len(result.Updated) != 0 || len(result.Unchanged) != 3 {
+        t.Fatalf("repeated replace %+v, want everything unchanged", result)
+    }
+}
+
+func TestApplySetChangesRevision(t *testing.T) {
+    ts := newTestServer(t, "")
+    ctx := context.Background()
+    record := ts.createRecord("blacklist", "10.0.0.1")
+    revision, err := ts.ipsetStorage.Revision(ctx)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // Изменение другого сета не мешает импорту
+    ts.createRecord("whitelist", "10.0.0.2")
+    if err := ts.ipsetStorage.ApplySetChanges(ctx, "blacklist", revision, nil, nil, nil,
+        []*models.IPSetRecord{{SetName: "blacklist", IP: "10.0.0.3", Context: "test"}}); err != nil {
+        t.Fatal(err)
+    }
+
+    // Сет изменился после revision - импорт, посчитанный по нему, не
+    // применяется
+    ts.createRecord("blacklist", "10.0.0.4")
+    err = ts.ipsetStorage.ApplySetChanges(ctx, "blacklist", revision, nil, []int{record.ID}, nil, nil)
+    var changed *storage.SetChangedError
+    if !errors.As(err, &changed) {
+        t.Fatalf("error %v, want a set changed error", err)
+    }
+    if _, err := ts.ipsetStorage.GetByID(ctx, record.ID); err != nil {
+        t.Fatalf("record was removed: %v", err)
+    }
+}
@@ -0,0 +1,172 @@
+package api
+
+import (
+    "fmt"
+    "net/url"
+    "strconv"
+    "strings"
+    "time"
+    "ipset-api-server/internal/models"
+    "ipset-api-server/internal/storage"
+    
+    "github.com/gin-gonic/gin"
+)
+
+// parseRecordQuery читает параметры выборки записей:
+// limit, cursor, set_name, context, protocol, port,
+// created_after, created_before, updated_after, updated_before (RFC3339)
+// и sort (имя поля, с префиксом "-" для сортировки по убыванию)
+func parseRecordQuery(c *gin.Context) (*models.RecordQuery, error) {
+    query := &models.RecordQuery{
+        SetName:  c.Query("set_name"),
+        Context:  c.Query("context"),
+        Protocol: c.Query("protocol"),
+        Cursor:   c.Query("cursor"),
+    }
+    
+    var err error
+    if query.Limit, err = intParam(c, "limit"); err != nil {
+        return nil, err
+    }
+    if query.Port, err = intParam(c, "port"); err != nil {
+        return nil, err
+    }
+    
+    times := []struct {
+        name  string
+        value *time.Time
+    }{
+        {"created_after", &query.CreatedAfter},
+        {"created_before", &query.CreatedBefore},
+        {"updated_after", &query.UpdatedAfter},
+        {"updated_before", &query.UpdatedBefore},
+    }
+    for _, t := range times {
+        if *t.value, err = timeParam(c, t.name); err != nil {
+            return nil, err
+        }
+    }
+    
+    sort := c.Query("sort")
+    if strings.HasPrefix(sort, "-") {
+        query.Desc = true
+        sort = sort[1:]
+    }
+    query.SortBy = sort
+    
+    if err := storage.NormalizeRecordQuery(query); err != nil {
+        return nil, err
+    }
+    return query, nil
+}
+
+// parseSetQuery читает параметры выборки сетов: limit, cursor, set_type
+// и sort (name или -name)
+func parseSetQuery(c *gin.Context) (*models.SetQuery, error) {
+    query := &models.SetQuery{
+        SetType: c.Query("set_type"),
+        Cursor:  c.Query("cursor"),
+    }
+    
+    var err error
+    if query.Limit, err = intParam(c, "limit"); err != nil {
+        return nil, err
+    }
+    
+    switch c.Query("sort") {
+    case "", "name":
+    case "-name":
+        query.Desc = true
+    default:
+        return nil, fmt.Errorf("unsupported sort field: %s", c.Query("sort"))
+    }
+    
+    if err := storage.NormalizeSetQuery(query); err != nil {
+        return nil, err
+    }
+    return query, nil
+}
+
+// parseAuditQuery читает фильтры журнала аудита: actor, action, set_name,
+// record_id, request_id, since, until (RFC3339), limit и cursor
+func parseAuditQuery(c *gin.Context) (*models.AuditQuery, error) {
+    query := &models.AuditQuery{
+        Actor:     c.Query("actor"),
+        Action:    c.Query("action"),
+        SetName:   c.Query("set_name"),
+        RequestID: c.Query("request_id"),
+        Cursor:    c.Query("cursor"),
+    }
+    
+    var err error
+    if query.Limit, err = intParam(c, "limit"); err != nil {
+        return nil, err
+    }
+    if query.RecordID, err = intParam(c, "record_id"); err != nil {
+        return nil, err
+    }
+    if query.Since, err = timeParam(c, "since"); err != nil {
+        return nil, err
+    }
+    if query.Until, err = timeParam(c, "until"); err != nil {
+        return nil, err
+    }
+    
+    if err := storage.NormalizeAuditQuery(query); err != nil {
+        return nil, err
+    }
+    return query, nil
+}
+
+func intParam(c *gin.Context, name string) (int, error) {
+    value := c.Query(name)
+    if value == "" {
+        return 0, nil
+    }
+    
+    n, err := strconv.Atoi(value)
+    if err != nil || n < 0 {
+        return 0, fmt.Errorf("invalid %s: %s", name, value)
+    }
+    return n, nil
+}
+
+func boolParam(c *gin.Context, name string) (bool, error) {
+    value := c.Query(name)
+    if value == "" {
+        return false, nil
+    }
+    
+    b, err := strconv.ParseBool(value)
+    if err != nil {
+        return false, fmt.Errorf("invalid %s: %s", name, value)
+    }
+    return b, nil
+}
+
+func timeParam(c *gin.Context, name string) (time.Time, error) {
+    value := c.Query(name)
+    if value == "" {
+        return time.Time{}, nil
+    }
+    
+    t, err := time.Parse(time.RFC3339, value)
+    if err != nil {
+        return time.Time{}, fmt.Errorf("invalid %s (expected RFC3339): %s", name, value)
+    }
+    return t, nil
+}
+
+// setNextLink добавляет ссылку на следующую страницу с теми же параметрами
+func setNextLink(c *gin.Context, cursor string) {
+    if cursor == "" {
+        return
+    }
+    
+    params := c.Request.URL.Query()
+    params.Set("cursor", cursor)
+    next := url.URL{Path: c.Request.URL.Path, RawQuery: params.Encode()}
+    
+    c.Header("X-Next-Cursor", cursor)
+    c.Header("Link", fmt.Sprintf("<%s>; rel=\"next\"", next.String()))
+}
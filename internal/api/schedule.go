@@ -0,0 +1,174 @@
+package api
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "sort"
+    "time"
+    "ipset-api-server/internal/models"
+    "ipset-api-server/pkg/schedule"
+)
+
+// Окно действия записи: active_from и расписание schedule. Хранилище
+// отдает записи независимо от окна (они нужны для аудита удаления сета,
+// импорта и переписывания записей при изменении сета), поэтому все, что
+// отдает сет потребителям - GET /sets/:name, экспорт, GET /lookup и
+// контрольная сумма для агентов, - отбирает действующие записи через
+// activeRecords и activeSetRecords. Планировщик пишет в аудит события
+// activate/deactivate на границах окон и обновляет сет записи, чтобы в
+// потоке изменений (GET /watch, webhooks, агент) появилось update сета -
+// по нему потребители экспорта применяют сет заново.
+
+// schedulerActor - автор событий аудита о начале и конце окна действия
+const schedulerActor = "system"
+
+// validateSchedule проверяет расписание из запроса
+func validateSchedule(value string) error {
+    if value == "" {
+        return nil
+    }
+    if _, err := schedule.Parse(value); err != nil {
+        return fmt.Errorf("schedule: %v", err)
+    }
+    return nil
+}
+
+// recordActive - действует ли запись в момент now. Расписание, которое не
+// удается разобрать (проверяется при записи, так что это только ручная
+// правка базы), не ограничивает запись.
+func recordActive(record *models.IPSetRecord, now time.Time) bool {
+    if record.ActiveFrom != nil && now.Before(*record.ActiveFrom) {
+        return false
+    }
+    if record.Schedule == "" {
+        return true
+    }
+    sched, err := schedule.Parse(record.Schedule)
+    if err != nil {
+        return true
+    }
+    return sched.Active(now)
+}
+
+// activeRecords - записи, действующие в момент now
+func activeRecords(records []*models.IPSetRecord, now time.Time) []*models.IPSetRecord {
+    result := make([]*models.IPSetRecord, 0, len(records))
+    for _, record := range records {
+        if recordActive(record, now) {
+            result = append(result, record)
+        }
+    }
+    return result
+}
+
+// activeSetRecords - записи сета, действующие в момент at
+func (s *Server) activeSetRecords(ctx context.Context, setName string, at time.Time) []*models.IPSetRecord {
+    // Ошибка означает, что в сете нет записей
+    records, _ := s.ipsetStorage.GetBySetName(ctx, setName)
+    return activeRecords(records, at)
+}
+
+// nextBoundary - ближайший после now момент, когда запись может начать или
+// перестать действовать; нулевое время, если таких моментов нет
+func nextBoundary(record *models.IPSetRecord, now time.Time) time.Time {
+    var next time.Time
+    if record.ActiveFrom != nil && record.ActiveFrom.After(now) {
+        next = *record.ActiveFrom
+    }
+    if record.Schedule != "" {
+        if sched, err := schedule.Parse(record.Schedule); err == nil {
+            if at := sched.Next(now); !at.IsZero() && (next.IsZero() || at.Before(next)) {
+                next = at
+            }
+        }
+    }
+    return next
+}
+
+// wakeScheduler просит планировщик пересчитать ближайшую границу: у новой
+// или измененной записи она может быть раньше, чем он собирался проснуться
+func (s *Server) wakeScheduler() {
+    select {
+    case s.schedulerWake <- struct{}{}:
+    default:
+    }
+}
+
+// runScheduler следит за окнами действия записей: на каждой границе окна
+// пишет в аудит activate или deactivate и отмечает изменение сета записи в
+// потоке изменений (touchSets). Просыпается на ближайшей границе,
+// после изменения записи с окном действия и не реже SchedulerInterval.
+// Состояние не хранится: записи сравниваются с предыдущей проверкой, поэтому
+// границы, пройденные до запуска сервера, событий не дают.
+func (s *Server) runScheduler(ctx context.Context) {
+    prev := time.Now()
+    timer := time.NewTimer(0)
+    defer timer.Stop()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-timer.C:
+        case <-s.schedulerWake:
+            // С Go 1.23 Stop гарантирует, что старое срабатывание не придет
+            timer.Stop()
+        }
+
+        now := time.Now()
+        wake := now.Add(s.config.SchedulerInterval)
+
+        records, err := s.ipsetStorage.GetAll(ctx)
+        if err != nil {
+            log.Printf("scheduler: failed to read records: %v", err)
+        }
+        touched := make(map[string]bool)
+        for _, record := range records {
+            if record.ActiveFrom == nil && record.Schedule == "" {
+                continue
+            }
+
+            was, is := recordActive(record, prev), recordActive(record, now)
+            switch {
+            case !was && is:
+                s.writeAudit(ctx, schedulerActor, "", models.AuditActivate, nil, record)
+                touched[record.SetName] = true
+            case was && !is:
+                s.writeAudit(ctx, schedulerActor, "", models.AuditDeactivate, record, nil)
+                touched[record.SetName] = true
+            }
+
+            if at := nextBoundary(record, now); !at.IsZero() && at.Before(wake) {
+                wake = at
+            }
+        }
+        if len(touched) > 0 {
+            log.Printf("scheduler: records of %d sets changed activation state", len(touched))
+            s.touchSets(ctx, touched)
+        }
+
+        prev = now
+        timer.Reset(time.Until(wake))
+    }
+}
+
+// touchSets обновляет сеты без изменения полей: хранилище дает на это
+// update сета с новым номером в потоке изменений
+func (s *Server) touchSets(ctx context.Context, names map[string]bool) {
+    sorted := make([]string, 0, len(names))
+    for name := range names {
+        sorted = append(sorted, name)
+    }
+    sort.Strings(sorted)
+
+    for _, name := range sorted {
+        set, err := s.ipsetStorage.GetSet(ctx, name)
+        if err == nil {
+            err = s.ipsetStorage.UpdateSet(ctx, set)
+        }
+        if err != nil {
+            log.Printf("scheduler: failed to mark set %s changed: %v", name, err)
+        }
+    }
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+    "context"
+    "net/http"
+    "strings"
+    "testing"
+    "time"
+    "ipset-api-server/internal/models"
+)
+
+func TestInactiveRecordsHidden(t *testing.T) {
+    ts := newTestServer(t, "")
+    // Запись IPv6 в сете без опции family - из данных, записанных до
+    // проверки семейства; API такую уже не примет
+    activeFrom := time.Now().Add(time.Hour)
+    inactive := &models.IPSetRecord{
+        SetName:    "blacklist",
+        SetType:    "hash:ip",
+        IP:         "2001:db8::1",
+        Context:    "test",
+        ActiveFrom: &activeFrom,
+    }
+    if err := ts.ipsetStorage.Create(context.Background(), inactive); err != nil {
+        t.Fatal(err)
+    }
+    active := ts.createRecord("blacklist", "10.0.0.1")
+
+    // Семейство сета определяется по действующей записи IPv4
+    code, raw, err := ts.request(http.MethodGet, "/sets/blacklist/export", nil)
+    if err != nil || code != http.StatusOK {
+        t.Fatalf("export: status %d, error %v: %s", code, err, raw)
+    }
+    export := string(raw)
+    if !strings.Contains(export, "ipset create blacklist hash:ip  -exist") ||
+        !strings.Contains(export, "ipset add blacklist 10.0.0.1 -exist") ||
+        strings.Contains(export, "2001:db8::1") {
+        t.Fatalf("export of a set with an inactive IPv6 record:\n%s", export)
+    }
+
+    var records []*models.IPSetRecord
+    ts.do(http.MethodGet, "/sets/blacklist/export?format=json", nil, http.StatusOK, &records)
+    if len(records) != 1 || records[0].ID != active.ID {
+        t.Fatalf("json export %+v, want only record %d", records, active.ID)
+    }
+
+    // Запись вне окна действия адрес не блокирует
+    var result models.LookupResult
+    ts.do(http.MethodGet, "/lookup?ip=2001:db8::1", nil, http.StatusOK, &result)
+    if len(result.Records) != 0 || len(result.Sets) != 0 {
+        t.Fatalf("lookup of an inactive record %+v, want no matches", result)
+    }
+    ts.do(http.MethodGet, "/lookup?ip=10.0.0.1", nil, http.StatusOK, &result)
+    if len(result.Records) != 1 || result.Records[0].ID != active.ID {
+        t.Fatalf("lookup %+v, want record %d", result, active.ID)
+    }
+}
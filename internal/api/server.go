@@ -1,31 +1,52 @@
 package api
 
 import (
+    "context"
+    "errors"
     "fmt"
     "net/http"
     "strconv"
     "strings"
+    "time"
     "ipset-api-server/internal/auth"
     "ipset-api-server/internal/config"
     "ipset-api-server/internal/models"
     "ipset-api-server/internal/storage"
+    "ipset-api-server/pkg/validation"
     
     "github.com/gin-gonic/gin"
 )
 
 type Server struct {
-    router       *gin.Engine
-    config       *config.Config
-    authManager  *auth.Manager
-    ipsetStorage storage.IPSetStorage
+    router         *gin.Engine
+    config         *config.Config
+    authManager    *auth.Manager
+    ipsetStorage   storage.IPSetStorage
+    auditStorage   storage.AuditStorage
+    webhookStorage storage.WebhookStorage
+    agentStorage   storage.AgentStorage
+    
+    // schedulerWake будит планировщик окон действия после изменения записи
+    schedulerWake chan struct{}
+    // watchHub сообщает ожидающим GET /watch о новых изменениях
+    watchHub *watchHub
+    // webhookWake будит рассылку webhooks после изменения через API
+    webhookWake chan struct{}
 }
 
-func NewServer(cfg *config.Config, authManager *auth.Manager, ipsetStorage storage.IPSetStorage) *Server {
+func NewServer(cfg *config.Config, authManager *auth.Manager, ipsetStorage storage.IPSetStorage, auditStorage storage.AuditStorage, webhookStorage storage.WebhookStorage, agentStorage storage.AgentStorage) *Server {
     server := &Server{
-        router:       gin.Default(),
-        config:       cfg,
-        authManager:  authManager,
-        ipsetStorage: ipsetStorage,
+        router:         gin.Default(),
+        config:         cfg,
+        authManager:    authManager,
+        ipsetStorage:   ipsetStorage,
+        auditStorage:   auditStorage,
+        webhookStorage: webhookStorage,
+        agentStorage:   agentStorage,
+        
+        schedulerWake: make(chan struct{}, 1),
+        watchHub:      newWatchHub(),
+        webhookWake:   make(chan struct{}, 1),
     }
     
     server.setupRoutes()
@@ -33,27 +54,75 @@ func NewServer(cfg *config.Config, authManager *auth.Manager, ipsetStorage stora
 }
 
 func (s *Server) setupRoutes() {
+    s.router.Use(requestIDMiddleware())
+    
     // Публичные маршруты
     s.router.POST("/login", s.login)
     
     // Защищенные маршруты
     authorized := s.router.Group("/")
-    authorized.Use(s.authMiddleware())
+    authorized.Use(s.authMiddleware(), s.watchMiddleware())
     {
         // Records endpoints
         authorized.GET("/records", s.getAllRecords)
         authorized.GET("/records/:id", s.getRecordByID)
         authorized.POST("/records", s.createRecord)
+        authorized.POST("/records/bulk", s.bulkRecords)
+        authorized.POST("/records/bulk/update", s.bulkUpdateRecords)
         authorized.PUT("/records/:id", s.updateRecord)
         authorized.DELETE("/records/:id", s.deleteRecord)
         authorized.GET("/records/search", s.searchRecords)
+        authorized.GET("/records/:id/history", s.getRecordHistory)
+        authorized.POST("/records/:id/restore", s.restoreRecord)
         
         // Sets endpoints
         authorized.GET("/sets", s.getAllSets)
+        authorized.POST("/sets", s.createSet)
         authorized.GET("/sets/:set_name", s.getSetByName)
+        authorized.PUT("/sets/:set_name", s.updateSet)
         authorized.DELETE("/sets/:set_name", s.deleteSet)
         authorized.POST("/sets/import", s.importSet)
+        authorized.POST("/sets/swap", s.swapSets)
+        authorized.POST("/sets/:set_name/rename", s.renameSet)
+        authorized.POST("/sets/:set_name/copy", s.copySet)
         authorized.GET("/sets/:set_name/export", s.exportSet)
+        authorized.POST("/sets/:set_name/restore", s.restoreSet)
+        
+        // Какие сеты и контексты покрывают адрес
+        authorized.GET("/lookup", s.lookup)
+        
+        // Журнал изменений
+        authorized.GET("/audit", s.getAuditLog)
+        
+        // Удаленные записи
+        authorized.GET("/trash", s.getTrash)
+        
+        // Поток изменений
+        authorized.GET("/watch", s.watch)
+        
+        // Подписки на изменения
+        authorized.GET("/webhooks", s.getWebhooks)
+        authorized.POST("/webhooks", s.createWebhook)
+        authorized.GET("/webhooks/deliveries", s.getDeliveries)
+        authorized.POST("/webhooks/deliveries/:id/retry", s.retryDelivery)
+        authorized.GET("/webhooks/:id", s.getWebhook)
+        authorized.PUT("/webhooks/:id", s.updateWebhook)
+        authorized.DELETE("/webhooks/:id", s.deleteWebhook)
+        authorized.GET("/webhooks/:id/deliveries", s.getWebhookDeliveries)
+        
+        // Агенты на хостах: реестр, heartbeat, отчеты о применении сетов и
+        // правила назначения сетов
+        authorized.GET("/agents", s.getAgents)
+        authorized.POST("/agents/register", s.registerAgent)
+        authorized.POST("/agents/report", s.reportAgent)
+        authorized.GET("/agents/assignments", s.getAssignments)
+        authorized.POST("/agents/assignments", s.createAssignment)
+        authorized.GET("/agents/assignments/:id", s.getAssignment)
+        authorized.PUT("/agents/assignments/:id", s.updateAssignment)
+        authorized.DELETE("/agents/assignments/:id", s.deleteAssignment)
+        authorized.GET("/agents/:hostname", s.getAgent)
+        authorized.DELETE("/agents/:hostname", s.deleteAgent)
+        authorized.POST("/agents/:hostname/heartbeat", s.heartbeatAgent)
     }
     
     // Выводим все зарегистрированные маршруты для отладки
@@ -81,7 +150,7 @@ func (s *Server) authMiddleware() gin.HandlerFunc {
             return
         }
         
-        valid, err := s.authManager.ValidateKey(apiKey)
+        valid, err := s.authManager.ValidateKey(c.Request.Context(), apiKey)
         if err != nil || !valid {
             c.JSON(http.StatusUnauthorized, models.ErrorResponse{Error: "invalid or expired API key"})
             c.Abort()
@@ -89,6 +158,7 @@ func (s *Server) authMiddleware() gin.HandlerFunc {
         }
         
         c.Set("api_key", apiKey)
+        c.Set("key_id", auth.KeyID(apiKey))
         c.Next()
     }
 }
@@ -100,7 +170,7 @@ func (s *Server) login(c *gin.Context) {
         return
     }
     
-    valid, err := s.authManager.ValidateKey(req.APIKey)
+    valid, err := s.authManager.ValidateKey(c.Request.Context(), req.APIKey)
     if err != nil {
         c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "internal server error"})
         return
@@ -120,14 +190,23 @@ func (s *Server) login(c *gin.Context) {
     c.JSON(http.StatusOK, models.LoginResponse{Token: token})
 }
 
+// getAllRecords возвращает одну страницу записей. Курсор следующей страницы
+// передается в заголовках X-Next-Cursor и Link (rel="next").
 func (s *Server) getAllRecords(c *gin.Context) {
-    records, err := s.ipsetStorage.GetAll()
+    query, err := parseRecordQuery(c)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+    
+    page, err := s.ipsetStorage.List(c.Request.Context(), query)
     if err != nil {
         c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
         return
     }
     
-    c.JSON(http.StatusOK, records)
+    setNextLink(c, page.NextCursor)
+    c.JSON(http.StatusOK, page.Records)
 }
 
 func (s *Server) getRecordByID(c *gin.Context) {
@@ -137,7 +216,7 @@ func (s *Server) getRecordByID(c *gin.Context) {
         return
     }
     
-    record, err := s.ipsetStorage.GetByID(id)
+    record, err := s.ipsetStorage.GetByID(c.Request.Context(), id)
     if err != nil {
         c.JSON(http.StatusNotFound, models.ErrorResponse{Error: err.Error()})
         return
@@ -146,6 +225,8 @@ func (s *Server) getRecordByID(c *gin.Context) {
     c.JSON(http.StatusOK, record)
 }
 
+// createRecord создает запись. С ?upsert=true запись с тем же элементом,
+// которая уже есть в сете, не дает 409, а получает поля запроса (200).
 func (s *Server) createRecord(c *gin.Context) {
     var req models.CreateIPSetRequest
     if err := c.ShouldBindJSON(&req); err != nil {
@@ -153,22 +234,34 @@ func (s *Server) createRecord(c *gin.Context) {
         return
     }
     
-    record := &models.IPSetRecord{
-        SetName:     req.SetName,
-        SetType:     req.SetType,
-        SetOptions:  req.SetOptions,
-        IP:          req.IP,
-        CIDR:        req.CIDR,
-        Port:        req.Port,
-        Protocol:    req.Protocol,
-        Description: req.Description,
-        Context:     req.Context,
+    upsert, err := boolParam(c, "upsert")
+    if err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
     }
     
-    if err := s.ipsetStorage.Create(record); err != nil {
-        c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
+    record, status, err := s.newRecord(c.Request.Context(), nil, &req)
+    if err != nil {
+        c.JSON(status, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+    
+    err = s.ipsetStorage.Create(c.Request.Context(), record)
+    var duplicate *storage.DuplicateError
+    if upsert && errors.As(err, &duplicate) {
+        s.upsertRecord(c, duplicate.ID, record)
+        return
+    }
+    if err != nil {
+        if !respondDuplicate(c, err) {
+            c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
+        }
         return
     }
+    s.audit(c, models.AuditCreate, nil, record)
+    if record.ActiveFrom != nil || record.Schedule != "" {
+        s.wakeScheduler()
+    }
     
     c.JSON(http.StatusCreated, record)
 }
@@ -186,12 +279,72 @@ func (s *Server) updateRecord(c *gin.Context) {
         return
     }
     
-    existing, err := s.ipsetStorage.GetByID(id)
+    existing, err := s.ipsetStorage.GetByID(c.Request.Context(), id)
     if err != nil {
         c.JSON(http.StatusNotFound, models.ErrorResponse{Error: err.Error()})
         return
     }
+    before := *existing
+    
+    if status, err := s.changeRecord(c.Request.Context(), nil, existing, &req); err != nil {
+        c.JSON(status, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+    
+    if err := s.ipsetStorage.Update(c.Request.Context(), id, existing); err != nil {
+        if !respondDuplicate(c, err) {
+            c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
+        }
+        return
+    }
+    s.audit(c, models.AuditUpdate, &before, existing)
+    if existing.ActiveFrom != nil || existing.Schedule != "" {
+        s.wakeScheduler()
+    }
     
+    c.JSON(http.StatusOK, existing)
+}
+
+// newRecord собирает запись из запроса POST /records и проверяет ее, sets -
+// как у resolveSet. Вместе с ошибкой возвращается код ответа.
+func (s *Server) newRecord(ctx context.Context, sets setCache, req *models.CreateIPSetRequest) (*models.IPSetRecord, int, error) {
+    record := &models.IPSetRecord{
+        SetName:     req.SetName,
+        SetType:     req.SetType,
+        SetOptions:  req.SetOptions,
+        IP:          req.IP,
+        CIDR:        req.CIDR,
+        Port:        req.Port,
+        Protocol:    req.Protocol,
+        SecondIP:    req.SecondIP,
+        Description: req.Description,
+        Context:     req.Context,
+    }
+    
+    expiresAt, _, err := recordExpiry(req.ExpiresAt, req.TTL, time.Now())
+    if err != nil {
+        return nil, http.StatusBadRequest, err
+    }
+    record.ExpiresAt = expiresAt
+    
+    if err := validateSchedule(req.Schedule); err != nil {
+        return nil, http.StatusBadRequest, err
+    }
+    record.ActiveFrom = req.ActiveFrom
+    record.Schedule = req.Schedule
+    
+    if err := s.resolveSet(ctx, sets, record, req.SetType, req.SetOptions); err != nil {
+        return nil, http.StatusConflict, err
+    }
+    if err := prepareRecord(record); err != nil {
+        return nil, http.StatusBadRequest, err
+    }
+    return record, 0, nil
+}
+
+// changeRecord применяет к записи запрос PUT /records/:id и проверяет ее,
+// sets - как у resolveSet. Вместе с ошибкой возвращается код ответа.
+func (s *Server) changeRecord(ctx context.Context, sets setCache, existing *models.IPSetRecord, req *models.UpdateIPSetRequest) (int, error) {
     if req.SetName != "" {
         existing.SetName = req.SetName
     }
@@ -207,25 +360,42 @@ func (s *Server) updateRecord(c *gin.Context) {
     if req.Protocol != "" {
         existing.Protocol = req.Protocol
     }
+    if req.SecondIP != "" {
+        existing.SecondIP = req.SecondIP
+    }
     if req.Description != "" {
         existing.Description = req.Description
     }
     if req.Context != "" {
         existing.Context = req.Context
     }
-    if req.SetType != "" {
-        existing.SetType = req.SetType
+    
+    expiresAt, ok, err := recordExpiry(req.ExpiresAt, req.TTL, time.Now())
+    if err != nil {
+        return http.StatusBadRequest, err
     }
-    if req.SetOptions != "" {
-        existing.SetOptions = req.SetOptions
+    if ok {
+        existing.ExpiresAt = expiresAt
     }
     
-    if err := s.ipsetStorage.Update(id, existing); err != nil {
-        c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
-        return
+    if req.ActiveFrom != nil {
+        existing.ActiveFrom = req.ActiveFrom
+    }
+    if req.Schedule != nil {
+        if err := validateSchedule(*req.Schedule); err != nil {
+            return http.StatusBadRequest, err
+        }
+        existing.Schedule = *req.Schedule
     }
     
-    c.JSON(http.StatusOK, existing)
+    // Тип и опции записи меняются вместе с сетом (PUT /sets/:set_name)
+    if err := s.resolveSet(ctx, sets, existing, req.SetType, req.SetOptions); err != nil {
+        return http.StatusConflict, err
+    }
+    if err := prepareRecord(existing); err != nil {
+        return http.StatusBadRequest, err
+    }
+    return 0, nil
 }
 
 func (s *Server) deleteRecord(c *gin.Context) {
@@ -235,10 +405,17 @@ func (s *Server) deleteRecord(c *gin.Context) {
         return
     }
     
-    if err := s.ipsetStorage.Delete(id); err != nil {
+    record, err := s.ipsetStorage.GetByID(c.Request.Context(), id)
+    if err != nil {
+        c.JSON(http.StatusNotFound, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+    
+    if err := s.ipsetStorage.Delete(c.Request.Context(), id); err != nil {
         c.JSON(http.StatusNotFound, models.ErrorResponse{Error: err.Error()})
         return
     }
+    s.audit(c, models.AuditDelete, record, nil)
     
     c.JSON(http.StatusOK, models.SuccessResponse{Message: "record deleted successfully"})
 }
@@ -249,8 +426,10 @@ func (s *Server) searchRecords(c *gin.Context) {
         c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "search query required"})
         return
     }
+    // Адреса хранятся в канонической форме, 2001:DB8:0::1 ищем как 2001:db8::1
+    query = validation.NormalizeQuery(query)
     
-    records, err := s.ipsetStorage.Search(query)
+    records, err := s.ipsetStorage.Search(c.Request.Context(), query)
     if err != nil {
         c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
         return
@@ -259,140 +438,164 @@ func (s *Server) searchRecords(c *gin.Context) {
     c.JSON(http.StatusOK, records)
 }
 
-// Sets endpoints
-func (s *Server) getAllSets(c *gin.Context) {
-    sets, err := s.ipsetStorage.GetAllSets()
+// lookup ищет записи, которые содержат адрес или пересекаются с сетью
+func (s *Server) lookup(c *gin.Context) {
+    prefix, err := validation.LookupPrefix(c.Query("ip"))
     if err != nil {
-        c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
         return
     }
     
-    c.JSON(http.StatusOK, sets)
-}
-
-func (s *Server) getSetByName(c *gin.Context) {
-    setName := c.Param("set_name")
-    
-    records, err := s.ipsetStorage.GetBySetName(setName)
+    records, err := s.ipsetStorage.Lookup(c.Request.Context(), prefix)
     if err != nil {
         c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
         return
     }
     
-    if len(records) == 0 {
-        c.JSON(http.StatusNotFound, models.ErrorResponse{Error: "set not found"})
-        return
+    // Одиночный адрес показываем без /32 и /128
+    result := models.LookupResult{
+        IP:       prefix.String(),
+        Records:  []*models.IPSetRecord{},
+        Sets:     []string{},
+        Contexts: []string{},
     }
-    
-    // Преобразуем []*models.IPSetRecord в []models.IPSetRecord
-    recordList := make([]models.IPSetRecord, len(records))
-    for i, r := range records {
-        recordList[i] = *r
+    if prefix.IsSingleIP() {
+        result.IP = prefix.Addr().String()
     }
     
-    set := &models.IPSetSet{
-        Name:      setName,
-        Type:      records[0].SetType,
-        Options:   records[0].SetOptions,
-        Records:   recordList,
-        CreatedAt: records[0].CreatedAt,
-        UpdatedAt: records[0].UpdatedAt,
+    // Запись вне окна действия адрес не блокирует (см. schedule.go)
+    seenSets := make(map[string]bool)
+    seenContexts := make(map[string]bool)
+    for _, record := range activeRecords(records, time.Now()) {
+        result.Records = append(result.Records, record)
+        if !seenSets[record.SetName] {
+            seenSets[record.SetName] = true
+            result.Sets = append(result.Sets, record.SetName)
+        }
+        if record.Context != "" && !seenContexts[record.Context] {
+            seenContexts[record.Context] = true
+            result.Contexts = append(result.Contexts, record.Context)
+        }
     }
     
-    c.JSON(http.StatusOK, set)
+    c.JSON(http.StatusOK, result)
 }
 
-func (s *Server) deleteSet(c *gin.Context) {
-    setName := c.Param("set_name")
+// Sets endpoints
+func (s *Server) getAllSets(c *gin.Context) {
+    query, err := parseSetQuery(c)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
+    }
     
-    if err := s.ipsetStorage.DeleteSet(setName); err != nil {
+    page, err := s.ipsetStorage.ListSets(c.Request.Context(), query)
+    if err != nil {
         c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
         return
     }
     
-    c.JSON(http.StatusOK, models.SuccessResponse{Message: "set deleted successfully"})
+    setNextLink(c, page.NextCursor)
+    c.JSON(http.StatusOK, page.Sets)
 }
 
-func (s *Server) importSet(c *gin.Context) {
-    var importData struct {
-        SetName    string   `json:"set_name" binding:"required"`
-        SetType    string   `json:"set_type" binding:"required"`
-        SetOptions string   `json:"set_options"`
-        Records    []struct {
-            IP       string `json:"ip" binding:"required"`
-            CIDR     string `json:"cidr"`
-            Port     int    `json:"port"`
-            Protocol string `json:"protocol"`
-        } `json:"records" binding:"required"`
-        Description string `json:"description"`
-        Context     string `json:"context" binding:"required"`
-    }
-    
-    if err := c.ShouldBindJSON(&importData); err != nil {
+func (s *Server) getSetByName(c *gin.Context) {
+    setName := c.Param("set_name")
+    ctx := c.Request.Context()
+    
+    // as_of - сет в том виде, в каком он был в этот момент
+    asOf, err := timeParam(c, "as_of")
+    if err != nil {
         c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
         return
     }
     
-    var results []models.ImportResult
-    var successCount int
-    
-    for _, rec := range importData.Records {
-        record := &models.IPSetRecord{
-            SetName:     importData.SetName,
-            SetType:     importData.SetType,
-            SetOptions:  importData.SetOptions,
-            IP:          rec.IP,
-            CIDR:        rec.CIDR,
-            Port:        rec.Port,
-            Protocol:    rec.Protocol,
-            Description: importData.Description,
-            Context:     importData.Context,
+    // Только записи, действующие в этот момент (см. schedule.go)
+    set, setErr := s.ipsetStorage.GetSet(ctx, setName)
+    var records []*models.IPSetRecord
+    if asOf.IsZero() {
+        if setErr != nil {
+            c.JSON(http.StatusNotFound, models.ErrorResponse{Error: setErr.Error()})
+            return
         }
-        
-        if err := s.ipsetStorage.Create(record); err != nil {
-            results = append(results, models.ImportResult{
-                SetName: importData.SetName,
-                Records: 0,
-                SetType: importData.SetType,
-                Success: false,
-                Error:   err.Error(),
-            })
-        } else {
-            successCount++
+        records = s.activeSetRecords(ctx, setName, time.Now())
+    } else {
+        records, err = s.ipsetStorage.GetBySetNameAt(ctx, setName, asOf)
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
+            return
+        }
+        if setErr != nil {
+            // Сет удален после as_of: тип и опции берем из записей
+            if len(records) == 0 {
+                c.JSON(http.StatusNotFound, models.ErrorResponse{Error: "set not found"})
+                return
+            }
+            set = &models.IPSetSet{
+                Name:      setName,
+                Type:      records[0].SetType,
+                Options:   records[0].SetOptions,
+                Family:    validation.Family(records[0].SetOptions),
+                CreatedAt: records[0].CreatedAt,
+                UpdatedAt: records[0].UpdatedAt,
+            }
         }
+        records = activeRecords(records, asOf)
     }
     
-    if successCount > 0 {
-        results = append(results, models.ImportResult{
-            SetName: importData.SetName,
-            Records: successCount,
-            SetType: importData.SetType,
-            Success: true,
-        })
+    set.RecordCount = len(records)
+    set.Records = make([]models.IPSetRecord, len(records))
+    for i, r := range records {
+        set.Records[i] = *r
+    }
+    
+    c.JSON(http.StatusOK, set)
+}
+
+func (s *Server) deleteSet(c *gin.Context) {
+    setName := c.Param("set_name")
+    
+    // Записи читаем заранее: в журнал попадает каждая удаленная запись.
+    // Ошибка означает, что в сете нет записей.
+    records, _ := s.ipsetStorage.GetBySetName(c.Request.Context(), setName)
+    set, _ := s.ipsetStorage.GetSet(c.Request.Context(), setName)
+    
+    if err := s.ipsetStorage.DeleteSet(c.Request.Context(), setName); err != nil {
+        c.JSON(http.StatusNotFound, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+    for _, record := range records {
+        s.audit(c, models.AuditDeleteSet, record, nil)
+    }
+    // Удаление пустого сета - одно событие о самом сете
+    if len(records) == 0 && set != nil {
+        s.auditSet(c, models.AuditDeleteSet, set, nil)
     }
     
-    c.JSON(http.StatusOK, gin.H{
-        "message":       "import completed",
-        "results":       results,
-        "total_success": successCount,
-    })
+    c.JSON(http.StatusOK, models.SuccessResponse{Message: "set deleted successfully"})
 }
 
 func (s *Server) exportSet(c *gin.Context) {
     setName := c.Param("set_name")
     format := c.DefaultQuery("format", "ipset")
     
-    records, err := s.ipsetStorage.GetBySetName(setName)
+    set, err := s.ipsetStorage.GetSet(c.Request.Context(), setName)
     if err != nil {
-        c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
+        c.JSON(http.StatusNotFound, models.ErrorResponse{Error: err.Error()})
         return
     }
     
-    if len(records) == 0 {
-        c.JSON(http.StatusNotFound, models.ErrorResponse{Error: "set not found"})
-        return
+    // Номер изменения читается до записей: продолжив с него GET /watch,
+    // потребитель получит все изменения после экспорта
+    if revision, err := s.ipsetStorage.Revision(c.Request.Context()); err == nil {
+        c.Header("X-Revision", strconv.FormatInt(revision, 10))
     }
     
+    // Экспортируются только действующие записи (см. schedule.go); в сете
+    // без них экспортируется пустой сет
+    now := time.Now()
+    records := s.activeSetRecords(c.Request.Context(), setName, now)
+    
     switch format {
     case "json":
         c.JSON(http.StatusOK, records)
@@ -402,74 +605,111 @@ func (s *Server) exportSet(c *gin.Context) {
     case "ipset":
         fallthrough
     default:
-        export := generateIPSetExport(records)
+        export := generateIPSetExport(set, records, now)
         c.String(http.StatusOK, export)
     }
 }
 
-func generateIPSetExport(records []*models.IPSetRecord) string {
-    if len(records) == 0 {
-        return ""
-    }
-    
+// prepareRecord проверяет запись на соответствие типу и опциям сета и
+// приводит адреса к каноническому виду
+func prepareRecord(record *models.IPSetRecord) error {
+    entry := validation.Entry{
+        IP:       record.IP,
+        CIDR:     record.CIDR,
+        Port:     record.Port,
+        Protocol: record.Protocol,
+        SecondIP: record.SecondIP,
+    }
+    if err := validation.ValidateRecord(record.SetName, record.SetType, record.SetOptions, entry); err != nil {
+        return err
+    }
+    
+    entry = validation.NormalizeEntry(record.SetType, entry)
+    record.IP = entry.IP
+    record.CIDR = entry.CIDR
+    record.Protocol = entry.Protocol
+    record.SecondIP = entry.SecondIP
+    return nil
+}
+
+// generateIPSetExport - скрипт ipset для действующих в момент now записей
+// сета: по ним же определяется семейство сета без опции family
+func generateIPSetExport(set *models.IPSetSet, records []*models.IPSetRecord, now time.Time) string {
     var sb strings.Builder
     
     sb.WriteString("#!/bin/bash\n")
     sb.WriteString("# IPSet rules exported from API\n\n")
     
-    setMap := make(map[string][]*models.IPSetRecord)
-    for _, record := range records {
-        setMap[record.SetName] = append(setMap[record.SetName], record)
+    ips := make([]string, len(records))
+    for i, record := range records {
+        ips[i] = record.IP
     }
+    family := validation.ExportFamily(set.Options, ips)
     
-    for setName, setRecords := range setMap {
-        setType := "hash:ip"
-        setOptions := ""
-        if len(setRecords) > 0 {
-            if setRecords[0].SetType != "" {
-                setType = setRecords[0].SetType
-            }
-            setOptions = setRecords[0].SetOptions
+    // В сет с опцией timeout каждая запись добавляется со своим сроком
+    withTimeout := validation.HasTimeout(set.Options)
+    
+    sb.WriteString(fmt.Sprintf("# Create set: %s\n", set.Name))
+    if set.Description != "" {
+        sb.WriteString(fmt.Sprintf("# %s\n", set.Description))
+    }
+    sb.WriteString(fmt.Sprintf("ipset create %s %s %s -exist\n", 
+        set.Name, set.Type, validation.WithFamily(set.Options, family)))
+    
+    for _, record := range records {
+        // Запись другого семейства ipset не примет, пропускаем ее
+        if f := validation.AddrFamily(record.IP); f != "" && f != family {
+            sb.WriteString(fmt.Sprintf("# Skipped record %d: %s does not belong to family %s\n",
+                record.ID, record.IP, family))
+            continue
         }
         
-        sb.WriteString(fmt.Sprintf("# Create set: %s\n", setName))
-        sb.WriteString(fmt.Sprintf("ipset create %s %s %s -exist\n", 
-            setName, setType, setOptions))
+        entry := validation.FormatEntry(family, validation.Entry{
+            IP:       record.IP,
+            CIDR:     record.CIDR,
+            Port:     record.Port,
+            Protocol: record.Protocol,
+            SecondIP: record.SecondIP,
+        })
+        if withTimeout {
+            entry += fmt.Sprintf(" timeout %d", validation.EntryTimeout(record.ExpiresAt, now))
+        }
         
-        for _, record := range setRecords {
-            entry := record.IP
-            if record.CIDR != "" && record.CIDR != "0" && record.CIDR != "32" {
-                entry += "/" + record.CIDR
-            }
-            
-            if record.Port != 0 {
-                if record.Protocol != "" {
-                    entry += fmt.Sprintf(",%s:%d", record.Protocol, record.Port)
-                } else {
-                    entry += fmt.Sprintf(",%d", record.Port)
-                }
-            }
-            
-            comment := fmt.Sprintf("# %s", record.Description)
-            if record.Context != "" {
-                comment += fmt.Sprintf(" [%s]", record.Context)
-            }
-            
-            sb.WriteString(fmt.Sprintf("%s\n", comment))
-            sb.WriteString(fmt.Sprintf("ipset add %s %s -exist\n", setName, entry))
+        comment := fmt.Sprintf("# %s", record.Description)
+        if record.Context != "" {
+            comment += fmt.Sprintf(" [%s]", record.Context)
         }
-        sb.WriteString("\n")
+        
+        sb.WriteString(fmt.Sprintf("%s\n", comment))
+        sb.WriteString(fmt.Sprintf("ipset add %s %s -exist\n", set.Name, entry))
     }
+    sb.WriteString("\n")
     
-    sb.WriteString("# Example iptables rules:\n")
-    for setName := range setMap {
-        sb.WriteString(fmt.Sprintf("# iptables -A INPUT -m set --match-set %s src -j ACCEPT\n", setName))
+    iptables := "iptables"
+    if family == "inet6" {
+        iptables = "ip6tables"
     }
+    sb.WriteString("# Example iptables rules:\n")
+    sb.WriteString(fmt.Sprintf("# %s -A INPUT -m set --match-set %s src -j ACCEPT\n", iptables, set.Name))
     
     return sb.String()
 }
 
 func (s *Server) Run(addr string) error {
+    if s.config.TrashRetention > 0 {
+        go s.purgeTrash(context.Background())
+    }
+    if s.config.ExpirySweepInterval > 0 {
+        go s.sweepExpired(context.Background())
+    }
+    if s.config.SchedulerInterval > 0 {
+        go s.runScheduler(context.Background())
+    }
+    go s.runWatcher(context.Background())
+    if s.config.WebhookInterval > 0 {
+        go s.runWebhooks(context.Background())
+    }
+    
     return s.router.Run(addr)
 }
 
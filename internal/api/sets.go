@@ -0,0 +1,370 @@
+package api
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net/http"
+    "strings"
+    "ipset-api-server/internal/models"
+    "ipset-api-server/internal/storage"
+    "ipset-api-server/pkg/validation"
+
+    "github.com/gin-gonic/gin"
+)
+
+// Сет задает тип, опции и семейство своих записей. Записи хранят их копию,
+// поэтому при изменении типа или опций сета переписываются и его записи -
+// одной транзакцией с сетом (ApplySetChanges): в одном сете не бывает
+// записей разных типов.
+
+// createSet создает сет, в том числе пустой. Сет, в который добавляют
+// запись, создается и без этого - с типом и опциями из запроса записи.
+func (s *Server) createSet(c *gin.Context) {
+    var req models.CreateSetRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    if err := validation.ValidateSetName("name", req.Name); err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    set := &models.IPSetSet{
+        Name:        req.Name,
+        Type:        req.Type,
+        Options:     req.Options,
+        Description: req.Description,
+        Owner:       req.Owner,
+    }
+    if set.Type == "" {
+        set.Type = validation.DefaultSetType
+    }
+    if set.Owner == "" {
+        set.Owner = c.GetString("key_id")
+    }
+    if err := prepareSet(set, req.Family); err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    if _, err := s.ipsetStorage.GetSet(c.Request.Context(), set.Name); err == nil {
+        c.JSON(http.StatusConflict, models.ErrorResponse{Error: fmt.Sprintf("set %s already exists", set.Name)})
+        return
+    }
+
+    if err := s.ipsetStorage.CreateSet(c.Request.Context(), set); err != nil {
+        c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+    s.auditSet(c, models.AuditCreateSet, nil, set)
+
+    c.JSON(http.StatusCreated, set)
+}
+
+// updateSet меняет сет. Если меняются тип или опции, каждая запись сета
+// должна им подходить, иначе сет не меняется (409); записи получают новые
+// тип и опции и попадают в журнал как update.
+func (s *Server) updateSet(c *gin.Context) {
+    setName := c.Param("set_name")
+    ctx := c.Request.Context()
+
+    var req models.UpdateSetRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    // Сет и записи читаются на номере изменения: если до сохранения их
+    // изменят, пересчитанные записи устареют
+    revision, err := s.ipsetStorage.Revision(ctx)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+    set, err := s.ipsetStorage.GetSet(ctx, setName)
+    if err != nil {
+        c.JSON(http.StatusNotFound, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+    before := *set
+
+    if req.Type != nil {
+        set.Type = *req.Type
+    }
+    if req.Options != nil {
+        set.Options = *req.Options
+    }
+    if req.Description != nil {
+        set.Description = *req.Description
+    }
+    if req.Owner != nil {
+        set.Owner = *req.Owner
+    }
+    family := ""
+    if req.Family != nil {
+        family = *req.Family
+    }
+    if err := prepareSet(set, family); err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    var current, updated []*models.IPSetRecord
+    if set.Type != before.Type || set.Options != before.Options {
+        // Ошибка означает, что в сете нет записей
+        current, _ = s.ipsetStorage.GetBySetName(ctx, setName)
+        for _, record := range current {
+            changed := *record
+            changed.SetType = set.Type
+            changed.SetOptions = set.Options
+            if err := prepareRecord(&changed); err != nil {
+                c.JSON(http.StatusConflict, models.ErrorResponse{Error: fmt.Sprintf("record %d: %v", record.ID, err)})
+                return
+            }
+            updated = append(updated, &changed)
+        }
+    }
+
+    // Сет и его записи сохраняются вместе: если какую-то запись сохранить
+    // нельзя, не меняется ни сет, ни записи
+    if err := s.ipsetStorage.ApplySetChanges(ctx, setName, revision, set, nil, updated, nil); err != nil {
+        var changed *storage.SetChangedError
+        switch {
+        case errors.As(err, &changed):
+            c.JSON(http.StatusConflict, models.ErrorResponse{
+                Error: fmt.Sprintf("set %s is being changed concurrently, retry the update", setName),
+            })
+        case !respondDuplicate(c, err):
+            c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
+        }
+        return
+    }
+    for i, record := range updated {
+        s.audit(c, models.AuditUpdate, current[i], record)
+    }
+    s.auditSet(c, models.AuditUpdateSet, &before, set)
+
+    c.JSON(http.StatusOK, set)
+}
+
+// renameSet переименовывает сет вместе с записями, как ipset rename
+func (s *Server) renameSet(c *gin.Context) {
+    setName := c.Param("set_name")
+    ctx := c.Request.Context()
+
+    var req models.RenameSetRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+    if !s.checkSetTarget(c, setName, req.Name) {
+        return
+    }
+
+    before, err := s.ipsetStorage.GetSet(ctx, setName)
+    if err != nil {
+        c.JSON(http.StatusNotFound, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    if err := s.ipsetStorage.RenameSet(ctx, setName, req.Name); err != nil {
+        c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    set, err := s.ipsetStorage.GetSet(ctx, req.Name)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+    s.auditSet(c, models.AuditRenameSet, before, set)
+
+    c.JSON(http.StatusOK, set)
+}
+
+// copySet создает копию сета с действующими записями, как ipset create
+// и add в новый сет. Копии записей получают новые ID.
+func (s *Server) copySet(c *gin.Context) {
+    setName := c.Param("set_name")
+    ctx := c.Request.Context()
+
+    var req models.RenameSetRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+    if !s.checkSetTarget(c, setName, req.Name) {
+        return
+    }
+
+    source, err := s.ipsetStorage.GetSet(ctx, setName)
+    if err != nil {
+        c.JSON(http.StatusNotFound, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    records, err := s.ipsetStorage.CopySet(ctx, setName, req.Name)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    set, err := s.ipsetStorage.GetSet(ctx, req.Name)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+    s.auditSet(c, models.AuditCopySet, source, set)
+    for _, record := range records {
+        s.audit(c, models.AuditCreate, nil, record)
+    }
+
+    c.JSON(http.StatusCreated, set)
+}
+
+// swapSets меняет два сета содержимым, как ipset swap: новый список
+// собирается во временном сете и одним запросом занимает место рабочего.
+// Как и ipset, меняет только сеты одного типа и семейства.
+func (s *Server) swapSets(c *gin.Context) {
+    ctx := c.Request.Context()
+
+    var req models.SwapSetsRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+    if req.From == req.To {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "from and to are the same set"})
+        return
+    }
+
+    from, err := s.ipsetStorage.GetSet(ctx, req.From)
+    if err != nil {
+        c.JSON(http.StatusNotFound, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+    to, err := s.ipsetStorage.GetSet(ctx, req.To)
+    if err != nil {
+        c.JSON(http.StatusNotFound, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+    if from.Type != to.Type || from.Family != to.Family {
+        c.JSON(http.StatusConflict, models.ErrorResponse{Error: fmt.Sprintf(
+            "sets %s (%s, %s) and %s (%s, %s) are not compatible: type and family must match",
+            from.Name, from.Type, from.Family, to.Name, to.Type, to.Family)})
+        return
+    }
+
+    if err := s.ipsetStorage.SwapSets(ctx, req.From, req.To); err != nil {
+        c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    swapped := make([]*models.IPSetSet, 0, 2)
+    for _, before := range []*models.IPSetSet{from, to} {
+        set, err := s.ipsetStorage.GetSet(ctx, before.Name)
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
+            return
+        }
+        s.auditSet(c, models.AuditSwapSet, before, set)
+        swapped = append(swapped, set)
+    }
+
+    c.JSON(http.StatusOK, swapped)
+}
+
+// checkSetTarget проверяет имя сета, который появится после rename или
+// copy, и отвечает клиенту, если оно не подходит
+func (s *Server) checkSetTarget(c *gin.Context, setName, target string) bool {
+    if err := validation.ValidateSetName("name", target); err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return false
+    }
+    if target == setName {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: fmt.Sprintf("name: must differ from %s", setName)})
+        return false
+    }
+    if _, err := s.ipsetStorage.GetSet(c.Request.Context(), target); err == nil {
+        c.JSON(http.StatusConflict, models.ErrorResponse{Error: fmt.Sprintf("set %s already exists", target)})
+        return false
+    }
+    return true
+}
+
+// prepareSet проверяет тип и опции сета. family из запроса дописывается
+// в опции и не должен расходиться с указанным в них.
+func prepareSet(set *models.IPSetSet, family string) error {
+    if family != "" {
+        if family != "inet" && family != "inet6" {
+            return fmt.Errorf("family: unknown family %q (use inet or inet6)", family)
+        }
+        set.Options = validation.WithFamily(set.Options, family)
+        if current := validation.Family(set.Options); current != family {
+            return fmt.Errorf("family: options set family %s, request has family %s", current, family)
+        }
+    }
+
+    if err := validation.ValidateSet(set.Type, set.Options); err != nil {
+        return err
+    }
+    set.Family = validation.Family(set.Options)
+    return nil
+}
+
+// resolveSet сверяет запись с ее сетом: тип и опции записи - копия типа и
+// опций сета. Тип и опции из запроса (пустые - не указаны) должны совпадать
+// с сетом. Сета еще нет - хранилище заведет его с типом и опциями записи.
+func (s *Server) resolveSet(ctx context.Context, sets setCache, record *models.IPSetRecord, setType, setOptions string) error {
+    set, err := s.getSet(ctx, sets, record.SetName)
+    if err != nil {
+        if setType != "" {
+            record.SetType = setType
+        }
+        if setOptions != "" {
+            record.SetOptions = setOptions
+        }
+        if record.SetType == "" {
+            record.SetType = validation.DefaultSetType
+        }
+        return nil
+    }
+
+    if setType != "" && setType != set.Type {
+        return fmt.Errorf("set_type: set %s has type %s, not %s", set.Name, set.Type, setType)
+    }
+    if setOptions != "" && !sameOptions(setOptions, set.Options) {
+        return fmt.Errorf("set_options: set %s has options %q, not %q", set.Name, set.Options, setOptions)
+    }
+    record.SetType = set.Type
+    record.SetOptions = set.Options
+    return nil
+}
+
+// setCache - сеты, уже прочитанные при обработке запроса, по имени (nil -
+// сета нет): пакетные операции читают каждый сет один раз
+type setCache map[string]*models.IPSetSet
+
+// getSet читает сет, запоминая его в sets (nil - не запоминать)
+func (s *Server) getSet(ctx context.Context, sets setCache, name string) (*models.IPSetSet, error) {
+    if set, ok := sets[name]; ok {
+        if set == nil {
+            return nil, fmt.Errorf("set %s not found", name)
+        }
+        return set, nil
+    }
+
+    set, err := s.ipsetStorage.GetSet(ctx, name)
+    if sets != nil {
+        sets[name] = set
+    }
+    return set, err
+}
+
+// sameOptions сравнивает опции без учета лишних пробелов
+func sameOptions(a, b string) bool {
+    return strings.Join(strings.Fields(a), " ") == strings.Join(strings.Fields(b), " ")
+}
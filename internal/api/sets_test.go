@@ -0,0 +1,77 @@
+package api
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "strconv"
+    "testing"
+    "ipset-api-server/internal/models"
+    "ipset-api-server/internal/storage"
+)
+
+func TestUpdateSetRewritesRecords(t *testing.T) {
+    ts := newTestServer(t, "")
+    record := ts.createRecord("blacklist", "10.0.0.1")
+
+    var set models.IPSetSet
+    ts.do(http.MethodPut, "/sets/blacklist", map[string]string{"type": "hash:net"}, http.StatusOK, &set)
+    if set.Type != "hash:net" {
+        t.Fatalf("set type %q, want hash:net", set.Type)
+    }
+    var got models.IPSetRecord
+    ts.do(http.MethodGet, "/records/"+strconv.Itoa(record.ID), nil, http.StatusOK, &got)
+    if got.SetType != "hash:net" {
+        t.Fatalf("record type %q after the set type change", got.SetType)
+    }
+}
+
+func TestUpdateSetFailedRewriteChangesNothing(t *testing.T) {
+    ts := newTestServer(t, "")
+    ctx := context.Background()
+    first := ts.createRecord("blacklist", "10.0.0.1")
+    second := ts.createRecord("blacklist", "10.0.0.2")
+
+    revision, err := ts.ipsetStorage.Revision(ctx)
+    if err != nil {
+        t.Fatal(err)
+    }
+    set, err := ts.ipsetStorage.GetSet(ctx, "blacklist")
+    if err != nil {
+        t.Fatal(err)
+    }
+    before := *set
+
+    // Вторая переписанная запись совпадает с первой - ее не сохранить
+    set.Type = "hash:net"
+    var updated []*models.IPSetRecord
+    for _, record := range []*models.IPSetRecord{first, second} {
+        changed := *record
+        changed.SetType = set.Type
+        changed.IP = first.IP
+        updated = append(updated, &changed)
+    }
+    err = ts.ipsetStorage.ApplySetChanges(ctx, "blacklist", revision, set, nil, updated, nil)
+    var duplicate *storage.DuplicateError
+    if !errors.As(err, &duplicate) {
+        t.Fatalf("error %v, want a duplicate error", err)
+    }
+
+    // Ни сет, ни записи не изменились
+    set, err = ts.ipsetStorage.GetSet(ctx, "blacklist")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if set.Type != before.Type || set.Options != before.Options {
+        t.Fatalf("set changed to %s %q, want %s %q", set.Type, set.Options, before.Type, before.Options)
+    }
+    for _, record := range []*models.IPSetRecord{first, second} {
+        stored, err := ts.ipsetStorage.GetByID(ctx, record.ID)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if stored.SetType != record.SetType || stored.IP != record.IP {
+            t.Fatalf("record %d changed to %s %s", record.ID, stored.SetType, stored.IP)
+        }
+    }
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+    "context"
+    "log"
+    "net/http"
+    "strconv"
+    "time"
+    "ipset-api-server/internal/models"
+
+    "github.com/gin-gonic/gin"
+)
+
+// getTrash возвращает страницу удаленных записей. Фильтры, сортировка и
+// курсор - те же, что у GET /records.
+func (s *Server) getTrash(c *gin.Context) {
+    query, err := parseRecordQuery(c)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    page, err := s.ipsetStorage.ListTrash(c.Request.Context(), query)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    setNextLink(c, page.NextCursor)
+    c.JSON(http.StatusOK, page.Records)
+}
+
+// restoreRecord возвращает запись из корзины с прежним ID
+func (s *Server) restoreRecord(c *gin.Context) {
+    id, err := strconv.Atoi(c.Param("id"))
+    if err != nil || id < 100000 || id > 999999 {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "invalid ID (must be 6-digit number)"})
+        return
+    }
+
+    record, err := s.ipsetStorage.Undelete(c.Request.Context(), id)
+    if err != nil {
+        if !respondDuplicate(c, err) {
+            c.JSON(http.StatusNotFound, models.ErrorResponse{Error: err.Error()})
+        }
+        return
+    }
+    s.audit(c, models.AuditRestore, nil, record)
+
+    c.JSON(http.StatusOK, record)
+}
+
+// undeleteSet возвращает из корзины все удаленные записи сета - restoreSet
+// без as_of
+func (s *Server) undeleteSet(c *gin.Context) {
+    setName := c.Param("set_name")
+
+    records, err := s.ipsetStorage.UndeleteSet(c.Request.Context(), setName)
+    if err != nil {
+        if !respondDuplicate(c, err) {
+            c.JSON(http.StatusNotFound, models.ErrorResponse{Error: err.Error()})
+        }
+        return
+    }
+
+    result := models.RestoreResult{
+        SetName:  setName,
+        Restored: []int{},
+        Updated:  []int{},
+        Deleted:  []int{},
+    }
+    for _, record := range records {
+        s.audit(c, models.AuditRestore, nil, record)
+        result.Restored = append(result.Restored, record.ID)
+    }
+
+    c.JSON(http.StatusOK, result)
+}
+
+// purgeTrash раз в TrashPurgeInterval окончательно удаляет записи, которые
+// пролежали в корзине дольше TrashRetention
+func (s *Server) purgeTrash(ctx context.Context) {
+    interval := s.config.TrashPurgeInterval
+    if interval <= 0 {
+        interval = time.Hour
+    }
+
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        before := time.Now().Add(-s.config.TrashRetention)
+        purged, err := s.ipsetStorage.PurgeTrash(ctx, before)
+        if err != nil {
+            log.Printf("trash: failed to purge records deleted before %s: %v", before.Format(time.RFC3339), err)
+        } else if purged > 0 {
+            log.Printf("trash: purged %d records deleted before %s", purged, before.Format(time.RFC3339))
+        }
+
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+    }
+}
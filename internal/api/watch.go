@@ -0,0 +1,319 @@
+package api
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "ipset-api-server/internal/models"
+    "ipset-api-server/internal/storage"
+
+    "github.com/gin-gonic/gin"
+)
+
+// Поток изменений GET /watch: хранилище нумерует изменения записей и
+// сетов (см. storage/changes.go), а сервер отдает их после номера since -
+// потоком Server-Sent Events или длинным опросом. Изменение может прийти
+// не только через этот сервер (другой экземпляр, общая база), поэтому
+// пока есть ожидающие, сервер опрашивает номер последнего изменения раз
+// в WatchPollInterval; изменения через API будят ожидающих сразу.
+
+const (
+    // watchBatch - наибольшее число изменений в одном ответе или пачке потока
+    watchBatch = 1000
+    // watchTimeout и watchMaxTimeout - время ожидания длинного опроса по
+    // умолчанию и наибольшее
+    watchTimeout    = 30 * time.Second
+    watchMaxTimeout = 5 * time.Minute
+    // watchPing - период пустых событий потока, чтобы прокси не закрывали
+    // соединение
+    watchPing = 15 * time.Second
+)
+
+// watchHub сообщает ожидающим о новых изменениях: канал changed
+// закрывается и заменяется новым, когда номер последнего изменения меняется
+type watchHub struct {
+    mu       sync.Mutex
+    revision int64
+    changed  chan struct{}
+    watchers int
+
+    // wake будит опрос хранилища после изменения через API
+    wake chan struct{}
+}
+
+func newWatchHub() *watchHub {
+    return &watchHub{
+        changed: make(chan struct{}),
+        wake:    make(chan struct{}, 1),
+    }
+}
+
+// subscribe регистрирует ожидающего, unsubscribe снимает его
+func (h *watchHub) subscribe() {
+    h.mu.Lock()
+    h.watchers++
+    h.mu.Unlock()
+}
+
+func (h *watchHub) unsubscribe() {
+    h.mu.Lock()
+    h.watchers--
+    h.mu.Unlock()
+}
+
+// wait возвращает канал, который закроется при следующем изменении.
+// Канал берется до чтения изменений, чтобы не пропустить изменение между
+// чтением и ожиданием.
+func (h *watchHub) wait() <-chan struct{} {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    return h.changed
+}
+
+// publish запоминает номер последнего изменения и будит ожидающих, если он
+// изменился
+func (h *watchHub) publish(revision int64) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    if revision == h.revision {
+        return
+    }
+    h.revision = revision
+    close(h.changed)
+    h.changed = make(chan struct{})
+}
+
+func (h *watchHub) idle() bool {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    return h.watchers == 0
+}
+
+// wakeWatcher просит опрос проверить номер последнего изменения сразу
+func (s *Server) wakeWatcher() {
+    select {
+    case s.watchHub.wake <- struct{}{}:
+    default:
+    }
+}
+
+// watchMiddleware будит опрос и рассылку webhooks после успешного
+// изменяющего запроса
+func (s *Server) watchMiddleware() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        c.Next()
+
+        if c.Request.Method != http.MethodGet && c.Writer.Status() < http.StatusBadRequest {
+            s.wakeWatcher()
+            s.wakeWebhooks()
+        }
+    }
+}
+
+// runWatcher опрашивает номер последнего изменения раз в WatchPollInterval
+// (если есть ожидающие) и после изменений через API
+func (s *Server) runWatcher(ctx context.Context) {
+    var tick <-chan time.Time
+    if s.config.WatchPollInterval > 0 {
+        ticker := time.NewTicker(s.config.WatchPollInterval)
+        defer ticker.Stop()
+        tick = ticker.C
+    }
+
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-tick:
+        case <-s.watchHub.wake:
+        }
+        if s.watchHub.idle() {
+            continue
+        }
+
+        revision, err := s.ipsetStorage.Revision(ctx)
+        if err != nil {
+            log.Printf("watch: failed to get revision: %v", err)
+            continue
+        }
+        s.watchHub.publish(revision)
+    }
+}
+
+// watch отдает изменения с номером больше since: потоком Server-Sent
+// Events, если клиент принимает text/event-stream, иначе длинным опросом.
+// Без since (и заголовка Last-Event-ID) отдаются изменения после текущего
+// номера. set_name ограничивает поток одним сетом. Если изменения после
+// since уже удалены из потока, ответ - 410 Gone: клиент должен прочитать
+// сеты целиком и продолжить с текущего номера.
+func (s *Server) watch(c *gin.Context) {
+    ctx := c.Request.Context()
+
+    since, err := watchSince(c)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+    if since < 0 {
+        if since, err = s.ipsetStorage.Revision(ctx); err != nil {
+            c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
+            return
+        }
+    }
+
+    timeout := watchTimeout
+    if seconds, err := intParam(c, "timeout"); err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
+    } else if c.Query("timeout") != "" {
+        timeout = time.Duration(seconds) * time.Second
+    }
+    if timeout > watchMaxTimeout {
+        timeout = watchMaxTimeout
+    }
+
+    // Проверка до начала потока, пока еще можно ответить кодом
+    if _, err := s.ipsetStorage.Changes(ctx, since, 1); err != nil {
+        c.JSON(watchErrorStatus(err), models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    s.watchHub.subscribe()
+    defer s.watchHub.unsubscribe()
+
+    if strings.Contains(c.GetHeader("Accept"), "text/event-stream") {
+        s.watchStream(c, since)
+        return
+    }
+
+    deadline := time.NewTimer(timeout)
+    defer deadline.Stop()
+
+    for {
+        changed := s.watchHub.wait()
+        changes, next, err := s.nextChanges(ctx, since, c.Query("set_name"))
+        if err != nil {
+            c.JSON(watchErrorStatus(err), models.ErrorResponse{Error: err.Error()})
+            return
+        }
+        since = next
+        if len(changes) > 0 {
+            c.JSON(http.StatusOK, models.WatchResult{Revision: since, Changes: changes})
+            return
+        }
+
+        select {
+        case <-changed:
+        case <-deadline.C:
+            c.JSON(http.StatusOK, models.WatchResult{Revision: since, Changes: []*models.ChangeEvent{}})
+            return
+        case <-ctx.Done():
+            return
+        }
+    }
+}
+
+// watchStream отдает изменения потоком Server-Sent Events: событие change
+// на каждое изменение с номером в id, и ping с текущим номером, пока
+// изменений нет. Переподключившись с Last-Event-ID, клиент продолжает с
+// того же места.
+func (s *Server) watchStream(c *gin.Context, since int64) {
+    ctx := c.Request.Context()
+
+    c.Header("Content-Type", "text/event-stream")
+    c.Header("Cache-Control", "no-cache")
+    c.Header("Connection", "keep-alive")
+    c.Header("X-Accel-Buffering", "no")
+    c.Status(http.StatusOK)
+
+    ping := time.NewTicker(watchPing)
+    defer ping.Stop()
+
+    for {
+        changed := s.watchHub.wait()
+        changes, next, err := s.nextChanges(ctx, since, c.Query("set_name"))
+        if err != nil {
+            log.Printf("watch: %v", err)
+            return
+        }
+        for _, change := range changes {
+            data, _ := json.Marshal(change)
+            fmt.Fprintf(c.Writer, "id: %d\nevent: change\ndata: %s\n\n", change.Revision, data)
+        }
+        c.Writer.Flush()
+        moved := next != since
+        since = next
+        if moved {
+            // Изменений может быть больше, чем вошло в пачку
+            continue
+        }
+
+        select {
+        case <-changed:
+        case <-ping.C:
+            fmt.Fprintf(c.Writer, "id: %d\nevent: ping\ndata: {\"revision\":%d}\n\n", since, since)
+            c.Writer.Flush()
+        case <-ctx.Done():
+            return
+        }
+    }
+}
+
+// nextChanges читает пачку изменений после since и отбирает изменения сета
+// setName (если указан). next - номер, с которого читать дальше: номер
+// последнего прочитанного изменения, даже если оно не подошло под отбор.
+func (s *Server) nextChanges(ctx context.Context, since int64, setName string) ([]*models.ChangeEvent, int64, error) {
+    changes, err := s.ipsetStorage.Changes(ctx, since, watchBatch)
+    if err != nil {
+        return nil, since, err
+    }
+    if len(changes) == 0 {
+        return nil, since, nil
+    }
+
+    next := changes[len(changes)-1].Revision
+    if setName == "" {
+        return changes, next, nil
+    }
+    matched := changes[:0]
+    for _, change := range changes {
+        if change.SetName == setName {
+            matched = append(matched, change)
+        }
+    }
+    return matched, next, nil
+}
+
+// watchErrorStatus - код ответа на ошибку чтения изменений
+func watchErrorStatus(err error) int {
+    var expired *storage.ChangesExpiredError
+    if errors.As(err, &expired) {
+        return http.StatusGone
+    }
+    return http.StatusInternalServerError
+}
+
+// watchSince читает since из запроса или заголовка Last-Event-ID
+// (переподключение EventSource); -1, если номер не указан
+func watchSince(c *gin.Context) (int64, error) {
+    value := c.Query("since")
+    if value == "" {
+        value = c.GetHeader("Last-Event-ID")
+    }
+    if value == "" {
+        return -1, nil
+    }
+
+    since, err := strconv.ParseInt(value, 10, 64)
+    if err != nil || since < 0 {
+        return 0, fmt.Errorf("invalid since: %s", value)
+    }
+    return since, nil
+}
@@ -0,0 +1,353 @@
+package api
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+    "ipset-api-server/internal/auth"
+    "ipset-api-server/internal/config"
+    "ipset-api-server/internal/models"
+    "ipset-api-server/internal/storage"
+
+    "github.com/gin-gonic/gin"
+)
+
+const testAPIKey = "testkey-123"
+
+// testServer - сервер на файловых хранилищах в каталоге dir
+type testServer struct {
+    t      *testing.T
+    dir    string
+    server *Server
+    http   *httptest.Server
+    token  string
+    closed bool
+    stop   context.CancelFunc
+
+    ipsetStorage   *storage.FileIPSetStorage
+    auditStorage   *storage.FileAuditStorage
+    webhookStorage *storage.FileWebhookStorage
+    agentStorage   *storage.FileAgentStorage
+}
+
+func testConfig(dir string) *config.Config {
+    return &config.Config{
+        JWTSecret:          "test-secret",
+        WatchPollInterval:  50 * time.Millisecond,
+        WebhookTimeout:     time.Second,
+        WebhookRetryBase:   time.Minute,
+        WebhookMaxAttempts: 3,
+        AuthKeysFilePath:   filepath.Join(dir, "keys.json"),
+        IPSetFilePath:      filepath.Join(dir, "records.json"),
+        AuditFilePath:      filepath.Join(dir, "audit_log.jsonl"),
+        WebhooksFilePath:   filepath.Join(dir, "webhooks.json"),
+        AgentsFilePath:     filepath.Join(dir, "agents.json"),
+    }
+}
+
+// newTestServer запускает сервер с данными в dir (пустой dir - новый
+// временный каталог) и входит с тестовым ключом
+func newTestServer(t *testing.T, dir string) *testServer {
+    t.Helper()
+    gin.SetMode(gin.TestMode)
+    if dir == "" {
+        dir = t.TempDir()
+    }
+    cfg := testConfig(dir)
+
+    keyStorage, err := storage.NewFileKeyStorage(cfg.AuthKeysFilePath)
+    if err != nil {
+        t.Fatal(err)
+    }
+    now := time.Now().UTC()
+    if err := keyStorage.SaveKey(context.Background(), &models.AuthKey{
+        Key: testAPIKey, CreatedAt: now, ExpiresAt: now.Add(time.Hour), IsActive: true,
+    }); err != nil {
+        t.Fatal(err)
+    }
+
+    ts := &testServer{t: t, dir: dir}
+    if ts.ipsetStorage, err = storage.NewFileIPSetStorage(cfg.IPSetFilePath); err != nil {
+        t.Fatal(err)
+    }
+    if ts.auditStorage, err = storage.NewFileAuditStorage(cfg.AuditFilePath); err != nil {
+        t.Fatal(err)
+    }
+    if ts.webhookStorage, err = storage.NewFileWebhookStorage(cfg.WebhooksFilePath); err != nil {
+        t.Fatal(err)
+    }
+    if ts.agentStorage, err = storage.NewFileAgentStorage(cfg.AgentsFilePath); err != nil {
+        t.Fatal(err)
+    }
+
+    ts.server = NewServer(cfg, auth.NewManager(keyStorage), ts.ipsetStorage, ts.auditStorage, ts.webhookStorage, ts.agentStorage)
+    ctx, stop := context.WithCancel(context.Background())
+    ts.stop = stop
+    go ts.server.runWatcher(ctx)
+    ts.http = httptest.NewServer(ts.server.router)
+    t.Cleanup(ts.close)
+
+    var login struct {
+        Token string `json:"token"`
+    }
+    ts.do(http.MethodPost, "/login", map[string]string{"api_key": testAPIKey}, http.StatusOK, &login)
+    ts.token = login.Token
+    return ts
+}
+
+// close останавливает сервер и освобождает файлы, чтобы их мог открыть
+// следующий сервер
+func (ts *testServer) close() {
+    if ts.closed {
+        return
+    }
+    ts.closed = true
+    ts.http.Close()
+    ts.stop()
+    ts.ipsetStorage.Close()
+    ts.auditStorage.Close()
+    ts.webhookStorage.Close()
+    ts.agentStorage.Close()
+}
+
+// request выполняет запрос и возвращает код и тело ответа. В отличие от
+// do, его можно вызывать не из горутины теста.
+func (ts *testServer) request(method, path string, body interface{}) (int, []byte, error) {
+    var data []byte
+    if body != nil {
+        var err error
+        if data, err = json.Marshal(body); err != nil {
+            return 0, nil, err
+        }
+    }
+
+    req, err := http.NewRequest(method, ts.http.URL+path, bytes.NewReader(data))
+    if err != nil {
+        return 0, nil, err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    if ts.token != "" {
+        req.Header.Set("Authorization", "Bearer "+ts.token)
+    }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        return 0, nil, err
+    }
+    defer resp.Body.Close()
+
+    var raw bytes.Buffer
+    _, err = raw.ReadFrom(resp.Body)
+    return resp.StatusCode, raw.Bytes(), err
+}
+
+// do выполняет запрос и проверяет код ответа; тело ответа разбирается в out
+func (ts *testServer) do(method, path string, body interface{}, status int, out interface{}) {
+    ts.t.Helper()
+    code, raw, err := ts.request(method, path, body)
+    if err != nil {
+        ts.t.Fatalf("%s %s: %v", method, path, err)
+    }
+    if code != status {
+        ts.t.Fatalf("%s %s: status %d, want %d: %s", method, path, code, status, raw)
+    }
+    if out != nil {
+        if err := json.Unmarshal(raw, out); err != nil {
+            ts.t.Fatalf("%s %s: %v: %s", method, path, err, raw)
+        }
+    }
+}
+
+func (ts *testServer) createRecord(setName, ip string) *models.IPSetRecord {
+    ts.t.Helper()
+    var record models.IPSetRecord
+    ts.do(http.MethodPost, "/records", map[string]string{"set_name": setName, "ip": ip, "context": "test"}, http.StatusCreated, &record)
+    return &record
+}
+
+func (ts *testServer) watch(query string) *models.WatchResult {
+    ts.t.Helper()
+    var result models.WatchResult
+    ts.do(http.MethodGet, "/watch?"+query, nil, http.StatusOK, &result)
+    return &result
+}
+
+func changeRevisions(changes []*models.ChangeEvent) []int64 {
+    revisions := make([]int64, len(changes))
+    for i, change := range changes {
+        revisions[i] = change.Revision
+    }
+    return revisions
+}
+
+func TestWatchLongPollResume(t *testing.T) {
+    ts := newTestServer(t, "")
+
+    first := ts.createRecord("blacklist", "10.0.0.1")
+    ts.createRecord("blacklist", "10.0.0.2")
+    ts.createRecord("whitelist", "10.0.1.1")
+
+    all := ts.watch("since=0&timeout=1")
+    // Сеты создаются вместе с первой записью
+    if len(all.Changes) != 5 {
+        t.Fatalf("changes since 0: %v, want 5", changeRevisions(all.Changes))
+    }
+    for i, change := range all.Changes {
+        if change.Revision != int64(i+1) {
+            t.Fatalf("revisions %v are not consecutive", changeRevisions(all.Changes))
+        }
+    }
+    if all.Revision != 5 {
+        t.Fatalf("revision %d, want 5", all.Revision)
+    }
+    if all.Changes[1].RecordID != first.ID || all.Changes[1].Operation != models.RevisionCreate {
+        t.Fatalf("change 2: record %d %s, want create of %d", all.Changes[1].RecordID, all.Changes[1].Operation, first.ID)
+    }
+
+    // Продолжение с середины отдает только следующие изменения
+    resumed := ts.watch("since=2&timeout=1")
+    if got := changeRevisions(resumed.Changes); fmt.Sprint(got) != "[3 4 5]" {
+        t.Fatalf("changes since 2: %v, want [3 4 5]", got)
+    }
+    filtered := ts.watch("since=2&timeout=1&set_name=whitelist")
+    if got := changeRevisions(filtered.Changes); fmt.Sprint(got) != "[4 5]" || filtered.Revision != 5 {
+        t.Fatalf("whitelist changes since 2: %v (revision %d), want [4 5]", got, filtered.Revision)
+    }
+
+    // Без новых изменений опрос ждет timeout и отдает тот же номер
+    empty := ts.watch("since=5&timeout=1")
+    if len(empty.Changes) != 0 || empty.Revision != 5 {
+        t.Fatalf("changes since 5: %v (revision %d), want none", changeRevisions(empty.Changes), empty.Revision)
+    }
+
+    // Ожидающий опрос получает изменение, как только оно сделано
+    go func() {
+        time.Sleep(200 * time.Millisecond)
+        if code, raw, err := ts.request(http.MethodDelete, fmt.Sprintf("/records/%d", first.ID), nil); err != nil || code != http.StatusOK {
+            t.Errorf("delete record: %d %s %v", code, raw, err)
+        }
+    }()
+    started := time.Now()
+    woken := ts.watch("since=5&timeout=10")
+    if time.Since(started) > 5*time.Second {
+        t.Fatalf("long poll returned after %v", time.Since(started))
+    }
+    if len(woken.Changes) != 1 || woken.Changes[0].Operation != models.RevisionDelete || woken.Changes[0].RecordID != first.ID {
+        t.Fatalf("changes since 5: %+v, want delete of %d", woken.Changes, first.ID)
+    }
+}
+
+func TestWatchResumeAfterRestart(t *testing.T) {
+    ts := newTestServer(t, "")
+    ts.createRecord("blacklist", "10.0.0.1")
+    ts.createRecord("blacklist", "10.0.0.2")
+    before := ts.watch("since=0&timeout=1")
+    ts.close()
+
+    // Изменения и их номера переживают перезапуск, новые продолжают счет
+    ts = newTestServer(t, ts.dir)
+    after := ts.watch("since=0&timeout=1")
+    if fmt.Sprint(changeRevisions(after.Changes)) != fmt.Sprint(changeRevisions(before.Changes)) {
+        t.Fatalf("changes after restart: %v, want %v", changeRevisions(after.Changes), changeRevisions(before.Changes))
+    }
+    ts.createRecord("blacklist", "10.0.0.3")
+    next := ts.watch(fmt.Sprintf("since=%d&timeout=1", before.Revision))
+    if len(next.Changes) != 1 || next.Changes[0].Revision != before.Revision+1 {
+        t.Fatalf("changes since %d: %v, want [%d]", before.Revision, changeRevisions(next.Changes), before.Revision+1)
+    }
+}
+
+func TestWatchInvalidSince(t *testing.T) {
+    ts := newTestServer(t, "")
+    ts.do(http.MethodGet, "/watch?since=abc", nil, http.StatusBadRequest, nil)
+    ts.do(http.MethodGet, "/watch?since=-2", nil, http.StatusBadRequest, nil)
+}
+
+// sseEvent - событие потока Server-Sent Events
+type sseEvent struct {
+    id    string
+    event string
+    data  string
+}
+
+// readEvents читает события потока, пока stop не вернет true
+func readEvents(t *testing.T, reader *bufio.Reader, stop func(events []sseEvent) bool) []sseEvent {
+    t.Helper()
+    var events []sseEvent
+    var current sseEvent
+    for !stop(events) {
+        line, err := reader.ReadString('\n')
+        if err != nil {
+            t.Fatalf("read stream: %v (events so far: %v)", err, events)
+        }
+        line = strings.TrimRight(line, "\n")
+        switch {
+        case line == "":
+            if current.event != "" {
+                events = append(events, current)
+            }
+            current = sseEvent{}
+        case strings.HasPrefix(line, "id: "):
+            current.id = strings.TrimPrefix(line, "id: ")
+        case strings.HasPrefix(line, "event: "):
+            current.event = strings.TrimPrefix(line, "event: ")
+        case strings.HasPrefix(line, "data: "):
+            current.data = strings.TrimPrefix(line, "data: ")
+        }
+    }
+    return events
+}
+
+func TestWatchStreamResume(t *testing.T) {
+    ts := newTestServer(t, "")
+    ts.createRecord("blacklist", "10.0.0.1")
+    ts.createRecord("blacklist", "10.0.0.2")
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.http.URL+"/watch", nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    req.Header.Set("Authorization", "Bearer "+ts.token)
+    req.Header.Set("Accept", "text/event-stream")
+    // Переподключение EventSource: продолжение после последнего
+    // полученного события
+    req.Header.Set("Last-Event-ID", "1")
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+        t.Fatalf("status %d, content type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+    }
+
+    reader := bufio.NewReader(resp.Body)
+    events := readEvents(t, reader, func(events []sseEvent) bool { return len(events) == 2 })
+    // Поток открыт и ждет: новое изменение приходит в нем сразу
+    ts.createRecord("blacklist", "10.0.0.3")
+    events = append(events, readEvents(t, reader, func(events []sseEvent) bool { return len(events) == 1 })...)
+
+    for i, event := range events {
+        want := int64(i + 2)
+        if event.event != "change" || event.id != strconv.FormatInt(want, 10) {
+            t.Fatalf("event %d: %s %s, want change %d", i, event.event, event.id, want)
+        }
+        var change models.ChangeEvent
+        if err := json.Unmarshal([]byte(event.data), &change); err != nil {
+            t.Fatalf("event %d: %v", i, err)
+        }
+        if change.Revision != want {
+            t.Fatalf("event %d: revision %d in data, want %d", i, change.Revision, want)
+        }
+    }
+}
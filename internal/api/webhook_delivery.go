@@ -0,0 +1,264 @@
+package api
+
+import (
+    "bytes"
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "strconv"
+    "time"
+    "ipset-api-server/internal/models"
+    "ipset-api-server/internal/storage"
+)
+
+// Доставка webhooks: рассылка читает поток изменений (см. watch.go) с
+// номера, сохраненного в хранилище подписок, и на каждое изменение создает
+// доставку каждой подходящей подписке - вместе с новым номером, так что
+// изменение не теряется и не рассылается дважды при перезапуске. Доставки
+// отправляются POST-запросом с подписью HMAC-SHA256; после неудачи попытка
+// повторяется с удвоением паузы, после WebhookMaxAttempts попыток доставка
+// попадает в очередь недоставленных (status = dead), откуда ее можно
+// отправить заново. Рассылку должен вести один экземпляр сервера.
+
+const (
+    // webhookBatch - наибольшее число доставок, отправляемых за один проход
+    webhookBatch = 100
+    // maxWebhookBackoff - наибольшая пауза между попытками
+    maxWebhookBackoff = time.Hour
+    // webhookPurgeInterval - период удаления старых доставленных доставок
+    webhookPurgeInterval = time.Hour
+    // maxWebhookResponse - сколько тела ответа с ошибкой попадает в журнал
+    maxWebhookResponse = 512
+)
+
+// wakeWebhooks просит рассылку проверить новые изменения сразу
+func (s *Server) wakeWebhooks() {
+    select {
+    case s.webhookWake <- struct{}{}:
+    default:
+    }
+}
+
+// runWebhooks раз в WebhookInterval и после изменений через API создает
+// доставки по новым изменениям и отправляет те, время которых наступило
+func (s *Server) runWebhooks(ctx context.Context) {
+    client := &http.Client{Timeout: s.config.WebhookTimeout}
+    ticker := time.NewTicker(s.config.WebhookInterval)
+    defer ticker.Stop()
+
+    var purged time.Time
+    for {
+        if err := s.enqueueDeliveries(ctx); err != nil {
+            log.Printf("webhooks: failed to enqueue deliveries: %v", err)
+        }
+        if err := s.sendDeliveries(ctx, client); err != nil {
+            log.Printf("webhooks: failed to send deliveries: %v", err)
+        }
+
+        if s.config.WebhookDeliveryRetention > 0 && time.Since(purged) >= webhookPurgeInterval {
+            purged = time.Now()
+            n, err := s.webhookStorage.PurgeDeliveries(ctx, purged.Add(-s.config.WebhookDeliveryRetention))
+            if err != nil {
+                log.Printf("webhooks: failed to purge deliveries: %v", err)
+            } else if n > 0 {
+                log.Printf("webhooks: purged %d delivered deliveries", n)
+            }
+        }
+
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        case <-s.webhookWake:
+        }
+    }
+}
+
+// enqueueDeliveries создает доставки по изменениям после сохраненного
+// номера. При первом запуске рассылка начинается с текущего номера:
+// изменения, сделанные до нее, не рассылаются.
+func (s *Server) enqueueDeliveries(ctx context.Context) error {
+    cursor, err := s.webhookStorage.WebhookCursor(ctx)
+    if err != nil {
+        return err
+    }
+    if cursor < 0 {
+        revision, err := s.ipsetStorage.Revision(ctx)
+        if err != nil {
+            return err
+        }
+        return s.webhookStorage.EnqueueDeliveries(ctx, nil, revision)
+    }
+
+    webhooks, err := s.webhookStorage.ListWebhooks(ctx)
+    if err != nil {
+        return err
+    }
+
+    for {
+        changes, err := s.ipsetStorage.Changes(ctx, cursor, watchBatch)
+        var expired *storage.ChangesExpiredError
+        if errors.As(err, &expired) {
+            // Пропущенные изменения уже не разослать: рассылка продолжается
+            // с первого сохраненного
+            log.Printf("webhooks: changes %d-%d expired before delivery", cursor+1, expired.Oldest-1)
+            cursor = expired.Oldest - 1
+            if err := s.webhookStorage.EnqueueDeliveries(ctx, nil, cursor); err != nil {
+                return err
+            }
+            continue
+        }
+        if err != nil {
+            return err
+        }
+        if len(changes) == 0 {
+            return nil
+        }
+
+        now := time.Now().UTC()
+        var deliveries []*models.WebhookDelivery
+        for _, change := range changes {
+            event := webhookEvent(change)
+            for _, webhook := range webhooks {
+                if !webhookMatches(webhook, event, change) {
+                    continue
+                }
+                payload, err := json.Marshal(&models.WebhookPayload{Event: event, WebhookID: webhook.ID, ChangeEvent: change})
+                if err != nil {
+                    return fmt.Errorf("failed to encode change %d: %v", change.Revision, err)
+                }
+                deliveries = append(deliveries, &models.WebhookDelivery{
+                    WebhookID:     webhook.ID,
+                    Revision:      change.Revision,
+                    Event:         event,
+                    Payload:       payload,
+                    Status:        models.DeliveryPending,
+                    NextAttemptAt: now,
+                    CreatedAt:     now,
+                    UpdatedAt:     now,
+                })
+            }
+        }
+
+        cursor = changes[len(changes)-1].Revision
+        if err := s.webhookStorage.EnqueueDeliveries(ctx, deliveries, cursor); err != nil {
+            return err
+        }
+        if len(changes) < watchBatch {
+            return nil
+        }
+    }
+}
+
+// sendDeliveries отправляет доставки, время которых наступило. Доставки
+// выключенной подписки сразу попадают в очередь недоставленных, как и
+// доставки удаленной подписки (если хранилище не удалило их вместе с ней),
+// иначе они оставались бы в начале очереди навсегда.
+func (s *Server) sendDeliveries(ctx context.Context, client *http.Client) error {
+    due, err := s.webhookStorage.DueDeliveries(ctx, time.Now(), webhookBatch)
+    if err != nil || len(due) == 0 {
+        return err
+    }
+
+    list, err := s.webhookStorage.ListWebhooks(ctx)
+    if err != nil {
+        return err
+    }
+    webhooks := make(map[int64]*models.Webhook, len(list))
+    for _, webhook := range list {
+        webhooks[webhook.ID] = webhook
+    }
+
+    for _, delivery := range due {
+        webhook := webhooks[delivery.WebhookID]
+        switch {
+        case webhook == nil:
+            delivery.LastStatus, err = 0, fmt.Errorf("webhook %d not found", delivery.WebhookID)
+        case webhook.Active:
+            delivery.Attempts++
+            delivery.LastStatus, err = postWebhook(ctx, client, webhook, delivery)
+        default:
+            delivery.LastStatus, err = 0, fmt.Errorf("webhook is inactive")
+        }
+
+        now := time.Now().UTC()
+        delivery.UpdatedAt = now
+        switch {
+        case err == nil:
+            delivery.Status = models.DeliveryDelivered
+            delivery.LastError = ""
+        case webhook == nil || !webhook.Active || delivery.Attempts >= s.config.WebhookMaxAttempts:
+            delivery.Status = models.DeliveryDead
+            delivery.LastError = err.Error()
+            log.Printf("webhooks: delivery %d to webhook %d failed after %d attempts: %v",
+                delivery.ID, delivery.WebhookID, delivery.Attempts, err)
+        default:
+            delivery.LastError = err.Error()
+            delivery.NextAttemptAt = now.Add(webhookBackoff(s.config.WebhookRetryBase, delivery.Attempts))
+        }
+
+        if err := s.webhookStorage.UpdateDelivery(ctx, delivery); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// webhookBackoff - пауза перед следующей попыткой: base после первой
+// неудачи и вдвое больше после каждой следующей, не больше maxWebhookBackoff
+func webhookBackoff(base time.Duration, attempts int) time.Duration {
+    backoff := base
+    for i := 1; i < attempts && backoff < maxWebhookBackoff; i++ {
+        backoff *= 2
+    }
+    if backoff > maxWebhookBackoff {
+        backoff = maxWebhookBackoff
+    }
+    return backoff
+}
+
+// webhookSignature - подпись тела доставки: HMAC-SHA256 ключом подписки от
+// строки "<timestamp>.<body>" в hex
+func webhookSignature(secret, timestamp string, body []byte) string {
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write([]byte(timestamp + "."))
+    mac.Write(body)
+    return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// postWebhook отправляет доставку. Доставленной считается доставка, на
+// которую получатель ответил кодом 2xx.
+func postWebhook(ctx context.Context, client *http.Client, webhook *models.Webhook, delivery *models.WebhookDelivery) (int, error) {
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(delivery.Payload))
+    if err != nil {
+        return 0, err
+    }
+
+    timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("User-Agent", "ipset-api-server-webhooks")
+    req.Header.Set("X-Webhook-ID", strconv.FormatInt(webhook.ID, 10))
+    req.Header.Set("X-Webhook-Delivery", strconv.FormatInt(delivery.ID, 10))
+    req.Header.Set("X-Webhook-Event", delivery.Event)
+    req.Header.Set("X-Webhook-Timestamp", timestamp)
+    req.Header.Set("X-Webhook-Signature", webhookSignature(webhook.Secret, timestamp, delivery.Payload))
+
+    resp, err := client.Do(req)
+    if err != nil {
+        return 0, err
+    }
+    defer resp.Body.Close()
+
+    body, _ := io.ReadAll(io.LimitReader(resp.Body, maxWebhookResponse))
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        return resp.StatusCode, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+    }
+    return resp.StatusCode, nil
+}
@@ -0,0 +1,246 @@
+package api
+
+import (
+    "context"
+    "encoding/json"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "sync"
+    "testing"
+    "time"
+    "ipset-api-server/internal/models"
+)
+
+// webhookReceiver - получатель доставок: запоминает запросы и отвечает
+// кодами из statuses по очереди (после них - 200)
+type webhookReceiver struct {
+    mu       sync.Mutex
+    statuses []int
+    requests []*http.Request
+    bodies   [][]byte
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+    body, _ := io.ReadAll(req.Body)
+
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.requests = append(r.requests, req)
+    r.bodies = append(r.bodies, body)
+    status := http.StatusOK
+    if len(r.statuses) > 0 {
+        status, r.statuses = r.statuses[0], r.statuses[1:]
+    }
+    w.WriteHeader(status)
+}
+
+func (r *webhookReceiver) count() int {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return len(r.requests)
+}
+
+// newWebhookTest запускает сервер и получателя и подписывает получателя на
+// изменения сета blacklist. Рассылка начинается с текущего номера.
+func newWebhookTest(t *testing.T, statuses ...int) (*testServer, *webhookReceiver, *models.Webhook) {
+    t.Helper()
+    ts := newTestServer(t, "")
+    receiver := &webhookReceiver{statuses: statuses}
+    target := httptest.NewServer(receiver)
+    t.Cleanup(target.Close)
+
+    now := time.Now().UTC()
+    webhook := &models.Webhook{
+        URL:       target.URL,
+        Secret:    "webhook-secret",
+        Events:    []string{"record.create"},
+        SetNames:  []string{"blacklist"},
+        Active:    true,
+        CreatedAt: now,
+        UpdatedAt: now,
+    }
+    if err := ts.webhookStorage.CreateWebhook(context.Background(), webhook); err != nil {
+        t.Fatal(err)
+    }
+    if err := ts.server.enqueueDeliveries(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    return ts, receiver, webhook
+}
+
+// deliveries - доставки подписки от новых к старым
+func deliveries(t *testing.T, ts *testServer, webhookID int64) []*models.WebhookDelivery {
+    t.Helper()
+    page, err := ts.webhookStorage.ListDeliveries(context.Background(), &models.DeliveryQuery{WebhookID: webhookID, Limit: 100})
+    if err != nil {
+        t.Fatal(err)
+    }
+    return page.Deliveries
+}
+
+func sendDue(t *testing.T, ts *testServer) {
+    t.Helper()
+    if err := ts.server.enqueueDeliveries(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    if err := ts.server.sendDeliveries(context.Background(), &http.Client{Timeout: time.Second}); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestWebhookDeliverySignature(t *testing.T) {
+    ts, receiver, webhook := newWebhookTest(t)
+
+    record := ts.createRecord("blacklist", "10.0.0.1")
+    // Сет whitelist и создание сетов под подписку не подходят
+    ts.createRecord("whitelist", "10.0.0.2")
+    sendDue(t, ts)
+
+    if receiver.count() != 1 {
+        t.Fatalf("receiver got %d requests, want 1", receiver.count())
+    }
+    req, body := receiver.requests[0], receiver.bodies[0]
+    timestamp := req.Header.Get("X-Webhook-Timestamp")
+    if _, err := strconv.ParseInt(timestamp, 10, 64); err != nil {
+        t.Fatalf("invalid timestamp %q", timestamp)
+    }
+    if got, want := req.Header.Get("X-Webhook-Signature"), webhookSignature(webhook.Secret, timestamp, body); got != want {
+        t.Fatalf("signature %q, want %q", got, want)
+    }
+    if got := webhookSignature("other-secret", timestamp, body); got == req.Header.Get("X-Webhook-Signature") {
+        t.Fatal("signature does not depend on the secret")
+    }
+    if req.Header.Get("X-Webhook-Event") != "record.create" || req.Header.Get("X-Webhook-ID") != strconv.FormatInt(webhook.ID, 10) {
+        t.Fatalf("event %q, webhook %q", req.Header.Get("X-Webhook-Event"), req.Header.Get("X-Webhook-ID"))
+    }
+
+    var payload models.WebhookPayload
+    if err := json.Unmarshal(body, &payload); err != nil {
+        t.Fatal(err)
+    }
+    if payload.Event != "record.create" || payload.ChangeEvent == nil || payload.RecordID != record.ID {
+        t.Fatalf("payload %s, want record.create of %d", body, record.ID)
+    }
+
+    list := deliveries(t, ts, webhook.ID)
+    if len(list) != 1 || list[0].Status != models.DeliveryDelivered || list[0].Attempts != 1 || list[0].LastStatus != http.StatusOK {
+        t.Fatalf("deliveries %+v, want one delivered", list)
+    }
+
+    // Доставленное не отправляется повторно
+    sendDue(t, ts)
+    if receiver.count() != 1 {
+        t.Fatalf("receiver got %d requests after resend, want 1", receiver.count())
+    }
+}
+
+func TestWebhookDeliveryRetryAndDeadLetter(t *testing.T) {
+    ts, receiver, webhook := newWebhookTest(t, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable)
+    base := ts.server.config.WebhookRetryBase
+
+    ts.createRecord("blacklist", "10.0.0.1")
+    for attempt := 1; attempt <= ts.server.config.WebhookMaxAttempts; attempt++ {
+        sendDue(t, ts)
+        if receiver.count() != attempt {
+            t.Fatalf("attempt %d: receiver got %d requests", attempt, receiver.count())
+        }
+        list := deliveries(t, ts, webhook.ID)
+        if len(list) != 1 {
+            t.Fatalf("attempt %d: %d deliveries, want 1", attempt, len(list))
+        }
+        delivery := list[0]
+        if delivery.Attempts != attempt || delivery.LastError == "" {
+            t.Fatalf("attempt %d: delivery %+v", attempt, delivery)
+        }
+        if attempt == ts.server.config.WebhookMaxAttempts {
+            if delivery.Status != models.DeliveryDead || delivery.LastStatus != http.StatusServiceUnavailable {
+                t.Fatalf("delivery after %d attempts: status %s (%d), want dead", attempt, delivery.Status, delivery.LastStatus)
+            }
+            break
+        }
+
+        // Пауза удваивается после каждой неудачи
+        if delivery.Status != models.DeliveryPending {
+            t.Fatalf("attempt %d: status %s, want pending", attempt, delivery.Status)
+        }
+        if got, want := delivery.NextAttemptAt.Sub(delivery.UpdatedAt), base<<(attempt-1); got != want {
+            t.Fatalf("attempt %d: next attempt in %v, want %v", attempt, got, want)
+        }
+        // До следующей попытки доставка не отправляется
+        sendDue(t, ts)
+        if receiver.count() != attempt {
+            t.Fatalf("attempt %d: delivery was resent before its backoff", attempt)
+        }
+
+        delivery.NextAttemptAt = time.Now().UTC().Add(-time.Second)
+        if err := ts.webhookStorage.UpdateDelivery(context.Background(), delivery); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    // Недоставленная больше не отправляется, пока ее не повторят вручную
+    sendDue(t, ts)
+    if receiver.count() != ts.server.config.WebhookMaxAttempts {
+        t.Fatalf("dead delivery was resent: %d requests", receiver.count())
+    }
+}
+
+func TestWebhookDeliveryOfDeletedWebhook(t *testing.T) {
+    ts, receiver, _ := newWebhookTest(t)
+    ctx := context.Background()
+
+    // Доставка, созданная для подписки, которую удалили до записи доставки
+    cursor, err := ts.webhookStorage.WebhookCursor(ctx)
+    if err != nil {
+        t.Fatal(err)
+    }
+    now := time.Now().UTC()
+    orphan := &models.WebhookDelivery{
+        WebhookID:     999,
+        Revision:      cursor,
+        Event:         "record.create",
+        Payload:       json.RawMessage(`{}`),
+        Status:        models.DeliveryPending,
+        NextAttemptAt: now,
+        CreatedAt:     now,
+        UpdatedAt:     now,
+    }
+    if err := ts.webhookStorage.EnqueueDeliveries(ctx, []*models.WebhookDelivery{orphan}, cursor); err != nil {
+        t.Fatal(err)
+    }
+
+    sendDue(t, ts)
+    list := deliveries(t, ts, 999)
+    if len(list) != 1 || list[0].Status != models.DeliveryDead || list[0].LastError == "" {
+        t.Fatalf("deliveries %+v, want one dead", list)
+    }
+    if receiver.count() != 0 {
+        t.Fatalf("receiver got %d requests, want none", receiver.count())
+    }
+    due, err := ts.webhookStorage.DueDeliveries(ctx, time.Now(), webhookBatch)
+    if err != nil || len(due) != 0 {
+        t.Fatalf("due deliveries %v (%v), want none", due, err)
+    }
+}
+
+func TestWebhookBackoff(t *testing.T) {
+    base := 10 * time.Second
+    tests := []struct {
+        attempts int
+        want     time.Duration
+    }{
+        {1, 10 * time.Second},
+        {2, 20 * time.Second},
+        {3, 40 * time.Second},
+        {9, 2560 * time.Second},
+        {10, maxWebhookBackoff},
+        {100, maxWebhookBackoff},
+    }
+    for _, tt := range tests {
+        if got := webhookBackoff(base, tt.attempts); got != tt.want {
+            t.Errorf("webhookBackoff(%v, %d) = %v, want %v", base, tt.attempts, got, tt.want)
+        }
+    }
+}
@@ -0,0 +1,310 @@
+package api
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "fmt"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "time"
+    "ipset-api-server/internal/models"
+
+    "github.com/gin-gonic/gin"
+)
+
+// webhookEvents - события, на которые можно подписаться: вид и операция
+// изменения из потока GET /watch
+var webhookEvents = map[string]bool{
+    "record.create": true, "record.update": true, "record.delete": true,
+    "set.create": true, "set.update": true, "set.delete": true,
+}
+
+// webhookEvent - имя события изменения
+func webhookEvent(change *models.ChangeEvent) string {
+    return change.Kind + "." + change.Operation
+}
+
+// webhookMatches - подписан ли webhook на изменение
+func webhookMatches(webhook *models.Webhook, event string, change *models.ChangeEvent) bool {
+    if !webhook.Active {
+        return false
+    }
+    if len(webhook.Events) > 0 && !containsString(webhook.Events, event) {
+        return false
+    }
+    if len(webhook.SetNames) > 0 && !containsString(webhook.SetNames, change.SetName) {
+        return false
+    }
+    return true
+}
+
+func containsString(values []string, value string) bool {
+    for _, v := range values {
+        if v == value {
+            return true
+        }
+    }
+    return false
+}
+
+// applyWebhookRequest переносит указанные в запросе поля в подписку и
+// проверяет результат
+func applyWebhookRequest(webhook *models.Webhook, req *models.WebhookRequest) error {
+    if req.URL != nil {
+        webhook.URL = strings.TrimSpace(*req.URL)
+    }
+    if req.Secret != nil {
+        webhook.Secret = *req.Secret
+    }
+    if req.Events != nil {
+        webhook.Events = *req.Events
+    }
+    if req.SetNames != nil {
+        webhook.SetNames = *req.SetNames
+    }
+    if req.Description != nil {
+        webhook.Description = *req.Description
+    }
+    if req.Active != nil {
+        webhook.Active = *req.Active
+    }
+
+    u, err := url.Parse(webhook.URL)
+    if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+        return fmt.Errorf("url: must be an http or https URL")
+    }
+    if webhook.Secret == "" {
+        return fmt.Errorf("secret: must not be empty")
+    }
+    if webhook.Events == nil {
+        webhook.Events = []string{}
+    }
+    for _, event := range webhook.Events {
+        if !webhookEvents[event] {
+            return fmt.Errorf("events: unknown event %q (use record.create, record.update, record.delete, set.create, set.update, set.delete)", event)
+        }
+    }
+    if webhook.SetNames == nil {
+        webhook.SetNames = []string{}
+    }
+    for _, setName := range webhook.SetNames {
+        if setName == "" || strings.Contains(setName, ",") {
+            return fmt.Errorf("set_names: invalid set name %q", setName)
+        }
+    }
+    return nil
+}
+
+// newWebhookSecret - ключ подписи, если клиент не задал свой
+func newWebhookSecret() string {
+    buf := make([]byte, 32)
+    rand.Read(buf)
+    return hex.EncodeToString(buf)
+}
+
+// webhookID разбирает ID из пути запроса
+func webhookID(c *gin.Context) (int64, bool) {
+    id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+    if err != nil || id <= 0 {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "invalid ID"})
+        return 0, false
+    }
+    return id, true
+}
+
+// hideSecret - подписка без ключа подписи: ключ отдается только при создании
+func hideSecret(webhook *models.Webhook) *models.Webhook {
+    copied := *webhook
+    copied.Secret = ""
+    return &copied
+}
+
+func (s *Server) createWebhook(c *gin.Context) {
+    var req models.WebhookRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    now := time.Now().UTC()
+    webhook := &models.Webhook{
+        Active:    true,
+        CreatedAt: now,
+        UpdatedAt: now,
+    }
+    if req.Secret == nil || *req.Secret == "" {
+        secret := newWebhookSecret()
+        req.Secret = &secret
+    }
+    if err := applyWebhookRequest(webhook, &req); err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    if err := s.webhookStorage.CreateWebhook(c.Request.Context(), webhook); err != nil {
+        c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    c.JSON(http.StatusCreated, webhook)
+}
+
+func (s *Server) getWebhooks(c *gin.Context) {
+    webhooks, err := s.webhookStorage.ListWebhooks(c.Request.Context())
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    result := make([]*models.Webhook, 0, len(webhooks))
+    for _, webhook := range webhooks {
+        result = append(result, hideSecret(webhook))
+    }
+    c.JSON(http.StatusOK, result)
+}
+
+func (s *Server) getWebhook(c *gin.Context) {
+    id, ok := webhookID(c)
+    if !ok {
+        return
+    }
+
+    webhook, err := s.webhookStorage.GetWebhook(c.Request.Context(), id)
+    if err != nil {
+        c.JSON(http.StatusNotFound, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    c.JSON(http.StatusOK, hideSecret(webhook))
+}
+
+func (s *Server) updateWebhook(c *gin.Context) {
+    id, ok := webhookID(c)
+    if !ok {
+        return
+    }
+
+    var req models.WebhookRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    webhook, err := s.webhookStorage.GetWebhook(c.Request.Context(), id)
+    if err != nil {
+        c.JSON(http.StatusNotFound, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+    if err := applyWebhookRequest(webhook, &req); err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+    webhook.UpdatedAt = time.Now().UTC()
+
+    if err := s.webhookStorage.UpdateWebhook(c.Request.Context(), webhook); err != nil {
+        c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    c.JSON(http.StatusOK, hideSecret(webhook))
+}
+
+func (s *Server) deleteWebhook(c *gin.Context) {
+    id, ok := webhookID(c)
+    if !ok {
+        return
+    }
+
+    if _, err := s.webhookStorage.GetWebhook(c.Request.Context(), id); err != nil {
+        c.JSON(http.StatusNotFound, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+    if err := s.webhookStorage.DeleteWebhook(c.Request.Context(), id); err != nil {
+        c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    c.JSON(http.StatusOK, models.SuccessResponse{Message: "webhook deleted successfully"})
+}
+
+// getWebhookDeliveries - журнал доставок одной подписки
+func (s *Server) getWebhookDeliveries(c *gin.Context) {
+    id, ok := webhookID(c)
+    if !ok {
+        return
+    }
+    if _, err := s.webhookStorage.GetWebhook(c.Request.Context(), id); err != nil {
+        c.JSON(http.StatusNotFound, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    s.listDeliveries(c, id)
+}
+
+// getDeliveries - журнал доставок всех подписок; status=dead - очередь
+// недоставленных
+func (s *Server) getDeliveries(c *gin.Context) {
+    var id int64
+    if value := c.Query("webhook_id"); value != "" {
+        var err error
+        if id, err = strconv.ParseInt(value, 10, 64); err != nil || id <= 0 {
+            c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "invalid webhook_id: " + value})
+            return
+        }
+    }
+
+    s.listDeliveries(c, id)
+}
+
+// listDeliveries отдает страницу журнала доставок, от новых к старым.
+// Курсор следующей страницы - в заголовках X-Next-Cursor и Link.
+func (s *Server) listDeliveries(c *gin.Context, webhookID int64) {
+    query := &models.DeliveryQuery{
+        WebhookID: webhookID,
+        Status:    c.Query("status"),
+        Cursor:    c.Query("cursor"),
+    }
+    var err error
+    if query.Limit, err = intParam(c, "limit"); err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    page, err := s.webhookStorage.ListDeliveries(c.Request.Context(), query)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    setNextLink(c, page.NextCursor)
+    c.JSON(http.StatusOK, page.Deliveries)
+}
+
+// retryDelivery ставит доставку (обычно из очереди недоставленных) в
+// очередь заново с полным числом попыток
+func (s *Server) retryDelivery(c *gin.Context) {
+    id, ok := webhookID(c)
+    if !ok {
+        return
+    }
+
+    delivery, err := s.webhookStorage.GetDelivery(c.Request.Context(), id)
+    if err != nil {
+        c.JSON(http.StatusNotFound, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    now := time.Now().UTC()
+    delivery.Status = models.DeliveryPending
+    delivery.Attempts = 0
+    delivery.NextAttemptAt = now
+    delivery.UpdatedAt = now
+    if err := s.webhookStorage.UpdateDelivery(c.Request.Context(), delivery); err != nil {
+        c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: err.Error()})
+        return
+    }
+
+    c.JSON(http.StatusOK, delivery)
+}
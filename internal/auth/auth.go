@@ -1,6 +1,9 @@
 package auth
 
 import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
     "errors"
     "time"
     "ipset-api-server/internal/storage"
@@ -18,8 +21,15 @@ func NewManager(keyStorage storage.KeyStorage) *Manager {
     }
 }
 
-func (m *Manager) ValidateKey(key string) (bool, error) {
-    authKey, err := m.keyStorage.GetKey(key)
+// KeyID - идентификатор ключа API для журналов: первые 16 hex-символов
+// SHA-256 от ключа. Сам ключ в журналы не попадает.
+func KeyID(key string) string {
+    sum := sha256.Sum256([]byte(key))
+    return hex.EncodeToString(sum[:])[:16]
+}
+
+func (m *Manager) ValidateKey(ctx context.Context, key string) (bool, error) {
+    authKey, err := m.keyStorage.GetKey(ctx, key)
     if err != nil {
         return false, err
     }
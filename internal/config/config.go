@@ -2,6 +2,10 @@ package config
 
 import (
     "os"
+    "strconv"
+    "time"
+    
+    "github.com/joho/godotenv"
 )
 
 type Config struct {
@@ -16,6 +20,10 @@ type Config struct {
     // IPSet storage settings
     IPSetStorageType string
     
+    // Cache settings
+    IPSetCacheEnabled bool
+    IPSetCacheTTL     time.Duration
+    
     // Database settings
     ClickHouseHost     string
     ClickHousePort     string
@@ -35,12 +43,91 @@ type Config struct {
     PostgreSQLUsername string
     PostgreSQLPassword string
     
+    SQLitePath string
+    
+    // AutoMigrate - применять недостающие миграции схемы при старте
+    AutoMigrate bool
+    
+    // DBQueryTimeout - ограничение времени одного обращения к хранилищу,
+    // 0 - без ограничения (действует только контекст запроса)
+    DBQueryTimeout time.Duration
+    
+    // TrashRetention - сколько удаленные записи хранятся в корзине,
+    // 0 - корзина не очищается. TrashPurgeInterval - период очистки.
+    TrashRetention     time.Duration
+    TrashPurgeInterval time.Duration
+    
+    // ExpirySweepInterval - период удаления истекших записей,
+    // 0 - записи не удаляются (но и не видны после истечения)
+    ExpirySweepInterval time.Duration
+    
+    // SchedulerInterval - наибольший период проверки окон действия записей
+    // (на границах окон планировщик просыпается сам), 0 - планировщик выключен
+    SchedulerInterval time.Duration
+    
+    // WatchPollInterval - период проверки новых изменений для GET /watch,
+    // пока есть ожидающие (изменения через этот сервер видны сразу),
+    // 0 - хранилище не опрашивается
+    WatchPollInterval time.Duration
+    
+    // WebhookInterval - период проверки новых изменений и доставок webhooks,
+    // 0 - доставка выключена. Попытка доставки ограничена WebhookTimeout,
+    // после неудачи следующая через WebhookRetryBase, каждый раз вдвое
+    // дольше; после WebhookMaxAttempts попыток доставка попадает в очередь
+    // недоставленных. Доставленные хранятся WebhookDeliveryRetention.
+    WebhookInterval          time.Duration
+    WebhookTimeout           time.Duration
+    WebhookRetryBase         time.Duration
+    WebhookMaxAttempts       int
+    WebhookDeliveryRetention time.Duration
+    
+    // AgentStaleAfter - через сколько после последнего heartbeat агент
+    // считается пропавшим (статус stale в GET /agents)
+    AgentStaleAfter time.Duration
+    
     // File storage settings
     AuthKeysFilePath string
     IPSetFilePath    string
+    AuditFilePath    string
+    WebhooksFilePath string
+    AgentsFilePath   string
 }
 
 func Load() *Config {
+    return load(os.Getenv)
+}
+
+// LoadFromFile читает конфигурацию из env-файла, значения из файла имеют
+// приоритет над переменными окружения. Используется, когда нужно работать
+// сразу с двумя хранилищами одного типа (например, при переносе данных).
+func LoadFromFile(path string) (*Config, error) {
+    values, err := godotenv.Read(path)
+    if err != nil {
+        return nil, err
+    }
+    
+    return load(func(key string) string {
+        if value, ok := values[key]; ok {
+            return value
+        }
+        return os.Getenv(key)
+    }), nil
+}
+
+func load(lookup func(string) string) *Config {
+    getEnv := func(key, defaultValue string) string {
+        return getEnvFrom(lookup, key, defaultValue)
+    }
+    getEnvBool := func(key string, defaultValue bool) bool {
+        return getEnvBoolFrom(lookup, key, defaultValue)
+    }
+    getEnvDuration := func(key string, defaultValue time.Duration) time.Duration {
+        return getEnvDurationFrom(lookup, key, defaultValue)
+    }
+    getEnvInt := func(key string, defaultValue int) int {
+        return getEnvIntFrom(lookup, key, defaultValue)
+    }
+    
     return &Config{
         ServerHost: getEnv("SERVER_HOST", "localhost"),
         ServerPort: getEnv("SERVER_PORT", "8080"),
@@ -50,6 +137,9 @@ func Load() *Config {
         
         IPSetStorageType: getEnv("IPSET_STORAGE_TYPE", "file"),
         
+        IPSetCacheEnabled: getEnvBool("IPSET_CACHE_ENABLED", false),
+        IPSetCacheTTL:     getEnvDuration("IPSET_CACHE_TTL", time.Minute),
+        
         ClickHouseHost:     getEnv("CLICKHOUSE_HOST", "localhost"),
         ClickHousePort:     getEnv("CLICKHOUSE_PORT", "9000"),
         ClickHouseDatabase: getEnv("CLICKHOUSE_DATABASE", "ipset"),
@@ -68,15 +158,59 @@ func Load() *Config {
         PostgreSQLUsername: getEnv("POSTGRES_USERNAME", "postgres"),
         PostgreSQLPassword: getEnv("POSTGRES_PASSWORD", ""),
         
+        SQLitePath: getEnv("SQLITE_PATH", "data/ipset.db"),
+        
+        AutoMigrate:    getEnvBool("DB_AUTO_MIGRATE", true),
+        DBQueryTimeout: getEnvDuration("DB_QUERY_TIMEOUT", 30*time.Second),
+        
+        TrashRetention:     getEnvDuration("TRASH_RETENTION", 30*24*time.Hour),
+        TrashPurgeInterval: getEnvDuration("TRASH_PURGE_INTERVAL", time.Hour),
+        
+        ExpirySweepInterval: getEnvDuration("EXPIRY_SWEEP_INTERVAL", time.Minute),
+        SchedulerInterval:   getEnvDuration("SCHEDULER_INTERVAL", time.Minute),
+        
+        WatchPollInterval: getEnvDuration("WATCH_POLL_INTERVAL", time.Second),
+        
+        WebhookInterval:          getEnvDuration("WEBHOOK_INTERVAL", 5*time.Second),
+        WebhookTimeout:           getEnvDuration("WEBHOOK_TIMEOUT", 10*time.Second),
+        WebhookRetryBase:         getEnvDuration("WEBHOOK_RETRY_BASE", 30*time.Second),
+        WebhookMaxAttempts:       getEnvInt("WEBHOOK_MAX_ATTEMPTS", 8),
+        WebhookDeliveryRetention: getEnvDuration("WEBHOOK_DELIVERY_RETENTION", 7*24*time.Hour),
+        
+        AgentStaleAfter: getEnvDuration("AGENT_STALE_AFTER", 5*time.Minute),
+        
         AuthKeysFilePath: getEnv("AUTH_KEYS_FILE", "data/auth_keys.json"),
         IPSetFilePath:    getEnv("IPSET_FILE", "data/ipset_records.json"),
+        AuditFilePath:    getEnv("AUDIT_FILE", "data/audit_log.jsonl"),
+        WebhooksFilePath: getEnv("WEBHOOKS_FILE", "data/webhooks.json"),
+        AgentsFilePath:   getEnv("AGENTS_FILE", "data/agents.json"),
+    }
+}
+
+func getEnvFrom(lookup func(string) string, key, defaultValue string) string {
+    if value := lookup(key); value != "" {
+        return value
     }
+    return defaultValue
 }
 
-func getEnv(key, defaultValue string) string {
-    if value := os.Getenv(key); value != "" {
+func getEnvBoolFrom(lookup func(string) string, key string, defaultValue bool) bool {
+    if value, err := strconv.ParseBool(lookup(key)); err == nil {
         return value
     }
     return defaultValue
 }
 
+func getEnvDurationFrom(lookup func(string) string, key string, defaultValue time.Duration) time.Duration {
+    if value, err := time.ParseDuration(lookup(key)); err == nil {
+        return value
+    }
+    return defaultValue
+}
+
+func getEnvIntFrom(lookup func(string) string, key string, defaultValue int) int {
+    if value, err := strconv.Atoi(lookup(key)); err == nil {
+        return value
+    }
+    return defaultValue
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+    "encoding/json"
     "time"
 )
 
@@ -18,33 +19,393 @@ type IPSetRecord struct {
     CIDR        string    `json:"cidr,omitempty"`
     Port        int       `json:"port,omitempty"`
     Protocol    string    `json:"protocol,omitempty"`
+    SecondIP    string    `json:"second_ip,omitempty"`
     Description string    `json:"description"`
     Context     string    `json:"context"`
     SetType     string    `json:"set_type,omitempty"`
     SetOptions  string    `json:"set_options,omitempty"`
     CreatedAt   time.Time `json:"created_at"`
     UpdatedAt   time.Time `json:"updated_at"`
+    
+    // ExpiresAt - время, после которого запись не видна и удаляется
+    // сервером; nil - бессрочная запись
+    ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+    
+    // ActiveFrom - время, с которого запись действует, Schedule - окна
+    // действия по дням недели (формат pkg/schedule). Вне окна запись
+    // хранится, но не попадает в экспорт сета.
+    ActiveFrom  *time.Time `json:"active_from,omitempty"`
+    Schedule    string     `json:"schedule,omitempty"`
+    
+    // DeletedAt - время переноса в корзину, заполнен только у записей из корзины
+    DeletedAt   *time.Time `json:"deleted_at,omitempty"`
 }
 
+// IPSetSet - сет. Тип, опции и семейство задаются сетом, записи получают
+// их копию. RecordCount - число действующих записей; сами записи
+// заполняются только при запросе одного сета.
 type IPSetSet struct {
     Name        string         `json:"name"`
     Type        string         `json:"type"`
     Options     string         `json:"options,omitempty"`
-    Records     []IPSetRecord  `json:"records"`
+    Family      string         `json:"family"`
+    Description string         `json:"description"`
+    Owner       string         `json:"owner"`
+    RecordCount int            `json:"record_count"`
+    Records     []IPSetRecord  `json:"records,omitempty"`
     CreatedAt   time.Time      `json:"created_at"`
     UpdatedAt   time.Time      `json:"updated_at"`
 }
 
+// RecordQuery - параметры постраничной выборки записей. Пустые поля не
+// участвуют в фильтрации, Context ищется как подстрока без учета регистра.
+type RecordQuery struct {
+    SetName       string
+    Context       string
+    Protocol      string
+    Port          int
+    CreatedAfter  time.Time
+    CreatedBefore time.Time
+    UpdatedAfter  time.Time
+    UpdatedBefore time.Time
+    
+    // SortBy - поле сортировки (id, set_name, ip, context, created_at, updated_at)
+    SortBy string
+    Desc   bool
+    
+    Limit  int
+    Cursor string
+}
+
+// RecordPage - страница записей и курсор следующей страницы (пустой, если
+// страница последняя)
+type RecordPage struct {
+    Records    []*IPSetRecord
+    NextCursor string
+}
+
+// SetQuery - параметры постраничной выборки сетов, сортировка по имени
+type SetQuery struct {
+    SetType string
+    Desc    bool
+    
+    Limit  int
+    Cursor string
+}
+
+type SetPage struct {
+    Sets       []*IPSetSet
+    NextCursor string
+}
+
+// Действия в журнале аудита. Каждое событие относится к одной записи или
+// к сету (create_set, update_set, rename_set, copy_set, swap_set): удаление
+// сета и импорт пишут по событию на каждую затронутую запись, удаление
+// пустого сета - событие о сете. Отчеты агентов (agent_apply,
+// agent_apply_failed) пишут по событию на каждый примененный сет.
+const (
+    AuditCreate     = "create"
+    AuditUpdate     = "update"
+    AuditDelete     = "delete"
+    AuditDeleteSet  = "delete_set"
+    AuditImport     = "import"
+    AuditRestore    = "restore"
+    AuditExpire     = "expire"
+    AuditActivate   = "activate"
+    AuditDeactivate = "deactivate"
+    AuditCreateSet  = "create_set"
+    AuditUpdateSet  = "update_set"
+    AuditRenameSet  = "rename_set"
+    AuditCopySet    = "copy_set"
+    AuditSwapSet    = "swap_set"
+    
+    AuditAgentApply       = "agent_apply"
+    AuditAgentApplyFailed = "agent_apply_failed"
+)
+
+// AuditEvent - событие журнала аудита. Actor - ID ключа API (не сам ключ),
+// Before и After - запись до и после изменения (null при создании и удалении);
+// у событий о сете это сет, а RecordID равен нулю
+type AuditEvent struct {
+    ID        int64           `json:"id"`
+    Timestamp time.Time       `json:"timestamp"`
+    Actor     string          `json:"actor"`
+    RequestID string          `json:"request_id,omitempty"`
+    Action    string          `json:"action"`
+    SetName   string          `json:"set_name"`
+    RecordID  int             `json:"record_id"`
+    Before    json.RawMessage `json:"before,omitempty"`
+    After     json.RawMessage `json:"after,omitempty"`
+}
+
+// AuditQuery - фильтры журнала аудита. События отдаются от новых к старым,
+// Since включительно, Until - исключая.
+type AuditQuery struct {
+    Actor     string
+    Action    string
+    SetName   string
+    RecordID  int
+    RequestID string
+    Since     time.Time
+    Until     time.Time
+    
+    Limit  int
+    Cursor string
+}
+
+type AuditPage struct {
+    Events     []*AuditEvent
+    NextCursor string
+}
+
+// Операции в истории записи
+const (
+    RevisionCreate = "create"
+    RevisionUpdate = "update"
+    RevisionDelete = "delete"
+)
+
+// RecordRevision - состояние записи после изменения. У ревизии удаления
+// Record - последнее состояние записи перед удалением.
+type RecordRevision struct {
+    Revision  int         `json:"revision"`
+    Operation string      `json:"operation"`
+    ChangedAt time.Time   `json:"changed_at"`
+    Record    IPSetRecord `json:"record"`
+}
+
+// Вид изменения в потоке GET /watch
+const (
+    ChangeKindRecord = "record"
+    ChangeKindSet    = "set"
+)
+
+// ChangeEvent - изменение записи или сета с номером Revision. Номера
+// растут монотонно для всего хранилища. Operation - create, update или
+// delete (как у ревизий), Record или Set - состояние после изменения, у
+// удаления - последнее состояние перед ним.
+type ChangeEvent struct {
+    Revision  int64        `json:"revision"`
+    ChangedAt time.Time    `json:"changed_at"`
+    Kind      string       `json:"kind"`
+    Operation string       `json:"operation"`
+    SetName   string       `json:"set_name"`
+    RecordID  int          `json:"record_id,omitempty"`
+    Record    *IPSetRecord `json:"record,omitempty"`
+    Set       *IPSetSet    `json:"set,omitempty"`
+}
+
+// WatchResult - ответ GET /watch без потока: изменения после since и номер,
+// с которого продолжать
+type WatchResult struct {
+    Revision int64          `json:"revision"`
+    Changes  []*ChangeEvent `json:"changes"`
+}
+
+// Webhook - подписка на изменения записей и сетов. Events - события вида
+// record.create или set.delete, SetNames - сеты; пустой список - все.
+// Secret - ключ подписи доставок, возвращается только при создании.
+type Webhook struct {
+    ID          int64     `json:"id"`
+    URL         string    `json:"url"`
+    Secret      string    `json:"secret,omitempty"`
+    Events      []string  `json:"events"`
+    SetNames    []string  `json:"set_names"`
+    Description string    `json:"description"`
+    Active      bool      `json:"active"`
+    CreatedAt   time.Time `json:"created_at"`
+    UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// WebhookRequest - создание и изменение подписки. При изменении меняются
+// только указанные поля.
+type WebhookRequest struct {
+    URL         *string   `json:"url"`
+    Secret      *string   `json:"secret"`
+    Events      *[]string `json:"events"`
+    SetNames    *[]string `json:"set_names"`
+    Description *string   `json:"description"`
+    Active      *bool     `json:"active"`
+}
+
+// Состояние доставки: ждет отправки (в том числе повторной), доставлена,
+// попытки исчерпаны (очередь недоставленных)
+const (
+    DeliveryPending   = "pending"
+    DeliveryDelivered = "delivered"
+    DeliveryDead      = "dead"
+)
+
+// WebhookDelivery - отправка одного изменения одной подписке. Payload -
+// тело запроса, LastStatus и LastError - итог последней попытки.
+type WebhookDelivery struct {
+    ID            int64           `json:"id"`
+    WebhookID     int64           `json:"webhook_id"`
+    Revision      int64           `json:"revision"`
+    Event         string          `json:"event"`
+    Payload       json.RawMessage `json:"payload"`
+    Status        string          `json:"status"`
+    Attempts      int             `json:"attempts"`
+    NextAttemptAt time.Time       `json:"next_attempt_at"`
+    LastStatus    int             `json:"last_status,omitempty"`
+    LastError     string          `json:"last_error,omitempty"`
+    CreatedAt     time.Time       `json:"created_at"`
+    UpdatedAt     time.Time       `json:"updated_at"`
+}
+
+// WebhookPayload - тело доставки: изменение из потока GET /watch и имя
+// события
+type WebhookPayload struct {
+    Event     string `json:"event"`
+    WebhookID int64  `json:"webhook_id"`
+    *ChangeEvent
+}
+
+// DeliveryQuery - фильтры журнала доставок. Доставки отдаются от новых к
+// старым.
+type DeliveryQuery struct {
+    WebhookID int64
+    Status    string
+    
+    Limit  int
+    Cursor string
+}
+
+type DeliveryPage struct {
+    Deliveries []*WebhookDelivery
+    NextCursor string
+}
+
+// AgentSetResult - результат применения сета к ядру агентом (cmd/agent):
+// номер изменения, с которым сет был получен, число элементов и контрольная
+// сумма содержимого (drift.Digest); Error - причина, по которой сет не
+// применен последний раз (AppliedAt тогда пустой или время прошлого
+// применения)
+type AgentSetResult struct {
+    SetName   string     `json:"set_name" binding:"required"`
+    Revision  int64      `json:"revision"`
+    Entries   int        `json:"entries"`
+    Digest    string     `json:"digest,omitempty"`
+    Error     string     `json:"error,omitempty"`
+    AppliedAt *time.Time `json:"applied_at,omitempty"`
+}
+
+// AgentReport - отчет агента после применения сетов
+type AgentReport struct {
+    Hostname string            `json:"hostname" binding:"required"`
+    Sets     []*AgentSetResult `json:"sets" binding:"required,dive,required"`
+}
+
+// Agent - хост с агентом в реестре, ключ - имя хоста. Sets - состояние
+// сетов из последнего heartbeat, LastError - последняя ошибка агента вне
+// применения сетов (например, GET /watch).
+type Agent struct {
+    Hostname     string            `json:"hostname"`
+    Labels       map[string]string `json:"labels"`
+    Sets         []*AgentSetResult `json:"sets"`
+    LastError    string            `json:"last_error,omitempty"`
+    RegisteredAt time.Time         `json:"registered_at"`
+    LastSeenAt   time.Time         `json:"last_seen_at"`
+}
+
+// AgentRegistration - регистрация агента; повторная регистрация хоста
+// заменяет метки
+type AgentRegistration struct {
+    Hostname string            `json:"hostname" binding:"required"`
+    Labels   map[string]string `json:"labels"`
+}
+
+// AgentHeartbeat - состояние агента: последний результат по каждому сету,
+// который он применяет, и последняя ошибка агента (пустая - ошибки нет)
+type AgentHeartbeat struct {
+    Sets  []*AgentSetResult `json:"sets" binding:"dive,required"`
+    Error string            `json:"error"`
+}
+
+// Статусы агента: ok - все сеты применены в текущем виде, drifted - какой-то
+// сет не применен или изменился на сервере после применения, stale - агент
+// давно не присылал heartbeat
+const (
+    AgentOK      = "ok"
+    AgentDrifted = "drifted"
+    AgentStale   = "stale"
+)
+
+// Статусы сета на агенте: применен в текущем виде, изменился на сервере
+// после применения, последнее применение не удалось, назначен, но агент о
+// нем не сообщал
+const (
+    AgentSetOK       = "ok"
+    AgentSetOutdated = "outdated"
+    AgentSetFailed   = "failed"
+    AgentSetMissing  = "missing"
+)
+
+// AgentSetStatus - сет агента с его статусом
+type AgentSetStatus struct {
+    AgentSetResult
+    Status string `json:"status"`
+}
+
+// AgentStatus - агент в GET /agents: сеты, назначенные ему правилами, и
+// статус раскатки. Sets - назначенные сеты и сеты из heartbeat.
+type AgentStatus struct {
+    *Agent
+    Sets         []*AgentSetStatus `json:"sets"`
+    AssignedSets []string          `json:"assigned_sets"`
+    Status       string            `json:"status"`
+}
+
+// AssignmentRule - правило назначения сетов: сеты Sets назначаются агентам,
+// у которых есть все метки Selector (пустой селектор - всем агентам)
+type AssignmentRule struct {
+    ID          int64             `json:"id"`
+    Selector    map[string]string `json:"selector"`
+    Sets        []string          `json:"sets"`
+    Description string            `json:"description"`
+    CreatedAt   time.Time         `json:"created_at"`
+    UpdatedAt   time.Time         `json:"updated_at"`
+}
+
+// AssignmentRequest - создание и изменение правила назначения. При
+// изменении меняются только указанные поля.
+type AssignmentRequest struct {
+    Selector    *map[string]string `json:"selector"`
+    Sets        *[]string          `json:"sets"`
+    Description *string            `json:"description"`
+}
+
+// RestoreResult - изменения, которыми сет возвращен к состоянию на AsOf:
+// восстановленные удаленные записи, измененные и удаленные записи. При
+// восстановлении из корзины AsOf не заполнен.
+type RestoreResult struct {
+    SetName  string     `json:"set_name"`
+    AsOf     *time.Time `json:"as_of,omitempty"`
+    Restored []int     `json:"restored"`
+    Updated  []int     `json:"updated"`
+    Deleted  []int     `json:"deleted"`
+    Errors   []string  `json:"errors,omitempty"`
+}
+
 type CreateIPSetRequest struct {
     SetName     string `json:"set_name" binding:"required"`
-    IP          string `json:"ip" binding:"required"`
+    IP          string `json:"ip"`
     CIDR        string `json:"cidr"`
     Port        int    `json:"port"`
     Protocol    string `json:"protocol"`
+    SecondIP    string `json:"second_ip"`
     Description string `json:"description"`
     Context     string `json:"context" binding:"required"`
     SetType     string `json:"set_type"`
     SetOptions  string `json:"set_options"`
+    
+    // Срок записи: время истечения или TTL в секундах от текущего момента
+    ExpiresAt   *time.Time `json:"expires_at"`
+    TTL         int        `json:"ttl"`
+    
+    // Окно действия записи
+    ActiveFrom  *time.Time `json:"active_from"`
+    Schedule    string     `json:"schedule"`
 }
 
 type UpdateIPSetRequest struct {
@@ -53,18 +414,171 @@ type UpdateIPSetRequest struct {
     CIDR        string `json:"cidr"`
     Port        int    `json:"port"`
     Protocol    string `json:"protocol"`
+    SecondIP    string `json:"second_ip"`
     Description string `json:"description"`
     Context     string `json:"context"`
     SetType     string `json:"set_type"`
     SetOptions  string `json:"set_options"`
+    
+    // Новый срок записи, как в CreateIPSetRequest
+    ExpiresAt   *time.Time `json:"expires_at"`
+    TTL         int        `json:"ttl"`
+    
+    // Новое окно действия; пустая строка в schedule снимает расписание
+    ActiveFrom  *time.Time `json:"active_from"`
+    Schedule    *string    `json:"schedule"`
 }
 
-type ImportResult struct {
-    SetName     string   `json:"set_name"`
-    Records     int      `json:"records"`
-    SetType     string   `json:"set_type"`
-    Success     bool     `json:"success"`
-    Error       string   `json:"error,omitempty"`
+// CreateSetRequest - новый сет. Тип по умолчанию hash:ip, семейство можно
+// задать отдельно или опцией family; owner по умолчанию - ID ключа API.
+type CreateSetRequest struct {
+    Name        string `json:"name" binding:"required"`
+    Type        string `json:"type"`
+    Options     string `json:"options"`
+    Family      string `json:"family"`
+    Description string `json:"description"`
+    Owner       string `json:"owner"`
+}
+
+// UpdateSetRequest - изменение сета, nil - поле не меняется
+type UpdateSetRequest struct {
+    Type        *string `json:"type"`
+    Options     *string `json:"options"`
+    Family      *string `json:"family"`
+    Description *string `json:"description"`
+    Owner       *string `json:"owner"`
+}
+
+// RenameSetRequest - новое имя сета (rename) или имя копии (copy)
+type RenameSetRequest struct {
+    Name string `json:"name" binding:"required"`
+}
+
+// SwapSetsRequest - сеты, которые меняются содержимым, как в ipset swap
+type SwapSetsRequest struct {
+    From string `json:"from" binding:"required"`
+    To   string `json:"to" binding:"required"`
+}
+
+// Режимы импорта сета: append добавляет записи, которых в сете нет;
+// sync делает сет равным импорту, оставляя совпадающие записи как есть;
+// replace делает сет равным импорту вместе с описанием, контекстом и сроком
+// записей
+const (
+    ImportAppend  = "append"
+    ImportSync    = "sync"
+    ImportReplace = "replace"
+)
+
+// ImportSetRequest - импорт сета. description и context задают значения
+// по умолчанию для записей импорта. upsert - переписать описание, контекст
+// и срок записей, которые уже есть в сете.
+type ImportSetRequest struct {
+    SetName     string            `json:"set_name" binding:"required"`
+    SetType     string            `json:"set_type"`
+    SetOptions  string            `json:"set_options"`
+    Mode        string            `json:"mode"`
+    Upsert      bool              `json:"upsert"`
+    Records     []ImportSetRecord `json:"records" binding:"required"`
+    Description string            `json:"description"`
+    Context     string            `json:"context" binding:"required"`
+}
+
+// ImportSetRecord - запись импорта; пустые description и context берутся
+// из запроса, ttl - срок записи в секундах
+type ImportSetRecord struct {
+    IP          string `json:"ip"`
+    CIDR        string `json:"cidr"`
+    Port        int    `json:"port"`
+    Protocol    string `json:"protocol"`
+    SecondIP    string `json:"second_ip"`
+    Description string `json:"description"`
+    Context     string `json:"context"`
+    TTL         int    `json:"ttl"`
+}
+
+// ImportSetResult - итог импорта: ID добавленных, перенесенных в корзину,
+// измененных (upsert) и оставшихся без изменений записей
+type ImportSetResult struct {
+    SetName   string `json:"set_name"`
+    Mode      string `json:"mode"`
+    Added     []int  `json:"added"`
+    Removed   []int  `json:"removed"`
+    Updated   []int  `json:"updated"`
+    Unchanged []int  `json:"unchanged"`
+}
+
+// Режимы пакетных операций: atomic выполняет все операции одной
+// транзакцией или ни одной, best_effort - каждую операцию отдельно
+const (
+    BulkAtomic     = "atomic"
+    BulkBestEffort = "best_effort"
+)
+
+// BulkRecordsRequest - пакет операций с записями (POST /records/bulk)
+type BulkRecordsRequest struct {
+    Mode       string          `json:"mode"`
+    Operations []BulkOperation `json:"operations" binding:"required"`
+}
+
+// BulkOperation - операция пакета: create (record - как тело POST /records),
+// update (id и record - как тело PUT /records/:id) или delete (id)
+type BulkOperation struct {
+    Op     string          `json:"op"`
+    ID     int             `json:"id"`
+    Record json.RawMessage `json:"record"`
+}
+
+// BulkUpdateRequest - изменение всех записей, подходящих под фильтр
+// (POST /records/bulk/update). update - как тело PUT /records/:id.
+type BulkUpdateRequest struct {
+    Mode   string             `json:"mode"`
+    Filter RecordFilter       `json:"filter"`
+    Update UpdateIPSetRequest `json:"update"`
+}
+
+// RecordFilter - фильтры выборки записей, как параметры GET /records
+type RecordFilter struct {
+    SetName       string    `json:"set_name"`
+    Context       string    `json:"context"`
+    Protocol      string    `json:"protocol"`
+    Port          int       `json:"port"`
+    CreatedAfter  time.Time `json:"created_after"`
+    CreatedBefore time.Time `json:"created_before"`
+    UpdatedAfter  time.Time `json:"updated_after"`
+    UpdatedBefore time.Time `json:"updated_before"`
+}
+
+// BulkResult - итог операции пакета: код ответа, который получила бы
+// операция отдельным запросом, и запись после операции (для delete - до
+// нее). Операции, не выполненные из-за ошибки другой операции в режиме
+// atomic, получают код 424.
+type BulkResult struct {
+    Index      int          `json:"index"`
+    Op         string       `json:"op"`
+    ID         int          `json:"id,omitempty"`
+    Status     int          `json:"status"`
+    Error      string       `json:"error,omitempty"`
+    ExistingID int          `json:"existing_id,omitempty"`
+    Record     *IPSetRecord `json:"record,omitempty"`
+}
+
+// BulkRecordsResult - итог пакета: число выполненных и невыполненных
+// операций и итог каждой операции в порядке запроса
+type BulkRecordsResult struct {
+    Mode      string       `json:"mode"`
+    Succeeded int          `json:"succeeded"`
+    Failed    int          `json:"failed"`
+    Results   []BulkResult `json:"results"`
+}
+
+// LookupResult - записи, которые покрывают адрес или пересекаются с сетью,
+// и сводка по их сетам и контекстам
+type LookupResult struct {
+    IP       string         `json:"ip"`
+    Records  []*IPSetRecord `json:"records"`
+    Sets     []string       `json:"sets"`
+    Contexts []string       `json:"contexts"`
 }
 
 type LoginRequest struct {
@@ -79,6 +593,13 @@ type ErrorResponse struct {
     Error string `json:"error"`
 }
 
+// DuplicateResponse - ответ 409, когда в сете уже есть запись с тем же
+// элементом: existing_id - ID этой записи
+type DuplicateResponse struct {
+    Error      string `json:"error"`
+    ExistingID int    `json:"existing_id"`
+}
+
 type SuccessResponse struct {
     Message string `json:"message"`
 }
@@ -0,0 +1,112 @@
+package storage
+
+import (
+    "context"
+    "database/sql"
+    "fmt"
+    "net/netip"
+    "sort"
+    "ipset-api-server/internal/models"
+    "ipset-api-server/pkg/validation"
+)
+
+// Диапазон адресов записи хранится как пара 16-байтовых значений (IPv4 -
+// в виде IPv4-mapped IPv6), чтобы адреса обоих семейств сравнивались
+// побайтно одним индексом. Так устроены колонки range_start/range_end
+// в MySQL и SQLite, в PostgreSQL и ClickHouse используются родные типы.
+
+// addrRangeValues - значения колонок range_start и range_end для записи,
+// NULL для записей без адреса
+func addrRangeValues(ip, cidr string) (interface{}, interface{}) {
+    first, last, ok := validation.EntryRange(ip, cidr)
+    if !ok {
+        return nil, nil
+    }
+    start, end := first.As16(), last.As16()
+    return start[:], end[:]
+}
+
+// lookupRangeArgs - границы префикса для сравнения с range_start/range_end
+func lookupRangeArgs(prefix netip.Prefix) ([]byte, []byte) {
+    first, last := validation.PrefixRange(prefix)
+    start, end := first.As16(), last.As16()
+    return start[:], end[:]
+}
+
+// overlaps сообщает, пересекается ли диапазон записи с префиксом. Адреса
+// разных семейств не пересекаются.
+func overlaps(record *models.IPSetRecord, prefix netip.Prefix) bool {
+    first, last, ok := validation.EntryRange(record.IP, record.CIDR)
+    if !ok || first.Is4() != prefix.Addr().Is4() {
+        return false
+    }
+    pFirst, pLast := validation.PrefixRange(prefix)
+    return first.Compare(pLast) <= 0 && pFirst.Compare(last) <= 0
+}
+
+// lookupInMemory - Lookup для хранилищ, которые держат записи в памяти.
+// Результат упорядочен по имени сета и ID, как в SQL-хранилищах.
+func lookupInMemory(records []*models.IPSetRecord, prefix netip.Prefix) []*models.IPSetRecord {
+    var matched []*models.IPSetRecord
+    for _, record := range records {
+        if overlaps(record, prefix) {
+            matched = append(matched, record)
+        }
+    }
+
+    sortLookupResult(matched)
+    return matched
+}
+
+func sortLookupResult(records []*models.IPSetRecord) {
+    sort.Slice(records, func(i, j int) bool {
+        if records[i].SetName != records[j].SetName {
+            return records[i].SetName < records[j].SetName
+        }
+        return records[i].ID < records[j].ID
+    })
+}
+
+// backfillAddrRanges заполняет range_start/range_end у существующих записей.
+// Используется миграциями MySQL и SQLite, где колонки вычисляются в Go.
+func backfillAddrRanges(ctx context.Context, tx *sql.Tx) error {
+    rows, err := tx.QueryContext(ctx, "SELECT id, ip, cidr FROM ipset_records")
+    if err != nil {
+        return fmt.Errorf("failed to read records: %v", err)
+    }
+
+    type entry struct {
+        id       int
+        ip, cidr string
+    }
+    var entries []entry
+    for rows.Next() {
+        var e entry
+        var cidr sql.NullString
+        if err := rows.Scan(&e.id, &e.ip, &cidr); err != nil {
+            rows.Close()
+            return fmt.Errorf("failed to scan record: %v", err)
+        }
+        e.cidr = cidr.String
+        entries = append(entries, e)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return fmt.Errorf("failed to read records: %v", err)
+    }
+
+    for _, e := range entries {
+        start, end := addrRangeValues(e.ip, e.cidr)
+        if start == nil {
+            continue
+        }
+        if _, err := tx.ExecContext(ctx,
+            "UPDATE ipset_records SET range_start = ?, range_end = ? WHERE id = ?",
+            start, end, e.id,
+        ); err != nil {
+            return fmt.Errorf("failed to update record %d: %v", e.id, err)
+        }
+    }
+
+    return nil
+}
@@ -0,0 +1,313 @@
+package storage
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "sort"
+    "strings"
+    "time"
+    "ipset-api-server/internal/models"
+)
+
+// Агенты хранятся в таблице agents (ключ - имя хоста), правила назначения
+// - в agent_assignments. Метки агента и селектор правила хранятся строкой
+// вида key=value через запятую, сеты правила - через запятую, состояние
+// сетов агента - JSON.
+
+const (
+    agentColumns      = `hostname, labels, sets, last_error, registered_at, last_seen_at`
+    assignmentColumns = `id, selector, sets, description, created_at, updated_at`
+)
+
+// joinLabels - метки строкой key=value через запятую, по возрастанию ключа
+func joinLabels(labels map[string]string) string {
+    pairs := make([]string, 0, len(labels))
+    for key, value := range labels {
+        pairs = append(pairs, key+"="+value)
+    }
+    sort.Strings(pairs)
+    return strings.Join(pairs, ",")
+}
+
+func splitLabels(value string) map[string]string {
+    labels := make(map[string]string)
+    if value == "" {
+        return labels
+    }
+    for _, pair := range strings.Split(value, ",") {
+        key, val, _ := strings.Cut(pair, "=")
+        labels[key] = val
+    }
+    return labels
+}
+
+func marshalAgentSets(sets []*models.AgentSetResult) (string, error) {
+    if sets == nil {
+        sets = []*models.AgentSetResult{}
+    }
+    data, err := json.Marshal(sets)
+    if err != nil {
+        return "", fmt.Errorf("failed to encode agent sets: %v", err)
+    }
+    return string(data), nil
+}
+
+func unmarshalAgentSets(value string) ([]*models.AgentSetResult, error) {
+    sets := []*models.AgentSetResult{}
+    if value == "" {
+        return sets, nil
+    }
+    if err := json.Unmarshal([]byte(value), &sets); err != nil {
+        return nil, fmt.Errorf("failed to decode agent sets: %v", err)
+    }
+    return sets, nil
+}
+
+func scanAgents(rows *sql.Rows) ([]*models.Agent, error) {
+    var agents []*models.Agent
+    for rows.Next() {
+        var agent models.Agent
+        var labels, sets string
+        var lastError sql.NullString
+        if err := rows.Scan(
+            &agent.Hostname, &labels, &sets, &lastError, &agent.RegisteredAt, &agent.LastSeenAt,
+        ); err != nil {
+            return nil, fmt.Errorf("failed to scan agent: %v", err)
+        }
+        var err error
+        if agent.Sets, err = unmarshalAgentSets(sets); err != nil {
+            return nil, err
+        }
+        agent.Labels = splitLabels(labels)
+        agent.LastError = lastError.String
+        agents = append(agents, &agent)
+    }
+
+    return agents, rows.Err()
+}
+
+func scanAssignments(rows *sql.Rows) ([]*models.AssignmentRule, error) {
+    var rules []*models.AssignmentRule
+    for rows.Next() {
+        var rule models.AssignmentRule
+        var selector, sets string
+        var description sql.NullString
+        if err := rows.Scan(
+            &rule.ID, &selector, &sets, &description, &rule.CreatedAt, &rule.UpdatedAt,
+        ); err != nil {
+            return nil, fmt.Errorf("failed to scan assignment: %v", err)
+        }
+        rule.Selector = splitLabels(selector)
+        rule.Sets = splitWebhookList(sets)
+        rule.Description = description.String
+        rules = append(rules, &rule)
+    }
+
+    return rules, rows.Err()
+}
+
+// SQLAgentStorage - агенты и правила назначения в SQL хранилищах. Как и у
+// подписок, запросы общие, отличается только диалект.
+type SQLAgentStorage struct {
+    db           *sql.DB
+    dialect      sqlDialect
+    queryTimeout time.Duration
+    // returning - ID нового правила возвращает INSERT ... RETURNING id
+    // (PostgreSQL), иначе LastInsertId
+    returning bool
+}
+
+func (s *SQLAgentStorage) query(query string) string {
+    return bindParams(s.dialect, query)
+}
+
+// SaveAgent заменяет строку агента целиком: UPDATE без изменений в MySQL
+// не находит строк, поэтому строка удаляется и вставляется заново
+func (s *SQLAgentStorage) SaveAgent(ctx context.Context, agent *models.Agent) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    sets, err := marshalAgentSets(agent.Sets)
+    if err != nil {
+        return err
+    }
+
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback()
+
+    if _, err := tx.ExecContext(ctx, s.query("DELETE FROM agents WHERE hostname = ?"), agent.Hostname); err != nil {
+        return fmt.Errorf("failed to save agent: %v", err)
+    }
+    if _, err := tx.ExecContext(ctx, s.query(`
+        INSERT INTO agents (`+agentColumns+`)
+        VALUES (?, ?, ?, ?, ?, ?)`),
+        agent.Hostname, joinLabels(agent.Labels), sets, agent.LastError,
+        agent.RegisteredAt.UTC(), agent.LastSeenAt.UTC(),
+    ); err != nil {
+        return fmt.Errorf("failed to save agent: %v", err)
+    }
+
+    if err := tx.Commit(); err != nil {
+        return fmt.Errorf("failed to commit transaction: %v", err)
+    }
+    return nil
+}
+
+func (s *SQLAgentStorage) GetAgent(ctx context.Context, hostname string) (*models.Agent, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    rows, err := s.db.QueryContext(ctx, s.query("SELECT "+agentColumns+" FROM agents WHERE hostname = ?"), hostname)
+    if err != nil {
+        return nil, fmt.Errorf("failed to get agent: %v", err)
+    }
+    defer rows.Close()
+
+    agents, err := scanAgents(rows)
+    if err != nil {
+        return nil, err
+    }
+    if len(agents) == 0 {
+        return nil, fmt.Errorf("agent %s not found", hostname)
+    }
+    return agents[0], nil
+}
+
+func (s *SQLAgentStorage) ListAgents(ctx context.Context) ([]*models.Agent, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    rows, err := s.db.QueryContext(ctx, "SELECT "+agentColumns+" FROM agents ORDER BY hostname")
+    if err != nil {
+        return nil, fmt.Errorf("failed to list agents: %v", err)
+    }
+    defer rows.Close()
+
+    return scanAgents(rows)
+}
+
+func (s *SQLAgentStorage) DeleteAgent(ctx context.Context, hostname string) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    result, err := s.db.ExecContext(ctx, s.query("DELETE FROM agents WHERE hostname = ?"), hostname)
+    if err != nil {
+        return fmt.Errorf("failed to delete agent: %v", err)
+    }
+
+    affected, err := result.RowsAffected()
+    if err != nil {
+        return fmt.Errorf("failed to get rows affected: %v", err)
+    }
+    if affected == 0 {
+        return fmt.Errorf("agent %s not found", hostname)
+    }
+    return nil
+}
+
+func (s *SQLAgentStorage) CreateAssignment(ctx context.Context, rule *models.AssignmentRule) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback()
+
+    rule.ID, err = insertID(ctx, tx, s.dialect, s.returning, `
+        INSERT INTO agent_assignments (selector, sets, description, created_at, updated_at)
+        VALUES (?, ?, ?, ?, ?)`,
+        joinLabels(rule.Selector), joinWebhookList(rule.Sets), rule.Description,
+        rule.CreatedAt.UTC(), rule.UpdatedAt.UTC(),
+    )
+    if err != nil {
+        return fmt.Errorf("failed to create assignment: %v", err)
+    }
+
+    if err := tx.Commit(); err != nil {
+        return fmt.Errorf("failed to commit transaction: %v", err)
+    }
+    return nil
+}
+
+func (s *SQLAgentStorage) GetAssignment(ctx context.Context, id int64) (*models.AssignmentRule, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    rows, err := s.db.QueryContext(ctx, s.query("SELECT "+assignmentColumns+" FROM agent_assignments WHERE id = ?"), id)
+    if err != nil {
+        return nil, fmt.Errorf("failed to get assignment: %v", err)
+    }
+    defer rows.Close()
+
+    rules, err := scanAssignments(rows)
+    if err != nil {
+        return nil, err
+    }
+    if len(rules) == 0 {
+        return nil, fmt.Errorf("assignment with id %d not found", id)
+    }
+    return rules[0], nil
+}
+
+func (s *SQLAgentStorage) ListAssignments(ctx context.Context) ([]*models.AssignmentRule, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    rows, err := s.db.QueryContext(ctx, "SELECT "+assignmentColumns+" FROM agent_assignments ORDER BY id")
+    if err != nil {
+        return nil, fmt.Errorf("failed to list assignments: %v", err)
+    }
+    defer rows.Close()
+
+    return scanAssignments(rows)
+}
+
+func (s *SQLAgentStorage) UpdateAssignment(ctx context.Context, rule *models.AssignmentRule) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    result, err := s.db.ExecContext(ctx, s.query(`
+        UPDATE agent_assignments
+        SET selector = ?, sets = ?, description = ?, updated_at = ?
+        WHERE id = ?`),
+        joinLabels(rule.Selector), joinWebhookList(rule.Sets), rule.Description, rule.UpdatedAt.UTC(), rule.ID,
+    )
+    if err != nil {
+        return fmt.Errorf("failed to update assignment: %v", err)
+    }
+
+    affected, err := result.RowsAffected()
+    if err != nil {
+        return fmt.Errorf("failed to get rows affected: %v", err)
+    }
+    if affected == 0 {
+        return fmt.Errorf("assignment with id %d not found", rule.ID)
+    }
+    return nil
+}
+
+func (s *SQLAgentStorage) DeleteAssignment(ctx context.Context, id int64) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    result, err := s.db.ExecContext(ctx, s.query("DELETE FROM agent_assignments WHERE id = ?"), id)
+    if err != nil {
+        return fmt.Errorf("failed to delete assignment: %v", err)
+    }
+
+    affected, err := result.RowsAffected()
+    if err != nil {
+        return fmt.Errorf("failed to get rows affected: %v", err)
+    }
+    if affected == 0 {
+        return fmt.Errorf("assignment with id %d not found", id)
+    }
+    return nil
+}
@@ -0,0 +1,167 @@
+package storage
+
+import (
+    "database/sql"
+    "fmt"
+    "sort"
+    "strconv"
+    "ipset-api-server/internal/models"
+)
+
+// NormalizeAuditQuery проверяет курсор и выставляет лимит по умолчанию
+func NormalizeAuditQuery(q *models.AuditQuery) error {
+    q.Limit = normalizeLimit(q.Limit)
+
+    _, err := auditCursorID(q.Cursor)
+    return err
+}
+
+// auditCursorID возвращает ID последнего события предыдущей страницы,
+// 0 - если курсора нет
+func auditCursorID(cursor string) (int64, error) {
+    c, err := decodeCursor(cursor)
+    if err != nil || c == nil {
+        return 0, err
+    }
+
+    id, err := strconv.ParseInt(c.Value, 10, 64)
+    if err != nil {
+        return 0, fmt.Errorf("invalid cursor")
+    }
+    return id, nil
+}
+
+// auditPage обрезает выборку, полученную с лимитом limit+1, и строит курсор
+// следующей страницы по ID последнего события
+func auditPage(events []*models.AuditEvent, q *models.AuditQuery) *models.AuditPage {
+    page := &models.AuditPage{Events: events}
+    if len(events) > q.Limit {
+        page.Events = events[:q.Limit]
+        last := page.Events[len(page.Events)-1]
+        page.NextCursor = encodeCursor(listCursor{Value: strconv.FormatInt(last.ID, 10)})
+    }
+    if page.Events == nil {
+        page.Events = []*models.AuditEvent{}
+    }
+    return page
+}
+
+// buildAuditListSQL строит условия, сортировку и лимит для выборки событий
+// аудита. События идут от новых к старым, курсор - ID последнего события.
+func buildAuditListSQL(q *models.AuditQuery, d sqlDialect) (string, []interface{}, error) {
+    if err := NormalizeAuditQuery(q); err != nil {
+        return "", nil, err
+    }
+
+    c := &sqlConditions{dialect: d}
+
+    if q.Actor != "" {
+        c.add("actor = %s", q.Actor)
+    }
+    if q.Action != "" {
+        c.add("action = %s", q.Action)
+    }
+    if q.SetName != "" {
+        c.add("set_name = %s", q.SetName)
+    }
+    if q.RecordID != 0 {
+        c.add("record_id = %s", q.RecordID)
+    }
+    if q.RequestID != "" {
+        c.add("request_id = %s", q.RequestID)
+    }
+    if !q.Since.IsZero() {
+        c.add("created_at >= %s", q.Since)
+    }
+    if !q.Until.IsZero() {
+        c.add("created_at < %s", q.Until)
+    }
+
+    if id, _ := auditCursorID(q.Cursor); id != 0 {
+        c.add("id < %s", id)
+    }
+
+    query := fmt.Sprintf("%s ORDER BY id DESC LIMIT %d", c.where(), q.Limit+1)
+    return query, c.args, nil
+}
+
+// auditJSON - значение колонки before_json/after_json, NULL если данных нет
+func auditJSON(data []byte) interface{} {
+    if len(data) == 0 {
+        return nil
+    }
+    return string(data)
+}
+
+// scanAuditEvents читает события из результата запроса с колонками
+// id, created_at, actor, request_id, action, set_name, record_id,
+// before_json, after_json
+func scanAuditEvents(rows *sql.Rows) ([]*models.AuditEvent, error) {
+    var events []*models.AuditEvent
+    for rows.Next() {
+        var event models.AuditEvent
+        var before, after sql.NullString
+        if err := rows.Scan(
+            &event.ID, &event.Timestamp, &event.Actor, &event.RequestID, &event.Action,
+            &event.SetName, &event.RecordID, &before, &after,
+        ); err != nil {
+            return nil, fmt.Errorf("failed to scan audit event: %v", err)
+        }
+        if before.String != "" {
+            event.Before = []byte(before.String)
+        }
+        if after.String != "" {
+            event.After = []byte(after.String)
+        }
+        events = append(events, &event)
+    }
+
+    return events, rows.Err()
+}
+
+// listAuditInMemory - выборка событий для хранилищ, которые читают журнал целиком
+func listAuditInMemory(events []*models.AuditEvent, q *models.AuditQuery) (*models.AuditPage, error) {
+    if err := NormalizeAuditQuery(q); err != nil {
+        return nil, err
+    }
+
+    cursorID, _ := auditCursorID(q.Cursor)
+
+    var matched []*models.AuditEvent
+    for _, event := range events {
+        if q.Actor != "" && event.Actor != q.Actor {
+            continue
+        }
+        if q.Action != "" && event.Action != q.Action {
+            continue
+        }
+        if q.SetName != "" && event.SetName != q.SetName {
+            continue
+        }
+        if q.RecordID != 0 && event.RecordID != q.RecordID {
+            continue
+        }
+        if q.RequestID != "" && event.RequestID != q.RequestID {
+            continue
+        }
+        if !q.Since.IsZero() && event.Timestamp.Before(q.Since) {
+            continue
+        }
+        if !q.Until.IsZero() && !event.Timestamp.Before(q.Until) {
+            continue
+        }
+        if cursorID != 0 && event.ID >= cursorID {
+            continue
+        }
+        matched = append(matched, event)
+    }
+
+    sort.Slice(matched, func(i, j int) bool {
+        return matched[i].ID > matched[j].ID
+    })
+
+    if len(matched) > q.Limit+1 {
+        matched = matched[:q.Limit+1]
+    }
+    return auditPage(matched, q), nil
+}
@@ -0,0 +1,102 @@
+package storage
+
+import (
+    "context"
+    "database/sql"
+    "fmt"
+    "time"
+    "ipset-api-server/internal/models"
+)
+
+// Операции пакета изменений записей (POST /records/bulk)
+const (
+    ChangeCreate = "create"
+    ChangeUpdate = "update"
+    ChangeDelete = "delete"
+)
+
+// RecordChange - одна операция пакета: create сохраняет Record с новым ID,
+// update перезаписывает запись ID содержимым Record, delete переносит
+// запись ID в корзину
+type RecordChange struct {
+    Op     string
+    ID     int
+    Record *models.IPSetRecord
+}
+
+// ChangeError - операция пакета с номером Index не выполнена. Err - ошибка
+// операции, в том числе *DuplicateError. Applied - число первых операций,
+// которые остались выполненными (не 0 только в хранилищах без транзакций).
+type ChangeError struct {
+    Index   int
+    Applied int
+    Err     error
+}
+
+func (e *ChangeError) Error() string {
+    return fmt.Sprintf("operation %d: %v", e.Index, e.Err)
+}
+
+func (e *ChangeError) Unwrap() error {
+    return e.Err
+}
+
+// applyChangesTx выполняет операции пакета в транзакции tx по порядку.
+// ensureSet заводит сет записи, если его нет, updateRecord и insert - как
+// в applySetChangesTx. Ошибка операции возвращается как *ChangeError.
+func applyChangesTx(ctx context.Context, tx *sql.Tx, d sqlDialect, changes []*RecordChange,
+    ensureSet, updateRecord, insert func(record *models.IPSetRecord) error) error {
+    now := time.Now().UTC()
+    for i, change := range changes {
+        if err := applyChangeTx(ctx, tx, d, change, now, ensureSet, updateRecord, insert); err != nil {
+            return &ChangeError{Index: i, Err: err}
+        }
+    }
+    return nil
+}
+
+func applyChangeTx(ctx context.Context, tx *sql.Tx, d sqlDialect, change *RecordChange, now time.Time,
+    ensureSet, updateRecord, insert func(record *models.IPSetRecord) error) error {
+    switch change.Op {
+    case ChangeDelete:
+        result, err := tx.ExecContext(ctx, fmt.Sprintf(
+            "UPDATE ipset_records SET deleted_at = %s WHERE id = %s AND deleted_at IS NULL",
+            d.placeholder(1), d.placeholder(2)), now, change.ID)
+        if err != nil {
+            return fmt.Errorf("failed to delete record: %v", err)
+        }
+        rowsAffected, err := result.RowsAffected()
+        if err != nil {
+            return fmt.Errorf("failed to get rows affected: %v", err)
+        }
+        if rowsAffected == 0 {
+            return fmt.Errorf("record with id %d not found", change.ID)
+        }
+        return nil
+
+    case ChangeCreate, ChangeUpdate:
+        record := change.Record
+        if change.Op == ChangeCreate {
+            record.CreatedAt = now
+        } else {
+            record.ID = change.ID
+        }
+        record.UpdatedAt = now
+
+        if err := ensureSet(record); err != nil {
+            return err
+        }
+        if err := lockSet(ctx, tx, d, record.SetName); err != nil {
+            return err
+        }
+        save := insert
+        if change.Op == ChangeUpdate {
+            save = updateRecord
+        }
+        if err := save(record); err != nil {
+            return err
+        }
+        return checkDuplicate(ctx, tx, d, record)
+    }
+    return fmt.Errorf("unknown operation %q", change.Op)
+}
@@ -0,0 +1,657 @@
+package storage
+
+import (
+    "context"
+    "fmt"
+    "net/netip"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+    "ipset-api-server/internal/models"
+)
+
+// CachedIPSetStorage - декоратор, который держит все записи в памяти с индексами
+// по ID, имени сета и IP/префиксу. Чтение обслуживается из памяти, запись
+// уходит в нижележащее хранилище и затем обновляет затронутые записи в кэше.
+// Если ttl больше нуля, кэш целиком перечитывается по его истечении, чтобы
+// подхватить изменения, сделанные другими экземплярами сервера.
+type CachedIPSetStorage struct {
+    backend IPSetStorage
+    ttl     time.Duration
+
+    mu       sync.RWMutex
+    loaded   bool
+    loadedAt time.Time
+    byID     map[int]*models.IPSetRecord
+    bySet    map[string]map[int]struct{}
+    byIP     map[string]map[int]struct{}
+
+    // sorted - кэш отсортированных ID, строится лениво при чтении
+    sortMu sync.Mutex
+    sorted []int
+}
+
+func NewCachedIPSetStorage(backend IPSetStorage, ttl time.Duration) *CachedIPSetStorage {
+    return &CachedIPSetStorage{
+        backend: backend,
+        ttl:     ttl,
+    }
+}
+
+// Invalidate сбрасывает кэш, следующее чтение загрузит данные заново
+func (s *CachedIPSetStorage) Invalidate() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.loaded = false
+}
+
+func (s *CachedIPSetStorage) isFresh() bool {
+    return s.loaded && (s.ttl <= 0 || time.Since(s.loadedAt) < s.ttl)
+}
+
+// ensureLoaded загружает данные из хранилища, если кэш пуст или устарел.
+// Возвращается с захваченной блокировкой на чтение.
+func (s *CachedIPSetStorage) ensureLoaded(ctx context.Context) error {
+    s.mu.RLock()
+    if s.isFresh() {
+        return nil
+    }
+    s.mu.RUnlock()
+
+    for {
+        // Пока ждали блокировку на запись, кэш мог загрузить другой запрос:
+        // хранилище читается один раз, остальные берут загруженное
+        s.mu.Lock()
+        if !s.isFresh() {
+            if err := s.reload(ctx); err != nil {
+                s.mu.Unlock()
+                return err
+            }
+        }
+        s.mu.Unlock()
+
+        // Между Unlock и RLock кэш могли сбросить (Invalidate) - тогда
+        // загружаем заново. Истекший за это время ttl не мешает: данные
+        // только что прочитаны.
+        s.mu.RLock()
+        if s.loaded {
+            return nil
+        }
+        s.mu.RUnlock()
+    }
+}
+
+// reload вызывается под s.mu
+func (s *CachedIPSetStorage) reload(ctx context.Context) error {
+    records, err := s.backend.GetAll(ctx)
+    if err != nil {
+        return fmt.Errorf("failed to load cache: %v", err)
+    }
+
+    s.byID = make(map[int]*models.IPSetRecord, len(records))
+    s.bySet = make(map[string]map[int]struct{})
+    s.byIP = make(map[string]map[int]struct{})
+    s.sorted = nil
+
+    for _, record := range records {
+        s.index(record)
+    }
+
+    s.loaded = true
+    s.loadedAt = time.Now()
+    return nil
+}
+
+// ipKeys возвращает ключи индекса по адресу: сам IP и IP/префикс
+func ipKeys(record *models.IPSetRecord) []string {
+    keys := []string{strings.ToLower(record.IP)}
+    if record.CIDR != "" {
+        keys = append(keys, strings.ToLower(record.IP+"/"+record.CIDR))
+    }
+    return keys
+}
+
+// index и unindex вызываются под s.mu
+func (s *CachedIPSetStorage) index(record *models.IPSetRecord) {
+    copied := *record
+    s.byID[copied.ID] = &copied
+
+    if s.bySet[copied.SetName] == nil {
+        s.bySet[copied.SetName] = make(map[int]struct{})
+    }
+    s.bySet[copied.SetName][copied.ID] = struct{}{}
+
+    for _, key := range ipKeys(&copied) {
+        if s.byIP[key] == nil {
+            s.byIP[key] = make(map[int]struct{})
+        }
+        s.byIP[key][copied.ID] = struct{}{}
+    }
+
+    s.sorted = nil
+}
+
+func (s *CachedIPSetStorage) unindex(id int) {
+    record, exists := s.byID[id]
+    if !exists {
+        return
+    }
+
+    delete(s.byID, id)
+
+    if ids := s.bySet[record.SetName]; ids != nil {
+        delete(ids, id)
+        if len(ids) == 0 {
+            delete(s.bySet, record.SetName)
+        }
+    }
+
+    for _, key := range ipKeys(record) {
+        if ids := s.byIP[key]; ids != nil {
+            delete(ids, id)
+            if len(ids) == 0 {
+                delete(s.byIP, key)
+            }
+        }
+    }
+
+    s.sorted = nil
+}
+
+// refresh перечитывает одну запись из хранилища после изменения.
+// При ошибке кэш сбрасывается целиком. Вызывается под s.mu.
+func (s *CachedIPSetStorage) refresh(ctx context.Context, id int) {
+    if !s.loaded {
+        return
+    }
+
+    s.unindex(id)
+    record, err := s.backend.GetByID(ctx, id)
+    if err != nil {
+        s.loaded = false
+        return
+    }
+    s.index(record)
+}
+
+// sortedIDs возвращает ID всех записей по возрастанию. Вызывается под
+// блокировкой на чтение, сам срез защищен отдельным мьютексом, а пишущие
+// операции сбрасывают его под эксклюзивной блокировкой.
+func (s *CachedIPSetStorage) sortedIDs() []int {
+    s.sortMu.Lock()
+    defer s.sortMu.Unlock()
+
+    if s.sorted == nil {
+        ids := make([]int, 0, len(s.byID))
+        for id := range s.byID {
+            ids = append(ids, id)
+        }
+        sort.Ints(ids)
+        s.sorted = ids
+    }
+    return s.sorted
+}
+
+// Истекшие записи остаются в кэше до DeleteExpired, но чтения их пропускают
+func (s *CachedIPSetStorage) collect(ids map[int]struct{}) []*models.IPSetRecord {
+    list := make([]int, 0, len(ids))
+    for id := range ids {
+        list = append(list, id)
+    }
+    sort.Ints(list)
+
+    now := time.Now()
+    result := make([]*models.IPSetRecord, 0, len(list))
+    for _, id := range list {
+        if isExpired(s.byID[id], now) {
+            continue
+        }
+        copied := *s.byID[id]
+        result = append(result, &copied)
+    }
+    return result
+}
+
+func (s *CachedIPSetStorage) Create(ctx context.Context, record *models.IPSetRecord) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if err := s.backend.Create(ctx, record); err != nil {
+        return err
+    }
+
+    if s.loaded {
+        s.index(record)
+    }
+    return nil
+}
+
+func (s *CachedIPSetStorage) ImportRecord(ctx context.Context, record *models.IPSetRecord) error {
+    importer, ok := s.backend.(RecordImporter)
+    if !ok {
+        return fmt.Errorf("storage does not support importing records")
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if err := importer.ImportRecord(ctx, record); err != nil {
+        return err
+    }
+
+    if s.loaded {
+        s.unindex(record.ID)
+        s.index(record)
+    }
+    return nil
+}
+
+func (s *CachedIPSetStorage) GetByID(ctx context.Context, id int) (*models.IPSetRecord, error) {
+    if err := s.ensureLoaded(ctx); err != nil {
+        return nil, err
+    }
+    defer s.mu.RUnlock()
+
+    record, exists := s.byID[id]
+    if !exists || isExpired(record, time.Now()) {
+        return nil, fmt.Errorf("record with id %d not found", id)
+    }
+
+    copied := *record
+    return &copied, nil
+}
+
+func (s *CachedIPSetStorage) GetAll(ctx context.Context) ([]*models.IPSetRecord, error) {
+    if err := s.ensureLoaded(ctx); err != nil {
+        return nil, err
+    }
+    defer s.mu.RUnlock()
+
+    ids := s.sortedIDs()
+    now := time.Now()
+    result := make([]*models.IPSetRecord, 0, len(ids))
+    for _, id := range ids {
+        if isExpired(s.byID[id], now) {
+            continue
+        }
+        copied := *s.byID[id]
+        result = append(result, &copied)
+    }
+
+    return result, nil
+}
+
+func (s *CachedIPSetStorage) GetBySetName(ctx context.Context, setName string) ([]*models.IPSetRecord, error) {
+    if err := s.ensureLoaded(ctx); err != nil {
+        return nil, err
+    }
+    defer s.mu.RUnlock()
+
+    records := s.collect(s.bySet[setName])
+    if len(records) == 0 {
+        return nil, fmt.Errorf("set %s not found", setName)
+    }
+
+    return records, nil
+}
+
+// Сеты в кэше не хранятся: число записей считает нижележащее хранилище
+func (s *CachedIPSetStorage) GetAllSets(ctx context.Context) ([]*models.IPSetSet, error) {
+    return s.backend.GetAllSets(ctx)
+}
+
+func (s *CachedIPSetStorage) GetSet(ctx context.Context, name string) (*models.IPSetSet, error) {
+    return s.backend.GetSet(ctx, name)
+}
+
+func (s *CachedIPSetStorage) CreateSet(ctx context.Context, set *models.IPSetSet) error {
+    return s.backend.CreateSet(ctx, set)
+}
+
+func (s *CachedIPSetStorage) UpdateSet(ctx context.Context, set *models.IPSetSet) error {
+    return s.backend.UpdateSet(ctx, set)
+}
+
+func (s *CachedIPSetStorage) ImportSet(ctx context.Context, set *models.IPSetSet) error {
+    importer, ok := s.backend.(RecordImporter)
+    if !ok {
+        return fmt.Errorf("storage does not support importing records")
+    }
+    return importer.ImportSet(ctx, set)
+}
+
+func (s *CachedIPSetStorage) ApplySetChanges(ctx context.Context, setName string, revision int64, set *models.IPSetSet, remove []int, update, add []*models.IPSetRecord) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if err := s.backend.ApplySetChanges(ctx, setName, revision, set, remove, update, add); err != nil {
+        return err
+    }
+
+    if s.loaded {
+        for _, id := range remove {
+            s.unindex(id)
+        }
+        for _, record := range update {
+            s.refresh(ctx, record.ID)
+        }
+        for _, record := range add {
+            s.index(record)
+        }
+    }
+    return nil
+}
+
+func (s *CachedIPSetStorage) ApplyChanges(ctx context.Context, changes []*RecordChange) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if err := s.backend.ApplyChanges(ctx, changes); err != nil {
+        // ClickHouse оставляет выполненными операции до ошибочной, поэтому
+        // кэш загружается заново
+        s.loaded = false
+        return err
+    }
+
+    if s.loaded {
+        for _, change := range changes {
+            switch change.Op {
+            case ChangeCreate:
+                s.index(change.Record)
+            case ChangeUpdate:
+                s.refresh(ctx, change.ID)
+            case ChangeDelete:
+                s.unindex(change.ID)
+            }
+        }
+    }
+    return nil
+}
+
+// RenameSet и SwapSets перечитывают записи затронутых сетов: имя сета
+// у них меняет хранилище
+func (s *CachedIPSetStorage) RenameSet(ctx context.Context, from, to string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if err := s.backend.RenameSet(ctx, from, to); err != nil {
+        return err
+    }
+
+    s.refreshSets(ctx, from)
+    return nil
+}
+
+func (s *CachedIPSetStorage) CopySet(ctx context.Context, from, to string) ([]*models.IPSetRecord, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    records, err := s.backend.CopySet(ctx, from, to)
+    if err != nil {
+        return nil, err
+    }
+
+    if s.loaded {
+        for _, record := range records {
+            s.index(record)
+        }
+    }
+    return records, nil
+}
+
+func (s *CachedIPSetStorage) SwapSets(ctx context.Context, a, b string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if err := s.backend.SwapSets(ctx, a, b); err != nil {
+        return err
+    }
+
+    s.refreshSets(ctx, a, b)
+    return nil
+}
+
+// refreshSets перечитывает записи, которые были в сетах setNames.
+// Вызывается под s.mu.
+func (s *CachedIPSetStorage) refreshSets(ctx context.Context, setNames ...string) {
+    if !s.loaded {
+        return
+    }
+
+    var ids []int
+    for _, setName := range setNames {
+        for id := range s.bySet[setName] {
+            ids = append(ids, id)
+        }
+    }
+    for _, id := range ids {
+        s.refresh(ctx, id)
+    }
+}
+
+func (s *CachedIPSetStorage) Update(ctx context.Context, id int, record *models.IPSetRecord) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if err := s.backend.Update(ctx, id, record); err != nil {
+        return err
+    }
+
+    // Часть полей (например, updated_at) хранилище выставляет само
+    s.refresh(ctx, id)
+    return nil
+}
+
+func (s *CachedIPSetStorage) Delete(ctx context.Context, id int) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if err := s.backend.Delete(ctx, id); err != nil {
+        return err
+    }
+
+    if s.loaded {
+        s.unindex(id)
+    }
+    return nil
+}
+
+func (s *CachedIPSetStorage) DeleteSet(ctx context.Context, setName string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if err := s.backend.DeleteSet(ctx, setName); err != nil {
+        return err
+    }
+
+    if s.loaded {
+        for id := range s.bySet[setName] {
+            s.unindex(id)
+        }
+    }
+    return nil
+}
+
+// Search ищет подстроку в контексте, описании, IP и имени сета. Точные
+// совпадения по имени сета и IP/префиксу берутся из индексов и идут первыми.
+func (s *CachedIPSetStorage) Search(ctx context.Context, query string) ([]*models.IPSetRecord, error) {
+    if err := s.ensureLoaded(ctx); err != nil {
+        return nil, err
+    }
+    defer s.mu.RUnlock()
+
+    lower := strings.ToLower(query)
+    seen := make(map[int]struct{})
+    var result []*models.IPSetRecord
+
+    appendIDs := func(ids map[int]struct{}) {
+        for _, record := range s.collect(ids) {
+            if _, ok := seen[record.ID]; !ok {
+                seen[record.ID] = struct{}{}
+                result = append(result, record)
+            }
+        }
+    }
+
+    appendIDs(s.bySet[query])
+    appendIDs(s.byIP[lower])
+
+    now := time.Now()
+    for _, id := range s.sortedIDs() {
+        if _, ok := seen[id]; ok {
+            continue
+        }
+        record := s.byID[id]
+        if isExpired(record, now) {
+            continue
+        }
+        if strings.Contains(strings.ToLower(record.Context), lower) ||
+           strings.Contains(strings.ToLower(record.Description), lower) ||
+           strings.Contains(strings.ToLower(record.IP), lower) ||
+           strings.Contains(strings.ToLower(record.SetName), lower) {
+            copied := *record
+            result = append(result, &copied)
+        }
+    }
+
+    return result, nil
+}
+
+func (s *CachedIPSetStorage) Lookup(ctx context.Context, prefix netip.Prefix) ([]*models.IPSetRecord, error) {
+    if err := s.ensureLoaded(ctx); err != nil {
+        return nil, err
+    }
+    defer s.mu.RUnlock()
+    
+    now := time.Now()
+    records := make([]*models.IPSetRecord, 0, len(s.byID))
+    for _, record := range s.byID {
+        if !isExpired(record, now) {
+            records = append(records, record)
+        }
+    }
+    
+    result := lookupInMemory(records, prefix)
+    for i, record := range result {
+        copied := *record
+        result[i] = &copied
+    }
+    return result, nil
+}
+
+func (s *CachedIPSetStorage) List(ctx context.Context, q *models.RecordQuery) (*models.RecordPage, error) {
+    if err := s.ensureLoaded(ctx); err != nil {
+        return nil, err
+    }
+    defer s.mu.RUnlock()
+    
+    // Индекс по сету сужает выборку, остальные фильтры проверяются по записям
+    var ids []int
+    if q.SetName != "" {
+        for id := range s.bySet[q.SetName] {
+            ids = append(ids, id)
+        }
+    } else {
+        ids = s.sortedIDs()
+    }
+    
+    now := time.Now()
+    records := make([]*models.IPSetRecord, 0, len(ids))
+    for _, id := range ids {
+        if !isExpired(s.byID[id], now) {
+            records = append(records, s.byID[id])
+        }
+    }
+    
+    page, err := listRecordsInMemory(records, q)
+    if err != nil {
+        return nil, err
+    }
+    
+    for i, record := range page.Records {
+        copied := *record
+        page.Records[i] = &copied
+    }
+    return page, nil
+}
+
+func (s *CachedIPSetStorage) ListSets(ctx context.Context, q *models.SetQuery) (*models.SetPage, error) {
+    return s.backend.ListSets(ctx, q)
+}
+
+// История в кэше не хранится и читается из нижележащего хранилища
+func (s *CachedIPSetStorage) History(ctx context.Context, id int) ([]*models.RecordRevision, error) {
+    return s.backend.History(ctx, id)
+}
+
+func (s *CachedIPSetStorage) GetBySetNameAt(ctx context.Context, setName string, at time.Time) ([]*models.IPSetRecord, error) {
+    return s.backend.GetBySetNameAt(ctx, setName, at)
+}
+
+func (s *CachedIPSetStorage) Revision(ctx context.Context) (int64, error) {
+    return s.backend.Revision(ctx)
+}
+
+func (s *CachedIPSetStorage) Changes(ctx context.Context, since int64, limit int) ([]*models.ChangeEvent, error) {
+    return s.backend.Changes(ctx, since, limit)
+}
+
+// Корзина в кэше не хранится: в кэше только действующие записи
+func (s *CachedIPSetStorage) ListTrash(ctx context.Context, q *models.RecordQuery) (*models.RecordPage, error) {
+    return s.backend.ListTrash(ctx, q)
+}
+
+func (s *CachedIPSetStorage) Undelete(ctx context.Context, id int) (*models.IPSetRecord, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    record, err := s.backend.Undelete(ctx, id)
+    if err != nil {
+        return nil, err
+    }
+
+    if s.loaded {
+        s.index(record)
+    }
+    return record, nil
+}
+
+func (s *CachedIPSetStorage) UndeleteSet(ctx context.Context, setName string) ([]*models.IPSetRecord, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    records, err := s.backend.UndeleteSet(ctx, setName)
+    if err != nil {
+        return nil, err
+    }
+
+    if s.loaded {
+        for _, record := range records {
+            s.index(record)
+        }
+    }
+    return records, nil
+}
+
+func (s *CachedIPSetStorage) PurgeTrash(ctx context.Context, before time.Time) (int, error) {
+    return s.backend.PurgeTrash(ctx, before)
+}
+
+func (s *CachedIPSetStorage) DeleteExpired(ctx context.Context, at time.Time) ([]*models.IPSetRecord, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    records, err := s.backend.DeleteExpired(ctx, at)
+    if err != nil {
+        return nil, err
+    }
+
+    if s.loaded {
+        for _, record := range records {
+            s.unindex(record.ID)
+        }
+    }
+    return records, nil
+}
@@ -0,0 +1,69 @@
+package storage
+
+import (
+    "context"
+    "path/filepath"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+    "ipset-api-server/internal/models"
+)
+
+// countingStorage считает чтения всех записей, которыми кэш загружается
+type countingStorage struct {
+    *FileIPSetStorage
+    loads atomic.Int32
+}
+
+func (s *countingStorage) GetAll(ctx context.Context) ([]*models.IPSetRecord, error) {
+    s.loads.Add(1)
+    // Пока идет загрузка, остальные запросы успевают встать в очередь
+    time.Sleep(20 * time.Millisecond)
+    return s.FileIPSetStorage.GetAll(ctx)
+}
+
+func TestCachedStorageLoadsOnce(t *testing.T) {
+    file, err := NewFileIPSetStorage(filepath.Join(t.TempDir(), "records.json"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer file.Close()
+    ctx := context.Background()
+    record := &models.IPSetRecord{SetName: "blacklist", IP: "10.0.0.1", Context: "test"}
+    if err := file.Create(ctx, record); err != nil {
+        t.Fatal(err)
+    }
+
+    backend := &countingStorage{FileIPSetStorage: file}
+    cached := NewCachedIPSetStorage(backend, 0)
+
+    var wg sync.WaitGroup
+    errs := make(chan error, 20)
+    for i := 0; i < 20; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            if _, err := cached.GetByID(ctx, record.ID); err != nil {
+                errs <- err
+            }
+        }()
+    }
+    wg.Wait()
+    close(errs)
+    for err := range errs {
+        t.Fatal(err)
+    }
+    if loads := backend.loads.Load(); loads != 1 {
+        t.Fatalf("cache loaded %d times, want 1", loads)
+    }
+
+    // После сброса кэш загружается заново
+    cached.Invalidate()
+    if _, err := cached.GetByID(ctx, record.ID); err != nil {
+        t.Fatal(err)
+    }
+    if loads := backend.loads.Load(); loads != 2 {
+        t.Fatalf("cache loaded %d times after Invalidate, want 2", loads)
+    }
+}
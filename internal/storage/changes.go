@@ -0,0 +1,221 @@
+package storage
+
+import (
+    "database/sql"
+    "fmt"
+    "strings"
+    "ipset-api-server/internal/models"
+)
+
+// Поток изменений (GET /watch) хранится в таблице ipset_changes: строка на
+// каждое изменение действующей записи или сета с номером revision, общим
+// для всего хранилища, и состоянием после изменения. Как и историю, таблицу
+// заполняет сама база. В SQL хранилищах номер выдает счетчик ipset_revision:
+// триггер увеличивает его в той же транзакции, строка счетчика остается
+// заблокированной до фиксации, поэтому изменения фиксируются в порядке
+// номеров и читатель не пропустит изменение с меньшим номером. В ClickHouse
+// номер - время вставки в наносекундах (см. clickHouseChangesSelect).
+// Файловое хранилище дописывает изменения в журнал рядом с файлом записей
+// и хранит только последние fileChangesLimit из них.
+//
+// Для потока перенос в корзину - удаление записи, возврат из корзины -
+// создание, а изменения записей в корзине и окончательное удаление из нее
+// не пишутся. Переименованный сет - удаление сета со старым именем и
+// создание с новым.
+
+// ChangesExpiredError - изменения после since уже удалены из потока,
+// первое сохраненное - Oldest. Потребитель должен заново прочитать сеты
+// целиком и продолжить с текущей ревизии.
+type ChangesExpiredError struct {
+    Since  int64
+    Oldest int64
+}
+
+func (e *ChangesExpiredError) Error() string {
+    return fmt.Sprintf("changes after revision %d expired, oldest kept is %d", e.Since, e.Oldest)
+}
+
+// recordChangeColumns и setChangeColumns - колонки состояния записи и сета
+// в ipset_changes, порядок совпадает с recordChangeValues и setChangeValues
+const (
+    recordChangeColumns = `set_name, record_id, ip, cidr, port, protocol, second_ip, description, context,
+         set_type, set_options, created_at, updated_at, expires_at, active_from, schedule`
+    setChangeColumns = `set_name, record_id, description, set_type, set_options, family, owner, created_at, updated_at`
+)
+
+func recordChangeValues(row string) string {
+    return fmt.Sprintf(`%[1]s.set_name, %[1]s.id, %[1]s.ip, %[1]s.cidr, %[1]s.port, %[1]s.protocol, %[1]s.second_ip,
+               %[1]s.description, %[1]s.context, %[1]s.set_type, %[1]s.set_options,
+               %[1]s.created_at, %[1]s.updated_at, %[1]s.expires_at, %[1]s.active_from, %[1]s.schedule`, row)
+}
+
+func setChangeValues(row string) string {
+    return fmt.Sprintf(`%[1]s.name, 0, %[1]s.description, %[1]s.type, %[1]s.options, %[1]s.family, %[1]s.owner,
+               %[1]s.created_at, %[1]s.updated_at`, row)
+}
+
+// changeInsertSQL - запись изменения в триггерах SQL хранилищ: счетчик
+// увеличивается, и изменение пишется с новым номером. row - строка таблицы
+// (NEW или OLD), operation и now - SQL-выражения, cond - условие, при
+// котором изменение пишется (пустое - всегда). Два оператора через ";".
+func changeInsertSQL(kind, row, operation, cond, now string) string {
+    columns, values := recordChangeColumns, recordChangeValues(row)
+    if kind == models.ChangeKindSet {
+        columns, values = setChangeColumns, setChangeValues(row)
+    }
+    where := ""
+    if cond != "" {
+        where = " WHERE " + cond
+    }
+
+    return fmt.Sprintf(`UPDATE ipset_revision SET revision = revision + 1%[1]s;
+        INSERT INTO ipset_changes (revision, changed_at, kind, operation, %[2]s)
+        SELECT revision, %[3]s, '%[4]s', %[5]s,
+               %[6]s
+        FROM ipset_revision%[1]s`, where, columns, now, kind, operation, values)
+}
+
+// recordChangesSQL - изменения записи для триггера на событие event
+// (INSERT, UPDATE или DELETE)
+func recordChangesSQL(event, now string) string {
+    switch event {
+    case "INSERT":
+        return changeInsertSQL(models.ChangeKindRecord, "NEW", "'create'", "NEW.deleted_at IS NULL", now)
+    case "UPDATE":
+        return changeInsertSQL(models.ChangeKindRecord, "NEW",
+            "CASE WHEN NEW.deleted_at IS NOT NULL THEN 'delete' WHEN OLD.deleted_at IS NOT NULL THEN 'create' ELSE 'update' END",
+            "(OLD.deleted_at IS NULL OR NEW.deleted_at IS NULL)", now)
+    default:
+        return changeInsertSQL(models.ChangeKindRecord, "OLD", "'delete'", "OLD.deleted_at IS NULL", now)
+    }
+}
+
+// setChangesSQL - изменения сета для триггера на событие event
+func setChangesSQL(event, now string) string {
+    switch event {
+    case "INSERT":
+        return changeInsertSQL(models.ChangeKindSet, "NEW", "'create'", "", now)
+    case "UPDATE":
+        return strings.Join([]string{
+            changeInsertSQL(models.ChangeKindSet, "OLD", "'delete'", "OLD.name <> NEW.name", now),
+            changeInsertSQL(models.ChangeKindSet, "NEW", "'create'", "OLD.name <> NEW.name", now),
+            changeInsertSQL(models.ChangeKindSet, "NEW", "'update'", "OLD.name = NEW.name", now),
+        }, ";\n")
+    default:
+        return changeInsertSQL(models.ChangeKindSet, "OLD", "'delete'", "", now)
+    }
+}
+
+// changesBackfillSQL - изменения, с которых начинается поток: создание
+// существующих сетов и действующих записей, чтобы поток с начала давал
+// текущее состояние. Последний оператор выставляет счетчик.
+var changesBackfillSQL = []string{
+    // Миграции MySQL не откатываются, поэтому повтор начинается с чистого листа
+    `DELETE FROM ipset_changes`,
+    `DELETE FROM ipset_revision`,
+    `INSERT INTO ipset_changes (revision, changed_at, kind, operation, ` + setChangeColumns + `)
+    SELECT ROW_NUMBER() OVER (ORDER BY s.name), s.updated_at, 'set', 'create',
+           ` + setChangeValues("s") + `
+    FROM ipset_sets s`,
+    `INSERT INTO ipset_changes (revision, changed_at, kind, operation, ` + recordChangeColumns + `)
+    SELECT (SELECT COUNT(*) FROM ipset_sets) + ROW_NUMBER() OVER (ORDER BY r.id),
+           COALESCE(r.updated_at, r.created_at, CURRENT_TIMESTAMP), 'record', 'create',
+           ` + recordChangeValues("r") + `
+    FROM ipset_records r
+    WHERE r.deleted_at IS NULL`,
+    `INSERT INTO ipset_revision (revision) SELECT COALESCE(MAX(revision), 0) FROM ipset_changes`,
+}
+
+// changesSQL - изменения с номером больше since по возрастанию номера.
+// Параметры: since, limit.
+func changesSQL(d sqlDialect) string {
+    return fmt.Sprintf(`
+        SELECT revision, changed_at, kind, operation, set_name, record_id,
+               ip, cidr, port, protocol, second_ip, description, context, set_type, set_options,
+               family, owner, created_at, updated_at, expires_at, active_from, schedule
+        FROM ipset_changes
+        WHERE revision > %s
+        ORDER BY revision
+        LIMIT %s
+    `, d.placeholder(1), d.placeholder(2))
+}
+
+// revisionSQL - номер последнего изменения
+const revisionSQL = "SELECT revision FROM ipset_revision"
+
+// scanChanges читает результат changesSQL
+func scanChanges(rows *sql.Rows) ([]*models.ChangeEvent, error) {
+    var changes []*models.ChangeEvent
+    for rows.Next() {
+        var change models.ChangeEvent
+        var record models.IPSetRecord
+        var ip, cidr, protocol, secondIP, description, context, setType, setOptions, family, owner, schedule sql.NullString
+        var port sql.NullInt64
+        var createdAt, updatedAt sql.NullTime
+        if err := rows.Scan(
+            &change.Revision, &change.ChangedAt, &change.Kind, &change.Operation, &change.SetName, &change.RecordID,
+            &ip, &cidr, &port, &protocol, &secondIP, &description, &context, &setType, &setOptions,
+            &family, &owner, &createdAt, &updatedAt, &record.ExpiresAt, &record.ActiveFrom, &schedule,
+        ); err != nil {
+            return nil, fmt.Errorf("failed to scan change: %v", err)
+        }
+
+        if change.Kind == models.ChangeKindSet {
+            change.Set = &models.IPSetSet{
+                Name:        change.SetName,
+                Type:        setType.String,
+                Options:     setOptions.String,
+                Family:      family.String,
+                Description: description.String,
+                Owner:       owner.String,
+                CreatedAt:   createdAt.Time,
+                UpdatedAt:   updatedAt.Time,
+            }
+        } else {
+            record.ID = change.RecordID
+            record.SetName = change.SetName
+            record.IP = ip.String
+            record.CIDR = cidr.String
+            record.Port = int(port.Int64)
+            record.Protocol = protocol.String
+            record.SecondIP = secondIP.String
+            record.Description = description.String
+            record.Context = context.String
+            record.SetType = setType.String
+            record.SetOptions = setOptions.String
+            record.CreatedAt = createdAt.Time
+            record.UpdatedAt = updatedAt.Time
+            record.Schedule = schedule.String
+            change.Record = &record
+        }
+        changes = append(changes, &change)
+    }
+
+    return changes, rows.Err()
+}
+
+// changeOfRecord и changeOfSet - изменения для хранилищ, которые пишут
+// поток сами (файловое хранилище)
+func changeOfRecord(operation string, record *models.IPSetRecord) *models.ChangeEvent {
+    copied := *record
+    copied.DeletedAt = nil
+    return &models.ChangeEvent{
+        Kind:      models.ChangeKindRecord,
+        Operation: operation,
+        SetName:   record.SetName,
+        RecordID:  record.ID,
+        Record:    &copied,
+    }
+}
+
+func changeOfSet(operation string, set *models.IPSetSet) *models.ChangeEvent {
+    copied := *set
+    copied.Records = nil
+    copied.RecordCount = 0
+    return &models.ChangeEvent{
+        Kind:      models.ChangeKindSet,
+        Operation: operation,
+        SetName:   set.Name,
+        Set:       &copied,
+    }
+}
@@ -3,20 +3,412 @@ package storage
 import (
     "context"
     "fmt"
+    "net/netip"
+    "sync"
     "time"
     "ipset-api-server/internal/config"
     "ipset-api-server/internal/models"
+    "ipset-api-server/pkg/validation"
     
     "github.com/ClickHouse/clickhouse-go/v2"
     "github.com/ClickHouse/clickhouse-go/v2/lib/driver"
 )
 
-// ClickHouseKeyStorage - реализация для хранения ключей в ClickHouse
-type ClickHouseKeyStorage struct {
-    conn driver.Conn
+// clickHouseMigrations - миграции схемы ClickHouse. Транзакций нет, поэтому
+// каждая миграция должна безопасно выполняться повторно.
+var clickHouseMigrations = []Migration{
+    {
+        Version:     1,
+        Description: "create auth_keys and ipset_records",
+        Statements: []string{
+            `CREATE TABLE IF NOT EXISTS auth_keys (
+                key String,
+                created_at DateTime,
+                expires_at DateTime,
+                is_active UInt8,
+                updated_at DateTime DEFAULT now()
+            ) ENGINE = MergeTree()
+            ORDER BY (key, created_at)
+            SETTINGS index_granularity = 8192`,
+            `CREATE TABLE IF NOT EXISTS ipset_records (
+                id UInt32,
+                set_name String,
+                ip String,
+                cidr String,
+                port UInt16,
+                protocol String,
+                description String,
+                context String,
+                set_type String,
+                set_options String,
+                created_at DateTime,
+                updated_at DateTime,
+                is_deleted UInt8 DEFAULT 0,
+                version UInt32
+            ) ENGINE = ReplacingMergeTree(version)
+            ORDER BY (id, updated_at)
+            SETTINGS index_granularity = 8192`,
+        },
+    },
+    {
+        Version:     2,
+        Description: "add second_ip to ipset_records",
+        Statements: []string{
+            // Третий компонент записей hash:ip,port,ip и hash:ip,port,net
+            `ALTER TABLE ipset_records ADD COLUMN IF NOT EXISTS second_ip String DEFAULT '' AFTER protocol`,
+        },
+    },
+    {
+        Version:     3,
+        Description: "add address range columns to ipset_records",
+        Statements: []string{
+            // Первый и последний адрес записи для Lookup. IPv4 хранится как
+            // IPv4-mapped IPv6 (::ffff:a.b.c.d), поэтому длина префикса IPv4
+            // увеличивается на 96. CIDR "0" в старых записях означает
+            // одиночный адрес. Для MAC, имени сета и пустого ip addr_valid = 0.
+            `ALTER TABLE ipset_records
+                ADD COLUMN IF NOT EXISTS addr_valid UInt8
+                    MATERIALIZED isIPv4String(ip) OR isIPv6String(ip),
+                ADD COLUMN IF NOT EXISTS range_start IPv6
+                    MATERIALIZED tupleElement(IPv6CIDRToRange(toIPv6OrDefault(ip),
+                        toUInt8(if(isIPv6String(ip),
+                            if(cidr IN ('', '0'), 128, toUInt8OrZero(cidr)),
+                            96 + if(cidr IN ('', '0'), 32, toUInt8OrZero(cidr))))), 1),
+                ADD COLUMN IF NOT EXISTS range_end IPv6
+                    MATERIALIZED tupleElement(IPv6CIDRToRange(toIPv6OrDefault(ip),
+                        toUInt8(if(isIPv6String(ip),
+                            if(cidr IN ('', '0'), 128, toUInt8OrZero(cidr)),
+                            96 + if(cidr IN ('', '0'), 32, toUInt8OrZero(cidr))))), 2)`,
+            // Заполняем колонки для уже существующих строк
+            `ALTER TABLE ipset_records MATERIALIZE COLUMN addr_valid`,
+            `ALTER TABLE ipset_records MATERIALIZE COLUMN range_start`,
+            `ALTER TABLE ipset_records MATERIALIZE COLUMN range_end`,
+        },
+    },
+    {
+        Version:     4,
+        Description: "create audit_log",
+        Statements: []string{
+            `CREATE TABLE IF NOT EXISTS audit_log (
+                id UInt64,
+                created_at DateTime64(6),
+                actor String,
+                request_id String,
+                action LowCardinality(String),
+                set_name String,
+                record_id UInt32,
+                before_json String,
+                after_json String
+            ) ENGINE = MergeTree()
+            ORDER BY id
+            SETTINGS index_granularity = 8192`,
+        },
+    },
+    {
+        Version:     5,
+        Description: "create ipset_record_history",
+        Statements: []string{
+            // Версионные строки ipset_records схлопываются при слиянии,
+            // поэтому каждая вставленная строка копируется в историю
+            `CREATE TABLE IF NOT EXISTS ipset_record_history (
+                record_id UInt32,
+                revision UInt32,
+                operation LowCardinality(String),
+                changed_at DateTime,
+                set_name String,
+                ip String,
+                cidr String,
+                port UInt16,
+                protocol String,
+                description String,
+                context String,
+                set_type String,
+                set_options String,
+                second_ip String,
+                created_at DateTime,
+                updated_at DateTime
+            ) ENGINE = MergeTree()
+            ORDER BY (record_id, revision)
+            SETTINGS index_granularity = 8192`,
+            `CREATE MATERIALIZED VIEW IF NOT EXISTS ipset_record_history_mv
+            TO ipset_record_history AS ` + clickHouseHistorySelect,
+            // Версии, которые еще не слились, переносим в историю как есть
+            `INSERT INTO ipset_record_history
+                (record_id, revision, operation, changed_at, set_name, ip, cidr, port, protocol,
+                 description, context, set_type, set_options, second_ip, created_at, updated_at)
+            ` + clickHouseHistorySelect + `
+            WHERE (id, version) NOT IN (SELECT record_id, revision FROM ipset_record_history)`,
+        },
+    },
+    {
+        Version:     6,
+        Description: "add expires_at to ipset_records",
+        Statements: []string{
+            // Время истечения записи, NULL у бессрочных записей
+            `ALTER TABLE ipset_records ADD COLUMN IF NOT EXISTS expires_at Nullable(DateTime)`,
+        },
+    },
+    {
+        Version:     7,
+        Description: "add activation window to ipset_records",
+        Statements: []string{
+            // Начало действия записи и расписание, в которое она действует
+            `ALTER TABLE ipset_records
+                ADD COLUMN IF NOT EXISTS active_from Nullable(DateTime),
+                ADD COLUMN IF NOT EXISTS schedule String DEFAULT ''`,
+        },
+    },
+    {
+        Version:     8,
+        Description: "create ipset_sets",
+        Statements: []string{
+            `CREATE TABLE IF NOT EXISTS ipset_sets (
+                name String,
+                type String,
+                options String,
+                family String,
+                description String,
+                owner String,
+                created_at DateTime,
+                updated_at DateTime,
+                is_deleted UInt8 DEFAULT 0,
+                version UInt32
+            ) ENGINE = ReplacingMergeTree(version)
+            ORDER BY name
+            SETTINGS index_granularity = 8192`,
+            // Сеты записей, созданных до появления ipset_sets
+            `INSERT INTO ipset_sets
+                (name, type, options, family, description, owner, created_at, updated_at, is_deleted, version)
+            SELECT set_name,
+                   if(any(set_type) = '', 'hash:ip', any(set_type)),
+                   any(set_options),
+                   if(position(any(set_options), 'family inet6') > 0, 'inet6', 'inet'),
+                   '', '',
+                   min(created_at), max(updated_at), 0, 1
+            FROM (
+                SELECT *
+                FROM ipset_records
+                ORDER BY id, version DESC
+                LIMIT 1 BY id
+            )
+            WHERE is_deleted = 0
+            GROUP BY set_name`,
+        },
+    },
+    {
+        Version:     9,
+        Description: "create ipset_changes",
+        Statements: []string{
+            `CREATE TABLE IF NOT EXISTS ipset_changes (
+                revision Int64,
+                changed_at DateTime,
+                kind LowCardinality(String),
+                operation LowCardinality(String),
+                set_name String,
+                record_id UInt32,
+                ip String,
+                cidr String,
+                port UInt16,
+                protocol String,
+                second_ip String,
+                description String,
+                context String,
+                set_type String,
+                set_options String,
+                family String,
+                owner String,
+                created_at DateTime,
+                updated_at DateTime,
+                expires_at Nullable(DateTime),
+                active_from Nullable(DateTime),
+                schedule String
+            ) ENGINE = MergeTree()
+            ORDER BY revision
+            SETTINGS index_granularity = 8192`,
+            `CREATE MATERIALIZED VIEW IF NOT EXISTS ipset_record_changes_mv
+            TO ipset_changes AS ` + clickHouseRecordChangesSelect,
+            `CREATE MATERIALIZED VIEW IF NOT EXISTS ipset_set_changes_mv
+            TO ipset_changes AS ` + clickHouseSetChangesSelect,
+            // Поток начинается с создания существующих сетов и действующих записей
+            `INSERT INTO ipset_changes
+                (revision, changed_at, kind, operation, set_name, record_id, description,
+                 set_type, set_options, family, owner, created_at, updated_at)
+            SELECT rowNumberInAllBlocks() + 1, updated_at, 'set', 'create', name, 0, description,
+                   type, options, family, owner, created_at, updated_at
+            FROM (
+                SELECT *
+                FROM ipset_sets
+                ORDER BY name, version DESC
+                LIMIT 1 BY name
+            )
+            WHERE is_deleted = 0
+            ORDER BY name`,
+            `INSERT INTO ipset_changes
+                (revision, changed_at, kind, operation, set_name, record_id, ip, cidr, port, protocol,
+                 second_ip, description, context, set_type, set_options, created_at, updated_at,
+                 expires_at, active_from, schedule)
+            SELECT (SELECT count() FROM ipset_changes) + rowNumberInAllBlocks() + 1, updated_at,
+                   'record', 'create', set_name, id, ip, cidr, port, protocol,
+                   second_ip, description, context, set_type, set_options, created_at, updated_at,
+                   expires_at, active_from, schedule
+            FROM (
+                SELECT *
+                FROM ipset_records
+                ORDER BY id, version DESC
+                LIMIT 1 BY id
+            )
+            WHERE is_deleted = 0
+            ORDER BY id`,
+        },
+    },
+    {
+        Version:     10,
+        Description: "create webhooks",
+        Statements: []string{
+            // Как и записи, подписки и доставки меняются вставкой новой версии
+            `CREATE TABLE IF NOT EXISTS webhooks (
+                id UInt64,
+                url String,
+                secret String,
+                events String,
+                set_names String,
+                description String,
+                active UInt8,
+                created_at DateTime,
+                updated_at DateTime,
+                is_deleted UInt8 DEFAULT 0,
+                version UInt64
+            ) ENGINE = ReplacingMergeTree(version)
+            ORDER BY id
+            SETTINGS index_granularity = 8192`,
+            `CREATE TABLE IF NOT EXISTS webhook_deliveries (
+                id UInt64,
+                webhook_id UInt64,
+                revision Int64,
+                event LowCardinality(String),
+                payload String,
+                status LowCardinality(String),
+                attempts UInt32,
+                next_attempt_at DateTime,
+                last_status UInt16,
+                last_error String,
+                created_at DateTime,
+                updated_at DateTime,
+                version UInt64
+            ) ENGINE = ReplacingMergeTree(version)
+            ORDER BY id
+            SETTINGS index_granularity = 8192`,
+            `CREATE TABLE IF NOT EXISTS webhook_cursor (
+                id UInt8,
+                revision Int64,
+                version UInt64
+            ) ENGINE = ReplacingMergeTree(version)
+            ORDER BY id`,
+        },
+    },
+    {
+        Version:     11,
+        Description: "create agents",
+        Statements: []string{
+            `CREATE TABLE IF NOT EXISTS agents (
+                hostname String,
+                labels String,
+                sets String,
+                last_error String,
+                registered_at DateTime,
+                last_seen_at DateTime,
+                is_deleted UInt8 DEFAULT 0,
+                version UInt64
+            ) ENGINE = ReplacingMergeTree(version)
+            ORDER BY hostname
+            SETTINGS index_granularity = 8192`,
+            `CREATE TABLE IF NOT EXISTS agent_assignments (
+                id UInt64,
+                selector String,
+                sets String,
+                description String,
+                created_at DateTime,
+                updated_at DateTime,
+                is_deleted UInt8 DEFAULT 0,
+                version UInt64
+            ) ENGINE = ReplacingMergeTree(version)
+            ORDER BY id
+            SETTINGS index_granularity = 8192`,
+        },
+    },
 }
 
-func NewClickHouseKeyStorage(cfg *config.Config) (*ClickHouseKeyStorage, error) {
+// clickHouseHistorySelect - строка ipset_records в виде ревизии: version -
+// номер ревизии, строка с is_deleted = 1 - удаление, updated_at - время
+// изменения (при удалении в него пишется время удаления)
+const clickHouseHistorySelect = `SELECT
+                id AS record_id,
+                version AS revision,
+                multiIf(is_deleted = 1, 'delete', version = 1, 'create', 'update') AS operation,
+                updated_at AS changed_at,
+                set_name, ip, cidr, port, protocol, description, context,
+                set_type, set_options, second_ip, created_at, updated_at
+            FROM ipset_records`
+
+// clickHouseChangesSelect - номер изменения в ClickHouse: время вставки в
+// наносекундах и номер строки в блоке, чтобы строки одной вставки шли по
+// порядку. Строка с is_deleted = 1 - удаление, первая версия - создание.
+// Номер - не счетчик: вставка, начатая раньше, может стать видна позже
+// следующей, поэтому читатели видят изменения с задержкой clickHouseChangeLag.
+// Поддерживается один сервер, пишущий в ClickHouse.
+const clickHouseChangesSelect = `toUnixTimestamp64Nano(now64(9)) + rowNumberInBlock() AS revision,
+                now() AS changed_at,
+                multiIf(is_deleted = 1, 'delete', version = 1, 'create', 'update') AS operation`
+
+// clickHouseChangeLag - задержка, с которой изменения видны в Revision и
+// Changes: за это время вставка, получившая меньший номер, успевает стать
+// видна, и читатель, ушедший дальше по номерам, ее не пропустит
+const clickHouseChangeLag = 5 * time.Second
+
+// clickHouseVisibleRevision - условие на номер изменения, которое уже видно
+// читателям (параметр - clickHouseChangeLag в наносекундах)
+const clickHouseVisibleRevision = `revision <= toUnixTimestamp64Nano(now64(9)) - ?`
+
+// clickHouseRecordChangesSelect и clickHouseSetChangesSelect - строки
+// ipset_records и ipset_sets в виде изменений для ipset_changes
+const (
+    clickHouseRecordChangesSelect = `SELECT
+                ` + clickHouseChangesSelect + `,
+                'record' AS kind,
+                set_name, id AS record_id, ip, cidr, port, protocol, second_ip, description, context,
+                set_type, set_options, created_at, updated_at, expires_at, active_from, schedule
+            FROM ipset_records`
+    clickHouseSetChangesSelect = `SELECT
+                ` + clickHouseChangesSelect + `,
+                'set' AS kind,
+                name AS set_name, toUInt32(0) AS record_id, description,
+                type AS set_type, options AS set_options, family, owner, created_at, updated_at
+            FROM ipset_sets`
+)
+
+// clickHouseSetSelect - последние версии сетов с числом действующих записей,
+// к запросу добавляются условия по name и type
+var clickHouseSetSelect = `SELECT * FROM (
+        SELECT s.name AS name, s.type AS type, s.options AS options, s.family AS family,
+               s.description AS description, s.owner AS owner,
+               s.created_at AS created_at, s.updated_at AS updated_at,
+               c.record_count AS record_count
+        FROM (
+            SELECT *
+            FROM ipset_sets
+            ORDER BY name, version DESC
+            LIMIT 1 BY name
+        ) AS s
+        LEFT JOIN (
+            SELECT set_name, count() AS record_count
+            FROM ipset_records
+            WHERE is_deleted = 0 AND ` + notExpiredSQL(clickHouseDialect) + `
+            GROUP BY set_name
+        ) AS c ON c.set_name = s.name
+        WHERE s.is_deleted = 0
+    )`
+
+func openClickHouse(cfg *config.Config) (driver.Conn, error) {
     ctx := context.Background()
     
     conn, err := clickhouse.Open(&clickhouse.Options{
@@ -29,10 +421,10 @@ func NewClickHouseKeyStorage(cfg *config.Config) (*ClickHouseKeyStorage, error)
         Settings: clickhouse.Settings{
             "max_execution_time": 60,
         },
-        DialTimeout:      time.Second * 30,
-        MaxOpenConns:     10,
-        MaxIdleConns:     5,
-        ConnMaxLifetime:  time.Hour,
+        DialTimeout:     time.Second * 30,
+        MaxOpenConns:    10,
+        MaxIdleConns:    5,
+        ConnMaxLifetime: time.Hour,
     })
     
     if err != nil {
@@ -49,27 +441,31 @@ func NewClickHouseKeyStorage(cfg *config.Config) (*ClickHouseKeyStorage, error)
         return nil, fmt.Errorf("failed to create database: %v", err)
     }
     
-    // Создаем таблицу для ключей
-    err = conn.Exec(ctx, `
-        CREATE TABLE IF NOT EXISTS auth_keys (
-            key String,
-            created_at DateTime,
-            expires_at DateTime,
-            is_active UInt8,
-            updated_at DateTime DEFAULT now()
-        ) ENGINE = MergeTree()
-        ORDER BY (key, created_at)
-        SETTINGS index_granularity = 8192
-    `)
+    return conn, nil
+}
+
+// ClickHouseKeyStorage - реализация для хранения ключей в ClickHouse
+type ClickHouseKeyStorage struct {
+    conn         driver.Conn
+    queryTimeout time.Duration
+}
+
+func NewClickHouseKeyStorage(cfg *config.Config) (*ClickHouseKeyStorage, error) {
+    conn, err := openClickHouse(cfg)
     if err != nil {
-        return nil, fmt.Errorf("failed to create auth_keys table: %v", err)
+        return nil, err
+    }
+    
+    if err := ensureSchema(&clickHouseMigrator{conn: conn}, cfg.AutoMigrate); err != nil {
+        return nil, err
     }
     
-    return &ClickHouseKeyStorage{conn: conn}, nil
+    return &ClickHouseKeyStorage{conn: conn, queryTimeout: cfg.DBQueryTimeout}, nil
 }
 
-func (s *ClickHouseKeyStorage) GetKey(key string) (*models.AuthKey, error) {
-    ctx := context.Background()
+func (s *ClickHouseKeyStorage) GetKey(ctx context.Context, key string) (*models.AuthKey, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
     
     var authKey models.AuthKey
     var isActive uint8
@@ -93,8 +489,9 @@ func (s *ClickHouseKeyStorage) GetKey(key string) (*models.AuthKey, error) {
     return &authKey, nil
 }
 
-func (s *ClickHouseKeyStorage) SaveKey(key *models.AuthKey) error {
-    ctx := context.Background()
+func (s *ClickHouseKeyStorage) SaveKey(ctx context.Context, key *models.AuthKey) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
     
     isActive := uint8(0)
     if key.IsActive {
@@ -113,8 +510,9 @@ func (s *ClickHouseKeyStorage) SaveKey(key *models.AuthKey) error {
     return nil
 }
 
-func (s *ClickHouseKeyStorage) DeleteKey(key string) error {
-    ctx := context.Background()
+func (s *ClickHouseKeyStorage) DeleteKey(ctx context.Context, key string) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
     
     // Помечаем ключ как неактивный вместо удаления
     err := s.conn.Exec(ctx, `
@@ -133,8 +531,9 @@ func (s *ClickHouseKeyStorage) DeleteKey(key string) error {
     return nil
 }
 
-func (s *ClickHouseKeyStorage) ListKeys() ([]*models.AuthKey, error) {
-    ctx := context.Background()
+func (s *ClickHouseKeyStorage) ListKeys(ctx context.Context) ([]*models.AuthKey, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
     
     rows, err := s.conn.Query(ctx, `
         SELECT 
@@ -165,71 +564,30 @@ func (s *ClickHouseKeyStorage) ListKeys() ([]*models.AuthKey, error) {
 
 // ClickHouseIPSetStorage
 type ClickHouseIPSetStorage struct {
-    conn driver.Conn
+    conn         driver.Conn
+    queryTimeout time.Duration
 }
 
 func NewClickHouseIPSetStorage(cfg *config.Config) (*ClickHouseIPSetStorage, error) {
-    ctx := context.Background()
-    
-    conn, err := clickhouse.Open(&clickhouse.Options{
-        Addr: []string{fmt.Sprintf("%s:%s", cfg.ClickHouseHost, cfg.ClickHousePort)},
-        Auth: clickhouse.Auth{
-            Database: cfg.ClickHouseDatabase,
-            Username: cfg.ClickHouseUsername,
-            Password: cfg.ClickHousePassword,
-        },
-        Settings: clickhouse.Settings{
-            "max_execution_time": 60,
-        },
-        DialTimeout:     time.Second * 30,
-        MaxOpenConns:    10,
-        MaxIdleConns:    5,
-        ConnMaxLifetime: time.Hour,
-    })
-    
+    conn, err := openClickHouse(cfg)
     if err != nil {
-        return nil, fmt.Errorf("failed to connect to clickhouse: %v", err)
-    }
-    
-    if err := conn.Ping(ctx); err != nil {
-        return nil, fmt.Errorf("failed to ping clickhouse: %v", err)
+        return nil, err
     }
     
-    // Создаем таблицу для ipset записей
-    err = conn.Exec(ctx, `
-        CREATE TABLE IF NOT EXISTS ipset_records (
-            id UInt32,
-            set_name String,
-            ip String,
-            cidr String,
-            port UInt16,
-            protocol String,
-            description String,
-            context String,
-            set_type String,
-            set_options String,
-            created_at DateTime,
-            updated_at DateTime,
-            is_deleted UInt8 DEFAULT 0,
-            version UInt32
-        ) ENGINE = ReplacingMergeTree(version)
-        ORDER BY (id, updated_at)
-        SETTINGS index_granularity = 8192
-    `)
-    if err != nil {
-        return nil, fmt.Errorf("failed to create ipset_records table: %v", err)
+    if err := ensureSchema(&clickHouseMigrator{conn: conn}, cfg.AutoMigrate); err != nil {
+        return nil, err
     }
     
-    return &ClickHouseIPSetStorage{conn: conn}, nil
+    return &ClickHouseIPSetStorage{conn: conn, queryTimeout: cfg.DBQueryTimeout}, nil
 }
 
 func (s *ClickHouseIPSetStorage) getNextID(ctx context.Context) (int, error) {
-    // Получаем максимальный ID среди активных записей
+    // Получаем максимальный ID среди всех записей: ID записей из корзины
+    // не выдаются повторно
     var maxID uint32
     err := s.conn.QueryRow(ctx, `
         SELECT MAX(id) 
-        FROM ipset_records 
-        WHERE is_deleted = 0
+        FROM ipset_records
     `).Scan(&maxID)
     
     if err != nil {
@@ -248,8 +606,42 @@ func (s *ClickHouseIPSetStorage) getNextID(ctx context.Context) (int, error) {
     return nextID, nil
 }
 
-func (s *ClickHouseIPSetStorage) Create(record *models.IPSetRecord) error {
-    ctx := context.Background()
+// findDuplicate ищет другую действующую запись сета с тем же элементом,
+// что у записи record. Проверка идет до записи и без блокировок, поэтому
+// параллельные запросы могут ее обойти.
+func (s *ClickHouseIPSetStorage) findDuplicate(ctx context.Context, record *models.IPSetRecord) error {
+    var id uint32
+    err := s.conn.QueryRow(ctx, `
+        SELECT id
+        FROM (
+            SELECT *
+            FROM ipset_records
+            ORDER BY id, version DESC
+            LIMIT 1 BY id
+        )
+        WHERE set_name = ? AND ip = ? AND cidr = ? AND port = ? AND protocol = ? AND second_ip = ?
+          AND id != ? AND is_deleted = 0 AND `+notExpiredSQL(clickHouseDialect)+`
+        ORDER BY id
+        LIMIT 1
+    `, record.SetName, record.IP, record.CIDR, uint16(record.Port), record.Protocol, record.SecondIP, uint32(record.ID)).Scan(&id)
+    
+    if err != nil {
+        if err.Error() == "sql: no rows in result set" {
+            return nil
+        }
+        return fmt.Errorf("failed to check duplicates: %v", err)
+    }
+    
+    return &DuplicateError{SetName: record.SetName, ID: int(id)}
+}
+
+func (s *ClickHouseIPSetStorage) Create(ctx context.Context, record *models.IPSetRecord) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    if err := s.findDuplicate(ctx, record); err != nil {
+        return err
+    }
     
     // Получаем следующий ID
     id, err := s.getNextID(ctx)
@@ -264,23 +656,60 @@ func (s *ClickHouseIPSetStorage) Create(record *models.IPSetRecord) error {
     
     err = s.conn.Exec(ctx, `
         INSERT INTO ipset_records 
-        (id, set_name, ip, cidr, port, protocol, description, context, set_type, set_options, created_at, updated_at, is_deleted, version)
-        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+        (id, set_name, ip, cidr, port, protocol, description, context, set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule, is_deleted, version)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
     `,
         uint32(record.ID), record.SetName, record.IP, record.CIDR, uint16(record.Port), 
-        record.Protocol, record.Description, record.Context, record.SetType, record.SetOptions,
-        record.CreatedAt, record.UpdatedAt, uint8(0), uint32(1),
+        record.Protocol, record.Description, record.Context, record.SetType, record.SetOptions, record.SecondIP,
+        record.CreatedAt, record.UpdatedAt, nullTimeValue(record.ExpiresAt), nullTimeValue(record.ActiveFrom), record.Schedule, uint8(0), uint32(1),
     )
     
     if err != nil {
         return fmt.Errorf("failed to create record: %v", err)
     }
     
-    return nil
+    return s.ensureSet(ctx, record)
 }
 
-func (s *ClickHouseIPSetStorage) GetByID(id int) (*models.IPSetRecord, error) {
-    ctx := context.Background()
+func (s *ClickHouseIPSetStorage) ImportRecord(ctx context.Context, record *models.IPSetRecord) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    if err := s.findDuplicate(ctx, record); err != nil {
+        return err
+    }
+    
+    // Новая версия строки вытесняет существующую запись с тем же ID
+    var currentVersion uint32
+    err := s.conn.QueryRow(ctx, `
+        SELECT max(version)
+        FROM ipset_records
+        WHERE id = ?
+    `, uint32(record.ID)).Scan(&currentVersion)
+    if err != nil {
+        return fmt.Errorf("failed to get current version: %v", err)
+    }
+    
+    err = s.conn.Exec(ctx, `
+        INSERT INTO ipset_records 
+        (id, set_name, ip, cidr, port, protocol, description, context, set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule, is_deleted, version)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+    `,
+        uint32(record.ID), record.SetName, record.IP, record.CIDR, uint16(record.Port), 
+        record.Protocol, record.Description, record.Context, record.SetType, record.SetOptions, record.SecondIP,
+        record.CreatedAt, record.UpdatedAt, nullTimeValue(record.ExpiresAt), nullTimeValue(record.ActiveFrom), record.Schedule, uint8(0), currentVersion+1,
+    )
+    
+    if err != nil {
+        return fmt.Errorf("failed to import record %d: %v", record.ID, err)
+    }
+    
+    return s.ensureSet(ctx, record)
+}
+
+func (s *ClickHouseIPSetStorage) GetByID(ctx context.Context, id int) (*models.IPSetRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
     
     var record models.IPSetRecord
     // var isDeleted uint8
@@ -291,15 +720,15 @@ func (s *ClickHouseIPSetStorage) GetByID(id int) (*models.IPSetRecord, error) {
     
     err := s.conn.QueryRow(ctx, `
         SELECT id, set_name, ip, cidr, port, protocol, description, context, 
-               set_type, set_options, created_at, updated_at
+               set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule
         FROM ipset_records
-        WHERE id = ? AND is_deleted = 0
+        WHERE id = ? AND is_deleted = 0 AND `+notExpiredSQL(clickHouseDialect)+`
         ORDER BY version DESC
         LIMIT 1
     `, uint32(id)).Scan(
         &record.ID, &record.SetName, &record.IP, &record.CIDR, &record.Port, &record.Protocol,
-        &record.Description, &record.Context, &record.SetType, &record.SetOptions,
-        &record.CreatedAt, &record.UpdatedAt,
+        &record.Description, &record.Context, &record.SetType, &record.SetOptions, &record.SecondIP,
+        &record.CreatedAt, &record.UpdatedAt, &record.ExpiresAt, &record.ActiveFrom, &record.Schedule,
     )
     
     if err != nil {
@@ -312,15 +741,16 @@ func (s *ClickHouseIPSetStorage) GetByID(id int) (*models.IPSetRecord, error) {
     return &record, nil
 }
 
-func (s *ClickHouseIPSetStorage) GetAll() ([]*models.IPSetRecord, error) {
-    ctx := context.Background()
+func (s *ClickHouseIPSetStorage) GetAll(ctx context.Context) ([]*models.IPSetRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
     
     rows, err := s.conn.Query(ctx, `
         SELECT 
             id, set_name, ip, cidr, port, protocol, description, context, 
-            set_type, set_options, created_at, updated_at
+            set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule
         FROM ipset_records
-        WHERE is_deleted = 0
+        WHERE is_deleted = 0 AND `+notExpiredSQL(clickHouseDialect)+`
         ORDER BY id
     `)
     if err != nil {
@@ -333,8 +763,8 @@ func (s *ClickHouseIPSetStorage) GetAll() ([]*models.IPSetRecord, error) {
         var record models.IPSetRecord
         if err := rows.Scan(
             &record.ID, &record.SetName, &record.IP, &record.CIDR, &record.Port, &record.Protocol,
-            &record.Description, &record.Context, &record.SetType, &record.SetOptions,
-            &record.CreatedAt, &record.UpdatedAt,
+            &record.Description, &record.Context, &record.SetType, &record.SetOptions, &record.SecondIP,
+            &record.CreatedAt, &record.UpdatedAt, &record.ExpiresAt, &record.ActiveFrom, &record.Schedule,
         ); err != nil {
             return nil, fmt.Errorf("failed to scan record: %v", err)
         }
@@ -344,15 +774,16 @@ func (s *ClickHouseIPSetStorage) GetAll() ([]*models.IPSetRecord, error) {
     return records, nil
 }
 
-func (s *ClickHouseIPSetStorage) GetBySetName(setName string) ([]*models.IPSetRecord, error) {
-    ctx := context.Background()
+func (s *ClickHouseIPSetStorage) GetBySetName(ctx context.Context, setName string) ([]*models.IPSetRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
     
     rows, err := s.conn.Query(ctx, `
         SELECT 
             id, set_name, ip, cidr, port, protocol, description, context, 
-            set_type, set_options, created_at, updated_at
+            set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule
         FROM ipset_records
-        WHERE set_name = ? AND is_deleted = 0
+        WHERE set_name = ? AND is_deleted = 0 AND `+notExpiredSQL(clickHouseDialect)+`
         ORDER BY id
     `, setName)
     if err != nil {
@@ -365,8 +796,8 @@ func (s *ClickHouseIPSetStorage) GetBySetName(setName string) ([]*models.IPSetRe
         var record models.IPSetRecord
         if err := rows.Scan(
             &record.ID, &record.SetName, &record.IP, &record.CIDR, &record.Port, &record.Protocol,
-            &record.Description, &record.Context, &record.SetType, &record.SetOptions,
-            &record.CreatedAt, &record.UpdatedAt,
+            &record.Description, &record.Context, &record.SetType, &record.SetOptions, &record.SecondIP,
+            &record.CreatedAt, &record.UpdatedAt, &record.ExpiresAt, &record.ActiveFrom, &record.Schedule,
         ); err != nil {
             return nil, fmt.Errorf("failed to scan record: %v", err)
         }
@@ -380,259 +811,1949 @@ func (s *ClickHouseIPSetStorage) GetBySetName(setName string) ([]*models.IPSetRe
     return records, nil
 }
 
-func (s *ClickHouseIPSetStorage) GetAllSets() ([]*models.IPSetSet, error) {
-    ctx := context.Background()
+func (s *ClickHouseIPSetStorage) GetAllSets(ctx context.Context) ([]*models.IPSetSet, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
     
-    // Получаем уникальные сеты с агрегированной информацией
-    rows, err := s.conn.Query(ctx, `
-        SELECT 
-            set_name,
-            any(set_type) as set_type,
-            any(set_options) as set_options,
-            MIN(created_at) as created_at,
-            MAX(updated_at) as updated_at,
-            COUNT(*) as record_count
-        FROM ipset_records
-        WHERE is_deleted = 0
-        GROUP BY set_name
-        ORDER BY set_name
-    `)
+    sets, err := s.querySets(ctx, clickHouseSetSelect+" ORDER BY name")
     if err != nil {
         return nil, fmt.Errorf("failed to get all sets: %v", err)
     }
+    
+    return sets, nil
+}
+
+func (s *ClickHouseIPSetStorage) querySets(ctx context.Context, query string, args ...interface{}) ([]*models.IPSetSet, error) {
+    rows, err := s.conn.Query(ctx, query, args...)
+    if err != nil {
+        return nil, err
+    }
     defer rows.Close()
     
     var sets []*models.IPSetSet
     for rows.Next() {
-        set := &models.IPSetSet{
-            Records: []models.IPSetRecord{},
-        }
+        var set models.IPSetSet
         var recordCount uint64
-        
-        err := rows.Scan(&set.Name, &set.Type, &set.Options, &set.CreatedAt, &set.UpdatedAt, &recordCount)
-        if err != nil {
+        if err := rows.Scan(&set.Name, &set.Type, &set.Options, &set.Family, &set.Description, &set.Owner,
+            &set.CreatedAt, &set.UpdatedAt, &recordCount); err != nil {
             return nil, fmt.Errorf("failed to scan set: %v", err)
         }
-        
-        // Получаем записи для этого сета
-        records, err := s.GetBySetName(set.Name)
-        if err == nil {
-            for _, r := range records {
-                set.Records = append(set.Records, *r)
-            }
-        }
-        
-        sets = append(sets, set)
+        set.RecordCount = int(recordCount)
+        sets = append(sets, &set)
     }
     
-    return sets, nil
+    return sets, rows.Err()
 }
 
-func (s *ClickHouseIPSetStorage) Update(id int, record *models.IPSetRecord) error {
-    ctx := context.Background()
-    
-    // Получаем текущую версию и created_at
-    var currentVersion uint32
-    var createdAt time.Time
-    
+// setVersion - последняя версия строки сета и нет ли сета (он удален или
+// не создавался, тогда версия 0)
+func (s *ClickHouseIPSetStorage) setVersion(ctx context.Context, name string) (uint32, bool, error) {
+    var version uint32
+    var isDeleted uint8
     err := s.conn.QueryRow(ctx, `
-        SELECT version, created_at
-        FROM ipset_records
-        WHERE id = ? AND is_deleted = 0
+        SELECT version, is_deleted
+        FROM ipset_sets
+        WHERE name = ?
         ORDER BY version DESC
         LIMIT 1
-    `, uint32(id)).Scan(&currentVersion, &createdAt)
-    
+    `, name).Scan(&version, &isDeleted)
     if err != nil {
         if err.Error() == "sql: no rows in result set" {
-            return fmt.Errorf("record with id %d not found", id)
+            return 0, true, nil
         }
-        return fmt.Errorf("failed to get current version: %v", err)
+        return 0, false, fmt.Errorf("failed to get set version: %v", err)
     }
     
-    record.UpdatedAt = time.Now()
-    record.CreatedAt = createdAt // Сохраняем оригинальную дату создания
-    
-    err = s.conn.Exec(ctx, `
-        INSERT INTO ipset_records 
-        (id, set_name, ip, cidr, port, protocol, description, context, set_type, set_options, created_at, updated_at, is_deleted, version)
-        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+    return version, isDeleted == 1, nil
+}
+
+func (s *ClickHouseIPSetStorage) insertSet(ctx context.Context, set *models.IPSetSet, isDeleted uint8, version uint32) error {
+    return s.conn.Exec(ctx, `
+        INSERT INTO ipset_sets
+        (name, type, options, family, description, owner, created_at, updated_at, is_deleted, version)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
     `,
-        uint32(id), record.SetName, record.IP, record.CIDR, uint16(record.Port), 
-        record.Protocol, record.Description, record.Context, record.SetType, record.SetOptions,
-        record.CreatedAt, record.UpdatedAt, uint8(0), currentVersion+1,
+        set.Name, set.Type, set.Options, set.Family, set.Description, set.Owner,
+        set.CreatedAt, set.UpdatedAt, isDeleted, version,
     )
-    
+}
+
+// ensureSet заводит сет записи, если его еще нет
+func (s *ClickHouseIPSetStorage) ensureSet(ctx context.Context, record *models.IPSetRecord) error {
+    version, deleted, err := s.setVersion(ctx, record.SetName)
     if err != nil {
-        return fmt.Errorf("failed to update record: %v", err)
+        return err
+    }
+    if !deleted {
+        return nil
     }
     
+    if err := s.insertSet(ctx, recordSet(record, time.Now()), 0, version+1); err != nil {
+        return fmt.Errorf("failed to create set %s: %v", record.SetName, err)
+    }
     return nil
 }
 
-func (s *ClickHouseIPSetStorage) Delete(id int) error {
-    ctx := context.Background()
+func (s *ClickHouseIPSetStorage) CreateSet(ctx context.Context, set *models.IPSetSet) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
     
-    // Получаем текущую версию и данные
-    var currentVersion uint32
-    var setName, ip, cidr, protocol, description, context, setType, setOptions string
-    var port uint16
-    var createdAt, updatedAt time.Time
+    version, deleted, err := s.setVersion(ctx, set.Name)
+    if err != nil {
+        return err
+    }
+    if !deleted {
+        return fmt.Errorf("set %s already exists", set.Name)
+    }
     
-    err := s.conn.QueryRow(ctx, `
-        SELECT version, set_name, ip, cidr, port, protocol, description, context, 
-               set_type, set_options, created_at, updated_at
-        FROM ipset_records
-        WHERE id = ? AND is_deleted = 0
-        ORDER BY version DESC
-        LIMIT 1
-    `, uint32(id)).Scan(&currentVersion, &setName, &ip, &cidr, &port, &protocol, 
-        &description, &context, &setType, &setOptions, &createdAt, &updatedAt)
+    now := time.Now()
+    set.CreatedAt = now
+    set.UpdatedAt = now
     
-    if err != nil {
-        if err.Error() == "sql: no rows in result set" {
-            return fmt.Errorf("record with id %d not found", id)
-        }
-        return fmt.Errorf("failed to get record for deletion: %v", err)
+    if err := s.insertSet(ctx, set, 0, version+1); err != nil {
+        return fmt.Errorf("failed to create set: %v", err)
     }
     
-    // Вставляем запись с пометкой удаления
-    err = s.conn.Exec(ctx, `
-        INSERT INTO ipset_records 
-        (id, set_name, ip, cidr, port, protocol, description, context, set_type, set_options, created_at, updated_at, is_deleted, version)
-        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-    `,
-        uint32(id), setName, ip, cidr, port, protocol, description, context, 
-        setType, setOptions, createdAt, time.Now(), uint8(1), currentVersion+1,
-    )
+    return nil
+}
+
+func (s *ClickHouseIPSetStorage) ImportSet(ctx context.Context, set *models.IPSetSet) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
     
+    // Новая версия строки вытесняет существующий сет с тем же именем
+    version, _, err := s.setVersion(ctx, set.Name)
     if err != nil {
-        return fmt.Errorf("failed to delete record: %v", err)
+        return err
+    }
+    
+    if err := s.insertSet(ctx, set, 0, version+1); err != nil {
+        return fmt.Errorf("failed to import set %s: %v", set.Name, err)
     }
     
     return nil
 }
 
-func (s *ClickHouseIPSetStorage) DeleteSet(setName string) error {
-    ctx := context.Background()
+func (s *ClickHouseIPSetStorage) GetSet(ctx context.Context, name string) (*models.IPSetSet, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
     
-    // Получаем все записи сета
-    rows, err := s.conn.Query(ctx, `
-        SELECT id, version, set_name, ip, cidr, port, protocol, description, context, 
-               set_type, set_options, created_at, updated_at
-        FROM ipset_records
-        WHERE set_name = ? AND is_deleted = 0
-    `, setName)
+    sets, err := s.querySets(ctx, clickHouseSetSelect+" WHERE name = ?", name)
     if err != nil {
-        return fmt.Errorf("failed to get set records for deletion: %v", err)
+        return nil, fmt.Errorf("failed to get set: %v", err)
     }
-    defer rows.Close()
     
-    var records []struct {
-        id          uint32
-        version     uint32
-        setName     string
-        ip          string
-        cidr        string
-        port        uint16
-        protocol    string
-        description string
-        context     string
-        setType     string
-        setOptions  string
-        createdAt   time.Time
-        updatedAt   time.Time
+    if len(sets) == 0 {
+        return nil, fmt.Errorf("set %s not found", name)
     }
     
-    for rows.Next() {
-        var r struct {
-            id          uint32
-            version     uint32
-            setName     string
-            ip          string
-            cidr        string
-            port        uint16
-            protocol    string
-            description string
-            context     string
-            setType     string
-            setOptions  string
-            createdAt   time.Time
-            updatedAt   time.Time
-        }
-        err := rows.Scan(&r.id, &r.version, &r.setName, &r.ip, &r.cidr, &r.port, 
-            &r.protocol, &r.description, &r.context, &r.setType, &r.setOptions, 
-            &r.createdAt, &r.updatedAt)
-        if err != nil {
-            return fmt.Errorf("failed to scan record: %v", err)
-        }
-        records = append(records, r)
-    }
+    return sets[0], nil
+}
+
+func (s *ClickHouseIPSetStorage) UpdateSet(ctx context.Context, set *models.IPSetSet) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
     
-    if len(records) == 0 {
-        return fmt.Errorf("set %s not found", setName)
+    version, deleted, err := s.setVersion(ctx, set.Name)
+    if err != nil {
+        return err
+    }
+    if deleted {
+        return fmt.Errorf("set %s not found", set.Name)
     }
     
-    // Помечаем все записи как удаленные
-    for _, r := range records {
-        err = s.conn.Exec(ctx, `
-            INSERT INTO ipset_records 
-            (id, set_name, ip, cidr, port, protocol, description, context, set_type, set_options, created_at, updated_at, is_deleted, version)
-            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-        `,
-            r.id, r.setName, r.ip, r.cidr, r.port, r.protocol, r.description, r.context,
-            r.setType, r.setOptions, r.createdAt, time.Now(), uint8(1), r.version+1,
-        )
-        if err != nil {
-            return fmt.Errorf("failed to delete record %d: %v", r.id, err)
-        }
+    set.UpdatedAt = time.Now()
+    if err := s.insertSet(ctx, set, 0, version+1); err != nil {
+        return fmt.Errorf("failed to update set: %v", err)
     }
     
     return nil
 }
 
-func (s *ClickHouseIPSetStorage) Search(query string) ([]*models.IPSetRecord, error) {
-    ctx := context.Background()
-    
-    // ClickHouse поддерживает полнотекстовый поиск через токенизацию
+// Транзакций в ClickHouse нет, поэтому RenameSet, CopySet и SwapSets
+// пишут новые версии строк сетов и записей одну за другой: чтение во время
+// операции может застать ее на середине, а сбой - оставить ее незавершенной.
+
+// liveSetRecords - последние версии действующих записей сета и их номера
+func (s *ClickHouseIPSetStorage) liveSetRecords(ctx context.Context, setName string) ([]*models.IPSetRecord, []uint32, error) {
     rows, err := s.conn.Query(ctx, `
-        SELECT 
-            id, set_name, ip, cidr, port, protocol, description, context, 
-            set_type, set_options, created_at, updated_at
-        FROM ipset_records
-        WHERE is_deleted = 0 
-            AND (positionCaseInsensitive(context, ?) > 0 
-                 OR positionCaseInsensitive(description, ?) > 0
-                 OR positionCaseInsensitive(ip, ?) > 0
-                 OR positionCaseInsensitive(set_name, ?) > 0)
-        ORDER BY 
-            CASE 
-                WHEN positionCaseInsensitive(set_name, ?) = 1 THEN 1
-                WHEN positionCaseInsensitive(ip, ?) = 1 THEN 2
-                WHEN positionCaseInsensitive(context, ?) = 1 THEN 3
-                WHEN positionCaseInsensitive(description, ?) = 1 THEN 4
-                ELSE 5
-            END,
-            id
-    `, query, query, query, query, query, query, query, query)
-    
+        SELECT version, id, set_name, ip, cidr, port, protocol, description, context,
+               set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule
+        FROM (
+            SELECT *
+            FROM ipset_records
+            ORDER BY id, version DESC
+            LIMIT 1 BY id
+        )
+        WHERE set_name = ? AND is_deleted = 0 AND `+notExpiredSQL(clickHouseDialect)+`
+        ORDER BY id
+    `, setName)
     if err != nil {
-        return nil, fmt.Errorf("failed to search records: %v", err)
+        return nil, nil, fmt.Errorf("failed to get set records: %v", err)
     }
     defer rows.Close()
     
     var records []*models.IPSetRecord
+    var versions []uint32
     for rows.Next() {
         var record models.IPSetRecord
+        var version uint32
         if err := rows.Scan(
-            &record.ID, &record.SetName, &record.IP, &record.CIDR, &record.Port, &record.Protocol,
-            &record.Description, &record.Context, &record.SetType, &record.SetOptions,
-            &record.CreatedAt, &record.UpdatedAt,
+            &version, &record.ID, &record.SetName, &record.IP, &record.CIDR, &record.Port, &record.Protocol,
+            &record.Description, &record.Context, &record.SetType, &record.SetOptions, &record.SecondIP,
+            &record.CreatedAt, &record.UpdatedAt, &record.ExpiresAt, &record.ActiveFrom, &record.Schedule,
         ); err != nil {
-            return nil, fmt.Errorf("failed to scan record: %v", err)
+            return nil, nil, fmt.Errorf("failed to scan record: %v", err)
         }
         records = append(records, &record)
+        versions = append(versions, version)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, nil, fmt.Errorf("failed to get set records: %v", err)
+    }
+    
+    return records, versions, nil
+}
+
+// insertRecordVersion пишет действующую версию записи
+func (s *ClickHouseIPSetStorage) insertRecordVersion(ctx context.Context, record *models.IPSetRecord, version uint32) error {
+    return s.conn.Exec(ctx, `
+        INSERT INTO ipset_records 
+        (id, set_name, ip, cidr, port, protocol, description, context, set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule, is_deleted, version)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+    `,
+        uint32(record.ID), record.SetName, record.IP, record.CIDR, uint16(record.Port),
+        record.Protocol, record.Description, record.Context, record.SetType, record.SetOptions, record.SecondIP,
+        record.CreatedAt, record.UpdatedAt, nullTimeValue(record.ExpiresAt), nullTimeValue(record.ActiveFrom), record.Schedule, uint8(0), version,
+    )
+}
+
+// moveRecords переносит записи в сет setName новыми версиями
+func (s *ClickHouseIPSetStorage) moveRecords(ctx context.Context, records []*models.IPSetRecord, versions []uint32, setName string, at time.Time) error {
+    for i, record := range records {
+        record.SetName = setName
+        record.UpdatedAt = at
+        if err := s.insertRecordVersion(ctx, record, versions[i]+1); err != nil {
+            return fmt.Errorf("failed to move record %d: %v", record.ID, err)
+        }
+    }
+    return nil
+}
+
+func (s *ClickHouseIPSetStorage) RenameSet(ctx context.Context, from, to string) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    set, err := s.GetSet(ctx, from)
+    if err != nil {
+        return err
+    }
+    fromVersion, _, err := s.setVersion(ctx, from)
+    if err != nil {
+        return err
+    }
+    toVersion, deleted, err := s.setVersion(ctx, to)
+    if err != nil {
+        return err
+    }
+    if !deleted {
+        return fmt.Errorf("set %s already exists", to)
+    }
+    records, versions, err := s.liveSetRecords(ctx, from)
+    if err != nil {
+        return err
+    }
+    
+    now := time.Now()
+    set.Name = to
+    set.UpdatedAt = now
+    if err := s.insertSet(ctx, set, 0, toVersion+1); err != nil {
+        return fmt.Errorf("failed to rename set: %v", err)
+    }
+    if err := s.moveRecords(ctx, records, versions, to, now); err != nil {
+        return err
+    }
+    
+    set.Name = from
+    if err := s.insertSet(ctx, set, 1, fromVersion+1); err != nil {
+        return fmt.Errorf("failed to rename set: %v", err)
+    }
+    
+    return nil
+}
+
+func (s *ClickHouseIPSetStorage) CopySet(ctx context.Context, from, to string) ([]*models.IPSetRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    set, err := s.GetSet(ctx, from)
+    if err != nil {
+        return nil, err
+    }
+    toVersion, deleted, err := s.setVersion(ctx, to)
+    if err != nil {
+        return nil, err
+    }
+    if !deleted {
+        return nil, fmt.Errorf("set %s already exists", to)
+    }
+    records, _, err := s.liveSetRecords(ctx, from)
+    if err != nil {
+        return nil, err
+    }
+    
+    // ID выдаются подряд за наибольшим, как в getNextID
+    id, err := s.getNextID(ctx)
+    if err != nil {
+        return nil, err
+    }
+    if id+len(records)-1 > 999999 {
+        return nil, fmt.Errorf("no available IDs in range 100000-999999")
+    }
+    
+    now := time.Now()
+    set.Name = to
+    set.CreatedAt = now
+    set.UpdatedAt = now
+    if err := s.insertSet(ctx, set, 0, toVersion+1); err != nil {
+        return nil, fmt.Errorf("failed to create set: %v", err)
+    }
+    
+    for i, record := range records {
+        record.ID = id + i
+        record.SetName = to
+        record.CreatedAt = now
+        record.UpdatedAt = now
+        if err := s.insertRecordVersion(ctx, record, 1); err != nil {
+            return nil, fmt.Errorf("failed to copy record: %v", err)
+        }
     }
     
     return records, nil
-}
\ No newline at end of file
+}
+
+func (s *ClickHouseIPSetStorage) SwapSets(ctx context.Context, a, b string) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    setA, err := s.GetSet(ctx, a)
+    if err != nil {
+        return err
+    }
+    setB, err := s.GetSet(ctx, b)
+    if err != nil {
+        return err
+    }
+    versionA, _, err := s.setVersion(ctx, a)
+    if err != nil {
+        return err
+    }
+    versionB, _, err := s.setVersion(ctx, b)
+    if err != nil {
+        return err
+    }
+    recordsA, versionsA, err := s.liveSetRecords(ctx, a)
+    if err != nil {
+        return err
+    }
+    recordsB, versionsB, err := s.liveSetRecords(ctx, b)
+    if err != nil {
+        return err
+    }
+    
+    // Имена остаются на месте, содержимое сетов меняется местами
+    now := time.Now()
+    setA.Name, setB.Name = b, a
+    setA.UpdatedAt, setB.UpdatedAt = now, now
+    if err := s.insertSet(ctx, setB, 0, versionA+1); err != nil {
+        return fmt.Errorf("failed to swap sets: %v", err)
+    }
+    if err := s.insertSet(ctx, setA, 0, versionB+1); err != nil {
+        return fmt.Errorf("failed to swap sets: %v", err)
+    }
+    if err := s.moveRecords(ctx, recordsA, versionsA, b, now); err != nil {
+        return err
+    }
+    if err := s.moveRecords(ctx, recordsB, versionsB, a, now); err != nil {
+        return err
+    }
+    
+    return nil
+}
+
+// ApplyChanges выполняет операции по очереди: транзакций в ClickHouse нет,
+// и операции до ошибочной остаются выполненными
+func (s *ClickHouseIPSetStorage) ApplyChanges(ctx context.Context, changes []*RecordChange) error {
+    for i, change := range changes {
+        var err error
+        switch change.Op {
+        case ChangeCreate:
+            err = s.Create(ctx, change.Record)
+        case ChangeUpdate:
+            err = s.Update(ctx, change.ID, change.Record)
+        case ChangeDelete:
+            err = s.Delete(ctx, change.ID)
+        default:
+            err = fmt.Errorf("unknown operation %q", change.Op)
+        }
+        if err != nil {
+            return &ChangeError{Index: i, Applied: i, Err: err}
+        }
+    }
+    return nil
+}
+
+// ApplySetChanges в ClickHouse, как и RenameSet, пишет версии строк одну
+// за другой и не атомарен. Номер revision не проверяется: Revision отстает
+// на clickHouseChangeLag, и свежие изменения сета выглядели бы сделанными
+// после него.
+func (s *ClickHouseIPSetStorage) ApplySetChanges(ctx context.Context, setName string, revision int64, set *models.IPSetSet, remove []int, update, add []*models.IPSetRecord) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    now := time.Now()
+    if set != nil {
+        version, deleted, err := s.setVersion(ctx, setName)
+        if err != nil {
+            return err
+        }
+        if deleted && set.CreatedAt.IsZero() {
+            set.CreatedAt = now
+        }
+        set.UpdatedAt = now
+        if err := s.insertSet(ctx, set, 0, version+1); err != nil {
+            return fmt.Errorf("failed to save set %s: %v", setName, err)
+        }
+    }
+    
+    for _, id := range remove {
+        if err := s.Delete(ctx, id); err != nil {
+            return err
+        }
+    }
+    
+    for _, record := range update {
+        if record.SetName != setName {
+            return fmt.Errorf("record with id %d not found in set %s", record.ID, setName)
+        }
+        if err := s.Update(ctx, record.ID, record); err != nil {
+            return err
+        }
+    }
+    
+    if len(add) == 0 {
+        return nil
+    }
+    for _, record := range add {
+        record.SetName = setName
+        if err := s.findDuplicate(ctx, record); err != nil {
+            return err
+        }
+    }
+    // ID выдаются подряд за наибольшим, как в getNextID
+    id, err := s.getNextID(ctx)
+    if err != nil {
+        return err
+    }
+    if id+len(add)-1 > 999999 {
+        return fmt.Errorf("no available IDs in range 100000-999999")
+    }
+    for i, record := range add {
+        record.ID = id + i
+        record.SetName = setName
+        record.CreatedAt = now
+        record.UpdatedAt = now
+        if err := s.insertRecordVersion(ctx, record, 1); err != nil {
+            return fmt.Errorf("failed to create record: %v", err)
+        }
+    }
+    
+    return s.ensureSet(ctx, add[0])
+}
+
+func (s *ClickHouseIPSetStorage) Update(ctx context.Context, id int, record *models.IPSetRecord) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    // Получаем текущую версию и created_at
+    var currentVersion uint32
+    var createdAt time.Time
+    
+    err := s.conn.QueryRow(ctx, `
+        SELECT version, created_at
+        FROM ipset_records
+        WHERE id = ? AND is_deleted = 0 AND `+notExpiredSQL(clickHouseDialect)+`
+        ORDER BY version DESC
+        LIMIT 1
+    `, uint32(id)).Scan(&currentVersion, &createdAt)
+    
+    if err != nil {
+        if err.Error() == "sql: no rows in result set" {
+            return fmt.Errorf("record with id %d not found", id)
+        }
+        return fmt.Errorf("failed to get current version: %v", err)
+    }
+    
+    record.ID = id
+    if err := s.findDuplicate(ctx, record); err != nil {
+        return err
+    }
+    
+    record.UpdatedAt = time.Now()
+    record.CreatedAt = createdAt // Сохраняем оригинальную дату создания
+    
+    err = s.conn.Exec(ctx, `
+        INSERT INTO ipset_records 
+        (id, set_name, ip, cidr, port, protocol, description, context, set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule, is_deleted, version)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+    `,
+        uint32(id), record.SetName, record.IP, record.CIDR, uint16(record.Port), 
+        record.Protocol, record.Description, record.Context, record.SetType, record.SetOptions, record.SecondIP,
+        record.CreatedAt, record.UpdatedAt, nullTimeValue(record.ExpiresAt), nullTimeValue(record.ActiveFrom), record.Schedule, uint8(0), currentVersion+1,
+    )
+    
+    if err != nil {
+        return fmt.Errorf("failed to update record: %v", err)
+    }
+    
+    // Запись могла перейти в новый сет
+    return s.ensureSet(ctx, record)
+}
+
+func (s *ClickHouseIPSetStorage) Delete(ctx context.Context, id int) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    // Получаем текущую версию и данные
+    var currentVersion uint32
+    var setName, ip, cidr, protocol, description, context, setType, setOptions, secondIP, schedule string
+    var port uint16
+    var createdAt, updatedAt time.Time
+    var expiresAt, activeFrom *time.Time
+    
+    err := s.conn.QueryRow(ctx, `
+        SELECT version, set_name, ip, cidr, port, protocol, description, context, 
+               set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule
+        FROM ipset_records
+        WHERE id = ? AND is_deleted = 0
+        ORDER BY version DESC
+        LIMIT 1
+    `, uint32(id)).Scan(&currentVersion, &setName, &ip, &cidr, &port, &protocol, 
+        &description, &context, &setType, &setOptions, &secondIP, &createdAt, &updatedAt, &expiresAt, &activeFrom, &schedule)
+    
+    if err != nil {
+        if err.Error() == "sql: no rows in result set" {
+            return fmt.Errorf("record with id %d not found", id)
+        }
+        return fmt.Errorf("failed to get record for deletion: %v", err)
+    }
+    
+    // Вставляем запись с пометкой удаления
+    err = s.conn.Exec(ctx, `
+        INSERT INTO ipset_records 
+        (id, set_name, ip, cidr, port, protocol, description, context, set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule, is_deleted, version)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+    `,
+        uint32(id), setName, ip, cidr, port, protocol, description, context, 
+        setType, setOptions, secondIP, createdAt, time.Now(), expiresAt, activeFrom, schedule, uint8(1), currentVersion+1,
+    )
+    
+    if err != nil {
+        return fmt.Errorf("failed to delete record: %v", err)
+    }
+    
+    return nil
+}
+
+func (s *ClickHouseIPSetStorage) DeleteSet(ctx context.Context, setName string) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    // Получаем все записи сета
+    rows, err := s.conn.Query(ctx, `
+        SELECT id, version, set_name, ip, cidr, port, protocol, description, context, 
+               set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule
+        FROM ipset_records
+        WHERE set_name = ? AND is_deleted = 0
+    `, setName)
+    if err != nil {
+        return fmt.Errorf("failed to get set records for deletion: %v", err)
+    }
+    defer rows.Close()
+    
+    var records []struct {
+        id          uint32
+        version     uint32
+        setName     string
+        ip          string
+        cidr        string
+        port        uint16
+        protocol    string
+        description string
+        context     string
+        setType     string
+        setOptions  string
+        secondIP    string
+        createdAt   time.Time
+        updatedAt   time.Time
+        expiresAt   *time.Time
+        activeFrom  *time.Time
+        schedule    string
+    }
+    
+    for rows.Next() {
+        var r struct {
+            id          uint32
+            version     uint32
+            setName     string
+            ip          string
+            cidr        string
+            port        uint16
+            protocol    string
+            description string
+            context     string
+            setType     string
+            setOptions  string
+            secondIP    string
+            createdAt   time.Time
+            updatedAt   time.Time
+            expiresAt   *time.Time
+            activeFrom  *time.Time
+            schedule    string
+        }
+        err := rows.Scan(&r.id, &r.version, &r.setName, &r.ip, &r.cidr, &r.port, 
+            &r.protocol, &r.description, &r.context, &r.setType, &r.setOptions, 
+            &r.secondIP, &r.createdAt, &r.updatedAt, &r.expiresAt, &r.activeFrom, &r.schedule)
+        if err != nil {
+            return fmt.Errorf("failed to scan record: %v", err)
+        }
+        records = append(records, r)
+    }
+    
+    set, err := s.GetSet(ctx, setName)
+    if err != nil && len(records) == 0 {
+        return fmt.Errorf("set %s not found", setName)
+    }
+    
+    // Помечаем все записи как удаленные
+    for _, r := range records {
+        err = s.conn.Exec(ctx, `
+            INSERT INTO ipset_records 
+            (id, set_name, ip, cidr, port, protocol, description, context, set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule, is_deleted, version)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+        `,
+            r.id, r.setName, r.ip, r.cidr, r.port, r.protocol, r.description, r.context,
+            r.setType, r.setOptions, r.secondIP, r.createdAt, time.Now(), r.expiresAt, r.activeFrom, r.schedule, uint8(1), r.version+1,
+        )
+        if err != nil {
+            return fmt.Errorf("failed to delete record %d: %v", r.id, err)
+        }
+    }
+    
+    if set != nil {
+        version, _, err := s.setVersion(ctx, setName)
+        if err != nil {
+            return err
+        }
+        set.UpdatedAt = time.Now()
+        if err := s.insertSet(ctx, set, 1, version+1); err != nil {
+            return fmt.Errorf("failed to delete set: %v", err)
+        }
+    }
+    
+    return nil
+}
+
+func (s *ClickHouseIPSetStorage) Search(ctx context.Context, query string) ([]*models.IPSetRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    // ClickHouse поддерживает полнотекстовый поиск через токенизацию
+    rows, err := s.conn.Query(ctx, `
+        SELECT 
+            id, set_name, ip, cidr, port, protocol, description, context, 
+            set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule
+        FROM ipset_records
+        WHERE is_deleted = 0 AND `+notExpiredSQL(clickHouseDialect)+`
+            AND (positionCaseInsensitive(context, ?) > 0 
+                 OR positionCaseInsensitive(description, ?) > 0
+                 OR positionCaseInsensitive(ip, ?) > 0
+                 OR positionCaseInsensitive(set_name, ?) > 0)
+        ORDER BY 
+            CASE 
+                WHEN positionCaseInsensitive(set_name, ?) = 1 THEN 1
+                WHEN positionCaseInsensitive(ip, ?) = 1 THEN 2
+                WHEN positionCaseInsensitive(context, ?) = 1 THEN 3
+                WHEN positionCaseInsensitive(description, ?) = 1 THEN 4
+                ELSE 5
+            END,
+            id
+    `, query, query, query, query, query, query, query, query)
+    
+    if err != nil {
+        return nil, fmt.Errorf("failed to search records: %v", err)
+    }
+    defer rows.Close()
+    
+    var records []*models.IPSetRecord
+    for rows.Next() {
+        var record models.IPSetRecord
+        if err := rows.Scan(
+            &record.ID, &record.SetName, &record.IP, &record.CIDR, &record.Port, &record.Protocol,
+            &record.Description, &record.Context, &record.SetType, &record.SetOptions, &record.SecondIP,
+            &record.CreatedAt, &record.UpdatedAt, &record.ExpiresAt, &record.ActiveFrom, &record.Schedule,
+        ); err != nil {
+            return nil, fmt.Errorf("failed to scan record: %v", err)
+        }
+        records = append(records, &record)
+    }
+    
+    return records, nil
+}
+
+// Lookup сравнивает границы префикса с материализованными range_start и
+// range_end. Адреса IPv4 передаются в виде IPv4-mapped IPv6, как и хранятся.
+func (s *ClickHouseIPSetStorage) Lookup(ctx context.Context, prefix netip.Prefix) ([]*models.IPSetRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    first, last := validation.PrefixRange(prefix)
+    rows, err := s.conn.Query(ctx, `
+        SELECT 
+            id, set_name, ip, cidr, port, protocol, description, context, 
+            set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule
+        FROM ipset_records
+        WHERE is_deleted = 0 AND `+notExpiredSQL(clickHouseDialect)+`
+            AND addr_valid = 1
+            AND range_start <= toIPv6(?)
+            AND range_end >= toIPv6(?)
+        ORDER BY set_name, id
+    `, netip.AddrFrom16(last.As16()).String(), netip.AddrFrom16(first.As16()).String())
+    
+    if err != nil {
+        return nil, fmt.Errorf("failed to lookup records: %v", err)
+    }
+    defer rows.Close()
+    
+    var records []*models.IPSetRecord
+    for rows.Next() {
+        var record models.IPSetRecord
+        if err := rows.Scan(
+            &record.ID, &record.SetName, &record.IP, &record.CIDR, &record.Port, &record.Protocol,
+            &record.Description, &record.Context, &record.SetType, &record.SetOptions, &record.SecondIP,
+            &record.CreatedAt, &record.UpdatedAt, &record.ExpiresAt, &record.ActiveFrom, &record.Schedule,
+        ); err != nil {
+            return nil, fmt.Errorf("failed to scan record: %v", err)
+        }
+        records = append(records, &record)
+    }
+    
+    return records, nil
+}
+
+func (s *ClickHouseIPSetStorage) List(ctx context.Context, q *models.RecordQuery) (*models.RecordPage, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    tail, args, err := buildRecordListSQL(q, clickHouseDialect, "is_deleted = 0 AND "+notExpiredSQL(clickHouseDialect))
+    if err != nil {
+        return nil, err
+    }
+    
+    rows, err := s.conn.Query(ctx, `
+        SELECT 
+            id, set_name, ip, cidr, port, protocol, description, context, 
+            set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule
+        FROM ipset_records
+    `+tail, args...)
+    if err != nil {
+        return nil, fmt.Errorf("failed to list records: %v", err)
+    }
+    defer rows.Close()
+    
+    var records []*models.IPSetRecord
+    for rows.Next() {
+        var record models.IPSetRecord
+        if err := rows.Scan(
+            &record.ID, &record.SetName, &record.IP, &record.CIDR, &record.Port, &record.Protocol,
+            &record.Description, &record.Context, &record.SetType, &record.SetOptions, &record.SecondIP,
+            &record.CreatedAt, &record.UpdatedAt, &record.ExpiresAt, &record.ActiveFrom, &record.Schedule,
+        ); err != nil {
+            return nil, fmt.Errorf("failed to scan record: %v", err)
+        }
+        records = append(records, &record)
+    }
+    
+    return recordPage(records, q), nil
+}
+
+func (s *ClickHouseIPSetStorage) ListSets(ctx context.Context, q *models.SetQuery) (*models.SetPage, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    where, tail, args, err := buildSetListSQL(q, clickHouseDialect)
+    if err != nil {
+        return nil, err
+    }
+    
+    sets, err := s.querySets(ctx, clickHouseSetSelect+" "+where+" "+tail, args...)
+    if err != nil {
+        return nil, fmt.Errorf("failed to list sets: %v", err)
+    }
+    
+    return setPage(sets, q), nil
+}
+
+func (s *ClickHouseIPSetStorage) History(ctx context.Context, id int) ([]*models.RecordRevision, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    rows, err := s.conn.Query(ctx, `
+        SELECT revision, operation, changed_at,
+               record_id, set_name, ip, cidr, port, protocol, description, context,
+               set_type, set_options, second_ip, created_at, updated_at
+        FROM ipset_record_history
+        WHERE record_id = ?
+        ORDER BY revision
+    `, uint32(id))
+    if err != nil {
+        return nil, fmt.Errorf("failed to get record history: %v", err)
+    }
+    defer rows.Close()
+    
+    var revisions []*models.RecordRevision
+    for rows.Next() {
+        var revision models.RecordRevision
+        record := &revision.Record
+        if err := rows.Scan(
+            &revision.Revision, &revision.Operation, &revision.ChangedAt,
+            &record.ID, &record.SetName, &record.IP, &record.CIDR, &record.Port, &record.Protocol,
+            &record.Description, &record.Context, &record.SetType, &record.SetOptions, &record.SecondIP,
+            &record.CreatedAt, &record.UpdatedAt,
+        ); err != nil {
+            return nil, fmt.Errorf("failed to scan revision: %v", err)
+        }
+        revisions = append(revisions, &revision)
+    }
+    
+    return revisions, rows.Err()
+}
+
+func (s *ClickHouseIPSetStorage) GetBySetNameAt(ctx context.Context, setName string, at time.Time) ([]*models.IPSetRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    // Последняя ревизия каждой записи не позже at
+    rows, err := s.conn.Query(ctx, `
+        SELECT record_id, set_name, ip, cidr, port, protocol, description, context,
+               set_type, set_options, second_ip, created_at, updated_at
+        FROM (
+            SELECT *
+            FROM ipset_record_history
+            WHERE changed_at <= ?
+            ORDER BY record_id, revision DESC
+            LIMIT 1 BY record_id
+        )
+        WHERE set_name = ? AND operation != 'delete'
+        ORDER BY record_id
+    `, at.UTC(), setName)
+    if err != nil {
+        return nil, fmt.Errorf("failed to get set history: %v", err)
+    }
+    defer rows.Close()
+    
+    var records []*models.IPSetRecord
+    for rows.Next() {
+        var record models.IPSetRecord
+        if err := rows.Scan(
+            &record.ID, &record.SetName, &record.IP, &record.CIDR, &record.Port, &record.Protocol,
+            &record.Description, &record.Context, &record.SetType, &record.SetOptions, &record.SecondIP,
+            &record.CreatedAt, &record.UpdatedAt,
+        ); err != nil {
+            return nil, fmt.Errorf("failed to scan record: %v", err)
+        }
+        records = append(records, &record)
+    }
+    
+    return records, rows.Err()
+}
+
+func (s *ClickHouseIPSetStorage) Revision(ctx context.Context) (int64, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    var revision int64
+    if err := s.conn.QueryRow(ctx, "SELECT max(revision) FROM ipset_changes WHERE "+clickHouseVisibleRevision,
+        clickHouseChangeLag.Nanoseconds()).Scan(&revision); err != nil {
+        return 0, fmt.Errorf("failed to get revision: %v", err)
+    }
+    
+    return revision, nil
+}
+
+func (s *ClickHouseIPSetStorage) Changes(ctx context.Context, since int64, limit int) ([]*models.ChangeEvent, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    rows, err := s.conn.Query(ctx, `
+        SELECT revision, changed_at, kind, operation, set_name, record_id,
+               ip, cidr, port, protocol, second_ip, description, context, set_type, set_options,
+               family, owner, created_at, updated_at, expires_at, active_from, schedule
+        FROM ipset_changes
+        WHERE revision > ? AND `+clickHouseVisibleRevision+`
+        ORDER BY revision
+        LIMIT ?
+    `, since, clickHouseChangeLag.Nanoseconds(), limit)
+    if err != nil {
+        return nil, fmt.Errorf("failed to get changes: %v", err)
+    }
+    defer rows.Close()
+    
+    var changes []*models.ChangeEvent
+    for rows.Next() {
+        var change models.ChangeEvent
+        var record models.IPSetRecord
+        var set models.IPSetSet
+        if err := rows.Scan(
+            &change.Revision, &change.ChangedAt, &change.Kind, &change.Operation, &change.SetName, &change.RecordID,
+            &record.IP, &record.CIDR, &record.Port, &record.Protocol, &record.SecondIP, &record.Description,
+            &record.Context, &record.SetType, &record.SetOptions, &set.Family, &set.Owner,
+            &record.CreatedAt, &record.UpdatedAt, &record.ExpiresAt, &record.ActiveFrom, &record.Schedule,
+        ); err != nil {
+            return nil, fmt.Errorf("failed to scan change: %v", err)
+        }
+        
+        if change.Kind == models.ChangeKindSet {
+            set.Name = change.SetName
+            set.Type = record.SetType
+            set.Options = record.SetOptions
+            set.Description = record.Description
+            set.CreatedAt = record.CreatedAt
+            set.UpdatedAt = record.UpdatedAt
+            change.Set = &set
+        } else {
+            record.ID = change.RecordID
+            record.SetName = change.SetName
+            change.Record = &record
+        }
+        changes = append(changes, &change)
+    }
+    
+    return changes, rows.Err()
+}
+
+func (s *ClickHouseIPSetStorage) ListTrash(ctx context.Context, q *models.RecordQuery) (*models.RecordPage, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    // В корзине записи, последняя версия которых помечена удалением
+    tail, args, err := buildRecordListSQL(q, clickHouseDialect,
+        "is_deleted = 1 AND (id, version) IN (SELECT id, max(version) FROM ipset_records GROUP BY id)")
+    if err != nil {
+        return nil, err
+    }
+    
+    rows, err := s.conn.Query(ctx, `
+        SELECT 
+            id, set_name, ip, cidr, port, protocol, description, context, 
+            set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule
+        FROM ipset_records
+    `+tail, args...)
+    if err != nil {
+        return nil, fmt.Errorf("failed to list trash: %v", err)
+    }
+    defer rows.Close()
+    
+    var records []*models.IPSetRecord
+    for rows.Next() {
+        var record models.IPSetRecord
+        if err := rows.Scan(
+            &record.ID, &record.SetName, &record.IP, &record.CIDR, &record.Port, &record.Protocol,
+            &record.Description, &record.Context, &record.SetType, &record.SetOptions, &record.SecondIP,
+            &record.CreatedAt, &record.UpdatedAt, &record.ExpiresAt, &record.ActiveFrom, &record.Schedule,
+        ); err != nil {
+            return nil, fmt.Errorf("failed to scan record: %v", err)
+        }
+        // Время удаления - updated_at строки с пометкой удаления
+        deletedAt := record.UpdatedAt
+        record.DeletedAt = &deletedAt
+        records = append(records, &record)
+    }
+    
+    return recordPage(records, q), nil
+}
+
+func (s *ClickHouseIPSetStorage) Undelete(ctx context.Context, id int) (*models.IPSetRecord, error) {
+    records, err := s.undelete(ctx, "id = ?", uint32(id))
+    if err != nil {
+        return nil, err
+    }
+    if len(records) == 0 {
+        return nil, fmt.Errorf("record with id %d not found in trash", id)
+    }
+    
+    return records[0], nil
+}
+
+func (s *ClickHouseIPSetStorage) UndeleteSet(ctx context.Context, setName string) ([]*models.IPSetRecord, error) {
+    records, err := s.undelete(ctx, "set_name = ?", setName)
+    if err != nil {
+        return nil, err
+    }
+    if len(records) == 0 {
+        return nil, fmt.Errorf("set %s not found in trash", setName)
+    }
+    
+    return records, nil
+}
+
+// undelete вставляет новую версию без пометки удаления для записей из
+// корзины, последняя версия которых подходит под условие
+func (s *ClickHouseIPSetStorage) undelete(ctx context.Context, condition string, value interface{}) ([]*models.IPSetRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    rows, err := s.conn.Query(ctx, `
+        SELECT version, id, set_name, ip, cidr, port, protocol, description, context,
+               set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule
+        FROM (
+            SELECT *
+            FROM ipset_records
+            ORDER BY id, version DESC
+            LIMIT 1 BY id
+        )
+        WHERE is_deleted = 1 AND `+condition+`
+        ORDER BY id
+    `, value)
+    if err != nil {
+        return nil, fmt.Errorf("failed to get trash records: %v", err)
+    }
+    defer rows.Close()
+    
+    var records []*models.IPSetRecord
+    var versions []uint32
+    for rows.Next() {
+        var record models.IPSetRecord
+        var version uint32
+        if err := rows.Scan(
+            &version, &record.ID, &record.SetName, &record.IP, &record.CIDR, &record.Port, &record.Protocol,
+            &record.Description, &record.Context, &record.SetType, &record.SetOptions, &record.SecondIP,
+            &record.CreatedAt, &record.UpdatedAt, &record.ExpiresAt, &record.ActiveFrom, &record.Schedule,
+        ); err != nil {
+            return nil, fmt.Errorf("failed to scan record: %v", err)
+        }
+        records = append(records, &record)
+        versions = append(versions, version)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, fmt.Errorf("failed to get trash records: %v", err)
+    }
+    
+    // Пока записи были в корзине, в сет могли добавить тот же элемент.
+    // Восстанавливаемые записи не должны повторять и друг друга.
+    restoring := make(map[string]int, len(records))
+    for _, record := range records {
+        key := record.SetName + " " + EntryKey(record)
+        if id, ok := restoring[key]; ok {
+            return nil, &DuplicateError{SetName: record.SetName, ID: id}
+        }
+        restoring[key] = record.ID
+        if err := s.findDuplicate(ctx, record); err != nil {
+            return nil, err
+        }
+    }
+    
+    now := time.Now()
+    for i, record := range records {
+        err = s.conn.Exec(ctx, `
+            INSERT INTO ipset_records 
+            (id, set_name, ip, cidr, port, protocol, description, context, set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule, is_deleted, version)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+        `,
+            uint32(record.ID), record.SetName, record.IP, record.CIDR, uint16(record.Port),
+            record.Protocol, record.Description, record.Context, record.SetType, record.SetOptions, record.SecondIP,
+            record.CreatedAt, now, nullTimeValue(record.ExpiresAt), nullTimeValue(record.ActiveFrom), record.Schedule, uint8(0), versions[i]+1,
+        )
+        if err != nil {
+            return nil, fmt.Errorf("failed to restore record %d: %v", record.ID, err)
+        }
+        if err := s.ensureSet(ctx, record); err != nil {
+            return nil, err
+        }
+    }
+    
+    return restoredRecords(records, now), nil
+}
+
+func (s *ClickHouseIPSetStorage) PurgeTrash(ctx context.Context, before time.Time) (int, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    rows, err := s.conn.Query(ctx, `
+        SELECT id
+        FROM (
+            SELECT id, is_deleted, updated_at
+            FROM ipset_records
+            ORDER BY id, version DESC
+            LIMIT 1 BY id
+        )
+        WHERE is_deleted = 1 AND updated_at < ?
+    `, before)
+    if err != nil {
+        return 0, fmt.Errorf("failed to get trash records: %v", err)
+    }
+    defer rows.Close()
+    
+    var ids []uint32
+    for rows.Next() {
+        var id uint32
+        if err := rows.Scan(&id); err != nil {
+            return 0, fmt.Errorf("failed to scan record id: %v", err)
+        }
+        ids = append(ids, id)
+    }
+    if len(ids) == 0 {
+        return 0, rows.Err()
+    }
+    
+    // Удаляются все версии записей, история в ipset_record_history остается
+    if err := s.conn.Exec(ctx, "ALTER TABLE ipset_records DELETE WHERE id IN ?", ids); err != nil {
+        return 0, fmt.Errorf("failed to purge trash: %v", err)
+    }
+    
+    return len(ids), nil
+}
+
+func (s *ClickHouseIPSetStorage) CountExpired(ctx context.Context, at time.Time) (int, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    var count uint64
+    err := s.conn.QueryRow(ctx, `
+        SELECT count()
+        FROM (
+            SELECT *
+            FROM ipset_records
+            ORDER BY id, version DESC
+            LIMIT 1 BY id
+        )
+        WHERE is_deleted = 0 AND expires_at <= ?
+    `, at).Scan(&count)
+    if err != nil {
+        return 0, fmt.Errorf("failed to count expired records: %v", err)
+    }
+    
+    return int(count), nil
+}
+
+func (s *ClickHouseIPSetStorage) DeleteExpired(ctx context.Context, at time.Time) ([]*models.IPSetRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    rows, err := s.conn.Query(ctx, `
+        SELECT version, id, set_name, ip, cidr, port, protocol, description, context,
+               set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule
+        FROM (
+            SELECT *
+            FROM ipset_records
+            ORDER BY id, version DESC
+            LIMIT 1 BY id
+        )
+        WHERE is_deleted = 0 AND expires_at <= ?
+        ORDER BY id
+    `, at)
+    if err != nil {
+        return nil, fmt.Errorf("failed to get expired records: %v", err)
+    }
+    defer rows.Close()
+    
+    var records []*models.IPSetRecord
+    var versions []uint32
+    for rows.Next() {
+        var record models.IPSetRecord
+        var version uint32
+        if err := rows.Scan(
+            &version, &record.ID, &record.SetName, &record.IP, &record.CIDR, &record.Port, &record.Protocol,
+            &record.Description, &record.Context, &record.SetType, &record.SetOptions, &record.SecondIP,
+            &record.CreatedAt, &record.UpdatedAt, &record.ExpiresAt, &record.ActiveFrom, &record.Schedule,
+        ); err != nil {
+            return nil, fmt.Errorf("failed to scan record: %v", err)
+        }
+        records = append(records, &record)
+        versions = append(versions, version)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, fmt.Errorf("failed to get expired records: %v", err)
+    }
+    if len(records) == 0 {
+        return nil, nil
+    }
+    
+    // Строка с пометкой удаления попадает в историю через
+    // ipset_record_history_mv, затем удаляются все версии записей, минуя корзину
+    ids := make([]uint32, len(records))
+    for i, record := range records {
+        ids[i] = uint32(record.ID)
+        err = s.conn.Exec(ctx, `
+            INSERT INTO ipset_records 
+            (id, set_name, ip, cidr, port, protocol, description, context, set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule, is_deleted, version)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+        `,
+            uint32(record.ID), record.SetName, record.IP, record.CIDR, uint16(record.Port),
+            record.Protocol, record.Description, record.Context, record.SetType, record.SetOptions, record.SecondIP,
+            record.CreatedAt, at, nullTimeValue(record.ExpiresAt), nullTimeValue(record.ActiveFrom), record.Schedule, uint8(1), versions[i]+1,
+        )
+        if err != nil {
+            return nil, fmt.Errorf("failed to delete record %d: %v", record.ID, err)
+        }
+    }
+    
+    if err := s.conn.Exec(ctx, "ALTER TABLE ipset_records DELETE WHERE id IN ?", ids); err != nil {
+        return nil, fmt.Errorf("failed to delete expired records: %v", err)
+    }
+    
+    return records, nil
+}
+
+// ClickHouseAuditStorage - журнал аудита в таблице audit_log. Автоинкремента
+// в ClickHouse нет, ID события выдается как max(id) + 1 под блокировкой
+// процесса, поэтому писать журнал должен один экземпляр сервера.
+type ClickHouseAuditStorage struct {
+    conn         driver.Conn
+    queryTimeout time.Duration
+    
+    mu     sync.Mutex
+    lastID uint64
+}
+
+func NewClickHouseAuditStorage(cfg *config.Config) (*ClickHouseAuditStorage, error) {
+    conn, err := openClickHouse(cfg)
+    if err != nil {
+        return nil, err
+    }
+    
+    if err := ensureSchema(&clickHouseMigrator{conn: conn}, cfg.AutoMigrate); err != nil {
+        return nil, err
+    }
+    
+    return &ClickHouseAuditStorage{conn: conn, queryTimeout: cfg.DBQueryTimeout}, nil
+}
+
+func (s *ClickHouseAuditStorage) Append(ctx context.Context, event *models.AuditEvent) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    var maxID uint64
+    if err := s.conn.QueryRow(ctx, "SELECT max(id) FROM audit_log").Scan(&maxID); err != nil {
+        return fmt.Errorf("failed to get next audit event id: %v", err)
+    }
+    if maxID < s.lastID {
+        maxID = s.lastID
+    }
+    id := maxID + 1
+    
+    err := s.conn.Exec(ctx, `
+        INSERT INTO audit_log
+        (id, created_at, actor, request_id, action, set_name, record_id, before_json, after_json)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+    `,
+        id, event.Timestamp.UTC(), event.Actor, event.RequestID, event.Action, event.SetName,
+        uint32(event.RecordID), string(event.Before), string(event.After),
+    )
+    if err != nil {
+        return fmt.Errorf("failed to append audit event: %v", err)
+    }
+    
+    s.lastID = id
+    event.ID = int64(id)
+    return nil
+}
+
+func (s *ClickHouseAuditStorage) List(ctx context.Context, q *models.AuditQuery) (*models.AuditPage, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    tail, args, err := buildAuditListSQL(q, clickHouseDialect)
+    if err != nil {
+        return nil, err
+    }
+    
+    rows, err := s.conn.Query(ctx, `
+        SELECT id, created_at, actor, request_id, action, set_name, record_id, before_json, after_json
+        FROM audit_log
+    `+tail, args...)
+    if err != nil {
+        return nil, fmt.Errorf("failed to list audit events: %v", err)
+    }
+    defer rows.Close()
+    
+    var events []*models.AuditEvent
+    for rows.Next() {
+        var event models.AuditEvent
+        var id uint64
+        var recordID uint32
+        var before, after string
+        if err := rows.Scan(
+            &id, &event.Timestamp, &event.Actor, &event.RequestID, &event.Action,
+            &event.SetName, &recordID, &before, &after,
+        ); err != nil {
+            return nil, fmt.Errorf("failed to scan audit event: %v", err)
+        }
+        event.ID = int64(id)
+        event.RecordID = int(recordID)
+        if before != "" {
+            event.Before = []byte(before)
+        }
+        if after != "" {
+            event.After = []byte(after)
+        }
+        events = append(events, &event)
+    }
+    
+    return auditPage(events, q), nil
+}
+
+// clickHouseWebhookSelect и clickHouseDeliverySelect - последние версии
+// подписок и доставок
+const (
+    clickHouseWebhookSelect = `(
+        SELECT *
+        FROM webhooks
+        ORDER BY id, version DESC
+        LIMIT 1 BY id
+    )`
+    clickHouseDeliverySelect = `(
+        SELECT *
+        FROM webhook_deliveries
+        ORDER BY id, version DESC
+        LIMIT 1 BY id
+    )`
+)
+
+// ClickHouseWebhookStorage - подписки и доставки в таблицах webhooks и
+// webhook_deliveries. Изменение - вставка новой версии строки, ID выдается
+// как max(id) + 1 под блокировкой процесса (как у журнала аудита).
+// Транзакций нет: если номер изменения не сохранится после доставок,
+// доставки будут созданы повторно.
+type ClickHouseWebhookStorage struct {
+    conn         driver.Conn
+    queryTimeout time.Duration
+    
+    mu          sync.Mutex
+    lastVersion uint64
+}
+
+func NewClickHouseWebhookStorage(cfg *config.Config) (*ClickHouseWebhookStorage, error) {
+    conn, err := openClickHouse(cfg)
+    if err != nil {
+        return nil, err
+    }
+    
+    if err := ensureSchema(&clickHouseMigrator{conn: conn}, cfg.AutoMigrate); err != nil {
+        return nil, err
+    }
+    
+    return &ClickHouseWebhookStorage{conn: conn, queryTimeout: cfg.DBQueryTimeout}, nil
+}
+
+// version - версия новой строки: время в наносекундах, растущее и при
+// нескольких вставках в одну наносекунду. Вызывается под s.mu.
+func (s *ClickHouseWebhookStorage) version() uint64 {
+    version := uint64(time.Now().UnixNano())
+    if version <= s.lastVersion {
+        version = s.lastVersion + 1
+    }
+    s.lastVersion = version
+    return version
+}
+
+func (s *ClickHouseWebhookStorage) nextID(ctx context.Context, table string) (uint64, error) {
+    var maxID uint64
+    if err := s.conn.QueryRow(ctx, "SELECT max(id) FROM "+table).Scan(&maxID); err != nil {
+        return 0, fmt.Errorf("failed to get next %s id: %v", table, err)
+    }
+    return maxID + 1, nil
+}
+
+func (s *ClickHouseWebhookStorage) writeWebhook(ctx context.Context, webhook *models.Webhook, deleted uint8) error {
+    var active uint8
+    if webhook.Active {
+        active = 1
+    }
+    return s.conn.Exec(ctx, `
+        INSERT INTO webhooks
+        (id, url, secret, events, set_names, description, active, created_at, updated_at, is_deleted, version)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+    `,
+        uint64(webhook.ID), webhook.URL, webhook.Secret, joinWebhookList(webhook.Events),
+        joinWebhookList(webhook.SetNames), webhook.Description, active,
+        webhook.CreatedAt.UTC(), webhook.UpdatedAt.UTC(), deleted, s.version(),
+    )
+}
+
+func (s *ClickHouseWebhookStorage) writeDelivery(ctx context.Context, delivery *models.WebhookDelivery) error {
+    return s.conn.Exec(ctx, `
+        INSERT INTO webhook_deliveries
+        (id, webhook_id, revision, event, payload, status, attempts, next_attempt_at,
+         last_status, last_error, created_at, updated_at, version)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+    `,
+        uint64(delivery.ID), uint64(delivery.WebhookID), delivery.Revision, delivery.Event, string(delivery.Payload),
+        delivery.Status, uint32(delivery.Attempts), delivery.NextAttemptAt.UTC(), uint16(delivery.LastStatus),
+        deliveryError(delivery.LastError), delivery.CreatedAt.UTC(), delivery.UpdatedAt.UTC(), s.version(),
+    )
+}
+
+func (s *ClickHouseWebhookStorage) queryWebhooks(ctx context.Context, where string, args ...interface{}) ([]*models.Webhook, error) {
+    rows, err := s.conn.Query(ctx, `
+        SELECT `+webhookColumns+`
+        FROM `+clickHouseWebhookSelect+`
+        WHERE is_deleted = 0`+where+`
+        ORDER BY id
+    `, args...)
+    if err != nil {
+        return nil, fmt.Errorf("failed to get webhooks: %v", err)
+    }
+    defer rows.Close()
+    
+    var webhooks []*models.Webhook
+    for rows.Next() {
+        var webhook models.Webhook
+        var id uint64
+        var events, setNames string
+        var active uint8
+        if err := rows.Scan(
+            &id, &webhook.URL, &webhook.Secret, &events, &setNames, &webhook.Description,
+            &active, &webhook.CreatedAt, &webhook.UpdatedAt,
+        ); err != nil {
+            return nil, fmt.Errorf("failed to scan webhook: %v", err)
+        }
+        webhook.ID = int64(id)
+        webhook.Events = splitWebhookList(events)
+        webhook.SetNames = splitWebhookList(setNames)
+        webhook.Active = active == 1
+        webhooks = append(webhooks, &webhook)
+    }
+    
+    return webhooks, rows.Err()
+}
+
+func (s *ClickHouseWebhookStorage) queryDeliveries(ctx context.Context, tail string, args ...interface{}) ([]*models.WebhookDelivery, error) {
+    rows, err := s.conn.Query(ctx, `
+        SELECT `+deliveryColumns+`
+        FROM `+clickHouseDeliverySelect+`
+    `+tail, args...)
+    if err != nil {
+        return nil, fmt.Errorf("failed to get webhook deliveries: %v", err)
+    }
+    defer rows.Close()
+    
+    var deliveries []*models.WebhookDelivery
+    for rows.Next() {
+        var delivery models.WebhookDelivery
+        var id, webhookID uint64
+        var attempts uint32
+        var lastStatus uint16
+        var payload string
+        if err := rows.Scan(
+            &id, &webhookID, &delivery.Revision, &delivery.Event, &payload,
+            &delivery.Status, &attempts, &delivery.NextAttemptAt,
+            &lastStatus, &delivery.LastError, &delivery.CreatedAt, &delivery.UpdatedAt,
+        ); err != nil {
+            return nil, fmt.Errorf("failed to scan webhook delivery: %v", err)
+        }
+        delivery.ID = int64(id)
+        delivery.WebhookID = int64(webhookID)
+        delivery.Attempts = int(attempts)
+        delivery.LastStatus = int(lastStatus)
+        delivery.Payload = []byte(payload)
+        deliveries = append(deliveries, &delivery)
+    }
+    
+    return deliveries, rows.Err()
+}
+
+func (s *ClickHouseWebhookStorage) CreateWebhook(ctx context.Context, webhook *models.Webhook) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    id, err := s.nextID(ctx, "webhooks")
+    if err != nil {
+        return err
+    }
+    webhook.ID = int64(id)
+    
+    if err := s.writeWebhook(ctx, webhook, 0); err != nil {
+        return fmt.Errorf("failed to create webhook: %v", err)
+    }
+    return nil
+}
+
+func (s *ClickHouseWebhookStorage) GetWebhook(ctx context.Context, id int64) (*models.Webhook, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    webhooks, err := s.queryWebhooks(ctx, " AND id = ?", uint64(id))
+    if err != nil {
+        return nil, err
+    }
+    if len(webhooks) == 0 {
+        return nil, fmt.Errorf("webhook with id %d not found", id)
+    }
+    return webhooks[0], nil
+}
+
+func (s *ClickHouseWebhookStorage) ListWebhooks(ctx context.Context) ([]*models.Webhook, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    return s.queryWebhooks(ctx, "")
+}
+
+func (s *ClickHouseWebhookStorage) UpdateWebhook(ctx context.Context, webhook *models.Webhook) error {
+    if _, err := s.GetWebhook(ctx, webhook.ID); err != nil {
+        return err
+    }
+    
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    if err := s.writeWebhook(ctx, webhook, 0); err != nil {
+        return fmt.Errorf("failed to update webhook: %v", err)
+    }
+    return nil
+}
+
+func (s *ClickHouseWebhookStorage) DeleteWebhook(ctx context.Context, id int64) error {
+    webhook, err := s.GetWebhook(ctx, id)
+    if err != nil {
+        return err
+    }
+    
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    webhook.UpdatedAt = time.Now()
+    if err := s.writeWebhook(ctx, webhook, 1); err != nil {
+        return fmt.Errorf("failed to delete webhook: %v", err)
+    }
+    if err := s.conn.Exec(ctx, "ALTER TABLE webhook_deliveries DELETE WHERE webhook_id = ?", uint64(id)); err != nil {
+        return fmt.Errorf("failed to delete webhook deliveries: %v", err)
+    }
+    return nil
+}
+
+func (s *ClickHouseWebhookStorage) WebhookCursor(ctx context.Context) (int64, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    var count uint64
+    var revision int64
+    err := s.conn.QueryRow(ctx, `
+        SELECT count(), argMax(revision, version)
+        FROM webhook_cursor
+    `).Scan(&count, &revision)
+    if err != nil {
+        return 0, fmt.Errorf("failed to get webhook cursor: %v", err)
+    }
+    if count == 0 {
+        return -1, nil
+    }
+    return revision, nil
+}
+
+func (s *ClickHouseWebhookStorage) EnqueueDeliveries(ctx context.Context, deliveries []*models.WebhookDelivery, revision int64) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    if len(deliveries) > 0 {
+        id, err := s.nextID(ctx, "webhook_deliveries")
+        if err != nil {
+            return err
+        }
+        for _, delivery := range deliveries {
+            delivery.ID = int64(id)
+            id++
+            if err := s.writeDelivery(ctx, delivery); err != nil {
+                return fmt.Errorf("failed to enqueue webhook delivery: %v", err)
+            }
+        }
+    }
+    
+    if err := s.conn.Exec(ctx, "INSERT INTO webhook_cursor (id, revision, version) VALUES (?, ?, ?)",
+        uint8(1), revision, s.version()); err != nil {
+        return fmt.Errorf("failed to update webhook cursor: %v", err)
+    }
+    return nil
+}
+
+func (s *ClickHouseWebhookStorage) DueDeliveries(ctx context.Context, at time.Time, limit int) ([]*models.WebhookDelivery, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    return s.queryDeliveries(ctx, `
+        WHERE status = ? AND next_attempt_at <= ?
+        ORDER BY next_attempt_at, id
+        LIMIT ?
+    `, models.DeliveryPending, at.UTC(), limit)
+}
+
+func (s *ClickHouseWebhookStorage) GetDelivery(ctx context.Context, id int64) (*models.WebhookDelivery, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    deliveries, err := s.queryDeliveries(ctx, "WHERE id = ?", uint64(id))
+    if err != nil {
+        return nil, err
+    }
+    if len(deliveries) == 0 {
+        return nil, fmt.Errorf("delivery with id %d not found", id)
+    }
+    return deliveries[0], nil
+}
+
+func (s *ClickHouseWebhookStorage) UpdateDelivery(ctx context.Context, delivery *models.WebhookDelivery) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    if err := s.writeDelivery(ctx, delivery); err != nil {
+        return fmt.Errorf("failed to update webhook delivery: %v", err)
+    }
+    return nil
+}
+
+func (s *ClickHouseWebhookStorage) ListDeliveries(ctx context.Context, q *models.DeliveryQuery) (*models.DeliveryPage, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    tail, args, err := buildDeliveryListSQL(q, clickHouseDialect)
+    if err != nil {
+        return nil, err
+    }
+    
+    deliveries, err := s.queryDeliveries(ctx, tail, args...)
+    if err != nil {
+        return nil, err
+    }
+    
+    return deliveryPage(deliveries, q), nil
+}
+
+func (s *ClickHouseWebhookStorage) PurgeDeliveries(ctx context.Context, before time.Time) (int, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    var ids []uint64
+    rows, err := s.conn.Query(ctx, `
+        SELECT id
+        FROM `+clickHouseDeliverySelect+`
+        WHERE status = ? AND updated_at < ?
+    `, models.DeliveryDelivered, before.UTC())
+    if err != nil {
+        return 0, fmt.Errorf("failed to get delivered webhook deliveries: %v", err)
+    }
+    defer rows.Close()
+    
+    for rows.Next() {
+        var id uint64
+        if err := rows.Scan(&id); err != nil {
+            return 0, fmt.Errorf("failed to scan delivery id: %v", err)
+        }
+        ids = append(ids, id)
+    }
+    if len(ids) == 0 {
+        return 0, rows.Err()
+    }
+    
+    if err := s.conn.Exec(ctx, "ALTER TABLE webhook_deliveries DELETE WHERE id IN ?", ids); err != nil {
+        return 0, fmt.Errorf("failed to purge webhook deliveries: %v", err)
+    }
+    
+    return len(ids), nil
+}
+
+// clickHouseAgentSelect и clickHouseAssignmentSelect - последние версии
+// агентов и правил назначения
+const (
+    clickHouseAgentSelect = `(
+        SELECT *
+        FROM agents
+        ORDER BY hostname, version DESC
+        LIMIT 1 BY hostname
+    )`
+    clickHouseAssignmentSelect = `(
+        SELECT *
+        FROM agent_assignments
+        ORDER BY id, version DESC
+        LIMIT 1 BY id
+    )`
+)
+
+// ClickHouseAgentStorage - агенты и правила назначения в таблицах agents и
+// agent_assignments. Как и у подписок, изменение - вставка новой версии
+// строки, ID правила выдается как max(id) + 1 под блокировкой процесса.
+type ClickHouseAgentStorage struct {
+    conn         driver.Conn
+    queryTimeout time.Duration
+    
+    mu          sync.Mutex
+    lastVersion uint64
+}
+
+func NewClickHouseAgentStorage(cfg *config.Config) (*ClickHouseAgentStorage, error) {
+    conn, err := openClickHouse(cfg)
+    if err != nil {
+        return nil, err
+    }
+    
+    if err := ensureSchema(&clickHouseMigrator{conn: conn}, cfg.AutoMigrate); err != nil {
+        return nil, err
+    }
+    
+    return &ClickHouseAgentStorage{conn: conn, queryTimeout: cfg.DBQueryTimeout}, nil
+}
+
+// version - версия новой строки, как у ClickHouseWebhookStorage. Вызывается
+// под s.mu.
+func (s *ClickHouseAgentStorage) version() uint64 {
+    version := uint64(time.Now().UnixNano())
+    if version <= s.lastVersion {
+        version = s.lastVersion + 1
+    }
+    s.lastVersion = version
+    return version
+}
+
+func (s *ClickHouseAgentStorage) writeAgent(ctx context.Context, agent *models.Agent, deleted uint8) error {
+    sets, err := marshalAgentSets(agent.Sets)
+    if err != nil {
+        return err
+    }
+    return s.conn.Exec(ctx, `
+        INSERT INTO agents
+        (hostname, labels, sets, last_error, registered_at, last_seen_at, is_deleted, version)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+    `,
+        agent.Hostname, joinLabels(agent.Labels), sets, agent.LastError,
+        agent.RegisteredAt.UTC(), agent.LastSeenAt.UTC(), deleted, s.version(),
+    )
+}
+
+func (s *ClickHouseAgentStorage) writeAssignment(ctx context.Context, rule *models.AssignmentRule, deleted uint8) error {
+    return s.conn.Exec(ctx, `
+        INSERT INTO agent_assignments
+        (id, selector, sets, description, created_at, updated_at, is_deleted, version)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+    `,
+        uint64(rule.ID), joinLabels(rule.Selector), joinWebhookList(rule.Sets), rule.Description,
+        rule.CreatedAt.UTC(), rule.UpdatedAt.UTC(), deleted, s.version(),
+    )
+}
+
+func (s *ClickHouseAgentStorage) queryAgents(ctx context.Context, where string, args ...interface{}) ([]*models.Agent, error) {
+    rows, err := s.conn.Query(ctx, `
+        SELECT `+agentColumns+`
+        FROM `+clickHouseAgentSelect+`
+        WHERE is_deleted = 0`+where+`
+        ORDER BY hostname
+    `, args...)
+    if err != nil {
+        return nil, fmt.Errorf("failed to get agents: %v", err)
+    }
+    defer rows.Close()
+    
+    var agents []*models.Agent
+    for rows.Next() {
+        var agent models.Agent
+        var labels, sets string
+        if err := rows.Scan(
+            &agent.Hostname, &labels, &sets, &agent.LastError, &agent.RegisteredAt, &agent.LastSeenAt,
+        ); err != nil {
+            return nil, fmt.Errorf("failed to scan agent: %v", err)
+        }
+        if agent.Sets, err = unmarshalAgentSets(sets); err != nil {
+            return nil, err
+        }
+        agent.Labels = splitLabels(labels)
+        agents = append(agents, &agent)
+    }
+    
+    return agents, rows.Err()
+}
+
+func (s *ClickHouseAgentStorage) queryAssignments(ctx context.Context, where string, args ...interface{}) ([]*models.AssignmentRule, error) {
+    rows, err := s.conn.Query(ctx, `
+        SELECT `+assignmentColumns+`
+        FROM `+clickHouseAssignmentSelect+`
+        WHERE is_deleted = 0`+where+`
+        ORDER BY id
+    `, args...)
+    if err != nil {
+        return nil, fmt.Errorf("failed to get assignments: %v", err)
+    }
+    defer rows.Close()
+    
+    var rules []*models.AssignmentRule
+    for rows.Next() {
+        var rule models.AssignmentRule
+        var id uint64
+        var selector, sets string
+        if err := rows.Scan(
+            &id, &selector, &sets, &rule.Description, &rule.CreatedAt, &rule.UpdatedAt,
+        ); err != nil {
+            return nil, fmt.Errorf("failed to scan assignment: %v", err)
+        }
+        rule.ID = int64(id)
+        rule.Selector = splitLabels(selector)
+        rule.Sets = splitWebhookList(sets)
+        rules = append(rules, &rule)
+    }
+    
+    return rules, rows.Err()
+}
+
+func (s *ClickHouseAgentStorage) SaveAgent(ctx context.Context, agent *models.Agent) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    if err := s.writeAgent(ctx, agent, 0); err != nil {
+        return fmt.Errorf("failed to save agent: %v", err)
+    }
+    return nil
+}
+
+func (s *ClickHouseAgentStorage) GetAgent(ctx context.Context, hostname string) (*models.Agent, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    agents, err := s.queryAgents(ctx, " AND hostname = ?", hostname)
+    if err != nil {
+        return nil, err
+    }
+    if len(agents) == 0 {
+        return nil, fmt.Errorf("agent %s not found", hostname)
+    }
+    return agents[0], nil
+}
+
+func (s *ClickHouseAgentStorage) ListAgents(ctx context.Context) ([]*models.Agent, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    return s.queryAgents(ctx, "")
+}
+
+func (s *ClickHouseAgentStorage) DeleteAgent(ctx context.Context, hostname string) error {
+    agent, err := s.GetAgent(ctx, hostname)
+    if err != nil {
+        return err
+    }
+    
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    if err := s.writeAgent(ctx, agent, 1); err != nil {
+        return fmt.Errorf("failed to delete agent: %v", err)
+    }
+    return nil
+}
+
+func (s *ClickHouseAgentStorage) CreateAssignment(ctx context.Context, rule *models.AssignmentRule) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    var maxID uint64
+    if err := s.conn.QueryRow(ctx, "SELECT max(id) FROM agent_assignments").Scan(&maxID); err != nil {
+        return fmt.Errorf("failed to get next agent_assignments id: %v", err)
+    }
+    rule.ID = int64(maxID + 1)
+    
+    if err := s.writeAssignment(ctx, rule, 0); err != nil {
+        return fmt.Errorf("failed to create assignment: %v", err)
+    }
+    return nil
+}
+
+func (s *ClickHouseAgentStorage) GetAssignment(ctx context.Context, id int64) (*models.AssignmentRule, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    rules, err := s.queryAssignments(ctx, " AND id = ?", uint64(id))
+    if err != nil {
+        return nil, err
+    }
+    if len(rules) == 0 {
+        return nil, fmt.Errorf("assignment with id %d not found", id)
+    }
+    return rules[0], nil
+}
+
+func (s *ClickHouseAgentStorage) ListAssignments(ctx context.Context) ([]*models.AssignmentRule, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    return s.queryAssignments(ctx, "")
+}
+
+func (s *ClickHouseAgentStorage) UpdateAssignment(ctx context.Context, rule *models.AssignmentRule) error {
+    if _, err := s.GetAssignment(ctx, rule.ID); err != nil {
+        return err
+    }
+    
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    if err := s.writeAssignment(ctx, rule, 0); err != nil {
+        return fmt.Errorf("failed to update assignment: %v", err)
+    }
+    return nil
+}
+
+func (s *ClickHouseAgentStorage) DeleteAssignment(ctx context.Context, id int64) error {
+    rule, err := s.GetAssignment(ctx, id)
+    if err != nil {
+        return err
+    }
+    
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    rule.UpdatedAt = time.Now()
+    if err := s.writeAssignment(ctx, rule, 1); err != nil {
+        return fmt.Errorf("failed to delete assignment: %v", err)
+    }
+    return nil
+}
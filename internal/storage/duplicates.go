@@ -0,0 +1,81 @@
+package storage
+
+import (
+    "context"
+    "database/sql"
+    "fmt"
+    "ipset-api-server/internal/models"
+)
+
+// Элемент сета (ip, cidr, port, protocol, second_ip) встречается среди
+// действующих записей сета не больше одного раза: ipset и сам не хранит
+// один элемент дважды. Записи в корзине и истекшие записи не мешают.
+// Уникальный индекс не используется: в MySQL нет частичных индексов, а в
+// базах, заполненных до проверки, дубликаты уже могут быть (их сливает
+// ipset-admin dedupe). Поэтому хранилища проверяют запись сами: SQL
+// хранилища - после вставки или изменения, в той же транзакции и под
+// блокировкой строки сета, файловое - под s.mu, ClickHouse - перед записью
+// (без транзакций проверка не защищает от параллельных запросов).
+// Переименование, копирование и обмен сетов переносят записи как есть.
+
+// DuplicateError - в сете уже есть действующая запись с тем же элементом
+type DuplicateError struct {
+    SetName string
+    ID      int
+}
+
+func (e *DuplicateError) Error() string {
+    return fmt.Sprintf("set %s already contains this entry as record %d", e.SetName, e.ID)
+}
+
+// EntryKey - элемент сета, который задает запись. Адреса сравниваются в
+// том виде, в каком хранятся (сервер приводит их перед записью).
+func EntryKey(record *models.IPSetRecord) string {
+    return fmt.Sprintf("%s/%s,%s:%d,%s", record.IP, record.CIDR, record.Protocol, record.Port, record.SecondIP)
+}
+
+// lockSet блокирует строку сета до конца транзакции, чтобы записи одного
+// сета проверялись на дубликаты по очереди. Перед сетом блокируется счетчик
+// изменений (см. changes.go): триггер все равно возьмет его при первом
+// изменении, а так транзакция, которая меняет несколько сетов, не ждет
+// чужой сет, держа счетчик.
+func lockSet(ctx context.Context, tx *sql.Tx, d sqlDialect, setName string) error {
+    if d.forUpdate == "" {
+        return nil
+    }
+
+    var revision int64
+    if err := tx.QueryRowContext(ctx, revisionSQL+d.forUpdate).Scan(&revision); err != nil {
+        return fmt.Errorf("failed to lock revision counter: %v", err)
+    }
+
+    var name string
+    err := tx.QueryRowContext(ctx, "SELECT name FROM ipset_sets WHERE name = "+d.placeholder(1)+d.forUpdate, setName).Scan(&name)
+    if err != nil && err != sql.ErrNoRows {
+        return fmt.Errorf("failed to lock set %s: %v", setName, err)
+    }
+    return nil
+}
+
+// checkDuplicate ищет другую действующую запись сета с тем же элементом,
+// что у записи record, уже сохраненной в транзакции tx. Колонки, которые
+// в старых записях могли остаться NULL, сравниваются как пустые.
+func checkDuplicate(ctx context.Context, tx *sql.Tx, d sqlDialect, record *models.IPSetRecord) error {
+    query := fmt.Sprintf(`SELECT id FROM ipset_records
+        WHERE set_name = %s AND ip = %s AND COALESCE(cidr, '') = %s AND COALESCE(port, 0) = %s
+          AND COALESCE(protocol, '') = %s AND COALESCE(second_ip, '') = %s AND id <> %s AND %s
+        ORDER BY id LIMIT 1%s`,
+        d.placeholder(1), d.placeholder(2), d.placeholder(3), d.placeholder(4),
+        d.placeholder(5), d.placeholder(6), d.placeholder(7), activeRecordSQL(d), d.forUpdate)
+
+    var id int
+    err := tx.QueryRowContext(ctx, query, record.SetName, record.IP, record.CIDR, record.Port,
+        record.Protocol, record.SecondIP, record.ID).Scan(&id)
+    if err == sql.ErrNoRows {
+        return nil
+    }
+    if err != nil {
+        return fmt.Errorf("failed to check duplicates: %v", err)
+    }
+    return &DuplicateError{SetName: record.SetName, ID: id}
+}
@@ -0,0 +1,37 @@
+package storage
+
+import (
+    "time"
+    "ipset-api-server/internal/models"
+)
+
+// Срок действия записей. Запись с expires_at не позже текущего времени
+// считается истекшей: выборки ее не возвращают, а сервер периодически
+// удаляет такие записи через DeleteExpired, минуя корзину. Время
+// сравнивается на стороне базы, поэтому expires_at хранится в UTC, как и
+// остальные времена записей.
+
+// notExpiredSQL - условие "запись не истекла"
+func notExpiredSQL(d sqlDialect) string {
+    return "(expires_at IS NULL OR expires_at > " + d.now + ")"
+}
+
+// activeRecordSQL - условие для действующих записей SQL хранилищ: запись не
+// в корзине и не истекла
+func activeRecordSQL(d sqlDialect) string {
+    return "deleted_at IS NULL AND " + notExpiredSQL(d)
+}
+
+// nullTimeValue - значение колонки времени, которое может быть не задано
+// (expires_at, active_from): NULL или время в UTC
+func nullTimeValue(t *time.Time) interface{} {
+    if t == nil {
+        return nil
+    }
+    return t.UTC()
+}
+
+// isExpired - истекла ли запись к моменту now, для хранилищ в памяти
+func isExpired(record *models.IPSetRecord, now time.Time) bool {
+    return record.ExpiresAt != nil && !record.ExpiresAt.After(now)
+}
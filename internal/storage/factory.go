@@ -15,12 +15,27 @@ func NewKeyStorage(storageType string, cfg *config.Config) (KeyStorage, error) {
         return NewPostgreSQLKeyStorage(cfg)
     case "clickhouse":
         return NewClickHouseKeyStorage(cfg)
+    case "sqlite":
+        return NewSQLiteKeyStorage(cfg)
     default:
         return nil, fmt.Errorf("unsupported storage type: %s", storageType)
     }
 }
 
 func NewIPSetStorage(storageType string, cfg *config.Config) (IPSetStorage, error) {
+    backend, err := newIPSetBackend(storageType, cfg)
+    if err != nil {
+        return nil, err
+    }
+    
+    if cfg.IPSetCacheEnabled {
+        return NewCachedIPSetStorage(backend, cfg.IPSetCacheTTL), nil
+    }
+    
+    return backend, nil
+}
+
+func newIPSetBackend(storageType string, cfg *config.Config) (IPSetStorage, error) {
     switch storageType {
     case "file":
         return NewFileIPSetStorage(cfg.IPSetFilePath)
@@ -30,8 +45,65 @@ func NewIPSetStorage(storageType string, cfg *config.Config) (IPSetStorage, erro
         return NewPostgreSQLIPSetStorage(cfg)
     case "clickhouse":
         return NewClickHouseIPSetStorage(cfg)
+    case "sqlite":
+        return NewSQLiteIPSetStorage(cfg)
     default:
         return nil, fmt.Errorf("unsupported storage type: %s", storageType)
     }
 }
 
+// NewAuditStorage создает журнал аудита в том же хранилище, что и записи
+func NewAuditStorage(storageType string, cfg *config.Config) (AuditStorage, error) {
+    switch storageType {
+    case "file":
+        return NewFileAuditStorage(cfg.AuditFilePath)
+    case "mysql":
+        return NewMySQLAuditStorage(cfg)
+    case "postgresql":
+        return NewPostgreSQLAuditStorage(cfg)
+    case "clickhouse":
+        return NewClickHouseAuditStorage(cfg)
+    case "sqlite":
+        return NewSQLiteAuditStorage(cfg)
+    default:
+        return nil, fmt.Errorf("unsupported storage type: %s", storageType)
+    }
+}
+
+// NewWebhookStorage создает подписки и очередь доставок в том же
+// хранилище, что и записи
+func NewWebhookStorage(storageType string, cfg *config.Config) (WebhookStorage, error) {
+    switch storageType {
+    case "file":
+        return NewFileWebhookStorage(cfg.WebhooksFilePath)
+    case "mysql":
+        return NewMySQLWebhookStorage(cfg)
+    case "postgresql":
+        return NewPostgreSQLWebhookStorage(cfg)
+    case "clickhouse":
+        return NewClickHouseWebhookStorage(cfg)
+    case "sqlite":
+        return NewSQLiteWebhookStorage(cfg)
+    default:
+        return nil, fmt.Errorf("unsupported storage type: %s", storageType)
+    }
+}
+
+// NewAgentStorage создает реестр агентов и правила назначения в том же
+// хранилище, что и записи
+func NewAgentStorage(storageType string, cfg *config.Config) (AgentStorage, error) {
+    switch storageType {
+    case "file":
+        return NewFileAgentStorage(cfg.AgentsFilePath)
+    case "mysql":
+        return NewMySQLAgentStorage(cfg)
+    case "postgresql":
+        return NewPostgreSQLAgentStorage(cfg)
+    case "clickhouse":
+        return NewClickHouseAgentStorage(cfg)
+    case "sqlite":
+        return NewSQLiteAgentStorage(cfg)
+    default:
+        return nil, fmt.Errorf("unsupported storage type: %s", storageType)
+    }
+}
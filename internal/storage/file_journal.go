@@ -0,0 +1,113 @@
+package storage
+
+import (
+    "bytes"
+    "fmt"
+    "os"
+)
+
+// fileJournal - журнал JSON-строк рядом с файлом записей (история и поток
+// изменений файлового хранилища). Новые строки дописываются в конец, а не
+// перезаписывают журнал целиком. Журнал пишется до файла записей: если
+// файл записей записать не удалось, дописанное обрезается (rollback), а
+// строки, оставшиеся после сбоя, отбрасываются при чтении по номеру
+// последней записи файла.
+type fileJournal struct {
+    path string
+    // size - размер журнала после последней успешной записи, prev - до нее
+    size int64
+    prev int64
+    // lines - число строк в журнале
+    lines int
+    // broken - обрезать журнал не удалось, перед следующей записью его
+    // нужно переписать целиком
+    broken bool
+}
+
+func newFileJournal(path string) *fileJournal {
+    return &fileJournal{path: path}
+}
+
+// read читает строки журнала. Строка, которую не удалось разобрать
+// (недописанная при сбое), пропускается, и read возвращает dirty = true -
+// журнал стоит переписать.
+func (j *fileJournal) read(decode func(line []byte) error) (dirty bool, err error) {
+    data, err := os.ReadFile(j.path)
+    if os.IsNotExist(err) {
+        return false, nil
+    }
+    if err != nil {
+        return false, err
+    }
+
+    j.size, j.prev, j.lines = int64(len(data)), int64(len(data)), 0
+    for _, line := range bytes.Split(data, []byte("\n")) {
+        if len(bytes.TrimSpace(line)) == 0 {
+            continue
+        }
+        if err := decode(line); err != nil {
+            dirty = true
+            continue
+        }
+        j.lines++
+    }
+    return dirty, nil
+}
+
+// append дописывает строки и сбрасывает журнал на диск
+func (j *fileJournal) append(lines [][]byte) error {
+    j.prev = j.size
+    if len(lines) == 0 {
+        return nil
+    }
+
+    var buf bytes.Buffer
+    for _, line := range lines {
+        buf.Write(line)
+        buf.WriteByte('\n')
+    }
+
+    f, err := os.OpenFile(j.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+    if err != nil {
+        return fmt.Errorf("failed to open %s: %v", j.path, err)
+    }
+    _, err = f.Write(buf.Bytes())
+    if err == nil {
+        err = f.Sync()
+    }
+    if closeErr := f.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        j.rollback()
+        return fmt.Errorf("failed to append to %s: %v", j.path, err)
+    }
+
+    j.size += int64(buf.Len())
+    j.lines += len(lines)
+    return nil
+}
+
+// rollback обрезает строки, дописанные последним append
+func (j *fileJournal) rollback() {
+    if err := os.Truncate(j.path, j.prev); err != nil && !os.IsNotExist(err) {
+        j.broken = true
+        return
+    }
+    j.size = j.prev
+}
+
+// rewrite переписывает журнал целиком
+func (j *fileJournal) rewrite(lines [][]byte) error {
+    var buf bytes.Buffer
+    for _, line := range lines {
+        buf.Write(line)
+        buf.WriteByte('\n')
+    }
+    if err := writeFileAtomic(j.path, buf.Bytes(), 0644); err != nil {
+        return fmt.Errorf("failed to write %s: %v", j.path, err)
+    }
+
+    j.size, j.prev, j.lines, j.broken = int64(buf.Len()), int64(buf.Len()), len(lines), false
+    return nil
+}
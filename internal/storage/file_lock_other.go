@@ -0,0 +1,17 @@
+//go:build !unix
+
+package storage
+
+import (
+    "os"
+)
+
+// На платформах без flock блокировка ограничивается открытым lock-файлом,
+// защита от второго процесса в этом случае не обеспечивается
+func lockDataFile(path string) (*os.File, error) {
+    return os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+}
+
+func unlockDataFile(f *os.File) error {
+    return f.Close()
+}
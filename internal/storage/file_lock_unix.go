@@ -0,0 +1,36 @@
+//go:build unix
+
+package storage
+
+import (
+    "fmt"
+    "os"
+    "syscall"
+)
+
+// lockDataFile берет эксклюзивную advisory-блокировку (flock) на файл.
+// Блокировка снимается при закрытии файла или завершении процесса.
+func lockDataFile(path string) (*os.File, error) {
+    f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+    if err != nil {
+        return nil, err
+    }
+    
+    if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+        f.Close()
+        if err == syscall.EWOULDBLOCK {
+            return nil, fmt.Errorf("data file is used by another process")
+        }
+        return nil, err
+    }
+    
+    return f, nil
+}
+
+func unlockDataFile(f *os.File) error {
+    if err := syscall.Flock(int(f.Fd()), syscall.LOCK_UN); err != nil {
+        f.Close()
+        return err
+    }
+    return f.Close()
+}
@@ -1,30 +1,157 @@
 package storage
 
 import (
+    "bytes"
+    "context"
     "encoding/json"
     "fmt"
+    "net/netip"
     "os"
+    "path/filepath"
+    "sort"
     "sync"
     "time"
     "ipset-api-server/internal/models"
     "strings"
 )
+
+const (
+    minRecordID = 100000
+    maxRecordID = 999999
+)
+
 // FileKeyStorage - реализация для хранения ключей в файле
 type FileKeyStorage struct {
     filePath string
     mu       sync.RWMutex
 }
 
-// FileIPSetStorage - реализация для хранения ipset записей в файле
+// FileIPSetStorage - реализация для хранения ipset записей в файле.
+// Все операции чтения-изменения-записи выполняются под одной блокировкой,
+// файл перезаписывается атомарно, а на время жизни хранилища берется
+// эксклюзивная advisory-блокировка, чтобы второй процесс не испортил данные.
+// Поэтому содержимое файла хранится в памяти и читается с диска только при
+// запуске. История записей и поток изменений - в журналах рядом с файлом
+// (FILE.history.jsonl и FILE.changes.jsonl), в которые только дописываются
+// новые строки.
 type FileIPSetStorage struct {
     filePath string
     mu       sync.RWMutex
-    nextID   int
+    lockFile *os.File
+    
+    // state - содержимое файла после последней записи. Методы меняют его
+    // копию (readFileData), а writeData заменяет state записанной копией.
+    state *fileIPSetData
+    // history - история записей, changes - последние fileChangesLimit
+    // изменений потока
+    history map[int][]*models.RecordRevision
+    changes []*models.ChangeEvent
+    
+    historyLog *fileJournal
+    changesLog *fileJournal
+}
+
+// fileChangesLimit - сколько последних изменений потока хранит файловое
+// хранилище. Журнал изменений сжимается до этого размера, когда вырастает
+// вдвое; потребитель, отставший больше, получает ChangesExpiredError.
+const fileChangesLimit = 100000
+
+// fileIPSetData - формат файла с записями. Счетчик ID хранится вместе с
+// записями, чтобы не начинать нумерацию заново после перезапуска. Trash -
+// удаленные записи, которые еще можно вернуть, Sets - сеты, в том числе
+// пустые. Revision - номер последнего изменения потока, Commit - номер
+// записи файла, которым помечаются строки журнала истории.
+//
+// History и Changes в файле были до появления журналов: при запуске они
+// переносятся в журналы, а в копии состояния собирают новые ревизии и
+// изменения для writeData. changedSets - сеты, которые метод завел,
+// изменил или удалил (putSet, removeSet); измененные записи writeData
+// узнает по новым ревизиям истории.
+type fileIPSetData struct {
+    NextID   int                              `json:"next_id"`
+    Records  map[int]*models.IPSetRecord      `json:"records"`
+    Trash    map[int]*models.IPSetRecord      `json:"trash,omitempty"`
+    History  map[int][]*models.RecordRevision `json:"history,omitempty"`
+    Sets     map[string]*models.IPSetSet      `json:"sets,omitempty"`
+    Revision int64                            `json:"revision,omitempty"`
+    Commit   int64                            `json:"commit,omitempty"`
+    Changes  []*models.ChangeEvent            `json:"changes,omitempty"`
+    
+    changedSets map[string]bool
+}
+
+// putSet сохраняет сет под именем name и отмечает его для потока изменений
+func (d *fileIPSetData) putSet(name string, set *models.IPSetSet) {
+    d.Sets[name] = set
+    d.markSet(name)
+}
+
+// removeSet удаляет сет и отмечает его для потока изменений
+func (d *fileIPSetData) removeSet(name string) {
+    delete(d.Sets, name)
+    d.markSet(name)
+}
+
+func (d *fileIPSetData) markSet(name string) {
+    if d.changedSets == nil {
+        d.changedSets = make(map[string]bool)
+    }
+    d.changedSets[name] = true
+}
+
+// fileHistoryEntry - строка журнала истории: ревизия записи и номер записи
+// файла, с которой она сохранена
+type fileHistoryEntry struct {
+    Commit int64 `json:"commit"`
+    *models.RecordRevision
+}
+
+// writeFileAtomic записывает данные во временный файл рядом с целевым,
+// сбрасывает его на диск и переименовывает поверх целевого файла
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+    dir := filepath.Dir(path)
+    
+    tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+    if err != nil {
+        return err
+    }
+    tmpName := tmp.Name()
+    
+    // Удаляем временный файл, если до переименования что-то пошло не так
+    defer os.Remove(tmpName)
+    
+    if _, err := tmp.Write(data); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Chmod(perm); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Sync(); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        return err
+    }
+    
+    if err := os.Rename(tmpName, path); err != nil {
+        return err
+    }
+    
+    // Сбрасываем каталог, чтобы переименование пережило сбой питания
+    if d, err := os.Open(dir); err == nil {
+        d.Sync()
+        d.Close()
+    }
+    
+    return nil
 }
 
 func NewFileKeyStorage(filePath string) (*FileKeyStorage, error) {
     // Создаем директорию если не существует
-    if err := os.MkdirAll("data", 0755); err != nil {
+    if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
         return nil, err
     }
     
@@ -40,9 +167,12 @@ func NewFileKeyStorage(filePath string) (*FileKeyStorage, error) {
     }, nil
 }
 
-func (s *FileKeyStorage) readKeys() (map[string]*models.AuthKey, error) {
-    s.mu.RLock()
-    defer s.mu.RUnlock()
+// readKeys и writeKeys вызываются под s.mu. Если запрос отменили, пока
+// ждали блокировку, файл не читается.
+func (s *FileKeyStorage) readKeys(ctx context.Context) (map[string]*models.AuthKey, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
     
     data, err := os.ReadFile(s.filePath)
     if err != nil {
@@ -53,24 +183,27 @@ func (s *FileKeyStorage) readKeys() (map[string]*models.AuthKey, error) {
     if err := json.Unmarshal(data, &keys); err != nil {
         return nil, err
     }
+    if keys == nil {
+        keys = make(map[string]*models.AuthKey)
+    }
     
     return keys, nil
 }
 
 func (s *FileKeyStorage) writeKeys(keys map[string]*models.AuthKey) error {
-    s.mu.Lock()
-    defer s.mu.Unlock()
-    
     data, err := json.MarshalIndent(keys, "", "  ")
     if err != nil {
         return err
     }
     
-    return os.WriteFile(s.filePath, data, 0644)
+    return writeFileAtomic(s.filePath, data, 0644)
 }
 
-func (s *FileKeyStorage) GetKey(key string) (*models.AuthKey, error) {
-    keys, err := s.readKeys()
+func (s *FileKeyStorage) GetKey(ctx context.Context, key string) (*models.AuthKey, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    
+    keys, err := s.readKeys(ctx)
     if err != nil {
         return nil, err
     }
@@ -78,8 +211,11 @@ func (s *FileKeyStorage) GetKey(key string) (*models.AuthKey, error) {
     return keys[key], nil
 }
 
-func (s *FileKeyStorage) SaveKey(key *models.AuthKey) error {
-    keys, err := s.readKeys()
+func (s *FileKeyStorage) SaveKey(ctx context.Context, key *models.AuthKey) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    keys, err := s.readKeys(ctx)
     if err != nil {
         return err
     }
@@ -88,8 +224,11 @@ func (s *FileKeyStorage) SaveKey(key *models.AuthKey) error {
     return s.writeKeys(keys)
 }
 
-func (s *FileKeyStorage) DeleteKey(key string) error {
-    keys, err := s.readKeys()
+func (s *FileKeyStorage) DeleteKey(ctx context.Context, key string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    keys, err := s.readKeys(ctx)
     if err != nil {
         return err
     }
@@ -98,8 +237,11 @@ func (s *FileKeyStorage) DeleteKey(key string) error {
     return s.writeKeys(keys)
 }
 
-func (s *FileKeyStorage) ListKeys() ([]*models.AuthKey, error) {
-    keys, err := s.readKeys()
+func (s *FileKeyStorage) ListKeys(ctx context.Context) ([]*models.AuthKey, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    
+    keys, err := s.readKeys(ctx)
     if err != nil {
         return nil, err
     }
@@ -113,231 +255,2100 @@ func (s *FileKeyStorage) ListKeys() ([]*models.AuthKey, error) {
 }
 
 func NewFileIPSetStorage(filePath string) (*FileIPSetStorage, error) {
-    if err := os.MkdirAll("data", 0755); err != nil {
+    if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
         return nil, err
     }
     
+    // Не даем второму процессу работать с тем же файлом
+    lockFile, err := lockDataFile(filePath + ".lock")
+    if err != nil {
+        return nil, fmt.Errorf("failed to lock %s: %v", filePath, err)
+    }
+    
     storage := &FileIPSetStorage{
-        filePath: filePath,
-        nextID:   100000, // Начинаем с 6-значных чисел
+        filePath:   filePath,
+        lockFile:   lockFile,
+        state:      emptyFileData(),
+        history:    make(map[int][]*models.RecordRevision),
+        historyLog: newFileJournal(filePath + ".history.jsonl"),
+        changesLog: newFileJournal(filePath + ".changes.jsonl"),
     }
     
     // Создаем файл если не существует
     if _, err := os.Stat(filePath); os.IsNotExist(err) {
-        if err := storage.writeRecords(map[int]*models.IPSetRecord{}); err != nil {
+        if err := storage.writeData(emptyFileData()); err != nil {
+            storage.Close()
             return nil, err
         }
+    } else if err := storage.load(); err != nil {
+        storage.Close()
+        return nil, err
+    } else if err := storage.restoreNextID(); err != nil {
+        storage.Close()
+        return nil, err
+    } else if err := storage.backfillHistory(); err != nil {
+        storage.Close()
+        return nil, err
+    } else if err := storage.backfillSets(); err != nil {
+        storage.Close()
+        return nil, err
+    } else if err := storage.backfillChanges(); err != nil {
+        storage.Close()
+        return nil, err
     }
     
     return storage, nil
 }
 
-func (s *FileIPSetStorage) readRecords() (map[int]*models.IPSetRecord, error) {
-    s.mu.RLock()
-    defer s.mu.RUnlock()
+// Close снимает блокировку файла данных
+func (s *FileIPSetStorage) Close() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
     
+    if s.lockFile == nil {
+        return nil
+    }
+    err := unlockDataFile(s.lockFile)
+    s.lockFile = nil
+    return err
+}
+
+// readData читает файл с записями. Файл старого формата (просто объект
+// с записями без счетчика) читается как раньше, счетчик в нем равен нулю.
+func (s *FileIPSetStorage) readData() (*fileIPSetData, error) {
     data, err := os.ReadFile(s.filePath)
     if err != nil {
         return nil, err
     }
     
-    var records map[int]*models.IPSetRecord
-    if err := json.Unmarshal(data, &records); err != nil {
+    var raw map[string]json.RawMessage
+    if err := json.Unmarshal(data, &raw); err != nil {
         return nil, err
     }
     
-    return records, nil
-}
-
-func (s *FileIPSetStorage) writeRecords(records map[int]*models.IPSetRecord) error {
-    s.mu.Lock()
-    defer s.mu.Unlock()
+    fileData := &fileIPSetData{}
+    if _, ok := raw["records"]; ok {
+        if err := json.Unmarshal(data, fileData); err != nil {
+            return nil, err
+        }
+    } else if err := json.Unmarshal(data, &fileData.Records); err != nil {
+        return nil, err
+    }
     
-    data, err := json.MarshalIndent(records, "", "  ")
-    if err != nil {
-        return err
+    if fileData.Records == nil {
+        fileData.Records = make(map[int]*models.IPSetRecord)
+    }
+    if fileData.Trash == nil {
+        fileData.Trash = make(map[int]*models.IPSetRecord)
+    }
+    if fileData.History == nil {
+        fileData.History = make(map[int][]*models.RecordRevision)
+    }
+    if fileData.Sets == nil {
+        fileData.Sets = make(map[string]*models.IPSetSet)
     }
     
-    return os.WriteFile(s.filePath, data, 0644)
+    return fileData, nil
+}
+
+func emptyFileData() *fileIPSetData {
+    return &fileIPSetData{
+        Records: make(map[int]*models.IPSetRecord),
+        Trash:   make(map[int]*models.IPSetRecord),
+        History: make(map[int][]*models.RecordRevision),
+        Sets:    make(map[string]*models.IPSetSet),
+    }
 }
 
-func (s *FileIPSetStorage) Create(record *models.IPSetRecord) error {
-    records, err := s.readRecords()
+// load читает файл и журналы при запуске. Строки журналов, записанные после
+// последней записи файла (сбой между журналом и файлом), отбрасываются.
+// История и поток из файла старого формата переносятся в журналы.
+func (s *FileIPSetStorage) load() error {
+    fileData, err := s.readData()
     if err != nil {
         return err
     }
     
-    // Генерируем 6-значный ID
-    for s.nextID < 1000000 {
-        if _, exists := records[s.nextID]; !exists {
-            record.ID = s.nextID
-            s.nextID++
-            break
+    // Отброшенная строка, как и недописанная, делает журнал грязным
+    dirtyHistory, err := s.historyLog.read(func(line []byte) error {
+        var entry fileHistoryEntry
+        if err := json.Unmarshal(line, &entry); err != nil || entry.RecordRevision == nil {
+            return fmt.Errorf("invalid history entry")
+        }
+        if entry.Commit > fileData.Commit {
+            return fmt.Errorf("history entry after commit %d", fileData.Commit)
+        }
+        s.history[entry.Record.ID] = append(s.history[entry.Record.ID], entry.RecordRevision)
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+    dirtyChanges, err := s.changesLog.read(func(line []byte) error {
+        var change models.ChangeEvent
+        if err := json.Unmarshal(line, &change); err != nil {
+            return err
+        }
+        if change.Revision > fileData.Revision {
+            return fmt.Errorf("change after revision %d", fileData.Revision)
         }
-        s.nextID++
+        s.changes = append(s.changes, &change)
+        return nil
+    })
+    if err != nil {
+        return err
     }
     
-    now := time.Now()
-    record.CreatedAt = now
-    record.UpdatedAt = now
-    records[record.ID] = record
+    legacy := len(fileData.History) > 0 || len(fileData.Changes) > 0
+    if legacy {
+        s.history = fileData.History
+        s.changes = fileData.Changes
+    }
+    if len(s.changes) > fileChangesLimit {
+        s.changes = append([]*models.ChangeEvent{}, s.changes[len(s.changes)-fileChangesLimit:]...)
+    }
+    if legacy || dirtyHistory {
+        if err := s.historyLog.rewrite(s.historyLines(fileData.Commit)); err != nil {
+            return err
+        }
+    }
+    if legacy || dirtyChanges {
+        if err := s.changesLog.rewrite(changeLines(s.changes)); err != nil {
+            return err
+        }
+    }
     
-    return s.writeRecords(records)
+    fileData.History = nil
+    fileData.Changes = nil
+    s.state = fileData
+    if legacy {
+        // Файл без истории и потока; номер записи не меняется, так что
+        // перенесенные строки журналов остаются действительными
+        return s.writeState(fileData)
+    }
+    return nil
 }
 
-func (s *FileIPSetStorage) GetByID(id int) (*models.IPSetRecord, error) {
-    records, err := s.readRecords()
-    if err != nil {
-        return nil, err
+// historyLines - вся история для переписывания журнала: по ID записи,
+// ревизии одной записи - по порядку
+func (s *FileIPSetStorage) historyLines(commit int64) [][]byte {
+    ids := make([]int, 0, len(s.history))
+    for id := range s.history {
+        ids = append(ids, id)
     }
+    sort.Ints(ids)
     
-    record, exists := records[id]
-    if !exists {
-        return nil, fmt.Errorf("record with id %d not found", id)
+    var lines [][]byte
+    for _, id := range ids {
+        for _, revision := range s.history[id] {
+            if data, err := json.Marshal(&fileHistoryEntry{Commit: commit, RecordRevision: revision}); err == nil {
+                lines = append(lines, data)
+            }
+        }
     }
-    
-    return record, nil
+    return lines
 }
 
-func (s *FileIPSetStorage) GetAll() ([]*models.IPSetRecord, error) {
-    records, err := s.readRecords()
-    if err != nil {
-        return nil, err
+func changeLines(changes []*models.ChangeEvent) [][]byte {
+    lines := make([][]byte, 0, len(changes))
+    for _, change := range changes {
+        if data, err := json.Marshal(change); err == nil {
+            lines = append(lines, data)
+        }
     }
+    return lines
+}
+
+// restoreNextID восстанавливает счетчик ID из файла. Для файлов старого
+// формата счетчик продолжается после максимального существующего ID.
+func (s *FileIPSetStorage) restoreNextID() error {
+    fileData := s.state
     
-    result := make([]*models.IPSetRecord, 0, len(records))
-    for _, record := range records {
-        result = append(result, record)
+    // Начинаем с 6-значных чисел
+    if fileData.NextID < minRecordID {
+        fileData.NextID = minRecordID
+    }
+    for _, records := range []map[int]*models.IPSetRecord{fileData.Records, fileData.Trash} {
+        for id := range records {
+            if id >= fileData.NextID && id < maxRecordID {
+                fileData.NextID = id + 1
+            }
+        }
     }
     
-    return result, nil
+    return nil
 }
 
-func (s *FileIPSetStorage) GetBySetName(setName string) ([]*models.IPSetRecord, error) {
-    records, err := s.readRecords()
-    if err != nil {
-        return nil, err
-    }
+// backfillHistory заводит первую ревизию записям без истории - так же, как
+// миграция SQL хранилищ для записей, созданных до появления истории
+func (s *FileIPSetStorage) backfillHistory() error {
+    fileData := s.clone()
     
-    var result []*models.IPSetRecord
-    for _, record := range records {
-        if record.SetName == setName {
-            result = append(result, record)
+    changed := false
+    for id, record := range fileData.Records {
+        if len(fileData.History[id]) == 0 {
+            appendRevision(fileData.History, models.RevisionCreate, record.CreatedAt, record)
+            changed = true
         }
     }
     
-    if len(result) == 0 {
-        return nil, fmt.Errorf("set %s not found", setName)
+    if !changed {
+        return nil
+    }
+    return s.writeData(fileData)
+}
+
+// backfillSets заводит сеты записям из файлов, записанных до появления
+// раздела sets
+func (s *FileIPSetStorage) backfillSets() error {
+    fileData := s.clone()
+    
+    count := len(fileData.Sets)
+    for _, record := range fileData.Records {
+        ensureFileSet(fileData, record, record.CreatedAt)
     }
     
-    return result, nil
+    if len(fileData.Sets) == count {
+        return nil
+    }
+    return s.writeData(fileData)
 }
 
-func (s *FileIPSetStorage) GetAllSets() ([]*models.IPSetSet, error) {
-    records, err := s.readRecords()
-    if err != nil {
-        return nil, err
+// backfillChanges заводит поток изменений файлу, записанному до его
+// появления: как и миграция SQL хранилищ, поток начинается с создания
+// существующих сетов и записей
+func (s *FileIPSetStorage) backfillChanges() error {
+    fileData := s.clone()
+    
+    if !fileChangesMissing(fileData) {
+        return nil
+    }
+    ids := make([]int, 0, len(fileData.Records))
+    for id := range fileData.Records {
+        ids = append(ids, id)
+    }
+    sort.Ints(ids)
+    for name := range fileData.Sets {
+        fileData.markSet(name)
+    }
+    appendChanges(fileData, &fileIPSetData{}, ids, time.Now().UTC())
+    return s.writeData(fileData)
+}
+
+// fileChangesMissing - в файле есть данные, но нет потока изменений
+func fileChangesMissing(fileData *fileIPSetData) bool {
+    return fileData.Revision == 0 && (len(fileData.Records) > 0 || len(fileData.Sets) > 0)
+}
+
+// appendChanges дописывает в поток изменения, которые сделал метод: сеты
+// next.changedSets и записи ids (по возрастанию). Вид изменения - по
+// сохраненному состоянию prev: сначала созданные и измененные сеты, затем
+// удаленные записи, созданные и измененные записи и удаленные сеты.
+// Перенос в корзину и окончательное удаление записи одинаково дают
+// удаление, изменения записей в корзине в поток не попадают.
+func appendChanges(next, prev *fileIPSetData, ids []int, at time.Time) {
+    add := func(change *models.ChangeEvent) {
+        next.Revision++
+        change.Revision = next.Revision
+        change.ChangedAt = at
+        next.Changes = append(next.Changes, change)
     }
     
-    setMap := make(map[string]*models.IPSetSet)
+    names := make([]string, 0, len(next.changedSets))
+    for name := range next.changedSets {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        set, exists := next.Sets[name]
+        if !exists {
+            continue
+        }
+        if _, existed := prev.Sets[name]; existed {
+            add(changeOfSet(models.RevisionUpdate, set))
+        } else {
+            add(changeOfSet(models.RevisionCreate, set))
+        }
+    }
     
-    for _, record := range records {
-        if set, exists := setMap[record.SetName]; exists {
-            set.Records = append(set.Records, *record)
-            if record.UpdatedAt.After(set.UpdatedAt) {
-                set.UpdatedAt = record.UpdatedAt
-            }
+    for _, id := range ids {
+        if _, exists := next.Records[id]; !exists && prev.Records[id] != nil {
+            add(changeOfRecord(models.RevisionDelete, prev.Records[id]))
+        }
+    }
+    for _, id := range ids {
+        record, exists := next.Records[id]
+        if !exists {
+            continue
+        }
+        if _, existed := prev.Records[id]; existed {
+            add(changeOfRecord(models.RevisionUpdate, record))
         } else {
-            setMap[record.SetName] = &models.IPSetSet{
-                Name:      record.SetName,
-                Type:      record.SetType,
-                Options:   record.SetOptions,
-                Records:   []models.IPSetRecord{*record},
-                CreatedAt: record.CreatedAt,
-                UpdatedAt: record.UpdatedAt,
-            }
+            add(changeOfRecord(models.RevisionCreate, record))
         }
     }
     
-    result := make([]*models.IPSetSet, 0, len(setMap))
-    for _, set := range setMap {
-        result = append(result, set)
+    for _, name := range names {
+        if _, exists := next.Sets[name]; !exists && prev.Sets[name] != nil {
+            add(changeOfSet(models.RevisionDelete, prev.Sets[name]))
+        }
+    }
+}
+
+// ensureFileSet заводит сет записи, если его еще нет
+func ensureFileSet(fileData *fileIPSetData, record *models.IPSetRecord, at time.Time) {
+    if _, exists := fileData.Sets[record.SetName]; !exists {
+        fileData.putSet(record.SetName, recordSet(record, at))
+    }
+}
+
+// fileDuplicate ищет другую действующую запись сета с тем же элементом,
+// что у записи record
+func fileDuplicate(fileData *fileIPSetData, record *models.IPSetRecord, at time.Time) error {
+    key := EntryKey(record)
+    duplicate := 0
+    for id, other := range fileData.Records {
+        if id == record.ID || other.SetName != record.SetName || isExpired(other, at) || EntryKey(other) != key {
+            continue
+        }
+        if duplicate == 0 || id < duplicate {
+            duplicate = id
+        }
+    }
+    if duplicate != 0 {
+        return &DuplicateError{SetName: record.SetName, ID: duplicate}
+    }
+    return nil
+}
+
+// readFileData, readRecords и writeData вызываются под s.mu. Файл заблокирован
+// для других процессов, поэтому состояние в памяти совпадает с сохраненным.
+func (s *FileIPSetStorage) readFileData(ctx context.Context) (*fileIPSetData, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
     }
     
-    return result, nil
+    return s.clone(), nil
+}
+
+// clone - копия состояния, которую метод может менять и отдавать наружу:
+// записи и сеты копируются, срезы истории - без запаса емкости, чтобы
+// appendRevision не дописал в общий массив. Changes копии пуст - в нем
+// writeData собирает новые изменения.
+func (s *FileIPSetStorage) clone() *fileIPSetData {
+    fileData := &fileIPSetData{
+        NextID:   s.state.NextID,
+        Records:  make(map[int]*models.IPSetRecord, len(s.state.Records)),
+        Trash:    make(map[int]*models.IPSetRecord, len(s.state.Trash)),
+        History:  make(map[int][]*models.RecordRevision, len(s.history)),
+        Sets:     make(map[string]*models.IPSetSet, len(s.state.Sets)),
+        Revision: s.state.Revision,
+        Commit:   s.state.Commit,
+    }
+    for id, record := range s.state.Records {
+        copied := *record
+        fileData.Records[id] = &copied
+    }
+    for id, record := range s.state.Trash {
+        copied := *record
+        fileData.Trash[id] = &copied
+    }
+    for name, set := range s.state.Sets {
+        copied := *set
+        fileData.Sets[name] = &copied
+    }
+    for id, revisions := range s.history {
+        fileData.History[id] = revisions[:len(revisions):len(revisions)]
+    }
+    return fileData
 }
 
-func (s *FileIPSetStorage) Update(id int, record *models.IPSetRecord) error {
-    records, err := s.readRecords()
+// readRecords возвращает действующие записи: истекшие записи, которые еще
+// не удалил DeleteExpired, пропускаются
+func (s *FileIPSetStorage) readRecords(ctx context.Context) (map[int]*models.IPSetRecord, error) {
+    fileData, err := s.readFileData(ctx)
     if err != nil {
-        return err
+        return nil, err
     }
     
-    existing, exists := records[id]
-    if !exists {
-        return fmt.Errorf("record with id %d not found", id)
+    now := time.Now()
+    for id, record := range fileData.Records {
+        if isExpired(record, now) {
+            delete(fileData.Records, id)
+        }
     }
     
-    record.ID = id
-    record.CreatedAt = existing.CreatedAt
-    record.UpdatedAt = time.Now()
-    records[id] = record
-    
-    return s.writeRecords(records)
+    return fileData.Records, nil
 }
 
-func (s *FileIPSetStorage) Delete(id int) error {
-    records, err := s.readRecords()
-    if err != nil {
+// writeData сохраняет измененную копию состояния: дописывает в журналы
+// новые ревизии истории и изменения потока, затем перезаписывает файл
+// записей. Если файл записать не удалось, дописанное в журналы обрезается
+// и состояние в памяти не меняется.
+func (s *FileIPSetStorage) writeData(fileData *fileIPSetData) error {
+    if fileData.Records == nil {
+        fileData.Records = make(map[int]*models.IPSetRecord)
+    }
+    fileData.Commit = s.state.Commit + 1
+    
+    // Новые ревизии - дописанные в копию истории после ревизий в памяти
+    var revisions []*models.RecordRevision
+    for id, history := range fileData.History {
+        revisions = append(revisions, history[len(s.history[id]):]...)
+    }
+    sort.SliceStable(revisions, func(i, j int) bool {
+        return revisions[i].Record.ID < revisions[j].Record.ID
+    })
+    
+    // Каждое изменение записи пишет ревизию истории, поэтому в поток идут
+    // записи новых ревизий и отмеченные сеты. Файлу без потока поток
+    // заводит backfillChanges.
+    if !fileChangesMissing(s.state) {
+        var ids []int
+        for _, revision := range revisions {
+            if len(ids) == 0 || ids[len(ids)-1] != revision.Record.ID {
+                ids = append(ids, revision.Record.ID)
+            }
+        }
+        appendChanges(fileData, s.state, ids, time.Now().UTC())
+    }
+    var historyLines [][]byte
+    for _, revision := range revisions {
+        data, err := json.Marshal(&fileHistoryEntry{Commit: fileData.Commit, RecordRevision: revision})
+        if err != nil {
+            return err
+        }
+        historyLines = append(historyLines, data)
+    }
+    
+    if err := s.repairJournals(); err != nil {
+        return err
+    }
+    if err := s.historyLog.append(historyLines); err != nil {
+        return err
+    }
+    if err := s.changesLog.append(changeLines(fileData.Changes)); err != nil {
+        s.historyLog.rollback()
+        return err
+    }
+    if err := s.writeState(fileData); err != nil {
+        s.historyLog.rollback()
+        s.changesLog.rollback()
         return err
     }
     
-    if _, exists := records[id]; !exists {
-        return fmt.Errorf("record with id %d not found", id)
+    for _, revision := range revisions {
+        s.history[revision.Record.ID] = append(s.history[revision.Record.ID], revision)
     }
+    s.changes = append(s.changes, fileData.Changes...)
+    if len(s.changes) > fileChangesLimit {
+        s.changes = append([]*models.ChangeEvent{}, s.changes[len(s.changes)-fileChangesLimit:]...)
+    }
+    fileData.History = nil
+    fileData.Changes = nil
+    fileData.changedSets = nil
+    s.state = fileData
     
-    delete(records, id)
-    return s.writeRecords(records)
+    // Сжатие журнала изменений: изменение уже сохранено, ошибка сжатия
+    // только откладывает его до следующей записи
+    if s.changesLog.lines > 2*fileChangesLimit {
+        s.changesLog.rewrite(changeLines(s.changes))
+    }
+    return nil
 }
 
-func (s *FileIPSetStorage) DeleteSet(setName string) error {
-    records, err := s.readRecords()
+// writeState перезаписывает файл записей без истории и потока
+func (s *FileIPSetStorage) writeState(fileData *fileIPSetData) error {
+    saved := *fileData
+    saved.History = nil
+    saved.Changes = nil
+    
+    data, err := json.MarshalIndent(&saved, "", "  ")
     if err != nil {
         return err
     }
     
-    found := false
-    for id, record := range records {
-        if record.SetName == setName {
-            delete(records, id)
-            found = true
+    return writeFileAtomic(s.filePath, data, 0644)
+}
+
+// repairJournals переписывает из памяти журналы, которые не удалось обрезать
+// после неудачной записи
+func (s *FileIPSetStorage) repairJournals() error {
+    if s.historyLog.broken {
+        if err := s.historyLog.rewrite(s.historyLines(s.state.Commit)); err != nil {
+            return err
+        }
+    }
+    if s.changesLog.broken {
+        if err := s.changesLog.rewrite(changeLines(s.changes)); err != nil {
+            return err
         }
     }
+    return nil
+}
+
+// allocateID выдает следующий свободный 6-значный ID, при переполнении
+// начиная поиск с начала диапазона. ID записей из корзины заняты. Счетчик
+// сдвигается в копии fileData и сохраняется вместе с ней, поэтому
+// неудачная запись не расходует ID.
+func (s *FileIPSetStorage) allocateID(fileData *fileIPSetData) (int, error) {
+    if fileData.NextID < minRecordID || fileData.NextID > maxRecordID {
+        fileData.NextID = minRecordID
+    }
     
-    if !found {
-        return fmt.Errorf("set %s not found", setName)
+    for i := 0; i <= maxRecordID-minRecordID; i++ {
+        id := fileData.NextID
+        fileData.NextID++
+        if fileData.NextID > maxRecordID {
+            fileData.NextID = minRecordID
+        }
+        _, exists := fileData.Records[id]
+        _, trashed := fileData.Trash[id]
+        if !exists && !trashed {
+            return id, nil
+        }
     }
     
-    return s.writeRecords(records)
+    return 0, fmt.Errorf("no available IDs in range %d-%d", minRecordID, maxRecordID)
 }
 
-func (s *FileIPSetStorage) Search(query string) ([]*models.IPSetRecord, error) {
-    records, err := s.readRecords()
+func (s *FileIPSetStorage) Create(ctx context.Context, record *models.IPSetRecord) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    fileData, err := s.readFileData(ctx)
     if err != nil {
-        return nil, err
+        return err
     }
     
-    var result []*models.IPSetRecord
-    query = strings.ToLower(query)
+    now := time.Now()
+    if err := fileDuplicate(fileData, record, now); err != nil {
+        return err
+    }
     
-    for _, record := range records {
-        if strings.Contains(strings.ToLower(record.Context), query) ||
-           strings.Contains(strings.ToLower(record.Description), query) ||
-           strings.Contains(strings.ToLower(record.IP), query) ||
-           strings.Contains(strings.ToLower(record.SetName), query) {
-            result = append(result, record)
-        }
+    // Генерируем 6-значный ID
+    id, err := s.allocateID(fileData)
+    if err != nil {
+        return err
     }
     
+    record.ID = id
+    record.CreatedAt = now
+    record.UpdatedAt = now
+    fileData.Records[record.ID] = record
+    appendRevision(fileData.History, models.RevisionCreate, now, record)
+    ensureFileSet(fileData, record, now)
+    
+    return s.writeData(fileData)
+}
+
+func (s *FileIPSetStorage) ImportRecord(ctx context.Context, record *models.IPSetRecord) error {
+    if record.ID < minRecordID || record.ID > maxRecordID {
+        return fmt.Errorf("record id %d is out of range %d-%d", record.ID, minRecordID, maxRecordID)
+    }
+    
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    fileData, err := s.readFileData(ctx)
+    if err != nil {
+        return err
+    }
+    
+    if err := fileDuplicate(fileData, record, time.Now()); err != nil {
+        return err
+    }
+    
+    operation := models.RevisionCreate
+    if _, exists := fileData.Records[record.ID]; exists {
+        operation = models.RevisionUpdate
+    }
+    
+    copied := *record
+    copied.DeletedAt = nil
+    fileData.Records[copied.ID] = &copied
+    delete(fileData.Trash, copied.ID)
+    appendRevision(fileData.History, operation, copied.UpdatedAt, &copied)
+    ensureFileSet(fileData, &copied, copied.CreatedAt)
+    if copied.ID >= fileData.NextID && copied.ID < maxRecordID {
+        fileData.NextID = copied.ID + 1
+    }
+    
+    return s.writeData(fileData)
+}
+
+func (s *FileIPSetStorage) GetByID(ctx context.Context, id int) (*models.IPSetRecord, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    
+    records, err := s.readRecords(ctx)
+    if err != nil {
+        return nil, err
+    }
+    
+    record, exists := records[id]
+    if !exists {
+        return nil, fmt.Errorf("record with id %d not found", id)
+    }
+    
+    return record, nil
+}
+
+func (s *FileIPSetStorage) GetAll(ctx context.Context) ([]*models.IPSetRecord, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    
+    records, err := s.readRecords(ctx)
+    if err != nil {
+        return nil, err
+    }
+    
+    result := make([]*models.IPSetRecord, 0, len(records))
+    for _, record := range records {
+        result = append(result, record)
+    }
+    
+    return result, nil
+}
+
+func (s *FileIPSetStorage) GetBySetName(ctx context.Context, setName string) ([]*models.IPSetRecord, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    
+    records, err := s.readRecords(ctx)
+    if err != nil {
+        return nil, err
+    }
+    
+    var result []*models.IPSetRecord
+    for _, record := range records {
+        if record.SetName == setName {
+            result = append(result, record)
+        }
+    }
+    
+    if len(result) == 0 {
+        return nil, fmt.Errorf("set %s not found", setName)
+    }
+    
+    return result, nil
+}
+
+func (s *FileIPSetStorage) GetAllSets(ctx context.Context) ([]*models.IPSetSet, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    
+    fileData, err := s.readFileData(ctx)
+    if err != nil {
+        return nil, err
+    }
+    
+    counts := make(map[string]int)
+    now := time.Now()
+    for _, record := range fileData.Records {
+        if !isExpired(record, now) {
+            counts[record.SetName]++
+        }
+    }
+    
+    result := make([]*models.IPSetSet, 0, len(fileData.Sets))
+    for name, set := range fileData.Sets {
+        set.RecordCount = counts[name]
+        result = append(result, set)
+    }
+    
+    sort.Slice(result, func(i, j int) bool {
+        return result[i].Name < result[j].Name
+    })
+    
     return result, nil
 }
+
+func (s *FileIPSetStorage) CreateSet(ctx context.Context, set *models.IPSetSet) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    fileData, err := s.readFileData(ctx)
+    if err != nil {
+        return err
+    }
+    
+    if _, exists := fileData.Sets[set.Name]; exists {
+        return fmt.Errorf("set %s already exists", set.Name)
+    }
+    
+    now := time.Now()
+    set.CreatedAt = now
+    set.UpdatedAt = now
+    copied := *set
+    fileData.putSet(set.Name, &copied)
+    
+    return s.writeData(fileData)
+}
+
+func (s *FileIPSetStorage) ImportSet(ctx context.Context, set *models.IPSetSet) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    fileData, err := s.readFileData(ctx)
+    if err != nil {
+        return err
+    }
+    
+    copied := *set
+    copied.RecordCount = 0
+    copied.Records = nil
+    fileData.putSet(set.Name, &copied)
+    
+    return s.writeData(fileData)
+}
+
+func (s *FileIPSetStorage) GetSet(ctx context.Context, name string) (*models.IPSetSet, error) {
+    sets, err := s.GetAllSets(ctx)
+    if err != nil {
+        return nil, err
+    }
+    
+    for _, set := range sets {
+        if set.Name == name {
+            return set, nil
+        }
+    }
+    
+    return nil, fmt.Errorf("set %s not found", name)
+}
+
+func (s *FileIPSetStorage) UpdateSet(ctx context.Context, set *models.IPSetSet) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    fileData, err := s.readFileData(ctx)
+    if err != nil {
+        return err
+    }
+    
+    existing, exists := fileData.Sets[set.Name]
+    if !exists {
+        return fmt.Errorf("set %s not found", set.Name)
+    }
+    
+    set.CreatedAt = existing.CreatedAt
+    set.UpdatedAt = time.Now()
+    copied := *set
+    copied.RecordCount = 0
+    copied.Records = nil
+    fileData.putSet(set.Name, &copied)
+    
+    return s.writeData(fileData)
+}
+
+// setRecordIDs - ID действующих записей сета по возрастанию
+func setRecordIDs(fileData *fileIPSetData, setName string, at time.Time) []int {
+    var ids []int
+    for id, record := range fileData.Records {
+        if record.SetName == setName && !isExpired(record, at) {
+            ids = append(ids, id)
+        }
+    }
+    sort.Ints(ids)
+    return ids
+}
+
+// RenameSet, CopySet и SwapSets меняют файл одной записью под s.mu, поэтому
+// другие запросы не видят промежуточного состояния
+func (s *FileIPSetStorage) RenameSet(ctx context.Context, from, to string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    fileData, err := s.readFileData(ctx)
+    if err != nil {
+        return err
+    }
+    
+    set, exists := fileData.Sets[from]
+    if !exists {
+        return fmt.Errorf("set %s not found", from)
+    }
+    if _, exists := fileData.Sets[to]; exists {
+        return fmt.Errorf("set %s already exists", to)
+    }
+    
+    now := time.Now()
+    fileData.removeSet(from)
+    set.Name = to
+    set.UpdatedAt = now
+    fileData.putSet(to, set)
+    for _, id := range setRecordIDs(fileData, from, now) {
+        record := fileData.Records[id]
+        record.SetName = to
+        record.UpdatedAt = now
+        appendRevision(fileData.History, models.RevisionUpdate, now, record)
+    }
+    
+    return s.writeData(fileData)
+}
+
+func (s *FileIPSetStorage) CopySet(ctx context.Context, from, to string) ([]*models.IPSetRecord, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    fileData, err := s.readFileData(ctx)
+    if err != nil {
+        return nil, err
+    }
+    
+    set, exists := fileData.Sets[from]
+    if !exists {
+        return nil, fmt.Errorf("set %s not found", from)
+    }
+    if _, exists := fileData.Sets[to]; exists {
+        return nil, fmt.Errorf("set %s already exists", to)
+    }
+    
+    now := time.Now()
+    copiedSet := *set
+    copiedSet.Name = to
+    copiedSet.CreatedAt = now
+    copiedSet.UpdatedAt = now
+    fileData.putSet(to, &copiedSet)
+    
+    var records []*models.IPSetRecord
+    for _, id := range setRecordIDs(fileData, from, now) {
+        record := *fileData.Records[id]
+        newID, err := s.allocateID(fileData)
+        if err != nil {
+            return nil, err
+        }
+        record.ID = newID
+        record.SetName = to
+        record.CreatedAt = now
+        record.UpdatedAt = now
+        fileData.Records[newID] = &record
+        appendRevision(fileData.History, models.RevisionCreate, now, &record)
+        records = append(records, &record)
+    }
+    
+    if err := s.writeData(fileData); err != nil {
+        return nil, err
+    }
+    
+    return records, nil
+}
+
+func (s *FileIPSetStorage) SwapSets(ctx context.Context, a, b string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    fileData, err := s.readFileData(ctx)
+    if err != nil {
+        return err
+    }
+    
+    setA, exists := fileData.Sets[a]
+    if !exists {
+        return fmt.Errorf("set %s not found", a)
+    }
+    setB, exists := fileData.Sets[b]
+    if !exists {
+        return fmt.Errorf("set %s not found", b)
+    }
+    
+    // Имена остаются на месте, содержимое сетов меняется местами
+    now := time.Now()
+    idsA, idsB := setRecordIDs(fileData, a, now), setRecordIDs(fileData, b, now)
+    setA.Name, setB.Name = b, a
+    setA.UpdatedAt, setB.UpdatedAt = now, now
+    fileData.putSet(a, setB)
+    fileData.putSet(b, setA)
+    for _, moved := range []struct {
+        ids     []int
+        setName string
+    }{{idsA, b}, {idsB, a}} {
+        for _, id := range moved.ids {
+            record := fileData.Records[id]
+            record.SetName = moved.setName
+            record.UpdatedAt = now
+            appendRevision(fileData.History, models.RevisionUpdate, now, record)
+        }
+    }
+    
+    return s.writeData(fileData)
+}
+
+// ApplySetChanges меняет файл одной записью: при ошибке файл остается прежним
+func (s *FileIPSetStorage) ApplySetChanges(ctx context.Context, setName string, revision int64, set *models.IPSetSet, remove []int, update, add []*models.IPSetRecord) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    if s.setChangedSince(setName, revision) {
+        return &SetChangedError{SetName: setName, Revision: revision}
+    }
+    
+    fileData, err := s.readFileData(ctx)
+    if err != nil {
+        return err
+    }
+    
+    now := time.Now()
+    if set != nil {
+        if existing, exists := fileData.Sets[setName]; exists {
+            set.CreatedAt = existing.CreatedAt
+        } else {
+            set.CreatedAt = now
+        }
+        set.UpdatedAt = now
+        copied := *set
+        copied.RecordCount = 0
+        copied.Records = nil
+        fileData.putSet(setName, &copied)
+    }
+    
+    for _, id := range remove {
+        record, exists := fileData.Records[id]
+        if !exists || record.SetName != setName {
+            return fmt.Errorf("record with id %d not found in set %s", id, setName)
+        }
+        appendRevision(fileData.History, models.RevisionDelete, now, record)
+        s.moveToTrash(fileData, record, now)
+    }
+    
+    for _, record := range update {
+        existing, exists := fileData.Records[record.ID]
+        if !exists || existing.SetName != setName || record.SetName != setName || isExpired(existing, now) {
+            return fmt.Errorf("record with id %d not found in set %s", record.ID, setName)
+        }
+        if err := fileDuplicate(fileData, record, now); err != nil {
+            return err
+        }
+        record.CreatedAt = existing.CreatedAt
+        record.UpdatedAt = now
+        fileData.Records[record.ID] = record
+        appendRevision(fileData.History, models.RevisionUpdate, now, record)
+    }
+    
+    for _, record := range add {
+        record.SetName = setName
+        if err := fileDuplicate(fileData, record, now); err != nil {
+            return err
+        }
+        id, err := s.allocateID(fileData)
+        if err != nil {
+            return err
+        }
+        record.ID = id
+        record.CreatedAt = now
+        record.UpdatedAt = now
+        fileData.Records[id] = record
+        appendRevision(fileData.History, models.RevisionCreate, now, record)
+        ensureFileSet(fileData, record, now)
+    }
+    
+    return s.writeData(fileData)
+}
+
+// setChangedSince - есть ли в потоке изменения сета setName после
+// revision. Если изменения после revision уже удалены из потока, сет
+// считается измененным.
+func (s *FileIPSetStorage) setChangedSince(setName string, revision int64) bool {
+    if revision >= s.state.Revision {
+        return false
+    }
+    if len(s.changes) == 0 || revision < s.changes[0].Revision-1 {
+        return true
+    }
+    start := sort.Search(len(s.changes), func(i int) bool {
+        return s.changes[i].Revision > revision
+    })
+    for _, change := range s.changes[start:] {
+        if change.SetName == setName {
+            return true
+        }
+    }
+    return false
+}
+
+// ApplyChanges выполняет операции на копии данных и записывает файл, только
+// если все операции прошли
+func (s *FileIPSetStorage) ApplyChanges(ctx context.Context, changes []*RecordChange) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    fileData, err := s.readFileData(ctx)
+    if err != nil {
+        return err
+    }
+    
+    now := time.Now()
+    for i, change := range changes {
+        if err := s.applyChange(fileData, change, now); err != nil {
+            return &ChangeError{Index: i, Err: err}
+        }
+    }
+    
+    return s.writeData(fileData)
+}
+
+func (s *FileIPSetStorage) applyChange(fileData *fileIPSetData, change *RecordChange, now time.Time) error {
+    switch change.Op {
+    case ChangeCreate:
+        record := change.Record
+        if err := fileDuplicate(fileData, record, now); err != nil {
+            return err
+        }
+        id, err := s.allocateID(fileData)
+        if err != nil {
+            return err
+        }
+        record.ID = id
+        record.CreatedAt = now
+        record.UpdatedAt = now
+        fileData.Records[id] = record
+        appendRevision(fileData.History, models.RevisionCreate, now, record)
+        ensureFileSet(fileData, record, now)
+        return nil
+        
+    case ChangeUpdate:
+        record := change.Record
+        existing, exists := fileData.Records[change.ID]
+        if !exists || isExpired(existing, now) {
+            return fmt.Errorf("record with id %d not found", change.ID)
+        }
+        record.ID = change.ID
+        record.CreatedAt = existing.CreatedAt
+        record.UpdatedAt = now
+        if err := fileDuplicate(fileData, record, now); err != nil {
+            return err
+        }
+        fileData.Records[record.ID] = record
+        appendRevision(fileData.History, models.RevisionUpdate, now, record)
+        ensureFileSet(fileData, record, now)
+        return nil
+        
+    case ChangeDelete:
+        record, exists := fileData.Records[change.ID]
+        if !exists {
+            return fmt.Errorf("record with id %d not found", change.ID)
+        }
+        appendRevision(fileData.History, models.RevisionDelete, now, record)
+        s.moveToTrash(fileData, record, now)
+        return nil
+    }
+    return fmt.Errorf("unknown operation %q", change.Op)
+}
+
+func (s *FileIPSetStorage) Update(ctx context.Context, id int, record *models.IPSetRecord) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    fileData, err := s.readFileData(ctx)
+    if err != nil {
+        return err
+    }
+    
+    existing, exists := fileData.Records[id]
+    if !exists || isExpired(existing, time.Now()) {
+        return fmt.Errorf("record with id %d not found", id)
+    }
+    
+    record.ID = id
+    record.CreatedAt = existing.CreatedAt
+    record.UpdatedAt = time.Now()
+    if err := fileDuplicate(fileData, record, record.UpdatedAt); err != nil {
+        return err
+    }
+    fileData.Records[id] = record
+    appendRevision(fileData.History, models.RevisionUpdate, record.UpdatedAt, record)
+    // Запись могла перейти в новый сет
+    ensureFileSet(fileData, record, record.UpdatedAt)
+    
+    return s.writeData(fileData)
+}
+
+func (s *FileIPSetStorage) Delete(ctx context.Context, id int) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    fileData, err := s.readFileData(ctx)
+    if err != nil {
+        return err
+    }
+    
+    record, exists := fileData.Records[id]
+    if !exists {
+        return fmt.Errorf("record with id %d not found", id)
+    }
+    
+    now := time.Now()
+    appendRevision(fileData.History, models.RevisionDelete, now, record)
+    s.moveToTrash(fileData, record, now)
+    return s.writeData(fileData)
+}
+
+func (s *FileIPSetStorage) DeleteSet(ctx context.Context, setName string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    fileData, err := s.readFileData(ctx)
+    if err != nil {
+        return err
+    }
+    
+    now := time.Now()
+    _, found := fileData.Sets[setName]
+    fileData.removeSet(setName)
+    for _, record := range fileData.Records {
+        if record.SetName == setName {
+            appendRevision(fileData.History, models.RevisionDelete, now, record)
+            s.moveToTrash(fileData, record, now)
+            found = true
+        }
+    }
+    
+    if !found {
+        return fmt.Errorf("set %s not found", setName)
+    }
+    
+    return s.writeData(fileData)
+}
+
+func (s *FileIPSetStorage) Search(ctx context.Context, query string) ([]*models.IPSetRecord, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    
+    records, err := s.readRecords(ctx)
+    if err != nil {
+        return nil, err
+    }
+    
+    var result []*models.IPSetRecord
+    query = strings.ToLower(query)
+    
+    for _, record := range records {
+        if strings.Contains(strings.ToLower(record.Context), query) ||
+           strings.Contains(strings.ToLower(record.Description), query) ||
+           strings.Contains(strings.ToLower(record.IP), query) ||
+           strings.Contains(strings.ToLower(record.SetName), query) {
+            result = append(result, record)
+        }
+    }
+    
+    return result, nil
+}
+
+func (s *FileIPSetStorage) Lookup(ctx context.Context, prefix netip.Prefix) ([]*models.IPSetRecord, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    
+    records, err := s.readRecords(ctx)
+    if err != nil {
+        return nil, err
+    }
+    
+    all := make([]*models.IPSetRecord, 0, len(records))
+    for _, record := range records {
+        all = append(all, record)
+    }
+    
+    return lookupInMemory(all, prefix), nil
+}
+
+func (s *FileIPSetStorage) List(ctx context.Context, q *models.RecordQuery) (*models.RecordPage, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    
+    records, err := s.readRecords(ctx)
+    if err != nil {
+        return nil, err
+    }
+    
+    all := make([]*models.IPSetRecord, 0, len(records))
+    for _, record := range records {
+        all = append(all, record)
+    }
+    
+    return listRecordsInMemory(all, q)
+}
+
+func (s *FileIPSetStorage) ListSets(ctx context.Context, q *models.SetQuery) (*models.SetPage, error) {
+    sets, err := s.GetAllSets(ctx)
+    if err != nil {
+        return nil, err
+    }
+    
+    return listSetsInMemory(sets, q)
+}
+
+func (s *FileIPSetStorage) History(ctx context.Context, id int) ([]*models.RecordRevision, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    
+    return append([]*models.RecordRevision(nil), s.history[id]...), nil
+}
+
+func (s *FileIPSetStorage) GetBySetNameAt(ctx context.Context, setName string, at time.Time) ([]*models.IPSetRecord, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    
+    return setAtInMemory(s.history, setName, at), nil
+}
+
+func (s *FileIPSetStorage) Revision(ctx context.Context) (int64, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    
+    if err := ctx.Err(); err != nil {
+        return 0, err
+    }
+    
+    return s.state.Revision, nil
+}
+
+func (s *FileIPSetStorage) Changes(ctx context.Context, since int64, limit int) ([]*models.ChangeEvent, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    
+    // Номера в потоке идут подряд по возрастанию, старые изменения сверх
+    // fileChangesLimit уже удалены
+    if len(s.changes) > 0 && since < s.changes[0].Revision-1 {
+        return nil, &ChangesExpiredError{Since: since, Oldest: s.changes[0].Revision}
+    }
+    start := sort.Search(len(s.changes), func(i int) bool {
+        return s.changes[i].Revision > since
+    })
+    changes := s.changes[start:]
+    if limit > 0 && len(changes) > limit {
+        changes = changes[:limit]
+    }
+    
+    return append([]*models.ChangeEvent(nil), changes...), nil
+}
+
+// moveToTrash переносит запись в корзину с отметкой времени удаления
+func (s *FileIPSetStorage) moveToTrash(fileData *fileIPSetData, record *models.IPSetRecord, at time.Time) {
+    deletedAt := at
+    record.DeletedAt = &deletedAt
+    fileData.Trash[record.ID] = record
+    delete(fileData.Records, record.ID)
+}
+
+func (s *FileIPSetStorage) ListTrash(ctx context.Context, q *models.RecordQuery) (*models.RecordPage, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    
+    fileData, err := s.readFileData(ctx)
+    if err != nil {
+        return nil, err
+    }
+    
+    all := make([]*models.IPSetRecord, 0, len(fileData.Trash))
+    for _, record := range fileData.Trash {
+        all = append(all, record)
+    }
+    
+    return listRecordsInMemory(all, q)
+}
+
+func (s *FileIPSetStorage) Undelete(ctx context.Context, id int) (*models.IPSetRecord, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    fileData, err := s.readFileData(ctx)
+    if err != nil {
+        return nil, err
+    }
+    
+    record, exists := fileData.Trash[id]
+    if !exists {
+        return nil, fmt.Errorf("record with id %d not found in trash", id)
+    }
+    
+    now := time.Now()
+    // Пока запись была в корзине, в сет могли добавить тот же элемент
+    if err := fileDuplicate(fileData, record, now); err != nil {
+        return nil, err
+    }
+    
+    s.restoreFromTrash(fileData, record, now)
+    if err := s.writeData(fileData); err != nil {
+        return nil, err
+    }
+    
+    return record, nil
+}
+
+func (s *FileIPSetStorage) UndeleteSet(ctx context.Context, setName string) ([]*models.IPSetRecord, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    fileData, err := s.readFileData(ctx)
+    if err != nil {
+        return nil, err
+    }
+    
+    var result []*models.IPSetRecord
+    for _, record := range fileData.Trash {
+        if record.SetName == setName {
+            result = append(result, record)
+        }
+    }
+    
+    if len(result) == 0 {
+        return nil, fmt.Errorf("set %s not found in trash", setName)
+    }
+    
+    sort.Slice(result, func(i, j int) bool {
+        return result[i].ID < result[j].ID
+    })
+    
+    now := time.Now()
+    for _, record := range result {
+        s.restoreFromTrash(fileData, record, now)
+    }
+    // Файл еще не записан: при дубликате он остается прежним
+    for _, record := range result {
+        if err := fileDuplicate(fileData, record, now); err != nil {
+            return nil, err
+        }
+    }
+    if err := s.writeData(fileData); err != nil {
+        return nil, err
+    }
+    
+    return result, nil
+}
+
+// restoreFromTrash возвращает запись из корзины к действующим
+func (s *FileIPSetStorage) restoreFromTrash(fileData *fileIPSetData, record *models.IPSetRecord, at time.Time) {
+    record.DeletedAt = nil
+    record.UpdatedAt = at
+    fileData.Records[record.ID] = record
+    delete(fileData.Trash, record.ID)
+    appendRevision(fileData.History, models.RevisionUpdate, at, record)
+    ensureFileSet(fileData, record, at)
+}
+
+func (s *FileIPSetStorage) PurgeTrash(ctx context.Context, before time.Time) (int, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    fileData, err := s.readFileData(ctx)
+    if err != nil {
+        return 0, err
+    }
+    
+    // История удаленных записей остается, как и в SQL хранилищах
+    purged := 0
+    for id, record := range fileData.Trash {
+        if record.DeletedAt == nil || record.DeletedAt.Before(before) {
+            delete(fileData.Trash, id)
+            purged++
+        }
+    }
+    
+    if purged == 0 {
+        return 0, nil
+    }
+    return purged, s.writeData(fileData)
+}
+
+func (s *FileIPSetStorage) CountExpired(ctx context.Context, at time.Time) (int, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    
+    fileData, err := s.readFileData(ctx)
+    if err != nil {
+        return 0, err
+    }
+    
+    count := 0
+    for _, record := range fileData.Records {
+        if isExpired(record, at) {
+            count++
+        }
+    }
+    return count, nil
+}
+
+func (s *FileIPSetStorage) DeleteExpired(ctx context.Context, at time.Time) ([]*models.IPSetRecord, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    fileData, err := s.readFileData(ctx)
+    if err != nil {
+        return nil, err
+    }
+    
+    var expired []*models.IPSetRecord
+    for id, record := range fileData.Records {
+        if isExpired(record, at) {
+            appendRevision(fileData.History, models.RevisionDelete, at, record)
+            delete(fileData.Records, id)
+            expired = append(expired, record)
+        }
+    }
+    
+    if len(expired) == 0 {
+        return nil, nil
+    }
+    
+    sort.Slice(expired, func(i, j int) bool {
+        return expired[i].ID < expired[j].ID
+    })
+    if err := s.writeData(fileData); err != nil {
+        return nil, err
+    }
+    
+    return expired, nil
+}
+
+// FileAuditStorage - журнал аудита в файле JSON Lines: по событию на строку,
+// новые события дописываются в конец. Как и для записей, на время жизни
+// хранилища берется эксклюзивная блокировка файла.
+type FileAuditStorage struct {
+    filePath string
+    mu       sync.RWMutex
+    nextID   int64
+    lockFile *os.File
+}
+
+func NewFileAuditStorage(filePath string) (*FileAuditStorage, error) {
+    if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+        return nil, err
+    }
+    
+    lockFile, err := lockDataFile(filePath + ".lock")
+    if err != nil {
+        return nil, fmt.Errorf("failed to lock %s: %v", filePath, err)
+    }
+    
+    storage := &FileAuditStorage{
+        filePath: filePath,
+        nextID:   1,
+        lockFile: lockFile,
+    }
+    
+    events, err := storage.readEvents(context.Background())
+    if err != nil {
+        unlockDataFile(lockFile)
+        return nil, err
+    }
+    for _, event := range events {
+        if event.ID >= storage.nextID {
+            storage.nextID = event.ID + 1
+        }
+    }
+    
+    return storage, nil
+}
+
+// Close снимает блокировку файла журнала
+func (s *FileAuditStorage) Close() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    if s.lockFile == nil {
+        return nil
+    }
+    err := unlockDataFile(s.lockFile)
+    s.lockFile = nil
+    return err
+}
+
+// readEvents читает журнал целиком. Недописанная последняя строка (сбой
+// во время записи) пропускается.
+func (s *FileAuditStorage) readEvents(ctx context.Context) ([]*models.AuditEvent, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    
+    data, err := os.ReadFile(s.filePath)
+    if os.IsNotExist(err) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    
+    var events []*models.AuditEvent
+    for _, line := range strings.Split(string(data), "\n") {
+        if strings.TrimSpace(line) == "" {
+            continue
+        }
+        var event models.AuditEvent
+        if err := json.Unmarshal([]byte(line), &event); err != nil {
+            continue
+        }
+        events = append(events, &event)
+    }
+    
+    return events, nil
+}
+
+func (s *FileAuditStorage) Append(ctx context.Context, event *models.AuditEvent) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    
+    event.ID = s.nextID
+    data, err := json.Marshal(event)
+    if err != nil {
+        return fmt.Errorf("failed to encode audit event: %v", err)
+    }
+    
+    f, err := os.OpenFile(s.filePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+    if err != nil {
+        return fmt.Errorf("failed to open audit log: %v", err)
+    }
+    if _, err := f.Write(append(data, '\n')); err != nil {
+        f.Close()
+        return fmt.Errorf("failed to append audit event: %v", err)
+    }
+    if err := f.Sync(); err != nil {
+        f.Close()
+        return fmt.Errorf("failed to append audit event: %v", err)
+    }
+    if err := f.Close(); err != nil {
+        return fmt.Errorf("failed to append audit event: %v", err)
+    }
+    
+    s.nextID++
+    return nil
+}
+
+func (s *FileAuditStorage) List(ctx context.Context, q *models.AuditQuery) (*models.AuditPage, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    
+    events, err := s.readEvents(ctx)
+    if err != nil {
+        return nil, err
+    }
+    
+    return listAuditInMemory(events, q)
+}
+
+// FileWebhookStorage - подписки и доставки в файле JSON. Как и файл записей,
+// файл перезаписывается атомарно при каждом изменении и заблокирован на
+// время жизни хранилища.
+type FileWebhookStorage struct {
+    filePath string
+    mu       sync.RWMutex
+    lockFile *os.File
+}
+
+// fileWebhookData - формат файла подписок. Доставки идут по возрастанию ID,
+// Cursor - номер изменения, по которому созданы доставки (nil - еще не
+// создавались).
+type fileWebhookData struct {
+    NextWebhookID  int64                     `json:"next_webhook_id"`
+    NextDeliveryID int64                     `json:"next_delivery_id"`
+    Cursor         *int64                    `json:"cursor,omitempty"`
+    Webhooks       []*models.Webhook         `json:"webhooks"`
+    Deliveries     []*models.WebhookDelivery `json:"deliveries"`
+}
+
+func NewFileWebhookStorage(filePath string) (*FileWebhookStorage, error) {
+    if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+        return nil, err
+    }
+    
+    lockFile, err := lockDataFile(filePath + ".lock")
+    if err != nil {
+        return nil, fmt.Errorf("failed to lock %s: %v", filePath, err)
+    }
+    
+    storage := &FileWebhookStorage{
+        filePath: filePath,
+        lockFile: lockFile,
+    }
+    if _, err := storage.readData(context.Background()); err != nil {
+        unlockDataFile(lockFile)
+        return nil, err
+    }
+    
+    return storage, nil
+}
+
+// Close снимает блокировку файла подписок
+func (s *FileWebhookStorage) Close() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    if s.lockFile == nil {
+        return nil
+    }
+    err := unlockDataFile(s.lockFile)
+    s.lockFile = nil
+    return err
+}
+
+// readData и writeData вызываются под s.mu
+func (s *FileWebhookStorage) readData(ctx context.Context) (*fileWebhookData, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    
+    fileData := &fileWebhookData{NextWebhookID: 1, NextDeliveryID: 1}
+    data, err := os.ReadFile(s.filePath)
+    if os.IsNotExist(err) {
+        return fileData, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    
+    if err := json.Unmarshal(data, fileData); err != nil {
+        return nil, fmt.Errorf("failed to parse %s: %v", s.filePath, err)
+    }
+    // MarshalIndent переформатирует тела доставок вместе с файлом; получателю
+    // они отправляются в исходном компактном виде
+    for _, delivery := range fileData.Deliveries {
+        var compact bytes.Buffer
+        if err := json.Compact(&compact, delivery.Payload); err == nil {
+            delivery.Payload = compact.Bytes()
+        }
+    }
+    return fileData, nil
+}
+
+func (s *FileWebhookStorage) writeData(fileData *fileWebhookData) error {
+    data, err := json.MarshalIndent(fileData, "", "  ")
+    if err != nil {
+        return err
+    }
+    
+    return writeFileAtomic(s.filePath, data, 0644)
+}
+
+// update читает файл, применяет change и сохраняет результат
+func (s *FileWebhookStorage) update(ctx context.Context, change func(fileData *fileWebhookData) error) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    fileData, err := s.readData(ctx)
+    if err != nil {
+        return err
+    }
+    if err := change(fileData); err != nil {
+        return err
+    }
+    return s.writeData(fileData)
+}
+
+func (s *FileWebhookStorage) CreateWebhook(ctx context.Context, webhook *models.Webhook) error {
+    return s.update(ctx, func(fileData *fileWebhookData) error {
+        webhook.ID = fileData.NextWebhookID
+        fileData.NextWebhookID++
+        fileData.Webhooks = append(fileData.Webhooks, webhook)
+        return nil
+    })
+}
+
+func (s *FileWebhookStorage) GetWebhook(ctx context.Context, id int64) (*models.Webhook, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    
+    fileData, err := s.readData(ctx)
+    if err != nil {
+        return nil, err
+    }
+    
+    for _, webhook := range fileData.Webhooks {
+        if webhook.ID == id {
+            return webhook, nil
+        }
+    }
+    return nil, fmt.Errorf("webhook with id %d not found", id)
+}
+
+func (s *FileWebhookStorage) ListWebhooks(ctx context.Context) ([]*models.Webhook, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    
+    fileData, err := s.readData(ctx)
+    if err != nil {
+        return nil, err
+    }
+    
+    return fileData.Webhooks, nil
+}
+
+func (s *FileWebhookStorage) UpdateWebhook(ctx context.Context, webhook *models.Webhook) error {
+    return s.update(ctx, func(fileData *fileWebhookData) error {
+        for i, existing := range fileData.Webhooks {
+            if existing.ID == webhook.ID {
+                fileData.Webhooks[i] = webhook
+                return nil
+            }
+        }
+        return fmt.Errorf("webhook with id %d not found", webhook.ID)
+    })
+}
+
+// DeleteWebhook удаляет подписку вместе с ее доставками
+func (s *FileWebhookStorage) DeleteWebhook(ctx context.Context, id int64) error {
+    return s.update(ctx, func(fileData *fileWebhookData) error {
+        found := false
+        webhooks := fileData.Webhooks[:0]
+        for _, webhook := range fileData.Webhooks {
+            if webhook.ID == id {
+                found = true
+                continue
+            }
+            webhooks = append(webhooks, webhook)
+        }
+        if !found {
+            return fmt.Errorf("webhook with id %d not found", id)
+        }
+        fileData.Webhooks = webhooks
+        
+        deliveries := fileData.Deliveries[:0]
+        for _, delivery := range fileData.Deliveries {
+            if delivery.WebhookID != id {
+                deliveries = append(deliveries, delivery)
+            }
+        }
+        fileData.Deliveries = deliveries
+        return nil
+    })
+}
+
+func (s *FileWebhookStorage) WebhookCursor(ctx context.Context) (int64, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    
+    fileData, err := s.readData(ctx)
+    if err != nil {
+        return 0, err
+    }
+    if fileData.Cursor == nil {
+        return -1, nil
+    }
+    return *fileData.Cursor, nil
+}
+
+func (s *FileWebhookStorage) EnqueueDeliveries(ctx context.Context, deliveries []*models.WebhookDelivery, revision int64) error {
+    return s.update(ctx, func(fileData *fileWebhookData) error {
+        for _, delivery := range deliveries {
+            delivery.ID = fileData.NextDeliveryID
+            fileData.NextDeliveryID++
+            fileData.Deliveries = append(fileData.Deliveries, delivery)
+        }
+        fileData.Cursor = &revision
+        return nil
+    })
+}
+
+func (s *FileWebhookStorage) DueDeliveries(ctx context.Context, at time.Time, limit int) ([]*models.WebhookDelivery, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    
+    fileData, err := s.readData(ctx)
+    if err != nil {
+        return nil, err
+    }
+    
+    var due []*models.WebhookDelivery
+    for _, delivery := range fileData.Deliveries {
+        if delivery.Status == models.DeliveryPending && !delivery.NextAttemptAt.After(at) {
+            due = append(due, delivery)
+        }
+    }
+    sort.SliceStable(due, func(i, j int) bool {
+        return due[i].NextAttemptAt.Before(due[j].NextAttemptAt)
+    })
+    if len(due) > limit {
+        due = due[:limit]
+    }
+    return due, nil
+}
+
+func (s *FileWebhookStorage) GetDelivery(ctx context.Context, id int64) (*models.WebhookDelivery, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    
+    fileData, err := s.readData(ctx)
+    if err != nil {
+        return nil, err
+    }
+    
+    for _, delivery := range fileData.Deliveries {
+        if delivery.ID == id {
+            return delivery, nil
+        }
+    }
+    return nil, fmt.Errorf("delivery with id %d not found", id)
+}
+
+func (s *FileWebhookStorage) UpdateDelivery(ctx context.Context, delivery *models.WebhookDelivery) error {
+    return s.update(ctx, func(fileData *fileWebhookData) error {
+        for i, existing := range fileData.Deliveries {
+            if existing.ID == delivery.ID {
+                fileData.Deliveries[i] = delivery
+                return nil
+            }
+        }
+        // Доставку могли удалить вместе с подпиской, пока ее отправляли
+        return nil
+    })
+}
+
+func (s *FileWebhookStorage) ListDeliveries(ctx context.Context, q *models.DeliveryQuery) (*models.DeliveryPage, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    
+    fileData, err := s.readData(ctx)
+    if err != nil {
+        return nil, err
+    }
+    
+    return listDeliveriesInMemory(fileData.Deliveries, q)
+}
+
+func (s *FileWebhookStorage) PurgeDeliveries(ctx context.Context, before time.Time) (int, error) {
+    purged := 0
+    err := s.update(ctx, func(fileData *fileWebhookData) error {
+        deliveries := fileData.Deliveries[:0]
+        for _, delivery := range fileData.Deliveries {
+            if delivery.Status == models.DeliveryDelivered && delivery.UpdatedAt.Before(before) {
+                purged++
+                continue
+            }
+            deliveries = append(deliveries, delivery)
+        }
+        fileData.Deliveries = deliveries
+        return nil
+    })
+    return purged, err
+}
+
+// FileAgentStorage - агенты и правила назначения в файле JSON, как и
+// подписки: файл перезаписывается атомарно при каждом изменении и
+// заблокирован на время жизни хранилища.
+type FileAgentStorage struct {
+    filePath string
+    mu       sync.RWMutex
+    lockFile *os.File
+}
+
+// fileAgentData - формат файла агентов. Агенты идут по имени хоста,
+// правила - по возрастанию ID.
+type fileAgentData struct {
+    NextAssignmentID int64                    `json:"next_assignment_id"`
+    Agents           []*models.Agent          `json:"agents"`
+    Assignments      []*models.AssignmentRule `json:"assignments"`
+}
+
+func NewFileAgentStorage(filePath string) (*FileAgentStorage, error) {
+    if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+        return nil, err
+    }
+    
+    lockFile, err := lockDataFile(filePath + ".lock")
+    if err != nil {
+        return nil, fmt.Errorf("failed to lock %s: %v", filePath, err)
+    }
+    
+    storage := &FileAgentStorage{
+        filePath: filePath,
+        lockFile: lockFile,
+    }
+    if _, err := storage.readData(context.Background()); err != nil {
+        unlockDataFile(lockFile)
+        return nil, err
+    }
+    
+    return storage, nil
+}
+
+// Close снимает блокировку файла агентов
+func (s *FileAgentStorage) Close() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    if s.lockFile == nil {
+        return nil
+    }
+    err := unlockDataFile(s.lockFile)
+    s.lockFile = nil
+    return err
+}
+
+// readData и writeData вызываются под s.mu
+func (s *FileAgentStorage) readData(ctx context.Context) (*fileAgentData, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    
+    fileData := &fileAgentData{NextAssignmentID: 1}
+    data, err := os.ReadFile(s.filePath)
+    if os.IsNotExist(err) {
+        return fileData, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    
+    if err := json.Unmarshal(data, fileData); err != nil {
+        return nil, fmt.Errorf("failed to parse %s: %v", s.filePath, err)
+    }
+    return fileData, nil
+}
+
+func (s *FileAgentStorage) writeData(fileData *fileAgentData) error {
+    data, err := json.MarshalIndent(fileData, "", "  ")
+    if err != nil {
+        return err
+    }
+    
+    return writeFileAtomic(s.filePath, data, 0644)
+}
+
+// update читает файл, применяет change и сохраняет результат
+func (s *FileAgentStorage) update(ctx context.Context, change func(fileData *fileAgentData) error) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    fileData, err := s.readData(ctx)
+    if err != nil {
+        return err
+    }
+    if err := change(fileData); err != nil {
+        return err
+    }
+    return s.writeData(fileData)
+}
+
+func (s *FileAgentStorage) SaveAgent(ctx context.Context, agent *models.Agent) error {
+    return s.update(ctx, func(fileData *fileAgentData) error {
+        for i, existing := range fileData.Agents {
+            if existing.Hostname == agent.Hostname {
+                fileData.Agents[i] = agent
+                return nil
+            }
+        }
+        fileData.Agents = append(fileData.Agents, agent)
+        sort.Slice(fileData.Agents, func(i, j int) bool {
+            return fileData.Agents[i].Hostname < fileData.Agents[j].Hostname
+        })
+        return nil
+    })
+}
+
+func (s *FileAgentStorage) GetAgent(ctx context.Context, hostname string) (*models.Agent, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    
+    fileData, err := s.readData(ctx)
+    if err != nil {
+        return nil, err
+    }
+    
+    for _, agent := range fileData.Agents {
+        if agent.Hostname == hostname {
+            return agent, nil
+        }
+    }
+    return nil, fmt.Errorf("agent %s not found", hostname)
+}
+
+func (s *FileAgentStorage) ListAgents(ctx context.Context) ([]*models.Agent, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    
+    fileData, err := s.readData(ctx)
+    if err != nil {
+        return nil, err
+    }
+    
+    return fileData.Agents, nil
+}
+
+func (s *FileAgentStorage) DeleteAgent(ctx context.Context, hostname string) error {
+    return s.update(ctx, func(fileData *fileAgentData) error {
+        for i, agent := range fileData.Agents {
+            if agent.Hostname == hostname {
+                fileData.Agents = append(fileData.Agents[:i], fileData.Agents[i+1:]...)
+                return nil
+            }
+        }
+        return fmt.Errorf("agent %s not found", hostname)
+    })
+}
+
+func (s *FileAgentStorage) CreateAssignment(ctx context.Context, rule *models.AssignmentRule) error {
+    return s.update(ctx, func(fileData *fileAgentData) error {
+        rule.ID = fileData.NextAssignmentID
+        fileData.NextAssignmentID++
+        fileData.Assignments = append(fileData.Assignments, rule)
+        return nil
+    })
+}
+
+func (s *FileAgentStorage) GetAssignment(ctx context.Context, id int64) (*models.AssignmentRule, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    
+    fileData, err := s.readData(ctx)
+    if err != nil {
+        return nil, err
+    }
+    
+    for _, rule := range fileData.Assignments {
+        if rule.ID == id {
+            return rule, nil
+        }
+    }
+    return nil, fmt.Errorf("assignment with id %d not found", id)
+}
+
+func (s *FileAgentStorage) ListAssignments(ctx context.Context) ([]*models.AssignmentRule, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    
+    fileData, err := s.readData(ctx)
+    if err != nil {
+        return nil, err
+    }
+    
+    return fileData.Assignments, nil
+}
+
+func (s *FileAgentStorage) UpdateAssignment(ctx context.Context, rule *models.AssignmentRule) error {
+    return s.update(ctx, func(fileData *fileAgentData) error {
+        for i, existing := range fileData.Assignments {
+            if existing.ID == rule.ID {
+                fileData.Assignments[i] = rule
+                return nil
+            }
+        }
+        return fmt.Errorf("assignment with id %d not found", rule.ID)
+    })
+}
+
+func (s *FileAgentStorage) DeleteAssignment(ctx context.Context, id int64) error {
+    return s.update(ctx, func(fileData *fileAgentData) error {
+        for i, rule := range fileData.Assignments {
+            if rule.ID == id {
+                fileData.Assignments = append(fileData.Assignments[:i], fileData.Assignments[i+1:]...)
+                return nil
+            }
+        }
+        return fmt.Errorf("assignment with id %d not found", id)
+    })
+}
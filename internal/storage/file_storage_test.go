@@ -0,0 +1,148 @@
+package storage
+
+import (
+    "context"
+    "fmt"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+    "ipset-api-server/internal/models"
+)
+
+// changeList - изменения потока в виде "kind operation set[/id]"
+func changeList(changes []*models.ChangeEvent) []string {
+    var list []string
+    for _, change := range changes {
+        item := fmt.Sprintf("%s %s %s", change.Kind, change.Operation, change.SetName)
+        if change.RecordID != 0 {
+            item += fmt.Sprintf("/%d", change.RecordID)
+        }
+        list = append(list, item)
+    }
+    return list
+}
+
+func TestFileStorageChanges(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "records.json")
+    s, err := NewFileIPSetStorage(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ctx := context.Background()
+
+    first := &models.IPSetRecord{SetName: "blacklist", IP: "10.0.0.1", Context: "test"}
+    second := &models.IPSetRecord{SetName: "blacklist", IP: "10.0.0.2", Context: "test"}
+    for _, record := range []*models.IPSetRecord{first, second} {
+        if err := s.Create(ctx, record); err != nil {
+            t.Fatal(err)
+        }
+    }
+    first.Description = "changed"
+    if err := s.Update(ctx, first.ID, first); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Delete(ctx, second.ID); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := s.Undelete(ctx, second.ID); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.RenameSet(ctx, "blacklist", "denylist"); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.DeleteSet(ctx, "denylist"); err != nil {
+        t.Fatal(err)
+    }
+    // Окончательное удаление из корзины в поток не попадает
+    if _, err := s.PurgeTrash(ctx, first.CreatedAt.AddDate(1, 0, 0)); err != nil {
+        t.Fatal(err)
+    }
+
+    a, b := first.ID, second.ID
+    want := []string{
+        "set create blacklist",
+        fmt.Sprintf("record create blacklist/%d", a),
+        fmt.Sprintf("record create blacklist/%d", b),
+        fmt.Sprintf("record update blacklist/%d", a),
+        fmt.Sprintf("record delete blacklist/%d", b),
+        fmt.Sprintf("record create blacklist/%d", b),
+        "set create denylist",
+        fmt.Sprintf("record update denylist/%d", a),
+        fmt.Sprintf("record update denylist/%d", b),
+        "set delete blacklist",
+        fmt.Sprintf("record delete denylist/%d", a),
+        fmt.Sprintf("record delete denylist/%d", b),
+        "set delete denylist",
+    }
+    check := func(s *FileIPSetStorage) {
+        t.Helper()
+        changes, err := s.Changes(ctx, 0, 100)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if got := changeList(changes); strings.Join(got, "\n") != strings.Join(want, "\n") {
+            t.Fatalf("changes:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+        }
+        for i, change := range changes {
+            if change.Revision != int64(i+1) {
+                t.Fatalf("change %d has revision %d", i, change.Revision)
+            }
+        }
+    }
+    check(s)
+
+    // Поток читается из журнала после перезапуска
+    if err := s.Close(); err != nil {
+        t.Fatal(err)
+    }
+    s, err = NewFileIPSetStorage(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer s.Close()
+    check(s)
+}
+
+func TestFileStorageCountExpired(t *testing.T) {
+    s, err := NewFileIPSetStorage(filepath.Join(t.TempDir(), "records.json"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer s.Close()
+    ctx := context.Background()
+
+    expiresAt := time.Now().Add(time.Hour)
+    expiring := &models.IPSetRecord{SetName: "blacklist", IP: "10.0.0.1", Context: "test", ExpiresAt: &expiresAt}
+    permanent := &models.IPSetRecord{SetName: "blacklist", IP: "10.0.0.2", Context: "test"}
+    for _, record := range []*models.IPSetRecord{expiring, permanent} {
+        if err := s.Create(ctx, record); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    for _, tc := range []struct {
+        at   time.Time
+        want int
+    }{
+        {time.Now(), 0},
+        {expiresAt, 1},
+        {expiresAt.Add(time.Hour), 1},
+    } {
+        count, err := s.CountExpired(ctx, tc.at)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if count != tc.want {
+            t.Fatalf("%d expired records at %s, want %d", count, tc.at, tc.want)
+        }
+    }
+
+    // Удаленные DeleteExpired записи больше не считаются
+    if _, err := s.DeleteExpired(ctx, expiresAt); err != nil {
+        t.Fatal(err)
+    }
+    if count, err := s.CountExpired(ctx, expiresAt); err != nil || count != 0 {
+        t.Fatalf("%d expired records after DeleteExpired (error %v), want 0", count, err)
+    }
+}
@@ -0,0 +1,175 @@
+package storage
+
+import (
+    "database/sql"
+    "fmt"
+    "sort"
+    "time"
+    "ipset-api-server/internal/models"
+)
+
+// История записей хранится в таблице ipset_record_history: строка на каждое
+// изменение записи с номером ревизии, операцией, временем изменения и
+// состоянием записи. Так же устроены версионные строки ipset_records в
+// ClickHouse (version, is_deleted), только история не схлопывается при
+// слиянии. Таблицу заполняет сама база: триггеры в PostgreSQL, MySQL и
+// SQLite, материализованное представление в ClickHouse, поэтому в историю
+// попадают все изменения, включая перенос данных через ipset-admin copy.
+// Файловое хранилище держит историю в том же файле, что и записи.
+
+// historyInsertSQL - вставка ревизии в триггерах миграций SQL хранилищ.
+// row - строка ipset_records (NEW, OLD или переменная plpgsql), operation и
+// changedAt - SQL-выражения. Номер ревизии - следующий за последним номером
+// записи; INSERT ... SELECT, потому что MySQL не разрешает подзапрос к
+// целевой таблице в VALUES.
+func historyInsertSQL(row, operation, changedAt string) string {
+    return fmt.Sprintf(`INSERT INTO ipset_record_history
+            (record_id, revision, operation, changed_at, set_name, ip, cidr, port, protocol,
+             description, context, set_type, set_options, second_ip, created_at, updated_at)
+        SELECT %[1]s.id, COALESCE(MAX(revision), 0) + 1, %[2]s, %[3]s,
+               %[1]s.set_name, %[1]s.ip, %[1]s.cidr, %[1]s.port, %[1]s.protocol,
+               %[1]s.description, %[1]s.context, %[1]s.set_type, %[1]s.set_options, %[1]s.second_ip,
+               %[1]s.created_at, %[1]s.updated_at
+        FROM ipset_record_history
+        WHERE record_id = %[1]s.id`, row, operation, changedAt)
+}
+
+// historyBackfillSQL - первая ревизия для записей, у которых еще нет истории.
+// Прошлые изменения неизвестны, поэтому запись считается созданной в
+// created_at сразу в текущем виде.
+const historyBackfillSQL = `INSERT INTO ipset_record_history
+        (record_id, revision, operation, changed_at, set_name, ip, cidr, port, protocol,
+         description, context, set_type, set_options, second_ip, created_at, updated_at)
+    SELECT r.id, 1, 'create', COALESCE(r.created_at, r.updated_at, CURRENT_TIMESTAMP),
+           r.set_name, r.ip, r.cidr, r.port, r.protocol,
+           r.description, r.context, r.set_type, r.set_options, r.second_ip,
+           r.created_at, r.updated_at
+    FROM ipset_records r
+    WHERE NOT EXISTS (SELECT 1 FROM ipset_record_history h WHERE h.record_id = r.id)`
+
+// recordHistorySQL - ревизии одной записи по возрастанию номера
+func recordHistorySQL(d sqlDialect) string {
+    return fmt.Sprintf(`
+        SELECT revision, operation, changed_at,
+               record_id, set_name, ip, cidr, port, protocol, description, context,
+               set_type, set_options, second_ip, created_at, updated_at
+        FROM ipset_record_history
+        WHERE record_id = %s
+        ORDER BY revision
+    `, d.placeholder(1))
+}
+
+// setAtSQL - записи сета на момент времени: для каждой записи берется
+// последняя ревизия не позже этого момента, если это не удаление и запись
+// тогда была в этом сете. Параметры: имя сета, момент времени.
+func setAtSQL(d sqlDialect) string {
+    return fmt.Sprintf(`
+        SELECT h.record_id, h.set_name, h.ip, h.cidr, h.port, h.protocol, h.description, h.context,
+               h.set_type, h.set_options, h.second_ip, h.created_at, h.updated_at
+        FROM ipset_record_history h
+        WHERE h.set_name = %[1]s
+          AND h.operation <> 'delete'
+          AND h.revision = (
+              SELECT MAX(h2.revision)
+              FROM ipset_record_history h2
+              WHERE h2.record_id = h.record_id AND h2.changed_at <= %[2]s
+          )
+        ORDER BY h.record_id
+    `, d.placeholder(1), d.placeholder(2))
+}
+
+// historyColumns - колонки записи в ipset_record_history. Строки, перенесенные
+// из ipset_records старых версий, могут содержать NULL.
+type historyColumns struct {
+    cidr, protocol, description, setType, setOptions, secondIP sql.NullString
+    port                                                       sql.NullInt64
+}
+
+func (h *historyColumns) dest(record *models.IPSetRecord) []interface{} {
+    return []interface{}{
+        &record.ID, &record.SetName, &record.IP, &h.cidr, &h.port, &h.protocol,
+        &h.description, &record.Context, &h.setType, &h.setOptions, &h.secondIP,
+        &record.CreatedAt, &record.UpdatedAt,
+    }
+}
+
+func (h *historyColumns) fill(record *models.IPSetRecord) {
+    record.CIDR = h.cidr.String
+    record.Port = int(h.port.Int64)
+    record.Protocol = h.protocol.String
+    record.Description = h.description.String
+    record.SetType = h.setType.String
+    record.SetOptions = h.setOptions.String
+    record.SecondIP = h.secondIP.String
+}
+
+// scanRevisions читает результат recordHistorySQL
+func scanRevisions(rows *sql.Rows) ([]*models.RecordRevision, error) {
+    var revisions []*models.RecordRevision
+    for rows.Next() {
+        var revision models.RecordRevision
+        var h historyColumns
+        dest := append([]interface{}{&revision.Revision, &revision.Operation, &revision.ChangedAt}, h.dest(&revision.Record)...)
+        if err := rows.Scan(dest...); err != nil {
+            return nil, fmt.Errorf("failed to scan revision: %v", err)
+        }
+        h.fill(&revision.Record)
+        revisions = append(revisions, &revision)
+    }
+
+    return revisions, rows.Err()
+}
+
+// scanHistoryRecords читает результат setAtSQL
+func scanHistoryRecords(rows *sql.Rows) ([]*models.IPSetRecord, error) {
+    var records []*models.IPSetRecord
+    for rows.Next() {
+        var record models.IPSetRecord
+        var h historyColumns
+        if err := rows.Scan(h.dest(&record)...); err != nil {
+            return nil, fmt.Errorf("failed to scan record: %v", err)
+        }
+        h.fill(&record)
+        records = append(records, &record)
+    }
+
+    return records, rows.Err()
+}
+
+// appendRevision добавляет ревизию в историю, которую хранилище держит в памяти
+func appendRevision(history map[int][]*models.RecordRevision, operation string, at time.Time, record *models.IPSetRecord) {
+    revisions := history[record.ID]
+    revision := &models.RecordRevision{
+        Revision:  len(revisions) + 1,
+        Operation: operation,
+        ChangedAt: at,
+        Record:    *record,
+    }
+    if len(revisions) > 0 {
+        revision.Revision = revisions[len(revisions)-1].Revision + 1
+    }
+    history[record.ID] = append(revisions, revision)
+}
+
+// setAtInMemory - GetBySetNameAt для истории в памяти, результат упорядочен по ID
+func setAtInMemory(history map[int][]*models.RecordRevision, setName string, at time.Time) []*models.IPSetRecord {
+    var result []*models.IPSetRecord
+    for _, revisions := range history {
+        var last *models.RecordRevision
+        for _, revision := range revisions {
+            if !revision.ChangedAt.After(at) {
+                last = revision
+            }
+        }
+        if last == nil || last.Operation == models.RevisionDelete || last.Record.SetName != setName {
+            continue
+        }
+        record := last.Record
+        result = append(result, &record)
+    }
+
+    sort.Slice(result, func(i, j int) bool {
+        return result[i].ID < result[j].ID
+    })
+    return result
+}
@@ -1,25 +1,170 @@
 package storage
 
 import (
+    "context"
+    "net/netip"
+    "time"
     "ipset-api-server/internal/models"
 )
 
+// Все методы хранилищ принимают контекст: при отмене запроса или истечении
+// таймаута обращение к базе данных прерывается.
 type KeyStorage interface {
-    GetKey(key string) (*models.AuthKey, error)
-    SaveKey(key *models.AuthKey) error
-    DeleteKey(key string) error
-    ListKeys() ([]*models.AuthKey, error)
+    GetKey(ctx context.Context, key string) (*models.AuthKey, error)
+    SaveKey(ctx context.Context, key *models.AuthKey) error
+    DeleteKey(ctx context.Context, key string) error
+    ListKeys(ctx context.Context) ([]*models.AuthKey, error)
 }
 
+// Create, Update, ImportRecord, Undelete, UndeleteSet, ApplySetChanges и
+// ApplyChanges не дают сохранить в сете второй действующий экземпляр
+// элемента: ошибка *DuplicateError называет запись, которая уже есть (см.
+// duplicates.go).
 type IPSetStorage interface {
-    Create(record *models.IPSetRecord) error
-    GetByID(id int) (*models.IPSetRecord, error)
-    GetAll() ([]*models.IPSetRecord, error)
-    GetBySetName(setName string) ([]*models.IPSetRecord, error)
-    GetAllSets() ([]*models.IPSetSet, error)
-    Update(id int, record *models.IPSetRecord) error
-    Delete(id int) error
-    DeleteSet(setName string) error
-    Search(query string) ([]*models.IPSetRecord, error)
+    Create(ctx context.Context, record *models.IPSetRecord) error
+    GetByID(ctx context.Context, id int) (*models.IPSetRecord, error)
+    GetAll(ctx context.Context) ([]*models.IPSetRecord, error)
+    GetBySetName(ctx context.Context, setName string) ([]*models.IPSetRecord, error)
+    GetAllSets(ctx context.Context) ([]*models.IPSetSet, error)
+    Update(ctx context.Context, id int, record *models.IPSetRecord) error
+    Delete(ctx context.Context, id int) error
+    DeleteSet(ctx context.Context, setName string) error
+    Search(ctx context.Context, query string) ([]*models.IPSetRecord, error)
+    
+    // Сеты хранятся отдельно от записей (см. sets.go). GetAllSets, ListSets
+    // и GetSet не заполняют записи сета. Create, Update и ImportRecord
+    // заводят сет записи, если его нет; DeleteSet удаляет и сам сет.
+    CreateSet(ctx context.Context, set *models.IPSetSet) error
+    GetSet(ctx context.Context, name string) (*models.IPSetSet, error)
+    UpdateSet(ctx context.Context, set *models.IPSetSet) error
+    
+    // RenameSet, CopySet и SwapSets - аналоги ipset rename, copy и swap.
+    // Затрагивают действующие записи, записи в корзине остаются в прежнем
+    // сете. CopySet возвращает созданные копии записей, SwapSets меняет
+    // сеты содержимым (тип, опции, описание, владелец, записи).
+    RenameSet(ctx context.Context, from, to string) error
+    CopySet(ctx context.Context, from, to string) ([]*models.IPSetRecord, error)
+    SwapSets(ctx context.Context, a, b string) error
+    
+    // ApplySetChanges - изменение сета и его записей одной транзакцией (при
+    // импорте и смене типа сета): заводит сет set, если его нет, или
+    // перезаписывает его тип, опции, семейство, описание и владельца (nil -
+    // сет не меняется),
+    // переносит в корзину записи remove, перезаписывает записи update (по
+    // их ID) и создает записи add с новыми ID. Если какой-то записи remove
+    // или update уже нет в сете или изменение дает дубликат, ничего не
+    // меняется. revision - номер изменения, на котором прочитан сет: если
+    // сет менялся после него, изменение не применяется и возвращается
+    // *SetChangedError (ClickHouse номер не проверяет).
+    ApplySetChanges(ctx context.Context, setName string, revision int64, set *models.IPSetSet, remove []int, update, add []*models.IPSetRecord) error
+    
+    // ApplyChanges выполняет пакет операций с записями одной транзакцией
+    // (см. bulk.go): при ошибке операции ничего не меняется, а ошибка -
+    // *ChangeError с номером операции. В ClickHouse транзакций нет, там
+    // операции до ошибочной остаются выполненными.
+    ApplyChanges(ctx context.Context, changes []*RecordChange) error
+    
+    // List и ListSets возвращают одну страницу выборки с фильтрами и
+    // сортировкой, курсор следующей страницы берется из результата
+    List(ctx context.Context, query *models.RecordQuery) (*models.RecordPage, error)
+    ListSets(ctx context.Context, query *models.SetQuery) (*models.SetPage, error)
+    
+    // Lookup возвращает записи, которые содержат адрес или пересекаются
+    // с префиксом, упорядоченные по имени сета и ID
+    Lookup(ctx context.Context, prefix netip.Prefix) ([]*models.IPSetRecord, error)
+    
+    // History возвращает ревизии записи по возрастанию номера, GetBySetNameAt -
+    // записи сета в том виде, в каком они были в момент at (пустой список,
+    // если сета тогда не было)
+    History(ctx context.Context, id int) ([]*models.RecordRevision, error)
+    GetBySetNameAt(ctx context.Context, setName string, at time.Time) ([]*models.IPSetRecord, error)
+    
+    // Revision - номер последнего изменения записей и сетов, Changes -
+    // изменения с номером больше since по возрастанию номера, не больше
+    // limit (см. changes.go). Если изменения после since уже удалены,
+    // Changes возвращает *ChangesExpiredError.
+    Revision(ctx context.Context) (int64, error)
+    Changes(ctx context.Context, since int64, limit int) ([]*models.ChangeEvent, error)
+    
+    // Delete и DeleteSet переносят записи в корзину: остальные методы их
+    // не видят, но ID не выдаются новым записям, пока PurgeTrash не удалит
+    // записи окончательно. ListTrash - страница корзины с фильтрами List,
+    // Undelete и UndeleteSet возвращают записи из корзины.
+    ListTrash(ctx context.Context, query *models.RecordQuery) (*models.RecordPage, error)
+    Undelete(ctx context.Context, id int) (*models.IPSetRecord, error)
+    UndeleteSet(ctx context.Context, setName string) ([]*models.IPSetRecord, error)
+    PurgeTrash(ctx context.Context, before time.Time) (int, error)
+    
+    // DeleteExpired окончательно удаляет записи, истекшие к моменту at,
+    // минуя корзину, и возвращает их
+    DeleteExpired(ctx context.Context, at time.Time) ([]*models.IPSetRecord, error)
 }
 
+// AuditStorage - журнал аудита изменений записей и сетов. События только
+// добавляются, Append выставляет ID события.
+type AuditStorage interface {
+    Append(ctx context.Context, event *models.AuditEvent) error
+    List(ctx context.Context, query *models.AuditQuery) (*models.AuditPage, error)
+}
+
+// WebhookStorage - подписки на изменения и очередь их доставки (см.
+// webhooks.go). Create* выставляют ID, EnqueueDeliveries сохраняет доставки
+// вместе с номером изменения, до которого они созданы; WebhookCursor
+// возвращает этот номер, -1 - если доставки еще не создавались.
+type WebhookStorage interface {
+    CreateWebhook(ctx context.Context, webhook *models.Webhook) error
+    GetWebhook(ctx context.Context, id int64) (*models.Webhook, error)
+    ListWebhooks(ctx context.Context) ([]*models.Webhook, error)
+    UpdateWebhook(ctx context.Context, webhook *models.Webhook) error
+    DeleteWebhook(ctx context.Context, id int64) error
+    
+    WebhookCursor(ctx context.Context) (int64, error)
+    EnqueueDeliveries(ctx context.Context, deliveries []*models.WebhookDelivery, revision int64) error
+    // DueDeliveries - ожидающие доставки, время попытки которых наступило к at
+    DueDeliveries(ctx context.Context, at time.Time, limit int) ([]*models.WebhookDelivery, error)
+    GetDelivery(ctx context.Context, id int64) (*models.WebhookDelivery, error)
+    UpdateDelivery(ctx context.Context, delivery *models.WebhookDelivery) error
+    ListDeliveries(ctx context.Context, query *models.DeliveryQuery) (*models.DeliveryPage, error)
+    PurgeDeliveries(ctx context.Context, before time.Time) (int, error)
+}
+
+// AgentStorage - реестр агентов и правила назначения им сетов (см.
+// agents.go). SaveAgent создает или целиком заменяет агента с тем же
+// именем хоста, CreateAssignment выставляет ID правила.
+type AgentStorage interface {
+    SaveAgent(ctx context.Context, agent *models.Agent) error
+    GetAgent(ctx context.Context, hostname string) (*models.Agent, error)
+    ListAgents(ctx context.Context) ([]*models.Agent, error)
+    DeleteAgent(ctx context.Context, hostname string) error
+    
+    CreateAssignment(ctx context.Context, rule *models.AssignmentRule) error
+    GetAssignment(ctx context.Context, id int64) (*models.AssignmentRule, error)
+    ListAssignments(ctx context.Context) ([]*models.AssignmentRule, error)
+    UpdateAssignment(ctx context.Context, rule *models.AssignmentRule) error
+    DeleteAssignment(ctx context.Context, id int64) error
+}
+
+// RecordImporter - хранилище, которое умеет сохранить запись как есть:
+// с заданным ID и временем создания/изменения. Используется при переносе
+// данных между хранилищами. Существующая запись с тем же ID заменяется,
+// так же ImportSet заменяет сет с тем же именем.
+type RecordImporter interface {
+    ImportRecord(ctx context.Context, record *models.IPSetRecord) error
+    ImportSet(ctx context.Context, set *models.IPSetSet) error
+}
+
+// ExpiredCounter - хранилище, которое умеет посчитать истекшие к моменту at
+// записи, которые еще не удалены DeleteExpired. GetAll их не отдает, поэтому
+// при переносе данных они не копируются.
+type ExpiredCounter interface {
+    CountExpired(ctx context.Context, at time.Time) (int, error)
+}
+
+// withQueryTimeout ограничивает время одного обращения к хранилищу.
+// Если у контекста уже есть более ранний дедлайн, действует он.
+func withQueryTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+    if timeout <= 0 {
+        return context.WithCancel(ctx)
+    }
+    return context.WithTimeout(ctx, timeout)
+}
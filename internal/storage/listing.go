@@ -0,0 +1,467 @@
+package storage
+
+import (
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+    "ipset-api-server/internal/models"
+)
+
+const (
+    DefaultListLimit = 100
+    MaxListLimit     = 1000
+)
+
+// recordSortFields - поля, по которым можно сортировать записи
+var recordSortFields = map[string]bool{
+    "id":         true,
+    "set_name":   true,
+    "ip":         true,
+    "context":    true,
+    "created_at": true,
+    "updated_at": true,
+}
+
+// listCursor - позиция в выборке: значение поля сортировки и ID последней
+// записи предыдущей страницы. Для сетов используется только Value (имя сета).
+type listCursor struct {
+    Value string `json:"v"`
+    ID    int    `json:"id,omitempty"`
+}
+
+func encodeCursor(c listCursor) string {
+    data, _ := json.Marshal(c)
+    return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (*listCursor, error) {
+    if s == "" {
+        return nil, nil
+    }
+
+    data, err := base64.RawURLEncoding.DecodeString(s)
+    if err != nil {
+        return nil, fmt.Errorf("invalid cursor")
+    }
+
+    var c listCursor
+    if err := json.Unmarshal(data, &c); err != nil {
+        return nil, fmt.Errorf("invalid cursor")
+    }
+    return &c, nil
+}
+
+func normalizeLimit(limit int) int {
+    if limit <= 0 {
+        return DefaultListLimit
+    }
+    if limit > MaxListLimit {
+        return MaxListLimit
+    }
+    return limit
+}
+
+// NormalizeRecordQuery проверяет поле сортировки и курсор и выставляет
+// лимит по умолчанию. Вызывается хранилищами перед выборкой, API вызывает
+// ее заранее, чтобы отличить ошибку в параметрах от ошибки хранилища.
+func NormalizeRecordQuery(q *models.RecordQuery) error {
+    if q.SortBy == "" {
+        q.SortBy = "id"
+    }
+    if !recordSortFields[q.SortBy] {
+        return fmt.Errorf("unsupported sort field: %s", q.SortBy)
+    }
+
+    q.Limit = normalizeLimit(q.Limit)
+
+    c, err := decodeCursor(q.Cursor)
+    if err != nil {
+        return err
+    }
+    if c != nil {
+        if _, err := cursorArg(q.SortBy, c.Value); err != nil {
+            return fmt.Errorf("invalid cursor")
+        }
+    }
+    return nil
+}
+
+// NormalizeSetQuery - то же для выборки сетов
+func NormalizeSetQuery(q *models.SetQuery) error {
+    q.Limit = normalizeLimit(q.Limit)
+
+    _, err := decodeCursor(q.Cursor)
+    return err
+}
+
+// recordSortValue возвращает значение поля сортировки записи в виде строки
+// для курсора. Время хранится в UTC с наносекундами, чтобы не терять точность.
+func recordSortValue(record *models.IPSetRecord, field string) string {
+    switch field {
+    case "set_name":
+        return record.SetName
+    case "ip":
+        return record.IP
+    case "context":
+        return record.Context
+    case "created_at":
+        return record.CreatedAt.UTC().Format(time.RFC3339Nano)
+    case "updated_at":
+        return record.UpdatedAt.UTC().Format(time.RFC3339Nano)
+    default:
+        return strconv.Itoa(record.ID)
+    }
+}
+
+// cursorArg превращает значение из курсора в аргумент запроса
+func cursorArg(field, value string) (interface{}, error) {
+    switch field {
+    case "id":
+        return strconv.Atoi(value)
+    case "created_at", "updated_at":
+        t, err := time.Parse(time.RFC3339Nano, value)
+        if err != nil {
+            return nil, err
+        }
+        return t.UTC(), nil
+    default:
+        return value, nil
+    }
+}
+
+// recordPage обрезает выборку, полученную с лимитом limit+1, и строит
+// курсор следующей страницы по последней записи
+func recordPage(records []*models.IPSetRecord, q *models.RecordQuery) *models.RecordPage {
+    page := &models.RecordPage{Records: records}
+    if len(records) > q.Limit {
+        page.Records = records[:q.Limit]
+        last := page.Records[len(page.Records)-1]
+        page.NextCursor = encodeCursor(listCursor{Value: recordSortValue(last, q.SortBy), ID: last.ID})
+    }
+    if page.Records == nil {
+        page.Records = []*models.IPSetRecord{}
+    }
+    return page
+}
+
+func setPage(sets []*models.IPSetSet, q *models.SetQuery) *models.SetPage {
+    page := &models.SetPage{Sets: sets}
+    if len(sets) > q.Limit {
+        page.Sets = sets[:q.Limit]
+        page.NextCursor = encodeCursor(listCursor{Value: page.Sets[len(page.Sets)-1].Name})
+    }
+    if page.Sets == nil {
+        page.Sets = []*models.IPSetSet{}
+    }
+    return page
+}
+
+// sqlDialect описывает различия SQL хранилищ, которые важны для построения
+// запроса выборки
+type sqlDialect struct {
+    // placeholder возвращает n-й параметр запроса (нумерация с 1)
+    placeholder func(n int) string
+    // contains - условие "колонка содержит подстроку" без учета регистра
+    contains func(column, arg string) string
+    // now - текущее время в том виде, в каком хранятся времена записей
+    now string
+    // forUpdate - блокировка читаемых строк до конца транзакции. В SQLite
+    // транзакции на запись и так выполняются по одной.
+    forUpdate string
+}
+
+var questionPlaceholder = func(int) string { return "?" }
+
+var (
+    mySQLDialect = sqlDialect{
+        placeholder: questionPlaceholder,
+        // Сравнение в MySQL и так не учитывает регистр (collation *_ci)
+        contains: func(column, arg string) string { return fmt.Sprintf("LOCATE(%s, %s) > 0", arg, column) },
+        // Драйвер пишет времена в UTC (loc по умолчанию)
+        now:       "UTC_TIMESTAMP(6)",
+        forUpdate: " FOR UPDATE",
+    }
+    postgreSQLDialect = sqlDialect{
+        placeholder: func(n int) string { return fmt.Sprintf("$%d", n) },
+        contains:    func(column, arg string) string { return fmt.Sprintf("strpos(lower(%s), lower(%s)) > 0", column, arg) },
+        now:         "now()",
+        forUpdate:   " FOR UPDATE",
+    }
+    sqliteDialect = sqlDialect{
+        placeholder: questionPlaceholder,
+        contains:    func(column, arg string) string { return fmt.Sprintf("instr(lower(%s), lower(%s)) > 0", column, arg) },
+        // Времена хранятся текстом в UTC, в формате драйвера, поэтому
+        // сравниваются как строки
+        now: "strftime('%Y-%m-%d %H:%M:%f+00:00', 'now')",
+    }
+    clickHouseDialect = sqlDialect{
+        placeholder: questionPlaceholder,
+        contains:    func(column, arg string) string { return fmt.Sprintf("positionCaseInsensitive(%s, %s) > 0", column, arg) },
+        now:         "now()",
+    }
+)
+
+// sqlConditions собирает условия WHERE и аргументы с учетом нумерации
+// параметров диалекта
+type sqlConditions struct {
+    dialect    sqlDialect
+    conditions []string
+    args       []interface{}
+}
+
+func (c *sqlConditions) arg(value interface{}) string {
+    if t, ok := value.(time.Time); ok {
+        value = t.UTC()
+    }
+    c.args = append(c.args, value)
+    return c.dialect.placeholder(len(c.args))
+}
+
+func (c *sqlConditions) add(format string, values ...interface{}) {
+    placeholders := make([]interface{}, len(values))
+    for i, value := range values {
+        placeholders[i] = c.arg(value)
+    }
+    c.conditions = append(c.conditions, fmt.Sprintf(format, placeholders...))
+}
+
+func (c *sqlConditions) where() string {
+    if len(c.conditions) == 0 {
+        return ""
+    }
+    return "WHERE " + strings.Join(c.conditions, " AND ")
+}
+
+// buildRecordListSQL строит условия, сортировку и лимит для выборки записей.
+// Пагинация по курсору (keyset): следующая страница начинается после пары
+// (значение поля сортировки, id) последней записи, поэтому выборка остается
+// стабильной при вставках и не требует OFFSET. extra - условия, которые
+// хранилище добавляет всегда (например, is_deleted = 0 в ClickHouse).
+func buildRecordListSQL(q *models.RecordQuery, d sqlDialect, extra ...string) (string, []interface{}, error) {
+    if err := NormalizeRecordQuery(q); err != nil {
+        return "", nil, err
+    }
+
+    c := &sqlConditions{dialect: d, conditions: extra}
+
+    if q.SetName != "" {
+        c.add("set_name = %s", q.SetName)
+    }
+    if q.Context != "" {
+        c.conditions = append(c.conditions, d.contains("context", c.arg(q.Context)))
+    }
+    if q.Protocol != "" {
+        c.add("protocol = %s", q.Protocol)
+    }
+    if q.Port != 0 {
+        c.add("port = %s", q.Port)
+    }
+    if !q.CreatedAfter.IsZero() {
+        c.add("created_at >= %s", q.CreatedAfter)
+    }
+    if !q.CreatedBefore.IsZero() {
+        c.add("created_at < %s", q.CreatedBefore)
+    }
+    if !q.UpdatedAfter.IsZero() {
+        c.add("updated_at >= %s", q.UpdatedAfter)
+    }
+    if !q.UpdatedBefore.IsZero() {
+        c.add("updated_at < %s", q.UpdatedBefore)
+    }
+
+    op, dir := ">", "ASC"
+    if q.Desc {
+        op, dir = "<", "DESC"
+    }
+
+    cursor, _ := decodeCursor(q.Cursor)
+    if cursor != nil {
+        value, _ := cursorArg(q.SortBy, cursor.Value)
+        if q.SortBy == "id" {
+            c.add("id "+op+" %s", value)
+        } else {
+            c.add(fmt.Sprintf("(%[1]s %[2]s %%s OR (%[1]s = %%s AND id %[2]s %%s))", q.SortBy, op), value, value, cursor.ID)
+        }
+    }
+
+    order := fmt.Sprintf("ORDER BY %s %s", q.SortBy, dir)
+    if q.SortBy != "id" {
+        order += fmt.Sprintf(", id %s", dir)
+    }
+
+    query := fmt.Sprintf("%s %s LIMIT %d", c.where(), order, q.Limit+1)
+    return query, c.args, nil
+}
+
+// buildSetListSQL строит условия, сортировку и лимит для выборки сетов из
+// ipset_sets, сортировка по имени
+func buildSetListSQL(q *models.SetQuery, d sqlDialect, extra ...string) (where string, tail string, args []interface{}, err error) {
+    if err := NormalizeSetQuery(q); err != nil {
+        return "", "", nil, err
+    }
+
+    c := &sqlConditions{dialect: d, conditions: extra}
+
+    if q.SetType != "" {
+        c.add("type = %s", q.SetType)
+    }
+
+    op, dir := ">", "ASC"
+    if q.Desc {
+        op, dir = "<", "DESC"
+    }
+
+    cursor, _ := decodeCursor(q.Cursor)
+    if cursor != nil {
+        c.add("name "+op+" %s", cursor.Value)
+    }
+
+    tail = fmt.Sprintf("ORDER BY name %s LIMIT %d", dir, q.Limit+1)
+    return c.where(), tail, c.args, nil
+}
+
+// listRecordsInMemory - выборка для хранилищ, которые держат записи в памяти
+func listRecordsInMemory(records []*models.IPSetRecord, q *models.RecordQuery) (*models.RecordPage, error) {
+    if err := NormalizeRecordQuery(q); err != nil {
+        return nil, err
+    }
+
+    cursor, _ := decodeCursor(q.Cursor)
+    var cursorValue interface{}
+    if cursor != nil {
+        cursorValue, _ = cursorArg(q.SortBy, cursor.Value)
+    }
+
+    contextQuery := strings.ToLower(q.Context)
+
+    var matched []*models.IPSetRecord
+    for _, record := range records {
+        if q.SetName != "" && record.SetName != q.SetName {
+            continue
+        }
+        if contextQuery != "" && !strings.Contains(strings.ToLower(record.Context), contextQuery) {
+            continue
+        }
+        if q.Protocol != "" && record.Protocol != q.Protocol {
+            continue
+        }
+        if q.Port != 0 && record.Port != q.Port {
+            continue
+        }
+        if !q.CreatedAfter.IsZero() && record.CreatedAt.Before(q.CreatedAfter) {
+            continue
+        }
+        if !q.CreatedBefore.IsZero() && !record.CreatedAt.Before(q.CreatedBefore) {
+            continue
+        }
+        if !q.UpdatedAfter.IsZero() && record.UpdatedAt.Before(q.UpdatedAfter) {
+            continue
+        }
+        if !q.UpdatedBefore.IsZero() && !record.UpdatedAt.Before(q.UpdatedBefore) {
+            continue
+        }
+        if cursor != nil {
+            cmp := compareRecordField(record, q.SortBy, cursorValue)
+            if cmp == 0 && q.SortBy != "id" {
+                cmp = compareInts(record.ID, cursor.ID)
+            }
+            if (!q.Desc && cmp <= 0) || (q.Desc && cmp >= 0) {
+                continue
+            }
+        }
+        matched = append(matched, record)
+    }
+
+    sort.Slice(matched, func(i, j int) bool {
+        a, b := matched[i], matched[j]
+        cmp := compareRecordField(a, q.SortBy, sortFieldValue(b, q.SortBy))
+        if cmp == 0 {
+            cmp = compareInts(a.ID, b.ID)
+        }
+        if q.Desc {
+            return cmp > 0
+        }
+        return cmp < 0
+    })
+
+    if len(matched) > q.Limit+1 {
+        matched = matched[:q.Limit+1]
+    }
+    return recordPage(matched, q), nil
+}
+
+// sortFieldValue возвращает значение поля сортировки в том же виде, что и cursorArg
+func sortFieldValue(record *models.IPSetRecord, field string) interface{} {
+    switch field {
+    case "id":
+        return record.ID
+    case "created_at":
+        return record.CreatedAt
+    case "updated_at":
+        return record.UpdatedAt
+    default:
+        return recordSortValue(record, field)
+    }
+}
+
+func compareRecordField(record *models.IPSetRecord, field string, value interface{}) int {
+    switch v := value.(type) {
+    case int:
+        return compareInts(record.ID, v)
+    case time.Time:
+        t := sortFieldValue(record, field).(time.Time)
+        return t.Compare(v)
+    case string:
+        return strings.Compare(recordSortValue(record, field), v)
+    }
+    return 0
+}
+
+func compareInts(a, b int) int {
+    switch {
+    case a < b:
+        return -1
+    case a > b:
+        return 1
+    }
+    return 0
+}
+
+// listSetsInMemory - выборка сетов для хранилищ, которые держат записи в памяти
+func listSetsInMemory(sets []*models.IPSetSet, q *models.SetQuery) (*models.SetPage, error) {
+    if err := NormalizeSetQuery(q); err != nil {
+        return nil, err
+    }
+
+    cursor, _ := decodeCursor(q.Cursor)
+
+    var matched []*models.IPSetSet
+    for _, set := range sets {
+        if q.SetType != "" && set.Type != q.SetType {
+            continue
+        }
+        if cursor != nil {
+            cmp := strings.Compare(set.Name, cursor.Value)
+            if (!q.Desc && cmp <= 0) || (q.Desc && cmp >= 0) {
+                continue
+            }
+        }
+        matched = append(matched, set)
+    }
+
+    sort.Slice(matched, func(i, j int) bool {
+        if q.Desc {
+            return matched[i].Name > matched[j].Name
+        }
+        return matched[i].Name < matched[j].Name
+    })
+
+    if len(matched) > q.Limit+1 {
+        matched = matched[:q.Limit+1]
+    }
+    return setPage(matched, q), nil
+}
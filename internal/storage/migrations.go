@@ -0,0 +1,324 @@
+package storage
+
+import (
+    "context"
+    "database/sql"
+    "fmt"
+    "time"
+    "ipset-api-server/internal/config"
+
+    "github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// Migration - шаг изменения схемы базы данных. Версии в списке миграции
+// диалекта идут по возрастанию, начиная с 1, и никогда не переиспользуются:
+// чтобы изменить схему, добавляется новая миграция в конец списка.
+type Migration struct {
+    Version     int
+    Description string
+    Statements  []string
+
+    // Backfill - заполнение данных после Statements в той же транзакции,
+    // если новые колонки вычисляются в Go. ClickHouse его не поддерживает.
+    Backfill func(ctx context.Context, tx *sql.Tx) error `json:"-"`
+}
+
+// AppliedMigration - запись из таблицы schema_version
+type AppliedMigration struct {
+    Version     int       `json:"version"`
+    Description string    `json:"description"`
+    AppliedAt   time.Time `json:"applied_at"`
+}
+
+// SchemaStatus - состояние схемы базы данных относительно известных миграций
+type SchemaStatus struct {
+    StorageType string             `json:"storage_type"`
+    Current     int                `json:"current"`
+    Latest      int                `json:"latest"`
+    Applied     []AppliedMigration `json:"applied"`
+    Pending     []Migration        `json:"pending"`
+}
+
+// schemaMigrator - доступ к таблице schema_version конкретного диалекта
+type schemaMigrator interface {
+    storageType() string
+    migrations() []Migration
+    ensureVersionTable(ctx context.Context) error
+    applied(ctx context.Context) ([]AppliedMigration, error)
+    apply(ctx context.Context, m Migration) error
+}
+
+func latestVersion(migrations []Migration) int {
+    if len(migrations) == 0 {
+        return 0
+    }
+    return migrations[len(migrations)-1].Version
+}
+
+func schemaStatus(ctx context.Context, m schemaMigrator) (*SchemaStatus, error) {
+    if err := m.ensureVersionTable(ctx); err != nil {
+        return nil, fmt.Errorf("failed to create schema_version table: %v", err)
+    }
+
+    applied, err := m.applied(ctx)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read schema version: %v", err)
+    }
+
+    status := &SchemaStatus{
+        StorageType: m.storageType(),
+        Latest:      latestVersion(m.migrations()),
+        Applied:     applied,
+    }
+
+    done := make(map[int]bool, len(applied))
+    for _, a := range applied {
+        done[a.Version] = true
+        if a.Version > status.Current {
+            status.Current = a.Version
+        }
+    }
+
+    for _, migration := range m.migrations() {
+        if !done[migration.Version] {
+            status.Pending = append(status.Pending, migration)
+        }
+    }
+
+    return status, nil
+}
+
+func migrateUp(ctx context.Context, m schemaMigrator) ([]Migration, error) {
+    status, err := schemaStatus(ctx, m)
+    if err != nil {
+        return nil, err
+    }
+
+    if status.Current > status.Latest {
+        return nil, fmt.Errorf("%s schema version %d is newer than supported version %d", status.StorageType, status.Current, status.Latest)
+    }
+
+    var done []Migration
+    for _, migration := range status.Pending {
+        if err := m.apply(ctx, migration); err != nil {
+            return done, fmt.Errorf("migration %d (%s) failed: %v", migration.Version, migration.Description, err)
+        }
+        done = append(done, migration)
+    }
+
+    return done, nil
+}
+
+// ensureSchema вызывается при открытии хранилища: отказывается работать со
+// схемой новее известной и применяет недостающие миграции, если это разрешено
+func ensureSchema(m schemaMigrator, autoMigrate bool) error {
+    ctx := context.Background()
+
+    status, err := schemaStatus(ctx, m)
+    if err != nil {
+        return err
+    }
+
+    if status.Current > status.Latest {
+        return fmt.Errorf("%s schema version %d is newer than supported version %d, upgrade the server", status.StorageType, status.Current, status.Latest)
+    }
+
+    if len(status.Pending) == 0 {
+        return nil
+    }
+
+    if !autoMigrate {
+        return fmt.Errorf("%s schema is at version %d, %d migrations pending: run 'ipset-admin migrate up'", status.StorageType, status.Current, len(status.Pending))
+    }
+
+    _, err = migrateUp(ctx, m)
+    return err
+}
+
+// sqlMigrator - миграции для хранилищ на database/sql
+type sqlMigrator struct {
+    db         *sql.DB
+    name       string
+    list       []Migration
+    insertStmt string
+}
+
+func (m *sqlMigrator) storageType() string {
+    return m.name
+}
+
+func (m *sqlMigrator) migrations() []Migration {
+    return m.list
+}
+
+func (m *sqlMigrator) ensureVersionTable(ctx context.Context) error {
+    _, err := m.db.ExecContext(ctx, `
+        CREATE TABLE IF NOT EXISTS schema_version (
+            version INTEGER PRIMARY KEY,
+            description VARCHAR(255) NOT NULL,
+            applied_at TIMESTAMP NOT NULL
+        )
+    `)
+    return err
+}
+
+func (m *sqlMigrator) applied(ctx context.Context) ([]AppliedMigration, error) {
+    rows, err := m.db.QueryContext(ctx, "SELECT version, description, applied_at FROM schema_version ORDER BY version")
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var applied []AppliedMigration
+    for rows.Next() {
+        var a AppliedMigration
+        if err := rows.Scan(&a.Version, &a.Description, &a.AppliedAt); err != nil {
+            return nil, err
+        }
+        applied = append(applied, a)
+    }
+
+    return applied, rows.Err()
+}
+
+// apply выполняет миграцию в транзакции. MySQL фиксирует DDL неявно,
+// поэтому там миграции должны быть идемпотентными.
+func (m *sqlMigrator) apply(ctx context.Context, migration Migration) error {
+    tx, err := m.db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    for _, stmt := range migration.Statements {
+        if _, err := tx.ExecContext(ctx, stmt); err != nil {
+            return err
+        }
+    }
+
+    if migration.Backfill != nil {
+        if err := migration.Backfill(ctx, tx); err != nil {
+            return err
+        }
+    }
+
+    if _, err := tx.ExecContext(ctx, m.insertStmt, migration.Version, migration.Description, time.Now().UTC()); err != nil {
+        return err
+    }
+
+    return tx.Commit()
+}
+
+// clickHouseMigrator - миграции для ClickHouse. Транзакций нет, поэтому
+// каждая миграция должна быть идемпотентной (IF NOT EXISTS и т.п.)
+type clickHouseMigrator struct {
+    conn driver.Conn
+}
+
+func (m *clickHouseMigrator) storageType() string {
+    return "clickhouse"
+}
+
+func (m *clickHouseMigrator) migrations() []Migration {
+    return clickHouseMigrations
+}
+
+func (m *clickHouseMigrator) ensureVersionTable(ctx context.Context) error {
+    return m.conn.Exec(ctx, `
+        CREATE TABLE IF NOT EXISTS schema_version (
+            version UInt32,
+            description String,
+            applied_at DateTime
+        ) ENGINE = MergeTree()
+        ORDER BY version
+    `)
+}
+
+func (m *clickHouseMigrator) applied(ctx context.Context) ([]AppliedMigration, error) {
+    rows, err := m.conn.Query(ctx, "SELECT version, description, applied_at FROM schema_version ORDER BY version")
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var applied []AppliedMigration
+    for rows.Next() {
+        var version uint32
+        var a AppliedMigration
+        if err := rows.Scan(&version, &a.Description, &a.AppliedAt); err != nil {
+            return nil, err
+        }
+        a.Version = int(version)
+        applied = append(applied, a)
+    }
+
+    return applied, rows.Err()
+}
+
+func (m *clickHouseMigrator) apply(ctx context.Context, migration Migration) error {
+    for _, stmt := range migration.Statements {
+        if err := m.conn.Exec(ctx, stmt); err != nil {
+            return err
+        }
+    }
+
+    return m.conn.Exec(ctx, "INSERT INTO schema_version (version, description, applied_at) VALUES (?, ?, ?)",
+        uint32(migration.Version), migration.Description, time.Now().UTC())
+}
+
+// openMigrator открывает соединение с базой данных указанного типа без
+// проверки схемы. Возвращает функцию для закрытия соединения.
+func openMigrator(storageType string, cfg *config.Config) (schemaMigrator, func() error, error) {
+    switch storageType {
+    case "mysql":
+        db, err := openMySQL(cfg)
+        if err != nil {
+            return nil, nil, err
+        }
+        return newMySQLMigrator(db), db.Close, nil
+    case "postgresql":
+        db, err := openPostgreSQL(cfg)
+        if err != nil {
+            return nil, nil, err
+        }
+        return newPostgreSQLMigrator(db), db.Close, nil
+    case "sqlite":
+        db, err := openSQLite(cfg.SQLitePath)
+        if err != nil {
+            return nil, nil, err
+        }
+        return newSQLiteMigrator(db), db.Close, nil
+    case "clickhouse":
+        conn, err := openClickHouse(cfg)
+        if err != nil {
+            return nil, nil, err
+        }
+        return &clickHouseMigrator{conn: conn}, conn.Close, nil
+    case "file":
+        return nil, nil, fmt.Errorf("file storage has no schema to migrate")
+    default:
+        return nil, nil, fmt.Errorf("unsupported storage type: %s", storageType)
+    }
+}
+
+// GetSchemaStatus возвращает состояние схемы базы данных указанного типа
+func GetSchemaStatus(ctx context.Context, storageType string, cfg *config.Config) (*SchemaStatus, error) {
+    m, closeFn, err := openMigrator(storageType, cfg)
+    if err != nil {
+        return nil, err
+    }
+    defer closeFn()
+
+    return schemaStatus(ctx, m)
+}
+
+// MigrateSchema применяет все недостающие миграции и возвращает примененные
+func MigrateSchema(ctx context.Context, storageType string, cfg *config.Config) ([]Migration, error) {
+    m, closeFn, err := openMigrator(storageType, cfg)
+    if err != nil {
+        return nil, err
+    }
+    defer closeFn()
+
+    return migrateUp(ctx, m)
+}
@@ -1,8 +1,11 @@
 package storage
 
 import (
+    "context"
     "database/sql"
     "fmt"
+    "net/netip"
+    "strings"
      "time"
     "ipset-api-server/internal/config"
     "ipset-api-server/internal/models"
@@ -10,11 +13,357 @@ import (
     _ "github.com/go-sql-driver/mysql"
 )
 
-// MySQLKeyStorage - реализация для хранения ключей в MySQL
-type MySQLKeyStorage struct {
-    db *sql.DB
+// mySQLMigrations - миграции схемы MySQL. DDL в MySQL не транзакционный,
+// поэтому каждая миграция должна безопасно выполняться повторно: колонки и
+// индексы добавляются через mySQLAddColumn и mySQLAddIndex.
+var mySQLMigrations = []Migration{
+    {
+        Version:     1,
+        Description: "create auth_keys and ipset_records",
+        Statements: []string{
+            `CREATE TABLE IF NOT EXISTS auth_keys (
+                key VARCHAR(255) PRIMARY KEY,
+                created_at DATETIME,
+                expires_at DATETIME,
+                is_active BOOLEAN
+            ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+            `CREATE TABLE IF NOT EXISTS ipset_records (
+                id INT PRIMARY KEY,
+                set_name VARCHAR(255) NOT NULL,
+                ip VARCHAR(45) NOT NULL,
+                cidr VARCHAR(45),
+                port INT,
+                protocol VARCHAR(10),
+                description TEXT,
+                context TEXT NOT NULL,
+                set_type VARCHAR(50),
+                set_options TEXT,
+                created_at DATETIME,
+                updated_at DATETIME,
+                INDEX idx_set_name (set_name),
+                INDEX idx_ip (ip),
+                INDEX idx_context (context(255)),
+                CONSTRAINT chk_id CHECK (id >= 100000 AND id <= 999999)
+            ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+            // Триггер для автоматического обновления updated_at
+            `DROP TRIGGER IF EXISTS update_ipset_records_updated_at`,
+            `CREATE TRIGGER update_ipset_records_updated_at
+                BEFORE UPDATE ON ipset_records
+                FOR EACH ROW
+                SET NEW.updated_at = NOW()`,
+        },
+    },
+    {
+        Version:     2,
+        Description: "add second_ip to ipset_records",
+        // Третий компонент записей hash:ip,port,ip и hash:ip,port,net
+        Statements: mySQLAddColumn("ipset_records", "second_ip", "VARCHAR(64) NOT NULL DEFAULT '' AFTER protocol"),
+    },
+    {
+        Version:     3,
+        Description: "add address range columns to ipset_records",
+        // Первый и последний адрес записи (INET6_ATON-совместимые 16 байт,
+        // IPv4 как ::ffff:a.b.c.d) для Lookup, NULL у записей без IP-адреса
+        Statements: joinStatements(
+            mySQLAddColumn("ipset_records", "range_start", "VARBINARY(16) NULL AFTER second_ip"),
+            mySQLAddColumn("ipset_records", "range_end", "VARBINARY(16) NULL AFTER range_start"),
+            mySQLAddIndex("ipset_records", "idx_range", "range_start, range_end"),
+        ),
+        Backfill: backfillAddrRanges,
+    },
+    {
+        Version:     4,
+        Description: "create audit_log",
+        Statements: []string{
+            `CREATE TABLE IF NOT EXISTS audit_log (
+                id BIGINT AUTO_INCREMENT PRIMARY KEY,
+                created_at DATETIME(6) NOT NULL,
+                actor VARCHAR(64) NOT NULL,
+                request_id VARCHAR(64) NOT NULL DEFAULT '',
+                action VARCHAR(32) NOT NULL,
+                set_name VARCHAR(255) NOT NULL,
+                record_id INT NOT NULL,
+                before_json MEDIUMTEXT,
+                after_json MEDIUMTEXT,
+                INDEX idx_audit_created_at (created_at),
+                INDEX idx_audit_record_id (record_id),
+                INDEX idx_audit_set_name (set_name),
+                INDEX idx_audit_actor (actor)
+            ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+        },
+    },
+    {
+        Version:     5,
+        Description: "create ipset_record_history",
+        Statements: []string{
+            `CREATE TABLE IF NOT EXISTS ipset_record_history (
+                record_id INT NOT NULL,
+                revision INT NOT NULL,
+                operation VARCHAR(16) NOT NULL,
+                changed_at DATETIME(6) NOT NULL,
+                set_name VARCHAR(255) NOT NULL,
+                ip VARCHAR(45) NOT NULL,
+                cidr VARCHAR(45),
+                port INT,
+                protocol VARCHAR(10),
+                description TEXT,
+                context TEXT NOT NULL,
+                set_type VARCHAR(50),
+                set_options TEXT,
+                second_ip VARCHAR(64),
+                created_at DATETIME,
+                updated_at DATETIME,
+                PRIMARY KEY (record_id, revision),
+                INDEX idx_history_set_name (set_name)
+            ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+            historyBackfillSQL,
+            // Время создания и изменения - updated_at после триггера
+            // update_ipset_records_updated_at, время удаления - текущее
+            `DROP TRIGGER IF EXISTS ipset_records_history_insert`,
+            `CREATE TRIGGER ipset_records_history_insert
+                AFTER INSERT ON ipset_records
+                FOR EACH ROW
+                ` + historyInsertSQL("NEW", "'create'", "NEW.updated_at"),
+            `DROP TRIGGER IF EXISTS ipset_records_history_update`,
+            `CREATE TRIGGER ipset_records_history_update
+                AFTER UPDATE ON ipset_records
+                FOR EACH ROW
+                ` + historyInsertSQL("NEW", "'update'", "NEW.updated_at"),
+            `DROP TRIGGER IF EXISTS ipset_records_history_delete`,
+            `CREATE TRIGGER ipset_records_history_delete
+                AFTER DELETE ON ipset_records
+                FOR EACH ROW
+                ` + historyInsertSQL("OLD", "'delete'", "NOW(6)"),
+        },
+    },
+    {
+        Version:     6,
+        Description: "add deleted_at to ipset_records",
+        // Время переноса в корзину, NULL у действующих записей
+        Statements: joinStatements(
+            mySQLAddColumn("ipset_records", "deleted_at", "DATETIME(6) NULL"),
+            mySQLAddIndex("ipset_records", "idx_deleted_at", "deleted_at"),
+            []string{
+                `DROP TRIGGER IF EXISTS ipset_records_history_update`,
+                `CREATE TRIGGER ipset_records_history_update
+                    AFTER UPDATE ON ipset_records
+                    FOR EACH ROW
+                    ` + historyInsertSQL("NEW", trashOperationSQL, trashChangedAtSQL),
+                `DROP TRIGGER IF EXISTS ipset_records_history_delete`,
+                `CREATE TRIGGER ipset_records_history_delete
+                    AFTER DELETE ON ipset_records
+                    FOR EACH ROW
+                BEGIN
+                    IF OLD.deleted_at IS NULL THEN
+                        ` + historyInsertSQL("OLD", "'delete'", "NOW(6)") + `;
+                    END IF;
+                END`,
+            },
+        ),
+    },
+    {
+        Version:     7,
+        Description: "add expires_at to ipset_records",
+        // Время истечения записи, NULL у бессрочных записей
+        Statements: joinStatements(
+            mySQLAddColumn("ipset_records", "expires_at", "DATETIME(6) NULL"),
+            mySQLAddIndex("ipset_records", "idx_expires_at", "expires_at"),
+        ),
+    },
+    {
+        Version:     8,
+        Description: "add activation window to ipset_records",
+        // Начало действия записи и расписание, в которое она действует
+        Statements: joinStatements(
+            mySQLAddColumn("ipset_records", "active_from", "DATETIME(6) NULL"),
+            mySQLAddColumn("ipset_records", "schedule", "VARCHAR(255) NOT NULL DEFAULT ''"),
+        ),
+    },
+    {
+        Version:     9,
+        Description: "create ipset_sets",
+        Statements: []string{
+            `CREATE TABLE IF NOT EXISTS ipset_sets (
+                name VARCHAR(255) PRIMARY KEY,
+                type VARCHAR(50) NOT NULL,
+                options VARCHAR(1024) NOT NULL DEFAULT '',
+                family VARCHAR(10) NOT NULL DEFAULT 'inet',
+                description VARCHAR(1024) NOT NULL DEFAULT '',
+                owner VARCHAR(255) NOT NULL DEFAULT '',
+                created_at DATETIME(6) NOT NULL,
+                updated_at DATETIME(6) NOT NULL
+            ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+            // Сеты записей, созданных до появления ipset_sets
+            setsBackfillSQL,
+        },
+    },
+    {
+        Version:     10,
+        Description: "create ipset_changes",
+        Statements: append([]string{
+            `CREATE TABLE IF NOT EXISTS ipset_changes (
+                revision BIGINT PRIMARY KEY,
+                changed_at DATETIME(6) NOT NULL,
+                kind VARCHAR(8) NOT NULL,
+                operation VARCHAR(16) NOT NULL,
+                set_name VARCHAR(255) NOT NULL,
+                record_id INT NOT NULL DEFAULT 0,
+                ip VARCHAR(45),
+                cidr VARCHAR(45),
+                port INT,
+                protocol VARCHAR(10),
+                second_ip VARCHAR(64),
+                description TEXT,
+                context TEXT,
+                set_type VARCHAR(50),
+                set_options TEXT,
+                family VARCHAR(10),
+                owner VARCHAR(255),
+                created_at DATETIME(6),
+                updated_at DATETIME(6),
+                expires_at DATETIME(6),
+                active_from DATETIME(6),
+                schedule VARCHAR(255)
+            ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+            `CREATE TABLE IF NOT EXISTS ipset_revision (
+                revision BIGINT NOT NULL
+            ) ENGINE=InnoDB`,
+        }, append(changesBackfillSQL, mySQLChangeTriggers()...)...),
+    },
+    {
+        Version:     11,
+        Description: "create webhooks",
+        Statements: []string{
+            `CREATE TABLE IF NOT EXISTS webhooks (
+                id BIGINT AUTO_INCREMENT PRIMARY KEY,
+                url TEXT NOT NULL,
+                secret VARCHAR(255) NOT NULL,
+                events VARCHAR(255) NOT NULL,
+                set_names TEXT NOT NULL,
+                description TEXT,
+                active BOOLEAN NOT NULL,
+                created_at DATETIME(6) NOT NULL,
+                updated_at DATETIME(6) NOT NULL
+            ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+            `CREATE TABLE IF NOT EXISTS webhook_deliveries (
+                id BIGINT AUTO_INCREMENT PRIMARY KEY,
+                webhook_id BIGINT NOT NULL,
+                revision BIGINT NOT NULL,
+                event VARCHAR(32) NOT NULL,
+                payload MEDIUMTEXT NOT NULL,
+                status VARCHAR(16) NOT NULL,
+                attempts INTEGER NOT NULL,
+                next_attempt_at DATETIME(6) NOT NULL,
+                last_status INTEGER NOT NULL,
+                last_error VARCHAR(1024) NOT NULL,
+                created_at DATETIME(6) NOT NULL,
+                updated_at DATETIME(6) NOT NULL,
+                INDEX idx_webhook_deliveries_due (status, next_attempt_at),
+                INDEX idx_webhook_deliveries_webhook_id (webhook_id)
+            ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+            // Номер последнего изменения, по которому созданы доставки
+            `CREATE TABLE IF NOT EXISTS webhook_cursor (
+                revision BIGINT NOT NULL
+            ) ENGINE=InnoDB`,
+        },
+    },
+    {
+        Version:     12,
+        Description: "create agents",
+        Statements: []string{
+            `CREATE TABLE IF NOT EXISTS agents (
+                hostname VARCHAR(255) PRIMARY KEY,
+                labels TEXT NOT NULL,
+                sets MEDIUMTEXT NOT NULL,
+                last_error TEXT,
+                registered_at DATETIME(6) NOT NULL,
+                last_seen_at DATETIME(6) NOT NULL
+            ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+            `CREATE TABLE IF NOT EXISTS agent_assignments (
+                id BIGINT AUTO_INCREMENT PRIMARY KEY,
+                selector TEXT NOT NULL,
+                sets TEXT NOT NULL,
+                description TEXT,
+                created_at DATETIME(6) NOT NULL,
+                updated_at DATETIME(6) NOT NULL
+            ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+        },
+    },
 }
-func NewMySQLKeyStorage(cfg *config.Config) (*MySQLKeyStorage, error) {
+
+// mySQLAddColumn и mySQLAddIndex - ALTER TABLE, который выполняется, только
+// если колонки или индекса в таблице еще нет. В MySQL нет ADD COLUMN IF NOT
+// EXISTS, а ALTER фиксируется сразу и не откатывается вместе с миграцией,
+// поэтому без проверки миграция, прерванная после ALTER, повторно падает с
+// Duplicate column name. ALTER собирается в переменной сессии и выполняется
+// как подготовленный запрос (DO 0, если колонка уже есть); все операторы
+// миграции идут в одной транзакции, то есть в одном соединении.
+func mySQLAddColumn(table, column, definition string) []string {
+    return mySQLAlterUnless(
+        fmt.Sprintf(`SELECT COUNT(*) FROM information_schema.COLUMNS
+                WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = '%s' AND COLUMN_NAME = '%s'`, table, column),
+        fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+}
+
+func mySQLAddIndex(table, index, columns string) []string {
+    return mySQLAlterUnless(
+        fmt.Sprintf(`SELECT COUNT(*) FROM information_schema.STATISTICS
+                WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = '%s' AND INDEX_NAME = '%s'`, table, index),
+        fmt.Sprintf("ALTER TABLE %s ADD INDEX %s (%s)", table, index, columns))
+}
+
+// mySQLAlterUnless - alter, если запрос exists вернул 0
+func mySQLAlterUnless(exists, alter string) []string {
+    return []string{
+        fmt.Sprintf(`SET @ipset_migration = IF((%s) > 0, 'DO 0', '%s')`, exists, strings.ReplaceAll(alter, "'", "''")),
+        `PREPARE ipset_migration FROM @ipset_migration`,
+        `EXECUTE ipset_migration`,
+        `DEALLOCATE PREPARE ipset_migration`,
+    }
+}
+
+// joinStatements склеивает операторы миграции по порядку
+func joinStatements(lists ...[]string) []string {
+    var statements []string
+    for _, list := range lists {
+        statements = append(statements, list...)
+    }
+    return statements
+}
+
+// mySQLChangeTriggers - триггеры, которые пишут ipset_changes
+func mySQLChangeTriggers() []string {
+    var statements []string
+    for _, t := range []struct {
+        table string
+        write func(event, now string) string
+    }{
+        {"ipset_records", recordChangesSQL},
+        {"ipset_sets", setChangesSQL},
+    } {
+        for _, event := range []string{"INSERT", "UPDATE", "DELETE"} {
+            name := t.table + "_changes_" + strings.ToLower(event)
+            statements = append(statements, "DROP TRIGGER IF EXISTS "+name, fmt.Sprintf(`CREATE TRIGGER %s
+                AFTER %s ON %s
+                FOR EACH ROW
+            BEGIN
+                %s;
+            END`, name, event, t.table, t.write(event, mySQLDialect.now)))
+        }
+    }
+    return statements
+}
+
+func newMySQLMigrator(db *sql.DB) *sqlMigrator {
+    return &sqlMigrator{
+        db:         db,
+        name:       "mysql",
+        list:       mySQLMigrations,
+        insertStmt: "INSERT INTO schema_version (version, description, applied_at) VALUES (?, ?, ?)",
+    }
+}
+
+func openMySQL(cfg *config.Config) (*sql.DB, error) {
     dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true&charset=utf8mb4",
         cfg.MySQLUsername,
         cfg.MySQLPassword,
@@ -44,24 +393,32 @@ func NewMySQLKeyStorage(cfg *config.Config) (*MySQLKeyStorage, error) {
         return nil, fmt.Errorf("failed to use database: %v", err)
     }
     
-    // Создаем таблицу если не существует
-    _, err = db.Exec(`
-        CREATE TABLE IF NOT EXISTS auth_keys (
-            key VARCHAR(255) PRIMARY KEY,
-            created_at DATETIME,
-            expires_at DATETIME,
-            is_active BOOLEAN
-        ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4
-    `)
+    return db, nil
+}
+
+// MySQLKeyStorage - реализация для хранения ключей в MySQL
+type MySQLKeyStorage struct {
+    db           *sql.DB
+    queryTimeout time.Duration
+}
+func NewMySQLKeyStorage(cfg *config.Config) (*MySQLKeyStorage, error) {
+    db, err := openMySQL(cfg)
     if err != nil {
-        return nil, fmt.Errorf("failed to create auth_keys table: %v", err)
+        return nil, err
     }
     
-    return &MySQLKeyStorage{db: db}, nil
+    if err := ensureSchema(newMySQLMigrator(db), cfg.AutoMigrate); err != nil {
+        return nil, err
+    }
+    
+    return &MySQLKeyStorage{db: db, queryTimeout: cfg.DBQueryTimeout}, nil
 }
-func (s *MySQLKeyStorage) GetKey(key string) (*models.AuthKey, error) {
+func (s *MySQLKeyStorage) GetKey(ctx context.Context, key string) (*models.AuthKey, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
     var authKey models.AuthKey
-    err := s.db.QueryRow(
+    err := s.db.QueryRowContext(ctx,
         "SELECT key, created_at, expires_at, is_active FROM auth_keys WHERE key = ?",
         key,
     ).Scan(&authKey.Key, &authKey.CreatedAt, &authKey.ExpiresAt, &authKey.IsActive)
@@ -76,8 +433,11 @@ func (s *MySQLKeyStorage) GetKey(key string) (*models.AuthKey, error) {
     return &authKey, nil
 }
 
-func (s *MySQLKeyStorage) SaveKey(key *models.AuthKey) error {
-    _, err := s.db.Exec(
+func (s *MySQLKeyStorage) SaveKey(ctx context.Context, key *models.AuthKey) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    _, err := s.db.ExecContext(ctx,
         `INSERT INTO auth_keys (key, created_at, expires_at, is_active) 
          VALUES (?, ?, ?, ?)
          ON DUPLICATE KEY UPDATE 
@@ -92,16 +452,22 @@ func (s *MySQLKeyStorage) SaveKey(key *models.AuthKey) error {
     return nil
 }
 
-func (s *MySQLKeyStorage) DeleteKey(key string) error {
-    _, err := s.db.Exec("DELETE FROM auth_keys WHERE key = ?", key)
+func (s *MySQLKeyStorage) DeleteKey(ctx context.Context, key string) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    _, err := s.db.ExecContext(ctx, "DELETE FROM auth_keys WHERE key = ?", key)
     if err != nil {
         return fmt.Errorf("failed to delete key: %v", err)
     }
     return nil
 }
 
-func (s *MySQLKeyStorage) ListKeys() ([]*models.AuthKey, error) {
-    rows, err := s.db.Query("SELECT key, created_at, expires_at, is_active FROM auth_keys ORDER BY created_at DESC")
+func (s *MySQLKeyStorage) ListKeys(ctx context.Context) ([]*models.AuthKey, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    rows, err := s.db.QueryContext(ctx, "SELECT key, created_at, expires_at, is_active FROM auth_keys ORDER BY created_at DESC")
     if err != nil {
         return nil, fmt.Errorf("failed to list keys: %v", err)
     }
@@ -121,88 +487,28 @@ func (s *MySQLKeyStorage) ListKeys() ([]*models.AuthKey, error) {
 
 // MySQLIPSetStorage - реализация для хранения ipset записей в MySQL
 type MySQLIPSetStorage struct {
-    db *sql.DB
+    db           *sql.DB
+    queryTimeout time.Duration
 }
 
 func NewMySQLIPSetStorage(cfg *config.Config) (*MySQLIPSetStorage, error) {
-    dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true&charset=utf8mb4",
-        cfg.MySQLUsername,
-        cfg.MySQLPassword,
-        cfg.MySQLHost,
-        cfg.MySQLPort,
-        cfg.MySQLDatabase,
-    )
-    
-    db, err := sql.Open("mysql", dsn)
+    db, err := openMySQL(cfg)
     if err != nil {
-        return nil, fmt.Errorf("failed to connect to mysql: %v", err)
+        return nil, err
     }
     
-    if err := db.Ping(); err != nil {
-        return nil, fmt.Errorf("failed to ping mysql: %v", err)
+    if err := ensureSchema(newMySQLMigrator(db), cfg.AutoMigrate); err != nil {
+        return nil, err
     }
     
-    // Создаем базу данных если не существует
-    _, err = db.Exec(fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s", cfg.MySQLDatabase))
-    if err != nil {
-        return nil, fmt.Errorf("failed to create database: %v", err)
-    }
-    
-    // Используем созданную базу данных
-    _, err = db.Exec(fmt.Sprintf("USE %s", cfg.MySQLDatabase))
-    if err != nil {
-        return nil, fmt.Errorf("failed to use database: %v", err)
-    }
-    
-    // Создаем таблицу если не существует
-    _, err = db.Exec(`
-        CREATE TABLE IF NOT EXISTS ipset_records (
-            id INT PRIMARY KEY,
-            set_name VARCHAR(255) NOT NULL,
-            ip VARCHAR(45) NOT NULL,
-            cidr VARCHAR(45),
-            port INT,
-            protocol VARCHAR(10),
-            description TEXT,
-            context TEXT NOT NULL,
-            set_type VARCHAR(50),
-            set_options TEXT,
-            created_at DATETIME,
-            updated_at DATETIME,
-            INDEX idx_set_name (set_name),
-            INDEX idx_ip (ip),
-            INDEX idx_context (context(255)),
-            CONSTRAINT chk_id CHECK (id >= 100000 AND id <= 999999)
-        ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4
-    `)
-    if err != nil {
-        return nil, fmt.Errorf("failed to create ipset_records table: %v", err)
-    }
-    
-    // Создаем триггер для автоматического обновления updated_at
-    _, err = db.Exec(`
-        DROP TRIGGER IF EXISTS update_ipset_records_updated_at
-    `)
-    if err != nil {
-        return nil, fmt.Errorf("failed to drop trigger: %v", err)
-    }
-    
-    _, err = db.Exec(`
-        CREATE TRIGGER update_ipset_records_updated_at
-        BEFORE UPDATE ON ipset_records
-        FOR EACH ROW
-        SET NEW.updated_at = NOW()
-    `)
-    if err != nil {
-        return nil, fmt.Errorf("failed to create trigger: %v", err)
-    }
-    
-    return &MySQLIPSetStorage{db: db}, nil
+    return &MySQLIPSetStorage{db: db, queryTimeout: cfg.DBQueryTimeout}, nil
 }
 
-func (s *MySQLIPSetStorage) getNextID() (int, error) {
+// getNextID ищет свободный ID; db - s.db или транзакция, в которой
+// вставляются записи
+func (s *MySQLIPSetStorage) getNextID(ctx context.Context, db sqlExecer) (int, error) {
     var maxID sql.NullInt64
-    err := s.db.QueryRow("SELECT MAX(id) FROM ipset_records").Scan(&maxID)
+    err := db.QueryRowContext(ctx, "SELECT MAX(id) FROM ipset_records").Scan(&maxID)
     if err != nil {
         return 0, fmt.Errorf("failed to get max ID: %v", err)
     }
@@ -216,71 +522,121 @@ func (s *MySQLIPSetStorage) getNextID() (int, error) {
     }
     
     if nextID > 999999 {
-        rows, err := s.db.Query(`
+        err := db.QueryRowContext(ctx, `
             SELECT t1.id + 1 AS next_id
             FROM ipset_records t1
             LEFT JOIN ipset_records t2 ON t1.id + 1 = t2.id
             WHERE t2.id IS NULL AND t1.id >= 100000 AND t1.id < 999999
             ORDER BY t1.id
             LIMIT 1
-        `)
+        `).Scan(&nextID)
+        if err == sql.ErrNoRows {
+            return 0, fmt.Errorf("no available IDs in range 100000-999999")
+        }
         if err != nil {
             return 0, fmt.Errorf("failed to find free ID: %v", err)
         }
-        defer rows.Close()
-        
-        if rows.Next() {
-            err = rows.Scan(&nextID)
-            if err != nil {
-                return 0, fmt.Errorf("failed to scan free ID: %v", err)
-            }
-        } else {
-            return 0, fmt.Errorf("no available IDs in range 100000-999999")
-        }
     }
     
     return nextID, nil
 }
 
-func (s *MySQLIPSetStorage) Create(record *models.IPSetRecord) error {
-    id, err := s.getNextID()
+func (s *MySQLIPSetStorage) Create(ctx context.Context, record *models.IPSetRecord) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    tx, err := s.db.BeginTx(ctx, nil)
     if err != nil {
-        return err
+        return fmt.Errorf("failed to begin transaction: %v", err)
     }
+    defer tx.Rollback()
     
-    record.ID = id
     now := time.Now()
     record.CreatedAt = now
     record.UpdatedAt = now
     
-    _, err = s.db.Exec(`
+    if err := s.ensureSet(ctx, tx, record); err != nil {
+        return err
+    }
+    if err := lockSet(ctx, tx, mySQLDialect, record.SetName); err != nil {
+        return err
+    }
+    
+    if err := s.insertNewRecord(ctx, tx, record); err != nil {
+        return err
+    }
+    if err := checkDuplicate(ctx, tx, mySQLDialect, record); err != nil {
+        return err
+    }
+    
+    if err := tx.Commit(); err != nil {
+        return fmt.Errorf("failed to commit transaction: %v", err)
+    }
+    
+    return nil
+}
+
+func (s *MySQLIPSetStorage) ImportRecord(ctx context.Context, record *models.IPSetRecord) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback()
+    
+    if err := lockSet(ctx, tx, mySQLDialect, record.SetName); err != nil {
+        return err
+    }
+    
+    // Удаляем и вставляем заново, чтобы триггер не перезаписал updated_at
+    if _, err := tx.ExecContext(ctx, "DELETE FROM ipset_records WHERE id = ?", record.ID); err != nil {
+        return fmt.Errorf("failed to import record %d: %v", record.ID, err)
+    }
+    
+    rangeStart, rangeEnd := addrRangeValues(record.IP, record.CIDR)
+    _, err = tx.ExecContext(ctx, `
         INSERT INTO ipset_records 
-        (id, set_name, ip, cidr, port, protocol, description, context, set_type, set_options, created_at, updated_at)
-        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+        (id, set_name, ip, cidr, port, protocol, description, context, set_type, set_options, second_ip,
+         range_start, range_end, created_at, updated_at, expires_at, active_from, schedule)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
     `,
         record.ID, record.SetName, record.IP, record.CIDR, record.Port, record.Protocol,
-        record.Description, record.Context, record.SetType, record.SetOptions,
-        record.CreatedAt, record.UpdatedAt,
+        record.Description, record.Context, record.SetType, record.SetOptions, record.SecondIP,
+        rangeStart, rangeEnd, record.CreatedAt, record.UpdatedAt, nullTimeValue(record.ExpiresAt), nullTimeValue(record.ActiveFrom), record.Schedule,
     )
-    
     if err != nil {
-        return fmt.Errorf("failed to create record: %v", err)
+        return fmt.Errorf("failed to import record %d: %v", record.ID, err)
+    }
+    if err := s.ensureSet(ctx, tx, record); err != nil {
+        return err
+    }
+    if err := checkDuplicate(ctx, tx, mySQLDialect, record); err != nil {
+        return err
+    }
+    
+    if err := tx.Commit(); err != nil {
+        return fmt.Errorf("failed to commit transaction: %v", err)
     }
     
     return nil
 }
 
-func (s *MySQLIPSetStorage) GetByID(id int) (*models.IPSetRecord, error) {
+func (s *MySQLIPSetStorage) GetByID(ctx context.Context, id int) (*models.IPSetRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
     var record models.IPSetRecord
-    err := s.db.QueryRow(`
+    err := s.db.QueryRowContext(ctx, `
         SELECT id, set_name, ip, cidr, port, protocol, description, context, 
-               set_type, set_options, created_at, updated_at
+               set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule
         FROM ipset_records
-        WHERE id = ?
+        WHERE id = ? AND `+activeRecordSQL(mySQLDialect)+`
     `, id).Scan(
         &record.ID, &record.SetName, &record.IP, &record.CIDR, &record.Port, &record.Protocol,
-        &record.Description, &record.Context, &record.SetType, &record.SetOptions,
-        &record.CreatedAt, &record.UpdatedAt,
+        &record.Description, &record.Context, &record.SetType, &record.SetOptions, &record.SecondIP,
+        &record.CreatedAt, &record.UpdatedAt, &record.ExpiresAt, &record.ActiveFrom, &record.Schedule,
     )
     
     if err == sql.ErrNoRows {
@@ -293,11 +649,15 @@ func (s *MySQLIPSetStorage) GetByID(id int) (*models.IPSetRecord, error) {
     return &record, nil
 }
 
-func (s *MySQLIPSetStorage) GetAll() ([]*models.IPSetRecord, error) {
-    rows, err := s.db.Query(`
+func (s *MySQLIPSetStorage) GetAll(ctx context.Context) ([]*models.IPSetRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    rows, err := s.db.QueryContext(ctx, `
         SELECT id, set_name, ip, cidr, port, protocol, description, context, 
-               set_type, set_options, created_at, updated_at
+               set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule
         FROM ipset_records
+        WHERE `+activeRecordSQL(mySQLDialect)+`
         ORDER BY id
     `)
     if err != nil {
@@ -310,8 +670,8 @@ func (s *MySQLIPSetStorage) GetAll() ([]*models.IPSetRecord, error) {
         var record models.IPSetRecord
         if err := rows.Scan(
             &record.ID, &record.SetName, &record.IP, &record.CIDR, &record.Port, &record.Protocol,
-            &record.Description, &record.Context, &record.SetType, &record.SetOptions,
-            &record.CreatedAt, &record.UpdatedAt,
+            &record.Description, &record.Context, &record.SetType, &record.SetOptions, &record.SecondIP,
+            &record.CreatedAt, &record.UpdatedAt, &record.ExpiresAt, &record.ActiveFrom, &record.Schedule,
         ); err != nil {
             return nil, fmt.Errorf("failed to scan record: %v", err)
         }
@@ -321,12 +681,15 @@ func (s *MySQLIPSetStorage) GetAll() ([]*models.IPSetRecord, error) {
     return records, nil
 }
 
-func (s *MySQLIPSetStorage) GetBySetName(setName string) ([]*models.IPSetRecord, error) {
-    rows, err := s.db.Query(`
+func (s *MySQLIPSetStorage) GetBySetName(ctx context.Context, setName string) ([]*models.IPSetRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    rows, err := s.db.QueryContext(ctx, `
         SELECT id, set_name, ip, cidr, port, protocol, description, context, 
-               set_type, set_options, created_at, updated_at
+               set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule
         FROM ipset_records
-        WHERE set_name = ?
+        WHERE set_name = ? AND `+activeRecordSQL(mySQLDialect)+`
         ORDER BY id
     `, setName)
     if err != nil {
@@ -339,8 +702,8 @@ func (s *MySQLIPSetStorage) GetBySetName(setName string) ([]*models.IPSetRecord,
         var record models.IPSetRecord
         if err := rows.Scan(
             &record.ID, &record.SetName, &record.IP, &record.CIDR, &record.Port, &record.Protocol,
-            &record.Description, &record.Context, &record.SetType, &record.SetOptions,
-            &record.CreatedAt, &record.UpdatedAt,
+            &record.Description, &record.Context, &record.SetType, &record.SetOptions, &record.SecondIP,
+            &record.CreatedAt, &record.UpdatedAt, &record.ExpiresAt, &record.ActiveFrom, &record.Schedule,
         ); err != nil {
             return nil, fmt.Errorf("failed to scan record: %v", err)
         }
@@ -354,56 +717,314 @@ func (s *MySQLIPSetStorage) GetBySetName(setName string) ([]*models.IPSetRecord,
     return records, nil
 }
 
-func (s *MySQLIPSetStorage) GetAllSets() ([]*models.IPSetSet, error) {
-    rows, err := s.db.Query(`
-        SELECT set_name, set_type, set_options, 
-               MIN(created_at) as created_at,
-               MAX(updated_at) as updated_at,
-               COUNT(*) as record_count
-        FROM ipset_records
-        GROUP BY set_name, set_type, set_options
-        ORDER BY set_name
-    `)
+func (s *MySQLIPSetStorage) GetAllSets(ctx context.Context) ([]*models.IPSetSet, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    rows, err := s.db.QueryContext(ctx, setSelectSQL(mySQLDialect)+" ORDER BY name")
     if err != nil {
         return nil, fmt.Errorf("failed to get all sets: %v", err)
     }
     defer rows.Close()
     
-    var sets []*models.IPSetSet
-    for rows.Next() {
-        set := &models.IPSetSet{
-            Records: []models.IPSetRecord{},
-        }
-        var recordCount int
-        err := rows.Scan(&set.Name, &set.Type, &set.Options, &set.CreatedAt, &set.UpdatedAt, &recordCount)
+    return scanSets(rows)
+}
+
+// ensureSet заводит сет записи, если его еще нет
+func (s *MySQLIPSetStorage) ensureSet(ctx context.Context, db sqlExecer, record *models.IPSetRecord) error {
+    return s.createSetIfMissing(ctx, db, recordSet(record, time.Now().UTC()))
+}
+
+// createSetIfMissing заводит сет, если сета с таким именем еще нет
+func (s *MySQLIPSetStorage) createSetIfMissing(ctx context.Context, db sqlExecer, set *models.IPSetSet) error {
+    _, err := db.ExecContext(ctx, "INSERT IGNORE INTO ipset_sets ("+setColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?)", setValues(set)...)
+    if err != nil {
+        return fmt.Errorf("failed to create set %s: %v", set.Name, err)
+    }
+    return nil
+}
+
+func (s *MySQLIPSetStorage) CreateSet(ctx context.Context, set *models.IPSetSet) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    now := time.Now().UTC()
+    set.CreatedAt = now
+    set.UpdatedAt = now
+    
+    if _, err := s.db.ExecContext(ctx, insertSetSQL(mySQLDialect), setValues(set)...); err != nil {
+        return fmt.Errorf("failed to create set: %v", err)
+    }
+    
+    return nil
+}
+
+func (s *MySQLIPSetStorage) ImportSet(ctx context.Context, set *models.IPSetSet) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    _, err := s.db.ExecContext(ctx, insertSetSQL(mySQLDialect)+`
+        ON DUPLICATE KEY UPDATE
+            type = VALUES(type), options = VALUES(options), family = VALUES(family),
+            description = VALUES(description), owner = VALUES(owner),
+            created_at = VALUES(created_at), updated_at = VALUES(updated_at)
+    `, setValues(set)...)
+    if err != nil {
+        return fmt.Errorf("failed to import set %s: %v", set.Name, err)
+    }
+    
+    return nil
+}
+
+func (s *MySQLIPSetStorage) GetSet(ctx context.Context, name string) (*models.IPSetSet, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    rows, err := s.db.QueryContext(ctx, setSelectSQL(mySQLDialect)+" WHERE name = ?", name)
+    if err != nil {
+        return nil, fmt.Errorf("failed to get set: %v", err)
+    }
+    defer rows.Close()
+    
+    sets, err := scanSets(rows)
+    if err != nil {
+        return nil, err
+    }
+    
+    if len(sets) == 0 {
+        return nil, fmt.Errorf("set %s not found", name)
+    }
+    
+    return sets[0], nil
+}
+
+func (s *MySQLIPSetStorage) UpdateSet(ctx context.Context, set *models.IPSetSet) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    set.UpdatedAt = time.Now().UTC()
+    result, err := s.db.ExecContext(ctx, updateSetSQL(mySQLDialect), setUpdateValues(set)...)
+    if err != nil {
+        return fmt.Errorf("failed to update set: %v", err)
+    }
+    
+    rowsAffected, err := result.RowsAffected()
+    if err != nil {
+        return fmt.Errorf("failed to get rows affected: %v", err)
+    }
+    
+    if rowsAffected == 0 {
+        return fmt.Errorf("set %s not found", set.Name)
+    }
+    
+    return nil
+}
+
+// insertNewRecord выдает записи новый ID и вставляет ее в транзакции tx
+func (s *MySQLIPSetStorage) insertNewRecord(ctx context.Context, tx *sql.Tx, record *models.IPSetRecord) error {
+    id, err := s.getNextID(ctx, tx)
+    if err != nil {
+        return err
+    }
+    record.ID = id
+    
+    rangeStart, rangeEnd := addrRangeValues(record.IP, record.CIDR)
+    _, err = tx.ExecContext(ctx, `
+        INSERT INTO ipset_records
+        (id, set_name, ip, cidr, port, protocol, description, context, set_type, set_options, second_ip,
+         range_start, range_end, created_at, updated_at, expires_at, active_from, schedule)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+    `,
+        record.ID, record.SetName, record.IP, record.CIDR, record.Port, record.Protocol,
+        record.Description, record.Context, record.SetType, record.SetOptions, record.SecondIP,
+        rangeStart, rangeEnd, record.CreatedAt, record.UpdatedAt, nullTimeValue(record.ExpiresAt), nullTimeValue(record.ActiveFrom), record.Schedule,
+    )
+    if err != nil {
+        return fmt.Errorf("failed to create record: %v", err)
+    }
+    return nil
+}
+
+func (s *MySQLIPSetStorage) RenameSet(ctx context.Context, from, to string) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback()
+    
+    if err := renameSetTx(ctx, tx, mySQLDialect, from, to); err != nil {
+        return err
+    }
+    
+    if err := tx.Commit(); err != nil {
+        return fmt.Errorf("failed to commit transaction: %v", err)
+    }
+    
+    return nil
+}
+
+func (s *MySQLIPSetStorage) CopySet(ctx context.Context, from, to string) ([]*models.IPSetRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return nil, fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback()
+    
+    records, err := copySetTx(ctx, tx, mySQLDialect, from, to, func(record *models.IPSetRecord) error {
+        return s.insertNewRecord(ctx, tx, record)
+    })
+    if err != nil {
+        return nil, err
+    }
+    
+    if err := tx.Commit(); err != nil {
+        return nil, fmt.Errorf("failed to commit transaction: %v", err)
+    }
+    
+    return records, nil
+}
+
+func (s *MySQLIPSetStorage) SwapSets(ctx context.Context, a, b string) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback()
+    
+    if err := swapSetsTx(ctx, tx, mySQLDialect, a, b); err != nil {
+        return err
+    }
+    
+    if err := tx.Commit(); err != nil {
+        return fmt.Errorf("failed to commit transaction: %v", err)
+    }
+    
+    return nil
+}
+
+func (s *MySQLIPSetStorage) ApplySetChanges(ctx context.Context, setName string, revision int64, set *models.IPSetSet, remove []int, update, add []*models.IPSetRecord) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback()
+    
+    if err := checkSetRevision(ctx, tx, mySQLDialect, setName, revision); err != nil {
+        return err
+    }
+    
+    if set != nil {
+        err := saveSetTx(ctx, tx, mySQLDialect, set, func(set *models.IPSetSet) error {
+            return s.createSetIfMissing(ctx, tx, set)
+        })
         if err != nil {
-            return nil, fmt.Errorf("failed to scan set: %v", err)
-        }
-        
-        // Получаем записи для этого сета
-        records, err := s.GetBySetName(set.Name)
-        if err == nil {
-            for _, r := range records {
-                set.Records = append(set.Records, *r)
-            }
+            return err
         }
-        
-        sets = append(sets, set)
     }
     
-    return sets, nil
+    err = applySetChangesTx(ctx, tx, mySQLDialect, setName, remove, update, add, func(record *models.IPSetRecord) error {
+        return s.updateRecord(ctx, tx, record.ID, record)
+    }, func(record *models.IPSetRecord) error {
+        return s.insertNewRecord(ctx, tx, record)
+    })
+    if err != nil {
+        return err
+    }
+    
+    if err := tx.Commit(); err != nil {
+        return fmt.Errorf("failed to commit transaction: %v", err)
+    }
+    
+    return nil
+}
+
+func (s *MySQLIPSetStorage) ApplyChanges(ctx context.Context, changes []*RecordChange) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback()
+    
+    err = applyChangesTx(ctx, tx, mySQLDialect, changes, func(record *models.IPSetRecord) error {
+        return s.ensureSet(ctx, tx, record)
+    }, func(record *models.IPSetRecord) error {
+        return s.updateRecord(ctx, tx, record.ID, record)
+    }, func(record *models.IPSetRecord) error {
+        return s.insertNewRecord(ctx, tx, record)
+    })
+    if err != nil {
+        return err
+    }
+    
+    if err := tx.Commit(); err != nil {
+        return fmt.Errorf("failed to commit transaction: %v", err)
+    }
+    
+    return nil
+}
+
+func (s *MySQLIPSetStorage) Update(ctx context.Context, id int, record *models.IPSetRecord) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback()
+    
+    record.ID = id
+    
+    // Запись могла перейти в новый сет
+    if err := s.ensureSet(ctx, tx, record); err != nil {
+        return err
+    }
+    if err := lockSet(ctx, tx, mySQLDialect, record.SetName); err != nil {
+        return err
+    }
+    
+    if err := s.updateRecord(ctx, tx, id, record); err != nil {
+        return err
+    }
+    if err := checkDuplicate(ctx, tx, mySQLDialect, record); err != nil {
+        return err
+    }
+    
+    if err := tx.Commit(); err != nil {
+        return fmt.Errorf("failed to commit transaction: %v", err)
+    }
+    
+    return nil
 }
 
-func (s *MySQLIPSetStorage) Update(id int, record *models.IPSetRecord) error {
-    result, err := s.db.Exec(`
+// updateRecord перезаписывает действующую запись в транзакции tx
+func (s *MySQLIPSetStorage) updateRecord(ctx context.Context, tx *sql.Tx, id int, record *models.IPSetRecord) error {
+    rangeStart, rangeEnd := addrRangeValues(record.IP, record.CIDR)
+    result, err := tx.ExecContext(ctx, `
         UPDATE ipset_records
         SET set_name = ?, ip = ?, cidr = ?, port = ?, protocol = ?, 
-            description = ?, context = ?, set_type = ?, set_options = ?,
-            updated_at = NOW()
-        WHERE id = ?
+            description = ?, context = ?, set_type = ?, set_options = ?, second_ip = ?,
+            range_start = ?, range_end = ?, expires_at = ?, active_from = ?, schedule = ?, updated_at = NOW()
+        WHERE id = ? AND `+activeRecordSQL(mySQLDialect)+`
     `,
         record.SetName, record.IP, record.CIDR, record.Port, record.Protocol,
-        record.Description, record.Context, record.SetType, record.SetOptions, id,
+        record.Description, record.Context, record.SetType, record.SetOptions, record.SecondIP,
+        rangeStart, rangeEnd, nullTimeValue(record.ExpiresAt), nullTimeValue(record.ActiveFrom), record.Schedule, id,
     )
     
     if err != nil {
@@ -422,8 +1043,14 @@ func (s *MySQLIPSetStorage) Update(id int, record *models.IPSetRecord) error {
     return nil
 }
 
-func (s *MySQLIPSetStorage) Delete(id int) error {
-    result, err := s.db.Exec("DELETE FROM ipset_records WHERE id = ?", id)
+func (s *MySQLIPSetStorage) Delete(ctx context.Context, id int) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    result, err := s.db.ExecContext(ctx,
+        "UPDATE ipset_records SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL",
+        time.Now().UTC(), id,
+    )
     if err != nil {
         return fmt.Errorf("failed to delete record: %v", err)
     }
@@ -440,35 +1067,63 @@ func (s *MySQLIPSetStorage) Delete(id int) error {
     return nil
 }
 
-func (s *MySQLIPSetStorage) DeleteSet(setName string) error {
-    result, err := s.db.Exec("DELETE FROM ipset_records WHERE set_name = ?", setName)
+func (s *MySQLIPSetStorage) DeleteSet(ctx context.Context, setName string) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback()
+    
+    result, err := tx.ExecContext(ctx,
+        "UPDATE ipset_records SET deleted_at = ? WHERE set_name = ? AND deleted_at IS NULL",
+        time.Now().UTC(), setName,
+    )
     if err != nil {
         return fmt.Errorf("failed to delete set: %v", err)
     }
+    deletedRecords, err := result.RowsAffected()
+    if err != nil {
+        return fmt.Errorf("failed to get rows affected: %v", err)
+    }
     
-    rowsAffected, err := result.RowsAffected()
+    result, err = tx.ExecContext(ctx, "DELETE FROM ipset_sets WHERE name = ?", setName)
+    if err != nil {
+        return fmt.Errorf("failed to delete set: %v", err)
+    }
+    deletedSets, err := result.RowsAffected()
     if err != nil {
         return fmt.Errorf("failed to get rows affected: %v", err)
     }
     
-    if rowsAffected == 0 {
+    if deletedRecords == 0 && deletedSets == 0 {
         return fmt.Errorf("set %s not found", setName)
     }
     
+    if err := tx.Commit(); err != nil {
+        return fmt.Errorf("failed to commit transaction: %v", err)
+    }
+    
     return nil
 }
 
-func (s *MySQLIPSetStorage) Search(query string) ([]*models.IPSetRecord, error) {
+func (s *MySQLIPSetStorage) Search(ctx context.Context, query string) ([]*models.IPSetRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
     searchPattern := "%" + query + "%"
-    rows, err := s.db.Query(`
+    rows, err := s.db.QueryContext(ctx, `
         SELECT id, set_name, ip, cidr, port, protocol, description, context, 
-               set_type, set_options, created_at, updated_at
+               set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule
         FROM ipset_records
-        WHERE 
+        WHERE `+activeRecordSQL(mySQLDialect)+` AND (
             context LIKE ? OR
             description LIKE ? OR
             ip LIKE ? OR
             set_name LIKE ?
+        )
         ORDER BY 
             CASE 
                 WHEN set_name = ? THEN 1
@@ -490,8 +1145,8 @@ func (s *MySQLIPSetStorage) Search(query string) ([]*models.IPSetRecord, error)
         var record models.IPSetRecord
         if err := rows.Scan(
             &record.ID, &record.SetName, &record.IP, &record.CIDR, &record.Port, &record.Protocol,
-            &record.Description, &record.Context, &record.SetType, &record.SetOptions,
-            &record.CreatedAt, &record.UpdatedAt,
+            &record.Description, &record.Context, &record.SetType, &record.SetOptions, &record.SecondIP,
+            &record.CreatedAt, &record.UpdatedAt, &record.ExpiresAt, &record.ActiveFrom, &record.Schedule,
         ); err != nil {
             return nil, fmt.Errorf("failed to scan record: %v", err)
         }
@@ -499,4 +1154,413 @@ func (s *MySQLIPSetStorage) Search(query string) ([]*models.IPSetRecord, error)
     }
     
     return records, nil
-}
\ No newline at end of file
+}
+
+// Lookup сравнивает границы префикса с range_start/range_end побайтно
+func (s *MySQLIPSetStorage) Lookup(ctx context.Context, prefix netip.Prefix) ([]*models.IPSetRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    start, end := lookupRangeArgs(prefix)
+    rows, err := s.db.QueryContext(ctx, `
+        SELECT id, set_name, ip, cidr, port, protocol, description, context, 
+               set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule
+        FROM ipset_records
+        WHERE `+activeRecordSQL(mySQLDialect)+` AND range_start <= ? AND range_end >= ?
+        ORDER BY set_name, id
+    `, end, start)
+    if err != nil {
+        return nil, fmt.Errorf("failed to lookup records: %v", err)
+    }
+    defer rows.Close()
+    
+    var records []*models.IPSetRecord
+    for rows.Next() {
+        var record models.IPSetRecord
+        if err := rows.Scan(
+            &record.ID, &record.SetName, &record.IP, &record.CIDR, &record.Port, &record.Protocol,
+            &record.Description, &record.Context, &record.SetType, &record.SetOptions, &record.SecondIP,
+            &record.CreatedAt, &record.UpdatedAt, &record.ExpiresAt, &record.ActiveFrom, &record.Schedule,
+        ); err != nil {
+            return nil, fmt.Errorf("failed to scan record: %v", err)
+        }
+        records = append(records, &record)
+    }
+    
+    return records, nil
+}
+
+func (s *MySQLIPSetStorage) List(ctx context.Context, q *models.RecordQuery) (*models.RecordPage, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    tail, args, err := buildRecordListSQL(q, mySQLDialect, activeRecordSQL(mySQLDialect))
+    if err != nil {
+        return nil, err
+    }
+    
+    rows, err := s.db.QueryContext(ctx, `
+        SELECT id, set_name, ip, cidr, port, protocol, description, context, 
+               set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule
+        FROM ipset_records
+    `+tail, args...)
+    if err != nil {
+        return nil, fmt.Errorf("failed to list records: %v", err)
+    }
+    defer rows.Close()
+    
+    var records []*models.IPSetRecord
+    for rows.Next() {
+        var record models.IPSetRecord
+        if err := rows.Scan(
+            &record.ID, &record.SetName, &record.IP, &record.CIDR, &record.Port, &record.Protocol,
+            &record.Description, &record.Context, &record.SetType, &record.SetOptions, &record.SecondIP,
+            &record.CreatedAt, &record.UpdatedAt, &record.ExpiresAt, &record.ActiveFrom, &record.Schedule,
+        ); err != nil {
+            return nil, fmt.Errorf("failed to scan record: %v", err)
+        }
+        records = append(records, &record)
+    }
+    
+    return recordPage(records, q), nil
+}
+
+func (s *MySQLIPSetStorage) ListSets(ctx context.Context, q *models.SetQuery) (*models.SetPage, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    where, tail, args, err := buildSetListSQL(q, mySQLDialect)
+    if err != nil {
+        return nil, err
+    }
+    
+    rows, err := s.db.QueryContext(ctx, setSelectSQL(mySQLDialect)+" "+where+" "+tail, args...)
+    if err != nil {
+        return nil, fmt.Errorf("failed to list sets: %v", err)
+    }
+    defer rows.Close()
+    
+    sets, err := scanSets(rows)
+    if err != nil {
+        return nil, err
+    }
+    
+    return setPage(sets, q), nil
+}
+
+func (s *MySQLIPSetStorage) History(ctx context.Context, id int) ([]*models.RecordRevision, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    rows, err := s.db.QueryContext(ctx, recordHistorySQL(mySQLDialect), id)
+    if err != nil {
+        return nil, fmt.Errorf("failed to get record history: %v", err)
+    }
+    defer rows.Close()
+    
+    return scanRevisions(rows)
+}
+
+func (s *MySQLIPSetStorage) GetBySetNameAt(ctx context.Context, setName string, at time.Time) ([]*models.IPSetRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    rows, err := s.db.QueryContext(ctx, setAtSQL(mySQLDialect), setName, at.UTC())
+    if err != nil {
+        return nil, fmt.Errorf("failed to get set history: %v", err)
+    }
+    defer rows.Close()
+    
+    return scanHistoryRecords(rows)
+}
+
+func (s *MySQLIPSetStorage) Revision(ctx context.Context) (int64, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    var revision int64
+    if err := s.db.QueryRowContext(ctx, revisionSQL).Scan(&revision); err != nil {
+        return 0, fmt.Errorf("failed to get revision: %v", err)
+    }
+    return revision, nil
+}
+
+func (s *MySQLIPSetStorage) Changes(ctx context.Context, since int64, limit int) ([]*models.ChangeEvent, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    rows, err := s.db.QueryContext(ctx, changesSQL(mySQLDialect), since, limit)
+    if err != nil {
+        return nil, fmt.Errorf("failed to get changes: %v", err)
+    }
+    defer rows.Close()
+    
+    return scanChanges(rows)
+}
+
+func (s *MySQLIPSetStorage) ListTrash(ctx context.Context, q *models.RecordQuery) (*models.RecordPage, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    tail, args, err := buildRecordListSQL(q, mySQLDialect, "deleted_at IS NOT NULL")
+    if err != nil {
+        return nil, err
+    }
+    
+    rows, err := s.db.QueryContext(ctx, "SELECT "+trashColumns+" FROM ipset_records "+tail, args...)
+    if err != nil {
+        return nil, fmt.Errorf("failed to list trash: %v", err)
+    }
+    defer rows.Close()
+    
+    records, err := scanTrash(rows)
+    if err != nil {
+        return nil, err
+    }
+    
+    return recordPage(records, q), nil
+}
+
+func (s *MySQLIPSetStorage) Undelete(ctx context.Context, id int) (*models.IPSetRecord, error) {
+    records, err := s.undelete(ctx, "id", id)
+    if err != nil {
+        return nil, err
+    }
+    
+    if len(records) == 0 {
+        return nil, fmt.Errorf("record with id %d not found in trash", id)
+    }
+    
+    return records[0], nil
+}
+
+func (s *MySQLIPSetStorage) UndeleteSet(ctx context.Context, setName string) ([]*models.IPSetRecord, error) {
+    records, err := s.undelete(ctx, "set_name", setName)
+    if err != nil {
+        return nil, err
+    }
+    
+    if len(records) == 0 {
+        return nil, fmt.Errorf("set %s not found in trash", setName)
+    }
+    
+    return records, nil
+}
+
+// undelete возвращает из корзины записи с заданным значением колонки и
+// отдает их в том виде, в каком они стали после восстановления
+func (s *MySQLIPSetStorage) undelete(ctx context.Context, column string, value interface{}) ([]*models.IPSetRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return nil, fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback()
+    
+    rows, err := tx.QueryContext(ctx,
+        "SELECT "+trashColumns+" FROM ipset_records WHERE deleted_at IS NOT NULL AND "+column+" = ? ORDER BY id FOR UPDATE", value)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read trash: %v", err)
+    }
+    records, err := scanTrash(rows)
+    rows.Close()
+    if err != nil {
+        return nil, err
+    }
+    
+    now := time.Now().UTC()
+    _, err = tx.ExecContext(ctx,
+        "UPDATE ipset_records SET deleted_at = NULL, updated_at = ? WHERE deleted_at IS NOT NULL AND "+column+" = ?", now, value)
+    if err != nil {
+        return nil, fmt.Errorf("failed to restore records: %v", err)
+    }
+    for _, record := range records {
+        if err := s.ensureSet(ctx, tx, record); err != nil {
+            return nil, err
+        }
+        // Пока запись была в корзине, в сет могли добавить тот же элемент
+        if err := lockSet(ctx, tx, mySQLDialect, record.SetName); err != nil {
+            return nil, err
+        }
+        if err := checkDuplicate(ctx, tx, mySQLDialect, record); err != nil {
+            return nil, err
+        }
+    }
+    
+    if err := tx.Commit(); err != nil {
+        return nil, fmt.Errorf("failed to commit transaction: %v", err)
+    }
+    
+    return restoredRecords(records, now), nil
+}
+
+func (s *MySQLIPSetStorage) PurgeTrash(ctx context.Context, before time.Time) (int, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    result, err := s.db.ExecContext(ctx,
+        "DELETE FROM ipset_records WHERE deleted_at IS NOT NULL AND deleted_at < ?", before.UTC())
+    if err != nil {
+        return 0, fmt.Errorf("failed to purge trash: %v", err)
+    }
+    
+    purged, err := result.RowsAffected()
+    if err != nil {
+        return 0, fmt.Errorf("failed to get rows affected: %v", err)
+    }
+    
+    return int(purged), nil
+}
+
+func (s *MySQLIPSetStorage) CountExpired(ctx context.Context, at time.Time) (int, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    var count int
+    err := s.db.QueryRowContext(ctx,
+        "SELECT COUNT(*) FROM ipset_records WHERE deleted_at IS NULL AND expires_at <= ?", at.UTC()).Scan(&count)
+    if err != nil {
+        return 0, fmt.Errorf("failed to count expired records: %v", err)
+    }
+    
+    return count, nil
+}
+
+func (s *MySQLIPSetStorage) DeleteExpired(ctx context.Context, at time.Time) ([]*models.IPSetRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return nil, fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback()
+    
+    // Истекшие записи удаляются мимо корзины, триггер истории записывает удаление
+    rows, err := tx.QueryContext(ctx,
+        "SELECT "+trashColumns+" FROM ipset_records WHERE deleted_at IS NULL AND expires_at <= ? ORDER BY id FOR UPDATE", at.UTC())
+    if err != nil {
+        return nil, fmt.Errorf("failed to read expired records: %v", err)
+    }
+    records, err := scanTrash(rows)
+    rows.Close()
+    if err != nil {
+        return nil, err
+    }
+    
+    if len(records) == 0 {
+        return nil, nil
+    }
+    
+    _, err = tx.ExecContext(ctx,
+        "DELETE FROM ipset_records WHERE deleted_at IS NULL AND expires_at <= ?", at.UTC())
+    if err != nil {
+        return nil, fmt.Errorf("failed to delete expired records: %v", err)
+    }
+    
+    if err := tx.Commit(); err != nil {
+        return nil, fmt.Errorf("failed to commit transaction: %v", err)
+    }
+    
+    return records, nil
+}
+
+// MySQLAuditStorage - журнал аудита в таблице audit_log
+type MySQLAuditStorage struct {
+    db           *sql.DB
+    queryTimeout time.Duration
+}
+
+func NewMySQLAuditStorage(cfg *config.Config) (*MySQLAuditStorage, error) {
+    db, err := openMySQL(cfg)
+    if err != nil {
+        return nil, err
+    }
+    
+    if err := ensureSchema(newMySQLMigrator(db), cfg.AutoMigrate); err != nil {
+        return nil, err
+    }
+    
+    return &MySQLAuditStorage{db: db, queryTimeout: cfg.DBQueryTimeout}, nil
+}
+
+func (s *MySQLAuditStorage) Append(ctx context.Context, event *models.AuditEvent) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    result, err := s.db.ExecContext(ctx, `
+        INSERT INTO audit_log
+        (created_at, actor, request_id, action, set_name, record_id, before_json, after_json)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+    `,
+        event.Timestamp.UTC(), event.Actor, event.RequestID, event.Action, event.SetName, event.RecordID,
+        auditJSON(event.Before), auditJSON(event.After),
+    )
+    if err != nil {
+        return fmt.Errorf("failed to append audit event: %v", err)
+    }
+    
+    event.ID, err = result.LastInsertId()
+    if err != nil {
+        return fmt.Errorf("failed to get audit event id: %v", err)
+    }
+    return nil
+}
+
+func (s *MySQLAuditStorage) List(ctx context.Context, q *models.AuditQuery) (*models.AuditPage, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    tail, args, err := buildAuditListSQL(q, mySQLDialect)
+    if err != nil {
+        return nil, err
+    }
+    
+    rows, err := s.db.QueryContext(ctx, `
+        SELECT id, created_at, actor, request_id, action, set_name, record_id, before_json, after_json
+        FROM audit_log
+    `+tail, args...)
+    if err != nil {
+        return nil, fmt.Errorf("failed to list audit events: %v", err)
+    }
+    defer rows.Close()
+    
+    events, err := scanAuditEvents(rows)
+    if err != nil {
+        return nil, err
+    }
+    
+    return auditPage(events, q), nil
+}
+
+// NewMySQLWebhookStorage - подписки и доставки в таблицах webhooks и
+// webhook_deliveries
+func NewMySQLWebhookStorage(cfg *config.Config) (*SQLWebhookStorage, error) {
+    db, err := openMySQL(cfg)
+    if err != nil {
+        return nil, err
+    }
+    
+    if err := ensureSchema(newMySQLMigrator(db), cfg.AutoMigrate); err != nil {
+        return nil, err
+    }
+    
+    return &SQLWebhookStorage{db: db, dialect: mySQLDialect, queryTimeout: cfg.DBQueryTimeout, returning: false}, nil
+}
+
+// NewMySQLAgentStorage - агенты и правила назначения в таблицах agents и
+// agent_assignments
+func NewMySQLAgentStorage(cfg *config.Config) (*SQLAgentStorage, error) {
+    db, err := openMySQL(cfg)
+    if err != nil {
+        return nil, err
+    }
+    
+    if err := ensureSchema(newMySQLMigrator(db), cfg.AutoMigrate); err != nil {
+        return nil, err
+    }
+    
+    return &SQLAgentStorage{db: db, dialect: mySQLDialect, queryTimeout: cfg.DBQueryTimeout, returning: false}, nil
+}
@@ -1,8 +1,10 @@
 package storage
 
 import (
+    "context"
     "database/sql"
     "fmt"
+    "net/netip"
     "time"
     "ipset-api-server/internal/config"
     "ipset-api-server/internal/models"
@@ -10,12 +12,367 @@ import (
     _ "github.com/lib/pq"
 )
 
-// PostgreSQLKeyStorage - реализация для хранения ключей в PostgreSQL
-type PostgreSQLKeyStorage struct {
-    db *sql.DB
+// postgreSQLMigrations - миграции схемы PostgreSQL, каждая выполняется в транзакции
+var postgreSQLMigrations = []Migration{
+    {
+        Version:     1,
+        Description: "create auth_keys and ipset_records",
+        Statements: []string{
+            `CREATE TABLE IF NOT EXISTS auth_keys (
+                key VARCHAR(255) PRIMARY KEY,
+                created_at TIMESTAMP WITH TIME ZONE,
+                expires_at TIMESTAMP WITH TIME ZONE,
+                is_active BOOLEAN DEFAULT true
+            )`,
+            `CREATE TABLE IF NOT EXISTS ipset_records (
+                id INTEGER PRIMARY KEY CHECK (id >= 100000 AND id <= 999999),
+                set_name VARCHAR(255) NOT NULL,
+                ip VARCHAR(45) NOT NULL,
+                cidr VARCHAR(45),
+                port INTEGER,
+                protocol VARCHAR(10),
+                description TEXT,
+                context TEXT NOT NULL,
+                set_type VARCHAR(50),
+                set_options TEXT,
+                created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+                updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+            )`,
+            // Индексы для поиска
+            `CREATE INDEX IF NOT EXISTS idx_ipset_records_set_name ON ipset_records(set_name);
+            CREATE INDEX IF NOT EXISTS idx_ipset_records_ip ON ipset_records(ip);
+            CREATE INDEX IF NOT EXISTS idx_ipset_records_context ON ipset_records USING gin(to_tsvector('english', context));
+            CREATE INDEX IF NOT EXISTS idx_ipset_records_description ON ipset_records USING gin(to_tsvector('english', description));`,
+            // Функция и триггер для автоматического обновления updated_at
+            `CREATE OR REPLACE FUNCTION update_updated_at_column()
+            RETURNS TRIGGER AS $$
+            BEGIN
+                NEW.updated_at = CURRENT_TIMESTAMP;
+                RETURN NEW;
+            END;
+            $$ language 'plpgsql';`,
+            `DROP TRIGGER IF EXISTS update_ipset_records_updated_at ON ipset_records;
+            CREATE TRIGGER update_ipset_records_updated_at
+                BEFORE UPDATE ON ipset_records
+                FOR EACH ROW
+                EXECUTE FUNCTION update_updated_at_column();`,
+        },
+    },
+    {
+        Version:     2,
+        Description: "add second_ip to ipset_records",
+        Statements: []string{
+            // Третий компонент записей hash:ip,port,ip и hash:ip,port,net
+            `ALTER TABLE ipset_records ADD COLUMN IF NOT EXISTS second_ip VARCHAR(64) NOT NULL DEFAULT ''`,
+        },
+    },
+    {
+        Version:     3,
+        Description: "add net column with GiST index to ipset_records",
+        Statements: []string{
+            // Сеть записи для Lookup. Для MAC, имени сета и пустого ip
+            // (bitmap:port) функция возвращает NULL вместо ошибки приведения.
+            // CIDR "0" в старых записях означает одиночный адрес.
+            `CREATE OR REPLACE FUNCTION ipset_record_net(ip text, cidr text)
+            RETURNS cidr AS $$
+            DECLARE
+                addr inet;
+            BEGIN
+                addr := ip::inet;
+                IF cidr IS NULL OR cidr = '' OR cidr = '0' THEN
+                    RETURN network(set_masklen(addr, CASE WHEN family(addr) = 6 THEN 128 ELSE 32 END));
+                END IF;
+                RETURN network(set_masklen(addr, cidr::int));
+            EXCEPTION WHEN others THEN
+                RETURN NULL;
+            END;
+            $$ LANGUAGE plpgsql IMMUTABLE;`,
+            `ALTER TABLE ipset_records ADD COLUMN IF NOT EXISTS net cidr
+                GENERATED ALWAYS AS (ipset_record_net(ip, cidr)) STORED`,
+            `CREATE INDEX IF NOT EXISTS idx_ipset_records_net ON ipset_records USING gist (net inet_ops)`,
+        },
+    },
+    {
+        Version:     4,
+        Description: "create audit_log",
+        Statements: []string{
+            `CREATE TABLE IF NOT EXISTS audit_log (
+                id BIGSERIAL PRIMARY KEY,
+                created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+                actor VARCHAR(64) NOT NULL,
+                request_id VARCHAR(64) NOT NULL DEFAULT '',
+                action VARCHAR(32) NOT NULL,
+                set_name VARCHAR(255) NOT NULL,
+                record_id INTEGER NOT NULL,
+                before_json TEXT,
+                after_json TEXT
+            )`,
+            `CREATE INDEX IF NOT EXISTS idx_audit_log_created_at ON audit_log(created_at);
+            CREATE INDEX IF NOT EXISTS idx_audit_log_record_id ON audit_log(record_id);
+            CREATE INDEX IF NOT EXISTS idx_audit_log_set_name ON audit_log(set_name);
+            CREATE INDEX IF NOT EXISTS idx_audit_log_actor ON audit_log(actor);`,
+        },
+    },
+    {
+        Version:     5,
+        Description: "create ipset_record_history",
+        Statements: []string{
+            `CREATE TABLE IF NOT EXISTS ipset_record_history (
+                record_id INTEGER NOT NULL,
+                revision INTEGER NOT NULL,
+                operation VARCHAR(16) NOT NULL,
+                changed_at TIMESTAMP WITH TIME ZONE NOT NULL,
+                set_name VARCHAR(255) NOT NULL,
+                ip VARCHAR(45) NOT NULL,
+                cidr VARCHAR(45),
+                port INTEGER,
+                protocol VARCHAR(10),
+                description TEXT,
+                context TEXT NOT NULL,
+                set_type VARCHAR(50),
+                set_options TEXT,
+                second_ip VARCHAR(64),
+                created_at TIMESTAMP WITH TIME ZONE,
+                updated_at TIMESTAMP WITH TIME ZONE,
+                PRIMARY KEY (record_id, revision)
+            )`,
+            `CREATE INDEX IF NOT EXISTS idx_ipset_record_history_set_name ON ipset_record_history(set_name)`,
+            historyBackfillSQL,
+            // Время создания и изменения - updated_at после триггера
+            // update_ipset_records_updated_at, время удаления - текущее
+            `CREATE OR REPLACE FUNCTION ipset_record_history_write()
+            RETURNS TRIGGER AS $$
+            DECLARE
+                r RECORD;
+                op VARCHAR(16);
+                changed TIMESTAMP WITH TIME ZONE;
+            BEGIN
+                IF TG_OP = 'DELETE' THEN
+                    r := OLD;
+                    op := 'delete';
+                    changed := now();
+                ELSE
+                    r := NEW;
+                    op := CASE WHEN TG_OP = 'INSERT' THEN 'create' ELSE 'update' END;
+                    changed := COALESCE(NEW.updated_at, now());
+                END IF;
+                ` + historyInsertSQL("r", "op", "changed") + `;
+                RETURN NULL;
+            END;
+            $$ LANGUAGE plpgsql;`,
+            `DROP TRIGGER IF EXISTS ipset_records_history ON ipset_records;
+            CREATE TRIGGER ipset_records_history
+                AFTER INSERT OR UPDATE OR DELETE ON ipset_records
+                FOR EACH ROW
+                EXECUTE FUNCTION ipset_record_history_write();`,
+        },
+    },
+    {
+        Version:     6,
+        Description: "add deleted_at to ipset_records",
+        Statements: []string{
+            // Время переноса в корзину, NULL у действующих записей
+            `ALTER TABLE ipset_records ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP WITH TIME ZONE`,
+            `CREATE INDEX IF NOT EXISTS idx_ipset_records_deleted_at ON ipset_records(deleted_at)`,
+            // Перенос в корзину записывается как удаление, окончательное
+            // удаление из корзины в историю не попадает
+            `CREATE OR REPLACE FUNCTION ipset_record_history_write()
+            RETURNS TRIGGER AS $$
+            DECLARE
+                r RECORD;
+                op VARCHAR(16);
+                changed TIMESTAMP WITH TIME ZONE;
+            BEGIN
+                IF TG_OP = 'DELETE' THEN
+                    IF OLD.deleted_at IS NOT NULL THEN
+                        RETURN NULL;
+                    END IF;
+                    r := OLD;
+                    op := 'delete';
+                    changed := now();
+                ELSIF TG_OP = 'UPDATE' AND NEW.deleted_at IS NOT NULL THEN
+                    r := NEW;
+                    op := 'delete';
+                    changed := NEW.deleted_at;
+                ELSE
+                    r := NEW;
+                    op := CASE WHEN TG_OP = 'INSERT' THEN 'create' ELSE 'update' END;
+                    changed := COALESCE(NEW.updated_at, now());
+                END IF;
+                ` + historyInsertSQL("r", "op", "changed") + `;
+                RETURN NULL;
+            END;
+            $$ LANGUAGE plpgsql;`,
+        },
+    },
+    {
+        Version:     7,
+        Description: "add expires_at to ipset_records",
+        Statements: []string{
+            // Время истечения записи, NULL у бессрочных записей
+            `ALTER TABLE ipset_records ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP WITH TIME ZONE`,
+            `CREATE INDEX IF NOT EXISTS idx_ipset_records_expires_at ON ipset_records(expires_at)`,
+        },
+    },
+    {
+        Version:     8,
+        Description: "add activation window to ipset_records",
+        Statements: []string{
+            // Начало действия записи и расписание, в которое она действует
+            `ALTER TABLE ipset_records ADD COLUMN IF NOT EXISTS active_from TIMESTAMP WITH TIME ZONE`,
+            `ALTER TABLE ipset_records ADD COLUMN IF NOT EXISTS schedule VARCHAR(255) NOT NULL DEFAULT ''`,
+        },
+    },
+    {
+        Version:     9,
+        Description: "create ipset_sets",
+        Statements: []string{
+            `CREATE TABLE IF NOT EXISTS ipset_sets (
+                name VARCHAR(255) PRIMARY KEY,
+                type VARCHAR(50) NOT NULL,
+                options VARCHAR(1024) NOT NULL DEFAULT '',
+                family VARCHAR(10) NOT NULL DEFAULT 'inet',
+                description VARCHAR(1024) NOT NULL DEFAULT '',
+                owner VARCHAR(255) NOT NULL DEFAULT '',
+                created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+                updated_at TIMESTAMP WITH TIME ZONE NOT NULL
+            )`,
+            // Сеты записей, созданных до появления ipset_sets
+            setsBackfillSQL,
+        },
+    },
+    {
+        Version:     10,
+        Description: "create ipset_changes",
+        Statements: append(append([]string{
+            `CREATE TABLE IF NOT EXISTS ipset_changes (
+                revision BIGINT PRIMARY KEY,
+                changed_at TIMESTAMP WITH TIME ZONE NOT NULL,
+                kind VARCHAR(8) NOT NULL,
+                operation VARCHAR(16) NOT NULL,
+                set_name VARCHAR(255) NOT NULL,
+                record_id INTEGER NOT NULL DEFAULT 0,
+                ip VARCHAR(45),
+                cidr VARCHAR(45),
+                port INTEGER,
+                protocol VARCHAR(10),
+                second_ip VARCHAR(64),
+                description TEXT,
+                context TEXT,
+                set_type VARCHAR(50),
+                set_options TEXT,
+                family VARCHAR(10),
+                owner VARCHAR(255),
+                created_at TIMESTAMP WITH TIME ZONE,
+                updated_at TIMESTAMP WITH TIME ZONE,
+                expires_at TIMESTAMP WITH TIME ZONE,
+                active_from TIMESTAMP WITH TIME ZONE,
+                schedule VARCHAR(255)
+            )`,
+            `CREATE TABLE IF NOT EXISTS ipset_revision (
+                revision BIGINT NOT NULL
+            )`,
+        }, changesBackfillSQL...),
+            postgreSQLChangeTrigger("ipset_records", "ipset_record_changes_write", recordChangesSQL),
+            postgreSQLChangeTrigger("ipset_sets", "ipset_set_changes_write", setChangesSQL),
+        ),
+    },
+    {
+        Version:     11,
+        Description: "create webhooks",
+        Statements: []string{
+            `CREATE TABLE IF NOT EXISTS webhooks (
+                id BIGSERIAL PRIMARY KEY,
+                url TEXT NOT NULL,
+                secret VARCHAR(255) NOT NULL,
+                events VARCHAR(255) NOT NULL,
+                set_names TEXT NOT NULL,
+                description TEXT,
+                active BOOLEAN NOT NULL,
+                created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+                updated_at TIMESTAMP WITH TIME ZONE NOT NULL
+            )`,
+            `CREATE TABLE IF NOT EXISTS webhook_deliveries (
+                id BIGSERIAL PRIMARY KEY,
+                webhook_id BIGINT NOT NULL,
+                revision BIGINT NOT NULL,
+                event VARCHAR(32) NOT NULL,
+                payload TEXT NOT NULL,
+                status VARCHAR(16) NOT NULL,
+                attempts INTEGER NOT NULL,
+                next_attempt_at TIMESTAMP WITH TIME ZONE NOT NULL,
+                last_status INTEGER NOT NULL,
+                last_error VARCHAR(1024) NOT NULL,
+                created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+                updated_at TIMESTAMP WITH TIME ZONE NOT NULL
+            )`,
+            `CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries(status, next_attempt_at);
+            CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook_id ON webhook_deliveries(webhook_id);`,
+            // Номер последнего изменения, по которому созданы доставки
+            `CREATE TABLE IF NOT EXISTS webhook_cursor (
+                revision BIGINT NOT NULL
+            )`,
+        },
+    },
+    {
+        Version:     12,
+        Description: "create agents",
+        Statements: []string{
+            `CREATE TABLE IF NOT EXISTS agents (
+                hostname VARCHAR(255) PRIMARY KEY,
+                labels TEXT NOT NULL,
+                sets TEXT NOT NULL,
+                last_error TEXT,
+                registered_at TIMESTAMP WITH TIME ZONE NOT NULL,
+                last_seen_at TIMESTAMP WITH TIME ZONE NOT NULL
+            )`,
+            `CREATE TABLE IF NOT EXISTS agent_assignments (
+                id BIGSERIAL PRIMARY KEY,
+                selector TEXT NOT NULL,
+                sets TEXT NOT NULL,
+                description TEXT,
+                created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+                updated_at TIMESTAMP WITH TIME ZONE NOT NULL
+            )`,
+        },
+    },
 }
 
-func NewPostgreSQLKeyStorage(cfg *config.Config) (*PostgreSQLKeyStorage, error) {
+// postgreSQLChangeTrigger - функция и триггер, которые пишут ipset_changes
+// при изменении таблицы table
+func postgreSQLChangeTrigger(table, function string, write func(event, now string) string) string {
+    return fmt.Sprintf(`CREATE OR REPLACE FUNCTION %[2]s()
+            RETURNS TRIGGER AS $$
+            BEGIN
+                IF TG_OP = 'INSERT' THEN
+                    %[3]s;
+                ELSIF TG_OP = 'UPDATE' THEN
+                    %[4]s;
+                ELSE
+                    %[5]s;
+                END IF;
+                RETURN NULL;
+            END;
+            $$ LANGUAGE plpgsql;
+            DROP TRIGGER IF EXISTS %[1]s_changes ON %[1]s;
+            CREATE TRIGGER %[1]s_changes
+                AFTER INSERT OR UPDATE OR DELETE ON %[1]s
+                FOR EACH ROW
+                EXECUTE FUNCTION %[2]s();`,
+        table, function,
+        write("INSERT", postgreSQLDialect.now), write("UPDATE", postgreSQLDialect.now), write("DELETE", postgreSQLDialect.now))
+}
+
+func newPostgreSQLMigrator(db *sql.DB) *sqlMigrator {
+    return &sqlMigrator{
+        db:         db,
+        name:       "postgresql",
+        list:       postgreSQLMigrations,
+        insertStmt: "INSERT INTO schema_version (version, description, applied_at) VALUES ($1, $2, $3)",
+    }
+}
+
+func openPostgreSQL(cfg *config.Config) (*sql.DB, error) {
     dsn := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
         cfg.PostgreSQLHost,
         cfg.PostgreSQLPort,
@@ -33,26 +390,35 @@ func NewPostgreSQLKeyStorage(cfg *config.Config) (*PostgreSQLKeyStorage, error)
         return nil, fmt.Errorf("failed to ping postgresql: %v", err)
     }
     
-    // Создаем таблицу если не существует
-    _, err = db.Exec(`
-        CREATE TABLE IF NOT EXISTS auth_keys (
-            key VARCHAR(255) PRIMARY KEY,
-            created_at TIMESTAMP WITH TIME ZONE,
-            expires_at TIMESTAMP WITH TIME ZONE,
-            is_active BOOLEAN DEFAULT true
-        )
-    `)
+    return db, nil
+}
+
+// PostgreSQLKeyStorage - реализация для хранения ключей в PostgreSQL
+type PostgreSQLKeyStorage struct {
+    db           *sql.DB
+    queryTimeout time.Duration
+}
+
+func NewPostgreSQLKeyStorage(cfg *config.Config) (*PostgreSQLKeyStorage, error) {
+    db, err := openPostgreSQL(cfg)
     if err != nil {
-        return nil, fmt.Errorf("failed to create auth_keys table: %v", err)
+        return nil, err
+    }
+    
+    if err := ensureSchema(newPostgreSQLMigrator(db), cfg.AutoMigrate); err != nil {
+        return nil, err
     }
     
-    return &PostgreSQLKeyStorage{db: db}, nil
+    return &PostgreSQLKeyStorage{db: db, queryTimeout: cfg.DBQueryTimeout}, nil
 }
 
 
-func (s *PostgreSQLKeyStorage) GetKey(key string) (*models.AuthKey, error) {
+func (s *PostgreSQLKeyStorage) GetKey(ctx context.Context, key string) (*models.AuthKey, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
     var authKey models.AuthKey
-    err := s.db.QueryRow(
+    err := s.db.QueryRowContext(ctx,
         "SELECT key, created_at, expires_at, is_active FROM auth_keys WHERE key = $1",
         key,
     ).Scan(&authKey.Key, &authKey.CreatedAt, &authKey.ExpiresAt, &authKey.IsActive)
@@ -67,8 +433,11 @@ func (s *PostgreSQLKeyStorage) GetKey(key string) (*models.AuthKey, error) {
     return &authKey, nil
 }
 
-func (s *PostgreSQLKeyStorage) SaveKey(key *models.AuthKey) error {
-    _, err := s.db.Exec(
+func (s *PostgreSQLKeyStorage) SaveKey(ctx context.Context, key *models.AuthKey) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    _, err := s.db.ExecContext(ctx,
         `INSERT INTO auth_keys (key, created_at, expires_at, is_active) 
          VALUES ($1, $2, $3, $4)
          ON CONFLICT (key) DO UPDATE 
@@ -81,16 +450,22 @@ func (s *PostgreSQLKeyStorage) SaveKey(key *models.AuthKey) error {
     return nil
 }
 
-func (s *PostgreSQLKeyStorage) DeleteKey(key string) error {
-    _, err := s.db.Exec("DELETE FROM auth_keys WHERE key = $1", key)
+func (s *PostgreSQLKeyStorage) DeleteKey(ctx context.Context, key string) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    _, err := s.db.ExecContext(ctx, "DELETE FROM auth_keys WHERE key = $1", key)
     if err != nil {
         return fmt.Errorf("failed to delete key: %v", err)
     }
     return nil
 }
 
-func (s *PostgreSQLKeyStorage) ListKeys() ([]*models.AuthKey, error) {
-    rows, err := s.db.Query("SELECT key, created_at, expires_at, is_active FROM auth_keys ORDER BY created_at DESC")
+func (s *PostgreSQLKeyStorage) ListKeys(ctx context.Context) ([]*models.AuthKey, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    rows, err := s.db.QueryContext(ctx, "SELECT key, created_at, expires_at, is_active FROM auth_keys ORDER BY created_at DESC")
     if err != nil {
         return nil, fmt.Errorf("failed to list keys: %v", err)
     }
@@ -110,84 +485,19 @@ func (s *PostgreSQLKeyStorage) ListKeys() ([]*models.AuthKey, error) {
 
 // PostgreSQLIPSetStorage
 type PostgreSQLIPSetStorage struct {
-    db     *sql.DB
-    nextID int
+    db           *sql.DB
+    nextID       int
+    queryTimeout time.Duration
 }
 
 func NewPostgreSQLIPSetStorage(cfg *config.Config) (*PostgreSQLIPSetStorage, error) {
-    dsn := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-        cfg.PostgreSQLHost,
-        cfg.PostgreSQLPort,
-        cfg.PostgreSQLUsername,
-        cfg.PostgreSQLPassword,
-        cfg.PostgreSQLDatabase,
-    )
-    
-    db, err := sql.Open("postgres", dsn)
-    if err != nil {
-        return nil, fmt.Errorf("failed to connect to postgresql: %v", err)
-    }
-    
-    if err := db.Ping(); err != nil {
-        return nil, fmt.Errorf("failed to ping postgresql: %v", err)
-    }
-    
-    // Создаем таблицу если не существует
-    _, err = db.Exec(`
-        CREATE TABLE IF NOT EXISTS ipset_records (
-            id INTEGER PRIMARY KEY CHECK (id >= 100000 AND id <= 999999),
-            set_name VARCHAR(255) NOT NULL,
-            ip VARCHAR(45) NOT NULL,
-            cidr VARCHAR(45),
-            port INTEGER,
-            protocol VARCHAR(10),
-            description TEXT,
-            context TEXT NOT NULL,
-            set_type VARCHAR(50),
-            set_options TEXT,
-            created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
-            updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
-        )
-    `)
-    if err != nil {
-        return nil, fmt.Errorf("failed to create ipset_records table: %v", err)
-    }
-    
-    // Создаем индексы для поиска
-    _, err = db.Exec(`
-        CREATE INDEX IF NOT EXISTS idx_ipset_records_set_name ON ipset_records(set_name);
-        CREATE INDEX IF NOT EXISTS idx_ipset_records_ip ON ipset_records(ip);
-        CREATE INDEX IF NOT EXISTS idx_ipset_records_context ON ipset_records USING gin(to_tsvector('english', context));
-        CREATE INDEX IF NOT EXISTS idx_ipset_records_description ON ipset_records USING gin(to_tsvector('english', description));
-    `)
-    if err != nil {
-        return nil, fmt.Errorf("failed to create indexes: %v", err)
-    }
-    
-    // Создаем функцию для автоматического обновления updated_at
-    _, err = db.Exec(`
-        CREATE OR REPLACE FUNCTION update_updated_at_column()
-        RETURNS TRIGGER AS $$
-        BEGIN
-            NEW.updated_at = CURRENT_TIMESTAMP;
-            RETURN NEW;
-        END;
-        $$ language 'plpgsql';
-    `)
+    db, err := openPostgreSQL(cfg)
     if err != nil {
-        return nil, fmt.Errorf("failed to create function: %v", err)
+        return nil, err
     }
     
-    // Создаем триггер для автоматического обновления updated_at
-    _, err = db.Exec(`
-        DROP TRIGGER IF EXISTS update_ipset_records_updated_at ON ipset_records;
-        CREATE TRIGGER update_ipset_records_updated_at
-            BEFORE UPDATE ON ipset_records
-            FOR EACH ROW
-            EXECUTE FUNCTION update_updated_at_column();
-    `)
-    if err != nil {
-        return nil, fmt.Errorf("failed to create trigger: %v", err)
+    if err := ensureSchema(newPostgreSQLMigrator(db), cfg.AutoMigrate); err != nil {
+        return nil, err
     }
     
     // Получаем максимальный ID для определения следующего доступного
@@ -206,15 +516,18 @@ func NewPostgreSQLIPSetStorage(cfg *config.Config) (*PostgreSQLIPSetStorage, err
     }
     
     return &PostgreSQLIPSetStorage{
-        db:     db,
-        nextID: nextID,
+        db:           db,
+        nextID:       nextID,
+        queryTimeout: cfg.DBQueryTimeout,
     }, nil
 }
 
-func (s *PostgreSQLIPSetStorage) getNextID() (int, error) {
+// getNextID ищет свободный ID; db - s.db или транзакция, в которой
+// вставляются записи
+func (s *PostgreSQLIPSetStorage) getNextID(ctx context.Context, db sqlExecer) (int, error) {
     // Ищем первый свободный ID в диапазоне 100000-999999
     var id int
-    err := s.db.QueryRow(`
+    err := db.QueryRowContext(ctx, `
         SELECT generate_series
         FROM generate_series(100000, 999999) AS generate_series
         WHERE generate_series NOT IN (SELECT id FROM ipset_records)
@@ -232,46 +545,100 @@ func (s *PostgreSQLIPSetStorage) getNextID() (int, error) {
     return id, nil
 }
 
-func (s *PostgreSQLIPSetStorage) Create(record *models.IPSetRecord) error {
-    // Получаем следующий доступный ID
-    id, err := s.getNextID()
+func (s *PostgreSQLIPSetStorage) Create(ctx context.Context, record *models.IPSetRecord) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    tx, err := s.db.BeginTx(ctx, nil)
     if err != nil {
-        return err
+        return fmt.Errorf("failed to begin transaction: %v", err)
     }
+    defer tx.Rollback()
     
-    record.ID = id
     now := time.Now()
     record.CreatedAt = now
     record.UpdatedAt = now
     
-    _, err = s.db.Exec(`
+    if err := s.ensureSet(ctx, tx, record); err != nil {
+        return err
+    }
+    if err := lockSet(ctx, tx, postgreSQLDialect, record.SetName); err != nil {
+        return err
+    }
+    
+    if err := s.insertNewRecord(ctx, tx, record); err != nil {
+        return err
+    }
+    if err := checkDuplicate(ctx, tx, postgreSQLDialect, record); err != nil {
+        return err
+    }
+    
+    if err := tx.Commit(); err != nil {
+        return fmt.Errorf("failed to commit transaction: %v", err)
+    }
+    
+    return nil
+}
+
+func (s *PostgreSQLIPSetStorage) ImportRecord(ctx context.Context, record *models.IPSetRecord) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback()
+    
+    if err := lockSet(ctx, tx, postgreSQLDialect, record.SetName); err != nil {
+        return err
+    }
+    
+    // Удаляем и вставляем заново, чтобы триггер не перезаписал updated_at
+    if _, err := tx.ExecContext(ctx, "DELETE FROM ipset_records WHERE id = $1", record.ID); err != nil {
+        return fmt.Errorf("failed to import record %d: %v", record.ID, err)
+    }
+    
+    _, err = tx.ExecContext(ctx, `
         INSERT INTO ipset_records 
-        (id, set_name, ip, cidr, port, protocol, description, context, set_type, set_options, created_at, updated_at)
-        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+        (id, set_name, ip, cidr, port, protocol, description, context, set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
     `,
         record.ID, record.SetName, record.IP, record.CIDR, record.Port, record.Protocol,
-        record.Description, record.Context, record.SetType, record.SetOptions,
-        record.CreatedAt, record.UpdatedAt,
+        record.Description, record.Context, record.SetType, record.SetOptions, record.SecondIP,
+        record.CreatedAt, record.UpdatedAt, nullTimeValue(record.ExpiresAt), nullTimeValue(record.ActiveFrom), record.Schedule,
     )
-    
     if err != nil {
-        return fmt.Errorf("failed to create record: %v", err)
+        return fmt.Errorf("failed to import record %d: %v", record.ID, err)
+    }
+    if err := s.ensureSet(ctx, tx, record); err != nil {
+        return err
+    }
+    if err := checkDuplicate(ctx, tx, postgreSQLDialect, record); err != nil {
+        return err
+    }
+    
+    if err := tx.Commit(); err != nil {
+        return fmt.Errorf("failed to commit transaction: %v", err)
     }
     
     return nil
 }
 
-func (s *PostgreSQLIPSetStorage) GetByID(id int) (*models.IPSetRecord, error) {
+func (s *PostgreSQLIPSetStorage) GetByID(ctx context.Context, id int) (*models.IPSetRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
     var record models.IPSetRecord
-    err := s.db.QueryRow(`
+    err := s.db.QueryRowContext(ctx, `
         SELECT id, set_name, ip, cidr, port, protocol, description, context, 
-               set_type, set_options, created_at, updated_at
+               set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule
         FROM ipset_records
-        WHERE id = $1
+        WHERE id = $1 AND `+activeRecordSQL(postgreSQLDialect)+`
     `, id).Scan(
         &record.ID, &record.SetName, &record.IP, &record.CIDR, &record.Port, &record.Protocol,
-        &record.Description, &record.Context, &record.SetType, &record.SetOptions,
-        &record.CreatedAt, &record.UpdatedAt,
+        &record.Description, &record.Context, &record.SetType, &record.SetOptions, &record.SecondIP,
+        &record.CreatedAt, &record.UpdatedAt, &record.ExpiresAt, &record.ActiveFrom, &record.Schedule,
     )
     
     if err == sql.ErrNoRows {
@@ -284,11 +651,15 @@ func (s *PostgreSQLIPSetStorage) GetByID(id int) (*models.IPSetRecord, error) {
     return &record, nil
 }
 
-func (s *PostgreSQLIPSetStorage) GetAll() ([]*models.IPSetRecord, error) {
-    rows, err := s.db.Query(`
+func (s *PostgreSQLIPSetStorage) GetAll(ctx context.Context) ([]*models.IPSetRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    rows, err := s.db.QueryContext(ctx, `
         SELECT id, set_name, ip, cidr, port, protocol, description, context, 
-               set_type, set_options, created_at, updated_at
+               set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule
         FROM ipset_records
+        WHERE `+activeRecordSQL(postgreSQLDialect)+`
         ORDER BY id
     `)
     if err != nil {
@@ -301,8 +672,8 @@ func (s *PostgreSQLIPSetStorage) GetAll() ([]*models.IPSetRecord, error) {
         var record models.IPSetRecord
         if err := rows.Scan(
             &record.ID, &record.SetName, &record.IP, &record.CIDR, &record.Port, &record.Protocol,
-            &record.Description, &record.Context, &record.SetType, &record.SetOptions,
-            &record.CreatedAt, &record.UpdatedAt,
+            &record.Description, &record.Context, &record.SetType, &record.SetOptions, &record.SecondIP,
+            &record.CreatedAt, &record.UpdatedAt, &record.ExpiresAt, &record.ActiveFrom, &record.Schedule,
         ); err != nil {
             return nil, fmt.Errorf("failed to scan record: %v", err)
         }
@@ -312,12 +683,15 @@ func (s *PostgreSQLIPSetStorage) GetAll() ([]*models.IPSetRecord, error) {
     return records, nil
 }
 
-func (s *PostgreSQLIPSetStorage) GetBySetName(setName string) ([]*models.IPSetRecord, error) {
-    rows, err := s.db.Query(`
+func (s *PostgreSQLIPSetStorage) GetBySetName(ctx context.Context, setName string) ([]*models.IPSetRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    rows, err := s.db.QueryContext(ctx, `
         SELECT id, set_name, ip, cidr, port, protocol, description, context, 
-               set_type, set_options, created_at, updated_at
+               set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule
         FROM ipset_records
-        WHERE set_name = $1
+        WHERE set_name = $1 AND `+activeRecordSQL(postgreSQLDialect)+`
         ORDER BY id
     `, setName)
     if err != nil {
@@ -330,8 +704,8 @@ func (s *PostgreSQLIPSetStorage) GetBySetName(setName string) ([]*models.IPSetRe
         var record models.IPSetRecord
         if err := rows.Scan(
             &record.ID, &record.SetName, &record.IP, &record.CIDR, &record.Port, &record.Protocol,
-            &record.Description, &record.Context, &record.SetType, &record.SetOptions,
-            &record.CreatedAt, &record.UpdatedAt,
+            &record.Description, &record.Context, &record.SetType, &record.SetOptions, &record.SecondIP,
+            &record.CreatedAt, &record.UpdatedAt, &record.ExpiresAt, &record.ActiveFrom, &record.Schedule,
         ); err != nil {
             return nil, fmt.Errorf("failed to scan record: %v", err)
         }
@@ -345,58 +719,311 @@ func (s *PostgreSQLIPSetStorage) GetBySetName(setName string) ([]*models.IPSetRe
     return records, nil
 }
 
-func (s *PostgreSQLIPSetStorage) GetAllSets() ([]*models.IPSetSet, error) {
-    rows, err := s.db.Query(`
-        SELECT 
-            set_name, 
-            set_type, 
-            set_options, 
-            MIN(created_at) as created_at,
-            MAX(updated_at) as updated_at,
-            COUNT(*) as record_count
-        FROM ipset_records
-        GROUP BY set_name, set_type, set_options
-        ORDER BY set_name
-    `)
+func (s *PostgreSQLIPSetStorage) GetAllSets(ctx context.Context) ([]*models.IPSetSet, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    rows, err := s.db.QueryContext(ctx, setSelectSQL(postgreSQLDialect)+" ORDER BY name")
     if err != nil {
         return nil, fmt.Errorf("failed to get all sets: %v", err)
     }
     defer rows.Close()
     
-    var sets []*models.IPSetSet
-    for rows.Next() {
-        set := &models.IPSetSet{
-            Records: []models.IPSetRecord{},
-        }
-        var recordCount int
-        err := rows.Scan(&set.Name, &set.Type, &set.Options, &set.CreatedAt, &set.UpdatedAt, &recordCount)
+    return scanSets(rows)
+}
+
+// ensureSet заводит сет записи, если его еще нет
+func (s *PostgreSQLIPSetStorage) ensureSet(ctx context.Context, db sqlExecer, record *models.IPSetRecord) error {
+    return s.createSetIfMissing(ctx, db, recordSet(record, time.Now().UTC()))
+}
+
+// createSetIfMissing заводит сет, если сета с таким именем еще нет
+func (s *PostgreSQLIPSetStorage) createSetIfMissing(ctx context.Context, db sqlExecer, set *models.IPSetSet) error {
+    _, err := db.ExecContext(ctx, insertSetSQL(postgreSQLDialect)+" ON CONFLICT (name) DO NOTHING", setValues(set)...)
+    if err != nil {
+        return fmt.Errorf("failed to create set %s: %v", set.Name, err)
+    }
+    return nil
+}
+
+func (s *PostgreSQLIPSetStorage) CreateSet(ctx context.Context, set *models.IPSetSet) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    now := time.Now().UTC()
+    set.CreatedAt = now
+    set.UpdatedAt = now
+    
+    if _, err := s.db.ExecContext(ctx, insertSetSQL(postgreSQLDialect), setValues(set)...); err != nil {
+        return fmt.Errorf("failed to create set: %v", err)
+    }
+    
+    return nil
+}
+
+func (s *PostgreSQLIPSetStorage) ImportSet(ctx context.Context, set *models.IPSetSet) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    _, err := s.db.ExecContext(ctx, insertSetSQL(postgreSQLDialect)+`
+        ON CONFLICT (name) DO UPDATE SET
+            type = EXCLUDED.type, options = EXCLUDED.options, family = EXCLUDED.family,
+            description = EXCLUDED.description, owner = EXCLUDED.owner,
+            created_at = EXCLUDED.created_at, updated_at = EXCLUDED.updated_at
+    `, setValues(set)...)
+    if err != nil {
+        return fmt.Errorf("failed to import set %s: %v", set.Name, err)
+    }
+    
+    return nil
+}
+
+func (s *PostgreSQLIPSetStorage) GetSet(ctx context.Context, name string) (*models.IPSetSet, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    rows, err := s.db.QueryContext(ctx, setSelectSQL(postgreSQLDialect)+" WHERE name = $1", name)
+    if err != nil {
+        return nil, fmt.Errorf("failed to get set: %v", err)
+    }
+    defer rows.Close()
+    
+    sets, err := scanSets(rows)
+    if err != nil {
+        return nil, err
+    }
+    
+    if len(sets) == 0 {
+        return nil, fmt.Errorf("set %s not found", name)
+    }
+    
+    return sets[0], nil
+}
+
+func (s *PostgreSQLIPSetStorage) UpdateSet(ctx context.Context, set *models.IPSetSet) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    set.UpdatedAt = time.Now().UTC()
+    result, err := s.db.ExecContext(ctx, updateSetSQL(postgreSQLDialect), setUpdateValues(set)...)
+    if err != nil {
+        return fmt.Errorf("failed to update set: %v", err)
+    }
+    
+    rowsAffected, err := result.RowsAffected()
+    if err != nil {
+        return fmt.Errorf("failed to get rows affected: %v", err)
+    }
+    
+    if rowsAffected == 0 {
+        return fmt.Errorf("set %s not found", set.Name)
+    }
+    
+    return nil
+}
+
+// insertNewRecord выдает записи новый ID и вставляет ее в транзакции tx
+func (s *PostgreSQLIPSetStorage) insertNewRecord(ctx context.Context, tx *sql.Tx, record *models.IPSetRecord) error {
+    id, err := s.getNextID(ctx, tx)
+    if err != nil {
+        return err
+    }
+    record.ID = id
+    
+    _, err = tx.ExecContext(ctx, `
+        INSERT INTO ipset_records
+        (id, set_name, ip, cidr, port, protocol, description, context, set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
+    `,
+        record.ID, record.SetName, record.IP, record.CIDR, record.Port, record.Protocol,
+        record.Description, record.Context, record.SetType, record.SetOptions, record.SecondIP,
+        record.CreatedAt, record.UpdatedAt, nullTimeValue(record.ExpiresAt), nullTimeValue(record.ActiveFrom), record.Schedule,
+    )
+    if err != nil {
+        return fmt.Errorf("failed to create record: %v", err)
+    }
+    return nil
+}
+
+func (s *PostgreSQLIPSetStorage) RenameSet(ctx context.Context, from, to string) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback()
+    
+    if err := renameSetTx(ctx, tx, postgreSQLDialect, from, to); err != nil {
+        return err
+    }
+    
+    if err := tx.Commit(); err != nil {
+        return fmt.Errorf("failed to commit transaction: %v", err)
+    }
+    
+    return nil
+}
+
+func (s *PostgreSQLIPSetStorage) CopySet(ctx context.Context, from, to string) ([]*models.IPSetRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return nil, fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback()
+    
+    records, err := copySetTx(ctx, tx, postgreSQLDialect, from, to, func(record *models.IPSetRecord) error {
+        return s.insertNewRecord(ctx, tx, record)
+    })
+    if err != nil {
+        return nil, err
+    }
+    
+    if err := tx.Commit(); err != nil {
+        return nil, fmt.Errorf("failed to commit transaction: %v", err)
+    }
+    
+    return records, nil
+}
+
+func (s *PostgreSQLIPSetStorage) SwapSets(ctx context.Context, a, b string) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback()
+    
+    if err := swapSetsTx(ctx, tx, postgreSQLDialect, a, b); err != nil {
+        return err
+    }
+    
+    if err := tx.Commit(); err != nil {
+        return fmt.Errorf("failed to commit transaction: %v", err)
+    }
+    
+    return nil
+}
+
+func (s *PostgreSQLIPSetStorage) ApplySetChanges(ctx context.Context, setName string, revision int64, set *models.IPSetSet, remove []int, update, add []*models.IPSetRecord) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback()
+    
+    if err := checkSetRevision(ctx, tx, postgreSQLDialect, setName, revision); err != nil {
+        return err
+    }
+    
+    if set != nil {
+        err := saveSetTx(ctx, tx, postgreSQLDialect, set, func(set *models.IPSetSet) error {
+            return s.createSetIfMissing(ctx, tx, set)
+        })
         if err != nil {
-            return nil, fmt.Errorf("failed to scan set: %v", err)
+            return err
         }
-        
-        // Получаем записи для этого сета
-        records, err := s.GetBySetName(set.Name)
-        if err == nil {
-            for _, r := range records {
-                set.Records = append(set.Records, *r)
-            }
-        }
-        
-        sets = append(sets, set)
     }
     
-    return sets, nil
+    err = applySetChangesTx(ctx, tx, postgreSQLDialect, setName, remove, update, add, func(record *models.IPSetRecord) error {
+        return s.updateRecord(ctx, tx, record.ID, record)
+    }, func(record *models.IPSetRecord) error {
+        return s.insertNewRecord(ctx, tx, record)
+    })
+    if err != nil {
+        return err
+    }
+    
+    if err := tx.Commit(); err != nil {
+        return fmt.Errorf("failed to commit transaction: %v", err)
+    }
+    
+    return nil
 }
 
-func (s *PostgreSQLIPSetStorage) Update(id int, record *models.IPSetRecord) error {
-    result, err := s.db.Exec(`
+func (s *PostgreSQLIPSetStorage) ApplyChanges(ctx context.Context, changes []*RecordChange) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback()
+    
+    err = applyChangesTx(ctx, tx, postgreSQLDialect, changes, func(record *models.IPSetRecord) error {
+        return s.ensureSet(ctx, tx, record)
+    }, func(record *models.IPSetRecord) error {
+        return s.updateRecord(ctx, tx, record.ID, record)
+    }, func(record *models.IPSetRecord) error {
+        return s.insertNewRecord(ctx, tx, record)
+    })
+    if err != nil {
+        return err
+    }
+    
+    if err := tx.Commit(); err != nil {
+        return fmt.Errorf("failed to commit transaction: %v", err)
+    }
+    
+    return nil
+}
+
+func (s *PostgreSQLIPSetStorage) Update(ctx context.Context, id int, record *models.IPSetRecord) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback()
+    
+    record.ID = id
+    
+    // Запись могла перейти в новый сет
+    if err := s.ensureSet(ctx, tx, record); err != nil {
+        return err
+    }
+    if err := lockSet(ctx, tx, postgreSQLDialect, record.SetName); err != nil {
+        return err
+    }
+    
+    if err := s.updateRecord(ctx, tx, id, record); err != nil {
+        return err
+    }
+    if err := checkDuplicate(ctx, tx, postgreSQLDialect, record); err != nil {
+        return err
+    }
+    
+    if err := tx.Commit(); err != nil {
+        return fmt.Errorf("failed to commit transaction: %v", err)
+    }
+    
+    return nil
+}
+
+// updateRecord перезаписывает действующую запись в транзакции tx
+func (s *PostgreSQLIPSetStorage) updateRecord(ctx context.Context, tx *sql.Tx, id int, record *models.IPSetRecord) error {
+    result, err := tx.ExecContext(ctx, `
         UPDATE ipset_records
         SET set_name = $1, ip = $2, cidr = $3, port = $4, protocol = $5, 
-            description = $6, context = $7, set_type = $8, set_options = $9
-        WHERE id = $10
+            description = $6, context = $7, set_type = $8, set_options = $9,
+            second_ip = $10, expires_at = $11, active_from = $12, schedule = $13
+        WHERE id = $14 AND `+activeRecordSQL(postgreSQLDialect)+`
     `,
         record.SetName, record.IP, record.CIDR, record.Port, record.Protocol,
-        record.Description, record.Context, record.SetType, record.SetOptions, id,
+        record.Description, record.Context, record.SetType, record.SetOptions, record.SecondIP,
+        nullTimeValue(record.ExpiresAt), nullTimeValue(record.ActiveFrom), record.Schedule, id,
     )
     
     if err != nil {
@@ -415,8 +1042,14 @@ func (s *PostgreSQLIPSetStorage) Update(id int, record *models.IPSetRecord) erro
     return nil
 }
 
-func (s *PostgreSQLIPSetStorage) Delete(id int) error {
-    result, err := s.db.Exec("DELETE FROM ipset_records WHERE id = $1", id)
+func (s *PostgreSQLIPSetStorage) Delete(ctx context.Context, id int) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    result, err := s.db.ExecContext(ctx,
+        "UPDATE ipset_records SET deleted_at = $1 WHERE id = $2 AND deleted_at IS NULL",
+        time.Now().UTC(), id,
+    )
     if err != nil {
         return fmt.Errorf("failed to delete record: %v", err)
     }
@@ -433,37 +1066,65 @@ func (s *PostgreSQLIPSetStorage) Delete(id int) error {
     return nil
 }
 
-func (s *PostgreSQLIPSetStorage) DeleteSet(setName string) error {
-    result, err := s.db.Exec("DELETE FROM ipset_records WHERE set_name = $1", setName)
+func (s *PostgreSQLIPSetStorage) DeleteSet(ctx context.Context, setName string) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback()
+    
+    result, err := tx.ExecContext(ctx,
+        "UPDATE ipset_records SET deleted_at = $1 WHERE set_name = $2 AND deleted_at IS NULL",
+        time.Now().UTC(), setName,
+    )
     if err != nil {
         return fmt.Errorf("failed to delete set: %v", err)
     }
+    deletedRecords, err := result.RowsAffected()
+    if err != nil {
+        return fmt.Errorf("failed to get rows affected: %v", err)
+    }
     
-    rowsAffected, err := result.RowsAffected()
+    result, err = tx.ExecContext(ctx, "DELETE FROM ipset_sets WHERE name = $1", setName)
+    if err != nil {
+        return fmt.Errorf("failed to delete set: %v", err)
+    }
+    deletedSets, err := result.RowsAffected()
     if err != nil {
         return fmt.Errorf("failed to get rows affected: %v", err)
     }
     
-    if rowsAffected == 0 {
+    if deletedRecords == 0 && deletedSets == 0 {
         return fmt.Errorf("set %s not found", setName)
     }
     
+    if err := tx.Commit(); err != nil {
+        return fmt.Errorf("failed to commit transaction: %v", err)
+    }
+    
     return nil
 }
 
-func (s *PostgreSQLIPSetStorage) Search(query string) ([]*models.IPSetRecord, error) {
+func (s *PostgreSQLIPSetStorage) Search(ctx context.Context, query string) ([]*models.IPSetRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
     // Используем полнотекстовый поиск PostgreSQL для лучших результатов
-    rows, err := s.db.Query(`
+    rows, err := s.db.QueryContext(ctx, `
         SELECT id, set_name, ip, cidr, port, protocol, description, context, 
-               set_type, set_options, created_at, updated_at
+               set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule
         FROM ipset_records
-        WHERE 
+        WHERE `+activeRecordSQL(postgreSQLDialect)+` AND (
             to_tsvector('english', COALESCE(context, '')) @@ plainto_tsquery('english', $1)
             OR to_tsvector('english', COALESCE(description, '')) @@ plainto_tsquery('english', $1)
             OR context ILIKE '%' || $1 || '%'
             OR description ILIKE '%' || $1 || '%'
             OR ip ILIKE '%' || $1 || '%'
             OR set_name ILIKE '%' || $1 || '%'
+        )
         ORDER BY 
             CASE 
                 WHEN set_name = $1 THEN 1
@@ -485,8 +1146,42 @@ func (s *PostgreSQLIPSetStorage) Search(query string) ([]*models.IPSetRecord, er
         var record models.IPSetRecord
         if err := rows.Scan(
             &record.ID, &record.SetName, &record.IP, &record.CIDR, &record.Port, &record.Protocol,
-            &record.Description, &record.Context, &record.SetType, &record.SetOptions,
-            &record.CreatedAt, &record.UpdatedAt,
+            &record.Description, &record.Context, &record.SetType, &record.SetOptions, &record.SecondIP,
+            &record.CreatedAt, &record.UpdatedAt, &record.ExpiresAt, &record.ActiveFrom, &record.Schedule,
+        ); err != nil {
+            return nil, fmt.Errorf("failed to scan record: %v", err)
+        }
+        records = append(records, &record)
+    }
+    
+    return records, nil
+}
+
+// Lookup ищет записи, сеть которых содержит префикс или содержится в нем
+// (оператор && по GiST-индексу). Сети разных семейств не пересекаются.
+func (s *PostgreSQLIPSetStorage) Lookup(ctx context.Context, prefix netip.Prefix) ([]*models.IPSetRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    rows, err := s.db.QueryContext(ctx, `
+        SELECT id, set_name, ip, cidr, port, protocol, description, context, 
+               set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule
+        FROM ipset_records
+        WHERE `+activeRecordSQL(postgreSQLDialect)+` AND net && $1::cidr
+        ORDER BY set_name, id
+    `, prefix.Masked().String())
+    if err != nil {
+        return nil, fmt.Errorf("failed to lookup records: %v", err)
+    }
+    defer rows.Close()
+    
+    var records []*models.IPSetRecord
+    for rows.Next() {
+        var record models.IPSetRecord
+        if err := rows.Scan(
+            &record.ID, &record.SetName, &record.IP, &record.CIDR, &record.Port, &record.Protocol,
+            &record.Description, &record.Context, &record.SetType, &record.SetOptions, &record.SecondIP,
+            &record.CreatedAt, &record.UpdatedAt, &record.ExpiresAt, &record.ActiveFrom, &record.Schedule,
         ); err != nil {
             return nil, fmt.Errorf("failed to scan record: %v", err)
         }
@@ -494,4 +1189,375 @@ func (s *PostgreSQLIPSetStorage) Search(query string) ([]*models.IPSetRecord, er
     }
     
     return records, nil
-}
\ No newline at end of file
+}
+
+func (s *PostgreSQLIPSetStorage) List(ctx context.Context, q *models.RecordQuery) (*models.RecordPage, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    tail, args, err := buildRecordListSQL(q, postgreSQLDialect, activeRecordSQL(postgreSQLDialect))
+    if err != nil {
+        return nil, err
+    }
+    
+    rows, err := s.db.QueryContext(ctx, `
+        SELECT id, set_name, ip, cidr, port, protocol, description, context, 
+               set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule
+        FROM ipset_records
+    `+tail, args...)
+    if err != nil {
+        return nil, fmt.Errorf("failed to list records: %v", err)
+    }
+    defer rows.Close()
+    
+    var records []*models.IPSetRecord
+    for rows.Next() {
+        var record models.IPSetRecord
+        if err := rows.Scan(
+            &record.ID, &record.SetName, &record.IP, &record.CIDR, &record.Port, &record.Protocol,
+            &record.Description, &record.Context, &record.SetType, &record.SetOptions, &record.SecondIP,
+            &record.CreatedAt, &record.UpdatedAt, &record.ExpiresAt, &record.ActiveFrom, &record.Schedule,
+        ); err != nil {
+            return nil, fmt.Errorf("failed to scan record: %v", err)
+        }
+        records = append(records, &record)
+    }
+    
+    return recordPage(records, q), nil
+}
+
+func (s *PostgreSQLIPSetStorage) ListSets(ctx context.Context, q *models.SetQuery) (*models.SetPage, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    where, tail, args, err := buildSetListSQL(q, postgreSQLDialect)
+    if err != nil {
+        return nil, err
+    }
+    
+    rows, err := s.db.QueryContext(ctx, setSelectSQL(postgreSQLDialect)+" "+where+" "+tail, args...)
+    if err != nil {
+        return nil, fmt.Errorf("failed to list sets: %v", err)
+    }
+    defer rows.Close()
+    
+    sets, err := scanSets(rows)
+    if err != nil {
+        return nil, err
+    }
+    
+    return setPage(sets, q), nil
+}
+
+func (s *PostgreSQLIPSetStorage) History(ctx context.Context, id int) ([]*models.RecordRevision, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    rows, err := s.db.QueryContext(ctx, recordHistorySQL(postgreSQLDialect), id)
+    if err != nil {
+        return nil, fmt.Errorf("failed to get record history: %v", err)
+    }
+    defer rows.Close()
+    
+    return scanRevisions(rows)
+}
+
+func (s *PostgreSQLIPSetStorage) GetBySetNameAt(ctx context.Context, setName string, at time.Time) ([]*models.IPSetRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    rows, err := s.db.QueryContext(ctx, setAtSQL(postgreSQLDialect), setName, at.UTC())
+    if err != nil {
+        return nil, fmt.Errorf("failed to get set history: %v", err)
+    }
+    defer rows.Close()
+    
+    return scanHistoryRecords(rows)
+}
+
+func (s *PostgreSQLIPSetStorage) Revision(ctx context.Context) (int64, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    var revision int64
+    if err := s.db.QueryRowContext(ctx, revisionSQL).Scan(&revision); err != nil {
+        return 0, fmt.Errorf("failed to get revision: %v", err)
+    }
+    return revision, nil
+}
+
+func (s *PostgreSQLIPSetStorage) Changes(ctx context.Context, since int64, limit int) ([]*models.ChangeEvent, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    rows, err := s.db.QueryContext(ctx, changesSQL(postgreSQLDialect), since, limit)
+    if err != nil {
+        return nil, fmt.Errorf("failed to get changes: %v", err)
+    }
+    defer rows.Close()
+    
+    return scanChanges(rows)
+}
+
+func (s *PostgreSQLIPSetStorage) ListTrash(ctx context.Context, q *models.RecordQuery) (*models.RecordPage, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    tail, args, err := buildRecordListSQL(q, postgreSQLDialect, "deleted_at IS NOT NULL")
+    if err != nil {
+        return nil, err
+    }
+    
+    rows, err := s.db.QueryContext(ctx, "SELECT "+trashColumns+" FROM ipset_records "+tail, args...)
+    if err != nil {
+        return nil, fmt.Errorf("failed to list trash: %v", err)
+    }
+    defer rows.Close()
+    
+    records, err := scanTrash(rows)
+    if err != nil {
+        return nil, err
+    }
+    
+    return recordPage(records, q), nil
+}
+
+func (s *PostgreSQLIPSetStorage) Undelete(ctx context.Context, id int) (*models.IPSetRecord, error) {
+    records, err := s.undelete(ctx, "id", id)
+    if err != nil {
+        return nil, err
+    }
+    
+    if len(records) == 0 {
+        return nil, fmt.Errorf("record with id %d not found in trash", id)
+    }
+    
+    return records[0], nil
+}
+
+func (s *PostgreSQLIPSetStorage) UndeleteSet(ctx context.Context, setName string) ([]*models.IPSetRecord, error) {
+    records, err := s.undelete(ctx, "set_name", setName)
+    if err != nil {
+        return nil, err
+    }
+    
+    if len(records) == 0 {
+        return nil, fmt.Errorf("set %s not found in trash", setName)
+    }
+    
+    return records, nil
+}
+
+// undelete возвращает из корзины записи с заданным значением колонки и
+// отдает их в том виде, в каком они стали после восстановления
+func (s *PostgreSQLIPSetStorage) undelete(ctx context.Context, column string, value interface{}) ([]*models.IPSetRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return nil, fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback()
+    
+    rows, err := tx.QueryContext(ctx,
+        "SELECT "+trashColumns+" FROM ipset_records WHERE deleted_at IS NOT NULL AND "+column+" = $1 ORDER BY id FOR UPDATE", value)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read trash: %v", err)
+    }
+    records, err := scanTrash(rows)
+    rows.Close()
+    if err != nil {
+        return nil, err
+    }
+    
+    now := time.Now().UTC()
+    _, err = tx.ExecContext(ctx,
+        "UPDATE ipset_records SET deleted_at = NULL, updated_at = $1 WHERE deleted_at IS NOT NULL AND "+column+" = $2", now, value)
+    if err != nil {
+        return nil, fmt.Errorf("failed to restore records: %v", err)
+    }
+    for _, record := range records {
+        if err := s.ensureSet(ctx, tx, record); err != nil {
+            return nil, err
+        }
+        // Пока запись была в корзине, в сет могли добавить тот же элемент
+        if err := lockSet(ctx, tx, postgreSQLDialect, record.SetName); err != nil {
+            return nil, err
+        }
+        if err := checkDuplicate(ctx, tx, postgreSQLDialect, record); err != nil {
+            return nil, err
+        }
+    }
+    
+    if err := tx.Commit(); err != nil {
+        return nil, fmt.Errorf("failed to commit transaction: %v", err)
+    }
+    
+    return restoredRecords(records, now), nil
+}
+
+func (s *PostgreSQLIPSetStorage) PurgeTrash(ctx context.Context, before time.Time) (int, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    result, err := s.db.ExecContext(ctx,
+        "DELETE FROM ipset_records WHERE deleted_at IS NOT NULL AND deleted_at < $1", before.UTC())
+    if err != nil {
+        return 0, fmt.Errorf("failed to purge trash: %v", err)
+    }
+    
+    purged, err := result.RowsAffected()
+    if err != nil {
+        return 0, fmt.Errorf("failed to get rows affected: %v", err)
+    }
+    
+    return int(purged), nil
+}
+
+func (s *PostgreSQLIPSetStorage) CountExpired(ctx context.Context, at time.Time) (int, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    var count int
+    err := s.db.QueryRowContext(ctx,
+        "SELECT COUNT(*) FROM ipset_records WHERE deleted_at IS NULL AND expires_at <= $1", at.UTC()).Scan(&count)
+    if err != nil {
+        return 0, fmt.Errorf("failed to count expired records: %v", err)
+    }
+    
+    return count, nil
+}
+
+func (s *PostgreSQLIPSetStorage) DeleteExpired(ctx context.Context, at time.Time) ([]*models.IPSetRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return nil, fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback()
+    
+    // Истекшие записи удаляются мимо корзины, триггер истории записывает удаление
+    rows, err := tx.QueryContext(ctx,
+        "SELECT "+trashColumns+" FROM ipset_records WHERE deleted_at IS NULL AND expires_at <= $1 ORDER BY id FOR UPDATE", at.UTC())
+    if err != nil {
+        return nil, fmt.Errorf("failed to read expired records: %v", err)
+    }
+    records, err := scanTrash(rows)
+    rows.Close()
+    if err != nil {
+        return nil, err
+    }
+    
+    if len(records) == 0 {
+        return nil, nil
+    }
+    
+    _, err = tx.ExecContext(ctx,
+        "DELETE FROM ipset_records WHERE deleted_at IS NULL AND expires_at <= $1", at.UTC())
+    if err != nil {
+        return nil, fmt.Errorf("failed to delete expired records: %v", err)
+    }
+    
+    if err := tx.Commit(); err != nil {
+        return nil, fmt.Errorf("failed to commit transaction: %v", err)
+    }
+    
+    return records, nil
+}
+
+// PostgreSQLAuditStorage - журнал аудита в таблице audit_log
+type PostgreSQLAuditStorage struct {
+    db           *sql.DB
+    queryTimeout time.Duration
+}
+
+func NewPostgreSQLAuditStorage(cfg *config.Config) (*PostgreSQLAuditStorage, error) {
+    db, err := openPostgreSQL(cfg)
+    if err != nil {
+        return nil, err
+    }
+    
+    if err := ensureSchema(newPostgreSQLMigrator(db), cfg.AutoMigrate); err != nil {
+        return nil, err
+    }
+    
+    return &PostgreSQLAuditStorage{db: db, queryTimeout: cfg.DBQueryTimeout}, nil
+}
+
+func (s *PostgreSQLAuditStorage) Append(ctx context.Context, event *models.AuditEvent) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    err := s.db.QueryRowContext(ctx, `
+        INSERT INTO audit_log
+        (created_at, actor, request_id, action, set_name, record_id, before_json, after_json)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+        RETURNING id
+    `,
+        event.Timestamp.UTC(), event.Actor, event.RequestID, event.Action, event.SetName, event.RecordID,
+        auditJSON(event.Before), auditJSON(event.After),
+    ).Scan(&event.ID)
+    if err != nil {
+        return fmt.Errorf("failed to append audit event: %v", err)
+    }
+    return nil
+}
+
+func (s *PostgreSQLAuditStorage) List(ctx context.Context, q *models.AuditQuery) (*models.AuditPage, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+    
+    tail, args, err := buildAuditListSQL(q, postgreSQLDialect)
+    if err != nil {
+        return nil, err
+    }
+    
+    rows, err := s.db.QueryContext(ctx, `
+        SELECT id, created_at, actor, request_id, action, set_name, record_id, before_json, after_json
+        FROM audit_log
+    `+tail, args...)
+    if err != nil {
+        return nil, fmt.Errorf("failed to list audit events: %v", err)
+    }
+    defer rows.Close()
+    
+    events, err := scanAuditEvents(rows)
+    if err != nil {
+        return nil, err
+    }
+    
+    return auditPage(events, q), nil
+}
+
+// NewPostgreSQLWebhookStorage - подписки и доставки в таблицах webhooks и
+// webhook_deliveries
+func NewPostgreSQLWebhookStorage(cfg *config.Config) (*SQLWebhookStorage, error) {
+    db, err := openPostgreSQL(cfg)
+    if err != nil {
+        return nil, err
+    }
+    
+    if err := ensureSchema(newPostgreSQLMigrator(db), cfg.AutoMigrate); err != nil {
+        return nil, err
+    }
+    
+    return &SQLWebhookStorage{db: db, dialect: postgreSQLDialect, queryTimeout: cfg.DBQueryTimeout, returning: true}, nil
+}
+
+// NewPostgreSQLAgentStorage - агенты и правила назначения в таблицах agents
+// и agent_assignments
+func NewPostgreSQLAgentStorage(cfg *config.Config) (*SQLAgentStorage, error) {
+    db, err := openPostgreSQL(cfg)
+    if err != nil {
+        return nil, err
+    }
+    
+    if err := ensureSchema(newPostgreSQLMigrator(db), cfg.AutoMigrate); err != nil {
+        return nil, err
+    }
+    
+    return &SQLAgentStorage{db: db, dialect: postgreSQLDialect, queryTimeout: cfg.DBQueryTimeout, returning: true}, nil
+}
@@ -0,0 +1,363 @@
+package storage
+
+import (
+    "context"
+    "database/sql"
+    "fmt"
+    "time"
+    "ipset-api-server/internal/models"
+    "ipset-api-server/pkg/validation"
+)
+
+// Сеты хранятся отдельно от записей: таблица ipset_sets (миграция 9, в
+// ClickHouse - миграция 8), в файловом хранилище - раздел sets. Сет может
+// быть пустым. Записи ссылаются на сет по имени и по-прежнему хранят копию
+// типа и опций сета - по ним строится экспорт и история. Хранилище заводит
+// сет при сохранении записи в несуществующий сет (так создавались сеты до
+// появления ipset_sets), а тип и опции записи сверяет с сетом API.
+
+// setColumns - колонки ipset_sets, порядок совпадает с scanSets
+const setColumns = "name, type, options, family, description, owner, created_at, updated_at"
+
+// setSelectSQL - сеты с числом действующих записей
+func setSelectSQL(d sqlDialect) string {
+    return `SELECT ` + setColumns + `,
+               (SELECT COUNT(*) FROM ipset_records r
+                WHERE r.set_name = ipset_sets.name AND ` + activeRecordSQL(d) + `) AS record_count
+        FROM ipset_sets`
+}
+
+// setsBackfillSQL заводит сеты для записей, созданных до появления
+// ipset_sets. Тип и опции берутся из записей, семейство - из опций.
+const setsBackfillSQL = `INSERT INTO ipset_sets (` + setColumns + `)
+    SELECT set_name,
+           COALESCE(NULLIF(MIN(set_type), ''), 'hash:ip'),
+           COALESCE(MIN(set_options), ''),
+           CASE WHEN COALESCE(MIN(set_options), '') LIKE '%family inet6%' THEN 'inet6' ELSE 'inet' END,
+           '', '',
+           COALESCE(MIN(created_at), CURRENT_TIMESTAMP),
+           COALESCE(MAX(updated_at), CURRENT_TIMESTAMP)
+    FROM ipset_records
+    WHERE deleted_at IS NULL
+    GROUP BY set_name`
+
+// insertSetSQL - вставка сета, значения - setValues
+func insertSetSQL(d sqlDialect) string {
+    return fmt.Sprintf(`INSERT INTO ipset_sets (%s)
+        VALUES (%s, %s, %s, %s, %s, %s, %s, %s)`, setColumns,
+        d.placeholder(1), d.placeholder(2), d.placeholder(3), d.placeholder(4),
+        d.placeholder(5), d.placeholder(6), d.placeholder(7), d.placeholder(8))
+}
+
+// updateSetSQL - изменение сета по имени, значения - setUpdateValues
+func updateSetSQL(d sqlDialect) string {
+    return fmt.Sprintf(`UPDATE ipset_sets
+        SET type = %s, options = %s, family = %s, description = %s, owner = %s, updated_at = %s
+        WHERE name = %s`,
+        d.placeholder(1), d.placeholder(2), d.placeholder(3), d.placeholder(4),
+        d.placeholder(5), d.placeholder(6), d.placeholder(7))
+}
+
+func setValues(set *models.IPSetSet) []interface{} {
+    return []interface{}{
+        set.Name, set.Type, set.Options, set.Family, set.Description, set.Owner,
+        set.CreatedAt.UTC(), set.UpdatedAt.UTC(),
+    }
+}
+
+func setUpdateValues(set *models.IPSetSet) []interface{} {
+    return []interface{}{
+        set.Type, set.Options, set.Family, set.Description, set.Owner, set.UpdatedAt.UTC(), set.Name,
+    }
+}
+
+// scanSets читает сеты, выбранные setSelectSQL
+func scanSets(rows *sql.Rows) ([]*models.IPSetSet, error) {
+    var sets []*models.IPSetSet
+    for rows.Next() {
+        var set models.IPSetSet
+        if err := rows.Scan(&set.Name, &set.Type, &set.Options, &set.Family, &set.Description, &set.Owner,
+            &set.CreatedAt, &set.UpdatedAt, &set.RecordCount); err != nil {
+            return nil, fmt.Errorf("failed to scan set: %v", err)
+        }
+        sets = append(sets, &set)
+    }
+
+    return sets, rows.Err()
+}
+
+// recordSet - сет, который заводится для записи в несуществующий сет
+func recordSet(record *models.IPSetRecord, at time.Time) *models.IPSetSet {
+    setType := record.SetType
+    if setType == "" {
+        setType = validation.DefaultSetType
+    }
+    return &models.IPSetSet{
+        Name:      record.SetName,
+        Type:      setType,
+        Options:   record.SetOptions,
+        Family:    validation.Family(record.SetOptions),
+        CreatedAt: at,
+        UpdatedAt: at,
+    }
+}
+
+// sqlExecer - *sql.DB или *sql.Tx
+type sqlExecer interface {
+    ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+    QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// Переименование, копирование и обмен сетов выполняются в одной транзакции
+// (ее открывает хранилище) и затрагивают только действующие записи: записи
+// в корзине остаются в сете со старым именем и при восстановлении заводят
+// его заново. Изменения записей попадают в историю через триггеры.
+
+// txSet читает сет в транзакции
+func txSet(ctx context.Context, tx *sql.Tx, d sqlDialect, name string) (*models.IPSetSet, error) {
+    rows, err := tx.QueryContext(ctx, setSelectSQL(d)+" WHERE name = "+d.placeholder(1), name)
+    if err != nil {
+        return nil, fmt.Errorf("failed to get set: %v", err)
+    }
+    defer rows.Close()
+
+    sets, err := scanSets(rows)
+    if err != nil {
+        return nil, err
+    }
+    if len(sets) == 0 {
+        return nil, fmt.Errorf("set %s not found", name)
+    }
+    return sets[0], nil
+}
+
+// checkSetAbsent - ошибка, если сет с таким именем уже есть
+func checkSetAbsent(ctx context.Context, tx *sql.Tx, d sqlDialect, name string) error {
+    var count int
+    err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM ipset_sets WHERE name = "+d.placeholder(1), name).Scan(&count)
+    if err != nil {
+        return fmt.Errorf("failed to get set: %v", err)
+    }
+    if count > 0 {
+        return fmt.Errorf("set %s already exists", name)
+    }
+    return nil
+}
+
+// renameSetTx переименовывает сет from в to вместе с его записями
+func renameSetTx(ctx context.Context, tx *sql.Tx, d sqlDialect, from, to string) error {
+    if _, err := txSet(ctx, tx, d, from); err != nil {
+        return err
+    }
+    if err := checkSetAbsent(ctx, tx, d, to); err != nil {
+        return err
+    }
+
+    now := time.Now().UTC()
+    _, err := tx.ExecContext(ctx, fmt.Sprintf("UPDATE ipset_sets SET name = %s, updated_at = %s WHERE name = %s",
+        d.placeholder(1), d.placeholder(2), d.placeholder(3)), to, now, from)
+    if err != nil {
+        return fmt.Errorf("failed to rename set: %v", err)
+    }
+
+    _, err = tx.ExecContext(ctx, fmt.Sprintf("UPDATE ipset_records SET set_name = %s, updated_at = %s WHERE set_name = %s AND deleted_at IS NULL",
+        d.placeholder(1), d.placeholder(2), d.placeholder(3)), to, now, from)
+    if err != nil {
+        return fmt.Errorf("failed to rename set records: %v", err)
+    }
+    return nil
+}
+
+// swapSetsTx меняет сеты a и b содержимым: имена остаются на месте, а тип,
+// опции, описание, владелец и записи переходят в другой сет. Так обмен
+// не упирается в уникальность имени сета.
+func swapSetsTx(ctx context.Context, tx *sql.Tx, d sqlDialect, a, b string) error {
+    setA, err := txSet(ctx, tx, d, a)
+    if err != nil {
+        return err
+    }
+    setB, err := txSet(ctx, tx, d, b)
+    if err != nil {
+        return err
+    }
+
+    now := time.Now().UTC()
+    setA.Name, setB.Name = b, a
+    for _, set := range []*models.IPSetSet{setA, setB} {
+        set.UpdatedAt = now
+        _, err := tx.ExecContext(ctx, fmt.Sprintf(`UPDATE ipset_sets
+            SET type = %s, options = %s, family = %s, description = %s, owner = %s, created_at = %s, updated_at = %s
+            WHERE name = %s`,
+            d.placeholder(1), d.placeholder(2), d.placeholder(3), d.placeholder(4),
+            d.placeholder(5), d.placeholder(6), d.placeholder(7), d.placeholder(8)),
+            set.Type, set.Options, set.Family, set.Description, set.Owner, set.CreatedAt.UTC(), set.UpdatedAt, set.Name)
+        if err != nil {
+            return fmt.Errorf("failed to swap sets: %v", err)
+        }
+    }
+
+    _, err = tx.ExecContext(ctx, fmt.Sprintf(`UPDATE ipset_records
+        SET set_name = CASE WHEN set_name = %s THEN %s ELSE %s END, updated_at = %s
+        WHERE set_name IN (%s, %s) AND deleted_at IS NULL`,
+        d.placeholder(1), d.placeholder(2), d.placeholder(3), d.placeholder(4), d.placeholder(5), d.placeholder(6)),
+        a, b, a, now, a, b)
+    if err != nil {
+        return fmt.Errorf("failed to swap set records: %v", err)
+    }
+    return nil
+}
+
+// copySetTx заводит сет to с типом, опциями, описанием и владельцем сета
+// from и копирует в него действующие записи. insert сохраняет копию записи:
+// выдает ей новый ID и вставляет ее. Возвращает созданные записи.
+func copySetTx(ctx context.Context, tx *sql.Tx, d sqlDialect, from, to string,
+    insert func(record *models.IPSetRecord) error) ([]*models.IPSetRecord, error) {
+    set, err := txSet(ctx, tx, d, from)
+    if err != nil {
+        return nil, err
+    }
+    if err := checkSetAbsent(ctx, tx, d, to); err != nil {
+        return nil, err
+    }
+
+    rows, err := tx.QueryContext(ctx, "SELECT "+trashColumns+" FROM ipset_records WHERE set_name = "+d.placeholder(1)+
+        " AND "+activeRecordSQL(d)+" ORDER BY id", from)
+    if err != nil {
+        return nil, fmt.Errorf("failed to get set records: %v", err)
+    }
+    records, err := scanTrash(rows)
+    rows.Close()
+    if err != nil {
+        return nil, err
+    }
+
+    now := time.Now().UTC()
+    set.Name = to
+    set.CreatedAt = now
+    set.UpdatedAt = now
+    if _, err := tx.ExecContext(ctx, insertSetSQL(d), setValues(set)...); err != nil {
+        return nil, fmt.Errorf("failed to create set: %v", err)
+    }
+
+    for _, record := range records {
+        record.SetName = to
+        record.CreatedAt = now
+        record.UpdatedAt = now
+        if err := insert(record); err != nil {
+            return nil, err
+        }
+    }
+    return records, nil
+}
+
+// saveSetTx перезаписывает сет в транзакции tx, а если его нет, заводит
+// через create
+func saveSetTx(ctx context.Context, tx *sql.Tx, d sqlDialect, set *models.IPSetSet, create func(set *models.IPSetSet) error) error {
+    now := time.Now().UTC()
+    set.UpdatedAt = now
+    result, err := tx.ExecContext(ctx, updateSetSQL(d), setUpdateValues(set)...)
+    if err != nil {
+        return fmt.Errorf("failed to update set: %v", err)
+    }
+    rowsAffected, err := result.RowsAffected()
+    if err != nil {
+        return fmt.Errorf("failed to get rows affected: %v", err)
+    }
+    if rowsAffected > 0 {
+        return nil
+    }
+
+    // MySQL не считает строку, значения которой не изменились: тогда create
+    // ничего не вставит
+    if set.CreatedAt.IsZero() {
+        set.CreatedAt = now
+    }
+    return create(set)
+}
+
+// SetChangedError - сет изменили после номера Revision, на котором его
+// прочитали: изменение, посчитанное по прочитанному сету, устарело
+type SetChangedError struct {
+    SetName  string
+    Revision int64
+}
+
+func (e *SetChangedError) Error() string {
+    return fmt.Sprintf("set %s changed after revision %d", e.SetName, e.Revision)
+}
+
+// checkSetRevision блокирует счетчик изменений (как lockSet) и проверяет,
+// что после revision в потоке нет изменений сета setName. Вызывается до
+// первого изменения в транзакции tx: триггеры пишут изменения этой же
+// транзакции с большими номерами.
+func checkSetRevision(ctx context.Context, tx *sql.Tx, d sqlDialect, setName string, revision int64) error {
+    if err := lockSet(ctx, tx, d, setName); err != nil {
+        return err
+    }
+
+    var changed int64
+    err := tx.QueryRowContext(ctx, fmt.Sprintf(
+        "SELECT revision FROM ipset_changes WHERE revision > %s AND set_name = %s ORDER BY revision LIMIT 1%s",
+        d.placeholder(1), d.placeholder(2), d.forUpdate), revision, setName).Scan(&changed)
+    if err == sql.ErrNoRows {
+        return nil
+    }
+    if err != nil {
+        return fmt.Errorf("failed to check set %s revision: %v", setName, err)
+    }
+    return &SetChangedError{SetName: setName, Revision: revision}
+}
+
+// applySetChangesTx переносит в корзину записи remove, меняет записи update
+// через updateRecord и вставляет записи add через insert. Записи remove и
+// update должны быть действующими записями сета, иначе сет изменили во время
+// импорта и транзакция откатывается, как и при дубликате.
+func applySetChangesTx(ctx context.Context, tx *sql.Tx, d sqlDialect, setName string, remove []int, update, add []*models.IPSetRecord,
+    updateRecord, insert func(record *models.IPSetRecord) error) error {
+    if err := lockSet(ctx, tx, d, setName); err != nil {
+        return err
+    }
+
+    now := time.Now().UTC()
+    for _, id := range remove {
+        result, err := tx.ExecContext(ctx, fmt.Sprintf(
+            "UPDATE ipset_records SET deleted_at = %s WHERE id = %s AND set_name = %s AND deleted_at IS NULL",
+            d.placeholder(1), d.placeholder(2), d.placeholder(3)), now, id, setName)
+        if err != nil {
+            return fmt.Errorf("failed to delete record %d: %v", id, err)
+        }
+        rowsAffected, err := result.RowsAffected()
+        if err != nil {
+            return fmt.Errorf("failed to get rows affected: %v", err)
+        }
+        if rowsAffected == 0 {
+            return fmt.Errorf("record with id %d not found in set %s", id, setName)
+        }
+    }
+
+    for _, record := range update {
+        if record.SetName != setName {
+            return fmt.Errorf("record with id %d not found in set %s", record.ID, setName)
+        }
+        record.UpdatedAt = now
+        if err := updateRecord(record); err != nil {
+            return err
+        }
+        if err := checkDuplicate(ctx, tx, d, record); err != nil {
+            return err
+        }
+    }
+
+    for _, record := range add {
+        record.SetName = setName
+        record.CreatedAt = now
+        record.UpdatedAt = now
+        if err := insert(record); err != nil {
+            return err
+        }
+        if err := checkDuplicate(ctx, tx, d, record); err != nil {
+            return err
+        }
+    }
+    return nil
+}
@@ -0,0 +1,1452 @@
+package storage
+
+import (
+    "context"
+    "database/sql"
+    "fmt"
+    "net/netip"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+    "ipset-api-server/internal/config"
+    "ipset-api-server/internal/models"
+
+    _ "modernc.org/sqlite"
+)
+
+// sqliteMigrations - миграции схемы SQLite, каждая выполняется в транзакции
+var sqliteMigrations = []Migration{
+    {
+        Version:     1,
+        Description: "create auth_keys and ipset_records",
+        Statements: []string{
+            `CREATE TABLE IF NOT EXISTS auth_keys (
+                key VARCHAR(255) PRIMARY KEY,
+                created_at DATETIME,
+                expires_at DATETIME,
+                is_active BOOLEAN DEFAULT 1
+            )`,
+            `CREATE TABLE IF NOT EXISTS ipset_records (
+                id INTEGER PRIMARY KEY CHECK (id >= 100000 AND id <= 999999),
+                set_name VARCHAR(255) NOT NULL,
+                ip VARCHAR(45) NOT NULL,
+                cidr VARCHAR(45),
+                port INTEGER,
+                protocol VARCHAR(10),
+                description TEXT,
+                context TEXT NOT NULL,
+                set_type VARCHAR(50),
+                set_options TEXT,
+                created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+                updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+            )`,
+            // Индексы для поиска
+            `CREATE INDEX IF NOT EXISTS idx_ipset_records_set_name ON ipset_records(set_name);
+            CREATE INDEX IF NOT EXISTS idx_ipset_records_ip ON ipset_records(ip);
+            CREATE INDEX IF NOT EXISTS idx_ipset_records_context ON ipset_records(context COLLATE NOCASE);
+            CREATE INDEX IF NOT EXISTS idx_ipset_records_description ON ipset_records(description COLLATE NOCASE);`,
+        },
+    },
+    {
+        Version:     2,
+        Description: "add second_ip to ipset_records",
+        Statements: []string{
+            // Третий компонент записей hash:ip,port,ip и hash:ip,port,net
+            `ALTER TABLE ipset_records ADD COLUMN second_ip VARCHAR(64) NOT NULL DEFAULT ''`,
+        },
+    },
+    {
+        Version:     3,
+        Description: "add address range columns to ipset_records",
+        Statements: []string{
+            // Первый и последний адрес записи в 16-байтовом виде для Lookup,
+            // NULL у записей без IP-адреса. Заполняются при записи.
+            `ALTER TABLE ipset_records ADD COLUMN range_start BLOB`,
+            `ALTER TABLE ipset_records ADD COLUMN range_end BLOB`,
+            `CREATE INDEX IF NOT EXISTS idx_ipset_records_range ON ipset_records(range_start, range_end)`,
+        },
+        Backfill: backfillAddrRanges,
+    },
+    {
+        Version:     4,
+        Description: "create audit_log",
+        Statements: []string{
+            `CREATE TABLE IF NOT EXISTS audit_log (
+                id INTEGER PRIMARY KEY AUTOINCREMENT,
+                created_at DATETIME NOT NULL,
+                actor VARCHAR(64) NOT NULL,
+                request_id VARCHAR(64) NOT NULL DEFAULT '',
+                action VARCHAR(32) NOT NULL,
+                set_name VARCHAR(255) NOT NULL,
+                record_id INTEGER NOT NULL,
+                before_json TEXT,
+                after_json TEXT
+            )`,
+            `CREATE INDEX IF NOT EXISTS idx_audit_log_created_at ON audit_log(created_at);
+            CREATE INDEX IF NOT EXISTS idx_audit_log_record_id ON audit_log(record_id);
+            CREATE INDEX IF NOT EXISTS idx_audit_log_set_name ON audit_log(set_name);
+            CREATE INDEX IF NOT EXISTS idx_audit_log_actor ON audit_log(actor);`,
+        },
+    },
+    {
+        Version:     5,
+        Description: "create ipset_record_history",
+        Statements: []string{
+            `CREATE TABLE IF NOT EXISTS ipset_record_history (
+                record_id INTEGER NOT NULL,
+                revision INTEGER NOT NULL,
+                operation VARCHAR(16) NOT NULL,
+                changed_at DATETIME NOT NULL,
+                set_name VARCHAR(255) NOT NULL,
+                ip VARCHAR(45) NOT NULL,
+                cidr VARCHAR(45),
+                port INTEGER,
+                protocol VARCHAR(10),
+                description TEXT,
+                context TEXT NOT NULL,
+                set_type VARCHAR(50),
+                set_options TEXT,
+                second_ip VARCHAR(64),
+                created_at DATETIME,
+                updated_at DATETIME,
+                PRIMARY KEY (record_id, revision)
+            )`,
+            `CREATE INDEX IF NOT EXISTS idx_ipset_record_history_set_name ON ipset_record_history(set_name)`,
+            historyBackfillSQL,
+            // Время создания и изменения - updated_at, который пишет сервер,
+            // время удаления - текущее, в том же формате, что у драйвера
+            `CREATE TRIGGER IF NOT EXISTS ipset_records_history_insert
+                AFTER INSERT ON ipset_records
+            BEGIN
+                ` + historyInsertSQL("NEW", "'create'", "NEW.updated_at") + `;
+            END`,
+            `CREATE TRIGGER IF NOT EXISTS ipset_records_history_update
+                AFTER UPDATE ON ipset_records
+            BEGIN
+                ` + historyInsertSQL("NEW", "'update'", "NEW.updated_at") + `;
+            END`,
+            `CREATE TRIGGER IF NOT EXISTS ipset_records_history_delete
+                AFTER DELETE ON ipset_records
+            BEGIN
+                ` + historyInsertSQL("OLD", "'delete'", "strftime('%Y-%m-%d %H:%M:%f+00:00', 'now')") + `;
+            END`,
+        },
+    },
+    {
+        Version:     6,
+        Description: "add deleted_at to ipset_records",
+        Statements: []string{
+            // Время переноса в корзину, NULL у действующих записей
+            `ALTER TABLE ipset_records ADD COLUMN deleted_at DATETIME`,
+            `CREATE INDEX IF NOT EXISTS idx_ipset_records_deleted_at ON ipset_records(deleted_at)`,
+            `DROP TRIGGER IF EXISTS ipset_records_history_update`,
+            `CREATE TRIGGER ipset_records_history_update
+                AFTER UPDATE ON ipset_records
+            BEGIN
+                ` + historyInsertSQL("NEW", trashOperationSQL, trashChangedAtSQL) + `;
+            END`,
+            `DROP TRIGGER IF EXISTS ipset_records_history_delete`,
+            `CREATE TRIGGER ipset_records_history_delete
+                AFTER DELETE ON ipset_records
+                WHEN OLD.deleted_at IS NULL
+            BEGIN
+                ` + historyInsertSQL("OLD", "'delete'", "strftime('%Y-%m-%d %H:%M:%f+00:00', 'now')") + `;
+            END`,
+        },
+    },
+    {
+        Version:     7,
+        Description: "add expires_at to ipset_records",
+        Statements: []string{
+            // Время истечения записи, NULL у бессрочных записей
+            `ALTER TABLE ipset_records ADD COLUMN expires_at DATETIME`,
+            `CREATE INDEX IF NOT EXISTS idx_ipset_records_expires_at ON ipset_records(expires_at)`,
+        },
+    },
+    {
+        Version:     8,
+        Description: "add activation window to ipset_records",
+        Statements: []string{
+            // Начало действия записи и расписание, в которое она действует
+            `ALTER TABLE ipset_records ADD COLUMN active_from DATETIME`,
+            `ALTER TABLE ipset_records ADD COLUMN schedule TEXT NOT NULL DEFAULT ''`,
+        },
+    },
+    {
+        Version:     9,
+        Description: "create ipset_sets",
+        Statements: []string{
+            `CREATE TABLE IF NOT EXISTS ipset_sets (
+                name VARCHAR(255) PRIMARY KEY,
+                type VARCHAR(50) NOT NULL,
+                options TEXT NOT NULL DEFAULT '',
+                family VARCHAR(10) NOT NULL DEFAULT 'inet',
+                description TEXT NOT NULL DEFAULT '',
+                owner VARCHAR(255) NOT NULL DEFAULT '',
+                created_at DATETIME NOT NULL,
+                updated_at DATETIME NOT NULL
+            )`,
+            // Сеты записей, созданных до появления ipset_sets
+            setsBackfillSQL,
+        },
+    },
+    {
+        Version:     10,
+        Description: "create ipset_changes",
+        Statements: append([]string{
+            `CREATE TABLE IF NOT EXISTS ipset_changes (
+                revision INTEGER PRIMARY KEY,
+                changed_at DATETIME NOT NULL,
+                kind VARCHAR(8) NOT NULL,
+                operation VARCHAR(16) NOT NULL,
+                set_name VARCHAR(255) NOT NULL,
+                record_id INTEGER NOT NULL DEFAULT 0,
+                ip VARCHAR(45),
+                cidr VARCHAR(45),
+                port INTEGER,
+                protocol VARCHAR(10),
+                second_ip VARCHAR(64),
+                description TEXT,
+                context TEXT,
+                set_type VARCHAR(50),
+                set_options TEXT,
+                family VARCHAR(10),
+                owner VARCHAR(255),
+                created_at DATETIME,
+                updated_at DATETIME,
+                expires_at DATETIME,
+                active_from DATETIME,
+                schedule TEXT
+            )`,
+            `CREATE TABLE IF NOT EXISTS ipset_revision (
+                revision INTEGER NOT NULL
+            )`,
+        }, append(changesBackfillSQL, sqliteChangeTriggers()...)...),
+    },
+    {
+        Version:     11,
+        Description: "create webhooks",
+        Statements: []string{
+            `CREATE TABLE IF NOT EXISTS webhooks (
+                id INTEGER PRIMARY KEY AUTOINCREMENT,
+                url TEXT NOT NULL,
+                secret VARCHAR(255) NOT NULL,
+                events VARCHAR(255) NOT NULL,
+                set_names TEXT NOT NULL,
+                description TEXT,
+                active BOOLEAN NOT NULL,
+                created_at DATETIME NOT NULL,
+                updated_at DATETIME NOT NULL
+            )`,
+            `CREATE TABLE IF NOT EXISTS webhook_deliveries (
+                id INTEGER PRIMARY KEY AUTOINCREMENT,
+                webhook_id INTEGER NOT NULL,
+                revision INTEGER NOT NULL,
+                event VARCHAR(32) NOT NULL,
+                payload TEXT NOT NULL,
+                status VARCHAR(16) NOT NULL,
+                attempts INTEGER NOT NULL,
+                next_attempt_at DATETIME NOT NULL,
+                last_status INTEGER NOT NULL,
+                last_error VARCHAR(1024) NOT NULL,
+                created_at DATETIME NOT NULL,
+                updated_at DATETIME NOT NULL
+            )`,
+            `CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries(status, next_attempt_at);
+            CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook_id ON webhook_deliveries(webhook_id);`,
+            // Номер последнего изменения, по которому созданы доставки
+            `CREATE TABLE IF NOT EXISTS webhook_cursor (
+                revision INTEGER NOT NULL
+            )`,
+        },
+    },
+    {
+        Version:     12,
+        Description: "create agents",
+        Statements: []string{
+            `CREATE TABLE IF NOT EXISTS agents (
+                hostname VARCHAR(255) PRIMARY KEY,
+                labels TEXT NOT NULL,
+                sets TEXT NOT NULL,
+                last_error TEXT,
+                registered_at DATETIME NOT NULL,
+                last_seen_at DATETIME NOT NULL
+            )`,
+            `CREATE TABLE IF NOT EXISTS agent_assignments (
+                id INTEGER PRIMARY KEY AUTOINCREMENT,
+                selector TEXT NOT NULL,
+                sets TEXT NOT NULL,
+                description TEXT,
+                created_at DATETIME NOT NULL,
+                updated_at DATETIME NOT NULL
+            )`,
+        },
+    },
+}
+
+// sqliteChangeTriggers - триггеры, которые пишут ipset_changes
+func sqliteChangeTriggers() []string {
+    var statements []string
+    for _, t := range []struct {
+        table string
+        write func(event, now string) string
+    }{
+        {"ipset_records", recordChangesSQL},
+        {"ipset_sets", setChangesSQL},
+    } {
+        for _, event := range []string{"INSERT", "UPDATE", "DELETE"} {
+            statements = append(statements, fmt.Sprintf(`CREATE TRIGGER IF NOT EXISTS %[1]s_changes_%[2]s
+                AFTER %[3]s ON %[1]s
+            BEGIN
+                %[4]s;
+            END`, t.table, strings.ToLower(event), event, t.write(event, sqliteDialect.now)))
+        }
+    }
+    return statements
+}
+
+func newSQLiteMigrator(db *sql.DB) *sqlMigrator {
+    return &sqlMigrator{
+        db:         db,
+        name:       "sqlite",
+        list:       sqliteMigrations,
+        insertStmt: "INSERT INTO schema_version (version, description, applied_at) VALUES (?, ?, ?)",
+    }
+}
+
+func openSQLite(path string) (*sql.DB, error) {
+    if dir := filepath.Dir(path); dir != "" {
+        if err := os.MkdirAll(dir, 0755); err != nil {
+            return nil, err
+        }
+    }
+
+    // WAL позволяет читать во время записи, busy_timeout - дождаться блокировки
+    // вместо немедленной ошибки, а _txlock=immediate берет блокировку на запись
+    // в начале транзакции, чтобы read-modify-write не упирался в SQLITE_BUSY.
+    // _time_format=sqlite пишет время в формате, который сортируется как строка
+    dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)&_txlock=immediate&_time_format=sqlite", path)
+
+    db, err := sql.Open("sqlite", dsn)
+    if err != nil {
+        return nil, fmt.Errorf("failed to open sqlite database: %v", err)
+    }
+
+    if err := db.Ping(); err != nil {
+        return nil, fmt.Errorf("failed to ping sqlite: %v", err)
+    }
+
+    return db, nil
+}
+
+// SQLiteKeyStorage - реализация для хранения ключей в SQLite
+type SQLiteKeyStorage struct {
+    db           *sql.DB
+    queryTimeout time.Duration
+}
+
+func NewSQLiteKeyStorage(cfg *config.Config) (*SQLiteKeyStorage, error) {
+    db, err := openSQLite(cfg.SQLitePath)
+    if err != nil {
+        return nil, err
+    }
+
+    if err := ensureSchema(newSQLiteMigrator(db), cfg.AutoMigrate); err != nil {
+        return nil, err
+    }
+
+    return &SQLiteKeyStorage{db: db, queryTimeout: cfg.DBQueryTimeout}, nil
+}
+
+func (s *SQLiteKeyStorage) GetKey(ctx context.Context, key string) (*models.AuthKey, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    var authKey models.AuthKey
+    err := s.db.QueryRowContext(ctx,
+        "SELECT key, created_at, expires_at, is_active FROM auth_keys WHERE key = ?",
+        key,
+    ).Scan(&authKey.Key, &authKey.CreatedAt, &authKey.ExpiresAt, &authKey.IsActive)
+
+    if err == sql.ErrNoRows {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, fmt.Errorf("failed to get key: %v", err)
+    }
+
+    return &authKey, nil
+}
+
+func (s *SQLiteKeyStorage) SaveKey(ctx context.Context, key *models.AuthKey) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    _, err := s.db.ExecContext(ctx,
+        `INSERT INTO auth_keys (key, created_at, expires_at, is_active)
+         VALUES (?, ?, ?, ?)
+         ON CONFLICT (key) DO UPDATE
+         SET created_at = excluded.created_at, expires_at = excluded.expires_at, is_active = excluded.is_active`,
+        key.Key, key.CreatedAt.UTC(), key.ExpiresAt.UTC(), key.IsActive,
+    )
+    if err != nil {
+        return fmt.Errorf("failed to save key: %v", err)
+    }
+    return nil
+}
+
+func (s *SQLiteKeyStorage) DeleteKey(ctx context.Context, key string) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    _, err := s.db.ExecContext(ctx, "DELETE FROM auth_keys WHERE key = ?", key)
+    if err != nil {
+        return fmt.Errorf("failed to delete key: %v", err)
+    }
+    return nil
+}
+
+func (s *SQLiteKeyStorage) ListKeys(ctx context.Context) ([]*models.AuthKey, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    rows, err := s.db.QueryContext(ctx, "SELECT key, created_at, expires_at, is_active FROM auth_keys ORDER BY created_at DESC")
+    if err != nil {
+        return nil, fmt.Errorf("failed to list keys: %v", err)
+    }
+    defer rows.Close()
+
+    var keys []*models.AuthKey
+    for rows.Next() {
+        var key models.AuthKey
+        if err := rows.Scan(&key.Key, &key.CreatedAt, &key.ExpiresAt, &key.IsActive); err != nil {
+            return nil, fmt.Errorf("failed to scan key: %v", err)
+        }
+        keys = append(keys, &key)
+    }
+
+    return keys, nil
+}
+
+// SQLiteIPSetStorage - реализация для хранения ipset записей во встроенной SQLite.
+// Схема, индексы и семантика поиска повторяют PostgreSQLIPSetStorage.
+// Время хранится в UTC, чтобы строковое сравнение совпадало с хронологическим.
+type SQLiteIPSetStorage struct {
+    db           *sql.DB
+    queryTimeout time.Duration
+}
+
+func NewSQLiteIPSetStorage(cfg *config.Config) (*SQLiteIPSetStorage, error) {
+    db, err := openSQLite(cfg.SQLitePath)
+    if err != nil {
+        return nil, err
+    }
+
+    if err := ensureSchema(newSQLiteMigrator(db), cfg.AutoMigrate); err != nil {
+        return nil, err
+    }
+
+    return &SQLiteIPSetStorage{db: db, queryTimeout: cfg.DBQueryTimeout}, nil
+}
+
+// getNextID ищет первый свободный ID в диапазоне 100000-999999 внутри транзакции
+func (s *SQLiteIPSetStorage) getNextID(ctx context.Context, tx *sql.Tx) (int, error) {
+    var id sql.NullInt64
+    err := tx.QueryRowContext(ctx, `
+        SELECT CASE
+            WHEN NOT EXISTS (SELECT 1 FROM ipset_records WHERE id = 100000) THEN 100000
+            -- Без пропусков следующий ID - за наибольшим; поиск пропуска
+            -- перебирает все записи и заметно медленнее
+            WHEN (SELECT COUNT(*) FROM ipset_records) = (SELECT MAX(id) FROM ipset_records) - 99999
+                THEN (SELECT NULLIF(MAX(id) + 1, 1000000) FROM ipset_records)
+            ELSE (
+                SELECT MIN(t1.id + 1)
+                FROM ipset_records t1
+                WHERE t1.id + 1 <= 999999
+                  AND NOT EXISTS (SELECT 1 FROM ipset_records t2 WHERE t2.id = t1.id + 1)
+            )
+        END
+    `).Scan(&id)
+    if err != nil {
+        return 0, fmt.Errorf("failed to get next ID: %v", err)
+    }
+
+    if !id.Valid {
+        return 0, fmt.Errorf("no available IDs in range 100000-999999")
+    }
+
+    return int(id.Int64), nil
+}
+
+func (s *SQLiteIPSetStorage) Create(ctx context.Context, record *models.IPSetRecord) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback()
+
+    now := time.Now().UTC()
+    record.CreatedAt = now
+    record.UpdatedAt = now
+
+    if err := s.ensureSet(ctx, tx, record); err != nil {
+        return err
+    }
+
+    if err := s.insertNewRecord(ctx, tx, record); err != nil {
+        return err
+    }
+    if err := checkDuplicate(ctx, tx, sqliteDialect, record); err != nil {
+        return err
+    }
+
+    if err := tx.Commit(); err != nil {
+        return fmt.Errorf("failed to commit transaction: %v", err)
+    }
+
+    return nil
+}
+
+func (s *SQLiteIPSetStorage) ImportRecord(ctx context.Context, record *models.IPSetRecord) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback()
+
+    // Удаляем и вставляем заново, чтобы триггер не перезаписал updated_at
+    if _, err := tx.ExecContext(ctx, "DELETE FROM ipset_records WHERE id = ?", record.ID); err != nil {
+        return fmt.Errorf("failed to import record %d: %v", record.ID, err)
+    }
+
+    if err := s.ensureSet(ctx, tx, record); err != nil {
+        return err
+    }
+
+    rangeStart, rangeEnd := addrRangeValues(record.IP, record.CIDR)
+    _, err = tx.ExecContext(ctx, `
+        INSERT INTO ipset_records 
+        (id, set_name, ip, cidr, port, protocol, description, context, set_type, set_options, second_ip,
+         range_start, range_end, created_at, updated_at, expires_at, active_from, schedule)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+    `,
+        record.ID, record.SetName, record.IP, record.CIDR, record.Port, record.Protocol,
+        record.Description, record.Context, record.SetType, record.SetOptions, record.SecondIP,
+        rangeStart, rangeEnd, record.CreatedAt.UTC(), record.UpdatedAt.UTC(), nullTimeValue(record.ExpiresAt), nullTimeValue(record.ActiveFrom), record.Schedule,
+    )
+    if err != nil {
+        return fmt.Errorf("failed to import record %d: %v", record.ID, err)
+    }
+    if err := checkDuplicate(ctx, tx, sqliteDialect, record); err != nil {
+        return err
+    }
+
+    if err := tx.Commit(); err != nil {
+        return fmt.Errorf("failed to commit transaction: %v", err)
+    }
+
+    return nil
+}
+
+func (s *SQLiteIPSetStorage) queryRecords(ctx context.Context, query string, args ...interface{}) ([]*models.IPSetRecord, error) {
+    rows, err := s.db.QueryContext(ctx, query, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var records []*models.IPSetRecord
+    for rows.Next() {
+        var record models.IPSetRecord
+        var cidr, protocol, description, setType, setOptions, secondIP sql.NullString
+        var port sql.NullInt64
+        if err := rows.Scan(
+            &record.ID, &record.SetName, &record.IP, &cidr, &port, &protocol,
+            &description, &record.Context, &setType, &setOptions, &secondIP,
+            &record.CreatedAt, &record.UpdatedAt, &record.ExpiresAt, &record.ActiveFrom, &record.Schedule,
+        ); err != nil {
+            return nil, fmt.Errorf("failed to scan record: %v", err)
+        }
+        record.CIDR = cidr.String
+        record.Port = int(port.Int64)
+        record.Protocol = protocol.String
+        record.Description = description.String
+        record.SetType = setType.String
+        record.SetOptions = setOptions.String
+        record.SecondIP = secondIP.String
+        records = append(records, &record)
+    }
+
+    return records, rows.Err()
+}
+
+func (s *SQLiteIPSetStorage) GetByID(ctx context.Context, id int) (*models.IPSetRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    records, err := s.queryRecords(ctx, `
+        SELECT id, set_name, ip, cidr, port, protocol, description, context,
+               set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule
+        FROM ipset_records
+        WHERE id = ? AND `+activeRecordSQL(sqliteDialect)+`
+    `, id)
+    if err != nil {
+        return nil, fmt.Errorf("failed to get record: %v", err)
+    }
+
+    if len(records) == 0 {
+        return nil, fmt.Errorf("record with id %d not found", id)
+    }
+
+    return records[0], nil
+}
+
+func (s *SQLiteIPSetStorage) GetAll(ctx context.Context) ([]*models.IPSetRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    records, err := s.queryRecords(ctx, `
+        SELECT id, set_name, ip, cidr, port, protocol, description, context,
+               set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule
+        FROM ipset_records
+        WHERE `+activeRecordSQL(sqliteDialect)+`
+        ORDER BY id
+    `)
+    if err != nil {
+        return nil, fmt.Errorf("failed to get all records: %v", err)
+    }
+
+    return records, nil
+}
+
+func (s *SQLiteIPSetStorage) GetBySetName(ctx context.Context, setName string) ([]*models.IPSetRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    records, err := s.queryRecords(ctx, `
+        SELECT id, set_name, ip, cidr, port, protocol, description, context,
+               set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule
+        FROM ipset_records
+        WHERE set_name = ? AND `+activeRecordSQL(sqliteDialect)+`
+        ORDER BY id
+    `, setName)
+    if err != nil {
+        return nil, fmt.Errorf("failed to get records by set name: %v", err)
+    }
+
+    if len(records) == 0 {
+        return nil, fmt.Errorf("set %s not found", setName)
+    }
+
+    return records, nil
+}
+
+func (s *SQLiteIPSetStorage) GetAllSets(ctx context.Context) ([]*models.IPSetSet, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    rows, err := s.db.QueryContext(ctx, setSelectSQL(sqliteDialect)+" ORDER BY name")
+    if err != nil {
+        return nil, fmt.Errorf("failed to get all sets: %v", err)
+    }
+    defer rows.Close()
+
+    return scanSets(rows)
+}
+
+// ensureSet заводит сет записи, если его еще нет
+func (s *SQLiteIPSetStorage) ensureSet(ctx context.Context, db sqlExecer, record *models.IPSetRecord) error {
+    return s.createSetIfMissing(ctx, db, recordSet(record, time.Now().UTC()))
+}
+
+// createSetIfMissing заводит сет, если сета с таким именем еще нет
+func (s *SQLiteIPSetStorage) createSetIfMissing(ctx context.Context, db sqlExecer, set *models.IPSetSet) error {
+    _, err := db.ExecContext(ctx, insertSetSQL(sqliteDialect)+" ON CONFLICT (name) DO NOTHING", setValues(set)...)
+    if err != nil {
+        return fmt.Errorf("failed to create set %s: %v", set.Name, err)
+    }
+    return nil
+}
+
+func (s *SQLiteIPSetStorage) CreateSet(ctx context.Context, set *models.IPSetSet) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    now := time.Now().UTC()
+    set.CreatedAt = now
+    set.UpdatedAt = now
+
+    if _, err := s.db.ExecContext(ctx, insertSetSQL(sqliteDialect), setValues(set)...); err != nil {
+        return fmt.Errorf("failed to create set: %v", err)
+    }
+
+    return nil
+}
+
+func (s *SQLiteIPSetStorage) ImportSet(ctx context.Context, set *models.IPSetSet) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    _, err := s.db.ExecContext(ctx, insertSetSQL(sqliteDialect)+`
+        ON CONFLICT (name) DO UPDATE SET
+            type = excluded.type, options = excluded.options, family = excluded.family,
+            description = excluded.description, owner = excluded.owner,
+            created_at = excluded.created_at, updated_at = excluded.updated_at
+    `, setValues(set)...)
+    if err != nil {
+        return fmt.Errorf("failed to import set %s: %v", set.Name, err)
+    }
+
+    return nil
+}
+
+func (s *SQLiteIPSetStorage) GetSet(ctx context.Context, name string) (*models.IPSetSet, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    rows, err := s.db.QueryContext(ctx, setSelectSQL(sqliteDialect)+" WHERE name = ?", name)
+    if err != nil {
+        return nil, fmt.Errorf("failed to get set: %v", err)
+    }
+    defer rows.Close()
+
+    sets, err := scanSets(rows)
+    if err != nil {
+        return nil, err
+    }
+
+    if len(sets) == 0 {
+        return nil, fmt.Errorf("set %s not found", name)
+    }
+
+    return sets[0], nil
+}
+
+func (s *SQLiteIPSetStorage) UpdateSet(ctx context.Context, set *models.IPSetSet) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    set.UpdatedAt = time.Now().UTC()
+    result, err := s.db.ExecContext(ctx, updateSetSQL(sqliteDialect), setUpdateValues(set)...)
+    if err != nil {
+        return fmt.Errorf("failed to update set: %v", err)
+    }
+
+    rowsAffected, err := result.RowsAffected()
+    if err != nil {
+        return fmt.Errorf("failed to get rows affected: %v", err)
+    }
+
+    if rowsAffected == 0 {
+        return fmt.Errorf("set %s not found", set.Name)
+    }
+
+    return nil
+}
+
+// insertNewRecord выдает записи новый ID и вставляет ее в транзакции tx
+func (s *SQLiteIPSetStorage) insertNewRecord(ctx context.Context, tx *sql.Tx, record *models.IPSetRecord) error {
+    id, err := s.getNextID(ctx, tx)
+    if err != nil {
+        return err
+    }
+    record.ID = id
+
+    rangeStart, rangeEnd := addrRangeValues(record.IP, record.CIDR)
+    _, err = tx.ExecContext(ctx, `
+        INSERT INTO ipset_records
+        (id, set_name, ip, cidr, port, protocol, description, context, set_type, set_options, second_ip,
+         range_start, range_end, created_at, updated_at, expires_at, active_from, schedule)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+    `,
+        record.ID, record.SetName, record.IP, record.CIDR, record.Port, record.Protocol,
+        record.Description, record.Context, record.SetType, record.SetOptions, record.SecondIP,
+        rangeStart, rangeEnd, record.CreatedAt, record.UpdatedAt, nullTimeValue(record.ExpiresAt), nullTimeValue(record.ActiveFrom), record.Schedule,
+    )
+    if err != nil {
+        return fmt.Errorf("failed to create record: %v", err)
+    }
+    return nil
+}
+
+func (s *SQLiteIPSetStorage) RenameSet(ctx context.Context, from, to string) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback()
+
+    if err := renameSetTx(ctx, tx, sqliteDialect, from, to); err != nil {
+        return err
+    }
+
+    if err := tx.Commit(); err != nil {
+        return fmt.Errorf("failed to commit transaction: %v", err)
+    }
+
+    return nil
+}
+
+func (s *SQLiteIPSetStorage) CopySet(ctx context.Context, from, to string) ([]*models.IPSetRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return nil, fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback()
+
+    records, err := copySetTx(ctx, tx, sqliteDialect, from, to, func(record *models.IPSetRecord) error {
+        return s.insertNewRecord(ctx, tx, record)
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    if err := tx.Commit(); err != nil {
+        return nil, fmt.Errorf("failed to commit transaction: %v", err)
+    }
+
+    return records, nil
+}
+
+func (s *SQLiteIPSetStorage) SwapSets(ctx context.Context, a, b string) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback()
+
+    if err := swapSetsTx(ctx, tx, sqliteDialect, a, b); err != nil {
+        return err
+    }
+
+    if err := tx.Commit(); err != nil {
+        return fmt.Errorf("failed to commit transaction: %v", err)
+    }
+
+    return nil
+}
+
+func (s *SQLiteIPSetStorage) ApplySetChanges(ctx context.Context, setName string, revision int64, set *models.IPSetSet, remove []int, update, add []*models.IPSetRecord) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback()
+
+    if err := checkSetRevision(ctx, tx, sqliteDialect, setName, revision); err != nil {
+        return err
+    }
+
+    if set != nil {
+        err := saveSetTx(ctx, tx, sqliteDialect, set, func(set *models.IPSetSet) error {
+            return s.createSetIfMissing(ctx, tx, set)
+        })
+        if err != nil {
+            return err
+        }
+    }
+
+    err = applySetChangesTx(ctx, tx, sqliteDialect, setName, remove, update, add, func(record *models.IPSetRecord) error {
+        return s.updateRecord(ctx, tx, record.ID, record)
+    }, func(record *models.IPSetRecord) error {
+        return s.insertNewRecord(ctx, tx, record)
+    })
+    if err != nil {
+        return err
+    }
+
+    if err := tx.Commit(); err != nil {
+        return fmt.Errorf("failed to commit transaction: %v", err)
+    }
+
+    return nil
+}
+
+func (s *SQLiteIPSetStorage) ApplyChanges(ctx context.Context, changes []*RecordChange) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback()
+
+    err = applyChangesTx(ctx, tx, sqliteDialect, changes, func(record *models.IPSetRecord) error {
+        return s.ensureSet(ctx, tx, record)
+    }, func(record *models.IPSetRecord) error {
+        return s.updateRecord(ctx, tx, record.ID, record)
+    }, func(record *models.IPSetRecord) error {
+        return s.insertNewRecord(ctx, tx, record)
+    })
+    if err != nil {
+        return err
+    }
+
+    if err := tx.Commit(); err != nil {
+        return fmt.Errorf("failed to commit transaction: %v", err)
+    }
+
+    return nil
+}
+
+func (s *SQLiteIPSetStorage) Update(ctx context.Context, id int, record *models.IPSetRecord) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback()
+
+    record.ID = id
+    record.UpdatedAt = time.Now().UTC()
+
+    // Запись могла перейти в новый сет
+    if err := s.ensureSet(ctx, tx, record); err != nil {
+        return err
+    }
+
+    if err := s.updateRecord(ctx, tx, id, record); err != nil {
+        return err
+    }
+    if err := checkDuplicate(ctx, tx, sqliteDialect, record); err != nil {
+        return err
+    }
+
+    if err := tx.Commit(); err != nil {
+        return fmt.Errorf("failed to commit transaction: %v", err)
+    }
+
+    return nil
+}
+
+// updateRecord перезаписывает действующую запись в транзакции tx
+func (s *SQLiteIPSetStorage) updateRecord(ctx context.Context, tx *sql.Tx, id int, record *models.IPSetRecord) error {
+    rangeStart, rangeEnd := addrRangeValues(record.IP, record.CIDR)
+
+    result, err := tx.ExecContext(ctx, `
+        UPDATE ipset_records
+        SET set_name = ?, ip = ?, cidr = ?, port = ?, protocol = ?,
+            description = ?, context = ?, set_type = ?, set_options = ?, second_ip = ?,
+            range_start = ?, range_end = ?, updated_at = ?, expires_at = ?,
+            active_from = ?, schedule = ?
+        WHERE id = ? AND `+activeRecordSQL(sqliteDialect)+`
+    `,
+        record.SetName, record.IP, record.CIDR, record.Port, record.Protocol,
+        record.Description, record.Context, record.SetType, record.SetOptions, record.SecondIP,
+        rangeStart, rangeEnd, record.UpdatedAt, nullTimeValue(record.ExpiresAt), nullTimeValue(record.ActiveFrom), record.Schedule, id,
+    )
+
+    if err != nil {
+        return fmt.Errorf("failed to update record: %v", err)
+    }
+
+    rowsAffected, err := result.RowsAffected()
+    if err != nil {
+        return fmt.Errorf("failed to get rows affected: %v", err)
+    }
+
+    if rowsAffected == 0 {
+        return fmt.Errorf("record with id %d not found", id)
+    }
+
+    return nil
+}
+
+func (s *SQLiteIPSetStorage) Delete(ctx context.Context, id int) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    result, err := s.db.ExecContext(ctx,
+        "UPDATE ipset_records SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL",
+        time.Now().UTC(), id,
+    )
+    if err != nil {
+        return fmt.Errorf("failed to delete record: %v", err)
+    }
+
+    rowsAffected, err := result.RowsAffected()
+    if err != nil {
+        return fmt.Errorf("failed to get rows affected: %v", err)
+    }
+
+    if rowsAffected == 0 {
+        return fmt.Errorf("record with id %d not found", id)
+    }
+
+    return nil
+}
+
+func (s *SQLiteIPSetStorage) DeleteSet(ctx context.Context, setName string) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback()
+
+    result, err := tx.ExecContext(ctx,
+        "UPDATE ipset_records SET deleted_at = ? WHERE set_name = ? AND deleted_at IS NULL",
+        time.Now().UTC(), setName,
+    )
+    if err != nil {
+        return fmt.Errorf("failed to delete set: %v", err)
+    }
+    deletedRecords, err := result.RowsAffected()
+    if err != nil {
+        return fmt.Errorf("failed to get rows affected: %v", err)
+    }
+
+    result, err = tx.ExecContext(ctx, "DELETE FROM ipset_sets WHERE name = ?", setName)
+    if err != nil {
+        return fmt.Errorf("failed to delete set: %v", err)
+    }
+    deletedSets, err := result.RowsAffected()
+    if err != nil {
+        return fmt.Errorf("failed to get rows affected: %v", err)
+    }
+
+    if deletedRecords == 0 && deletedSets == 0 {
+        return fmt.Errorf("set %s not found", setName)
+    }
+
+    if err := tx.Commit(); err != nil {
+        return fmt.Errorf("failed to commit transaction: %v", err)
+    }
+
+    return nil
+}
+
+func (s *SQLiteIPSetStorage) Search(ctx context.Context, query string) ([]*models.IPSetRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    // LIKE в SQLite регистронезависим для ASCII, что соответствует ILIKE в PostgreSQL
+    records, err := s.queryRecords(ctx, `
+        SELECT id, set_name, ip, cidr, port, protocol, description, context,
+               set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule
+        FROM ipset_records
+        WHERE `+activeRecordSQL(sqliteDialect)+` AND (
+            context LIKE '%' || ?1 || '%'
+            OR description LIKE '%' || ?1 || '%'
+            OR ip LIKE '%' || ?1 || '%'
+            OR set_name LIKE '%' || ?1 || '%'
+        )
+        ORDER BY
+            CASE
+                WHEN set_name = ?1 THEN 1
+                WHEN ip = ?1 THEN 2
+                WHEN context LIKE ?1 THEN 3
+                WHEN description LIKE ?1 THEN 4
+                ELSE 5
+            END,
+            id
+    `, query)
+
+    if err != nil {
+        return nil, fmt.Errorf("failed to search records: %v", err)
+    }
+
+    return records, nil
+}
+
+// Lookup сравнивает границы префикса с range_start/range_end побайтно
+func (s *SQLiteIPSetStorage) Lookup(ctx context.Context, prefix netip.Prefix) ([]*models.IPSetRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    start, end := lookupRangeArgs(prefix)
+    records, err := s.queryRecords(ctx, `
+        SELECT id, set_name, ip, cidr, port, protocol, description, context,
+               set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule
+        FROM ipset_records
+        WHERE `+activeRecordSQL(sqliteDialect)+` AND range_start <= ? AND range_end >= ?
+        ORDER BY set_name, id
+    `, end, start)
+    if err != nil {
+        return nil, fmt.Errorf("failed to lookup records: %v", err)
+    }
+
+    return records, nil
+}
+
+func (s *SQLiteIPSetStorage) List(ctx context.Context, q *models.RecordQuery) (*models.RecordPage, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    tail, args, err := buildRecordListSQL(q, sqliteDialect, activeRecordSQL(sqliteDialect))
+    if err != nil {
+        return nil, err
+    }
+
+    records, err := s.queryRecords(ctx, `
+        SELECT id, set_name, ip, cidr, port, protocol, description, context,
+               set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule
+        FROM ipset_records
+    `+tail, args...)
+    if err != nil {
+        return nil, fmt.Errorf("failed to list records: %v", err)
+    }
+
+    return recordPage(records, q), nil
+}
+
+func (s *SQLiteIPSetStorage) ListSets(ctx context.Context, q *models.SetQuery) (*models.SetPage, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    where, tail, args, err := buildSetListSQL(q, sqliteDialect)
+    if err != nil {
+        return nil, err
+    }
+
+    rows, err := s.db.QueryContext(ctx, setSelectSQL(sqliteDialect)+" "+where+" "+tail, args...)
+    if err != nil {
+        return nil, fmt.Errorf("failed to list sets: %v", err)
+    }
+    defer rows.Close()
+
+    sets, err := scanSets(rows)
+    if err != nil {
+        return nil, err
+    }
+
+    return setPage(sets, q), nil
+}
+
+func (s *SQLiteIPSetStorage) History(ctx context.Context, id int) ([]*models.RecordRevision, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    rows, err := s.db.QueryContext(ctx, recordHistorySQL(sqliteDialect), id)
+    if err != nil {
+        return nil, fmt.Errorf("failed to get record history: %v", err)
+    }
+    defer rows.Close()
+
+    return scanRevisions(rows)
+}
+
+func (s *SQLiteIPSetStorage) GetBySetNameAt(ctx context.Context, setName string, at time.Time) ([]*models.IPSetRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    rows, err := s.db.QueryContext(ctx, setAtSQL(sqliteDialect), setName, at.UTC())
+    if err != nil {
+        return nil, fmt.Errorf("failed to get set history: %v", err)
+    }
+    defer rows.Close()
+
+    return scanHistoryRecords(rows)
+}
+
+func (s *SQLiteIPSetStorage) Revision(ctx context.Context) (int64, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    var revision int64
+    if err := s.db.QueryRowContext(ctx, revisionSQL).Scan(&revision); err != nil {
+        return 0, fmt.Errorf("failed to get revision: %v", err)
+    }
+    return revision, nil
+}
+
+func (s *SQLiteIPSetStorage) Changes(ctx context.Context, since int64, limit int) ([]*models.ChangeEvent, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    rows, err := s.db.QueryContext(ctx, changesSQL(sqliteDialect), since, limit)
+    if err != nil {
+        return nil, fmt.Errorf("failed to get changes: %v", err)
+    }
+    defer rows.Close()
+
+    return scanChanges(rows)
+}
+
+func (s *SQLiteIPSetStorage) ListTrash(ctx context.Context, q *models.RecordQuery) (*models.RecordPage, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    tail, args, err := buildRecordListSQL(q, sqliteDialect, "deleted_at IS NOT NULL")
+    if err != nil {
+        return nil, err
+    }
+
+    rows, err := s.db.QueryContext(ctx, "SELECT "+trashColumns+" FROM ipset_records "+tail, args...)
+    if err != nil {
+        return nil, fmt.Errorf("failed to list trash: %v", err)
+    }
+    defer rows.Close()
+
+    records, err := scanTrash(rows)
+    if err != nil {
+        return nil, err
+    }
+
+    return recordPage(records, q), nil
+}
+
+func (s *SQLiteIPSetStorage) Undelete(ctx context.Context, id int) (*models.IPSetRecord, error) {
+    records, err := s.undelete(ctx, "id", id)
+    if err != nil {
+        return nil, err
+    }
+
+    if len(records) == 0 {
+        return nil, fmt.Errorf("record with id %d not found in trash", id)
+    }
+
+    return records[0], nil
+}
+
+func (s *SQLiteIPSetStorage) UndeleteSet(ctx context.Context, setName string) ([]*models.IPSetRecord, error) {
+    records, err := s.undelete(ctx, "set_name", setName)
+    if err != nil {
+        return nil, err
+    }
+
+    if len(records) == 0 {
+        return nil, fmt.Errorf("set %s not found in trash", setName)
+    }
+
+    return records, nil
+}
+
+// undelete возвращает из корзины записи с заданным значением колонки и
+// отдает их в том виде, в каком они стали после восстановления
+func (s *SQLiteIPSetStorage) undelete(ctx context.Context, column string, value interface{}) ([]*models.IPSetRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return nil, fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback()
+
+    rows, err := tx.QueryContext(ctx,
+        "SELECT "+trashColumns+" FROM ipset_records WHERE deleted_at IS NOT NULL AND "+column+" = ? ORDER BY id", value)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read trash: %v", err)
+    }
+    records, err := scanTrash(rows)
+    rows.Close()
+    if err != nil {
+        return nil, err
+    }
+
+    now := time.Now().UTC()
+    _, err = tx.ExecContext(ctx,
+        "UPDATE ipset_records SET deleted_at = NULL, updated_at = ? WHERE deleted_at IS NOT NULL AND "+column+" = ?", now, value)
+    if err != nil {
+        return nil, fmt.Errorf("failed to restore records: %v", err)
+    }
+    for _, record := range records {
+        if err := s.ensureSet(ctx, tx, record); err != nil {
+            return nil, err
+        }
+        // Пока запись была в корзине, в сет могли добавить тот же элемент
+        if err := checkDuplicate(ctx, tx, sqliteDialect, record); err != nil {
+            return nil, err
+        }
+    }
+
+    if err := tx.Commit(); err != nil {
+        return nil, fmt.Errorf("failed to commit transaction: %v", err)
+    }
+
+    return restoredRecords(records, now), nil
+}
+
+func (s *SQLiteIPSetStorage) PurgeTrash(ctx context.Context, before time.Time) (int, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    result, err := s.db.ExecContext(ctx,
+        "DELETE FROM ipset_records WHERE deleted_at IS NOT NULL AND deleted_at < ?", before.UTC())
+    if err != nil {
+        return 0, fmt.Errorf("failed to purge trash: %v", err)
+    }
+
+    purged, err := result.RowsAffected()
+    if err != nil {
+        return 0, fmt.Errorf("failed to get rows affected: %v", err)
+    }
+
+    return int(purged), nil
+}
+
+func (s *SQLiteIPSetStorage) CountExpired(ctx context.Context, at time.Time) (int, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    var count int
+    err := s.db.QueryRowContext(ctx,
+        "SELECT COUNT(*) FROM ipset_records WHERE deleted_at IS NULL AND expires_at <= ?", at.UTC()).Scan(&count)
+    if err != nil {
+        return 0, fmt.Errorf("failed to count expired records: %v", err)
+    }
+
+    return count, nil
+}
+
+func (s *SQLiteIPSetStorage) DeleteExpired(ctx context.Context, at time.Time) ([]*models.IPSetRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return nil, fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback()
+
+    // Истекшие записи удаляются мимо корзины, триггер истории записывает удаление
+    rows, err := tx.QueryContext(ctx,
+        "SELECT "+trashColumns+" FROM ipset_records WHERE deleted_at IS NULL AND expires_at <= ? ORDER BY id", at.UTC())
+    if err != nil {
+        return nil, fmt.Errorf("failed to read expired records: %v", err)
+    }
+    records, err := scanTrash(rows)
+    rows.Close()
+    if err != nil {
+        return nil, err
+    }
+
+    if len(records) == 0 {
+        return nil, nil
+    }
+
+    _, err = tx.ExecContext(ctx,
+        "DELETE FROM ipset_records WHERE deleted_at IS NULL AND expires_at <= ?", at.UTC())
+    if err != nil {
+        return nil, fmt.Errorf("failed to delete expired records: %v", err)
+    }
+
+    if err := tx.Commit(); err != nil {
+        return nil, fmt.Errorf("failed to commit transaction: %v", err)
+    }
+
+    return records, nil
+}
+
+// SQLiteAuditStorage - журнал аудита в таблице audit_log
+type SQLiteAuditStorage struct {
+    db           *sql.DB
+    queryTimeout time.Duration
+}
+
+func NewSQLiteAuditStorage(cfg *config.Config) (*SQLiteAuditStorage, error) {
+    db, err := openSQLite(cfg.SQLitePath)
+    if err != nil {
+        return nil, err
+    }
+
+    if err := ensureSchema(newSQLiteMigrator(db), cfg.AutoMigrate); err != nil {
+        return nil, err
+    }
+
+    return &SQLiteAuditStorage{db: db, queryTimeout: cfg.DBQueryTimeout}, nil
+}
+
+func (s *SQLiteAuditStorage) Append(ctx context.Context, event *models.AuditEvent) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    result, err := s.db.ExecContext(ctx, `
+        INSERT INTO audit_log
+        (created_at, actor, request_id, action, set_name, record_id, before_json, after_json)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+    `,
+        event.Timestamp.UTC(), event.Actor, event.RequestID, event.Action, event.SetName, event.RecordID,
+        auditJSON(event.Before), auditJSON(event.After),
+    )
+    if err != nil {
+        return fmt.Errorf("failed to append audit event: %v", err)
+    }
+
+    event.ID, err = result.LastInsertId()
+    if err != nil {
+        return fmt.Errorf("failed to get audit event id: %v", err)
+    }
+    return nil
+}
+
+func (s *SQLiteAuditStorage) List(ctx context.Context, q *models.AuditQuery) (*models.AuditPage, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    tail, args, err := buildAuditListSQL(q, sqliteDialect)
+    if err != nil {
+        return nil, err
+    }
+
+    rows, err := s.db.QueryContext(ctx, `
+        SELECT id, created_at, actor, request_id, action, set_name, record_id, before_json, after_json
+        FROM audit_log
+    `+tail, args...)
+    if err != nil {
+        return nil, fmt.Errorf("failed to list audit events: %v", err)
+    }
+    defer rows.Close()
+
+    events, err := scanAuditEvents(rows)
+    if err != nil {
+        return nil, err
+    }
+
+    return auditPage(events, q), nil
+}
+
+// NewSQLiteWebhookStorage - подписки и доставки в таблицах webhooks и
+// webhook_deliveries
+func NewSQLiteWebhookStorage(cfg *config.Config) (*SQLWebhookStorage, error) {
+    db, err := openSQLite(cfg.SQLitePath)
+    if err != nil {
+        return nil, err
+    }
+
+    if err := ensureSchema(newSQLiteMigrator(db), cfg.AutoMigrate); err != nil {
+        return nil, err
+    }
+
+    return &SQLWebhookStorage{db: db, dialect: sqliteDialect, queryTimeout: cfg.DBQueryTimeout, returning: false}, nil
+}
+
+// NewSQLiteAgentStorage - агенты и правила назначения в таблицах agents и
+// agent_assignments
+func NewSQLiteAgentStorage(cfg *config.Config) (*SQLAgentStorage, error) {
+    db, err := openSQLite(cfg.SQLitePath)
+    if err != nil {
+        return nil, err
+    }
+
+    if err := ensureSchema(newSQLiteMigrator(db), cfg.AutoMigrate); err != nil {
+        return nil, err
+    }
+
+    return &SQLAgentStorage{db: db, dialect: sqliteDialect, queryTimeout: cfg.DBQueryTimeout, returning: false}, nil
+}
@@ -0,0 +1,57 @@
+package storage
+
+import (
+    "database/sql"
+    "fmt"
+    "time"
+    "ipset-api-server/internal/models"
+)
+
+// Корзина. SQL хранилища помечают удаленные записи колонкой deleted_at
+// (миграция 6), ClickHouse - строкой с is_deleted = 1, как и раньше,
+// файловое хранилище переносит запись в отдельный раздел файла. Записи
+// в корзине не видны при чтении, но их ID не выдаются новым записям, поэтому
+// запись всегда можно вернуть с прежним ID.
+
+// Триггер истории SQL хранилищ: изменение, которое выставляет deleted_at,
+// записывается как удаление в момент переноса в корзину. Окончательное
+// удаление из корзины в историю не попадает - удаление уже записано.
+const (
+    trashOperationSQL = "CASE WHEN NEW.deleted_at IS NOT NULL THEN 'delete' ELSE 'update' END"
+    trashChangedAtSQL = "COALESCE(NEW.deleted_at, NEW.updated_at)"
+)
+
+// trashColumns - колонки записи в корзине, порядок совпадает с scanTrash
+const trashColumns = `id, set_name, ip, cidr, port, protocol, description, context,
+               set_type, set_options, second_ip, created_at, updated_at, expires_at, active_from, schedule, deleted_at`
+
+// scanTrash читает записи с колонками trashColumns
+func scanTrash(rows *sql.Rows) ([]*models.IPSetRecord, error) {
+    var records []*models.IPSetRecord
+    for rows.Next() {
+        var record models.IPSetRecord
+        var h historyColumns
+        var deletedAt sql.NullTime
+        if err := rows.Scan(append(h.dest(&record), &record.ExpiresAt, &record.ActiveFrom, &record.Schedule, &deletedAt)...); err != nil {
+            return nil, fmt.Errorf("failed to scan record: %v", err)
+        }
+        h.fill(&record)
+        if deletedAt.Valid {
+            t := deletedAt.Time
+            record.DeletedAt = &t
+        }
+        records = append(records, &record)
+    }
+
+    return records, rows.Err()
+}
+
+// restoredRecords снимает с записей, прочитанных из корзины, отметку
+// удаления после Undelete/UndeleteSet
+func restoredRecords(records []*models.IPSetRecord, at time.Time) []*models.IPSetRecord {
+    for _, record := range records {
+        record.DeletedAt = nil
+        record.UpdatedAt = at
+    }
+    return records
+}
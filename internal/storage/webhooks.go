@@ -0,0 +1,505 @@
+package storage
+
+import (
+    "context"
+    "database/sql"
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+    "ipset-api-server/internal/models"
+)
+
+// Подписки хранятся в таблице webhooks, доставки - в webhook_deliveries,
+// номер последнего изменения потока (см. changes.go), по которому созданы
+// доставки, - в webhook_cursor. Доставки создает и отправляет сервер,
+// хранилище только сохраняет их состояние. Списки событий и сетов
+// подписки хранятся строкой через запятую.
+
+const (
+    webhookColumns  = `id, url, secret, events, set_names, description, active, created_at, updated_at`
+    deliveryColumns = `id, webhook_id, revision, event, payload, status, attempts, next_attempt_at,
+               last_status, last_error, created_at, updated_at`
+)
+
+// maxDeliveryError - ограничение длины last_error
+const maxDeliveryError = 1000
+
+func joinWebhookList(values []string) string {
+    return strings.Join(values, ",")
+}
+
+func splitWebhookList(value string) []string {
+    if value == "" {
+        return []string{}
+    }
+    return strings.Split(value, ",")
+}
+
+func deliveryError(err string) string {
+    if len(err) > maxDeliveryError {
+        return err[:maxDeliveryError]
+    }
+    return err
+}
+
+// NormalizeDeliveryQuery проверяет курсор и выставляет лимит по умолчанию
+func NormalizeDeliveryQuery(q *models.DeliveryQuery) error {
+    q.Limit = normalizeLimit(q.Limit)
+
+    switch q.Status {
+    case "", models.DeliveryPending, models.DeliveryDelivered, models.DeliveryDead:
+    default:
+        return fmt.Errorf("invalid status: %s", q.Status)
+    }
+
+    _, err := deliveryCursorID(q.Cursor)
+    return err
+}
+
+// deliveryCursorID возвращает ID последней доставки предыдущей страницы,
+// 0 - если курсора нет
+func deliveryCursorID(cursor string) (int64, error) {
+    c, err := decodeCursor(cursor)
+    if err != nil || c == nil {
+        return 0, err
+    }
+
+    id, err := strconv.ParseInt(c.Value, 10, 64)
+    if err != nil {
+        return 0, fmt.Errorf("invalid cursor")
+    }
+    return id, nil
+}
+
+// deliveryPage обрезает выборку, полученную с лимитом limit+1, и строит
+// курсор следующей страницы по ID последней доставки
+func deliveryPage(deliveries []*models.WebhookDelivery, q *models.DeliveryQuery) *models.DeliveryPage {
+    page := &models.DeliveryPage{Deliveries: deliveries}
+    if len(deliveries) > q.Limit {
+        page.Deliveries = deliveries[:q.Limit]
+        last := page.Deliveries[len(page.Deliveries)-1]
+        page.NextCursor = encodeCursor(listCursor{Value: strconv.FormatInt(last.ID, 10)})
+    }
+    if page.Deliveries == nil {
+        page.Deliveries = []*models.WebhookDelivery{}
+    }
+    return page
+}
+
+// buildDeliveryListSQL строит условия, сортировку и лимит для журнала
+// доставок: от новых к старым, курсор - ID последней доставки
+func buildDeliveryListSQL(q *models.DeliveryQuery, d sqlDialect) (string, []interface{}, error) {
+    if err := NormalizeDeliveryQuery(q); err != nil {
+        return "", nil, err
+    }
+
+    c := &sqlConditions{dialect: d}
+
+    if q.WebhookID != 0 {
+        c.add("webhook_id = %s", q.WebhookID)
+    }
+    if q.Status != "" {
+        c.add("status = %s", q.Status)
+    }
+    if id, _ := deliveryCursorID(q.Cursor); id != 0 {
+        c.add("id < %s", id)
+    }
+
+    query := fmt.Sprintf("%s ORDER BY id DESC LIMIT %d", c.where(), q.Limit+1)
+    return query, c.args, nil
+}
+
+// listDeliveriesInMemory - журнал доставок для хранилищ, которые читают
+// доставки целиком
+func listDeliveriesInMemory(deliveries []*models.WebhookDelivery, q *models.DeliveryQuery) (*models.DeliveryPage, error) {
+    if err := NormalizeDeliveryQuery(q); err != nil {
+        return nil, err
+    }
+
+    cursorID, _ := deliveryCursorID(q.Cursor)
+
+    var matched []*models.WebhookDelivery
+    for i := len(deliveries) - 1; i >= 0; i-- {
+        delivery := deliveries[i]
+        if q.WebhookID != 0 && delivery.WebhookID != q.WebhookID {
+            continue
+        }
+        if q.Status != "" && delivery.Status != q.Status {
+            continue
+        }
+        if cursorID != 0 && delivery.ID >= cursorID {
+            continue
+        }
+        matched = append(matched, delivery)
+        if len(matched) > q.Limit {
+            break
+        }
+    }
+
+    return deliveryPage(matched, q), nil
+}
+
+func scanWebhooks(rows *sql.Rows) ([]*models.Webhook, error) {
+    var webhooks []*models.Webhook
+    for rows.Next() {
+        var webhook models.Webhook
+        var events, setNames string
+        var description sql.NullString
+        if err := rows.Scan(
+            &webhook.ID, &webhook.URL, &webhook.Secret, &events, &setNames, &description,
+            &webhook.Active, &webhook.CreatedAt, &webhook.UpdatedAt,
+        ); err != nil {
+            return nil, fmt.Errorf("failed to scan webhook: %v", err)
+        }
+        webhook.Events = splitWebhookList(events)
+        webhook.SetNames = splitWebhookList(setNames)
+        webhook.Description = description.String
+        webhooks = append(webhooks, &webhook)
+    }
+
+    return webhooks, rows.Err()
+}
+
+func scanDeliveries(rows *sql.Rows) ([]*models.WebhookDelivery, error) {
+    var deliveries []*models.WebhookDelivery
+    for rows.Next() {
+        var delivery models.WebhookDelivery
+        var payload string
+        if err := rows.Scan(
+            &delivery.ID, &delivery.WebhookID, &delivery.Revision, &delivery.Event, &payload,
+            &delivery.Status, &delivery.Attempts, &delivery.NextAttemptAt,
+            &delivery.LastStatus, &delivery.LastError, &delivery.CreatedAt, &delivery.UpdatedAt,
+        ); err != nil {
+            return nil, fmt.Errorf("failed to scan webhook delivery: %v", err)
+        }
+        delivery.Payload = []byte(payload)
+        deliveries = append(deliveries, &delivery)
+    }
+
+    return deliveries, rows.Err()
+}
+
+// SQLWebhookStorage - подписки и доставки в SQL хранилищах. Запросы у
+// SQLite, MySQL и PostgreSQL общие, отличается только диалект.
+type SQLWebhookStorage struct {
+    db           *sql.DB
+    dialect      sqlDialect
+    queryTimeout time.Duration
+    // returning - ID новой строки возвращает INSERT ... RETURNING id
+    // (PostgreSQL), иначе LastInsertId
+    returning bool
+}
+
+// query подставляет параметры диалекта вместо "?"
+func (s *SQLWebhookStorage) query(query string) string {
+    return bindParams(s.dialect, query)
+}
+
+// insert выполняет INSERT и возвращает ID новой строки
+func (s *SQLWebhookStorage) insert(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) (int64, error) {
+    return insertID(ctx, tx, s.dialect, s.returning, query, args...)
+}
+
+// bindParams подставляет параметры диалекта d вместо "?"
+func bindParams(d sqlDialect, query string) string {
+    var sb strings.Builder
+    n := 0
+    for _, r := range query {
+        if r != '?' {
+            sb.WriteRune(r)
+            continue
+        }
+        n++
+        sb.WriteString(d.placeholder(n))
+    }
+    return sb.String()
+}
+
+// insertID выполняет INSERT и возвращает ID новой строки: через RETURNING id
+// (returning, PostgreSQL) или LastInsertId
+func insertID(ctx context.Context, tx *sql.Tx, d sqlDialect, returning bool, query string, args ...interface{}) (int64, error) {
+    if returning {
+        var id int64
+        err := tx.QueryRowContext(ctx, bindParams(d, query+" RETURNING id"), args...).Scan(&id)
+        return id, err
+    }
+
+    result, err := tx.ExecContext(ctx, bindParams(d, query), args...)
+    if err != nil {
+        return 0, err
+    }
+    return result.LastInsertId()
+}
+
+func (s *SQLWebhookStorage) CreateWebhook(ctx context.Context, webhook *models.Webhook) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback()
+
+    webhook.ID, err = s.insert(ctx, tx, `
+        INSERT INTO webhooks (url, secret, events, set_names, description, active, created_at, updated_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+        webhook.URL, webhook.Secret, joinWebhookList(webhook.Events), joinWebhookList(webhook.SetNames),
+        webhook.Description, webhook.Active, webhook.CreatedAt.UTC(), webhook.UpdatedAt.UTC(),
+    )
+    if err != nil {
+        return fmt.Errorf("failed to create webhook: %v", err)
+    }
+
+    if err := tx.Commit(); err != nil {
+        return fmt.Errorf("failed to commit transaction: %v", err)
+    }
+    return nil
+}
+
+func (s *SQLWebhookStorage) GetWebhook(ctx context.Context, id int64) (*models.Webhook, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    rows, err := s.db.QueryContext(ctx, s.query("SELECT "+webhookColumns+" FROM webhooks WHERE id = ?"), id)
+    if err != nil {
+        return nil, fmt.Errorf("failed to get webhook: %v", err)
+    }
+    defer rows.Close()
+
+    webhooks, err := scanWebhooks(rows)
+    if err != nil {
+        return nil, err
+    }
+    if len(webhooks) == 0 {
+        return nil, fmt.Errorf("webhook with id %d not found", id)
+    }
+    return webhooks[0], nil
+}
+
+func (s *SQLWebhookStorage) ListWebhooks(ctx context.Context) ([]*models.Webhook, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    rows, err := s.db.QueryContext(ctx, "SELECT "+webhookColumns+" FROM webhooks ORDER BY id")
+    if err != nil {
+        return nil, fmt.Errorf("failed to list webhooks: %v", err)
+    }
+    defer rows.Close()
+
+    return scanWebhooks(rows)
+}
+
+func (s *SQLWebhookStorage) UpdateWebhook(ctx context.Context, webhook *models.Webhook) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    result, err := s.db.ExecContext(ctx, s.query(`
+        UPDATE webhooks
+        SET url = ?, secret = ?, events = ?, set_names = ?, description = ?, active = ?, updated_at = ?
+        WHERE id = ?`),
+        webhook.URL, webhook.Secret, joinWebhookList(webhook.Events), joinWebhookList(webhook.SetNames),
+        webhook.Description, webhook.Active, webhook.UpdatedAt.UTC(), webhook.ID,
+    )
+    if err != nil {
+        return fmt.Errorf("failed to update webhook: %v", err)
+    }
+
+    affected, err := result.RowsAffected()
+    if err != nil {
+        return fmt.Errorf("failed to get rows affected: %v", err)
+    }
+    if affected == 0 {
+        return fmt.Errorf("webhook with id %d not found", webhook.ID)
+    }
+    return nil
+}
+
+// DeleteWebhook удаляет подписку вместе с ее доставками
+func (s *SQLWebhookStorage) DeleteWebhook(ctx context.Context, id int64) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback()
+
+    result, err := tx.ExecContext(ctx, s.query("DELETE FROM webhooks WHERE id = ?"), id)
+    if err != nil {
+        return fmt.Errorf("failed to delete webhook: %v", err)
+    }
+    affected, err := result.RowsAffected()
+    if err != nil {
+        return fmt.Errorf("failed to get rows affected: %v", err)
+    }
+    if affected == 0 {
+        return fmt.Errorf("webhook with id %d not found", id)
+    }
+
+    if _, err := tx.ExecContext(ctx, s.query("DELETE FROM webhook_deliveries WHERE webhook_id = ?"), id); err != nil {
+        return fmt.Errorf("failed to delete webhook deliveries: %v", err)
+    }
+
+    if err := tx.Commit(); err != nil {
+        return fmt.Errorf("failed to commit transaction: %v", err)
+    }
+    return nil
+}
+
+func (s *SQLWebhookStorage) WebhookCursor(ctx context.Context) (int64, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    var revision int64
+    err := s.db.QueryRowContext(ctx, "SELECT revision FROM webhook_cursor").Scan(&revision)
+    if err == sql.ErrNoRows {
+        return -1, nil
+    }
+    if err != nil {
+        return 0, fmt.Errorf("failed to get webhook cursor: %v", err)
+    }
+    return revision, nil
+}
+
+func (s *SQLWebhookStorage) EnqueueDeliveries(ctx context.Context, deliveries []*models.WebhookDelivery, revision int64) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback()
+
+    for _, delivery := range deliveries {
+        delivery.ID, err = s.insert(ctx, tx, `
+            INSERT INTO webhook_deliveries
+            (webhook_id, revision, event, payload, status, attempts, next_attempt_at,
+             last_status, last_error, created_at, updated_at)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+            delivery.WebhookID, delivery.Revision, delivery.Event, string(delivery.Payload),
+            delivery.Status, delivery.Attempts, delivery.NextAttemptAt.UTC(),
+            delivery.LastStatus, deliveryError(delivery.LastError), delivery.CreatedAt.UTC(), delivery.UpdatedAt.UTC(),
+        )
+        if err != nil {
+            return fmt.Errorf("failed to enqueue webhook delivery: %v", err)
+        }
+    }
+
+    // Строка номера одна, UPDATE без изменений в MySQL не находит строк,
+    // поэтому номер заменяется целиком
+    if _, err := tx.ExecContext(ctx, "DELETE FROM webhook_cursor"); err != nil {
+        return fmt.Errorf("failed to update webhook cursor: %v", err)
+    }
+    if _, err := tx.ExecContext(ctx, s.query("INSERT INTO webhook_cursor (revision) VALUES (?)"), revision); err != nil {
+        return fmt.Errorf("failed to update webhook cursor: %v", err)
+    }
+
+    if err := tx.Commit(); err != nil {
+        return fmt.Errorf("failed to commit transaction: %v", err)
+    }
+    return nil
+}
+
+func (s *SQLWebhookStorage) DueDeliveries(ctx context.Context, at time.Time, limit int) ([]*models.WebhookDelivery, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    rows, err := s.db.QueryContext(ctx, s.query(`
+        SELECT `+deliveryColumns+`
+        FROM webhook_deliveries
+        WHERE status = ? AND next_attempt_at <= ?
+        ORDER BY next_attempt_at, id
+        LIMIT ?`), models.DeliveryPending, at.UTC(), limit)
+    if err != nil {
+        return nil, fmt.Errorf("failed to get due webhook deliveries: %v", err)
+    }
+    defer rows.Close()
+
+    return scanDeliveries(rows)
+}
+
+func (s *SQLWebhookStorage) GetDelivery(ctx context.Context, id int64) (*models.WebhookDelivery, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    rows, err := s.db.QueryContext(ctx, s.query("SELECT "+deliveryColumns+" FROM webhook_deliveries WHERE id = ?"), id)
+    if err != nil {
+        return nil, fmt.Errorf("failed to get webhook delivery: %v", err)
+    }
+    defer rows.Close()
+
+    deliveries, err := scanDeliveries(rows)
+    if err != nil {
+        return nil, err
+    }
+    if len(deliveries) == 0 {
+        return nil, fmt.Errorf("delivery with id %d not found", id)
+    }
+    return deliveries[0], nil
+}
+
+func (s *SQLWebhookStorage) UpdateDelivery(ctx context.Context, delivery *models.WebhookDelivery) error {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    _, err := s.db.ExecContext(ctx, s.query(`
+        UPDATE webhook_deliveries
+        SET status = ?, attempts = ?, next_attempt_at = ?, last_status = ?, last_error = ?, updated_at = ?
+        WHERE id = ?`),
+        delivery.Status, delivery.Attempts, delivery.NextAttemptAt.UTC(), delivery.LastStatus,
+        deliveryError(delivery.LastError), delivery.UpdatedAt.UTC(), delivery.ID,
+    )
+    if err != nil {
+        return fmt.Errorf("failed to update webhook delivery: %v", err)
+    }
+    return nil
+}
+
+func (s *SQLWebhookStorage) ListDeliveries(ctx context.Context, q *models.DeliveryQuery) (*models.DeliveryPage, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    tail, args, err := buildDeliveryListSQL(q, s.dialect)
+    if err != nil {
+        return nil, err
+    }
+
+    rows, err := s.db.QueryContext(ctx, `
+        SELECT `+deliveryColumns+`
+        FROM webhook_deliveries
+    `+tail, args...)
+    if err != nil {
+        return nil, fmt.Errorf("failed to list webhook deliveries: %v", err)
+    }
+    defer rows.Close()
+
+    deliveries, err := scanDeliveries(rows)
+    if err != nil {
+        return nil, err
+    }
+
+    return deliveryPage(deliveries, q), nil
+}
+
+// PurgeDeliveries удаляет доставленные до before. Недоставленные
+// остаются, пока их не отправят заново или не удалят подписку.
+func (s *SQLWebhookStorage) PurgeDeliveries(ctx context.Context, before time.Time) (int, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.queryTimeout)
+    defer cancel()
+
+    result, err := s.db.ExecContext(ctx, s.query("DELETE FROM webhook_deliveries WHERE status = ? AND updated_at < ?"),
+        models.DeliveryDelivered, before.UTC())
+    if err != nil {
+        return 0, fmt.Errorf("failed to purge webhook deliveries: %v", err)
+    }
+
+    affected, err := result.RowsAffected()
+    if err != nil {
+        return 0, fmt.Errorf("failed to get rows affected: %v", err)
+    }
+    return int(affected), nil
+}
@@ -0,0 +1,344 @@
+// Package drift сравнивает сет в ядре (вывод ipset save) с копией сета на
+// сервере: каких элементов в ядре не хватает, какие лишние и чем отличаются
+// тип и опции. Пакет используется ipset-cli и агентом, поэтому, как и
+// validation, не зависит от остальных пакетов модуля.
+package drift
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "net/netip"
+    "sort"
+    "strings"
+
+    "ipset-api-server/pkg/validation"
+)
+
+// maxExpand - наибольший диапазон IPv4-адресов записи hash:ip, который
+// раскладывается на отдельные адреса, как это делает ipset
+const maxExpand = 1 << 16
+
+// Set - сет в синтаксисе ipset: тип и опции команды create, элементы
+// команд add (без timeout и других параметров элемента)
+type Set struct {
+    Name    string
+    Type    string
+    Options string
+    Entries []string
+}
+
+// Mismatch - различие типа или опции сета; пустое значение - опции нет
+type Mismatch struct {
+    Field  string `json:"field"`
+    Server string `json:"server"`
+    Kernel string `json:"kernel"`
+}
+
+// Report - расхождения сета в ядре с сервером. Missing - элементы, которых
+// нет в ядре, Extra - элементы ядра, которых нет на сервере. Loaded = false
+// - сета в ядре нет совсем.
+type Report struct {
+    SetName    string     `json:"set_name"`
+    Loaded     bool       `json:"loaded"`
+    Entries    int        `json:"entries"`
+    Missing    []string   `json:"missing"`
+    Extra      []string   `json:"extra"`
+    Mismatches []Mismatch `json:"mismatches"`
+}
+
+// Drifted - отличается ли сет в ядре от сервера
+func (r *Report) Drifted() bool {
+    return !r.Loaded || len(r.Missing) > 0 || len(r.Extra) > 0 || len(r.Mismatches) > 0
+}
+
+// Print выводит отчет для человека: строку итога и по строке на каждое
+// расхождение
+func Print(w io.Writer, r *Report) {
+    switch {
+    case !r.Loaded:
+        fmt.Fprintf(w, "Set %s: not loaded in the kernel (%d entries on the server)\n", r.SetName, r.Entries)
+        return
+    case !r.Drifted():
+        fmt.Fprintf(w, "Set %s: in sync (%d entries)\n", r.SetName, r.Entries)
+        return
+    }
+
+    fmt.Fprintf(w, "Set %s: %d missing, %d extra, %d mismatches\n", r.SetName, len(r.Missing), len(r.Extra), len(r.Mismatches))
+    for _, m := range r.Mismatches {
+        fmt.Fprintf(w, "  %-8s server %s, kernel %s\n", m.Field, orNone(m.Server), orNone(m.Kernel))
+    }
+    for _, entry := range r.Missing {
+        fmt.Fprintf(w, "  missing  %s\n", entry)
+    }
+    for _, entry := range r.Extra {
+        fmt.Fprintf(w, "  extra    %s\n", entry)
+    }
+}
+
+func orNone(value string) string {
+    if value == "" {
+        return "(none)"
+    }
+    return value
+}
+
+// ParseSave разбирает вывод ipset save (или файл ipset restore) в сеты по
+// именам
+func ParseSave(data string) map[string]*Set {
+    sets := make(map[string]*Set)
+    for _, line := range strings.Split(data, "\n") {
+        fields := strings.Fields(line)
+        if len(fields) < 3 {
+            continue
+        }
+
+        switch fields[0] {
+        case "create":
+            sets[fields[1]] = &Set{
+                Name:    fields[1],
+                Type:    fields[2],
+                Options: strings.Join(fields[3:], " "),
+            }
+        case "add":
+            set := sets[fields[1]]
+            if set == nil {
+                set = &Set{Name: fields[1]}
+                sets[fields[1]] = set
+            }
+            set.Entries = append(set.Entries, fields[2])
+        }
+    }
+    return sets
+}
+
+// ServerSet собирает сет сервера так же, как его экспортирует сервер и
+// применяет агент: семейство, определенное по опциям или записям,
+// добавляется в опции, записи другого семейства пропускаются
+func ServerSet(name, setType, options string, entries []validation.Entry) *Set {
+    ips := make([]string, len(entries))
+    for i, e := range entries {
+        ips[i] = e.IP
+    }
+    family := validation.ExportFamily(options, ips)
+
+    set := &Set{
+        Name:    name,
+        Type:    setType,
+        Options: validation.WithFamily(options, family),
+        Entries: []string{},
+    }
+    for _, e := range entries {
+        if f := validation.AddrFamily(e.IP); f != "" && f != family {
+            continue
+        }
+        set.Entries = append(set.Entries, validation.FormatEntry(family, e))
+    }
+    return set
+}
+
+// Digest - контрольная сумма сета: типа, опций и элементов в приведенном
+// виде. Агент сообщает сумму примененного сета, сервер сравнивает ее с
+// суммой текущего сета, чтобы найти агенты, применившие устаревший сет.
+func Digest(set *Set) string {
+    entries := make([]string, 0, len(set.Entries))
+    for entry := range entrySet(set.Type, set.Entries) {
+        entries = append(entries, entry)
+    }
+    sort.Strings(entries)
+
+    h := sha256.New()
+    fmt.Fprintf(h, "%s\n%s\n", set.Type, strings.Join(strings.Fields(set.Options), " "))
+    for _, entry := range entries {
+        fmt.Fprintf(h, "%s\n", entry)
+    }
+    return hex.EncodeToString(h.Sum(nil))
+}
+
+// Compare сравнивает сет сервера с сетом в ядре; kernel = nil - сета в ядре
+// нет. Элементы сравниваются в приведенном виде: адреса в форме netip, сети
+// с обнуленными битами хоста, порт без протокола - tcp.
+func Compare(server, kernel *Set) *Report {
+    expected := entrySet(server.Type, server.Entries)
+    report := &Report{
+        SetName:    server.Name,
+        Loaded:     kernel != nil,
+        Entries:    len(expected),
+        Missing:    []string{},
+        Extra:      []string{},
+        Mismatches: []Mismatch{},
+    }
+    if kernel == nil {
+        return report
+    }
+
+    if server.Type != kernel.Type {
+        report.Mismatches = append(report.Mismatches, Mismatch{Field: "type", Server: server.Type, Kernel: kernel.Type})
+    }
+    report.Mismatches = append(report.Mismatches, compareOptions(server.Options, kernel.Options)...)
+
+    actual := entrySet(server.Type, kernel.Entries)
+    for entry := range expected {
+        if !actual[entry] {
+            report.Missing = append(report.Missing, entry)
+        }
+    }
+    for entry := range actual {
+        if !expected[entry] {
+            report.Extra = append(report.Extra, entry)
+        }
+    }
+    sort.Strings(report.Missing)
+    sort.Strings(report.Extra)
+    return report
+}
+
+// checkedOptions - опции, которые сравниваются и когда их нет на сервере:
+// без них сет в ядре ведет себя иначе. Остальные опции (maxelem и т.п.)
+// сравниваются, только если заданы на сервере; hashsize, bucketsize и
+// initval ядро выбирает само.
+var checkedOptions = []string{"family", "timeout", "counters", "comment", "skbinfo", "forceadd", "netmask", "range", "markmask"}
+
+var ignoredOptions = map[string]bool{"hashsize": true, "bucketsize": true, "initval": true}
+
+// optionFlags - опции без значения
+var optionFlags = map[string]bool{"counters": true, "comment": true, "skbinfo": true, "forceadd": true}
+
+func compareOptions(server, kernel string) []Mismatch {
+    serverOpts, kernelOpts := parseOptions(server), parseOptions(kernel)
+    // Сет hash:* без family - inet; bitmap:* и list:set семейства не имеют
+    if _, ok := kernelOpts["family"]; ok && serverOpts["family"] == "" {
+        serverOpts["family"] = "inet"
+    }
+
+    keys := append([]string{}, checkedOptions...)
+    for key := range serverOpts {
+        if !ignoredOptions[key] && !containsString(keys, key) {
+            keys = append(keys, key)
+        }
+    }
+    sort.Strings(keys[len(checkedOptions):])
+
+    var mismatches []Mismatch
+    for _, key := range keys {
+        serverValue, inServer := serverOpts[key]
+        kernelValue, inKernel := kernelOpts[key]
+        if inServer != inKernel || serverValue != kernelValue {
+            mismatches = append(mismatches, Mismatch{
+                Field:  key,
+                Server: optionValue(key, serverValue, inServer),
+                Kernel: optionValue(key, kernelValue, inKernel),
+            })
+        }
+    }
+    return mismatches
+}
+
+func parseOptions(options string) map[string]string {
+    opts := make(map[string]string)
+    fields := strings.Fields(strings.ToLower(options))
+    for i := 0; i < len(fields); i++ {
+        if optionFlags[fields[i]] || i+1 == len(fields) {
+            opts[fields[i]] = ""
+            continue
+        }
+        opts[fields[i]] = fields[i+1]
+        i++
+    }
+    return opts
+}
+
+// optionValue - значение опции для отчета: у опций без значения - имя опции
+func optionValue(key, value string, ok bool) string {
+    if !ok {
+        return ""
+    }
+    if value == "" {
+        return key
+    }
+    return value
+}
+
+func containsString(values []string, value string) bool {
+    for _, v := range values {
+        if v == value {
+            return true
+        }
+    }
+    return false
+}
+
+// entrySet приводит элементы сета к сравнимому виду
+func entrySet(setType string, entries []string) map[string]bool {
+    result := make(map[string]bool, len(entries))
+    for _, entry := range entries {
+        for _, e := range normalizeEntry(setType, entry) {
+            result[e] = true
+        }
+    }
+    return result
+}
+
+// normalizeEntry приводит элемент к виду, в котором его выводит ipset save.
+// Диапазон IPv4-адресов в сетах hash:ip (10.0.0.0/30) ipset хранит как
+// отдельные адреса, поэтому он раскладывается на них.
+func normalizeEntry(setType string, entry string) []string {
+    kind := setType
+    if i := strings.Index(setType, ":"); i >= 0 {
+        kind = setType[i+1:]
+    }
+    components := strings.Split(kind, ",")
+
+    parts := strings.Split(entry, ",")
+    for i, part := range parts {
+        component := ""
+        if i < len(components) {
+            component = components[i]
+        }
+        switch component {
+        case "ip", "net":
+            parts[i] = normalizeAddr(part)
+        case "port":
+            parts[i] = strings.ToLower(part)
+            if strings.HasPrefix(setType, "hash:") && !strings.Contains(part, ":") {
+                parts[i] = "tcp:" + parts[i]
+            }
+        case "iface":
+        default:
+            parts[i] = strings.ToLower(part)
+        }
+    }
+
+    if len(components) > 0 && components[0] == "ip" {
+        if prefix, err := netip.ParsePrefix(parts[0]); err == nil && prefix.Addr().Is4() && prefix.Bits() >= 32-16 {
+            var result []string
+            for addr := prefix.Addr(); prefix.Contains(addr) && len(result) < maxExpand; addr = addr.Next() {
+                parts[0] = addr.String()
+                result = append(result, strings.Join(parts, ","))
+            }
+            return result
+        }
+    }
+    return []string{strings.Join(parts, ",")}
+}
+
+// normalizeAddr - адрес в форме netip, сеть - с обнуленными битами хоста,
+// сеть из одного адреса - как адрес. Остальное (диапазоны) не меняется.
+func normalizeAddr(value string) string {
+    value = strings.NewReplacer("[", "", "]", "").Replace(value)
+    if strings.Contains(value, "/") {
+        prefix, err := netip.ParsePrefix(value)
+        if err != nil {
+            return strings.ToLower(value)
+        }
+        if prefix.IsSingleIP() {
+            return prefix.Addr().String()
+        }
+        return prefix.Masked().String()
+    }
+    if addr, err := netip.ParseAddr(value); err == nil {
+        return addr.WithZone("").String()
+    }
+    return strings.ToLower(value)
+}
@@ -0,0 +1,241 @@
+// Package schedule разбирает расписание действия записи: окна по дням
+// недели и времени суток. Пакет общий для сервера и CLI.
+//
+// Формат: [TZ=<зона>] <окно>[; <окно>...], окно - [дни] [ЧЧ:ММ-ЧЧ:ММ].
+// Дни - mon..sun, диапазоны (mon-fri, fri-mon) и списки через запятую
+// (sat,sun), * или daily - каждый день. Окно без дней действует каждый день,
+// окно без времени - весь день. Если конец окна не позже начала, окно
+// заканчивается на следующий день: "mon-fri 18:00-09:00" - ночи после
+// рабочих дней. Время задается в зоне TZ (по умолчанию UTC).
+package schedule
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    // База часовых поясов нужна, даже если в системе ее нет
+    _ "time/tzdata"
+)
+
+// MaxLength - наибольшая длина расписания, как у колонки schedule
+const MaxLength = 255
+
+// Schedule - разобранное расписание
+type Schedule struct {
+    loc     *time.Location
+    windows []window
+}
+
+// window - окно действия: дни недели, в которые окно начинается, и время
+// начала и конца в минутах от полуночи
+type window struct {
+    days       [7]bool
+    start, end int
+}
+
+var weekdays = map[string]time.Weekday{
+    "sun": time.Sunday,
+    "mon": time.Monday,
+    "tue": time.Tuesday,
+    "wed": time.Wednesday,
+    "thu": time.Thursday,
+    "fri": time.Friday,
+    "sat": time.Saturday,
+}
+
+var (
+    locMu     sync.Mutex
+    locations = map[string]*time.Location{}
+)
+
+// loadLocation кэширует зоны: расписания разбираются при каждой проверке
+func loadLocation(name string) (*time.Location, error) {
+    locMu.Lock()
+    defer locMu.Unlock()
+
+    if loc, ok := locations[name]; ok {
+        return loc, nil
+    }
+    loc, err := time.LoadLocation(name)
+    if err != nil {
+        return nil, err
+    }
+    locations[name] = loc
+    return loc, nil
+}
+
+// Parse разбирает расписание
+func Parse(value string) (*Schedule, error) {
+    if len(value) > MaxLength {
+        return nil, fmt.Errorf("schedule is longer than %d characters", MaxLength)
+    }
+
+    s := &Schedule{loc: time.UTC}
+    value = strings.TrimSpace(value)
+    if rest, ok := strings.CutPrefix(value, "TZ="); ok {
+        name, windows, _ := strings.Cut(rest, " ")
+        loc, err := loadLocation(name)
+        if err != nil {
+            return nil, fmt.Errorf("unknown time zone %q", name)
+        }
+        s.loc = loc
+        value = windows
+    }
+
+    for _, part := range strings.Split(value, ";") {
+        w, err := parseWindow(strings.TrimSpace(part))
+        if err != nil {
+            return nil, err
+        }
+        s.windows = append(s.windows, w)
+    }
+    return s, nil
+}
+
+func parseWindow(value string) (window, error) {
+    fields := strings.Fields(value)
+    if len(fields) == 0 || len(fields) > 2 {
+        return window{}, fmt.Errorf("invalid window %q (use [days] [HH:MM-HH:MM])", value)
+    }
+
+    w := window{start: 0, end: 24 * 60}
+    var haveDays, haveTime bool
+    for _, field := range fields {
+        if field[0] >= '0' && field[0] <= '9' {
+            if haveTime {
+                return window{}, fmt.Errorf("invalid window %q: more than one time range", value)
+            }
+            from, to, ok := strings.Cut(field, "-")
+            if !ok {
+                return window{}, fmt.Errorf("invalid time range %q (use HH:MM-HH:MM)", field)
+            }
+            var err error
+            if w.start, err = parseClock(from); err != nil {
+                return window{}, err
+            }
+            if w.end, err = parseClock(to); err != nil {
+                return window{}, err
+            }
+            if w.start == w.end {
+                return window{}, fmt.Errorf("invalid time range %q: empty window", field)
+            }
+            haveTime = true
+            continue
+        }
+
+        if haveDays {
+            return window{}, fmt.Errorf("invalid window %q: more than one day list", value)
+        }
+        days, err := parseDays(field)
+        if err != nil {
+            return window{}, err
+        }
+        w.days = days
+        haveDays = true
+    }
+
+    if !haveDays {
+        for i := range w.days {
+            w.days[i] = true
+        }
+    }
+    return w, nil
+}
+
+// parseClock разбирает ЧЧ:ММ в минуты от полуночи, 24:00 - конец суток
+func parseClock(value string) (int, error) {
+    h, m, ok := strings.Cut(value, ":")
+    hours, err1 := strconv.Atoi(h)
+    minutes, err2 := strconv.Atoi(m)
+    if !ok || err1 != nil || err2 != nil || hours < 0 || minutes < 0 || minutes > 59 ||
+        hours > 24 || (hours == 24 && minutes != 0) {
+        return 0, fmt.Errorf("invalid time %q (use HH:MM)", value)
+    }
+    return hours*60 + minutes, nil
+}
+
+func parseDays(value string) ([7]bool, error) {
+    var days [7]bool
+    if value == "*" || value == "daily" {
+        for i := range days {
+            days[i] = true
+        }
+        return days, nil
+    }
+
+    for _, item := range strings.Split(strings.ToLower(value), ",") {
+        from, to, isRange := strings.Cut(item, "-")
+        first, ok := weekdays[from]
+        if !ok {
+            return days, fmt.Errorf("unknown day %q (use mon..sun)", from)
+        }
+        last := first
+        if isRange {
+            if last, ok = weekdays[to]; !ok {
+                return days, fmt.Errorf("unknown day %q (use mon..sun)", to)
+            }
+        }
+        // Диапазон может переходить через воскресенье: fri-mon
+        for d := first; ; d = (d + 1) % 7 {
+            days[d] = true
+            if d == last {
+                break
+            }
+        }
+    }
+    return days, nil
+}
+
+// bounds - начало и конец окна, которое начинается в день day
+func (w window) bounds(day time.Time, loc *time.Location) (time.Time, time.Time) {
+    y, m, d := day.Date()
+    start := time.Date(y, m, d, 0, w.start, 0, 0, loc)
+    if w.end > w.start {
+        return start, time.Date(y, m, d, 0, w.end, 0, 0, loc)
+    }
+    return start, time.Date(y, m, d+1, 0, w.end, 0, 0, loc)
+}
+
+// Active - действует ли расписание в момент t
+func (s *Schedule) Active(t time.Time) bool {
+    local := t.In(s.loc)
+    // Окно, начавшееся накануне, может еще продолжаться
+    for _, day := range []time.Time{local.AddDate(0, 0, -1), local} {
+        for _, w := range s.windows {
+            if !w.days[day.Weekday()] {
+                continue
+            }
+            start, end := w.bounds(day, s.loc)
+            if !t.Before(start) && t.Before(end) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// Next - ближайшая после t граница окна (начало или конец). В этот момент
+// Active может измениться; смежные окна дают границы, на которых Active
+// остается прежним.
+func (s *Schedule) Next(t time.Time) time.Time {
+    var next time.Time
+    local := t.In(s.loc)
+    for i := -1; i <= 7; i++ {
+        day := local.AddDate(0, 0, i)
+        for _, w := range s.windows {
+            if !w.days[day.Weekday()] {
+                continue
+            }
+            start, end := w.bounds(day, s.loc)
+            for _, b := range []time.Time{start, end} {
+                if b.After(t) && (next.IsZero() || b.Before(next)) {
+                    next = b
+                }
+            }
+        }
+    }
+    return next
+}
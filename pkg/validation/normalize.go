@@ -0,0 +1,225 @@
+package validation
+
+import (
+    "net"
+    "net/netip"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// AddrFamily возвращает семейство адреса (inet или inet6) или пустую строку,
+// если значение не является IP-адресом (MAC, имя сета, пустой ip bitmap:port)
+func AddrFamily(ip string) string {
+    addr, err := netip.ParseAddr(ip)
+    if err != nil {
+        return ""
+    }
+    if addr.Is4() {
+        return "inet"
+    }
+    return "inet6"
+}
+
+// DefaultPrefixLen - длина префикса одиночного адреса семейства
+func DefaultPrefixLen(family string) int {
+    if family == "inet6" {
+        return 128
+    }
+    return 32
+}
+
+// NormalizeEntry приводит проверенную запись к каноническому виду: адреса в
+// сокращенной форме netip (2001:db8::1), MAC в нижнем регистре, CIDR, равный
+// длине адреса, опускается. Одинаковые записи после нормализации совпадают
+// побайтно.
+func NormalizeEntry(setType string, e Entry) Entry {
+    if setType == "" {
+        setType = DefaultSetType
+    }
+    spec := setTypes[setType]
+
+    switch spec.addr {
+    case addrMAC:
+        if mac, err := net.ParseMAC(e.IP); err == nil {
+            e.IP = mac.String()
+        }
+    case addrIP, addrNet:
+        if addr, err := netip.ParseAddr(e.IP); err == nil {
+            e.IP = addr.String()
+            if cidr, err := strconv.Atoi(e.CIDR); err == nil && cidr == addr.BitLen() {
+                e.CIDR = ""
+            }
+        }
+    }
+
+    if e.SecondIP != "" {
+        if strings.Contains(e.SecondIP, "/") {
+            if prefix, err := netip.ParsePrefix(e.SecondIP); err == nil {
+                if prefix.IsSingleIP() {
+                    e.SecondIP = prefix.Addr().String()
+                } else {
+                    e.SecondIP = prefix.String()
+                }
+            }
+        } else if addr, err := netip.ParseAddr(e.SecondIP); err == nil {
+            e.SecondIP = addr.String()
+        }
+    }
+
+    e.Protocol = strings.ToLower(e.Protocol)
+    return e
+}
+
+// NormalizeQuery приводит адрес в поисковом запросе к той же форме,
+// в которой адреса хранятся, остальные запросы возвращает без изменений
+func NormalizeQuery(query string) string {
+    bare := strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(query), "["), "]")
+    if addr, err := netip.ParseAddr(bare); err == nil {
+        return addr.WithZone("").String()
+    }
+    return query
+}
+
+// ExportFamily определяет семейство сета при экспорте: из опций, а если
+// family не указан - по первому IP-адресу среди записей сета
+func ExportFamily(setOptions string, ips []string) string {
+    if family := parseOptions(setOptions)["family"]; family != "" {
+        return family
+    }
+    for _, ip := range ips {
+        if family := AddrFamily(ip); family != "" {
+            return family
+        }
+    }
+    return "inet"
+}
+
+// WithFamily добавляет family inet6 в опции сета, если его там нет: без него
+// ipset создаст сет IPv4
+func WithFamily(setOptions, family string) string {
+    if family != "inet6" {
+        return setOptions
+    }
+    if _, ok := parseOptions(setOptions)["family"]; ok {
+        return setOptions
+    }
+    return strings.TrimSpace("family inet6 " + setOptions)
+}
+
+// FormatEntry - элемент записи в синтаксисе ipset add: адрес с маской (маска
+// одиночного адреса семейства опускается), порт с протоколом и второй адрес
+// или интерфейс через запятую
+func FormatEntry(family string, e Entry) string {
+    entry := e.IP
+    if e.CIDR != "" && e.CIDR != "0" && e.CIDR != strconv.Itoa(DefaultPrefixLen(family)) {
+        entry += "/" + e.CIDR
+    }
+
+    if e.Port != 0 {
+        // У bitmap:port запись состоит только из порта
+        if entry != "" {
+            entry += ","
+        }
+        if e.Protocol != "" {
+            entry += e.Protocol + ":" + strconv.Itoa(e.Port)
+        } else {
+            entry += strconv.Itoa(e.Port)
+        }
+    }
+    if e.SecondIP != "" {
+        entry += "," + e.SecondIP
+    }
+    return entry
+}
+
+// EntryRange возвращает первый и последний адрес, которые покрывает запись
+// (ip и cidr). Для записей без IP-адреса (hash:mac, list:set, bitmap:port)
+// ok = false. CIDR "0" в старых записях означал отсутствие маски.
+func EntryRange(ip, cidr string) (first, last netip.Addr, ok bool) {
+    addr, err := netip.ParseAddr(ip)
+    if err != nil {
+        return netip.Addr{}, netip.Addr{}, false
+    }
+    addr = addr.WithZone("")
+
+    bits := addr.BitLen()
+    if cidr != "" && cidr != "0" {
+        n, err := strconv.Atoi(cidr)
+        if err != nil || n < 0 || n > bits {
+            return netip.Addr{}, netip.Addr{}, false
+        }
+        bits = n
+    }
+
+    first, last = PrefixRange(netip.PrefixFrom(addr, bits))
+    return first, last, true
+}
+
+// PrefixRange возвращает первый и последний адрес сети
+func PrefixRange(p netip.Prefix) (first, last netip.Addr) {
+    return p.Masked().Addr(), lastAddr(p)
+}
+
+// LookupPrefix разбирает адрес или сеть для поиска покрывающих записей:
+// 10.1.2.3, 10.1.0.0/16, 2001:db8::1, [2001:db8::1]. IPv4-mapped IPv6
+// (::ffff:10.1.2.3) ищется как IPv4.
+func LookupPrefix(value string) (netip.Prefix, error) {
+    value = strings.TrimSpace(value)
+    if value == "" {
+        return netip.Prefix{}, fieldErrorf("ip", "address or network is required")
+    }
+
+    var prefix netip.Prefix
+    if strings.Contains(value, "/") {
+        p, err := netip.ParsePrefix(strings.NewReplacer("[", "", "]", "").Replace(value))
+        if err != nil {
+            return netip.Prefix{}, fieldErrorf("ip", "%q is not a valid IP network", value)
+        }
+        prefix = p
+    } else {
+        addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(value, "["), "]"))
+        if err != nil {
+            return netip.Prefix{}, fieldErrorf("ip", "%q is not a valid IP address", value)
+        }
+        addr = addr.WithZone("")
+        prefix = netip.PrefixFrom(addr, addr.BitLen())
+    }
+
+    if addr := prefix.Addr(); addr.Is4In6() && prefix.Bits() >= 96 {
+        prefix = netip.PrefixFrom(addr.Unmap(), prefix.Bits()-96)
+    }
+    return prefix.Masked(), nil
+}
+
+// MaxTimeout - наибольший timeout записи, который принимает ipset, в секундах
+const MaxTimeout = 2147483
+
+// HasTimeout - создан ли сет с опцией timeout. Только в такие сеты ipset
+// принимает записи с timeout.
+func HasTimeout(setOptions string) bool {
+    _, ok := parseOptions(setOptions)["timeout"]
+    return ok
+}
+
+// EntryTimeout - timeout записи для ipset add: секунды до expiresAt,
+// округленные вверх, от 1 до MaxTimeout. Бессрочная запись получает 0 -
+// в ipset это запись без ограничения времени, а не timeout сета по
+// умолчанию. Уже истекшая запись получает 1, а не 0.
+func EntryTimeout(expiresAt *time.Time, now time.Time) int {
+    if expiresAt == nil {
+        return 0
+    }
+    left := expiresAt.Sub(now)
+    seconds := int(left / time.Second)
+    if left%time.Second > 0 {
+        seconds++
+    }
+    if seconds < 1 {
+        return 1
+    }
+    if seconds > MaxTimeout {
+        return MaxTimeout
+    }
+    return seconds
+}
@@ -0,0 +1,84 @@
+// Package validation проверяет записи ipset до сохранения: разбирает адреса
+// через net/netip и сверяет состав записи (адрес, сеть, порт, MAC, имя сета)
+// с типом сета. Пакет используется и сервером, и ipset-cli, поэтому не
+// зависит от остальных пакетов модуля.
+package validation
+
+import (
+    "sort"
+    "strings"
+)
+
+// DefaultSetType - тип сета, если он не указан
+const DefaultSetType = "hash:ip"
+
+// MaxSetNameLength - ограничение ipset на длину имени сета
+const MaxSetNameLength = 31
+
+type addrKind int
+
+const (
+    addrNone addrKind = iota
+    addrIP             // адрес; для IPv4 CIDR задает диапазон адресов
+    addrNet            // сеть: адрес и длина префикса
+    addrMAC            // MAC-адрес в поле ip
+    addrSet            // имя другого сета в поле ip (list:set)
+)
+
+// setTypeSpec - из чего состоит запись сета данного типа
+type setTypeSpec struct {
+    addr   addrKind
+    port   bool
+    second addrKind // третий компонент hash:ip,port,ip и hash:ip,port,net
+    bitmap bool     // bitmap:* - только IPv4, без family, с обязательным range
+}
+
+var setTypes = map[string]setTypeSpec{
+    "hash:ip":          {addr: addrIP},
+    "hash:net":         {addr: addrNet},
+    "hash:ip,port":     {addr: addrIP, port: true},
+    "hash:net,port":    {addr: addrNet, port: true},
+    "hash:ip,port,ip":  {addr: addrIP, port: true, second: addrIP},
+    "hash:ip,port,net": {addr: addrIP, port: true, second: addrNet},
+    "hash:mac":         {addr: addrMAC},
+    "bitmap:ip":        {addr: addrIP, bitmap: true},
+    "bitmap:port":      {port: true, bitmap: true},
+    "list:set":         {addr: addrSet},
+}
+
+// portProtocols - протоколы, допустимые в записях с портом. Пустой протокол
+// ipset трактует как tcp.
+var portProtocols = map[string]bool{
+    "tcp":     true,
+    "udp":     true,
+    "sctp":    true,
+    "udplite": true,
+}
+
+// SetTypes возвращает поддерживаемые типы сетов в алфавитном порядке
+func SetTypes() []string {
+    types := make([]string, 0, len(setTypes))
+    for t := range setTypes {
+        types = append(types, t)
+    }
+    sort.Strings(types)
+    return types
+}
+
+// KnownSetType сообщает, поддерживается ли тип сета
+func KnownSetType(setType string) bool {
+    _, ok := setTypes[setType]
+    return ok
+}
+
+func lookupSetType(setType string) (string, setTypeSpec, error) {
+    if setType == "" {
+        setType = DefaultSetType
+    }
+    spec, ok := setTypes[setType]
+    if !ok {
+        return setType, spec, fieldErrorf("set_type", "unknown set type %q (supported: %s)",
+            setType, strings.Join(SetTypes(), ", "))
+    }
+    return setType, spec, nil
+}
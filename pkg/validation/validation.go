@@ -0,0 +1,351 @@
+package validation
+
+import (
+    "fmt"
+    "net"
+    "net/netip"
+    "strconv"
+    "strings"
+)
+
+// FieldError - ошибка проверки с именем поля записи (как в JSON API)
+type FieldError struct {
+    Field   string
+    Message string
+}
+
+func (e *FieldError) Error() string {
+    return e.Field + ": " + e.Message
+}
+
+func fieldErrorf(field, format string, args ...interface{}) *FieldError {
+    return &FieldError{Field: field, Message: fmt.Sprintf(format, args...)}
+}
+
+// Entry - элемент сета в том виде, в каком он хранится в записи
+type Entry struct {
+    IP       string
+    CIDR     string
+    Port     int
+    Protocol string
+    SecondIP string
+}
+
+// ValidateRecord проверяет имя, тип и опции сета и саму запись
+func ValidateRecord(setName, setType, setOptions string, e Entry) error {
+    if err := ValidateSetName("set_name", setName); err != nil {
+        return err
+    }
+    if err := ValidateSet(setType, setOptions); err != nil {
+        return err
+    }
+    return ValidateEntry(setType, setOptions, e)
+}
+
+// ValidateSetName проверяет имя сета по правилам ipset; field - имя поля
+// для сообщения об ошибке
+func ValidateSetName(field, name string) error {
+    if name == "" {
+        return fieldErrorf(field, "set name is required")
+    }
+    if len(name) > MaxSetNameLength {
+        return fieldErrorf(field, "set name %q is longer than %d characters", name, MaxSetNameLength)
+    }
+    if strings.ContainsAny(name, " \t\r\n\"'") {
+        return fieldErrorf(field, "set name %q must not contain whitespace or quotes", name)
+    }
+    return nil
+}
+
+// ValidateSet проверяет тип сета и его опции (family, range)
+func ValidateSet(setType, setOptions string) error {
+    setType, spec, err := lookupSetType(setType)
+    if err != nil {
+        return err
+    }
+
+    opts := parseOptions(setOptions)
+    if family, ok := opts["family"]; ok {
+        if spec.bitmap || spec.addr == addrMAC || spec.addr == addrSet {
+            return fieldErrorf("set_options", "family is not supported by set type %s", setType)
+        }
+        if family != "inet" && family != "inet6" {
+            return fieldErrorf("set_options", "unknown family %q (use inet or inet6)", family)
+        }
+    }
+
+    if spec.bitmap {
+        value, ok := opts["range"]
+        if !ok {
+            return fieldErrorf("set_options", "set type %s requires the range option", setType)
+        }
+        if spec.port {
+            if _, _, err := parsePortRange(value); err != nil {
+                return fieldErrorf("set_options", "invalid range %q: %v", value, err)
+            }
+        } else if _, err := parseAddrRange(value); err != nil {
+            return fieldErrorf("set_options", "invalid range %q: %v", value, err)
+        }
+    }
+
+    return nil
+}
+
+// Family возвращает семейство адресов сета из опций (по умолчанию inet)
+func Family(setOptions string) string {
+    if family := parseOptions(setOptions)["family"]; family != "" {
+        return family
+    }
+    return "inet"
+}
+
+// ValidateEntry проверяет, что запись соответствует типу сета. Опции сета
+// должны быть предварительно проверены ValidateSet.
+func ValidateEntry(setType, setOptions string, e Entry) error {
+    setType, spec, err := lookupSetType(setType)
+    if err != nil {
+        return err
+    }
+    opts := parseOptions(setOptions)
+
+    switch spec.addr {
+    case addrNone:
+        if e.IP != "" {
+            return fieldErrorf("ip", "set type %s holds ports only, ip must be empty", setType)
+        }
+        if e.CIDR != "" {
+            return fieldErrorf("cidr", "not allowed for set type %s", setType)
+        }
+    case addrMAC:
+        mac, err := net.ParseMAC(e.IP)
+        if err != nil || len(mac) != 6 {
+            return fieldErrorf("ip", "%q is not a valid MAC address (set type %s stores the MAC in ip)", e.IP, setType)
+        }
+        if e.CIDR != "" {
+            return fieldErrorf("cidr", "not allowed for set type %s", setType)
+        }
+    case addrSet:
+        if err := ValidateSetName("ip", e.IP); err != nil {
+            return err
+        }
+        if e.CIDR != "" {
+            return fieldErrorf("cidr", "not allowed for set type %s", setType)
+        }
+    default:
+        prefix, err := entryPrefix(setType, spec, opts, e)
+        if err != nil {
+            return err
+        }
+        if spec.bitmap {
+            r, _ := parseAddrRange(opts["range"])
+            if !r.containsPrefix(prefix) {
+                return fieldErrorf("ip", "%s is outside the set range %s", prefix, opts["range"])
+            }
+        }
+    }
+
+    if err := validatePort(setType, spec, opts, e); err != nil {
+        return err
+    }
+
+    return validateSecond(setType, spec, e)
+}
+
+// entryPrefix разбирает ip и cidr записи в префикс и проверяет семейство
+func entryPrefix(setType string, spec setTypeSpec, opts map[string]string, e Entry) (netip.Prefix, error) {
+    if e.IP == "" {
+        return netip.Prefix{}, fieldErrorf("ip", "required for set type %s", setType)
+    }
+    if strings.Contains(e.IP, "/") {
+        return netip.Prefix{}, fieldErrorf("ip", "%q must be a bare address, put the prefix length into cidr", e.IP)
+    }
+
+    addr, err := netip.ParseAddr(e.IP)
+    if err != nil {
+        return netip.Prefix{}, fieldErrorf("ip", "%q is not a valid IP address", e.IP)
+    }
+    if addr.Zone() != "" {
+        return netip.Prefix{}, fieldErrorf("ip", "%q: zoned addresses are not supported", e.IP)
+    }
+
+    family := "inet"
+    if f := opts["family"]; f != "" {
+        family = f
+    }
+    switch {
+    case spec.bitmap && !addr.Is4():
+        return netip.Prefix{}, fieldErrorf("ip", "%s is not an IPv4 address (set type %s is IPv4 only)", e.IP, setType)
+    case family == "inet" && !addr.Is4():
+        return netip.Prefix{}, fieldErrorf("ip", "%s is not an IPv4 address (set family is inet)", e.IP)
+    case family == "inet6" && !addr.Is6():
+        return netip.Prefix{}, fieldErrorf("ip", "%s is not an IPv6 address (set family is inet6)", e.IP)
+    }
+
+    bits := addr.BitLen()
+    if e.CIDR == "" {
+        return netip.PrefixFrom(addr, bits), nil
+    }
+
+    cidr, err := strconv.Atoi(e.CIDR)
+    if err != nil || cidr < 1 || cidr > bits {
+        return netip.Prefix{}, fieldErrorf("cidr", "%q must be a prefix length between 1 and %d", e.CIDR, bits)
+    }
+    // hash:ip с IPv6 не принимает диапазоны, только отдельные адреса
+    if spec.addr == addrIP && addr.Is6() && cidr != bits {
+        return netip.Prefix{}, fieldErrorf("cidr", "set type %s does not support IPv6 ranges, use /%d", setType, bits)
+    }
+
+    return netip.PrefixFrom(addr, cidr), nil
+}
+
+func validatePort(setType string, spec setTypeSpec, opts map[string]string, e Entry) error {
+    if !spec.port {
+        if e.Port != 0 {
+            return fieldErrorf("port", "not allowed for set type %s", setType)
+        }
+        if e.Protocol != "" {
+            return fieldErrorf("protocol", "not allowed for set type %s", setType)
+        }
+        return nil
+    }
+
+    if e.Protocol != "" && !portProtocols[strings.ToLower(e.Protocol)] {
+        return fieldErrorf("protocol", "unsupported protocol %q (supported: tcp, udp, sctp, udplite)", e.Protocol)
+    }
+    if e.Port == 0 {
+        return fieldErrorf("port", "required for set type %s", setType)
+    }
+    if e.Port < 1 || e.Port > 65535 {
+        return fieldErrorf("port", "%d is out of range 1-65535", e.Port)
+    }
+
+    if spec.bitmap {
+        from, to, _ := parsePortRange(opts["range"])
+        if e.Port < from || e.Port > to {
+            return fieldErrorf("port", "%d is outside the set range %s", e.Port, opts["range"])
+        }
+    }
+
+    return nil
+}
+
+func validateSecond(setType string, spec setTypeSpec, e Entry) error {
+    if spec.second == addrNone {
+        if e.SecondIP != "" {
+            return fieldErrorf("second_ip", "not allowed for set type %s", setType)
+        }
+        return nil
+    }
+
+    if e.SecondIP == "" {
+        return fieldErrorf("second_ip", "required for set type %s", setType)
+    }
+
+    var prefix netip.Prefix
+    var err error
+    if spec.second == addrNet && strings.Contains(e.SecondIP, "/") {
+        prefix, err = netip.ParsePrefix(e.SecondIP)
+        if err == nil && prefix.Bits() == 0 {
+            return fieldErrorf("second_ip", "%q: prefix length must not be 0", e.SecondIP)
+        }
+    } else {
+        var addr netip.Addr
+        addr, err = netip.ParseAddr(e.SecondIP)
+        if err == nil {
+            prefix = netip.PrefixFrom(addr, addr.BitLen())
+        }
+    }
+    if err != nil || prefix.Addr().Zone() != "" {
+        if spec.second == addrNet {
+            return fieldErrorf("second_ip", "%q is not a valid IP address or network", e.SecondIP)
+        }
+        return fieldErrorf("second_ip", "%q is not a valid IP address", e.SecondIP)
+    }
+
+    if first, err := netip.ParseAddr(e.IP); err == nil && first.Is4() != prefix.Addr().Is4() {
+        return fieldErrorf("second_ip", "%s must be of the same address family as ip", e.SecondIP)
+    }
+
+    return nil
+}
+
+// parseOptions разбирает опции сета вида "family inet6 hashsize 1024"
+func parseOptions(setOptions string) map[string]string {
+    opts := make(map[string]string)
+    fields := strings.Fields(setOptions)
+    for i := 0; i < len(fields); i++ {
+        switch fields[i] {
+        case "family", "range", "hashsize", "maxelem", "netmask", "timeout", "size", "markmask":
+            if i+1 < len(fields) {
+                opts[fields[i]] = fields[i+1]
+                i++
+            }
+        default:
+            // Флаги без значения: counters, comment, skbinfo, forceadd, -exist
+            opts[fields[i]] = ""
+        }
+    }
+    return opts
+}
+
+// addrRange - диапазон адресов bitmap:ip
+type addrRange struct {
+    from, to netip.Addr
+}
+
+func (r addrRange) containsPrefix(p netip.Prefix) bool {
+    first := p.Masked().Addr()
+    last := lastAddr(p)
+    return r.from.Compare(first) <= 0 && last.Compare(r.to) <= 0
+}
+
+// parseAddrRange разбирает range в форме from-to или сети
+func parseAddrRange(value string) (addrRange, error) {
+    if from, to, ok := strings.Cut(value, "-"); ok {
+        a, err := netip.ParseAddr(from)
+        if err != nil || !a.Is4() {
+            return addrRange{}, fmt.Errorf("%q is not an IPv4 address", from)
+        }
+        b, err := netip.ParseAddr(to)
+        if err != nil || !b.Is4() {
+            return addrRange{}, fmt.Errorf("%q is not an IPv4 address", to)
+        }
+        if b.Less(a) {
+            return addrRange{}, fmt.Errorf("range end is before range start")
+        }
+        return addrRange{from: a, to: b}, nil
+    }
+
+    prefix, err := netip.ParsePrefix(value)
+    if err != nil || !prefix.Addr().Is4() {
+        return addrRange{}, fmt.Errorf("expected from-to or an IPv4 network")
+    }
+    return addrRange{from: prefix.Masked().Addr(), to: lastAddr(prefix)}, nil
+}
+
+// lastAddr возвращает последний адрес префикса
+func lastAddr(p netip.Prefix) netip.Addr {
+    a := p.Masked().Addr().AsSlice()
+    for i := p.Bits(); i < len(a)*8; i++ {
+        a[i/8] |= 1 << (7 - uint(i%8))
+    }
+    last, _ := netip.AddrFromSlice(a)
+    return last
+}
+
+// parsePortRange разбирает range bitmap:port в форме from-to
+func parsePortRange(value string) (int, int, error) {
+    from, to, ok := strings.Cut(value, "-")
+    if !ok {
+        return 0, 0, fmt.Errorf("expected fromport-toport")
+    }
+    a, err := strconv.Atoi(from)
+    if err != nil || a < 0 || a > 65535 {
+        return 0, 0, fmt.Errorf("%q is not a valid port", from)
+    }
+    b, err := strconv.Atoi(to)
+    if err != nil || b < a || b > 65535 {
+        return 0, 0, fmt.Errorf("%q is not a valid port", to)
+    }
+    return a, b, nil
+}